@@ -0,0 +1,256 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"ptra/utils"
+	"strconv"
+)
+
+// A synthetic cohort for trying out ptra without data, cf. WriteDemoData. The patients follow a number of known
+// disease progressions, with noise diagnoses in between, so that the trajectories and clusters that ptra finds can be
+// checked against the progressions the data was generated from.
+
+// demoCode is a diagnosis code of the demo vocabulary.
+type demoCode struct {
+	code, name string
+}
+
+// demoSection is a section of the demo vocabulary.
+type demoSection struct {
+	id, desc string
+	codes    []demoCode
+}
+
+// demoChapter is a chapter of the demo vocabulary.
+type demoChapter struct {
+	desc     string
+	sections []demoSection
+}
+
+// demoChapters is the vocabulary of the demo: a small part of ICD-10-CM, organized in chapters and sections as in the
+// ICD-10-CM tabular XML file.
+var demoChapters = []demoChapter{
+	{"Neoplasms (C00-D49)", []demoSection{
+		{"C30-C39", "Malignant neoplasms of respiratory and intrathoracic organs (C30-C39)",
+			[]demoCode{{"C34", "Malignant neoplasm of bronchus and lung"}}},
+		{"C64-C68", "Malignant neoplasms of urinary tract (C64-C68)",
+			[]demoCode{{"C67", "Malignant neoplasm of bladder"}}},
+	}},
+	{"Diseases of the blood and blood-forming organs and certain disorders involving the immune mechanism (D50-D89)",
+		[]demoSection{
+			{"D60-D64", "Aplastic and other anemias and other bone marrow failure syndromes (D60-D64)",
+				[]demoCode{{"D63", "Anemia in chronic diseases classified elsewhere"}}},
+		}},
+	{"Endocrine, nutritional and metabolic diseases (E00-E89)", []demoSection{
+		{"E08-E13", "Diabetes mellitus (E08-E13)", []demoCode{{"E11", "Type 2 diabetes mellitus"}}},
+		{"E65-E68", "Overweight, obesity and other hyperalimentation (E65-E68)",
+			[]demoCode{{"E66", "Overweight and obesity"}}},
+		{"E70-E88", "Metabolic disorders (E70-E88)",
+			[]demoCode{{"E78", "Disorders of lipoprotein metabolism and other lipidemias"}}},
+	}},
+	{"Mental, Behavioral and Neurodevelopmental disorders (F01-F99)", []demoSection{
+		{"F30-F39", "Mood [affective] disorders (F30-F39)",
+			[]demoCode{{"F32", "Major depressive disorder, single episode"}}},
+		{"F40-F48", "Anxiety, dissociative, stress-related, somatoform and other nonpsychotic mental disorders (F40-F48)",
+			[]demoCode{{"F41", "Other anxiety disorders"}}},
+	}},
+	{"Diseases of the nervous system (G00-G99)", []demoSection{
+		{"G40-G47", "Episodic and paroxysmal disorders (G40-G47)", []demoCode{{"G47", "Sleep disorders"}}},
+	}},
+	{"Diseases of the circulatory system (I00-I99)", []demoSection{
+		{"I10-I1A", "Hypertensive diseases (I10-I1A)", []demoCode{{"I10", "Essential (primary) hypertension"}}},
+		{"I20-I25", "Ischemic heart diseases (I20-I25)", []demoCode{{"I25", "Chronic ischemic heart disease"}}},
+		{"I30-I5A", "Other forms of heart disease (I30-I5A)",
+			[]demoCode{{"I48", "Atrial fibrillation and flutter"}, {"I50", "Heart failure"}}},
+	}},
+	{"Diseases of the respiratory system (J00-J99)", []demoSection{
+		{"J09-J18", "Influenza and pneumonia (J09-J18)", []demoCode{{"J18", "Pneumonia, unspecified organism"}}},
+		{"J40-J4A", "Chronic lower respiratory diseases (J40-J4A)",
+			[]demoCode{{"J44", "Other chronic obstructive pulmonary disease"}}},
+		{"J96-J99", "Other diseases of the respiratory system (J96-J99)",
+			[]demoCode{{"J96", "Respiratory failure, not elsewhere classified"}}},
+	}},
+	{"Diseases of the musculoskeletal system and connective tissue (M00-M99)", []demoSection{
+		{"M15-M19", "Osteoarthritis (M15-M19)", []demoCode{{"M17", "Osteoarthritis of knee"}}},
+		{"M80-M85", "Disorders of bone density and structure (M80-M85)",
+			[]demoCode{{"M81", "Osteoporosis without current pathological fracture"}}},
+	}},
+	{"Diseases of the genitourinary system (N00-N99)", []demoSection{
+		{"N17-N19", "Acute kidney failure and chronic kidney disease (N17-N19)",
+			[]demoCode{{"N18", "Chronic kidney disease (CKD)"}}},
+	}},
+}
+
+// DemoProgression is a disease progression that the patients of the demo cohort follow. A patient starts the
+// progression with probability Start, and continues to each next diagnosis with probability Next.
+type DemoProgression struct {
+	Codes       []string
+	Start, Next float64
+}
+
+// DemoProgressions are the disease progressions of the demo cohort.
+var DemoProgressions = []DemoProgression{
+	{Codes: []string{"E66", "E11", "N18", "D63"}, Start: 0.3, Next: 0.7},
+	{Codes: []string{"I10", "I25", "I50"}, Start: 0.35, Next: 0.6},
+	{Codes: []string{"J44", "J18", "J96"}, Start: 0.15, Next: 0.6},
+	{Codes: []string{"F41", "F32", "G47"}, Start: 0.2, Next: 0.6},
+	{Codes: []string{"M17", "M81"}, Start: 0.2, Next: 0.5},
+}
+
+// demoNoise are the codes of the diagnoses that are added at random, as noise, cf. demoNoiseDiagnoses.
+var demoNoise = []string{"E78", "I48", "C34", "C67", "J18", "G47", "F41", "M17"}
+
+const (
+	demoNoiseDiagnoses = 3    // the maximum number of noise diagnoses per patient
+	demoFirstYear      = 2000 // the first year of follow-up of the patients
+	demoLastYear       = 2022 // the last year of follow-up of the patients
+	demoDeathRate      = 0.1  // the fraction of the patients that die after their last diagnosis
+)
+
+// writeDemoVocabulary writes the demo vocabulary as an ICD-10-CM tabular XML file, cf. parseIcd10HierarchyFromXml.
+func writeDemoVocabulary(name string) error {
+	hierarchy := icd10Hierarchy{}
+	for _, c := range demoChapters {
+		chap := chapter{Desc: c.desc}
+		for _, s := range c.sections {
+			sec := section{Id: s.id, Desc: s.desc}
+			for _, code := range s.codes {
+				sec.Diagnoses = append(sec.Diagnoses, diag{Name: code.code, Desc: code.name})
+			}
+			chap.Sections = append(chap.Sections, sec)
+		}
+		hierarchy.Chapters = append(hierarchy.Chapters, chap)
+	}
+	content, err := xml.MarshalIndent(hierarchy, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append([]byte(xml.Header), append(content, '\n')...), 0644)
+}
+
+// demoDate returns a date in TriNetX format, YYYY-MM-DD, for a time in years.
+func demoDate(t float64) string {
+	year := int(t)
+	months := (t - float64(year)) * 12
+	return fmt.Sprintf("%04d-%02d-%02d", year, 1+int(months), 1+int((months-math.Floor(months))*28))
+}
+
+// WriteDemoData writes a synthetic cohort of nofPatients patients to a directory: a patient file, a diagnosis file,
+// and a vocabulary file in the formats of TriNetX and ICD-10-CM, cf. ParseTriNetXData. The patients follow the
+// DemoProgressions, with 1 to 3 years between consecutive diagnoses, and get up to demoNoiseDiagnoses random other
+// diagnoses. The cohort only depends on the seed. It returns the names of the files.
+func WriteDemoData(dir string, nofPatients int, seed int64) (patientFile, diagnosisFile, vocabularyFile string,
+	err error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", "", "", err
+	}
+	patientFile = filepath.Join(dir, "patient.csv")
+	diagnosisFile = filepath.Join(dir, "diagnosis.csv")
+	vocabularyFile = filepath.Join(dir, "icd10cm_demo.xml")
+	if err := writeDemoVocabulary(vocabularyFile); err != nil {
+		return "", "", "", err
+	}
+	patients, err := os.Create(patientFile)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer func() {
+		if cerr := patients.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	diagnoses, err := os.Create(diagnosisFile)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer func() {
+		if cerr := diagnoses.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	patientWriter, diagnosisWriter := csv.NewWriter(patients), csv.NewWriter(diagnoses)
+	r := utils.Rand().New(seed)
+	const missing = `\\000` // the TriNetX marker for a missing value
+	for i := 1; i <= nofPatients; i++ {
+		pid := strconv.Itoa(i)
+		sex := "M"
+		if r.Intn(2) == 0 {
+			sex = "F"
+		}
+		yob := 1930 + r.Intn(50)
+		start := float64(demoFirstYear) + r.Float64()*10
+		last := start
+		diagnose := func(code string, t float64) error {
+			if t >= demoLastYear {
+				return nil
+			}
+			last = max(last, t)
+			return diagnosisWriter.Write([]string{pid, missing, "ICD-10-CM", code, missing, missing, missing,
+				demoDate(t), missing, missing})
+		}
+		for _, p := range DemoProgressions {
+			if r.Float64() >= p.Start {
+				continue
+			}
+			t := start + r.Float64()*5
+			for k, code := range p.Codes {
+				if k > 0 {
+					if r.Float64() >= p.Next {
+						break
+					}
+					t += 1 + r.Float64()*2
+				}
+				if err := diagnose(code, t); err != nil {
+					return "", "", "", err
+				}
+			}
+		}
+		for k := r.Intn(demoNoiseDiagnoses + 1); k > 0; k-- {
+			code := demoNoise[r.Intn(len(demoNoise))]
+			if err := diagnose(code, start+r.Float64()*float64(demoLastYear-start)); err != nil {
+				return "", "", "", err
+			}
+		}
+		ageAtDeath, death := missing, missing
+		if r.Float64() < demoDeathRate {
+			year := int(last) + 1
+			if year < demoLastYear {
+				ageAtDeath = strconv.Itoa(year - yob)
+				death = fmt.Sprintf("%04d%02d", year, 1+r.Intn(12))
+			}
+		}
+		if err := patientWriter.Write([]string{pid, sex, missing, missing, strconv.Itoa(yob), ageAtDeath, missing,
+			missing, missing, missing, death, missing}); err != nil {
+			return "", "", "", err
+		}
+	}
+	patientWriter.Flush()
+	diagnosisWriter.Flush()
+	if err := patientWriter.Error(); err != nil {
+		return "", "", "", err
+	}
+	return patientFile, diagnosisFile, vocabularyFile, diagnosisWriter.Error()
+}
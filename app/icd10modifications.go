@@ -0,0 +1,164 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package app
+
+import (
+	"ptra/utils"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//National modifications of ICD10.
+//Many countries use a national modification of the WHO version of ICD10, e.g. ICD-10-CM in the USA, ICD-10-GM in
+//Germany, and ICD-10-AM in Australia. The modifications add extra, more detailed codes below the WHO codes, and
+//sometimes extra markers, but they keep the WHO codes of up to 4 characters (e.g. E11.6) as their base. The vocabulary
+//read from the ICD10 xml or CCSR file is ICD-10-CM. Codes from other modifications that are not in the vocabulary are
+//mapped onto the closest ancestor code that is, through their WHO base code.
+
+// icd10CodeSystems lists the code systems in the diagnoses file that are treated as ICD10. ICD-10-CM is the code system
+// of the vocabulary, the others are mapped onto it by an icd10CodeResolver.
+var icd10CodeSystems = map[string]bool{
+	"ICD-10-CM": true, // USA
+	"ICD-10-GM": true, // Germany
+	"ICD-10-AM": true, // Australia
+	"ICD-10-CA": true, // Canada
+	"ICD-10":    true, // WHO
+}
+
+// normalizeIcd10Code removes the markers that some ICD10 modifications add to codes, such as the dagger (+), asterisk
+// (*), and exclamation mark (!) of ICD-10-GM, and the diagnostic certainty (e.g. "G" for confirmed) that may be
+// appended after a space. It also adds the "." after the category if it is missing, e.g. E1190 becomes E11.90.
+func normalizeIcd10Code(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if i := strings.IndexByte(code, ' '); i >= 0 {
+		code = code[:i]
+	}
+	code = strings.TrimRightFunc(code, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(code) > 3 && !strings.Contains(code, ".") && isIcd10Category(code[:3]) {
+		code = code[:3] + "." + code[3:]
+	}
+	return code
+}
+
+// isIcd10Category checks if a code has the form of an ICD10 category: a letter followed by two digits, or a digit and a
+// letter, as in C7A of ICD-10-CM.
+func isIcd10Category(code string) bool {
+	return len(code) == 3 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= '0' && code[1] <= '9' &&
+		(code[2] >= '0' && code[2] <= '9' || code[2] >= 'A' && code[2] <= 'Z')
+}
+
+// Icd10WHOBaseCode returns the WHO base code of an ICD10 code of any modification, i.e. its category and at most one
+// character of its subcategory. E.g. the ICD-10-CM code E11.65 and the ICD-10-GM code E11.60 both have E11.6 as WHO
+// base code. Codes that are not ICD10 codes are returned normalized but otherwise unchanged.
+func Icd10WHOBaseCode(code string) string {
+	code = normalizeIcd10Code(code)
+	if len(code) > 5 && code[3] == '.' && isIcd10Category(code[:3]) {
+		return code[:5]
+	}
+	return code
+}
+
+// icd10Ancestors returns the ancestors of an ICD10 code, from the closest to the category, by dropping the characters
+// after the "." one by one. E.g. the ancestors of E11.659 are E11.65, E11.6 and E11.
+func icd10Ancestors(code string) []string {
+	if len(code) <= 3 || code[3] != '.' || !isIcd10Category(code[:3]) {
+		return nil
+	}
+	ancestors := []string{}
+	for i := len(code) - 1; i > 4; i-- {
+		ancestors = append(ancestors, code[:i])
+	}
+	return append(ancestors, code[:3])
+}
+
+// icd10CodeResolver maps ICD10 codes from the diagnoses file onto codes of the vocabulary.
+type icd10CodeResolver struct {
+	codes     map[string]string // maps codes of the vocabulary, and their unambiguous ancestors, onto a code of the vocabulary
+	baseCodes bool              // map all codes onto their WHO base code first, cf. Icd10WHOBaseCode
+	resolved  map[string]int    // counts the diagnoses per code system that are mapped onto another code
+}
+
+// newIcd10CodeResolver creates a resolver for a vocabulary, given as a map from each code onto a key that identifies the
+// analysis DIDs it maps onto. An ancestor of codes of the vocabulary that is not itself in the vocabulary resolves to
+// one of its descendants, but only if all of its descendants map onto the same analysis DIDs, i.e. if the analysis
+// level is coarse enough so that it does not matter which descendant is chosen.
+func newIcd10CodeResolver(vocabulary map[string]string, baseCodes bool) *icd10CodeResolver {
+	codes := map[string]string{}
+	keys := map[string]string{}
+	ambiguous := map[string]bool{}
+	sorted := make([]string, 0, len(vocabulary))
+	for code := range vocabulary {
+		sorted = append(sorted, code)
+	}
+	sort.Strings(sorted) // choose the same descendant in each run
+	for _, code := range sorted {
+		codes[code] = code
+		for _, ancestor := range icd10Ancestors(code) {
+			if _, ok := vocabulary[ancestor]; ok || ambiguous[ancestor] {
+				continue
+			}
+			if key, ok := keys[ancestor]; !ok {
+				keys[ancestor] = vocabulary[code]
+				codes[ancestor] = code
+			} else if key != vocabulary[code] {
+				ambiguous[ancestor] = true
+				delete(codes, ancestor)
+			}
+		}
+	}
+	return &icd10CodeResolver{codes: codes, baseCodes: baseCodes, resolved: map[string]int{}}
+}
+
+// resolve maps an ICD10 code of the given code system onto a code of the vocabulary. ICD-10-CM codes are looked up as
+// they are, unless all codes are mapped onto their WHO base codes. Other codes are mapped onto the closest ancestor
+// that resolves. It returns false if the code cannot be resolved.
+func (resolver *icd10CodeResolver) resolve(codeSystem, code string) (string, bool) {
+	if codeSystem == "ICD-10-CM" && !resolver.baseCodes {
+		resolved, ok := resolver.codes[code]
+		return code, ok && resolved == code
+	}
+	normalized := normalizeIcd10Code(code)
+	if resolver.baseCodes {
+		normalized = Icd10WHOBaseCode(normalized)
+	}
+	for _, c := range append([]string{normalized}, icd10Ancestors(normalized)...) {
+		if resolved, ok := resolver.codes[c]; ok {
+			if resolved != code {
+				resolver.resolved[codeSystem]++
+			}
+			return resolved, true
+		}
+	}
+	return code, false
+}
+
+// printIcd10CodeResolverSummary prints how many diagnoses of each code system were mapped onto another code of the
+// vocabulary.
+func printIcd10CodeResolverSummary(resolver *icd10CodeResolver) {
+	systems := []string{}
+	for system := range resolver.resolved {
+		systems = append(systems, system)
+	}
+	sort.Strings(systems)
+	for _, system := range systems {
+		utils.Info("Mapped ", resolver.resolved[system], " ", system, " diagnoses onto ICD-10-CM codes of the vocabulary.")
+	}
+}
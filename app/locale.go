@@ -0,0 +1,91 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Localized descriptions of the diagnoses, for outputs that are shared with non-English-speaking clinical boards.
+
+// ReadDescriptions reads localized descriptions of codes from a csv file with the header Code,Description, e.g. a
+// translation of the vocabulary. A code can only have one description.
+func ReadDescriptions(name string) (map[string]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(header) != 2 || strings.TrimSpace(header[0]) != "Code" || strings.TrimSpace(header[1]) != "Description" {
+		return nil, fmt.Errorf("%s: the header must be Code,Description", name)
+	}
+	descriptions := map[string]string{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		code, description := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if code == "" {
+			return nil, fmt.Errorf("%s, line %d: empty code", name, line)
+		}
+		if d, ok := descriptions[code]; ok && d != description {
+			return nil, fmt.Errorf("%s, line %d: code %s has two descriptions, %s and %s", name, line, code, d,
+				description)
+		}
+		descriptions[code] = description
+	}
+	return descriptions, nil
+}
+
+// LocalizeNames replaces the medical names of the diagnoses with their localized descriptions, cf. ReadDescriptions,
+// and updates their paths in the hierarchy accordingly, as ResolveNames does. The codes are the original codes of the
+// diagnoses in idMap. Diagnoses without a description, or with an empty one, keep their name. It returns the number of
+// names that were replaced.
+func LocalizeNames(descriptions map[string]string, nameMap, idMap map[int]string, hierarchy map[int][]string) int {
+	localized := 0
+	for did, code := range idMap {
+		description := descriptions[code]
+		if description == "" {
+			continue
+		}
+		name := nameMap[did]
+		nameMap[did] = description
+		if path := hierarchy[did]; len(path) > 0 && path[len(path)-1] == name {
+			path[len(path)-1] = description
+		}
+		localized++
+	}
+	return localized
+}
@@ -25,9 +25,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
 	"os"
-	"path/filepath"
 	"ptra/trajectory"
 	"ptra/utils"
 	"sort"
@@ -85,7 +83,7 @@ type icd10Hierarchy struct {
 
 // parseIcd10HierarchyFromXML parses the xml file with the ICD10 hierarchy into an icd10Hierarchy object.
 func parseIcd10HierarchyFromXml(file string) icd10Hierarchy {
-	fmt.Println("Parsing ICD10 code hierarchy from XML file: ", file)
+	utils.Info("Parsing ICD10 code hierarchy from XML file: ", file)
 	//open file
 	xmlFile, err := os.Open(file)
 	if err != nil {
@@ -101,56 +99,56 @@ func parseIcd10HierarchyFromXml(file string) icd10Hierarchy {
 
 // printIcd10Hierarchy prints an ICD10 hierarchy parsed from an XML file.
 func printIcd10Hierarchy(hierarchy icd10Hierarchy) {
-	fmt.Println("Printing ICD10 code hierarchy.")
+	utils.Info("Printing ICD10 code hierarchy.")
 	// count # DID per level
 	ctr1, ctr2, ctr3, ctr4, ctr5, ctr6, ctr7 := 0, 0, 0, 0, 0, 0, 0
 	for _, chap := range hierarchy.Chapters {
 		// level 1
 		ctr1++
-		fmt.Println("Chapter: ", chap.Desc)
+		utils.Info("Chapter: ", chap.Desc)
 		for _, section := range chap.Sections {
 			// level 2
 			ctr2++
-			fmt.Println("Section: ", section.Desc)
+			utils.Info("Section: ", section.Desc)
 			for _, diag := range section.Diagnoses {
 				// level 3
 				ctr3++
-				fmt.Println(diag.Name, " : ", diag.Desc)
+				utils.Info(diag.Name, " : ", diag.Desc)
 				if len(diag.Diagnoses) == 0 {
 					continue
 				}
 				for _, diag := range diag.Diagnoses {
 					// level 4
 					ctr4++
-					fmt.Println(diag.Name, " : ", diag.Desc)
+					utils.Info(diag.Name, " : ", diag.Desc)
 					if len(diag.Diagnoses) == 0 {
 						continue
 					}
 					for _, diag := range diag.Diagnoses {
 						// level 5
 						ctr5++
-						fmt.Println(diag.Name, " : ", diag.Desc)
+						utils.Info(diag.Name, " : ", diag.Desc)
 						if len(diag.Diagnoses) == 0 {
 							continue
 						}
 						for _, diag := range diag.Diagnoses {
 							// level 6
 							ctr6++
-							fmt.Println(diag.Name, " : ", diag.Desc)
+							utils.Info(diag.Name, " : ", diag.Desc)
 							if len(diag.Diagnoses) == 0 {
 								continue
 							}
 							// level 7
 							ctr7++
-							fmt.Println(diag.Name, " : ", diag.Desc)
+							utils.Info(diag.Name, " : ", diag.Desc)
 						}
 					}
 				}
 			}
 		}
 	}
-	fmt.Println("#ICD10 codes/descriptors per level: ")
-	fmt.Println("Lvl 0: ", ctr1, " Lvl 1: ", ctr2, " Lvl 2: ",
+	utils.Info("#ICD10 codes/descriptors per level: ")
+	utils.Info("Lvl 0: ", ctr1, " Lvl 1: ", ctr2, " Lvl 2: ",
 		ctr3, " Lvl 3: ", ctr4, " Lvl 4: ", ctr5, " Lvl 5: ", ctr6, " Lvl 6: ", ctr7)
 }
 
@@ -177,9 +175,9 @@ func selectParentCategory(name icd10Name) string {
 }
 
 func printIcd10NameMap(table map[string]icd10Name) {
-	fmt.Println("ICD10 Name map: ")
+	utils.Info("ICD10 Name map: ")
 	for id, name := range table {
-		fmt.Println(id, " : ", name)
+		utils.Info(id, " : ", name)
 	}
 }
 
@@ -285,23 +283,31 @@ func getNonICD10CodesToAddToAnalysis() map[string]string {
 // initializeIcd10AnalysisIDMap creates a map ICD10 DID -> analysis DID and a map analysis ID -> medical name. This is
 // useful to remap diagnosis codes used in the input to a higher level in the ICD10 hierarchy. E.g "typhoid fever" and
 // "cholera" are both "infectuous intestinal diseases", so they could both be identified as such during the analysis.
-// This can be interesting to obtain more global patient trajectories/clusters.
-func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int) (map[string]int, map[int]string, int) {
+// This can be interesting to obtain more global patient trajectories/clusters. It also returns a map analysis ID -> the
+// path of ICD10 categories from the chapter down to the medical name, for computing semantic similarities.
+func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int) (map[string]int, map[int]string,
+	map[int][]string, int) {
 	analysisIdMap := map[string]int{}                     // maps icd 10 code to analysis ID
 	analysisNameMap := map[int]string{}                   // maps analysis ID to a medical name
+	analysisHierarchy := map[int][]string{}               // maps analysis ID to its path in the ICD10 hierarchy
 	nameToAnalysisIdMap := map[string]int{}               // maps medical name to analysis ID
 	ctr := 0                                              //serves as analysis ID generator
 	icd10ToExclude := getIcd10DescToExcludeFromAnalysis() // a list of level 0 categories to exclude from analysis
-	for icd10Code, icd10Name := range icd10NameMap {
+	// number the names in the same order in each run
+	for _, icd10Code := range utils.SortedKeys(icd10NameMap) {
+		icd10Name := icd10NameMap[icd10Code]
 		if _, ok := icd10ToExclude[icd10Name.categories[0]]; ok {
 			// code to exclude from analysis
 			continue
 		}
 		var name string
+		var path []string
 		if level == icd10Name.level || level > icd10Name.level {
 			name = icd10Name.name
+			path = append(append([]string{}, icd10Name.categories[:icd10Name.level]...), name)
 		} else {
 			name = icd10Name.categories[level]
+			path = append([]string{}, icd10Name.categories[:level+1]...)
 		}
 		// may already have seen name, because of level
 		newID, ok := nameToAnalysisIdMap[name]
@@ -310,18 +316,20 @@ func intializeIcd10AnalysisMaps(icd10NameMap map[string]icd10Name, level int) (m
 			ctr++
 			analysisNameMap[newID] = name
 			nameToAnalysisIdMap[name] = newID
+			analysisHierarchy[newID] = path
 		}
 		analysisIdMap[icd10Code] = newID
 	}
 	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
+	for _, code := range utils.SortedKeys(extra) {
+		name := extra[code]
 		analysisNameMap[ctr] = name
 		nameToAnalysisIdMap[name] = ctr
 		analysisIdMap[code] = ctr
 		ctr++
 	}
-	fmt.Println("Mapped ", len(icd10NameMap), " ICD10 codes to ", ctr, " analysis IDs of level ", level)
-	return analysisIdMap, analysisNameMap, ctr
+	utils.Info("Mapped ", len(icd10NameMap), " ICD10 codes to ", ctr, " analysis IDs of level ", level)
+	return analysisIdMap, analysisNameMap, analysisHierarchy, ctr
 }
 
 // ccsrCategory is a struct for containing CCSR categories, encoding medically meaningful names for a DID in ICD10
@@ -345,6 +353,8 @@ func ccsrIcd10ToProperIcd10(code string) string {
 func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 	//map to collect data
 	icd10ToCCSRTable := map[string]ccsrCategory{}
+	// the category IDs and names are repeated for many ICD10 codes
+	interner := utils.NewInterner()
 	//open file
 	csvFile, err := os.Open(file)
 	if err != nil {
@@ -373,11 +383,12 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 			panic(err)
 		}
 		//create CSSR category, set default category
-		category := ccsrCategory{name: record[2], id: record[3], categories: map[string]string{}}
+		category := ccsrCategory{name: interner.Intern(record[2]), id: interner.Intern(record[3]),
+			categories: map[string]string{}}
 		//fill in unique CSSR alternative categories, up to 6 possible
 		for i := 6; i <= 17; i = i + 2 {
-			catID := record[i]
-			catName := record[i+1]
+			catID := interner.Intern(record[i])
+			catName := interner.Intern(record[i+1])
 			if catName == "" || catID == "' '" {
 				continue
 			}
@@ -394,11 +405,11 @@ func initializeIcd10ToCCSRMap(file string) map[string]ccsrCategory {
 
 // printIcd10ToCSSRTable is a simple function to print the map from iCD10 code to ccsr category. Useful for debugging.
 func printIcd10ToCCSRTable(tab map[string]ccsrCategory) {
-	fmt.Println("ICD10 to CCSR table")
+	utils.Info("ICD10 to CCSR table")
 	ctr := 0
 	for icd10Code, ccsr := range tab {
 		ctr++
-		fmt.Println(icd10Code, " : ", ccsr.categories)
+		utils.Info(icd10Code, " : ", ccsr.categories)
 		if ctr >= 1000 {
 			return
 		}
@@ -407,25 +418,35 @@ func printIcd10ToCCSRTable(tab map[string]ccsrCategory) {
 
 // initializeIcd10AnalysisMapsCCSR creates a map ICD10 DID -> [analysis DID] and a map analysis ID -> medical name,
 // starting from a CCSR mapping, which maps ICD10 codes onto medical meaningful categories.
-// Each icd10 code can be mapped to multiple ccsr categories, and therefore to multiple analysis IDs.
+// Each icd10 code can be mapped to multiple ccsr categories, and therefore to multiple analysis IDs. It also returns a
+// map analysis ID -> the path body system, ccsr category in the CCSR hierarchy, where the body system is the prefix of
+// the CCSR ID, e.g. END for END002.
 // TO DO: exclude specific ICD10 codes from the analysis.
-func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (map[string][]int, map[int]string, int) {
-	analysisIdMap := map[string][]int{} // maps icd 10 code to analysis IDs
-	analysisNameMap := map[int]string{} // maps analysis ID to a medical name
+func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (map[string][]int, map[int]string,
+	map[int][]string, int) {
+	analysisIdMap := map[string][]int{}     // maps icd 10 code to analysis IDs
+	analysisNameMap := map[int]string{}     // maps analysis ID to a medical name
+	analysisHierarchy := map[int][]string{} // maps analysis ID to its path in the CCSR hierarchy
 	ccsrIDMap := map[string]int{}
 	ctr := 0 //serves as analysis ID generator
 	icd10ToExclude := getIcd10CodesToExcludeFromAnalysis()
-	for icd10Code, ccsr := range icd10ToCssrMap {
+	// number the categories in the same order in each run
+	for _, icd10Code := range utils.SortedKeys(icd10ToCssrMap) {
+		ccsr := icd10ToCssrMap[icd10Code]
 		if _, ok := icd10ToExclude[icd10Code[0:1]]; ok {
 			continue
 		}
 		ids := []int{}
-		for id, name := range ccsr.categories {
+		for _, id := range utils.SortedKeys(ccsr.categories) {
+			name := ccsr.categories[id]
 			var ccsrID int
 			var ok bool
 			if ccsrID, ok = ccsrIDMap[id]; !ok {
 				ccsrID = ctr
 				analysisNameMap[ctr] = name
+				if len(id) > 3 {
+					analysisHierarchy[ctr] = []string{id[:3], name}
+				}
 				ccsrIDMap[id] = ccsrID
 				ctr++
 			}
@@ -434,25 +455,28 @@ func initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap map[string]ccsrCategory) (ma
 		analysisIdMap[icd10Code] = ids
 	}
 	extra := getNonICD10CodesToAddToAnalysis()
-	for code, name := range extra {
+	for _, code := range utils.SortedKeys(extra) {
+		name := extra[code]
 		analysisNameMap[ctr] = name
 		analysisIdMap[code] = []int{ctr}
 		ctr++
 	}
-	fmt.Println("Mapped ", len(icd10ToCssrMap), " ICD10 codes to ", ctr, " analysis IDs")
-	return analysisIdMap, analysisNameMap, ctr
+	utils.Info("Mapped ", len(icd10ToCssrMap), " ICD10 codes to ", ctr, " analysis IDs")
+	return analysisIdMap, analysisNameMap, analysisHierarchy, ctr
 }
 
 type icd10AnalysisMapsFromCCSR struct {
 	NameMap           map[int]string   // map analysis DID -> medical name
 	NofDiagnosisCodes int              // nr of different diagnosis codes
 	DIDMap            map[string][]int // maps ICD10 Code onto multiple DIDs
+	Hierarchy         map[int][]string // map analysis DID -> path in the CCSR hierarchy
 }
 
 type icd10AnalysisMapsFromXML struct {
-	NameMap           map[int]string // map analysis DID -> medical name
-	NofDiagnosisCodes int            // nr of different diagnosis codes
-	DIDMap            map[string]int // map ICD10 Code -> DID
+	NameMap           map[int]string   // map analysis DID -> medical name
+	NofDiagnosisCodes int              // nr of different diagnosis codes
+	DIDMap            map[string]int   // map ICD10 Code -> DID
+	Hierarchy         map[int][]string // map analysis DID -> path in the ICD10 hierarchy
 }
 
 func (analysisMap icd10AnalysisMapsFromXML) getDID(icd10DID string) int {
@@ -490,33 +514,74 @@ func (analysisMap icd10AnalysisMapsFromCCSR) GetICDCode(did int) string {
 	return ""
 }
 
+// getIdMap maps each analysis DID onto an ICD10 code that is mapped onto it. When several codes are mapped onto the
+// same DID, the first code in sorted order is used, so that the same code is used in each run.
 func (analysisMap icd10AnalysisMapsFromXML) getIdMap() map[int]string {
 	res := map[int]string{}
-	for icd10Code, didCode := range analysisMap.DIDMap {
-		res[didCode] = icd10Code
+	for _, icd10Code := range utils.SortedKeys(analysisMap.DIDMap) {
+		didCode := analysisMap.DIDMap[icd10Code]
+		if _, ok := res[didCode]; !ok {
+			res[didCode] = icd10Code
+		}
 	}
 	return res
 }
 
+// getIdMap maps each analysis DID onto an ICD10 code that is mapped onto it, cf.
+// icd10AnalysisMapsFromXML.getIdMap.
 func (analysisMap icd10AnalysisMapsFromCCSR) getIdMap() map[int]string {
 	res := map[int]string{}
-	for icd10Code, didCodes := range analysisMap.DIDMap {
-		for _, didCode := range didCodes {
-			res[didCode] = icd10Code
+	for _, icd10Code := range utils.SortedKeys(analysisMap.DIDMap) {
+		for _, didCode := range analysisMap.DIDMap[icd10Code] {
+			if _, ok := res[didCode]; !ok {
+				res[didCode] = icd10Code
+			}
 		}
 	}
 	return res
 }
 
+func (analysisMap icd10AnalysisMapsFromXML) getCodeKeys() map[string]string {
+	res := map[string]string{}
+	for icd10Code, didCode := range analysisMap.DIDMap {
+		res[icd10Code] = strconv.Itoa(didCode)
+	}
+	return res
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) getCodeKeys() map[string]string {
+	res := map[string]string{}
+	for icd10Code, didCodes := range analysisMap.DIDMap {
+		res[icd10Code] = fmt.Sprint(didCodes)
+	}
+	return res
+}
+
+func (analysisMap icd10AnalysisMapsFromXML) getCodeDIDs() map[string][]int {
+	res := map[string][]int{}
+	for icd10Code, didCode := range analysisMap.DIDMap {
+		res[icd10Code] = []int{didCode}
+	}
+	return res
+}
+
+func (analysisMap icd10AnalysisMapsFromCCSR) getCodeDIDs() map[string][]int {
+	return analysisMap.DIDMap
+}
+
 // AnalysisMaps represent maps extracted from the input that map analysis IDs onto medical terms and vice versa. This is
 // an interface that defines several methods. getICDCode returns for a did the original id in the input for the
 // diagnostic event. fillInPatientDiagnoses creates for a given diagnosis identifier from the input a Diagnosis object
-// and adds it to a patient's list of diagnoses.
+// and adds it to a patient's list of diagnoses. getCodeKeys returns for each ICD10 code a key that identifies the
+// analysis DIDs it maps onto, for resolving the codes of other ICD10 modifications, cf. newIcd10CodeResolver.
+// getCodeDIDs returns for each ICD10 code the analysis DIDs it maps onto, cf. trajectory.DiagnosisValidity.
 type AnalysisMaps interface {
 	fillInPatientDiagnoses(patient *trajectory.Patient, DidString string, date trajectory.DiagnosisDate) int
 	fillInNonICDPatientDiagnoses(patient *trajectory.Patient, infoMap map[string]*TreatmentInfo) int
 	GetICDCode(did int) string
 	getIdMap() map[int]string
+	getCodeKeys() map[string]string
+	getCodeDIDs() map[string][]int
 }
 
 func (analysisMap icd10AnalysisMapsFromXML) fillInPatientDiagnoses(patient *trajectory.Patient, DIDString string, date trajectory.DiagnosisDate) int {
@@ -598,68 +663,72 @@ func (analysisMap icd10AnalysisMapsFromCCSR) fillInNonICDPatientDiagnoses(patien
 // medical name for an ICD10 Hierarchy passed as xml file and a requested hierarchy level.
 func initializeIcd10AnalysisMapsFromXML(file string, level int) icd10AnalysisMapsFromXML {
 	icd10NameMapFromXml := initializeIcd10NameMap(file) // map ICD10 DID -> ICD 10 Name (medical desc, categories, level)
-	analysisIdMap, analysisNameMap, ctr := intializeIcd10AnalysisMaps(icd10NameMapFromXml, level)
-	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+	analysisIdMap, analysisNameMap, analysisHierarchy, ctr := intializeIcd10AnalysisMaps(icd10NameMapFromXml, level)
+	return icd10AnalysisMapsFromXML{DIDMap: analysisIdMap, NameMap: analysisNameMap, Hierarchy: analysisHierarchy,
+		NofDiagnosisCodes: ctr}
 }
 
 // initializeIcd10AnalysisMapsFromCCSR returns a map ICD10 -> []{internal analysis DID} and map analysis DID -> medical
 // name for ICD10 CCSR categorization passed as a csv file.
 func initializeIcd10AnalysisMapsFromCCSR(file string) icd10AnalysisMapsFromCCSR {
 	icd10ToCssrMap := initializeIcd10ToCCSRMap(file) // map ICD10 Code -> CCSR Name
-	analysisIdMap, analysisNameMap, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap)
-	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, NameMap: analysisNameMap, NofDiagnosisCodes: ctr}
+	analysisIdMap, analysisNameMap, analysisHierarchy, ctr := initializeIcd10AnalysisMapsCCSR(icd10ToCssrMap)
+	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, NameMap: analysisNameMap, Hierarchy: analysisHierarchy,
+		NofDiagnosisCodes: ctr}
 }
 
 //Parsing patient information.
 
+// splitInputFiles splits a comma-separated list of input files, such as yearly extracts of the same database.
+func splitInputFiles(files string) []string {
+	result := []string{}
+	for _, file := range strings.Split(files, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
 // parseTriNetXPatientData parses a file with patient information from the TriNetX database. Input: a patient file in csv
 // format, a desired number of age groups to initialize cohorts. Diagnoses of the patient need to be filled in after
-// parsing the diagnoses file.
+// parsing the diagnoses file. The file can also be a comma-separated list of files, e.g. yearly extracts, cf.
+// splitInputFiles. A patient ID that occurs more than once is merged into one patient: the first record with a year of
+// birth and a sex is kept, and a date of death is taken from a later record if the first one has none. The merge
+// counts are printed. Patients without a record with a year of birth and a sex of M or F are recorded as exclusions.
+// The files are parsed concurrently, cf. readCSVFiles.
 func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.PatientMap, int) {
-	//open file
-	csvFile, err := os.Open(file)
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := csvFile.Close(); err != nil {
-			panic(err)
-		}
-	}()
 	patientMap := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{}, PIDStringMap: map[string]int{}}
 	maxYOB := 1850
 	minYOB := 2021
 	deathCr := 0
 	regions := map[string]int{} //counts per region
 	regionIds := map[string]int{}
-	//parse file
-	reader := csv.NewReader(csvFile)
+	missing := map[string][2]string{} // patients without year of birth or sex, excluded unless another record has them
+	mergedCtr, conflictCtr := 0, 0
+	files := splitInputFiles(file)
 	//the header is omitted from the TriNetX file, but is should be: patient_id, sex, race, ethnicity, year_of_birth,
 	//age_at_death, patient_regional_location, postal_code, marital_status, reason_yob_missing, month_year_death,
 	//source_id
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		var yob int
-		if yob, err = strconv.Atoi(record[4]); err != nil {
-			continue //skip patients without year of birth
-		}
-		pidString := record[0]
-		patientMap.Ctr++      // avoid using 0 as PID
-		pid := patientMap.Ctr //analysis ID
-		var sex int
-		if record[1] == "M" {
-			sex = trajectory.Male
-			patientMap.MaleCtr++
+	readCSVFiles("Parsing patient files", files, func(record []string) {
+		yob, err := strconv.Atoi(record[4])
+		if err != nil || (record[1] != "M" && record[1] != "F") {
+			//skip patients without year of birth or sex
+			if _, ok := patientMap.PIDStringMap[record[0]]; ok {
+				mergedCtr++
+			} else if _, ok := missing[record[0]]; !ok {
+				reason, detail := trajectory.ExcludedMissingBirthYear, record[4]
+				if err == nil {
+					reason, detail = trajectory.ExcludedMissingSex, record[1]
+				}
+				missing[strings.Clone(record[0])] = [2]string{reason, detail}
+			}
+			return
 		}
+		pidString := strings.Clone(record[0]) // do not keep the complete record alive
+		sex := trajectory.Male
 		if record[1] == "F" {
 			sex = trajectory.Female
-			patientMap.FemaleCtr++
 		}
 		dateOfDeathString := record[10]
 		var dateOfDeath *trajectory.DiagnosisDate
@@ -668,7 +737,6 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 			if err == nil {
 				month, err := strconv.Atoi(dateOfDeathString[4:6])
 				if err == nil {
-					deathCr++
 					dateOfDeath = &trajectory.DiagnosisDate{
 						Year:  year,
 						Month: month,
@@ -677,6 +745,30 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 				}
 			}
 		}
+		if existing, ok := trajectory.GetPatient(pidString, patientMap); ok {
+			// the same patient in another record, e.g. in a later extract
+			mergedCtr++
+			if existing.YOB != yob || existing.Sex != sex {
+				conflictCtr++
+			}
+			if existing.DeathDate == nil && dateOfDeath != nil {
+				existing.DeathDate = dateOfDeath
+				deathCr++
+			}
+			return
+		}
+		delete(missing, pidString)
+		patientMap.Ctr++      // avoid using 0 as PID
+		pid := patientMap.Ctr //analysis ID
+		if record[1] == "M" {
+			patientMap.MaleCtr++
+		}
+		if record[1] == "F" {
+			patientMap.FemaleCtr++
+		}
+		if dateOfDeath != nil {
+			deathCr++
+		}
 		region := record[6]
 		if _, ok := regions[region]; !ok {
 			regions[region] = 0
@@ -696,28 +788,39 @@ func parseTriNetXPatientData(file string, nofCohortAges int) (*trajectory.Patien
 		}
 		patientMap.PIDMap[pid] = &patient
 		patientMap.PIDStringMap[pidString] = pid
-		maxYOB = utils.MaxInt(yob, maxYOB)
-		minYOB = utils.MinInt(yob, minYOB)
+		maxYOB = utils.Max(yob, maxYOB)
+		minYOB = utils.Min(yob, minYOB)
+	})
+	pidStrings := []string{}
+	for pidString := range missing {
+		pidStrings = append(pidStrings, pidString)
+	}
+	sort.Strings(pidStrings)
+	for _, pidString := range pidStrings {
+		trajectory.ExcludePatient(patientMap, pidString, missing[pidString][0], missing[pidString][1])
 	}
 	// initialize patient age groups
-	ageRange := float64(maxYOB-minYOB) / float64(nofCohortAges)
-	ageRange = math.Ceil(ageRange)
-	if nofCohortAges > 1 {
-		for _, p := range patientMap.PIDMap {
-			p.CohortAge = int(math.Floor(float64(p.YOB-minYOB) / float64(ageRange)))
-		}
+	trajectory.AssignCohortAges(patientMap, nofCohortAges)
+	utils.Info("Parsed patient data.")
+	utils.Info("Parsed ", patientMap.Ctr, " patients with year of birth known of which ", patientMap.FemaleCtr,
+		" females and ", patientMap.MaleCtr, " males; and of which ", deathCr, " have a known date of death.")
+	if mergedCtr > 0 {
+		utils.Info("Merged ", mergedCtr, " duplicate patient records from ", len(files), " patient files, of which ",
+			conflictCtr, " with a different sex or year of birth than the first record, which is kept.")
 	}
-	fmt.Println("Parsed patient data.")
-	fmt.Print("Parsed ", patientMap.Ctr, " patients with year of birth known ")
-	fmt.Print("of which ", patientMap.FemaleCtr, " females and ")
-	fmt.Println(patientMap.MaleCtr, "males; and of which ", deathCr, " have a known date of death.")
-	fmt.Println("Year of birth oldest patient:", minYOB)
-	fmt.Println("Year of birth youngest patient:", maxYOB)
-	fmt.Println("Patients are of ", len(regions), " regions: ")
-	for region, nr := range regions {
-		fmt.Print(region, ": ", nr, ", ")
+	utils.Info("Year of birth oldest patient:", minYOB)
+	utils.Info("Year of birth youngest patient:", maxYOB)
+	utils.Info("Patients are of ", len(regions), " regions: ")
+	regionNames := []string{}
+	for region := range regions {
+		regionNames = append(regionNames, region)
 	}
-	fmt.Println("")
+	sort.Strings(regionNames)
+	var regionCounts strings.Builder
+	for _, region := range regionNames {
+		fmt.Fprint(&regionCounts, region, ": ", regions[region], ", ")
+	}
+	utils.Info(regionCounts.String())
 	return patientMap, len(regions)
 }
 
@@ -780,7 +883,7 @@ func parseTriNetXTreatmentFile(fileName string) map[string]*TreatmentInfo {
 		if err != nil {
 			panic(err)
 		}
-		PIDString := record[0]
+		PIDString := strings.Clone(record[0])
 		var rcDate, mvacDate, ivtDate *trajectory.DiagnosisDate
 		if len(record[10]) == 10 { // valid date
 			d := parseTriNetXDiagnosisDate(record[10])
@@ -800,59 +903,61 @@ func parseTriNetXTreatmentFile(fileName string) map[string]*TreatmentInfo {
 }
 
 // parseTrinetXPatientDiagnoses parses a csv file containing patient diagnoses. It fills in those diagnoses for the given
-// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses.
+// patients. It uses the icd10AnalysisMap to assign internal analysis DID to the diagnoses. The file can also be a
+// comma-separated list of files, cf. splitInputFiles, in which case the diagnoses of the files are merged, and a
+// diagnosis that occurs in several files with the same date is only counted once. The files are parsed concurrently,
+// cf. readCSVFiles.
 // TO DO: Handle ICD09 diagnoses.
-func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, patients *trajectory.PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string) {
-	file, err := os.Open(diagnosesFile)
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	reader := csv.NewReader(file)
+func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, patients *trajectory.PatientMap, icd10AnalysisMap AnalysisMaps, icd9ToIcd10Map map[string]string, icd10BaseCodes bool) {
 	ctr := 0 //for counting the number of parsed diagnoses
 	ctrID09 := 0
 	ctrExcl := 0
 	EOICtr := 0
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
+	unmatched := map[string]bool{} // patients in the diagnoses file that are not in the patient file
+	resolver := newIcd10CodeResolver(icd10AnalysisMap.getCodeKeys(), icd10BaseCodes)
+	for _, e := range patients.Exclusions {
+		unmatched[e.PIDString] = true // already excluded while parsing the patient file
+	}
+	files := splitInputFiles(diagnosesFile)
+	readCSVFiles("Parsing diagnosis files", files, func(record []string) {
 		ctr++
 		PIDString := record[0]
 		patient, ok := trajectory.GetPatient(PIDString, patients)
 		if !ok {
-			continue //skip unknown patients
+			//skip unknown patients
+			if !unmatched[PIDString] {
+				unmatched[PIDString] = true
+				trajectory.ExcludePatient(patients, strings.Clone(PIDString), trajectory.ExcludedUnmatchedPatient, "")
+			}
+			return
 		}
 		DIDCodeSystem := record[2]
 		DIDString := record[3]
-		if DIDCodeSystem != "ICD-10-CM" {
+		if !icd10CodeSystems[DIDCodeSystem] {
 			// try to remap ICD9 code to ICD10 codes
 			if DIDString, ok = icd9ToIcd10Map[DIDString]; !ok {
-				continue // skip unkown ICD9 codes
+				return // skip unkown ICD9 codes
 			}
+			DIDCodeSystem = "ICD-10-CM"
 			ctrID09++
 		}
+		// map codes of other ICD10 modifications, or WHO base codes, onto codes of the vocabulary
+		if resolved, ok := resolver.resolve(DIDCodeSystem, DIDString); ok {
+			DIDString = resolved
+		}
 		date := parseTriNetXDiagnosisDate(record[7])
 
 		nr := icd10AnalysisMap.fillInPatientDiagnoses(patient, DIDString, date)
 		if nr > 0 {
 			ctrExcl++
-			continue
+			return
 		}
 		//Check if diagnosis is event of interest.
 		if patient.EOIDate == nil && TriNetXEventOfInterest(DIDString) {
 			EOICtr++
 			patient.EOIDate = &date // mark first event of interest (e.g. bladder cancers diagnosis)
 		}
-	}
+	})
 	var nonICD10DiagnosesMap map[string]*TreatmentInfo
 	nonICDCtr := 0
 	if treatmentInfoFile != "" {
@@ -863,19 +968,26 @@ func parseTrinetXPatientDiagnoses(diagnosesFile, treatmentInfoFile string, patie
 			nonICDCtr = nonICDCtr + r
 		}
 	}
+	duplicates := 0
 	for _, patient := range patients.PIDMap {
 		trajectory.SortDiagnoses(patient)
-		trajectory.CompactDiagnoses(patient)
+		duplicates += trajectory.CompactDiagnoses(patient)
+	}
+	utils.Info("Parsed diagnosis data.")
+	utils.Info("Parsed ", ctr, " diagnoses of which ", ctrID09, " ICD09 diagnoses and ", ctr-ctrID09,
+		" ICD10 diagnoses, and ", ctrExcl, " diagnoses excluded from analysis")
+	utils.Info("and of which ", EOICtr, " events of interest.")
+	if len(files) > 1 {
+		utils.Info("Merged the diagnoses of ", len(files), " diagnosis files, removing ", duplicates,
+			" duplicate diagnoses.")
 	}
-	fmt.Println("Parsed diagnosis data.")
-	fmt.Print("Parsed ", ctr, " diagnoses ")
-	fmt.Println("of which ", ctrID09, " ICD09 diagnoses and ", ctr-ctrID09, " ICD10 diagnoses, and ", ctrExcl, " diagnoses excluded from analysis")
-	fmt.Println("and of which ", EOICtr, " events of interest.")
-	fmt.Println("Parsed non ICD diagnoses for: ", nonICDCtr, " patients.")
+	printIcd10CodeResolverSummary(resolver)
+	utils.Info("Parsed non ICD diagnoses for: ", nonICDCtr, " patients.")
 }
 
-func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treatmentInfoFile string, nofCohortAges,
-	level int, minYears, maxYears float64, icd9ToIcd10File string, filters []trajectory.PatientFilter) (*trajectory.Experiment, *trajectory.PatientMap) {
+func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, grouper, treatmentInfoFile string, nofCohortAges,
+	level int, minYears, maxYears float64, icd9ToIcd10File string, icd10BaseCodes bool, filters []trajectory.PatientFilter,
+	codeValidityFile string, maxGap float64, bundlesFile string) (*trajectory.Experiment, *trajectory.PatientMap) {
 	// parse data
 	// fill in patients
 	patients, nofRegions := parseTriNetXPatientData(patientFile, nofCohortAges)
@@ -884,29 +996,75 @@ func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treat
 	var nofDiagnosisCodes int
 	var nameMap map[int]string
 	var idMap map[int]string
-	if filepath.Ext(diagnosisInfoFile) == ".xml" {
+	var hierarchy map[int][]string
+	switch DiagnosisGrouper(diagnosisInfoFile, grouper) {
+	case GrouperICD10:
 		maps := initializeIcd10AnalysisMapsFromXML(diagnosisInfoFile, level)
 		analysisMaps = maps
 		nofDiagnosisCodes = maps.NofDiagnosisCodes
 		nameMap = maps.NameMap
 		idMap = maps.getIdMap()
-	}
-	if filepath.Ext(diagnosisInfoFile) == ".csv" || filepath.Ext(diagnosisInfoFile) == ".CSV" {
+		hierarchy = maps.Hierarchy
+	case GrouperCCSR:
 		maps := initializeIcd10AnalysisMapsFromCCSR(diagnosisInfoFile)
 		analysisMaps = maps
 		nofDiagnosisCodes = maps.NofDiagnosisCodes
 		nameMap = maps.NameMap
 		idMap = maps.getIdMap()
+		hierarchy = maps.Hierarchy
+	case GrouperPhecode:
+		maps := initializeIcd10AnalysisMapsFromPhecodes(diagnosisInfoFile, level)
+		analysisMaps = maps
+		nofDiagnosisCodes = maps.NofDiagnosisCodes
+		nameMap = maps.NameMap
+		idMap = maps.getIdMap()
+		hierarchy = maps.Hierarchy
+	}
+	var validity []trajectory.ValidityPeriod
+	if codeValidityFile != "" {
+		codeValidity, err := trajectory.ReadCodeValidity(codeValidityFile)
+		if err != nil {
+			panic(err)
+		}
+		validity = trajectory.DiagnosisValidity(analysisMaps.getCodeDIDs(), codeValidity, nofDiagnosisCodes)
+		utils.Info("Parsed the validity periods of ", len(codeValidity), " diagnosis codes.")
 	}
 	icd9ToIcd10Map := map[string]string{}
 	if icd9ToIcd10File != "" {
 		icd9ToIcd10Map = parseIcd9ToIcd10Mapping(icd9ToIcd10File)
 	}
 	// fill in diagnoses for patients
-	parseTrinetXPatientDiagnoses(diagnosisFile, treatmentInfoFile, patients, analysisMaps, icd9ToIcd10Map)
+	parseTrinetXPatientDiagnoses(diagnosisFile, treatmentInfoFile, patients, analysisMaps, icd9ToIcd10Map, icd10BaseCodes)
+	patients = trajectory.ExcludePatientsWithoutDiagnoses(patients)
 	// Apply patient filter
 	patients = trajectory.ApplyPatientFilters(filters, patients)
-	fmt.Println("Filtered down to: ", len(patients.PIDMap), " patients.")
+	if maxGap > 0 {
+		patients = trajectory.ApplyObservationGapFilter(patients, maxGap)
+	}
+	// combine diagnoses into bundles, which are added as diagnoses after the diagnoses of the vocabulary
+	if bundlesFile != "" {
+		bundles, err := trajectory.LoadDiagnosisBundles(bundlesFile)
+		if err != nil {
+			panic(err)
+		}
+		for i, b := range bundles {
+			nameMap[nofDiagnosisCodes+i] = b.Name
+			idMap[nofDiagnosisCodes+i] = b.Code
+			if validity != nil {
+				validity = append(validity, trajectory.AlwaysValid)
+			}
+		}
+		nofDiagnosisCodes = trajectory.ApplyDiagnosisBundles(patients, bundles, analysisMaps.getCodeDIDs(),
+			nofDiagnosisCodes)
+	}
+	utils.Info("Filtered down to: ", len(patients.PIDMap), " patients.")
+	// only keep the diagnosis codes that occur in the cohort, to right-size the dense DxD structures
+	oldIDs := trajectory.CompactDiagnosisIDs(patients, nofDiagnosisCodes)
+	nofDiagnosisCodes = len(oldIDs)
+	nameMap = trajectory.CompactNameMap(nameMap, oldIDs)
+	idMap = trajectory.CompactNameMap(idMap, oldIDs)
+	hierarchy = trajectory.CompactHierarchy(hierarchy, oldIDs)
+	validity = trajectory.CompactValidity(validity, oldIDs)
 	// create cohorts
 	cohorts := trajectory.InitializeCohorts(patients, nofCohortAges, nofRegions, nofDiagnosisCodes)
 	mergedCohort := trajectory.MergeCohorts(cohorts)
@@ -922,8 +1080,12 @@ func ParseTriNetXData(name, patientFile, diagnosisFile, diagnosisInfoFile, treat
 		NameMap:           nameMap,
 		NofRegions:        nofRegions,
 		IdMap:             idMap,
+		Hierarchy:         hierarchy,
+		Validity:          validity,
 		FCtr:              patients.FemaleCtr,
 		MCtr:              patients.MaleCtr,
+		PatientCtr:        len(patients.PIDMap),
+		EOICtr:            trajectory.CountEOIPatients(patients),
 	}
 	return &exp, patients
 }
@@ -936,7 +1098,7 @@ func parseIcd9ToIcd10Mapping(file string) map[string]string {
 		panic(err)
 	}
 	defer jsonFile.Close()
-	fmt.Println("Parsing ICD9 to ICD10 mapping from a json file.")
+	utils.Info("Parsing ICD9 to ICD10 mapping from a json file.")
 	jsonBytes, _ := ioutil.ReadAll(jsonFile)
 	var mapping map[string]string
 	json.Unmarshal(jsonBytes, &mapping)
@@ -1029,7 +1191,7 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 		}
 		tumorSite := strings.Split(record[4], ".")
 		if tumorSite[0] == "C67" { //only record bladder cancer information
-			PIDString := record[0]
+			PIDString := strings.Clone(record[0])
 			date := parseTriNetXDiagnosisDate(record[1])
 			tumorSizeInfo := strings.Split(record[10], "_")
 			numberOfLymphNodesInfo := strings.Split(record[11], "_")
@@ -1052,7 +1214,7 @@ func ParsetTriNetXTumorData(fileName string) map[string][]*TumorInfo {
 }
 
 func printTumorInfoSummary(tumorInfo map[string][]*TumorInfo) {
-	fmt.Println("Parsed tumor info. Found tumor info for: ", len(tumorInfo), " patients.")
+	utils.Info("Parsed tumor info. Found tumor info for: ", len(tumorInfo), " patients.")
 	ctr := map[string]int{}
 	for _, tumors := range tumorInfo {
 		for _, tumor := range tumors {
@@ -1067,15 +1229,15 @@ func printTumorInfoSummary(tumorInfo map[string][]*TumorInfo) {
 	}
 	sort.Strings(stages)
 	for _, stage := range stages {
-		fmt.Println("For stage: ", stage, ": ", ctr[stage], " entries.")
+		utils.Info("For stage: ", stage, ": ", ctr[stage], " entries.")
 	}
 }
 
 func printTumorInfo(tumorInfo map[int][]*TumorInfo) {
-	fmt.Println("Nr of patients with tumor info: ", len(tumorInfo))
+	utils.Info("Nr of patients with tumor info: ", len(tumorInfo))
 	for pid, infos := range tumorInfo {
 		for _, info := range infos {
-			fmt.Println("Patient with pid: ", pid, " has TStage: ", info.TStage, " NStage: ", info.NStage, " MStage: ",
+			utils.Info("Patient with pid: ", pid, " has TStage: ", info.TStage, " NStage: ", info.NStage, " MStage: ",
 				info.MStage, " Global stage: ", info.Stage)
 		}
 	}
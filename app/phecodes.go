@@ -0,0 +1,228 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"ptra/utils"
+	"strings"
+)
+
+//Parsing the ICD10 -> Phecode mapping.
+//Phecodes group ICD codes into clinically meaningful phenotypes, for phenome-wide association studies. The ICD-10-CM
+//to Phecode mapping can be downloaded from https://phewascatalog.org/phecodes_icd10cm as a csv file with (at least)
+//the columns icd10cm, phecode, and phecode_str. Phecodes are hierarchical: e.g. 250.21 "Type 2 diabetes with
+//ketoacidosis" is a child of 250.2 "Type 2 diabetes", which is a child of 250 "Diabetes mellitus".
+
+// Diagnosis groupers, i.e. the vocabularies onto which the ICD10 codes of the input are mapped for analysis.
+const (
+	GrouperICD10   = "icd10"   // the ICD10 hierarchy, from an xml file
+	GrouperCCSR    = "ccsr"    // CCSR categories, from a csv file
+	GrouperPhecode = "phecode" // Phecodes, from a csv file
+)
+
+// DiagnosisGrouper returns the grouper for a diagnosis info file. If grouper is empty, it is derived from the file:
+// icd10 for xml files, phecode for csv files with a phecode column, and ccsr for other csv files.
+func DiagnosisGrouper(file, grouper string) string {
+	if grouper != "" {
+		switch grouper {
+		case GrouperICD10, GrouperCCSR, GrouperPhecode:
+			return grouper
+		}
+		panic(fmt.Sprintf("Unknown diagnosis grouper: %s", grouper))
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".xml" {
+		return GrouperICD10
+	}
+	if _, ok := phecodeColumns(readCSVHeader(file)); ok {
+		return GrouperPhecode
+	}
+	return GrouperCCSR
+}
+
+// readCSVHeader reads the first record of a csv file.
+func readCSVHeader(file string) []string {
+	csvFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := csvFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(csvFile)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	return header
+}
+
+// phecodeColumns returns the indexes of the ICD10 code, phecode, and phecode name columns in the header of a Phecode
+// mapping file. It returns false if the header does not have these columns.
+func phecodeColumns(header []string) ([3]int, bool) {
+	columns := [3]int{-1, -1, -1}
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "icd10cm", "icd10":
+			columns[0] = i
+		case "phecode":
+			columns[1] = i
+		case "phecode_str":
+			columns[2] = i
+		}
+	}
+	return columns, columns[0] >= 0 && columns[1] >= 0 && columns[2] >= 0
+}
+
+// phecodeRollup returns the ancestor of a phecode at the given level: the integer phecode at level 0, the phecode with
+// at most one decimal at level 1, and the phecode itself at level 2 or higher. E.g. 250.21 is rolled up to 250 at level
+// 0 and to 250.2 at level 1.
+func phecodeRollup(phecode string, level int) string {
+	i := strings.IndexByte(phecode, '.')
+	if i < 0 {
+		return phecode
+	}
+	if level <= 0 {
+		return phecode[:i]
+	}
+	if level == 1 && len(phecode) > i+2 {
+		return phecode[:i+2]
+	}
+	return phecode
+}
+
+// initializeIcd10ToPhecodeMap parses a Phecode mapping file into a map ICD10 code -> phecodes and a map phecode ->
+// phenotype name.
+func initializeIcd10ToPhecodeMap(file string) (map[string][]string, map[string]string) {
+	utils.Info("Parsing ICD10 to Phecode mapping from csv file: ", file)
+	csvFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := csvFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(csvFile)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		panic(err)
+	}
+	columns, ok := phecodeColumns(header)
+	if !ok {
+		panic(fmt.Sprintf("Phecode mapping file %s needs the columns icd10cm, phecode, and phecode_str.", file))
+	}
+	icd10ToPhecodes := map[string][]string{}
+	phecodeNames := map[string]string{}
+	interner := utils.NewInterner() // the phecodes and their names are repeated for many ICD10 codes
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(err)
+		}
+		icd10Code := normalizeIcd10Code(record[columns[0]])
+		phecode := strings.TrimSpace(record[columns[1]])
+		if icd10Code == "" || phecode == "" {
+			continue // ICD10 code that is not mapped onto a phecode
+		}
+		phecode = interner.Intern(phecode)
+		phecodeNames[phecode] = interner.Intern(strings.TrimSpace(record[columns[2]]))
+		icd10ToPhecodes[icd10Code] = append(icd10ToPhecodes[icd10Code], phecode)
+	}
+	return icd10ToPhecodes, phecodeNames
+}
+
+// initializeIcd10AnalysisMapsPhecode creates a map ICD10 code -> [analysis DID] and a map analysis DID -> medical name,
+// starting from a Phecode mapping, with the phecodes rolled up to the requested level, cf. phecodeRollup. The name of a
+// rolled-up phecode that does not occur in the mapping file is the phecode itself. It also returns a map analysis DID
+// -> the path of phecodes from the integer phecode down to the medical name, for computing semantic similarities. The
+// same ICD10 codes are excluded as for CCSR categories.
+func initializeIcd10AnalysisMapsPhecode(icd10ToPhecodes map[string][]string, phecodeNames map[string]string,
+	level int) (map[string][]int, map[int]string, map[int][]string, int) {
+	analysisIdMap := map[string][]int{}     // maps icd 10 code to analysis IDs
+	analysisNameMap := map[int]string{}     // maps analysis ID to a medical name
+	analysisHierarchy := map[int][]string{} // maps analysis ID to its path in the Phecode hierarchy
+	phecodeIDMap := map[string]int{}
+	ctr := 0 //serves as analysis ID generator
+	icd10ToExclude := getIcd10CodesToExcludeFromAnalysis()
+	// number the phecodes in the same order in each run
+	for _, icd10Code := range utils.SortedKeys(icd10ToPhecodes) {
+		if _, ok := icd10ToExclude[icd10Code[0:1]]; ok {
+			continue
+		}
+		ids := []int{}
+		for _, phecode := range icd10ToPhecodes[icd10Code] {
+			phecode = phecodeRollup(phecode, level)
+			id, ok := phecodeIDMap[phecode]
+			if !ok {
+				id = ctr
+				ctr++
+				name, ok := phecodeNames[phecode]
+				if !ok {
+					name = "Phecode " + phecode
+				}
+				analysisNameMap[id] = name
+				path := []string{}
+				for l := 0; l < 2; l++ {
+					ancestor := phecodeRollup(phecode, l)
+					if ancestor != phecode && (len(path) == 0 || path[len(path)-1] != ancestor) {
+						path = append(path, ancestor)
+					}
+				}
+				analysisHierarchy[id] = append(path, name)
+				phecodeIDMap[phecode] = id
+			}
+			if !utils.Member(id, ids) {
+				ids = append(ids, id)
+			}
+		}
+		analysisIdMap[icd10Code] = ids
+	}
+	extra := getNonICD10CodesToAddToAnalysis()
+	for _, code := range utils.SortedKeys(extra) {
+		name := extra[code]
+		analysisNameMap[ctr] = name
+		analysisIdMap[code] = []int{ctr}
+		ctr++
+	}
+	utils.Info("Mapped ", len(icd10ToPhecodes), " ICD10 codes to ", ctr, " analysis IDs of level ", level)
+	return analysisIdMap, analysisNameMap, analysisHierarchy, ctr
+}
+
+// initializeIcd10AnalysisMapsFromPhecodes returns a map ICD10 -> []{internal analysis DID} and map analysis DID ->
+// medical name for a Phecode mapping passed as a csv file. Like CCSR categories, an ICD10 code can be mapped onto
+// several phecodes, so the maps have the same shape as those for CCSR.
+func initializeIcd10AnalysisMapsFromPhecodes(file string, level int) icd10AnalysisMapsFromCCSR {
+	icd10ToPhecodes, phecodeNames := initializeIcd10ToPhecodeMap(file)
+	analysisIdMap, analysisNameMap, analysisHierarchy, ctr := initializeIcd10AnalysisMapsPhecode(icd10ToPhecodes,
+		phecodeNames, level)
+	return icd10AnalysisMapsFromCCSR{DIDMap: analysisIdMap, NameMap: analysisNameMap, Hierarchy: analysisHierarchy,
+		NofDiagnosisCodes: ctr}
+}
@@ -0,0 +1,133 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"ptra/utils"
+	"runtime"
+)
+
+// csvBatchSize is the number of records that the reader of an input file passes to the merge stage at once.
+const csvBatchSize = 4096
+
+// csvReadAhead is the number of batches that the reader of an input file can parse ahead of the merge stage.
+const csvReadAhead = 16
+
+// csvBatch is a batch of records parsed from an input file, or the error that stopped the parsing of the file.
+type csvBatch struct {
+	records [][]string
+	err     error
+}
+
+// readCSVFile parses a csv file and sends its records in batches on the given channel, which is closed at the end. It
+// stops early when done is closed.
+func readCSVFile(fileName string, batches chan<- csvBatch, done <-chan struct{}) {
+	defer close(batches)
+	send := func(batch csvBatch) bool {
+		select {
+		case batches <- batch:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		send(csvBatch{err: err})
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			send(csvBatch{err: err})
+		}
+	}()
+	reader := csv.NewReader(file)
+	records := make([][]string, 0, csvBatchSize)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			send(csvBatch{err: fmt.Errorf("%s: %w", fileName, err)})
+			return
+		}
+		records = append(records, record)
+		if len(records) == csvBatchSize {
+			if !send(csvBatch{records: records}) {
+				return
+			}
+			records = make([][]string, 0, csvBatchSize)
+		}
+	}
+	if len(records) > 0 {
+		send(csvBatch{records: records})
+	}
+}
+
+// readCSVFiles parses csv files concurrently, at most GOMAXPROCS files at a time, and calls process for each record.
+// Parsing is concurrent, but merging is not: process is called from the calling goroutine, for the files in the given
+// order and for the records in the order of each file, so that the result, e.g. the assignment of patient IDs, is the
+// same as when the files are parsed one after the other. The readers of the files that are not merged yet parse at most
+// csvReadAhead batches ahead, which bounds the memory use. The progress is reported as a stage of the pipeline with the
+// given name, with a step per file.
+func readCSVFiles(stageName string, files []string, process func(record []string)) {
+	stage := utils.StartStage(stageName, len(files))
+	defer stage.Done()
+	channels := make([]chan csvBatch, len(files))
+	for i := range channels {
+		channels[i] = make(chan csvBatch, csvReadAhead)
+	}
+	// the readers are started in file order, so that the file that is merged is always being read
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, file := range files {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(file string, batches chan<- csvBatch) {
+				defer func() { <-slots }()
+				readCSVFile(file, batches, done)
+			}(file, channels[i])
+		}
+	}()
+	for i, file := range files {
+		ctr := 0
+		for batch := range channels[i] {
+			if batch.err != nil {
+				panic(batch.err)
+			}
+			for _, record := range batch.records {
+				process(record)
+			}
+			ctr += len(batch.records)
+		}
+		stage.Add(1)
+		if len(files) > 1 {
+			utils.Info("Parsed ", ctr, " records from ", file, ".")
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"ptra/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resolving code display names with a FHIR terminology server.
+// Vocabularies that are not shipped with ptra, or vocabulary files without descriptions, leave diagnoses without a
+// medical name, so that the outputs only show their codes. A FHIR terminology server, such as the public tx.fhir.org or
+// a local Ontoserver, can look up the display names of such codes with the CodeSystem $lookup operation. The names are
+// cached on disk, so that each code is only looked up once, also across runs.
+
+// DefaultTerminologySystem is the code system in which codes are looked up by default: ICD-10-CM.
+const DefaultTerminologySystem = "http://hl7.org/fhir/sid/icd-10-cm"
+
+// TerminologyClient looks up the display names of codes on a FHIR terminology server, with an on-disk cache.
+type TerminologyClient struct {
+	BaseURL   string            // the base URL of the FHIR server, e.g. https://tx.fhir.org/r4
+	System    string            // the code system of the codes
+	CacheFile string            // the json file with the cached display names, "" for no on-disk cache
+	cache     map[string]string // maps system|code onto the display name, "" for codes unknown to the server
+	client    *http.Client
+}
+
+// DefaultTerminologyCacheFile returns the default file for caching display names: terminology-cache.json in the ptra
+// folder of the user's cache directory.
+func DefaultTerminologyCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ptra", "terminology-cache.json")
+}
+
+// NewTerminologyClient creates a client for a FHIR terminology server, and loads the cached display names from the
+// cache file if it exists.
+func NewTerminologyClient(baseURL, system, cacheFile string) (*TerminologyClient, error) {
+	c := &TerminologyClient{BaseURL: strings.TrimSuffix(baseURL, "/"), System: system, CacheFile: cacheFile,
+		cache: map[string]string{}, client: &http.Client{Timeout: 30 * time.Second}}
+	if cacheFile == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(cacheFile)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.cache); err != nil {
+		return nil, fmt.Errorf("%s: %v", cacheFile, err)
+	}
+	return c, nil
+}
+
+// fhirParameters is the part of a FHIR Parameters resource that is needed to read the result of a $lookup.
+type fhirParameters struct {
+	ResourceType string `json:"resourceType"`
+	Parameter    []struct {
+		Name        string `json:"name"`
+		ValueString string `json:"valueString"`
+	} `json:"parameter"`
+}
+
+// fhirOperationOutcome is the part of a FHIR OperationOutcome resource that is needed to recognize an unknown code.
+type fhirOperationOutcome struct {
+	ResourceType string `json:"resourceType"`
+	Issue        []struct {
+		Code string `json:"code"`
+	} `json:"issue"`
+}
+
+// notFound checks if an OperationOutcome reports that a code is not found.
+func (outcome *fhirOperationOutcome) notFound() bool {
+	for _, issue := range outcome.Issue {
+		if issue.Code == "not-found" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup looks up the display name of a code with the $lookup operation of the server. It returns "" if the server
+// does not know the code, i.e. answers 404 Not Found, or 400 Bad Request with a not-found issue. Other bad requests,
+// such as an unsupported code system, are errors.
+func (c *TerminologyClient) lookup(code string) (string, error) {
+	query := url.Values{"system": {c.System}, "code": {code}}
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+"/CodeSystem/$lookup?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/fhir+json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil // the server does not know the code
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		var outcome fhirOperationOutcome
+		if err := json.NewDecoder(resp.Body).Decode(&outcome); err == nil && outcome.notFound() {
+			return "", nil // the server does not know the code, reported as an OperationOutcome
+		}
+		return "", fmt.Errorf("looking up %s: %s", code, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("looking up %s: %s", code, resp.Status)
+	}
+	var parameters fhirParameters
+	if err := json.NewDecoder(resp.Body).Decode(&parameters); err != nil {
+		return "", fmt.Errorf("looking up %s: %v", code, err)
+	}
+	for _, p := range parameters.Parameter {
+		if p.Name == "display" {
+			return p.ValueString, nil
+		}
+	}
+	return "", nil
+}
+
+// Display returns the display name of a code, from the cache or else from the server. It returns "" if the server does
+// not know the code. Unknown codes are cached as well, but failed lookups are not.
+func (c *TerminologyClient) Display(code string) (string, error) {
+	key := c.System + "|" + code
+	if display, ok := c.cache[key]; ok {
+		return display, nil
+	}
+	display, err := c.lookup(code)
+	if err != nil {
+		return "", err
+	}
+	c.cache[key] = display
+	return display, nil
+}
+
+// SaveCache writes the cached display names to the cache file.
+func (c *TerminologyClient) SaveCache() error {
+	if c.CacheFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.CacheFile), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c.cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.CacheFile, data, 0600)
+}
+
+// missingName checks if a diagnosis has no medical name, i.e. its name is empty or just its code.
+func missingName(name, code string) bool {
+	name = strings.TrimSpace(name)
+	return name == "" || name == code
+}
+
+// ResolveNames fills in the medical names of the diagnoses without one with their display names on the terminology
+// server, and updates their paths in the hierarchy accordingly. The codes are the original codes of the diagnoses in
+// idMap. It returns the number of names that were filled in. If the server cannot be reached, it warns and keeps the
+// remaining codes as names, so that a run does not fail on an unavailable server.
+func ResolveNames(c *TerminologyClient, nameMap, idMap map[int]string, hierarchy map[int][]string) int {
+	dids := make([]int, 0, len(idMap))
+	for did := range idMap {
+		dids = append(dids, did)
+	}
+	sort.Ints(dids) // look up the codes in the same order in each run
+	resolved := 0
+	for _, did := range dids {
+		code, name := idMap[did], nameMap[did]
+		if code == "" || !missingName(name, code) {
+			continue
+		}
+		display, err := c.Display(code)
+		if err != nil {
+			utils.Warning("the terminology server failed, the remaining codes are not resolved: ", err)
+			break
+		}
+		if display == "" {
+			continue
+		}
+		nameMap[did] = display
+		if path := hierarchy[did]; len(path) > 0 && path[len(path)-1] == name {
+			path[len(path)-1] = display
+		}
+		resolved++
+	}
+	if err := c.SaveCache(); err != nil {
+		utils.Warning("could not save the terminology cache: ", err)
+	}
+	return resolved
+}
@@ -27,3 +27,6 @@ var ParseTrinetXPatientDiagnoses = parseTrinetXPatientDiagnoses
 var ParseIcd10HierarchyFromXml = parseIcd10HierarchyFromXml
 var PrintIcd10Hierarchy = printIcd10Hierarchy
 var PrintIcd10NameMap = printIcd10NameMap
+var NewIcd10CodeResolver = newIcd10CodeResolver
+var ResolveIcd10Code = (*icd10CodeResolver).resolve
+var InitializeIcd10AnalysisMapsFromPhecodes = initializeIcd10AnalysisMapsFromPhecodes
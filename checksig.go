@@ -0,0 +1,75 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"ptra/utils"
+	"sort"
+	"strings"
+)
+
+const checksigHelp = "\nptra checksig parameters:\n" +
+	"ptra checksig signatureFile keyFile\n" +
+	outputHelp +
+	profileHelp
+
+// checksig implements the ptra checksig command, which verifies the signature of the output files of a run signed with
+// --sign, and compares the output files with the signed hashes.
+func checksig() {
+	var profiling profiles
+	var flags flag.FlagSet
+	profiling.addFlags(&flags)
+	parseFlags(flags, 4, checksigHelp)
+	signatureFile := getFileName(os.Args[2], checksigHelp)
+	keyFile := getFileName(os.Args[3], checksigHelp)
+	stopProfiling := profiling.start(".")
+	defer stopProfiling()
+	differences, err := utils.VerifySignedOutputs(signatureFile, keyFile)
+	if errors.Is(err, utils.ErrInvalidSignature) {
+		fmt.Println("The signature is invalid: the signed hashes were altered, or signed with another key.")
+		stopProfiling()
+		os.Exit(1)
+	} else if err != nil {
+		panic(err)
+	}
+	files := []string{}
+	for file := range differences {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	altered := 0
+	for _, file := range files {
+		status := differences[file]
+		if status == utils.SignatureUnsigned {
+			fmt.Printf("%s %s\n", status, file)
+		} else {
+			fmt.Printf("%s %s\n", strings.ToUpper(status), file)
+			altered++
+		}
+	}
+	if altered > 0 {
+		fmt.Printf("%d signed files were changed or are missing.\n", altered)
+		stopProfiling()
+		os.Exit(1)
+	}
+	fmt.Println("The signature is valid and the signed files are unaltered.")
+}
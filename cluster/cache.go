@@ -0,0 +1,176 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// Caching the trajectory similarities between runs. Computing the similarities is the most expensive step of the
+// clustering, but they do not depend on the granularities, the cluster size constraints, or the outputs, so a sweep
+// over such parameters can reuse the similarities of an earlier run. The cache is content-addressed: the similarities
+// are stored in a file named after a hash of everything they depend on.
+
+// similarityCacheVersion is part of the cache keys, and changes when the similarities of the same inputs change.
+const similarityCacheVersion = 1
+
+// similarityCacheKey returns the key of the similarities of an experiment, a hash of its trajectories and of the
+// options that determine the similarities, cf. clusteringSimilarity. The trajectories are hashed with their diagnoses,
+// the codes, names, hierarchy, code hierarchy, and embeddings of the diagnoses, the relative risk ratios of their
+// transitions, and the patients of their transitions. The dates of the diagnoses of the patients that follow the full
+// trajectories are only hashed if the similarities depend on them, i.e. for DTWSimilarity and Options.TemporalWeight,
+// cf. trajectoryTimes and computeTemporalFeatures. It returns false if the similarities cannot be cached, because they
+// are computed by options.SimilarityFunc.
+func similarityCacheKey(exp *trajectory.Experiment, options Options) (string, bool, error) {
+	if options.ScorerPath == "" && options.SimilarityFile == "" && options.SimilarityFunc != nil {
+		return "", false, nil
+	}
+	timeDependent := options.ScorerPath == "" && (options.TemporalWeight > 0 ||
+		(options.SimilarityFile == "" && options.Similarity == DTWSimilarity))
+	hash := sha256.New()
+	fmt.Fprintln(hash, "ptra similarities", similarityCacheVersion)
+	if options.ScorerPath != "" {
+		scorer, err := utils.HashFile(options.ScorerPath)
+		if err != nil {
+			return "", false, err
+		}
+		fmt.Fprintln(hash, "scorer", scorer)
+	} else {
+		if options.SimilarityFile != "" {
+			similarities, err := utils.HashFile(options.SimilarityFile)
+			if err != nil {
+				return "", false, err
+			}
+			fmt.Fprintln(hash, "similarities", similarities)
+		} else {
+			fmt.Fprintln(hash, "similarity", options.Similarity)
+		}
+		fmt.Fprintln(hash, "temporalWeight", options.TemporalWeight, "patientWeight", options.PatientWeight)
+		if options.LSHBands > 0 {
+			fmt.Fprintln(hash, "lsh", options.LSHBands, options.LSHRows)
+		}
+	}
+	for _, t := range exp.Trajectories {
+		fmt.Fprintln(hash, "trajectory", t.Diagnoses, t.PatientNumbers)
+		for i, d := range t.Diagnoses {
+			fmt.Fprintf(hash, "%d\t%q\t%q\t%q\t%q\n", d, exp.IdMap[d], exp.NameMap[d], exp.Hierarchy[d],
+				trajectory.CodePath(exp, d))
+			if exp.Embeddings != nil {
+				fmt.Fprintln(hash, exp.Embeddings[d])
+			}
+			if i > 0 && exp.DxDRR != nil {
+				fmt.Fprintln(hash, exp.DxDRR[t.Diagnoses[i-1]][d])
+			}
+		}
+		for _, ps := range t.Patients {
+			for _, p := range ps {
+				fmt.Fprint(hash, p.PID, " ")
+			}
+			fmt.Fprintln(hash)
+		}
+		if timeDependent {
+			for _, p := range trajectory.LastPatients(t) {
+				fmt.Fprintln(hash, "dates", trajectory.TrajectoryDates(p, t.Diagnoses))
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), true, nil
+}
+
+// similarityCacheWriter writes the similarities in abc format to a cache file while they are passed on. Like
+// similarityGraphWriter, it never fails a write, but records the first error instead, so that a cache that cannot be
+// written does not fail the clustering.
+type similarityCacheWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+// Write writes p to the cache file.
+func (c *similarityCacheWriter) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.writer.Write(p)
+	}
+	return len(p), nil
+}
+
+// withSimilarityCache wraps a writer of similarities in abc format, so that the similarities are read from the cache
+// file fileName if it exists, instead of computing them, and written to it otherwise. The cache file is first written
+// to a temporary file, which is renamed when the similarities are complete, so that an interrupted run does not leave
+// an incomplete cache file behind.
+func withSimilarityCache(fileName string, writeAbc func(w io.Writer)) func(w io.Writer) {
+	return func(w io.Writer) {
+		if file, err := os.Open(fileName); err == nil {
+			utils.Info("Reusing the cached similarities in ", fileName)
+			_, err := io.Copy(w, bufio.NewReader(file))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				log.Panic(fmt.Sprintf("%s: %v", fileName, err))
+			}
+			return
+		} else if !os.IsNotExist(err) {
+			log.Panic(err)
+		}
+		file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+		if err != nil {
+			utils.Warning("cannot cache the similarities: ", err)
+			writeAbc(w)
+			return
+		}
+		defer os.Remove(file.Name())
+		c := &similarityCacheWriter{writer: bufio.NewWriter(file)}
+		writeAbc(io.MultiWriter(w, c))
+		if c.err == nil {
+			c.err = c.writer.Flush()
+		}
+		if err := file.Close(); c.err == nil {
+			c.err = err
+		}
+		if c.err == nil {
+			c.err = os.Rename(file.Name(), fileName)
+		}
+		if c.err != nil {
+			utils.Warning("cannot cache the similarities: ", c.err)
+			return
+		}
+		utils.Info("Cached the similarities in ", fileName)
+	}
+}
+
+// similarityCacheFileName returns the name of the cache file of the similarities of an experiment in the cache dir,
+// and creates the cache dir if needed. It returns false if the similarities cannot be cached, cf. similarityCacheKey.
+func similarityCacheFileName(exp *trajectory.Experiment, options Options) (string, bool, error) {
+	key, ok, err := similarityCacheKey(exp, options)
+	if err != nil || !ok {
+		return "", ok, err
+	}
+	if err := os.MkdirAll(options.CacheDir, 0777); err != nil {
+		return "", false, err
+	}
+	return filepath.Join(options.CacheDir, key+".abc"), true, nil
+}
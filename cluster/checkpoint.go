@@ -0,0 +1,243 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// Checkpointing the similarities while they are computed. The similarities of all pairs of trajectories are computed
+// in blocks of rows, cf. similarityBlocks, and with checkpoints, each block is also written to a chunk file of its own,
+// whose size and CRC are recorded in a manifest. An interrupted run then resumes from the last valid chunk, instead of
+// computing the similarities of all pairs of trajectories from the start.
+
+// similarityCheckpointVersion is part of the header of a manifest, and changes when the layout of the chunks changes,
+// e.g. similarityBlockPairs.
+const similarityCheckpointVersion = 1
+
+// similarityCheckpoints are the chunks of the similarities of an experiment in a checkpoint dir. The chunk files are
+// named chunk<nr>.abc, and are listed in order in the manifest, with a line per chunk with its number, its first and
+// end rows, its size, and its CRC-32. A chunk is only added to the manifest once its file is complete. Like
+// similarityCacheWriter, checkpoints that cannot be written are reported as a warning and do not fail the clustering.
+type similarityCheckpoints struct {
+	dir      string            // the dir of the chunks, named after the key of the similarities, cf. similarityCacheKey
+	blocks   []int             // the first row of each chunk, followed by the number of trajectories
+	chunks   []checkpointChunk // the valid chunks, which are read instead of computed
+	manifest *os.File          // the manifest, opened for appending, or nil if no more chunks can be written
+}
+
+// checkpointChunk is the size and the CRC-32 of a chunk file.
+type checkpointChunk struct {
+	size int64
+	crc  uint32
+}
+
+// checkpointManifestHeader returns the first line of the manifest of the checkpoints of the given similarity blocks.
+func checkpointManifestHeader(blocks []int) string {
+	return fmt.Sprintf("ptra similarity checkpoints\t%d\t%d\t%d", similarityCheckpointVersion, blocks[len(blocks)-1],
+		len(blocks)-1)
+}
+
+// chunkFileName returns the name of the file of chunk b.
+func (c *similarityCheckpoints) chunkFileName(b int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("chunk%06d.abc", b))
+}
+
+// chunkLine returns the line of the manifest for chunk b with the given content.
+func (c *similarityCheckpoints) chunkLine(b int, ch checkpointChunk) string {
+	return fmt.Sprintf("%d\t%d\t%d\t%d\t%08x", b, c.blocks[b], c.blocks[b+1], ch.size, ch.crc)
+}
+
+// fileChunk returns the size and the CRC-32 of a chunk file.
+func fileChunk(name string) (checkpointChunk, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return checkpointChunk{}, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	size, err := bufio.NewReader(file).WriteTo(hash)
+	return checkpointChunk{size: size, crc: hash.Sum32()}, err
+}
+
+// validChunks returns the chunks of the manifest in the checkpoint dir whose files are intact, up to the
+// first chunk that is missing, incomplete, or corrupted. A manifest of other similarity blocks has no valid chunks.
+func (c *similarityCheckpoints) validChunks() []checkpointChunk {
+	file, err := os.Open(filepath.Join(c.dir, "manifest.tsv"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != checkpointManifestHeader(c.blocks) {
+		utils.Warning("the checkpoints in ", c.dir, " do not match the similarities, starting from the first chunk.")
+		return nil
+	}
+	chunks := []checkpointChunk{}
+	for b := 0; b+1 < len(c.blocks) && scanner.Scan(); b++ {
+		ch, err := fileChunk(c.chunkFileName(b))
+		if err != nil || scanner.Text() != c.chunkLine(b, ch) {
+			utils.Warning("chunk ", b, " in ", c.dir, " is not valid, resuming the similarities from it.")
+			break
+		}
+		chunks = append(chunks, ch)
+	}
+	return chunks
+}
+
+// openSimilarityCheckpoints opens the checkpoints of the similarities of all pairs of trajectories of an experiment in
+// options.CheckpointDir, and rewrites the manifest with only its valid chunks, cf. validChunks. It returns nil if the
+// similarities cannot be checkpointed, because they are computed by options.SimilarityFunc, or because the checkpoint
+// dir cannot be written.
+func openSimilarityCheckpoints(exp *trajectory.Experiment, options Options) *similarityCheckpoints {
+	key, ok, err := similarityCacheKey(exp, options)
+	if err != nil || !ok {
+		utils.Warning("the similarities of a custom similarity function are not checkpointed.")
+		return nil
+	}
+	c := &similarityCheckpoints{dir: filepath.Join(options.CheckpointDir, key),
+		blocks: similarityBlocks(len(exp.Trajectories))}
+	if len(c.blocks) < 2 {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		utils.Warning("cannot checkpoint the similarities: ", err)
+		return nil
+	}
+	c.chunks = c.validChunks()
+	if err := c.rewriteManifest(); err != nil {
+		utils.Warning("cannot checkpoint the similarities: ", err)
+		return nil
+	}
+	if len(c.chunks) > 0 {
+		utils.Info("Resuming the similarities from ", len(c.chunks), " of ", len(c.blocks)-1,
+			" checkpointed chunks in ", c.dir)
+	}
+	return c
+}
+
+// rewriteManifest replaces the manifest by a manifest with the valid chunks, and opens it for appending.
+func (c *similarityCheckpoints) rewriteManifest() error {
+	name := filepath.Join(c.dir, "manifest.tsv")
+	file, err := os.CreateTemp(c.dir, "manifest.tsv.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, checkpointManifestHeader(c.blocks))
+	for b, ch := range c.chunks {
+		fmt.Fprintln(writer, c.chunkLine(b, ch))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), name); err != nil {
+		return err
+	}
+	c.manifest, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0666)
+	return err
+}
+
+// resumed returns whether chunk b is valid, so that it is read instead of computed. c may be nil.
+func (c *similarityCheckpoints) resumed(b int) bool {
+	return c != nil && b < len(c.chunks)
+}
+
+// read returns the content of the valid chunk b, after checking it against its CRC.
+func (c *similarityCheckpoints) read(b int) []byte {
+	name := c.chunkFileName(b)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		log.Panic(err)
+	}
+	if int64(len(data)) != c.chunks[b].size || crc32.ChecksumIEEE(data) != c.chunks[b].crc {
+		log.Panic(fmt.Sprintf("%s: the checkpointed similarities changed while they were read", name))
+	}
+	return data
+}
+
+// write adds chunk b with the given similarities, unless it was resumed. The chunk file is first written to a
+// temporary file, which is synced and renamed before the chunk is added to the manifest, so that an interruption never
+// leaves a chunk in the manifest that is not complete. c may be nil.
+func (c *similarityCheckpoints) write(b int, data []byte) {
+	if c == nil || c.manifest == nil || c.resumed(b) {
+		return
+	}
+	if err := c.writeChunk(b, data); err != nil {
+		utils.Warning("cannot checkpoint the similarities: ", err)
+		c.manifest.Close()
+		c.manifest = nil
+	}
+}
+
+// writeChunk writes the file of chunk b, and adds it to the manifest.
+func (c *similarityCheckpoints) writeChunk(b int, data []byte) error {
+	file, err := os.CreateTemp(c.dir, fmt.Sprintf("chunk%06d.abc.*.tmp", b))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), c.chunkFileName(b)); err != nil {
+		return err
+	}
+	ch := checkpointChunk{size: int64(len(data)), crc: crc32.ChecksumIEEE(data)}
+	if _, err := fmt.Fprintln(c.manifest, c.chunkLine(b, ch)); err != nil {
+		return err
+	}
+	return c.manifest.Sync()
+}
+
+// complete removes the checkpoints once all the similarities are passed on, since the run no longer needs to be
+// resumed. To reuse the similarities in later runs, cf. withSimilarityCache. c may be nil.
+func (c *similarityCheckpoints) complete() {
+	if c == nil {
+		return
+	}
+	if c.manifest != nil {
+		c.manifest.Close()
+	}
+	if err := os.RemoveAll(c.dir); err != nil {
+		utils.Warning("cannot remove the similarity checkpoints: ", err)
+		return
+	}
+	utils.Info("Removed the similarity checkpoints in ", c.dir)
+}
@@ -0,0 +1,347 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The tests of the unexported parts of the cluster package. The tests of its API are in ptra_test.
+
+// randomExperiment returns an experiment with n trajectories of 2 to 5 random diagnoses out of 20 codes.
+func randomExperiment(n int) *trajectory.Experiment {
+	exp := &trajectory.Experiment{Name: "random", NofDiagnosisCodes: 20, NameMap: map[int]string{},
+		IdMap: map[int]string{}, Hierarchy: map[int][]string{}}
+	for d := 0; d < exp.NofDiagnosisCodes; d++ {
+		exp.IdMap[d] = fmt.Sprintf("C%02d", d)
+		exp.NameMap[d] = fmt.Sprintf("diagnosis %d", d)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		t := &trajectory.Trajectory{}
+		for _, d := range rng.Perm(exp.NofDiagnosisCodes)[:2+rng.Intn(4)] {
+			t.Diagnoses = append(t.Diagnoses, d)
+		}
+		exp.Trajectories = append(exp.Trajectories, t)
+	}
+	return exp
+}
+
+func TestRRWeightedJaccard(t *testing.T) {
+	exp := &trajectory.Experiment{NofDiagnosisCodes: 5, DxDRR: trajectory.MakeDxDRR(5)}
+	exp.DxDRR[0][1] = 8
+	exp.DxDRR[1][2] = 2
+	exp.DxDRR[2][3] = 2
+	exp.DxDRR[3][4] = math.Inf(1)
+	similarity := newRRWeightedJaccard(exp)
+	t1 := &trajectory.Trajectory{Diagnoses: []int{0, 1, 2}}
+	for _, test := range []struct {
+		diagnoses []int
+		expected  float64
+	}{
+		{[]int{0, 1, 2}, 1},
+		{[]int{0, 1}, 16.0 / 18},   // weights 8, 8, 2 against 8, 8
+		{[]int{2, 3}, 2.0 / 20},    // weights 8, 8, 2 against 2, 2
+		{[]int{3, 4}, 0},           // the infinite RR counts as 1
+		{[]int{1, 2, 3}, 4.0 / 20}, // weights 8, 8, 2 against 2, 2, 2
+		{[]int{}, 0},
+	} {
+		t2 := &trajectory.Trajectory{Diagnoses: test.diagnoses}
+		if s := similarity(t1, t2); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("expected an RR-weighted Jaccard similarity of %v for %v, got %v", test.expected, test.diagnoses, s)
+		}
+	}
+	// with equal RRs, it is the Jaccard similarity
+	exp.DxDRR = trajectory.MakeDxDRR(5)
+	t2 := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	if s := newRRWeightedJaccard(exp)(t1, t2); math.Abs(s-JaccardTrajectory(t1, t2)) > 1e-9 {
+		t.Errorf("expected the Jaccard similarity %v for equal RRs, got %v", JaccardTrajectory(t1, t2), s)
+	}
+}
+
+func TestMclCommand(t *testing.T) {
+	limits, err := ParseMclLimits("nice=10,cpus=0-3,8,mcl.memory=16G,mcl.nice=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := Options{MclPath: "/opt/mcl/bin/", MclLimits: limits}
+	expected := map[string]string{
+		Mcxload: "nice -n 10 taskset -c 0-3,8 /opt/mcl/bin/mcxload -o x",
+		Mcl:     "nice -n 5 taskset -c 0-3,8 prlimit --as=17179869184 -- /opt/mcl/bin/mcl -o x",
+		Mcxdump: "nice -n 10 taskset -c 0-3,8 /opt/mcl/bin/mcxdump -o x",
+	}
+	for tool, args := range expected {
+		if cmd := mclCommand(options, tool, "-o", "x"); strings.Join(cmd.Args, " ") != args {
+			t.Errorf("expected the command line %s, got %s", args, strings.Join(cmd.Args, " "))
+		}
+	}
+	if cmd := mclCommand(Options{MclPath: "/usr/bin/"}, Mcl, "-o", "x"); len(cmd.Args) != 3 {
+		t.Errorf("expected an unwrapped command line without limits, got %v", cmd.Args)
+	}
+}
+
+func TestLSHCandidates(t *testing.T) {
+	exp := randomExperiment(300)
+	candidates, nofPairs := lshCandidates(exp, 20, 5)
+	found := map[[2]int]bool{}
+	for i, js := range candidates {
+		for _, j := range js {
+			if j <= i || found[[2]int{i, j}] {
+				t.Errorf("expected the candidates of trajectory %d to be unique IDs above it, got %v", i, js)
+			}
+			found[[2]int{i, j}] = true
+		}
+	}
+	if uint64(len(found)) != nofPairs {
+		t.Errorf("expected %d candidate pairs, got %d", nofPairs, len(found))
+	}
+	for i, t1 := range exp.Trajectories {
+		for j := i + 1; j < len(exp.Trajectories); j++ {
+			if s := JaccardTrajectory(t1, exp.Trajectories[j]); s >= 0.8 && !found[[2]int{i, j}] {
+				t.Errorf("expected trajectories %d and %d with similarity %f to be a candidate pair", i, j, s)
+			} else if s == 0 && found[[2]int{i, j}] {
+				t.Errorf("expected trajectories %d and %d without similarity not to be a candidate pair", i, j)
+			}
+		}
+	}
+}
+
+// interruptedWriter simulates an interrupted run: it panics at the given write.
+type interruptedWriter struct {
+	writes, at int
+}
+
+func (w *interruptedWriter) Write(p []byte) (int, error) {
+	if w.writes++; w.writes == w.at {
+		panic("interrupted")
+	}
+	return len(p), nil
+}
+
+// interruptSimilarities writes the similarities of an experiment with checkpoints, and interrupts them at the given
+// write.
+func interruptSimilarities(t *testing.T, exp *trajectory.Experiment, options Options, at int) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected the similarities to be interrupted")
+		}
+	}()
+	writeTrajectoriesAbc(exp, &interruptedWriter{at: at}, JaccardTrajectory, 1, false,
+		openSimilarityCheckpoints(exp, options))
+}
+
+func TestSimilarityCheckpoints(t *testing.T) {
+	exp := randomExperiment(600)
+	if blocks := similarityBlocks(len(exp.Trajectories)); len(blocks) < 4 {
+		t.Fatalf("expected at least 3 blocks of similarities, got %v", blocks)
+	}
+	dir := t.TempDir()
+	options := Options{Similarity: JaccardSimilarity, CheckpointDir: dir}
+	var expected bytes.Buffer
+	writeTrajectoriesAbc(exp, &expected, JaccardTrajectory, 1, false, nil)
+	var computed atomic.Int64
+	counting := func(t1, t2 *trajectory.Trajectory) float64 {
+		computed.Add(1)
+		return JaccardTrajectory(t1, t2)
+	}
+	interruptSimilarities(t, exp, options, 2)
+	chunks, err := filepath.Glob(filepath.Join(dir, "*", "chunk*.abc"))
+	if err != nil || len(chunks) != 2 {
+		t.Fatalf("expected 2 checkpointed chunks, got %v", chunks)
+	}
+	var resumed bytes.Buffer
+	writeTrajectoriesAbc(exp, &resumed, counting, 1, false, openSimilarityCheckpoints(exp, options))
+	if all := int64(allPairs(len(exp.Trajectories))); computed.Load() == 0 || computed.Load() >= all ||
+		resumed.String() != expected.String() {
+		t.Errorf("expected the similarities to be resumed from the checkpoints, computed %d of %d", computed.Load(),
+			all)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the checkpoints to be removed once the similarities are complete, got %v", entries)
+	}
+	// a corrupted chunk and the chunks after it are computed again
+	interruptSimilarities(t, exp, options, 2)
+	chunks, _ = filepath.Glob(filepath.Join(dir, "*", "chunk*.abc"))
+	data, err := os.ReadFile(chunks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 1
+	if err := os.WriteFile(chunks[1], data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := openSimilarityCheckpoints(exp, options)
+	if len(checkpoints.chunks) != 1 {
+		t.Errorf("expected only the chunk before the corrupted chunk to be valid, got %d", len(checkpoints.chunks))
+	}
+	var recomputed bytes.Buffer
+	writeTrajectoriesAbc(exp, &recomputed, JaccardTrajectory, 1, false, checkpoints)
+	if recomputed.String() != expected.String() {
+		t.Error("expected the similarities after a corrupted chunk to be computed again")
+	}
+}
+
+func TestSimilarityCacheKeyDates(t *testing.T) {
+	exp := randomExperiment(10)
+	for i, tr := range exp.Trajectories {
+		p := &trajectory.Patient{PID: i + 1}
+		for j, d := range tr.Diagnoses {
+			p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: p.PID, DID: d,
+				Date: trajectory.DiagnosisDate{Year: 2010 + j, Month: 1, Day: 1}})
+		}
+		tr.Patients = [][]*trajectory.Patient{{p}}
+	}
+	keys := func() []string {
+		keys := []string{}
+		for _, options := range []Options{{Similarity: JaccardSimilarity}, {Similarity: DTWSimilarity},
+			{Similarity: JaccardSimilarity, TemporalWeight: 0.5}} {
+			key, ok, err := similarityCacheKey(exp, options)
+			if err != nil || !ok {
+				t.Fatalf("expected a cache key, got %v", err)
+			}
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	before := keys()
+	exp.Trajectories[3].Patients[0][0].Diagnoses[1].Date.Year++
+	after := keys()
+	if before[0] != after[0] {
+		t.Errorf("expected the key of the jaccard similarity not to depend on the dates")
+	}
+	if before[1] == after[1] || before[2] == after[2] {
+		t.Errorf("expected the keys of the time-dependent similarities to depend on the dates")
+	}
+}
+
+func TestReadLegacyClusteringOrder(t *testing.T) {
+	exp := randomExperiment(8)
+	dumpFile := filepath.Join(t.TempDir(), "dump.random.mci.I40")
+	// the clusters are listed in a different order than the canonical one, with unsorted IDs
+	if err := os.WriteFile(dumpFile, []byte("7\n5\t1\n6\t0\t3\n4\t2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[*trajectory.Trajectory]int{}
+	for cid, ts := range readMclClusters(exp, dumpFile) {
+		for _, tr := range ts {
+			expected[tr] = cid
+		}
+	}
+	for _, tr := range exp.Trajectories {
+		tr.Cluster = -1
+	}
+	clustered, err := trajectory.ReadLegacyClustering(dumpFile, exp.Trajectories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clustered) != len(exp.Trajectories) {
+		t.Fatalf("expected %d clustered trajectories, got %d", len(exp.Trajectories), len(clustered))
+	}
+	for i, tr := range clustered {
+		if tr.Cluster != expected[tr] {
+			t.Errorf("expected trajectory %d in cluster %d like a new run, got %d", i, expected[tr], tr.Cluster)
+		}
+		if i > 0 && tr.Cluster < clustered[i-1].Cluster {
+			t.Errorf("expected the clustered trajectories to be ordered by cluster")
+		}
+	}
+}
+
+func TestReadClustererOutput(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		format, output, expected string
+	}{
+		{"lines", "# clusters\n4 1\n\n0 5 2\n", "[[0 2 5] [1 4] [3]]"},
+		{"pairs", "# node module flow\n0 7 0.1\n4 3 0.2\n1 7 0.1\n5 3 0.2\n2 9 0.4\n", "[[0 1] [4 5] [2] [3]]"},
+	} {
+		fileName := filepath.Join(dir, test.format)
+		if err := os.WriteFile(fileName, []byte(test.output), 0644); err != nil {
+			t.Fatal(err)
+		}
+		clusters, err := readClustererOutput(fileName, test.format, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(clusters) != test.expected {
+			t.Errorf("expected the %s clusters %s, got %v", test.format, test.expected, clusters)
+		}
+	}
+	for _, test := range []struct {
+		format, output, expected string
+	}{
+		{"lines", "0 1\n2 x\n", ":2: invalid trajectory ID x"},
+		{"lines", "0 1\n6\n", ":2: invalid trajectory ID 6"},
+		{"lines", "0 1\n1 2\n", ":2: trajectory 1 occurs in multiple clusters"},
+		{"pairs", "0 1\n2\n", ":2: expected a trajectory and a cluster ID"},
+	} {
+		fileName := filepath.Join(dir, "invalid")
+		if err := os.WriteFile(fileName, []byte(test.output), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readClustererOutput(fileName, test.format, 6); err == nil ||
+			!strings.HasSuffix(err.Error(), test.expected) {
+			t.Errorf("expected the error %s for %q, got %v", test.expected, test.output, err)
+		}
+	}
+}
+
+func TestRunExternalClusterer(t *testing.T) {
+	dir := t.TempDir() + "/"
+	exp := randomExperiment(4)
+	// the command keeps a copy of its input, and puts the first trajectory of each similar pair in cluster 1
+	c := &Clusterer{Name: "test", Input: "links", OutputFormat: "pairs", Output: "{granularity}.clu",
+		Command: []string{"sh", "-c", "cp {input} input{inflation} && awk '{print $1, 1}' {input} > {granularity}.clu"}}
+	writeAbc := func(w io.Writer) {
+		fmt.Fprint(w, "0\t1\t0.5\n2\t3\t0.25\n")
+	}
+	runExternalClusterer(c, exp, []int{14, 20}, dir, dir+"clusters", writeAbc)
+	input, err := os.ReadFile(dir + "random.links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(input) != "0 1 0.5\n2 3 0.25\n" {
+		t.Errorf("expected the similarities in the links format, got %q", input)
+	}
+	for _, inflation := range []string{"1.4", "2"} {
+		if _, err := os.Stat(dir + "input" + inflation); err != nil {
+			t.Errorf("expected the command to run with inflation %s: %v", inflation, err)
+		}
+	}
+	for _, gran := range []int{14, 20} {
+		dump, err := os.ReadFile(fmt.Sprintf("%sclusters.I%d", dir, gran))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the trajectories that are not in the output are singletons
+		if string(dump) != "0\t2\n1\n3\n" {
+			t.Errorf("expected the clustering in the format of mcxdump for granularity %d, got %q", gran, dump)
+		}
+	}
+}
@@ -20,153 +20,443 @@ package cluster
 
 import (
 	"bytes"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/exec"
+	"math"
 	"path/filepath"
 	"ptra/trajectory"
 	"ptra/utils"
+	"runtime"
 	"strconv"
 )
 
-// jaccardTrajectory computes the Jaccard similarity coefficient for two given trajectories.
-func jaccardTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+// JaccardTrajectory computes the Jaccard similarity coefficient for two given trajectories. It is the default
+// TrajectorySimilarity.
+func JaccardTrajectory(t1, t2 *trajectory.Trajectory) float64 {
 	// intersect t1 and t2
-	n := 0
-	for _, d1 := range t1.Diagnoses {
-		if utils.MemberInt(d1, t2.Diagnoses) {
-			n++
-		}
-	}
+	n := utils.IntersectionSize(t1.Diagnoses, t2.Diagnoses)
 	nt1 := len(t1.Diagnoses)
 	nt2 := len(t2.Diagnoses)
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
 	return float64(n) / (float64(nt1) + float64(nt2) - float64(n))
 }
 
 // SzymkiewiczSimpsonTrajectory computes the Szymkiewicz-Simpson similarity coefficient for two given trajectories.
 func SzymkiewiczSimpsonTrajectory(t1, t2 *trajectory.Trajectory) float64 {
-	n := 0
-	for _, d1 := range t1.Diagnoses {
-		if utils.MemberInt(d1, t2.Diagnoses) {
-			n++
-		}
-	}
+	n := utils.IntersectionSize(t1.Diagnoses, t2.Diagnoses)
 	nt1 := len(t1.Diagnoses)
 	nt2 := len(t2.Diagnoses)
-	return float64(n) / float64(utils.MinInt(nt1, nt2))
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return float64(n) / float64(utils.Min(nt1, nt2))
 }
 
-// SorensenDiceTrajectory computes the SorensenDice similarity coefficient for two given trajectories.
+// SorensenDiceTrajectory computes the Sorensen-Dice similarity coefficient for two given trajectories.
 func SorensenDiceTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	n := utils.IntersectionSize(t1.Diagnoses, t2.Diagnoses)
+	nt1 := len(t1.Diagnoses)
+	nt2 := len(t2.Diagnoses)
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return float64(2*n) / (float64(nt1 + nt2))
+}
+
+// ContainmentTrajectory computes the containment of a trajectory in another trajectory: the fraction of the distinct
+// diagnoses of t1 that also occur in t2. Unlike the other similarities, it is asymmetric, so that a trajectory that is
+// nested in a longer trajectory is fully contained in it, but not the other way around. E.g. D1 -> D2 is contained in
+// D1 -> D2 -> D3 with a similarity of 1, whereas D1 -> D2 -> D3 is contained in D1 -> D2 with a similarity of 2/3.
+func ContainmentTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	nt1 := utils.IntersectionSize(t1.Diagnoses, t1.Diagnoses)
+	if nt1 == 0 || len(t2.Diagnoses) == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return float64(utils.IntersectionSize(t1.Diagnoses, t2.Diagnoses)) / float64(nt1)
+}
+
+// directedSimilarity returns whether the similarities for the given options are asymmetric, cf. ContainmentSimilarity.
+// The similarities of both directions of each pair of trajectories are then written, and the similarity graph that is
+// clustered is directed. The similarities of a scorer or a similarity file, and a custom similarity function, are
+// assumed to be symmetric.
+func directedSimilarity(options Options) bool {
+	return options.Similarity == ContainmentSimilarity && options.ScorerPath == "" && options.SimilarityFile == "" &&
+		options.SimilarityFunc == nil
+}
+
+// writeAbcPair writes the similarity of the trajectories with IDs i and j in abc format. If directed is set, it also
+// writes the similarity in the other direction, cf. directedSimilarity.
+func writeAbcPair(w io.Writer, exp *trajectory.Experiment, similarity TrajectorySimilarity, i, j int, directed bool) {
+	t1, t2 := exp.Trajectories[i], exp.Trajectories[j]
+	fmt.Fprintf(w, "%d\t%d\t%f\n", i, j, similarity(t1, t2))
+	if directed {
+		fmt.Fprintf(w, "%d\t%d\t%f\n", j, i, similarity(t2, t1))
+	}
+}
+
+// transitionBigrams returns the set of the transitions of a trajectory, i.e. the pairs of consecutive diagnoses.
+func transitionBigrams(t *trajectory.Trajectory) utils.Set[[2]int] {
+	bigrams := utils.Set[[2]int]{}
+	for i := 1; i < len(t.Diagnoses); i++ {
+		bigrams.Add([2]int{t.Diagnoses[i-1], t.Diagnoses[i]})
+	}
+	return bigrams
+}
+
+// BigramTrajectory computes the Jaccard similarity coefficient of the transitions of two given trajectories, cf.
+// transitionBigrams, so that trajectories are similar when they share transitions rather than diagnoses. E.g. D1 -> D2
+// -> D3 and D3 -> D2 -> D1 have the same diagnoses, but no transitions in common.
+func BigramTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	b1, b2 := transitionBigrams(t1), transitionBigrams(t2)
+	if len(b1) == 0 || len(b2) == 0 { // trajectories without transitions are not similar to any trajectory
+		return 0
+	}
 	n := 0
-	for _, d1 := range t1.Diagnoses {
-		if utils.MemberInt(d1, t2.Diagnoses) {
+	for b := range b1 {
+		if b2.Contains(b) {
 			n++
 		}
 	}
-	nt1 := len(t1.Diagnoses)
-	nt2 := len(t2.Diagnoses)
-	return float64(2*n) / (float64(nt1 + nt2))
+	return float64(n) / float64(len(b1)+len(b2)-n)
 }
 
-// convertTrajectoriesToAbcFormat compute the jaccard between each trajectory and writes out the result to file.
-// Streaming algorithm to avoid pressure on memory.
-func convertTrajectoriesToAbcFormat(exp *trajectory.Experiment, name string) {
-	//create output file
-	file, err := os.Create(name)
-	if err != nil {
-		log.Panic(err)
+// rrWeights returns the weights of the diagnoses of a trajectory for the RR-weighted Jaccard similarity: the maximum RR
+// of the transitions of the trajectory from or to a diagnosis. The RRs that are not finite, and the diagnoses of a
+// trajectory without transitions, count as 1.
+func rrWeights(rr [][]float64, t *trajectory.Trajectory) map[int]float64 {
+	weights := make(map[int]float64, len(t.Diagnoses))
+	for i, d := range t.Diagnoses {
+		weights[d] = math.Max(weights[d], 0)
+		if i == 0 {
+			continue
+		}
+		w, d1 := 1.0, t.Diagnoses[i-1]
+		if d1 < len(rr) && d < len(rr[d1]) && !math.IsNaN(rr[d1][d]) && !math.IsInf(rr[d1][d], 0) {
+			w = rr[d1][d]
+		}
+		weights[d1] = math.Max(weights[d1], w)
+		weights[d] = math.Max(weights[d], w)
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Panic(err)
+	for d, w := range weights {
+		if w == 0 {
+			weights[d] = 1
 		}
-	}()
-	// compute the jacard index for the trajectories
-	for i, t1 := range exp.Trajectories {
-		t1.ID = i
-		for j := i + 1; j < len(exp.Trajectories); j++ {
-			t2 := exp.Trajectories[j]
-			t2.ID = j
-			coeff := jaccardTrajectory(t1, t2)
-			fmt.Fprintf(file, "%d\t%d\t%f\n", i, j, coeff)
+	}
+	return weights
+}
+
+// weightedJaccard computes the weighted Jaccard similarity coefficient of two weighted sets of diagnoses: the sum of
+// the minimum weights of the diagnoses divided by the sum of their maximum weights, where a missing diagnosis has
+// weight 0.
+func weightedJaccard(w1, w2 map[int]float64) float64 {
+	minSum, maxSum := 0.0, 0.0
+	for d, x := range w1 {
+		y := w2[d]
+		minSum += math.Min(x, y)
+		maxSum += math.Max(x, y)
+	}
+	for d, y := range w2 {
+		if _, ok := w1[d]; !ok {
+			maxSum += y
+		}
+	}
+	if maxSum == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return minSum / maxSum
+}
+
+// newRRWeightedJaccard returns a Jaccard similarity in which the diagnoses of the trajectories are weighted by the RRs
+// of their transitions in the experiment, cf. rrWeights. Sharing a diagnosis of a high-RR transition then contributes
+// more than sharing a diagnosis of a low-RR transition. With equal RRs, it is the Jaccard similarity. The weights of
+// the trajectories are computed once rather than for each pair of trajectories.
+func newRRWeightedJaccard(exp *trajectory.Experiment) TrajectorySimilarity {
+	weights := make(map[*trajectory.Trajectory]map[int]float64, len(exp.Trajectories))
+	for _, t := range exp.Trajectories {
+		weights[t] = rrWeights(exp.DxDRR, t)
+	}
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		w1, ok1 := weights[t1]
+		if !ok1 {
+			w1 = rrWeights(exp.DxDRR, t1)
+		}
+		w2, ok2 := weights[t2]
+		if !ok2 {
+			w2 = rrWeights(exp.DxDRR, t2)
+		}
+		return weightedJaccard(w1, w2)
+	}
+}
+
+// similarityBlockPairs is the number of pairs of trajectories per block of rows of the similarity matrix, cf.
+// similarityBlocks.
+const similarityBlockPairs = 1 << 16
+
+// similarityBlocks partitions the rows of the upper-triangular similarity matrix of n trajectories into blocks of
+// consecutive rows with at least similarityBlockPairs pairs each, except for the last block. Row i has the pairs of
+// trajectory i with the trajectories after it. It returns the first row of each block, followed by n.
+func similarityBlocks(n int) []int {
+	blocks := []int{0}
+	pairs := 0
+	for i := 0; i < n; i++ {
+		pairs += n - 1 - i
+		if pairs >= similarityBlockPairs && i+1 < n {
+			blocks = append(blocks, i+1)
+			pairs = 0
 		}
 	}
+	if n > 0 {
+		blocks = append(blocks, n)
+	}
+	return blocks
+}
+
+// writeTrajectoriesAbc computes the similarity between each trajectory and writes out the result in abc format to the
+// given writer. The blocks of rows of the upper-triangular similarity matrix, cf. similarityBlocks, are computed in
+// parallel by a pool of threads workers, or GOMAXPROCS workers if threads is 0, each into a buffer of its own. The
+// buffers are merged into the writer in the order of the blocks, so that the output is the same as computing the
+// pairs one by one. At most two blocks per worker are held in memory, so that the similarities are still streamed. If
+// directed is set, both directions of each pair are written, cf. directedSimilarity. If checkpoints is not nil, the
+// blocks are also written to its chunks, and the blocks of its valid chunks are read instead of computed.
+func writeTrajectoriesAbc(exp *trajectory.Experiment, w io.Writer, similarity TrajectorySimilarity, threads int,
+	directed bool, checkpoints *similarityCheckpoints) {
+	for i, t := range exp.Trajectories {
+		t.ID = i
+	}
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	blocks := similarityBlocks(len(exp.Trajectories))
+	if len(blocks) < 2 {
+		return
+	}
+	results := make([]chan *bytes.Buffer, len(blocks)-1)
+	for b := range results {
+		results[b] = make(chan *bytes.Buffer, 1)
+	}
+	jobs := make(chan int)
+	inFlight := make(chan struct{}, 2*threads)
+	go func() {
+		for b := range results {
+			inFlight <- struct{}{}
+			jobs <- b
+		}
+		close(jobs)
+	}()
+	for worker := 0; worker < threads; worker++ {
+		go func() {
+			for b := range jobs {
+				var buf bytes.Buffer
+				if checkpoints.resumed(b) {
+					buf.Write(checkpoints.read(b))
+					results[b] <- &buf
+					continue
+				}
+				for i := blocks[b]; i < blocks[b+1]; i++ {
+					for j := i + 1; j < len(exp.Trajectories); j++ {
+						writeAbcPair(&buf, exp, similarity, i, j, directed)
+					}
+				}
+				results[b] <- &buf
+			}
+		}()
+	}
+	for b, result := range results {
+		buf := <-result
+		checkpoints.write(b, buf.Bytes())
+		w.Write(buf.Bytes())
+		<-inFlight
+	}
+	checkpoints.complete()
 }
 
 // ClusterTrajectoriesDirectly performs clustering of the trajectories that have been calculated for a given experiment.
-// It does a pairwise comparison of all trajectories by calculating the jaccard similarity coefficients. Subsequently,
-// MCL clustering is used to group the trajectories by jaccard similarity into clusters.
-func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int, path, pathToMcl string) {
-	fmt.Println("Clustering trajectories directly with MCL")
+// It compares the pairs of trajectories with the similarity measure of the options, by default the jaccard similarity
+// coefficients, and groups the trajectories by similarity into clusters at each of the granularities of the options,
+// with MCL or the clusterer that the options select, cf. Options. The clusterings are written to a working dir in
+// path. It refuses to start, and returns an error, if the options are invalid, if the diagnosis IDs of the experiment
+// are inconsistent, cf. trajectory.ValidateExperiment, or if there is not enough disk space for the intermediate
+// files, cf. preflightDiskSpace. If one of the MCL tools fails, it returns an *MclError.
+func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, path string, options Options) error {
+	if err := trajectory.ValidateExperiment(exp); err != nil {
+		return err
+	}
+	if options.NullPercentile < 0 || options.NullPercentile >= 100 {
+		return fmt.Errorf("invalid null model percentile %v, expected a percentile between 0 and 100",
+			options.NullPercentile)
+	}
+	if options.Clusterer != nil {
+		utils.Info("Clustering trajectories directly with ", options.Clusterer.Name)
+	} else if options.Native {
+		utils.Info("Clustering trajectories directly with the native MCL")
+	} else {
+		utils.Info("Clustering trajectories directly with MCL")
+	}
 	// convert trajectories to abc format for the mcl tool
-	dirName := fmt.Sprintf("%s-clusters-directly/", exp.Name)
-	workingDir := filepath.Join(path, dirName) + string(filepath.Separator)
-	fmt.Println("Working path becomes: ", workingDir)
-	derr := os.MkdirAll(workingDir, 0777)
-	if derr != nil {
-		panic(derr)
-	}
-	// change working dir cause mcl program dumps files into working dir
-	os.Chdir(workingDir)
-	abcFileName := fmt.Sprintf("%s%s.abc", workingDir, exp.Name)
-	convertTrajectoriesToAbcFormat(exp, abcFileName)
-	tabFileName := fmt.Sprintf("%s%s.tab", workingDir, exp.Name)
-	mciFileName := fmt.Sprintf("%s%s.mci", workingDir, exp.Name)
-	mcxloadCmd := fmt.Sprintf("%smcxload", pathToMcl)
-	cmd := exec.Command(mcxloadCmd, "-abc", abcFileName, "--stream-mirror", "-write-tab", tabFileName, "-o", mciFileName)
-	var out bytes.Buffer
-	var serr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &serr
-	err := cmd.Run()
-	if err != nil {
-		panic(err)
+	workingDir := clusteringDir(path, fmt.Sprintf("%s-clusters-directly/", exp.Name))
+	var candidates [][]int
+	nofPairs := allPairs(len(exp.Trajectories))
+	if options.LSHBands > 0 {
+		if options.ScorerPath != "" {
+			utils.Warning("LSH is not supported with a scorer, computing the similarities of all pairs instead.")
+		} else {
+			candidates, nofPairs = lshCandidates(exp, options.LSHBands, options.LSHRows)
+		}
 	}
-	fmt.Println("Output: ", out.String(), serr.String())
-	// run the clusterings with different granularities
-	for _, gran := range granularities {
-		mcl_cmd := fmt.Sprintf("%smcl", pathToMcl)
-		cmd := exec.Command(mcl_cmd, mciFileName, "-I", fmt.Sprintf("%f", float64(gran)/10.0))
-		var out2 bytes.Buffer
-		var serr2 bytes.Buffer
-		cmd.Stdout = &out2
-		cmd.Stderr = &serr2
-		fmt.Println("Output: ", out2.String(), serr2.String())
-		err := cmd.Run()
-		if err != nil {
-			panic(err)
+	if err := preflightDiskSpace(exp, workingDir, nofPairs, &options); err != nil {
+		return err
+	}
+	var similarity TrajectorySimilarity
+	if options.ScorerPath == "" || options.SoftThreshold > 0 || hasSizeConstraints(options) {
+		similarity = clusteringSimilarity(exp, options)
+	}
+	directed := directedSimilarity(options)
+	writeAbc := func(w io.Writer) {
+		if options.ScorerPath != "" {
+			writeTrajectoriesAbcWithScorer(exp, options.ScorerPath, w)
+		} else if candidates != nil {
+			writeTrajectoriesAbcLSH(exp, w, similarity, candidates, directed)
+		} else {
+			var checkpoints *similarityCheckpoints
+			if options.CheckpointDir != "" {
+				checkpoints = openSimilarityCheckpoints(exp, options)
+			}
+			writeTrajectoriesAbc(exp, w, similarity, options.Threads, directed, checkpoints)
 		}
 	}
-	// convert the clusterings to readable format
-	clusterFileName := fmt.Sprintf("out.%s.mci", exp.Name)
-	outFileName := fmt.Sprintf("dump.%s.mci", exp.Name)
-	mcxdumpCmd := fmt.Sprintf("%smcxdump", pathToMcl)
-	for _, gran := range granularities {
-		cmd := exec.Command(mcxdumpCmd, "-icl", fmt.Sprintf("%s.I%d", clusterFileName, gran), "-tabr", tabFileName, "-o", fmt.Sprintf("%s.I%d", outFileName, gran))
-		fmt.Println(mcxdumpCmd, "-icl", fmt.Sprintf("%s.I%d", clusterFileName, gran), "-tabr", tabFileName, "-o", fmt.Sprintf("%s.I%d", outFileName, gran))
-		var out1 bytes.Buffer
-		var serr1 bytes.Buffer
-		cmd.Stdout = &out1
-		cmd.Stderr = &serr1
-		err := cmd.Run()
-		fmt.Println("Output: ", out1.String(), serr1.String())
+	if options.CheckpointDir != "" && (options.ScorerPath != "" || candidates != nil) {
+		utils.Warning("only the similarities of all pairs of trajectories are checkpointed, computing them without " +
+			"checkpoints.")
+	}
+	if options.CacheDir != "" {
+		cacheFileName, ok, err := similarityCacheFileName(exp, options)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if ok {
+			writeAbc = withSimilarityCache(cacheFileName, writeAbc)
+		} else {
+			utils.Warning("the similarities of a custom similarity function are not cached.")
+		}
+	}
+	if options.NullPercentile > 0 {
+		if options.ScorerPath != "" || options.SimilarityFile != "" {
+			utils.Warning("the null model requires a similarity that ptra computes, clustering without the null model.")
+		} else if (options.SimilarityFunc == nil && options.Similarity == PatientSimilarity) ||
+			options.PatientWeight > 0 {
+			utils.Warning("the null model only shuffles the diagnoses of the trajectories, not their patients, " +
+				"clustering without the null model.")
+		} else if cutoff := nullModelCutoff(exp, options, options.NullPercentile); cutoff > options.MinSimilarity {
+			options.MinSimilarity = cutoff
 		}
 	}
-	// convert the clusterings generated by mcl tool to gml format
-	for _, gran := range granularities {
+	if options.MinSimilarity > 0 {
+		writeAbc = withSimilarityCutoff(trajectoryIDs(exp), options.MinSimilarity, writeAbc)
+	}
+	if options.GraphML {
+		writeAbc = withSimilarityGraph(exp, fmt.Sprintf("%s%s.similarities.graphml", workingDir, exp.Name),
+			options.GraphThreshold, directed, writeAbc)
+	}
+	if len(options.MatrixFormats) > 0 {
+		writeAbc = withSimilarityMatrix(exp, fmt.Sprintf("%s%s.similarities", workingDir, exp.Name),
+			options.MatrixFormats, directed, writeAbc)
+	}
+	outFileName := fmt.Sprintf("%sdump.%s.mci", workingDir, exp.Name)
+	if options.Clusterer != nil {
+		runExternalClusterer(options.Clusterer, exp, options.Granularities, workingDir, outFileName, writeAbc)
+	} else if options.Native {
+		if err := runNativeMcl(exp, options.Granularities, outFileName, directed, writeAbc); err != nil {
+			return err
+		}
+	} else if err := runMcl(exp, options, workingDir, outFileName, writeAbc); err != nil {
+		return err
+	}
+	if hasSizeConstraints(options) {
+		if options.ScorerPath != "" {
+			utils.Warning("the cluster size constraints use the similarity ", options.Similarity,
+				" instead of the scorer.")
+		}
+		constraints := &sizeConstraints{exp: exp, options: options, workingDir: workingDir, similarity: similarity}
+		for _, gran := range options.Granularities {
+			if err := constraints.constrainClusterSizes(fmt.Sprintf("%s.I%d", outFileName, gran), gran); err != nil {
+				return err
+			}
+		}
+	}
+	// convert the clusterings generated by mcl or the external clusterer to gml format
+	for _, gran := range options.Granularities {
 		dumpFileName := fmt.Sprintf("%s.I%d", outFileName, gran)
-		convertToDirectTrajectoryClusterGraphs(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
-		convertToDirectTrajectoryClusterGraphsRR(exp, dumpFileName, fmt.Sprintf("%s.trajectories.RR.gml", dumpFileName))
+		clusters := readMclClusters(exp, dumpFileName)
+		if options.SoftThreshold > 0 {
+			assignSoftMemberships(exp, clusters, similarity, options.SoftThreshold)
+		}
+		convertToDirectTrajectoryClusterGraphs(exp, fmt.Sprintf("%s.trajectories.gml", dumpFileName),
+			options.SplitGraphs, options.BundleEdges)
+		convertToDirectTrajectoryClusterGraphsRR(exp, fmt.Sprintf("%s.trajectories.RR.gml", dumpFileName),
+			options.SplitGraphs, options.BundleEdges)
 		trajectory.PrintClusteredTrajectoriesToFile(exp, fmt.Sprintf("%s.clustered.trajectories.tab", dumpFileName))
 		trajectory.PrintClustersToCSVFiles(exp, fmt.Sprintf("%s.clustered.patients.csv", dumpFileName),
 			fmt.Sprintf("%s.clustered.clusters.csv", dumpFileName))
+		trajectory.PrintClusterAlignmentsToFile(exp, fmt.Sprintf("%s.clustered.alignment.tab", dumpFileName))
+		trajectory.PrintClusterNamesToCSVFile(trajectory.MatchClusterNames(exp, options.ClusterNames),
+			fmt.Sprintf("%s.clustered.names.csv", dumpFileName))
+		trajectory.PrintClusterCoverageToCSVFile(exp, fmt.Sprintf("%s.clustered.coverage.csv", dumpFileName))
+		trajectory.PrintClusterOverlapToCSVFiles(exp, fmt.Sprintf("%s.clustered.overlap.csv", dumpFileName),
+			fmt.Sprintf("%s.clustered.patient-clusters.csv", dumpFileName))
+		trajectory.PrintClusterChapterCompositionsToFiles(exp, fmt.Sprintf("%s.clustered.chapters.csv", dumpFileName),
+			fmt.Sprintf("%s.clustered.chapters.json", dumpFileName))
+		if exp.Literature != nil {
+			trajectory.PrintClusterLiteratureToCSVFile(exp, fmt.Sprintf("%s.clustered.literature.csv", dumpFileName))
+		}
+		if options.OMOPConcepts != nil {
+			trajectory.PrintClusterCohortDefinitionsToFiles(exp, options.OMOPConcepts,
+				fmt.Sprintf("%s.clustered.cohorts", dumpFileName))
+		}
+		metadata := map[string]string{"granularity": strconv.Itoa(gran)}
+		if options.MinSimilarity > 0 {
+			metadata["minSimilarity"] = strconv.FormatFloat(options.MinSimilarity, 'f', -1, 64)
+		}
+		if options.NullPercentile > 0 {
+			metadata["nullPercentile"] = strconv.FormatFloat(options.NullPercentile, 'f', -1, 64)
+		}
+		for key, value := range options.Metadata {
+			metadata[key] = value
+		}
+		if err := trajectory.WritePtraFile(fmt.Sprintf("%s.clustered.ptra", dumpFileName), exp, true,
+			metadata); err != nil {
+			log.Panic(err)
+		}
+		if options.BootstrapRuns > 0 {
+			trajectory.PrintClusterStatisticsToCSVFile(exp, fmt.Sprintf("%s.clustered.statistics.csv", dumpFileName),
+				options.BootstrapRuns)
+		}
+		if options.Figures > 0 {
+			trajectory.PrintClusterFiguresToPDFFile(exp, fmt.Sprintf("%s.clustered.figures.pdf", dumpFileName),
+				options.Figures)
+		}
+	}
+	// the legend of the colors of the EOI enrichments of the edges in the gml files
+	trajectory.PrintEOIColorScaleToCSVFile(filepath.Join(workingDir, "eoi-color-scale.csv"))
+	return nil
+}
+
+// runMcl clusters the trajectories with MCL for each of the granularities in options. The similarities are produced
+// by writeAbc. The clusterings are converted with mcxdump to files outFileName.I<granularity> in the working dir, with a
+// line per cluster that lists the IDs of its trajectories. If one of the MCL tools fails, it returns an *MclError.
+func runMcl(exp *trajectory.Experiment, options Options, workingDir, outFileName string,
+	writeAbc func(w io.Writer)) error {
+	abcFileName := fmt.Sprintf("%s%s.abc", workingDir, exp.Name)
+	tabFileName := fmt.Sprintf("%s%s.tab", workingDir, exp.Name)
+	mciFileName := fmt.Sprintf("%s%s.mci", workingDir, exp.Name)
+	if err := mcxloadAbc(options, workingDir, abcFileName, tabFileName, mciFileName, directedSimilarity(options),
+		writeAbc); err != nil {
+		return err
 	}
+	clusterFileName := fmt.Sprintf("out.%s.mci", exp.Name)
+	return runMclGranularities(options, workingDir, tabFileName, mciFileName, clusterFileName, outFileName)
 }
 
 // collectTrajectoriesFromClusterData looks up trajectories associated with a given list of trajectory ids and assigns
@@ -174,109 +464,119 @@ func ClusterTrajectoriesDirectly(exp *trajectory.Experiment, granularities []int
 func collectTrajectoriesFromClusterData(exp *trajectory.Experiment, ids []int, clusterID int) []*trajectory.Trajectory {
 	ts := []*trajectory.Trajectory{}
 	for _, id := range ids {
-		// assign cluster label to trajectory
+		// assign cluster label to trajectory, soft memberships of a previous clustering are reset
 		exp.Trajectories[id].Cluster = clusterID
+		exp.Trajectories[id].Memberships = nil
 		ts = append(ts, exp.Trajectories[id])
 	}
 	return ts
 }
 
-// convertToDirectTrajectoryClusterGraphs produces a GML graph file for the clustered trajectories in an experiment. For
-// this, it parses the cluster output from MCL, which is a file that lists for each cluster id a list of trajectory ids
-// that are assigned to it. Then it looks up the concrete trajectory objects for each trajectory id. Finally, each
-// cluster is written to the output file by writing all of the cluster's trajectories as part of a subgraph for that
-// cluster.
-func convertToDirectTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output string) {
-	file, err := os.Open(input)
+// readMclClusters parses the cluster output from MCL, which is a file that lists for each cluster id a list of
+// trajectory ids that are assigned to it. Then it looks up the concrete trajectory objects for each trajectory id and
+// assigns them to their clusters. The clusters are numbered in the canonical order of trajectory.SortClusters. It
+// returns the trajectories per cluster.
+func readMclClusters(exp *trajectory.Experiment, input string) [][]*trajectory.Trajectory {
+	ids, err := trajectory.ReadMclDumpFile(input)
 	if err != nil {
 		panic(err)
 	}
-	ofile, oerr := os.Create(output)
-	if oerr != nil {
-		panic(oerr)
+	if err := trajectory.ValidateClusters(exp, ids); err != nil {
+		panic(fmt.Errorf("%s: %v", input, err))
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
-		}
-		if oerr := ofile.Close(); oerr != nil {
-			panic(oerr)
-		}
-	}()
-	// trajectories to assign to clusters
-	nofClusters := 0
-
-	// parse file
-	reader := csv.NewReader(file)
-	reader.Comma = '\t'
-	reader.FieldsPerRecord = -1
-	reader.LazyQuotes = true
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		// collect codes in the cluster
-		var codes []int
-		for _, rcode := range record {
-			code, err := strconv.Atoi(rcode)
-			if err != nil {
-				panic(err)
-			}
-			codes = append(codes, code)
-		}
-		// print the trajectories in the cluster
-		collected := collectTrajectoriesFromClusterData(exp, codes, nofClusters)
-		nofClusters++
-		// print this cluster
-		// print header
-		fmt.Fprintf(ofile, "graph [ \n directed 1 \n multigraph 1\n")
-		nodePrinted := map[int]bool{}
-		// print nodes
-		for _, t := range collected {
-			for _, node := range t.Diagnoses {
-				if _, ok := nodePrinted[node]; !ok {
-					fmt.Fprintf(ofile, fmt.Sprintf("node [ id %d\n label \"%s\"\n ]\n", node, exp.NameMap[node]))
-					nodePrinted[node] = true
+	trajectory.SortClusters(ids)
+	clusters := [][]*trajectory.Trajectory{}
+	for _, codes := range ids {
+		clusters = append(clusters, collectTrajectoriesFromClusterData(exp, codes, len(clusters)))
+	}
+	return clusters
+}
+
+// edgeWeightAttribute returns for soft clustering a GML weight attribute for the edge d1 -> d2 in a cluster. The weight
+// is the largest membership weight of the cluster's trajectories that contain the edge. For hard clustering, it
+// returns an empty string.
+func edgeWeightAttribute(exp *trajectory.Experiment, ts []*trajectory.Trajectory, cluster, d1, d2 int) string {
+	if !trajectory.SoftClustered(exp) {
+		return ""
+	}
+	weight := 0.0
+	for _, t := range ts {
+		for i := 1; i < len(t.Diagnoses); i++ {
+			if t.Diagnoses[i-1] == d1 && t.Diagnoses[i] == d2 {
+				for _, m := range trajectory.ClusterMemberships(t) {
+					if m.Cluster == cluster && m.Weight > weight {
+						weight = m.Weight
+					}
 				}
 			}
 		}
-		// print edges
-		edgePrinted := make([][][]int, exp.NofDiagnosisCodes)
-		for i, _ := range edgePrinted {
-			edgePrinted[i] = make([][]int, exp.NofDiagnosisCodes)
-		}
-		for _, t := range collected {
-			d1 := t.Diagnoses[0]
-			for i := 1; i < len(t.Diagnoses); i++ {
-				d2 := t.Diagnoses[i]
-				n := t.PatientNumbers[i-1]
-				printed := edgePrinted[d1][d2]
-				if !utils.MemberInt(n, printed) {
-					fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %d\n]\n", d1, d2, n))
-					if printed == nil {
-						edgePrinted[d1][d2] = []int{n}
-					} else {
-						edgePrinted[d1][d2] = append(edgePrinted[d1][d2], n)
-					}
+	}
+	return fmt.Sprintf("weight %.3f\n", weight)
+}
+
+// convertToDirectTrajectoryClusterGraphs produces a GML graph file for the clustered trajectories in an experiment.
+// Each cluster is written to the output file by writing all of the cluster's trajectories as part of a subgraph for
+// that cluster. For soft clustering, a trajectory is written in each cluster it belongs to, and the edges are
+// annotated with membership weights. If split is true, each cluster is written to its own file, cf. writeClusterGraphs.
+// If bundle is true, the parallel edges of a transition are bundled into one edge, cf. writeBundledClusterGraph.
+func convertToDirectTrajectoryClusterGraphs(exp *trajectory.Experiment, output string, split, bundle bool) {
+	if bundle {
+		writeClusterGraphs(exp, output, split, writeBundledClusterGraph(false))
+		return
+	}
+	writeClusterGraphs(exp, output, split, writeClusterGraph)
+}
+
+// writeClusterGraph writes the trajectories of a cluster as a GML graph, with the patient numbers as edge labels.
+func writeClusterGraph(ofile io.Writer, exp *trajectory.Experiment, cid int, collected []*trajectory.Trajectory) {
+	// print header
+	fmt.Fprintf(ofile, "graph [ \n directed 1 \n multigraph 1\n")
+	nodePrinted := map[int]bool{}
+	// print nodes
+	for _, t := range collected {
+		for _, node := range t.Diagnoses {
+			if _, ok := nodePrinted[node]; !ok {
+				fmt.Fprintf(ofile, fmt.Sprintf("node [ id %d\n label \"%s\"\n ]\n", node, exp.NameMap[node]))
+				nodePrinted[node] = true
+			}
+		}
+	}
+	// print edges
+	enrichments := clusterEOIEnrichments(exp, collected)
+	edgePrinted := make([][][]int, exp.NofDiagnosisCodes)
+	for i, _ := range edgePrinted {
+		edgePrinted[i] = make([][]int, exp.NofDiagnosisCodes)
+	}
+	for _, t := range collected {
+		if len(t.Diagnoses) == 0 { // skipped, cf. writeClusterGraphs
+			continue
+		}
+		d1 := t.Diagnoses[0]
+		for i := 1; i < len(t.Diagnoses); i++ {
+			d2 := t.Diagnoses[i]
+			n := t.PatientNumbers[i-1]
+			printed := edgePrinted[d1][d2]
+			if !utils.Member(n, printed) {
+				fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %d\n%s%s%s]\n", d1, d2, n,
+					edgeWeightAttribute(exp, collected, cid, d1, d2), eoiEnrichmentAttribute(enrichments, d1, d2),
+					directionAttribute(exp, d1, d2)))
+				if printed == nil {
+					edgePrinted[d1][d2] = []int{n}
+				} else {
+					edgePrinted[d1][d2] = append(edgePrinted[d1][d2], n)
 				}
-				d1 = d2
 			}
+			d1 = d2
 		}
-		fmt.Fprintf(ofile, "]\n")
 	}
-	fmt.Println("For ", output)
-	fmt.Println("Collected ", nofClusters, " clusters")
+	fmt.Fprintf(ofile, "]\n")
 }
 
 // percentMalesFemales computes for a given list of patients the percentage of males and females wrt to the total number
-// of males and females in the experiment.
-func percentMalesFemales(exp *trajectory.Experiment, ps []*trajectory.Patient) (float64, float64) {
-	m := 0
-	f := 0
+// of males and females in the experiment. If the experiment has no males or no females, the corresponding percentage is
+// NaN and false is returned.
+func percentMalesFemales(exp *trajectory.Experiment, ps []*trajectory.Patient) (float64, float64, bool) {
+	var m, f int64
 	for _, p := range ps {
 		if p.Sex == trajectory.Male {
 			m++
@@ -284,7 +584,9 @@ func percentMalesFemales(exp *trajectory.Experiment, ps []*trajectory.Patient) (
 			f++
 		}
 	}
-	return (100.0 / float64(exp.MCtr)) * float64(m), (100.0 / float64(exp.FCtr)) * float64((f))
+	mp, mok := utils.Percentage(m, int64(exp.MCtr))
+	fp, fok := utils.Percentage(f, int64(exp.FCtr))
+	return mp, fp, mok && fok
 }
 
 // getDiagnosisDate returns the concrete diagnosis date for a given pair of diagnosis ids.
@@ -304,113 +606,93 @@ func getDiagnosisDate(p *trajectory.Patient, d1, d2 int) trajectory.DiagnosisDat
 }
 
 // percentEOI computes percent of patients that have their event of interest at the time of the transition of disease
-// d1 -> d2
-func percentEOI(exp *trajectory.Experiment, ps []*trajectory.Patient, d1, d2 int) float64 {
-	eoictr := 0
+// d1 -> d2. For an empty list of patients, the percentage is NaN and false is returned.
+func percentEOI(exp *trajectory.Experiment, ps []*trajectory.Patient, d1, d2 int) (float64, bool) {
+	var eoictr int64
 	for _, p := range ps {
 		d := getDiagnosisDate(p, d1, d2)
 		if p.EOIDate != nil && trajectory.DiagnosisDateSmallerThan(*p.EOIDate, d) {
 			eoictr++
 		}
 	}
-	return (100.0 / float64(len(ps))) * float64(eoictr)
+	return utils.Percentage(eoictr, int64(len(ps)))
 }
 
+// transitionInformation returns the RR, the male/female ratio, and the EOI percentage for the i-th transition d1 -> d2
+// of a trajectory. Statistics that are undefined for the transition are returned as NA and reported with a warning.
 func transitionInformation(exp *trajectory.Experiment, t *trajectory.Trajectory, i, d1, d2 int) (string, string, string) {
 	rr := strconv.FormatFloat(exp.DxDRR[d1][d2], 'f', 2, 64)
-	m, f := percentMalesFemales(exp, t.Patients[i])
-	mfratio := strconv.FormatFloat(m/f, 'f', 2, 64)
-	eoi := strconv.FormatFloat(percentEOI(exp, t.Patients[i], d1, d2), 'f', 0, 64)
+	m, f, ok := percentMalesFemales(exp, t.Patients[i])
+	mfratio := "NA"
+	if ok && f > 0 {
+		mfratio = utils.FormatStat(m/f, 2)
+	} else {
+		utils.Warning("M/F ratio undefined for transition ", d1, " -> ", d2, ", omitted.")
+	}
+	eoiPercent, ok := percentEOI(exp, t.Patients[i], d1, d2)
+	if !ok {
+		utils.Warning("no patients for transition ", d1, " -> ", d2, ", EOI percentage omitted.")
+	}
+	eoi := utils.FormatStat(eoiPercent, 0)
 	return rr, mfratio, eoi
 }
 
-// convertToDirectTrajectoryClusterGraphsRR converts MCL cluster output - a file with for each cluster id a list of
-// trajectory ids - to a GML output file that plots the trajectories as graphs. Each cluster is plotted as a separate
-// subgraph, with diagnosis codes used as nodes and trajectory transitions used as edges. The edges are annotated with
-// the relatitive risk score (RR) associated with the diagnosis pair that the edge represents.
-func convertToDirectTrajectoryClusterGraphsRR(exp *trajectory.Experiment, input, output string) {
-	file, err := os.Open(input)
-	if err != nil {
-		panic(err)
-	}
-	ofile, oerr := os.Create(output)
-	if oerr != nil {
-		panic(oerr)
+// convertToDirectTrajectoryClusterGraphsRR converts the clustered trajectories of an experiment to a GML output file
+// that plots the trajectories as graphs. Each cluster is plotted as a separate subgraph, with diagnosis codes used as
+// nodes and trajectory transitions used as edges. The edges are annotated with the relatitive risk score (RR)
+// associated with the diagnosis pair that the edge represents, and for soft clustering with membership weights. If
+// split is true, each cluster is written to its own file, cf. writeClusterGraphs. If bundle is true, the edges also have
+// the summed patient numbers and the number of trajectories as attributes, cf. writeBundledClusterGraph.
+func convertToDirectTrajectoryClusterGraphsRR(exp *trajectory.Experiment, output string, split, bundle bool) {
+	if bundle {
+		writeClusterGraphs(exp, output, split, writeBundledClusterGraph(true))
+		return
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
-		}
-		if oerr := ofile.Close(); oerr != nil {
-			panic(oerr)
-		}
-	}()
-	// trajectories to assign to clusters
-	nofClusters := 0
-
-	// parse file
-	reader := csv.NewReader(file)
-	reader.Comma = '\t'
-	reader.FieldsPerRecord = -1
-	reader.LazyQuotes = true
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			panic(err)
-		}
-		// collect codes in the cluster
-		var codes []int
-		for _, rcode := range record {
-			code, err := strconv.Atoi(rcode)
-			if err != nil {
-				panic(err)
-			}
-			codes = append(codes, code)
-		}
-		// print the trajectories in the cluster
-		collected := collectTrajectoriesFromClusterData(exp, codes, nofClusters)
-		nofClusters++
-		// print this cluster
-		// print header
-		fmt.Fprintf(ofile,
-			fmt.Sprintf("graph [ \n comment \"cluster %d\" \n directed 1 \n label \"cluster %d\" \n "+
-				"multigraph 1\n", nofClusters-1, nofClusters-1))
-		nodePrinted := map[int]bool{}
-		// print nodes
-		for _, t := range collected {
-			for _, node := range t.Diagnoses {
-				if _, ok := nodePrinted[node]; !ok {
-					fmt.Fprintf(ofile, fmt.Sprintf("node [ id %d\n label \"%s\"\n ]\n", node, exp.NameMap[node]))
-					nodePrinted[node] = true
-				}
+	writeClusterGraphs(exp, output, split, writeClusterGraphRR)
+}
+
+// writeClusterGraphRR writes the trajectories of a cluster as a GML graph, with the RR scores as edge labels.
+func writeClusterGraphRR(ofile io.Writer, exp *trajectory.Experiment, cid int, collected []*trajectory.Trajectory) {
+	// print header
+	fmt.Fprintf(ofile,
+		fmt.Sprintf("graph [ \n comment \"cluster %d\" \n directed 1 \n label \"cluster %d\" \n "+
+			"multigraph 1\n", cid, cid))
+	nodePrinted := map[int]bool{}
+	// print nodes
+	for _, t := range collected {
+		for _, node := range t.Diagnoses {
+			if _, ok := nodePrinted[node]; !ok {
+				fmt.Fprintf(ofile, fmt.Sprintf("node [ id %d\n label \"%s\"\n ]\n", node, exp.NameMap[node]))
+				nodePrinted[node] = true
 			}
 		}
-		// print edges
-		edgePrinted := make([][]bool, exp.NofDiagnosisCodes)
-		for i, _ := range edgePrinted {
-			edgePrinted[i] = make([]bool, exp.NofDiagnosisCodes)
-		}
-		for _, t := range collected {
-			d1 := t.Diagnoses[0]
-			tctr := 0
-			for i := 1; i < len(t.Diagnoses); i++ {
-				d2 := t.Diagnoses[i]
-				if !edgePrinted[d1][d2] {
-					edgePrinted[d1][d2] = true
-					RR := strconv.FormatFloat(exp.DxDRR[d1][d2], 'f', 2, 64)
-					fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %s\n]\n", d1, d2, RR))
-					//rr, mfratio, eoi := transitionInformation(exp, t, tctr, d1, d2)
-					//fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel \"RR:%s,M/F:%s,EOI:%s\"\n]\n", d1, d2, rr, mfratio, eoi))
-				}
-				d1 = d2
-				tctr++
+	}
+	// print edges
+	enrichments := clusterEOIEnrichments(exp, collected)
+	edgePrinted := make([][]bool, exp.NofDiagnosisCodes)
+	for i, _ := range edgePrinted {
+		edgePrinted[i] = make([]bool, exp.NofDiagnosisCodes)
+	}
+	for _, t := range collected {
+		if len(t.Diagnoses) == 0 { // skipped, cf. writeClusterGraphs
+			continue
+		}
+		d1 := t.Diagnoses[0]
+		tctr := 0
+		for i := 1; i < len(t.Diagnoses); i++ {
+			d2 := t.Diagnoses[i]
+			if !edgePrinted[d1][d2] {
+				edgePrinted[d1][d2] = true
+				RR := strconv.FormatFloat(exp.DxDRR[d1][d2], 'f', 2, 64)
+				fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %s\n%s%s%s]\n", d1, d2, RR,
+					edgeWeightAttribute(exp, collected, cid, d1, d2), eoiEnrichmentAttribute(enrichments, d1, d2),
+					directionAttribute(exp, d1, d2)))
+				//rr, mfratio, eoi := transitionInformation(exp, t, tctr, d1, d2)
+				//fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel \"RR:%s,M/F:%s,EOI:%s\"\n]\n", d1, d2, rr, mfratio, eoi))
 			}
+			d1 = d2
+			tctr++
 		}
-		fmt.Fprintf(ofile, "]\n")
 	}
-	fmt.Println("For ", output)
-	fmt.Println("Collected ", nofClusters, " clusters")
+	fmt.Fprintf(ofile, "]\n")
 }
@@ -19,17 +19,17 @@
 package cluster
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"ptra/trajectory"
 	"ptra/utils"
 	"strconv"
+	"strings"
 )
 
 // Clustering as in Brunak paper
@@ -47,12 +47,17 @@ import (
 // the total number of trajectories B belongs to
 // the total number of trajectories A->B belongs to
 func computeTotalOccurencesPairs(exp *trajectory.Experiment) ([]int, [][]int) {
+	trajectory.WarnSkippedTrajectories(trajectory.CountEmptyTrajectories(exp.Trajectories),
+		"counting diagnosis pairs")
 	diagnosisCounts := make([]int, exp.NofDiagnosisCodes)
 	pairCounts := make([][]int, exp.NofDiagnosisCodes)
 	for i, _ := range pairCounts {
 		pairCounts[i] = make([]int, exp.NofDiagnosisCodes)
 	}
 	for _, t := range exp.Trajectories {
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
 		d1 := t.Diagnoses[0]
 		diagnosisCounts[d1]++
 		for j := 1; j < len(t.Diagnoses); j++ {
@@ -87,94 +92,180 @@ func computeJaccardIndexForPairs(exp *trajectory.Experiment) [][]float64 {
 	return index
 }
 
-func convertTrajectoryPairsToAbcFormat(exp *trajectory.Experiment, name string) {
-	//create output file
-	file, err := os.Create(name)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Panic(err)
-		}
-	}()
-
+// writeTrajectoryPairsAbc computes the jaccard index for the pairs and writes them as part of the same graph in abc
+// format to the given writer.
+func writeTrajectoryPairsAbc(exp *trajectory.Experiment, w io.Writer) {
 	// compute the jacard index for the pairs
 	jaccardIndex := computeJaccardIndexForPairs(exp)
 	// plot pairs as part of the same graph
 	for d1, d2s := range jaccardIndex {
 		for d2, coeff := range d2s {
 			if coeff >= 0 {
-				fmt.Fprintf(file, "%d\t%d\t%f\n", d1, d2, coeff)
+				fmt.Fprintf(w, "%d\t%d\t%f\n", d1, d2, coeff)
 			}
 		}
 	}
 }
 
-func ClusterTrajectories(exp *trajectory.Experiment, granularities []int, path, pathToMcl string) {
-	fmt.Println("Clustering trajectories with MCL")
-	// convert trajectories to abc format for the mcl tool
-	dirName := fmt.Sprintf("%s-clusters/", exp.Name)
-	workingDir := filepath.Join(path, dirName) + string(filepath.Separator)
-	fmt.Println("Working path becomes: ", workingDir)
-	derr := os.MkdirAll(workingDir, 0777)
-	if derr != nil {
-		panic(derr)
-	}
-	// change working dir cause mcl program dumps files into working dir
-	os.Chdir(workingDir)
-	abcFileName := fmt.Sprintf("%s%s.abc", workingDir, exp.Name)
-	convertTrajectoryPairsToAbcFormat(exp, abcFileName)
-	tabFileName := fmt.Sprintf("%s%s.tab", workingDir, exp.Name)
-	mciFileName := fmt.Sprintf("%s%s.mci", workingDir, exp.Name)
-	mcxloadCmd := fmt.Sprintf("%smcxload", pathToMcl)
-	cmd := exec.Command(mcxloadCmd, "-abc", abcFileName, "--stream-mirror", "-write-tab", tabFileName, "-o", mciFileName)
-	var out bytes.Buffer
-	var serr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &serr
-	err := cmd.Run()
+// Options configures how trajectories are clustered with the external MCL tool.
+type Options struct {
+	Granularities  []int                    // the granularities (inflation x 10) used for the mcl clustering step
+	MclPath        string                   // the path where the mcl binaries can be found
+	MclLimits      map[string]ProcessLimits // per MCL tool, the resource limits of its processes, cf. ParseMclLimits
+	AbcFile        bool                     // write the similarities to an intermediate .abc file instead of streaming them into mcxload
+	ScorerPath     string                   // an external executable that computes the trajectory similarities, cf. writeScorerInput
+	Similarity     string                   // the trajectory similarity measure, e.g. JaccardSimilarity or SemanticSimilarity
+	SimilarityFunc TrajectorySimilarity     // if not nil, a custom trajectory similarity measure that replaces Similarity
+	SimilarityFile string                   // a file with pre-computed similarities that replace Similarity, cf. ReadSimilarityFile
+	SoftThreshold  float64                  // if > 0, soft clustering with this minimum membership weight, cf. assignSoftMemberships
+	MinClusterSize int                      // if > 0, smaller clusters are merged into their nearest neighbor, cf. sizeConstraints
+	MaxClusterSize int                      // if > 0, larger clusters are re-clustered at a higher inflation, cf. sizeConstraints
+	SplitGraphs    bool                     // write each cluster graph to its own GML file, cf. writeClusterGraphs
+	BundleEdges    bool                     // write one edge per transition in the cluster graphs, cf. writeBundledClusterGraph
+	BootstrapRuns  int                      // number of bootstrap runs for the cluster statistics, 0 to skip them
+	Figures        int                      // number of largest clusters in the PDF figure bundle, cf. PrintClusterFiguresToPDFFile
+	TemporalWeight float64                  // weight of the rate-of-progression features in the similarity, cf. withTemporalFeatures
+	PatientWeight  float64                  // weight of the patient overlap in the similarity, cf. withPatientOverlap
+	GraphML        bool                     // also write the similarity graph as GraphML, cf. withSimilarityGraph
+	GraphThreshold float64                  // the similarity above which pairs of trajectories are edges in the GraphML graph
+	MinSimilarity  float64                  // if > 0, only the similarities above it are clustered, cf. withSimilarityCutoff
+	NullPercentile float64                  // if in (0, 100), only similarities above this null model percentile are clustered
+	LSHBands       int                      // if > 0, only candidate pairs are compared, cf. lshCandidates
+	LSHRows        int                      // the number of rows per band of the MinHash signatures for LSH
+	Threads        int                      // the number of workers that compute the similarities, 0 for GOMAXPROCS
+	CacheDir       string                   // if set, the similarities are cached in this directory, cf. withSimilarityCache
+	CheckpointDir  string                   // if set, the similarities are checkpointed in this directory, cf. similarityCheckpoints
+	MatrixFormats  []string                 // the formats in which the similarity matrix is also written, cf. withSimilarityMatrix
+	ClusterNames   trajectory.ClusterNames  // the naming sheet of a previous run, cf. trajectory.MatchClusterNames
+	Clusterer      *Clusterer               // an external clusterer that is used instead of MCL, cf. LoadClusterer
+	Native         bool                     // cluster with the native MCL instead of the mcl binaries, cf. runNativeMcl
+	SkipDiskCheck  bool                     // do not check the free disk space before clustering, cf. preflightDiskSpace
+	Metadata       map[string]string        // written to the .ptra files of the clusterings, cf. trajectory.WritePtra
+	OMOPConcepts   trajectory.OMOPConcepts  // if not nil, write a cohort definition per cluster, cf. trajectory.PrintClusterCohortDefinitionsToFiles
+}
+
+// clusteringDir creates the directory dirName in path for the files of a clustering, and returns its absolute name,
+// ending with a separator. The files are named relative to it, so that the clustering does not change the working dir
+// of the process, which is shared with the goroutines that may read other results concurrently.
+func clusteringDir(path, dirName string) string {
+	workingDir, err := filepath.Abs(filepath.Join(path, dirName))
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("Output: ", out.String(), serr.String())
-	// run the clusterings with different granularities
-	for _, gran := range granularities {
-		mcl_cmd := fmt.Sprintf("%smcl", pathToMcl)
-		cmd := exec.Command(mcl_cmd, mciFileName, "-I", fmt.Sprintf("%f", float64(gran)/10.0))
-		var out2 bytes.Buffer
-		var serr2 bytes.Buffer
-		cmd.Stdout = &out2
-		cmd.Stderr = &serr2
-		fmt.Println("Output: ", out2.String(), serr2.String())
-		err := cmd.Run()
+	workingDir += string(filepath.Separator)
+	utils.Info("Working path becomes: ", workingDir)
+	if err := os.MkdirAll(workingDir, 0777); err != nil {
+		panic(err)
+	}
+	return workingDir
+}
+
+// mcxloadAbc runs mcxload to convert similarities in abc format into an mci matrix and a tab file. The similarities are
+// produced by writeAbc. By default they are streamed directly into the stdin of mcxload, so that no intermediate abc
+// file needs to be materialized, which can take hundreds of GBs for large runs. If options.AbcFile is set, the
+// similarities are first written to abcFileName, which is useful for debugging. mcxload mirrors the similarities, so
+// that each pair only needs to be written once, unless directed is set, in which case both directions of each pair are
+// written and the matrix is asymmetric, cf. directedSimilarity.
+func mcxloadAbc(options Options, workingDir, abcFileName, tabFileName, mciFileName string, directed bool,
+	writeAbc func(w io.Writer)) error {
+	abcInput := "-"
+	if options.AbcFile {
+		file, err := utils.CreateFile(abcFileName)
 		if err != nil {
-			panic(err)
+			log.Panic(err)
+		}
+		writer := bufio.NewWriter(file)
+		writeAbc(writer)
+		if err := writer.Flush(); err != nil {
+			log.Panic(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Panic(err)
 		}
+		abcInput = abcFileName
 	}
-	// convert the clusterings to readable format
-	clusterFileName := fmt.Sprintf("out.%s.mci", exp.Name)
-	outFileName := fmt.Sprintf("dump.%s.mci", exp.Name)
-	mcxdumpCmd := fmt.Sprintf("%smcxdump", pathToMcl)
-	for _, gran := range granularities {
-		cmd := exec.Command(mcxdumpCmd, "-icl", fmt.Sprintf("%s.I%d", clusterFileName, gran), "-tabr", tabFileName, "-o", fmt.Sprintf("%s.I%d", outFileName, gran))
-		fmt.Println(mcxdumpCmd, "-icl", fmt.Sprintf("%s.I%d", clusterFileName, gran), "-tabr", tabFileName, "-o", fmt.Sprintf("%s.I%d", outFileName, gran))
-		var out1 bytes.Buffer
-		var serr1 bytes.Buffer
-		cmd.Stdout = &out1
-		cmd.Stderr = &serr1
-		err := cmd.Run()
-		fmt.Println("Output: ", out1.String(), serr1.String())
+	args := []string{"-abc", abcInput}
+	if !directed {
+		args = append(args, "--stream-mirror")
+	}
+	cmd := mclCommand(options, Mcxload, append(args, "-write-tab", tabFileName, "-o", mciFileName)...)
+	if options.AbcFile {
+		return runMclCommand(workingDir, []string{abcFileName}, cmd, nil)
+	}
+	return runMclCommand(workingDir, nil, cmd, func() error {
+		stdin, err := cmd.StdinPipe()
 		if err != nil {
-			panic(err)
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		writer := bufio.NewWriter(stdin)
+		writeAbc(writer)
+		flushErr := writer.Flush()
+		stdin.Close()
+		// if mcxload stopped reading its input, its exit status says why
+		if err := cmd.Wait(); err != nil {
+			return err
+		}
+		return flushErr
+	})
+}
+
+// runMclGranularities runs mcl on mciFileName for each of the granularities in options, and converts the clusterings
+// with mcxdump to files outFileName.I<granularity>. If one of the MCL tools fails, it returns an *MclError.
+func runMclGranularities(options Options, workingDir, tabFileName, mciFileName, clusterFileName,
+	outFileName string) error {
+	// run the clusterings with different granularities
+	stage := utils.StartStage("Clustering trajectories", len(options.Granularities))
+	for _, gran := range options.Granularities {
+		cmd := mclCommand(options, Mcl, mciFileName, "-I", fmt.Sprintf("%f", float64(gran)/10.0))
+		if err := runMclCommand(workingDir, []string{mciFileName}, cmd, nil); err != nil {
+			return err
+		}
+		stage.Add(1)
+	}
+	// convert the clusterings to readable format
+	for _, gran := range options.Granularities {
+		clusters := fmt.Sprintf("%s%s.I%d", workingDir, clusterFileName, gran)
+		cmd := mclCommand(options, Mcxdump, "-icl", clusters, "-tabr", tabFileName, "-o", fmt.Sprintf("%s.I%d", outFileName,
+			gran))
+		utils.Detail(strings.Join(cmd.Args, " "))
+		if err := runMclCommand(workingDir, []string{clusters, tabFileName}, cmd, nil); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// ClusterTrajectories clusters the diagnosis codes of the computed trajectories with MCL, as in the Brunak paper, and
+// plots the trajectories that fall within each cluster. If one of the MCL tools fails, it returns an *MclError.
+func ClusterTrajectories(exp *trajectory.Experiment, path string, options Options) error {
+	utils.Info("Clustering trajectories with MCL")
+	// convert trajectories to abc format for the mcl tool
+	workingDir := clusteringDir(path, fmt.Sprintf("%s-clusters/", exp.Name))
+	abcFileName := fmt.Sprintf("%s%s.abc", workingDir, exp.Name)
+	tabFileName := fmt.Sprintf("%s%s.tab", workingDir, exp.Name)
+	mciFileName := fmt.Sprintf("%s%s.mci", workingDir, exp.Name)
+	err := mcxloadAbc(options, workingDir, abcFileName, tabFileName, mciFileName, false, func(w io.Writer) {
+		writeTrajectoryPairsAbc(exp, w)
+	})
+	if err != nil {
+		return err
+	}
+	clusterFileName := fmt.Sprintf("out.%s.mci", exp.Name)
+	outFileName := fmt.Sprintf("%sdump.%s.mci", workingDir, exp.Name)
+	if err := runMclGranularities(options, workingDir, tabFileName, mciFileName, clusterFileName,
+		outFileName); err != nil {
+		return err
+	}
 	// convert the clusterings generated by mcl tool to gml format
-	for _, gran := range granularities {
+	for _, gran := range options.Granularities {
 		dumpFileName := fmt.Sprintf("%s.I%d", outFileName, gran)
 		convertToTrajectoryClusterGraphs(exp, dumpFileName, fmt.Sprintf("%s.trajectories.gml", dumpFileName))
 		convertToDiagnosisGraphs(exp, dumpFileName, fmt.Sprintf("%s.gml", dumpFileName))
 	}
+	return nil
 }
 
 // collectTrajectoriesInCluster collects all trajectories that have all diagnosis codes in the cluster. Allow n missing
@@ -182,11 +273,12 @@ func ClusterTrajectories(exp *trajectory.Experiment, granularities []int, path,
 func collectTrajectoriesInCluster(trajectories []*trajectory.Trajectory, cluster []int, n int) ([]*trajectory.Trajectory, []*trajectory.Trajectory) {
 	collected := []*trajectory.Trajectory{}
 	uncollected := []*trajectory.Trajectory{}
+	members := utils.NewSet(cluster...)
 	for _, t := range trajectories {
 		misses := 0
 		pass := true
 		for _, d := range t.Diagnoses {
-			if !utils.MemberInt(d, cluster) {
+			if !members.Contains(d) {
 				misses++
 				if misses > n {
 					pass = false
@@ -208,7 +300,7 @@ func convertToDiagnosisGraphs(exp *trajectory.Experiment, input, output string)
 	if err != nil {
 		panic(err)
 	}
-	out, err := os.Create(output)
+	out, err := utils.CreateFile(output)
 	if err != nil {
 		panic(err)
 	}
@@ -276,11 +368,12 @@ func convertToDiagnosisGraphs(exp *trajectory.Experiment, input, output string)
 // line lists all nodes/diagnosis codes that belong to to that cluster.
 // We collect the trajectories that are fully contained in those clusters and plot them as a directed graph.
 func convertToTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output string) {
+	trajectory.WarnSkippedTrajectories(trajectory.CountEmptyTrajectories(exp.Trajectories), "writing "+output)
 	file, err := os.Open(input)
 	if err != nil {
 		panic(err)
 	}
-	ofile, oerr := os.Create(output)
+	ofile, oerr := utils.CreateFile(output)
 	if oerr != nil {
 		panic(oerr)
 	}
@@ -342,12 +435,15 @@ func convertToTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output
 				edgePrinted[i] = make([][]int, exp.NofDiagnosisCodes)
 			}
 			for _, t := range collected {
+				if len(t.Diagnoses) == 0 {
+					continue
+				}
 				d1 := t.Diagnoses[0]
 				for i := 1; i < len(t.Diagnoses); i++ {
 					d2 := t.Diagnoses[i]
 					n := t.PatientNumbers[i-1]
 					printed := edgePrinted[d1][d2]
-					if !utils.MemberInt(n, printed) {
+					if !utils.Member(n, printed) {
 						fmt.Fprintf(ofile, fmt.Sprintf("edge [\nsource %d\ntarget %d\nlabel %d\n]\n", d1, d2, n))
 						if printed == nil {
 							edgePrinted[d1][d2] = []int{n}
@@ -363,6 +459,9 @@ func convertToTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output
 	}
 	// print the unclustered trajectories as separate clusters
 	for _, t := range trajectories {
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
 		fmt.Fprintf(ofile, "graph [ \n directed 1 \n multigraph 1\n")
 		// print nodes
 		for _, d := range t.Diagnoses {
@@ -378,7 +477,7 @@ func convertToTrajectoryClusterGraphs(exp *trajectory.Experiment, input, output
 		}
 		fmt.Fprintf(ofile, "]\n")
 	}
-	fmt.Println("For ", output)
-	fmt.Println("Collected ", nofClusters, " clusters and ", len(trajectories), " not clustered trajectories.")
-	fmt.Println("Clustered ", len(exp.Trajectories)-len(trajectories), " out of ", len(exp.Trajectories), " trajectories.")
+	utils.Info("For ", output)
+	utils.Info("Collected ", nofClusters, " clusters and ", len(trajectories), " not clustered trajectories.")
+	utils.Info("Clustered ", len(exp.Trajectories)-len(trajectories), " out of ", len(exp.Trajectories), " trajectories.")
 }
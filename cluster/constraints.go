@@ -0,0 +1,220 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+)
+
+// Cluster size constraints, for more balanced, reviewable clusterings. Clusters with more trajectories than the
+// maximum size are recursively re-clustered with MCL at a higher inflation, and clusters with fewer trajectories than
+// the minimum size are merged into their nearest neighbor.
+
+const (
+	resplitInflationStep = 10 // the increase of the granularity (inflation x 10) for each re-clustering of a cluster
+	maxResplitDepth      = 5  // the maximum number of times a cluster is re-clustered
+)
+
+// sizeConstraints applies the cluster size constraints of the options to a clustering, given as the trajectory IDs
+// per cluster, cf. trajectory.ReadMclDumpFile.
+type sizeConstraints struct {
+	exp        *trajectory.Experiment
+	options    Options
+	workingDir string
+	similarity TrajectorySimilarity
+	splits     int // the number of re-clusterings so far, for naming their files
+}
+
+// hasSizeConstraints checks if the options set a minimum or maximum cluster size.
+func hasSizeConstraints(options Options) bool {
+	return options.MinClusterSize > 0 || options.MaxClusterSize > 0
+}
+
+// constrain applies the size constraints to a clustering at the given granularity. The clusters are returned from
+// largest to smallest, as MCL orders them.
+func (c *sizeConstraints) constrain(clusters [][]int, gran int) ([][]int, error) {
+	if c.options.MaxClusterSize > 0 {
+		split := [][]int{}
+		for _, cluster := range clusters {
+			parts, err := c.split(cluster, gran+resplitInflationStep, 1)
+			if err != nil {
+				return nil, err
+			}
+			split = append(split, parts...)
+		}
+		clusters = split
+	}
+	if c.options.MinClusterSize > 0 {
+		clusters = c.merge(clusters)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i]) > len(clusters[j])
+	})
+	return clusters, nil
+}
+
+// split re-clusters a cluster that exceeds the maximum size with MCL at the given granularity, and recursively
+// re-clusters its parts that still exceed the maximum size at a higher granularity. A cluster that cannot be split
+// within maxResplitDepth re-clusterings is kept as it is.
+func (c *sizeConstraints) split(cluster []int, gran, depth int) ([][]int, error) {
+	if len(cluster) <= c.options.MaxClusterSize {
+		return [][]int{cluster}, nil
+	}
+	if depth > maxResplitDepth || c.options.Clusterer != nil {
+		utils.Warning("could not split a cluster of ", len(cluster), " trajectories below the maximum size ",
+			c.options.MaxClusterSize)
+		return [][]int{cluster}, nil
+	}
+	parts, err := c.recluster(cluster, gran)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) <= 1 {
+		// no split at this inflation, try a higher one
+		return c.split(cluster, gran+resplitInflationStep, depth+1)
+	}
+	result := [][]int{}
+	for _, part := range parts {
+		split, err := c.split(part, gran+resplitInflationStep, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, split...)
+	}
+	return result, nil
+}
+
+// recluster clusters the trajectories of a cluster with MCL at the given granularity. The files of the re-clustering
+// are written to the working dir, with names <name>.split<nr>. With the native MCL, no files are written.
+func (c *sizeConstraints) recluster(cluster []int, gran int) ([][]int, error) {
+	c.splits++
+	name := fmt.Sprintf("%s.split%d", c.exp.Name, c.splits)
+	utils.Info("Re-clustering a cluster of ", len(cluster), " trajectories with inflation ", float64(gran)/10.0)
+	directed := directedSimilarity(c.options)
+	writeAbc := func(w io.Writer) {
+		for i, id1 := range cluster {
+			for _, id2 := range cluster[i+1:] {
+				writeAbcPair(w, c.exp, c.similarity, id1, id2, directed)
+			}
+		}
+	}
+	if c.options.MinSimilarity > 0 {
+		writeAbc = withSimilarityCutoff(cluster, c.options.MinSimilarity, writeAbc)
+	}
+	if c.options.Native {
+		g := newAbcGraph(cluster, directed)
+		writeAbc(g)
+		if err := g.flush(); err != nil {
+			return nil, err
+		}
+		return g.mcl(float64(gran) / 10.0), nil
+	}
+	abcFileName := fmt.Sprintf("%s%s.abc", c.workingDir, name)
+	tabFileName := fmt.Sprintf("%s%s.tab", c.workingDir, name)
+	mciFileName := fmt.Sprintf("%s%s.mci", c.workingDir, name)
+	err := mcxloadAbc(c.options, c.workingDir, abcFileName, tabFileName, mciFileName, directed, writeAbc)
+	if err != nil {
+		return nil, err
+	}
+	options := c.options
+	options.Granularities = []int{gran}
+	outFileName := fmt.Sprintf("%sdump.%s.mci", c.workingDir, name)
+	err = runMclGranularities(options, c.workingDir, tabFileName, mciFileName, fmt.Sprintf("out.%s.mci", name),
+		outFileName)
+	if err != nil {
+		return nil, err
+	}
+	return trajectory.ReadMclDumpFile(fmt.Sprintf("%s.I%d", outFileName, gran))
+}
+
+// meanSimilarity computes the mean similarity between the trajectories of two clusters.
+func (c *sizeConstraints) meanSimilarity(cluster1, cluster2 []int) float64 {
+	sum := 0.0
+	for _, id1 := range cluster1 {
+		for _, id2 := range cluster2 {
+			sum += c.similarity(c.exp.Trajectories[id1], c.exp.Trajectories[id2])
+		}
+	}
+	return sum / float64(len(cluster1)*len(cluster2))
+}
+
+// merge merges the clusters below the minimum size, from the smallest up, into the cluster with the highest mean
+// similarity, cf. meanSimilarity, unless that would exceed the maximum size. Clusters that are not similar to any
+// other cluster are kept as they are.
+func (c *sizeConstraints) merge(clusters [][]int) [][]int {
+	clusters = append([][]int{}, clusters...)
+	kept := [][]int{} // the clusters below the minimum size that are not similar to any other cluster
+	for {
+		smallest := -1
+		for i, cluster := range clusters {
+			if len(cluster) < c.options.MinClusterSize && (smallest < 0 || len(cluster) < len(clusters[smallest])) {
+				smallest = i
+			}
+		}
+		if smallest < 0 {
+			if len(kept) > 0 {
+				utils.Warning("kept ", len(kept), " clusters below the minimum size ", c.options.MinClusterSize,
+					" that are not similar to any other cluster")
+			}
+			return append(clusters, kept...)
+		}
+		nearest, best := -1, 0.0
+		for i, cluster := range clusters {
+			if i == smallest || (c.options.MaxClusterSize > 0 &&
+				len(cluster)+len(clusters[smallest]) > c.options.MaxClusterSize) {
+				continue
+			}
+			if s := c.meanSimilarity(clusters[smallest], cluster); s > best {
+				nearest, best = i, s
+			}
+		}
+		if nearest < 0 {
+			kept = append(kept, clusters[smallest])
+		} else {
+			clusters[nearest] = append(append([]int{}, clusters[nearest]...), clusters[smallest]...)
+		}
+		clusters = append(clusters[:smallest], clusters[smallest+1:]...)
+	}
+}
+
+// constrainClusterSizes applies the cluster size constraints of the options to the clustering in the dump file of the
+// given granularity. The original clustering is kept in a file with the extension .unconstrained.
+func (c *sizeConstraints) constrainClusterSizes(dumpFileName string, gran int) error {
+	clusters, err := trajectory.ReadMclDumpFile(dumpFileName)
+	if err != nil {
+		return err
+	}
+	if err := trajectory.ValidateClusters(c.exp, clusters); err != nil {
+		return fmt.Errorf("%s: %v", dumpFileName, err)
+	}
+	constrained, err := c.constrain(clusters, gran)
+	if err != nil {
+		return err
+	}
+	utils.Info("Constrained the cluster sizes from ", len(clusters), " to ", len(constrained), " clusters.")
+	if err := os.Rename(dumpFileName, dumpFileName+".unconstrained"); err != nil {
+		return err
+	}
+	writeMclDumpFile(dumpFileName, constrained)
+	return nil
+}
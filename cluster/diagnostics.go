@@ -0,0 +1,122 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"ptra/utils"
+	"strings"
+)
+
+// MclError reports a failed run of one of the MCL tools (mcxload, mcl, mcxdump). The command line, its output, and the
+// stats of its input files are persisted to a diagnostics bundle, a directory in the working dir of the clustering.
+type MclError struct {
+	Command  []string // the command line of the failed tool
+	ExitCode int      // the exit code of the tool, or -1 if it could not be started or was killed
+	Stdout   string   // the full standard output of the tool
+	Stderr   string   // the full standard error of the tool
+	Bundle   string   // the directory with the diagnostics bundle, or "" if it could not be written
+	Err      error    // the error returned by os/exec
+}
+
+func (e *MclError) Error() string {
+	msg := fmt.Sprintf("%s failed with exit code %d: %v", filepath.Base(e.Command[0]), e.ExitCode, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, lastLine(stderr))
+	}
+	if e.Bundle != "" {
+		msg = fmt.Sprintf("%s (diagnostics in %s)", msg, e.Bundle)
+	}
+	return msg
+}
+
+func (e *MclError) Unwrap() error {
+	return e.Err
+}
+
+// lastLine returns the last line of a text, which is usually the most informative line of an error message.
+func lastLine(text string) string {
+	return text[strings.LastIndexByte(text, '\n')+1:]
+}
+
+// runMclCommand runs an MCL tool in workingDir, capturing its output, which is printed when the tool finishes. By
+// default, the tool is run with cmd.Run, but run can be passed to run it differently, e.g. to stream its input. If the
+// tool fails, a diagnostics bundle is written to workingDir, cf. writeMclDiagnostics, and an *MclError is returned.
+func runMclCommand(workingDir string, inputs []string, cmd *exec.Cmd, run func() error) error {
+	// mcl dumps its output files into its working dir
+	cmd.Dir = workingDir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if run == nil {
+		run = cmd.Run
+	}
+	end := utils.TraceCommand(cmd)
+	err := run()
+	end(err)
+	utils.Detail("Output: ", stdout.String(), stderr.String())
+	if err == nil {
+		return nil
+	}
+	mclErr := &MclError{Command: cmd.Args, ExitCode: -1, Stdout: stdout.String(), Stderr: stderr.String(), Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		mclErr.ExitCode = exitErr.ExitCode()
+	}
+	mclErr.Bundle = writeMclDiagnostics(workingDir, mclErr, inputs)
+	return mclErr
+}
+
+// writeMclDiagnostics writes a diagnostics bundle for a failed MCL tool to the directory mcl-diagnostics in workingDir,
+// and returns the name of the directory. The bundle contains:
+// - command.txt: the exact command line, the exit code, and the error
+// - stdout.txt and stderr.txt: the full output of the tool
+// - inputs.txt: a line per input file with its name, size in bytes, and modification time, or that it is missing
+// It returns "" if the bundle cannot be written, since the failure of the tool is the error to report.
+func writeMclDiagnostics(workingDir string, mclErr *MclError, inputs []string) string {
+	dir := filepath.Join(workingDir, "mcl-diagnostics")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		utils.Warning("could not write MCL diagnostics: ", err)
+		return ""
+	}
+	var command strings.Builder
+	fmt.Fprintf(&command, "%s\nexit code: %d\nerror: %v\n", strings.Join(mclErr.Command, " "), mclErr.ExitCode,
+		mclErr.Err)
+	var stats strings.Builder
+	for _, input := range inputs {
+		if info, err := os.Stat(input); err != nil {
+			fmt.Fprintf(&stats, "%s\tmissing: %v\n", input, err)
+		} else {
+			fmt.Fprintf(&stats, "%s\t%d bytes\tmodified %s\n", input, info.Size(), info.ModTime().Format("2006-01-02 15:04:05"))
+		}
+	}
+	files := map[string]string{"command.txt": command.String(), "stdout.txt": mclErr.Stdout,
+		"stderr.txt": mclErr.Stderr, "inputs.txt": stats.String()}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0666); err != nil {
+			utils.Warning("could not write MCL diagnostics: ", err)
+			return ""
+		}
+	}
+	return dir
+}
@@ -0,0 +1,234 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Clusterer describes how to run an external community-detection tool instead of MCL, e.g. Infomap or a label
+// propagation binary. It is loaded from a JSON adapter config with LoadClusterer. The command and output file name can
+// contain the placeholders {input}, the file with the trajectory similarities, {dir}, the working dir,
+// {granularity}, the clustering granularity, and {inflation}, the granularity divided by 10 as for MCL.
+type Clusterer struct {
+	Name         string   // the name of the tool, used in log messages
+	Input        string   // the format of the similarities: abc (tab-separated) or links (space-separated)
+	Command      []string // the command and its arguments, run once per granularity in the working dir
+	Output       string   // the file to which the command writes the clustering, relative to the working dir
+	OutputFormat string   // the format of the clustering: lines or pairs, cf. readClustererOutput
+}
+
+// LoadClusterer loads an external clusterer adapter config from a JSON file.
+func LoadClusterer(fileName string) (*Clusterer, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	clusterer := &Clusterer{Input: "abc", OutputFormat: "lines"}
+	if err := json.Unmarshal(data, clusterer); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if len(clusterer.Command) == 0 || clusterer.Output == "" {
+		return nil, fmt.Errorf("%s: a clusterer needs a command and an output file", fileName)
+	}
+	if clusterer.Input != "abc" && clusterer.Input != "links" {
+		return nil, fmt.Errorf("%s: unknown input format %s", fileName, clusterer.Input)
+	}
+	if clusterer.OutputFormat != "lines" && clusterer.OutputFormat != "pairs" {
+		return nil, fmt.Errorf("%s: unknown output format %s", fileName, clusterer.OutputFormat)
+	}
+	if clusterer.Name == "" {
+		clusterer.Name = clusterer.Command[0]
+	}
+	return clusterer, nil
+}
+
+// expand fills in the placeholders of a command argument or output file name.
+func (c *Clusterer) expand(s, input, dir string, gran int) string {
+	return strings.NewReplacer("{input}", input, "{dir}", dir, "{granularity}", strconv.Itoa(gran),
+		"{inflation}", strconv.FormatFloat(float64(gran)/10.0, 'f', -1, 64)).Replace(s)
+}
+
+// linksWriter converts the tab-separated abc format to the space-separated links format.
+type linksWriter struct {
+	w io.Writer
+}
+
+func (lw linksWriter) Write(p []byte) (int, error) {
+	return lw.w.Write([]byte(strings.ReplaceAll(string(p), "\t", " ")))
+}
+
+// readClustererOutput reads the clustering written by an external clusterer. The lines format has a line per cluster
+// that lists the IDs of its trajectories, separated by whitespace. The pairs format has a line per trajectory with its
+// ID and its cluster ID, as in the .clu files of Infomap or the output of label propagation; further fields are
+// ignored. In both formats, lines starting with # are comments. Trajectories that do not occur in the output, e.g.
+// trajectories without similar trajectories, are put in singleton clusters. The clusters are ordered by decreasing
+// size, as in the MCL output.
+func readClustererOutput(fileName, format string, nofTrajectories int) ([][]int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	clusters := [][]int{}
+	index := map[string]int{} // maps cluster IDs of the pairs format to indexes in clusters
+	seen := make([]bool, nofTrajectories)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if format == "pairs" && len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a trajectory and a cluster ID", fileName, lineNr)
+		}
+		ids := fields
+		if format == "pairs" {
+			ids = fields[:1]
+		}
+		cluster := []int{}
+		for _, field := range ids {
+			id, err := strconv.Atoi(field)
+			if err != nil || id < 0 || id >= nofTrajectories {
+				return nil, fmt.Errorf("%s:%d: invalid trajectory ID %s", fileName, lineNr, field)
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("%s:%d: trajectory %d occurs in multiple clusters", fileName, lineNr, id)
+			}
+			seen[id] = true
+			cluster = append(cluster, id)
+		}
+		if format == "pairs" {
+			i, ok := index[fields[1]]
+			if !ok {
+				i = len(clusters)
+				index[fields[1]] = i
+				clusters = append(clusters, nil)
+			}
+			clusters[i] = append(clusters[i], cluster...)
+		} else {
+			clusters = append(clusters, cluster)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for id, ok := range seen {
+		if !ok {
+			clusters = append(clusters, []int{id})
+		}
+	}
+	for _, cluster := range clusters {
+		sort.Ints(cluster)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters, nil
+}
+
+// writeMclDumpFile writes a clustering in the format of mcxdump, cf. trajectory.ReadMclDumpFile.
+func writeMclDumpFile(fileName string, clusters [][]int) {
+	file, err := utils.CreateFile(fileName)
+	if err != nil {
+		log.Panic(err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, cluster := range clusters {
+		ids := make([]string, len(cluster))
+		for i, id := range cluster {
+			ids[i] = strconv.Itoa(id)
+		}
+		fmt.Fprintf(writer, "%s\n", strings.Join(ids, "\t"))
+	}
+	if err := writer.Flush(); err != nil {
+		log.Panic(err)
+	}
+	if err := file.Close(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// runExternalClusterer clusters the trajectories with an external clusterer for each of the given granularities. The
+// similarities produced by writeAbc are written once to an input file in the working dir. The clusterings are
+// converted to files outFileName.I<granularity> in the format of mcxdump, so that they are processed in the same way
+// as the MCL clusterings.
+func runExternalClusterer(c *Clusterer, exp *trajectory.Experiment, granularities []int, workingDir,
+	outFileName string, writeAbc func(w io.Writer)) {
+	input := fmt.Sprintf("%s%s.%s", workingDir, exp.Name, c.Input)
+	file, err := utils.CreateFile(input)
+	if err != nil {
+		log.Panic(err)
+	}
+	writer := bufio.NewWriter(file)
+	if c.Input == "links" {
+		writeAbc(linksWriter{writer})
+	} else {
+		writeAbc(writer)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Panic(err)
+	}
+	if err := file.Close(); err != nil {
+		log.Panic(err)
+	}
+	stage := utils.StartStage("Clustering trajectories", len(granularities))
+	for _, gran := range granularities {
+		args := make([]string, len(c.Command))
+		for i, arg := range c.Command {
+			args[i] = c.expand(arg, input, workingDir, gran)
+		}
+		utils.Detail(strings.Join(args, " "))
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = workingDir
+		end := utils.TraceCommand(cmd)
+		output, err := cmd.CombinedOutput()
+		end(err)
+		utils.Detail("Output:", string(output))
+		if err != nil {
+			log.Panic(fmt.Sprintf("%s failed: %v", c.Name, err))
+		}
+		outputFile := c.expand(c.Output, input, workingDir, gran)
+		if !filepath.IsAbs(outputFile) {
+			outputFile = filepath.Join(workingDir, outputFile)
+		}
+		clusters, err := readClustererOutput(outputFile, c.OutputFormat, len(exp.Trajectories))
+		if err != nil {
+			log.Panic(err)
+		}
+		writeMclDumpFile(fmt.Sprintf("%s.I%d", outFileName, gran), clusters)
+		stage.Add(1)
+	}
+}
@@ -0,0 +1,145 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"ptra/trajectory"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// The trajectory similarity graph, exported as GraphML for external network analysis, e.g. to run other community
+// detection algorithms or visualizations on the exact graph that is clustered.
+
+// xmlText escapes a string for use as XML text.
+func xmlText(s string) string {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(s)); err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
+
+// similarityGraphWriter converts similarities in abc format into the edges of a GraphML graph. The edges with a
+// similarity at or below the threshold are left out. It never fails a write, so that the clustering that reads the same
+// similarities is not affected, but records the first parse error instead.
+type similarityGraphWriter struct {
+	w         io.Writer
+	threshold float64
+	edges     int
+	partial   []byte
+	err       error
+}
+
+// Write converts the complete lines of similarities in p.
+func (g *similarityGraphWriter) Write(p []byte) (int, error) {
+	if g.err == nil {
+		g.partial, g.err = writeAbcLines(g.partial, p, g.parseLine)
+	}
+	return len(p), nil
+}
+
+// parseLine converts a line with two trajectory IDs and their similarity into an edge.
+func (g *similarityGraphWriter) parseLine(line string) error {
+	id1, id2, weight, ok, err := parseAbcLine(line)
+	if !ok || weight <= g.threshold || id1 == id2 {
+		return err
+	}
+	fmt.Fprintf(g.w, "    <edge source=\"t%d\" target=\"t%d\"><data key=\"similarity\">%s</data></edge>\n", id1, id2,
+		strconv.FormatFloat(weight, 'f', -1, 64))
+	g.edges++
+	return nil
+}
+
+// flush converts an incomplete last line, in case the similarities do not end with a newline.
+func (g *similarityGraphWriter) flush() error {
+	if g.err != nil {
+		return g.err
+	}
+	line := string(g.partial)
+	g.partial = nil
+	return g.parseLine(line)
+}
+
+// writeSimilarityGraphNodes writes the GraphML header and a node per trajectory of an experiment. The nodes have the
+// ID of the trajectory, its diagnoses as medical terms and as codes, its length, and its number of patients. If
+// directed is set, the edges of the graph are directed, cf. directedSimilarity.
+func writeSimilarityGraphNodes(w io.Writer, exp *trajectory.Experiment, directed bool) {
+	edgeDefault := "undirected"
+	if directed {
+		edgeDefault = "directed"
+	}
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n"+
+		"  <key id=\"tid\" for=\"node\" attr.name=\"tid\" attr.type=\"int\"/>\n"+
+		"  <key id=\"label\" for=\"node\" attr.name=\"label\" attr.type=\"string\"/>\n"+
+		"  <key id=\"codes\" for=\"node\" attr.name=\"codes\" attr.type=\"string\"/>\n"+
+		"  <key id=\"length\" for=\"node\" attr.name=\"length\" attr.type=\"int\"/>\n"+
+		"  <key id=\"patients\" for=\"node\" attr.name=\"patients\" attr.type=\"int\"/>\n"+
+		"  <key id=\"similarity\" for=\"edge\" attr.name=\"similarity\" attr.type=\"double\"/>\n"+
+		"  <graph id=\"%s\" edgedefault=\"%s\">\n", xmlText(exp.Name), edgeDefault)
+	for i, t := range exp.Trajectories {
+		names, codes := []string{}, []string{}
+		for _, d := range t.Diagnoses {
+			names = append(names, exp.NameMap[d])
+			codes = append(codes, exp.IdMap[d])
+		}
+		fmt.Fprintf(w, "    <node id=\"t%d\"><data key=\"tid\">%d</data><data key=\"label\">%s</data>"+
+			"<data key=\"codes\">%s</data><data key=\"length\">%d</data><data key=\"patients\">%d</data></node>\n",
+			i, i, xmlText(strings.Join(names, " -> ")), xmlText(strings.Join(codes, " -> ")), len(t.Diagnoses),
+			len(trajectory.LastPatients(t)))
+	}
+}
+
+// withSimilarityGraph wraps a writer of similarities in abc format, so that the similarities are also written as a
+// GraphML graph to fileName, with a node per trajectory, cf. writeSimilarityGraphNodes, and an undirected edge per pair
+// of trajectories with a similarity above the threshold, or a directed edge per direction if directed is set. The node
+// IDs are t<ID>, where ID is the ID of the trajectory in the clustering outputs.
+func withSimilarityGraph(exp *trajectory.Experiment, fileName string, threshold float64, directed bool,
+	writeAbc func(w io.Writer)) func(w io.Writer) {
+	return func(w io.Writer) {
+		file, err := utils.CreateFile(fileName)
+		if err != nil {
+			log.Panic(err)
+		}
+		writer := bufio.NewWriter(file)
+		writeSimilarityGraphNodes(writer, exp, directed)
+		g := &similarityGraphWriter{w: writer, threshold: threshold}
+		writeAbc(io.MultiWriter(w, g))
+		if err := g.flush(); err != nil {
+			log.Panic(fmt.Sprintf("%s: %v", fileName, err))
+		}
+		fmt.Fprintf(writer, "  </graph>\n</graphml>\n")
+		if err := writer.Flush(); err != nil {
+			log.Panic(err)
+		}
+		if err := file.Close(); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Wrote the similarity graph with ", len(exp.Trajectories), " trajectories and ", g.edges,
+			" edges to ", fileName)
+	}
+}
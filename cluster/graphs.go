@@ -0,0 +1,200 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// clusterGraphWriter writes the trajectories collected in a cluster as a single GML graph.
+type clusterGraphWriter func(w io.Writer, exp *trajectory.Experiment, cid int, collected []*trajectory.Trajectory)
+
+// createFile creates a file, panicking on failure, and returns a function that closes it.
+func createFile(name string) (io.Writer, func()) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	return file, func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// writeClusterGraphs writes a GML graph for each cluster of an experiment. If split is false, all graphs are
+// concatenated in the output file. Since most viewers only render the first graph of such a file, split can be set to
+// true to instead write each graph to its own file cluster-<cid>.gml in a directory named after the output file
+// without its .gml extension. The directory then also contains an index.tsv manifest that lists, for each cluster,
+// the file name, the number of trajectories, and the number of diagnoses.
+func writeClusterGraphs(exp *trajectory.Experiment, output string, split bool, writeGraph clusterGraphWriter) {
+	clusters := trajectory.CollectClusters(exp)
+	skipped := 0
+	for _, collected := range clusters {
+		skipped += trajectory.CountEmptyTrajectories(collected)
+	}
+	trajectory.WarnSkippedTrajectories(skipped, "writing "+output)
+	if !split {
+		ofile, closeFile := createFile(output)
+		defer closeFile()
+		for cid := 0; cid < len(clusters); cid++ {
+			writeGraph(ofile, exp, cid, clusters[cid])
+		}
+		return
+	}
+	dir := strings.TrimSuffix(output, ".gml")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	index, closeIndex := createFile(filepath.Join(dir, "index.tsv"))
+	defer closeIndex()
+	fmt.Fprintf(index, "CID\tFile\tTrajectories\tDiagnoses\n")
+	for cid := 0; cid < len(clusters); cid++ {
+		collected := clusters[cid]
+		name := fmt.Sprintf("cluster-%d.gml", cid)
+		ofile, closeFile := createFile(filepath.Join(dir, name))
+		writeGraph(ofile, exp, cid, collected)
+		closeFile()
+		diagnoses := map[int]bool{}
+		for _, t := range collected {
+			for _, d := range t.Diagnoses {
+				diagnoses[d] = true
+			}
+		}
+		fmt.Fprintf(index, "%d\t%s\t%d\t%d\n", cid, name, len(collected), len(diagnoses))
+	}
+}
+
+// clusterEOIEnrichments returns the EOI enrichment of each transition d1 -> d2 in the trajectories of a cluster, i.e. the
+// maximum over the occurrences of the transition, cf. trajectory.TransitionEOIEnrichments. Transitions with an unknown
+// enrichment are left out.
+func clusterEOIEnrichments(exp *trajectory.Experiment, collected []*trajectory.Trajectory) map[[2]int]float64 {
+	enrichments := map[[2]int]float64{}
+	for _, t := range collected {
+		for i, e := range trajectory.TransitionEOIEnrichments(exp, t) {
+			if math.IsNaN(e) || i+1 >= len(t.Diagnoses) {
+				continue
+			}
+			key := [2]int{t.Diagnoses[i], t.Diagnoses[i+1]}
+			if old, ok := enrichments[key]; !ok || e > old {
+				enrichments[key] = e
+			}
+		}
+	}
+	return enrichments
+}
+
+// eoiEnrichmentAttribute returns the GML attributes of an edge d1 -> d2 for its EOI enrichment: the enrichment, and its
+// color on the suggested color scale as the fill color of the edge, which yEd and Cytoscape use to draw the edge, cf.
+// trajectory.EOIEnrichmentColor. It returns "" if the enrichment is not known.
+func eoiEnrichmentAttribute(enrichments map[[2]int]float64, d1, d2 int) string {
+	e, ok := enrichments[[2]int{d1, d2}]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("eoiEnrichment %s\ngraphics [ fill \"%s\" ]\n", strconv.FormatFloat(e, 'f', 2, 64),
+		trajectory.EOIEnrichmentColor(e))
+}
+
+// directionAttribute returns the GML attributes of an edge d1 -> d2 for the evidence of its direction, cf.
+// trajectory.Direction: the fraction of the patients with both diagnoses that have d1 before d2, the numbers of
+// patients in both directions, and the p-value of the binomial test with which the direction is selected. It returns
+// "" if the direction is not known.
+func directionAttribute(exp *trajectory.Experiment, d1, d2 int) string {
+	d, ok := trajectory.TransitionDirection(exp, d1, d2)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("direction %s\ndirectionBefore %d\ndirectionAfter %d\ndirectionP %s\n",
+		strconv.FormatFloat(d.Confidence(), 'f', 4, 64), d.Before, d.After, strconv.FormatFloat(d.P, 'E', 3, 64))
+}
+
+// bundledEdge aggregates the occurrences of a transition d1 -> d2 in the trajectories of a cluster.
+type bundledEdge struct {
+	d1, d2       int
+	patients     int     // the sum of the patient numbers of the occurrences
+	rr           float64 // the maximum RR of the occurrences
+	trajectories int     // the number of trajectories in which the transition occurs
+}
+
+// bundleEdges bundles the parallel occurrences of each transition in the trajectories of a cluster into one edge, in
+// the order in which the transitions first occur.
+func bundleEdges(exp *trajectory.Experiment, collected []*trajectory.Trajectory) []*bundledEdge {
+	edges := []*bundledEdge{}
+	index := map[[2]int]*bundledEdge{}
+	for _, t := range collected {
+		seen := map[[2]int]bool{} // count a trajectory once per transition
+		for i := 1; i < len(t.Diagnoses); i++ {
+			key := [2]int{t.Diagnoses[i-1], t.Diagnoses[i]}
+			e, ok := index[key]
+			if !ok {
+				e = &bundledEdge{d1: key[0], d2: key[1], rr: math.Inf(-1)}
+				index[key] = e
+				edges = append(edges, e)
+			}
+			e.patients += t.PatientNumbers[i-1]
+			e.rr = math.Max(e.rr, exp.DxDRR[key[0]][key[1]])
+			if !seen[key] {
+				seen[key] = true
+				e.trajectories++
+			}
+		}
+	}
+	return edges
+}
+
+// writeBundledClusterGraph returns a clusterGraphWriter that writes the trajectories of a cluster as a GML graph with
+// one edge per transition, instead of one edge per occurrence of the transition, cf. bundleEdges. The edges have the
+// summed patient numbers, the maximum RR, and the number of trajectories as attributes, and either the patient numbers
+// or, if labelRR is true, the RR as label.
+func writeBundledClusterGraph(labelRR bool) clusterGraphWriter {
+	return func(ofile io.Writer, exp *trajectory.Experiment, cid int, collected []*trajectory.Trajectory) {
+		fmt.Fprintf(ofile, "graph [ \n comment \"cluster %d\" \n directed 1 \n label \"cluster %d\" \n multigraph 1\n",
+			cid, cid)
+		nodePrinted := map[int]bool{}
+		for _, t := range collected {
+			for _, node := range t.Diagnoses {
+				if !nodePrinted[node] {
+					fmt.Fprintf(ofile, "node [ id %d\n label \"%s\"\n ]\n", node, exp.NameMap[node])
+					nodePrinted[node] = true
+				}
+			}
+		}
+		enrichments := clusterEOIEnrichments(exp, collected)
+		for _, e := range bundleEdges(exp, collected) {
+			rr := strconv.FormatFloat(e.rr, 'f', 2, 64)
+			label := strconv.Itoa(e.patients)
+			if labelRR {
+				label = rr
+			}
+			fmt.Fprintf(ofile, "edge [\nsource %d\ntarget %d\nlabel %s\npatients %d\nrr %s\ntrajectories %d\n%s%s%s]\n",
+				e.d1, e.d2, label, e.patients, rr, e.trajectories, edgeWeightAttribute(exp, collected, cid, e.d1, e.d2),
+				eoiEnrichmentAttribute(enrichments, e.d1, e.d2), directionAttribute(exp, e.d1, e.d2))
+		}
+		fmt.Fprintf(ofile, "]\n")
+	}
+}
@@ -0,0 +1,145 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"os/exec"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// The MCL tools that are run as external processes, in the order of the stages of a clustering.
+const (
+	Mcxload = "mcxload"
+	Mcl     = "mcl"
+	Mcxdump = "mcxdump"
+)
+
+// mclTools lists the MCL tools, cf. Mcxload, Mcl, and Mcxdump.
+var mclTools = []string{Mcxload, Mcl, Mcxdump}
+
+// ProcessLimits configures the resources of an external process, so that it does not saturate a shared server. The
+// limits are applied by running the process through nice, taskset, and prlimit, which are available on Linux.
+type ProcessLimits struct {
+	Nice   int    // if > 0, the niceness of the process, cf. nice -n
+	CPUs   string // if not empty, the list of CPUs the process is bound to, e.g. 0-3,8, cf. taskset -c
+	Memory uint64 // if > 0, the maximum virtual memory of the process in bytes, cf. prlimit --as
+}
+
+// wrap returns the command line that runs the given command line within the limits.
+func (limits ProcessLimits) wrap(args []string) []string {
+	wrapped := []string{}
+	if limits.Nice > 0 {
+		wrapped = append(wrapped, "nice", "-n", strconv.Itoa(limits.Nice))
+	}
+	if limits.CPUs != "" {
+		wrapped = append(wrapped, "taskset", "-c", limits.CPUs)
+	}
+	if limits.Memory > 0 {
+		wrapped = append(wrapped, "prlimit", fmt.Sprintf("--as=%d", limits.Memory), "--")
+	}
+	return append(wrapped, args...)
+}
+
+// ParseMclLimits parses the resource limits of the MCL tools from a comma-separated list of key=value settings, with the
+// keys nice, cpus, and memory, cf. ProcessLimits. A key applies to all tools, unless it is prefixed with the name of a
+// tool, e.g. mcl.memory=16G, which overrides the setting for that tool only. The memory is a number of bytes with an
+// optional unit, cf. utils.ParseBytes. The CPU list is as for taskset, e.g. cpus=0-3,8. It returns the limits per tool.
+func ParseMclLimits(s string) (map[string]ProcessLimits, error) {
+	limits := map[string]ProcessLimits{}
+	if strings.TrimSpace(s) == "" {
+		return limits, nil
+	}
+	// the elements of a CPU list are separated by commas as well, so that they continue the previous setting
+	settings := []string{}
+	for _, element := range strings.Split(s, ",") {
+		if n := len(settings); n > 0 && !strings.Contains(element, "=") {
+			settings[n-1] += "," + element
+		} else {
+			settings = append(settings, element)
+		}
+	}
+	shared, specific := []string{}, []string{}
+	for _, setting := range settings {
+		if key, _, _ := strings.Cut(setting, "="); strings.Contains(key, ".") {
+			specific = append(specific, setting)
+		} else {
+			shared = append(shared, setting)
+		}
+	}
+	// the shared settings go first, so that the tool-specific settings override them
+	for _, setting := range append(shared, specific...) {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid MCL limit, expected key=value: %s", setting)
+		}
+		tools := mclTools
+		if tool, name, ok := strings.Cut(key, "."); ok {
+			if !isMclTool(tool) {
+				return nil, fmt.Errorf("invalid MCL limit %s, unknown tool: %s", setting, tool)
+			}
+			tools, key = []string{tool}, name
+		}
+		for _, tool := range tools {
+			toolLimits := limits[tool]
+			switch key {
+			case "nice":
+				nice, err := strconv.Atoi(value)
+				if err != nil || nice < 0 || nice > 19 {
+					return nil, fmt.Errorf("invalid MCL limit %s, expected a niceness from 0 to 19", setting)
+				}
+				toolLimits.Nice = nice
+			case "cpus":
+				if value == "" || strings.Trim(value, "0123456789-,") != "" {
+					return nil, fmt.Errorf("invalid MCL limit %s, expected a CPU list such as 0-3,8", setting)
+				}
+				toolLimits.CPUs = value
+			case "memory":
+				memory, err := utils.ParseBytes(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid MCL limit %s: %v", setting, err)
+				}
+				toolLimits.Memory = memory
+			default:
+				return nil, fmt.Errorf("invalid MCL limit %s, unknown key: %s", setting, key)
+			}
+			limits[tool] = toolLimits
+		}
+	}
+	return limits, nil
+}
+
+// isMclTool returns whether a name is one of the MCL tools.
+func isMclTool(name string) bool {
+	for _, tool := range mclTools {
+		if tool == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mclCommand returns the command that runs an MCL tool from options.MclPath with the given arguments, within the
+// resource limits of the tool in options.MclLimits.
+func mclCommand(options Options, tool string, args ...string) *exec.Cmd {
+	argv := options.MclLimits[tool].wrap(append([]string{options.MclPath + tool}, args...))
+	return exec.Command(argv[0], argv[1:]...)
+}
@@ -0,0 +1,147 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+)
+
+// Approximate clustering of large experiments with MinHash and locality-sensitive hashing (LSH). Computing the
+// similarity of every pair of trajectories is quadratic, which is infeasible for 100k trajectories or more. Instead,
+// each trajectory gets a MinHash signature of its set of diagnoses, which is split into bands of rows. Trajectories
+// whose signatures agree on all rows of at least one band become candidate pairs, and only the similarities of the
+// candidate pairs are computed exactly. Two trajectories with a Jaccard similarity s of their diagnoses become a
+// candidate pair with probability 1-(1-s^rows)^bands, which rises steeply around the similarity (1/bands)^(1/rows).
+// More bands increase the recall, i.e. fewer similar pairs are missed, while more rows increase the precision, i.e.
+// fewer dissimilar pairs are computed. The pairs that are not candidates are treated as having similarity 0, as MCL
+// does for pairs that are not listed.
+
+// mix64 is the finalizer of the SplitMix64 generator, which scrambles the bits of x into a well distributed hash.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// minHashSignature returns the MinHash signature of a set of diagnoses, with a minimum hash per seed.
+func minHashSignature(diagnoses []int, seeds []uint64) []uint64 {
+	signature := make([]uint64, len(seeds))
+	for k, seed := range seeds {
+		min := ^uint64(0)
+		for _, did := range diagnoses {
+			if h := mix64(uint64(did) ^ seed); h < min {
+				min = h
+			}
+		}
+		signature[k] = min
+	}
+	return signature
+}
+
+// bandKey returns the hash of the rows of a band of a MinHash signature.
+func bandKey(band []uint64) uint64 {
+	key := uint64(len(band))
+	for _, h := range band {
+		key = mix64(key ^ h)
+	}
+	return key
+}
+
+// lshCandidates returns the candidate pairs of the trajectories of an experiment for MinHash signatures with the given
+// number of bands and rows per band. For each trajectory ID i, it lists the IDs j > i of its candidates in ascending
+// order. It also returns the number of candidate pairs. The seeds of the hash functions are fixed, so that the
+// candidates do not change between runs.
+func lshCandidates(exp *trajectory.Experiment, bands, rows int) ([][]int, uint64) {
+	seeds := make([]uint64, bands*rows)
+	for k := range seeds {
+		seeds[k] = mix64(uint64(k))
+	}
+	signatures := make([][]uint64, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		if len(t.Diagnoses) > 0 { // empty trajectories are not similar to any trajectory
+			signatures[i] = minHashSignature(t.Diagnoses, seeds)
+		}
+	}
+	neighbors := make([]map[int]bool, len(exp.Trajectories))
+	for b := 0; b < bands; b++ {
+		buckets := map[uint64][]int{}
+		keys := []uint64{}
+		for i, signature := range signatures {
+			if signature == nil {
+				continue
+			}
+			key := bandKey(signature[b*rows : (b+1)*rows])
+			if _, ok := buckets[key]; !ok {
+				keys = append(keys, key)
+			}
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, key := range keys {
+			bucket := buckets[key]
+			for x, i := range bucket {
+				for _, j := range bucket[x+1:] {
+					if neighbors[i] == nil {
+						neighbors[i] = map[int]bool{}
+					}
+					neighbors[i][j] = true
+				}
+			}
+		}
+	}
+	candidates := make([][]int, len(exp.Trajectories))
+	nofPairs := uint64(0)
+	for i, js := range neighbors {
+		for j := range js {
+			candidates[i] = append(candidates[i], j)
+		}
+		sort.Ints(candidates[i])
+		nofPairs += uint64(len(candidates[i]))
+	}
+	utils.Info("Found ", nofPairs, " candidate pairs of ", allPairs(len(exp.Trajectories)),
+		" pairs of trajectories with LSH, ", bands, " bands of ", rows, " rows.")
+	return candidates, nofPairs
+}
+
+// writeTrajectoriesAbcLSH writes the similarities of the candidate pairs of trajectories, cf. lshCandidates, in abc
+// format. The trajectories that are not part of any candidate pair are written as isolated nodes, with a loop of
+// similarity 0, so that they still end up in a cluster of their own. If directed is set, both directions of each
+// candidate pair are written, cf. directedSimilarity.
+func writeTrajectoriesAbcLSH(exp *trajectory.Experiment, w io.Writer, similarity TrajectorySimilarity,
+	candidates [][]int, directed bool) {
+	paired := make([]bool, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		t.ID = i
+		for _, j := range candidates[i] {
+			paired[i], paired[j] = true, true
+		}
+	}
+	for i := range exp.Trajectories {
+		if !paired[i] {
+			fmt.Fprintf(w, "%d\t%d\t%f\n", i, i, 0.0)
+		}
+		for _, j := range candidates[i] {
+			writeAbcPair(w, exp, similarity, i, j, directed)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"ptra/trajectory"
+	"ptra/utils"
+	"strings"
+)
+
+// The trajectory similarity matrix, exported for data scientists that want to run their own clustering, e.g. in
+// Python, without recomputing the similarities.
+
+// The formats in which the similarity matrix can be exported, cf. Options.MatrixFormats.
+const (
+	NpyMatrix     = "npy"     // the full matrix as a NumPy array of float32 values
+	ParquetMatrix = "parquet" // the sparse matrix as a Parquet table with the columns i, j, and similarity
+)
+
+// parquetRowGroupSize is the number of similarities per row group of the Parquet files.
+const parquetRowGroupSize = 1 << 20
+
+// ParseMatrixFormats parses a comma-separated list of similarity matrix formats, e.g. npy,parquet.
+func ParseMatrixFormats(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	formats := []string{}
+	for _, format := range strings.Split(s, ",") {
+		format = strings.TrimSpace(format)
+		if format != NpyMatrix && format != ParquetMatrix {
+			return nil, fmt.Errorf("unknown similarity matrix format %s, expected %s or %s", format, NpyMatrix,
+				ParquetMatrix)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// similarityMatrixWriter collects similarities in abc format into the full similarity matrix, and writes them to a
+// Parquet file as a sparse matrix. The similarities of 0 and the loops are left out of the sparse matrix. Like
+// similarityGraphWriter, it never fails a write, but records the first error instead.
+type similarityMatrixWriter struct {
+	n       int
+	mirror  bool      // whether a similarity also fills in the reverse pair of the full matrix, cf. directedSimilarity
+	dense   []float32 // the full matrix, nil if it is not exported
+	sparse  *utils.ParquetWriter
+	entries int
+	partial []byte
+	err     error
+}
+
+// Write collects the complete lines of similarities in p.
+func (m *similarityMatrixWriter) Write(p []byte) (int, error) {
+	if m.err == nil {
+		m.partial, m.err = writeAbcLines(m.partial, p, m.parseLine)
+	}
+	return len(p), nil
+}
+
+// parseLine collects a line with two trajectory IDs and their similarity.
+func (m *similarityMatrixWriter) parseLine(line string) error {
+	id1, id2, weight, ok, err := parseAbcLine(line)
+	if !ok || id1 == id2 {
+		return err
+	}
+	if id1 >= m.n || id2 >= m.n {
+		return fmt.Errorf("invalid similarity %q, the experiment has %d trajectories", line, m.n)
+	}
+	if m.dense != nil {
+		m.dense[id1*m.n+id2] = float32(weight)
+		if m.mirror {
+			m.dense[id2*m.n+id1] = float32(weight)
+		}
+	}
+	if m.sparse != nil && weight > 0 {
+		m.entries++
+		return m.sparse.Write(int32(id1), int32(id2), weight)
+	}
+	return nil
+}
+
+// flush collects an incomplete last line, in case the similarities do not end with a newline.
+func (m *similarityMatrixWriter) flush() error {
+	if m.err != nil {
+		return m.err
+	}
+	line := string(m.partial)
+	m.partial = nil
+	return m.parseLine(line)
+}
+
+// withSimilarityMatrix wraps a writer of similarities in abc format, so that the similarity matrix is also written in
+// the given formats, to fileName.npy and fileName.parquet, cf. NpyMatrix and ParquetMatrix. The rows and columns of
+// the matrix are the IDs of the trajectories in the clustering outputs. The full matrix has a diagonal of 1, and a
+// similarity of 0 for the pairs that are not written, e.g. below Options.MinSimilarity or not LSH candidates. It is
+// collected in memory, which takes 4 bytes per pair of trajectories, whereas the sparse matrix is streamed to the
+// Parquet file, with a row per pair of trajectories with a similarity above 0. The full matrix is symmetric, unless
+// directed is set, in which case its rows are the trajectories that are contained in its columns, cf.
+// ContainmentTrajectory.
+func withSimilarityMatrix(exp *trajectory.Experiment, fileName string, formats []string, directed bool,
+	writeAbc func(w io.Writer)) func(w io.Writer) {
+	return func(w io.Writer) {
+		n := len(exp.Trajectories)
+		m := &similarityMatrixWriter{n: n, mirror: !directed}
+		var parquetFile io.WriteCloser
+		for _, format := range formats {
+			switch format {
+			case NpyMatrix:
+				m.dense = make([]float32, n*n)
+				for i := 0; i < n; i++ {
+					m.dense[i*n+i] = 1
+				}
+			case ParquetMatrix:
+				var err error
+				if parquetFile, err = utils.CreateFile(fileName + ".parquet"); err != nil {
+					log.Panic(err)
+				}
+				m.sparse = utils.NewParquetWriter(parquetFile, []utils.ParquetColumn{{Name: "i", Type: utils.ParquetInt32},
+					{Name: "j", Type: utils.ParquetInt32}, {Name: "similarity", Type: utils.ParquetDouble}},
+					parquetRowGroupSize)
+			}
+		}
+		writeAbc(io.MultiWriter(w, m))
+		if err := m.flush(); err != nil {
+			log.Panic(fmt.Sprintf("%s: %v", fileName, err))
+		}
+		if m.sparse != nil {
+			if err := m.sparse.Close(); err != nil {
+				log.Panic(err)
+			}
+			if err := parquetFile.Close(); err != nil {
+				log.Panic(err)
+			}
+			utils.Info("Wrote the ", m.entries, " similarities above 0 to ", fileName+".parquet")
+		}
+		if m.dense != nil {
+			file, err := utils.CreateFile(fileName + ".npy")
+			if err != nil {
+				log.Panic(err)
+			}
+			if err := utils.WriteNpyMatrix(file, n, m.dense); err != nil {
+				log.Panic(err)
+			}
+			if err := file.Close(); err != nil {
+				log.Panic(err)
+			}
+			utils.Info("Wrote the ", n, "x", n, " similarity matrix to ", fileName+".npy")
+		}
+	}
+}
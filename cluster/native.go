@@ -0,0 +1,363 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A native implementation of the Markov cluster algorithm (MCL), so that trajectories can be clustered without
+// installing the mcl binaries, e.g. for the demo or for small runs. It follows the defaults of the mcl binaries: loops
+// are added with the maximum weight of their column, the matrix is expanded by squaring it, and inflated with the
+// granularity divided by 10. Small entries are pruned after each inflation to keep the matrix sparse. For large runs,
+// the mcl binaries are faster and use less memory.
+
+// NativeClusterer is the name of the native MCL implementation for --clusterer, cf. Options.Native.
+const NativeClusterer = "native"
+
+const (
+	nativeMaxIterations  = 100  // the maximum number of expansion and inflation steps
+	nativePruneThreshold = 1e-4 // entries below this value are pruned after each inflation
+	nativeMaxEntries     = 500  // the maximum number of entries kept per column after each inflation
+	nativeConvergence    = 1e-6 // the maximum change of an entry at which the matrix has converged
+)
+
+// sparseColumn is a column of a sparse matrix, with the rows in increasing order.
+type sparseColumn struct {
+	rows   []int
+	values []float64
+}
+
+// normalize scales a column so that its values sum to 1.
+func (c *sparseColumn) normalize() {
+	sum := 0.0
+	for _, v := range c.values {
+		sum += v
+	}
+	if sum == 0 {
+		return
+	}
+	for i := range c.values {
+		c.values[i] /= sum
+	}
+}
+
+// abcGraph parses trajectory similarities in abc format, as written by writeTrajectoriesAbc, into a graph for the
+// native MCL. It is an io.Writer, so that the similarities can be streamed into it as into mcxload. Pairs with a
+// similarity of 0 add their trajectories as nodes without an edge. Like mcxload --stream-mirror, the graph is
+// undirected, unless the similarities are asymmetric, cf. directedSimilarity.
+type abcGraph struct {
+	nodes   map[int]int       // maps trajectory IDs onto node indexes
+	mirror  bool              // whether an edge is also added in the reverse direction
+	ids     []int             // the trajectory ID of each node
+	edges   []map[int]float64 // the similarities of each node with the other nodes
+	partial []byte            // an incomplete last line of the previous write
+	err     error             // the first parse error, since the writers of the similarities ignore write errors
+}
+
+// newAbcGraph creates a graph with nodes for the given trajectory IDs. If directed is set, the edges are not mirrored.
+func newAbcGraph(ids []int, directed bool) *abcGraph {
+	g := &abcGraph{nodes: map[int]int{}, mirror: !directed}
+	for _, id := range ids {
+		g.node(id)
+	}
+	return g
+}
+
+// node returns the index of the node of a trajectory ID, and adds the node if needed.
+func (g *abcGraph) node(id int) int {
+	if i, ok := g.nodes[id]; ok {
+		return i
+	}
+	g.nodes[id] = len(g.ids)
+	g.ids = append(g.ids, id)
+	g.edges = append(g.edges, map[int]float64{})
+	return len(g.ids) - 1
+}
+
+// writeAbcLines passes the complete lines of similarities in the data of a write to parseLine, and returns the
+// incomplete last line.
+func writeAbcLines(partial, p []byte, parseLine func(line string) error) ([]byte, error) {
+	data := append(partial, p...)
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		if err := parseLine(string(data[:end])); err != nil {
+			return nil, err
+		}
+		data = data[end+1:]
+	}
+	return append([]byte{}, data...), nil
+}
+
+// parseAbcLine parses a line with two trajectory IDs and their similarity. An empty line has no IDs, and returns ok
+// false.
+func parseAbcLine(line string) (id1, id2 int, weight float64, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, 0, 0, false, nil
+	}
+	if len(fields) != 3 {
+		return 0, 0, 0, false, fmt.Errorf("invalid similarity %q, expected two trajectory IDs and a similarity", line)
+	}
+	id1, err1 := strconv.Atoi(fields[0])
+	id2, err2 := strconv.Atoi(fields[1])
+	weight, err3 := strconv.ParseFloat(fields[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil || weight < 0 {
+		return 0, 0, 0, false, fmt.Errorf("invalid similarity %q, expected two trajectory IDs and a similarity", line)
+	}
+	return id1, id2, weight, true, nil
+}
+
+// Write parses the complete lines of similarities in p.
+func (g *abcGraph) Write(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	if g.partial, g.err = writeAbcLines(g.partial, p, g.parseLine); g.err != nil {
+		return 0, g.err
+	}
+	return len(p), nil
+}
+
+// parseLine parses a line with two trajectory IDs and their similarity.
+func (g *abcGraph) parseLine(line string) error {
+	id1, id2, weight, ok, err := parseAbcLine(line)
+	if !ok {
+		return err
+	}
+	n1, n2 := g.node(id1), g.node(id2)
+	if weight > 0 && n1 != n2 {
+		// mcxload keeps the maximum of the weights of a pair that occurs more than once
+		g.edges[n1][n2] = math.Max(g.edges[n1][n2], weight)
+		if g.mirror {
+			g.edges[n2][n1] = math.Max(g.edges[n2][n1], weight)
+		}
+	}
+	return nil
+}
+
+// flush parses an incomplete last line, in case the similarities do not end with a newline.
+func (g *abcGraph) flush() error {
+	if g.err != nil {
+		return g.err
+	}
+	line := string(g.partial)
+	g.partial = nil
+	return g.parseLine(line)
+}
+
+// matrix returns the column-stochastic matrix of the graph, with loops that have the maximum weight of their column.
+func (g *abcGraph) matrix() []*sparseColumn {
+	m := make([]*sparseColumn, len(g.ids))
+	for j, edges := range g.edges {
+		column := &sparseColumn{}
+		loop := 1.0
+		if len(edges) > 0 {
+			loop = 0
+			for _, w := range edges {
+				loop = math.Max(loop, w)
+			}
+		}
+		rows := append(utils.SortedKeys(edges), j)
+		sort.Ints(rows)
+		for _, i := range rows {
+			column.rows = append(column.rows, i)
+			if i == j {
+				column.values = append(column.values, loop)
+			} else {
+				column.values = append(column.values, edges[i])
+			}
+		}
+		column.normalize()
+		m[j] = column
+	}
+	return m
+}
+
+// expand squares a sparse matrix. The columns are accumulated in a dense vector, in the order of the rows, so that
+// the result does not depend on map iteration order.
+func expand(m []*sparseColumn) []*sparseColumn {
+	result := make([]*sparseColumn, len(m))
+	acc := make([]float64, len(m))
+	touched := make([]bool, len(m))
+	for j, column := range m {
+		rows := []int{}
+		for k, row := range column.rows {
+			v := column.values[k]
+			next := m[row]
+			for l, i := range next.rows {
+				if !touched[i] {
+					touched[i] = true
+					rows = append(rows, i)
+				}
+				acc[i] += v * next.values[l]
+			}
+		}
+		sort.Ints(rows)
+		c := &sparseColumn{rows: rows, values: make([]float64, len(rows))}
+		for k, i := range rows {
+			c.values[k] = acc[i]
+			acc[i] = 0
+			touched[i] = false
+		}
+		result[j] = c
+	}
+	return result
+}
+
+// inflate raises the entries of a column to the power of the inflation, prunes the small entries, and normalizes
+// the column.
+func (c *sparseColumn) inflate(inflation float64) {
+	for k, v := range c.values {
+		c.values[k] = math.Pow(v, inflation)
+	}
+	c.normalize()
+	keep := []int{}
+	for k, v := range c.values {
+		if v >= nativePruneThreshold {
+			keep = append(keep, k)
+		}
+	}
+	if len(keep) == 0 {
+		// keep the largest entry, so that the column is not emptied
+		largest := 0
+		for k, v := range c.values {
+			if v > c.values[largest] {
+				largest = k
+			}
+		}
+		keep = []int{largest}
+	}
+	if len(keep) > nativeMaxEntries {
+		sort.SliceStable(keep, func(a, b int) bool { return c.values[keep[a]] > c.values[keep[b]] })
+		keep = keep[:nativeMaxEntries]
+		sort.Ints(keep)
+	}
+	rows, values := make([]int, len(keep)), make([]float64, len(keep))
+	for k, index := range keep {
+		rows[k], values[k] = c.rows[index], c.values[index]
+	}
+	c.rows, c.values = rows, values
+	c.normalize()
+}
+
+// converged checks if no entry of two matrices differs by more than nativeConvergence.
+func converged(m1, m2 []*sparseColumn) bool {
+	for j := range m1 {
+		c1, c2 := m1[j], m2[j]
+		k1, k2 := 0, 0
+		for k1 < len(c1.rows) || k2 < len(c2.rows) {
+			switch {
+			case k2 == len(c2.rows) || (k1 < len(c1.rows) && c1.rows[k1] < c2.rows[k2]):
+				if c1.values[k1] > nativeConvergence {
+					return false
+				}
+				k1++
+			case k1 == len(c1.rows) || c2.rows[k2] < c1.rows[k1]:
+				if c2.values[k2] > nativeConvergence {
+					return false
+				}
+				k2++
+			default:
+				if math.Abs(c1.values[k1]-c2.values[k2]) > nativeConvergence {
+					return false
+				}
+				k1++
+				k2++
+			}
+		}
+	}
+	return true
+}
+
+// mcl clusters the graph with the Markov cluster algorithm at the given inflation. The clusters are the connected
+// components of the converged matrix, i.e. each attractor system with the nodes it attracts, as mcl interprets its
+// result. It returns the trajectory IDs per cluster.
+func (g *abcGraph) mcl(inflation float64) [][]int {
+	m := g.matrix()
+	for iteration := 0; iteration < nativeMaxIterations; iteration++ {
+		next := expand(m)
+		for _, c := range next {
+			c.inflate(inflation)
+		}
+		done := converged(m, next)
+		m = next
+		if done {
+			break
+		}
+	}
+	parent := make([]int, len(m))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for j, c := range m {
+		for _, i := range c.rows {
+			parent[find(i)] = find(j)
+		}
+	}
+	components := map[int][]int{}
+	for i := range m {
+		root := find(i)
+		components[root] = append(components[root], g.ids[i])
+	}
+	clusters := [][]int{}
+	for _, root := range utils.SortedKeys(components) {
+		clusters = append(clusters, components[root])
+	}
+	trajectory.SortClusters(clusters)
+	return clusters
+}
+
+// runNativeMcl clusters the trajectories with the native MCL for each of the granularities. The similarities are
+// produced by writeAbc. The clusterings are written to files outFileName.I<granularity> in the format of mcxdump, so
+// that they are processed in the same way as the clusterings of the mcl binaries. If directed is set, the directed
+// similarity graph is clustered, cf. directedSimilarity.
+func runNativeMcl(exp *trajectory.Experiment, granularities []int, outFileName string, directed bool,
+	writeAbc func(w io.Writer)) error {
+	g := newAbcGraph(trajectoryIDs(exp), directed)
+	writeAbc(g)
+	if err := g.flush(); err != nil {
+		return err
+	}
+	stage := utils.StartStage("Clustering trajectories", len(granularities))
+	for _, gran := range granularities {
+		utils.Detail("Native MCL with inflation ", float64(gran)/10.0)
+		writeMclDumpFile(fmt.Sprintf("%s.I%d", outFileName, gran), g.mcl(float64(gran)/10.0))
+		stage.Add(1)
+	}
+	return nil
+}
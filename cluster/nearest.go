@@ -0,0 +1,81 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"fmt"
+	"ptra/trajectory"
+	"sort"
+
+	"github.com/exascience/pargo/parallel"
+)
+
+// Neighbor is a trajectory that is similar to a query trajectory, with its index in the experiment and its
+// similarity, cf. NearestTrajectories.
+type Neighbor struct {
+	Trajectory *trajectory.Trajectory
+	Index      int
+	Similarity float64
+}
+
+// NearestTrajectories returns the k trajectories of an experiment that are most similar to the trajectory with the
+// given ID, by decreasing similarity, so that similar trajectories can be looked up without clustering. As for the
+// clustering, the ID of a trajectory is its index in the experiment. The experiment is only read, so that it can be
+// queried concurrently, e.g. a snapshot of a trajectory.Store, and the IDs of its trajectories are left as they are.
+// The metric is the name of a trajectory similarity measure, as in Options.Similarity. The query trajectory itself is
+// left out, and ties are broken by the order of the trajectories in the experiment. Fewer than k trajectories are
+// returned if the experiment has no more trajectories. It returns an error if there is no trajectory with the ID, if k
+// is not positive, or if the metric is unknown.
+func NearestTrajectories(exp *trajectory.Experiment, trajectoryID, k int, metric string) ([]Neighbor, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("the number of nearest trajectories must be positive, got %d", k)
+	}
+	if trajectoryID < 0 || trajectoryID >= len(exp.Trajectories) {
+		return nil, fmt.Errorf("trajectory %d does not exist, the experiment has %d trajectories", trajectoryID,
+			len(exp.Trajectories))
+	}
+	query := trajectoryID
+	similarity, err := lookupTrajectorySimilarity(exp, metric)
+	if err != nil {
+		return nil, err
+	}
+	q := exp.Trajectories[query]
+	similarities := make([]float64, len(exp.Trajectories))
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for i := low; i < high; i++ {
+			similarities[i] = similarity(q, exp.Trajectories[i])
+		}
+	})
+	candidates := make([]int, 0, len(exp.Trajectories)-1)
+	for i := range exp.Trajectories {
+		if i != query {
+			candidates = append(candidates, i)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return similarities[candidates[i]] > similarities[candidates[j]]
+	})
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+	neighbors := make([]Neighbor, k)
+	for i, c := range candidates[:k] {
+		neighbors[i] = Neighbor{Trajectory: exp.Trajectories[c], Index: c, Similarity: similarities[c]}
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,94 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"math"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+)
+
+// nullModelPairs is the number of random pairs of shuffled trajectories of which the similarities make up the null
+// distribution, cf. nullModelCutoff.
+const nullModelPairs = 10000
+
+// nullModelSeed is the seed of the shuffles and the random pairs of the null model, so that the cutoff of a clustering
+// is reproducible.
+const nullModelSeed = 1
+
+// shuffledTrajectories returns copies of the trajectories of an experiment of which the diagnoses are shuffled across
+// the trajectories: the diagnoses of all trajectories are pooled and dealt out randomly over trajectories of the same
+// lengths. This keeps the frequencies of the diagnoses and the lengths of the trajectories, but breaks up which
+// diagnoses occur together and in which order. The copies keep the patient numbers and the patients of the
+// trajectories, so the patients are not shuffled.
+func shuffledTrajectories(exp *trajectory.Experiment, rng utils.Random) []*trajectory.Trajectory {
+	pool := []int{}
+	for _, t := range exp.Trajectories {
+		pool = append(pool, t.Diagnoses...)
+	}
+	for i := len(pool) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		pool[i], pool[j] = pool[j], pool[i]
+	}
+	shuffled := make([]*trajectory.Trajectory, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		shuffled[i] = &trajectory.Trajectory{Diagnoses: pool[:len(t.Diagnoses):len(t.Diagnoses)],
+			PatientNumbers: t.PatientNumbers, Patients: t.Patients, ID: t.ID}
+		pool = pool[len(t.Diagnoses):]
+	}
+	return shuffled
+}
+
+// nullModelCutoff estimates a null distribution of the clustering similarities of an experiment with the given
+// options, cf. clusteringSimilarity, as the similarities of random pairs of shuffled trajectories, cf.
+// shuffledTrajectories, and returns the given percentile of it, e.g. 95 for the similarity that only 5% of the pairs
+// of unrelated trajectories exceed. The shuffled trajectories keep the rate of progression of the trajectories they
+// replace, cf. Options.TemporalWeight, so that the timing of unrelated trajectories is that of random pairs of
+// trajectories. It returns 0 for experiments with fewer than two trajectories.
+func nullModelCutoff(exp *trajectory.Experiment, options Options, percentile float64) float64 {
+	if len(exp.Trajectories) < 2 {
+		return 0
+	}
+	rng := utils.Rand().New(nullModelSeed)
+	shuffled := shuffledTrajectories(exp, rng)
+	temporalWeight := options.TemporalWeight
+	options.TemporalWeight = 0
+	similarity := clusteringSimilarity(exp, options)
+	if temporalWeight > 0 {
+		features := make(map[*trajectory.Trajectory]temporalFeatures, len(shuffled))
+		for i, t := range shuffled {
+			features[t] = computeTemporalFeatures(exp.Trajectories[i])
+		}
+		similarity = withTemporalSimilarity(similarity, temporalWeight, features)
+	}
+	similarities := make([]float64, nullModelPairs)
+	for k := range similarities {
+		i := rng.Intn(len(shuffled))
+		j := rng.Intn(len(shuffled) - 1)
+		if j >= i {
+			j++
+		}
+		similarities[k] = similarity(shuffled[i], shuffled[j])
+	}
+	sort.Float64s(similarities)
+	cutoff := similarities[int(math.Ceil(percentile/100*float64(len(similarities)-1)))]
+	utils.Info("The similarity at percentile ", percentile, " of the null model of ", nullModelPairs,
+		" pairs of shuffled trajectories is ", cutoff)
+	return cutoff
+}
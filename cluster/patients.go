@@ -0,0 +1,95 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"ptra/trajectory"
+	"ptra/utils"
+	"slices"
+)
+
+// Population-based trajectory similarity. The other measures compare the diagnoses of trajectories, so that clusters
+// reflect shared codes. The measure in this file compares the patients that follow the trajectories instead, so that
+// clusters reflect shared populations.
+
+// trajectoryPIDs returns the sorted IDs of the patients that follow the full trajectory, cf. trajectory.LastPatients.
+func trajectoryPIDs(t *trajectory.Trajectory) []int {
+	pids := []int{}
+	for _, p := range trajectory.LastPatients(t) {
+		pids = append(pids, p.PID)
+	}
+	slices.Sort(pids)
+	return slices.Compact(pids)
+}
+
+// patientJaccard computes the Jaccard similarity coefficient of two sorted sets of patient IDs.
+func patientJaccard(pids1, pids2 []int) float64 {
+	if len(pids1) == 0 || len(pids2) == 0 { // trajectories without patients are not similar to any trajectory
+		return 0
+	}
+	n := utils.SortedIntersectionSize(pids1, pids2)
+	return float64(n) / float64(len(pids1)+len(pids2)-n)
+}
+
+// PatientJaccardTrajectory computes the similarity of two trajectories as the Jaccard similarity coefficient of the
+// patients that follow them, cf. trajectory.LastPatients. Trajectories that are followed by the same patients are then
+// similar, even if they share no diagnoses. Trajectories without patients, e.g. read from a .ptra file, are not
+// similar to any trajectory.
+func PatientJaccardTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	return patientJaccard(trajectoryPIDs(t1), trajectoryPIDs(t2))
+}
+
+// newPatientJaccard returns PatientJaccardTrajectory for the trajectories of an experiment, with the patients of the
+// trajectories collected once rather than for each pair of trajectories.
+func newPatientJaccard(exp *trajectory.Experiment) TrajectorySimilarity {
+	pids := make(map[*trajectory.Trajectory][]int, len(exp.Trajectories))
+	withPatients := 0
+	for _, t := range exp.Trajectories {
+		pids[t] = trajectoryPIDs(t)
+		if len(pids[t]) > 0 {
+			withPatients++
+		}
+	}
+	if withPatients == 0 && len(exp.Trajectories) > 0 {
+		utils.Warning("the trajectories have no patients, so the patient similarity of all trajectories is 0.")
+	}
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		pids1, ok1 := pids[t1]
+		if !ok1 {
+			pids1 = trajectoryPIDs(t1)
+		}
+		pids2, ok2 := pids[t2]
+		if !ok2 {
+			pids2 = trajectoryPIDs(t2)
+		}
+		return patientJaccard(pids1, pids2)
+	}
+}
+
+// withPatientOverlap combines a trajectory similarity of the diagnoses with the similarity of the patients that follow
+// the trajectories, cf. PatientJaccardTrajectory. The result is (1 - weight) * similarity + weight * patient
+// similarity, so that the clusters capture both the clinical content of the trajectories and the populations that
+// follow them.
+func withPatientOverlap(exp *trajectory.Experiment, similarity TrajectorySimilarity,
+	weight float64) TrajectorySimilarity {
+	patients := newPatientJaccard(exp)
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		return (1-weight)*similarity(t1, t2) + weight*patients(t1, t2)
+	}
+}
@@ -0,0 +1,139 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// Checking the disk space needed by the clustering before it starts. The similarity of every pair of trajectories ends
+// up on disk, so the intermediate files grow quadratically with the number of trajectories, and a run on a full disk
+// would otherwise only fail when mcxload or mcl cannot write their output.
+
+const (
+	similarityBytes          = 9    // a similarity written with %f, e.g. 0.250000, plus a separator
+	outputBytesPerTrajectory = 2048 // the graphs, tab, and alignment files per granularity, per trajectory
+	outputBytesPerPatient    = 128  // the patient and cluster csv files per granularity, per patient
+	diskSpaceMargin          = 1.1  // the estimates are rough, require 10% more free space
+)
+
+// decimalDigits returns the number of decimal digits of n.
+func decimalDigits(n int) uint64 {
+	d := uint64(1)
+	for ; n >= 10; n /= 10 {
+		d++
+	}
+	return d
+}
+
+// EstimateClusteringDiskUsage estimates the number of bytes written when clustering nofTrajectories trajectories of a
+// cohort of nofPatients patients directly. Each pair of trajectories is written once to the abc file, if it is
+// materialized, and twice to the mci matrix, since mcxload mirrors it. With an asymmetric similarity, cf.
+// directedSimilarity, both directions of each pair are written to the abc file instead. The tab file, the clusterings,
+// and the outputs per granularity grow linearly with the number of trajectories and patients. The native MCL writes no
+// intermediate files.
+func EstimateClusteringDiskUsage(nofTrajectories, nofPatients int, options Options) uint64 {
+	return estimateClusteringDiskUsage(nofTrajectories, allPairs(nofTrajectories), nofPatients, options)
+}
+
+// allPairs returns the number of pairs of n trajectories.
+func allPairs(n int) uint64 {
+	if n < 2 {
+		return 0
+	}
+	return uint64(n) * uint64(n-1) / 2
+}
+
+// estimateClusteringDiskUsage estimates the number of bytes written when clustering nofTrajectories trajectories
+// directly, of which only nofPairs pairs are written, e.g. the candidate pairs of lshCandidates.
+func estimateClusteringDiskUsage(nofTrajectories int, nofPairs uint64, nofPatients int, options Options) uint64 {
+	n := uint64(nofTrajectories)
+	d := decimalDigits(nofTrajectories)
+	size := uint64(0)
+	if (options.AbcFile && !options.Native) || options.Clusterer != nil {
+		size += nofPairs * (2*(d+1) + similarityBytes)
+		if directedSimilarity(options) {
+			size *= 2
+		}
+	}
+	if options.Clusterer == nil && !options.Native {
+		size += 2 * nofPairs * (d + 1 + similarityBytes)
+		size += n * (2*d + 2)
+	}
+	grans := uint64(len(options.Granularities))
+	size += grans * (2*n*(d+1) + n*outputBytesPerTrajectory + uint64(nofPatients)*outputBytesPerPatient)
+	return size
+}
+
+// PreflightDiskSpace checks at the start of a run, before the relative risk ratios and the trajectories are computed,
+// that the file system of the working dir has enough free space for clustering at most maxTrajectories trajectories of
+// a cohort of nofPatients patients, cf. preflightDiskSpace. Since the number of trajectories is only known once they
+// are built, only the outputs per patient are estimated if maxTrajectories is 0. The clustering checks the disk space
+// again once the trajectories are built.
+func PreflightDiskSpace(workingDir string, maxTrajectories, nofPatients int, options *Options) error {
+	return checkDiskSpace(workingDir, maxTrajectories, allPairs(maxTrajectories), nofPatients, options)
+}
+
+// preflightDiskSpace checks that the file system of the working dir has enough free space for clustering the
+// trajectories of the experiment, of which nofPairs pairs are written, cf. EstimateClusteringDiskUsage and
+// checkDiskSpace.
+func preflightDiskSpace(exp *trajectory.Experiment, workingDir string, nofPairs uint64, options *Options) error {
+	return checkDiskSpace(workingDir, len(exp.Trajectories), nofPairs, exp.PatientCtr, options)
+}
+
+// checkDiskSpace checks that the file system of the working dir has enough free space for clustering nofTrajectories
+// trajectories of a cohort of nofPatients patients, of which nofPairs pairs are written. If there is only enough space
+// when the similarities are streamed into mcxload, it switches options.AbcFile off. If there is not enough space at
+// all, it returns an error before anything is written. The check is skipped if options.SkipDiskCheck is set, or if
+// the free space cannot be determined.
+func checkDiskSpace(workingDir string, nofTrajectories int, nofPairs uint64, nofPatients int, options *Options) error {
+	if options.SkipDiskCheck {
+		return nil
+	}
+	free, ok := utils.FreeDiskSpace(workingDir)
+	if !ok {
+		utils.Warning("cannot determine the free disk space in ", workingDir, ", skipping the disk space check.")
+		return nil
+	}
+	needed := func(options Options) uint64 {
+		estimate := estimateClusteringDiskUsage(nofTrajectories, nofPairs, nofPatients, options)
+		return uint64(float64(estimate) * diskSpaceMargin)
+	}
+	estimate := needed(*options)
+	utils.Info("Estimated disk usage of the clustering: ", utils.FormatBytes(estimate), ", available: ",
+		utils.FormatBytes(free))
+	if estimate <= free {
+		return nil
+	}
+	if options.AbcFile && options.Clusterer == nil {
+		streaming := *options
+		streaming.AbcFile = false
+		if needed(streaming) <= free {
+			utils.Warning("not enough disk space for the .abc file, streaming the similarities into mcxload " +
+				"instead.")
+			options.AbcFile = false
+			return nil
+		}
+	}
+	return fmt.Errorf("not enough disk space in %s: clustering %d trajectories of %d patients needs an estimated %s, "+
+		"but only %s is available (use --skipDiskCheck to cluster anyway)", workingDir, nofTrajectories, nofPatients,
+		utils.FormatBytes(estimate), utils.FormatBytes(free))
+}
@@ -0,0 +1,157 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+)
+
+// The scorer protocol is used to compute trajectory similarities with an external executable, so that domain-specific
+// similarity metrics can be used without recompiling ptra. ptra starts the executable once and writes the following
+// to its stdin. All numbers are little endian, strings are a uint32 length followed by the UTF-8 bytes.
+//
+//	magic        "PTRA"
+//	version      uint32, currently 1
+//	diagnoses    uint32 count, followed per diagnosis by its int32 ID, its original code (string), its name (string)
+//	trajectories uint32 count, followed per trajectory by a uint32 length and that many int32 diagnosis IDs
+//	pairs        uint64 count, followed per pair by two uint32 trajectory indices
+//
+// The executable writes a float64 similarity score to its stdout for each pair, in the same order as the pairs. Scores
+// <= 0 mean the trajectories are not similar. The executable can start writing scores before all pairs are read.
+const (
+	scorerMagic   = "PTRA"
+	scorerVersion = 1
+)
+
+// scorerWriter writes the scorer protocol, and remembers the first error.
+type scorerWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (sw *scorerWriter) write(v interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.LittleEndian, v)
+	}
+}
+
+func (sw *scorerWriter) writeString(s string) {
+	sw.write(uint32(len(s)))
+	if sw.err == nil {
+		_, sw.err = sw.w.WriteString(s)
+	}
+}
+
+// writeScorerInput writes the diagnoses, the trajectories, and the pairs of trajectories i < j to be scored.
+func writeScorerInput(exp *trajectory.Experiment, w io.Writer) error {
+	sw := &scorerWriter{w: bufio.NewWriter(w)}
+	sw.write([]byte(scorerMagic))
+	sw.write(uint32(scorerVersion))
+	dids := []int{}
+	for did := range exp.NameMap {
+		dids = append(dids, did)
+	}
+	sort.Ints(dids)
+	sw.write(uint32(len(dids)))
+	for _, did := range dids {
+		sw.write(int32(did))
+		sw.writeString(exp.IdMap[did])
+		sw.writeString(exp.NameMap[did])
+	}
+	sw.write(uint32(len(exp.Trajectories)))
+	for _, t := range exp.Trajectories {
+		sw.write(uint32(len(t.Diagnoses)))
+		for _, d := range t.Diagnoses {
+			sw.write(int32(d))
+		}
+	}
+	n := uint64(len(exp.Trajectories))
+	sw.write(n * (n - 1) / 2)
+	for i := range exp.Trajectories {
+		for j := i + 1; j < len(exp.Trajectories); j++ {
+			sw.write([2]uint32{uint32(i), uint32(j)})
+		}
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// writeTrajectoriesAbcWithScorer computes the similarity between each trajectory with the external scorer executable
+// and writes out the result in abc format to the given writer.
+func writeTrajectoriesAbcWithScorer(exp *trajectory.Experiment, scorerPath string, w io.Writer) {
+	utils.Info("Scoring trajectory similarities with ", scorerPath)
+	cmd := exec.Command(scorerPath)
+	cmd.Stderr = os.Stderr
+	end := utils.TraceCommand(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Panic(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := cmd.Start(); err != nil {
+		end(err)
+		log.Panic(err)
+	}
+	// write the input concurrently with reading the scores, so the pipes cannot fill up and block both processes
+	writeErr := make(chan error, 1)
+	go func() {
+		err := writeScorerInput(exp, stdin)
+		if cerr := stdin.Close(); err == nil {
+			err = cerr
+		}
+		writeErr <- err
+	}()
+	reader := bufio.NewReader(stdout)
+	for i, t1 := range exp.Trajectories {
+		t1.ID = i
+		for j := i + 1; j < len(exp.Trajectories); j++ {
+			exp.Trajectories[j].ID = j
+			var score float64
+			if err := binary.Read(reader, binary.LittleEndian, &score); err != nil {
+				log.Panic(fmt.Errorf("reading score of trajectories %d and %d from %s: %v", i, j, scorerPath, err))
+			}
+			if score > 0 && !math.IsInf(score, 0) && !math.IsNaN(score) {
+				fmt.Fprintf(w, "%d\t%d\t%f\n", i, j, score)
+			}
+		}
+	}
+	if err := <-writeErr; err != nil {
+		log.Panic(fmt.Errorf("writing trajectories to %s: %v", scorerPath, err))
+	}
+	err = cmd.Wait()
+	end(err)
+	if err != nil {
+		log.Panic(fmt.Errorf("%s: %v", scorerPath, err))
+	}
+}
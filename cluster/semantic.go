@@ -0,0 +1,161 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// TrajectorySimilarity is a similarity measure between trajectories for clustering, between 0 for unrelated
+// trajectories and 1 for the same trajectories. Any measure can be used for clustering with Options.SimilarityFunc,
+// e.g. SzymkiewiczSimpsonTrajectory or a measure of one's own, without changing the cluster package. A measure must be
+// symmetric, except for ContainmentTrajectory, cf. directedSimilarity, and safe for concurrent use, since the
+// similarities are computed in parallel.
+type TrajectorySimilarity func(t1, t2 *trajectory.Trajectory) float64
+
+// The trajectory similarity measures that can be used for clustering, cf. Options.Similarity.
+const (
+	JaccardSimilarity            = "jaccard"     // the Jaccard similarity coefficient of the diagnoses of both trajectories
+	SemanticSimilarity           = "semantic"    // the Jaccard similarity with soft matching of related diagnoses
+	SzymkiewiczSimpsonSimilarity = "overlap"     // the Szymkiewicz-Simpson overlap coefficient of the diagnoses
+	SorensenDiceSimilarity       = "dice"        // the Sorensen-Dice similarity coefficient of the diagnoses
+	LCSSimilarity                = "lcs"         // the longest common subsequence of the diagnoses, cf. LCSTrajectory
+	EditDistanceSimilarity       = "edit"        // the edit distance between the diagnoses, cf. EditDistanceTrajectory
+	DTWSimilarity                = "dtw"         // dynamic time warping of the diagnoses on a time axis, cf. DTWTrajectory
+	RRWeightedJaccardSimilarity  = "rrjaccard"   // the Jaccard similarity weighted by the RRs, cf. newRRWeightedJaccard
+	PatientSimilarity            = "patients"    // the Jaccard similarity of the patients, cf. PatientJaccardTrajectory
+	HierarchySimilarity          = "hierarchy"   // the Jaccard similarity with partial credit for shared ancestor codes
+	BigramSimilarity             = "bigram"      // the Jaccard similarity of the transitions, cf. BigramTrajectory
+	EmbeddingSimilarity          = "embedding"   // the Jaccard similarity with soft matching of close code embeddings
+	ContainmentSimilarity        = "containment" // the asymmetric containment of the diagnoses, cf. ContainmentTrajectory
+)
+
+// trajectorySimilarity returns the trajectory similarity measure with the given name.
+func trajectorySimilarity(exp *trajectory.Experiment, name string) TrajectorySimilarity {
+	similarity, err := lookupTrajectorySimilarity(exp, name)
+	if err != nil {
+		log.Panic(err)
+	}
+	return similarity
+}
+
+// lookupTrajectorySimilarity returns the trajectory similarity measure with the given name, or an error if there is no
+// such measure.
+func lookupTrajectorySimilarity(exp *trajectory.Experiment, name string) (TrajectorySimilarity, error) {
+	switch name {
+	case "", JaccardSimilarity:
+		return JaccardTrajectory, nil
+	case SzymkiewiczSimpsonSimilarity:
+		return SzymkiewiczSimpsonTrajectory, nil
+	case SorensenDiceSimilarity:
+		return SorensenDiceTrajectory, nil
+	case BigramSimilarity:
+		return BigramTrajectory, nil
+	case ContainmentSimilarity:
+		return ContainmentTrajectory, nil
+	case LCSSimilarity:
+		return LCSTrajectory, nil
+	case EditDistanceSimilarity:
+		return EditDistanceTrajectory, nil
+	case DTWSimilarity:
+		return newDTWSimilarity(exp), nil
+	case RRWeightedJaccardSimilarity:
+		return newRRWeightedJaccard(exp), nil
+	case PatientSimilarity:
+		return newPatientJaccard(exp), nil
+	case SemanticSimilarity:
+		if len(exp.Hierarchy) == 0 {
+			utils.Warning("no vocabulary hierarchy available, the semantic similarity reduces to the jaccard similarity.")
+		}
+		return newSemanticSimilarity(exp, trajectory.WuPalmerSimilarity).trajectorySimilarity, nil
+	case HierarchySimilarity:
+		return newSemanticSimilarity(exp, trajectory.AncestorSimilarity).trajectorySimilarity, nil
+	case EmbeddingSimilarity:
+		if len(exp.Embeddings) == 0 {
+			utils.Warning("no diagnosis embeddings available, the embedding similarity reduces to the jaccard similarity.")
+		}
+		return newSemanticSimilarity(exp, trajectory.EmbeddingCosineSimilarity).trajectorySimilarity, nil
+	default:
+		return nil, fmt.Errorf("unknown trajectory similarity: %s", name)
+	}
+}
+
+// semanticSimilarity contains the similarities between all diagnoses that occur in the trajectories of an experiment,
+// e.g. the Wu-Palmer similarities, so that they do not need to be recomputed for each pair of trajectories.
+type semanticSimilarity struct {
+	index        map[int]int // maps diagnosis ID to its index in similarities
+	similarities [][]float64
+}
+
+// newSemanticSimilarity computes the similarities between the diagnoses of an experiment with the given similarity
+// of diagnoses, e.g. trajectory.WuPalmerSimilarity, trajectory.AncestorSimilarity, or
+// trajectory.EmbeddingCosineSimilarity.
+func newSemanticSimilarity(exp *trajectory.Experiment,
+	diagnosisSimilarity func(exp *trajectory.Experiment, d1, d2 int) float64) *semanticSimilarity {
+	s := &semanticSimilarity{index: map[int]int{}}
+	dids := []int{}
+	for _, t := range exp.Trajectories {
+		for _, d := range t.Diagnoses {
+			if _, ok := s.index[d]; !ok {
+				s.index[d] = len(dids)
+				dids = append(dids, d)
+			}
+		}
+	}
+	s.similarities = make([][]float64, len(dids))
+	for i, d1 := range dids {
+		s.similarities[i] = make([]float64, len(dids))
+		for j, d2 := range dids {
+			s.similarities[i][j] = diagnosisSimilarity(exp, d1, d2)
+		}
+	}
+	return s
+}
+
+// softMatches sums for each diagnosis in ds1 the similarity of the most similar diagnosis in ds2.
+func (s *semanticSimilarity) softMatches(ds1, ds2 []int) float64 {
+	sum := 0.0
+	for _, d1 := range ds1 {
+		best := 0.0
+		for _, d2 := range ds2 {
+			if sim := s.similarities[s.index[d1]][s.index[d2]]; sim > best {
+				best = sim
+			}
+		}
+		sum = sum + best
+	}
+	return sum
+}
+
+// trajectorySimilarity computes a soft Jaccard similarity coefficient for two given trajectories. Instead of counting
+// the diagnoses that occur in both trajectories, the intersection sums the semantic similarities of the best matching
+// diagnoses, so that related diagnoses contribute a partial overlap. For diagnoses that only match themselves, this is
+// the same as the Jaccard similarity coefficient.
+func (s *semanticSimilarity) trajectorySimilarity(t1, t2 *trajectory.Trajectory) float64 {
+	n := (s.softMatches(t1.Diagnoses, t2.Diagnoses) + s.softMatches(t2.Diagnoses, t1.Diagnoses)) / 2
+	nt1 := len(t1.Diagnoses)
+	nt2 := len(t2.Diagnoses)
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return n / (float64(nt1) + float64(nt2) - n)
+}
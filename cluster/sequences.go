@@ -0,0 +1,181 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"math"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// Order-aware trajectory similarities. The set-based measures, e.g. JaccardTrajectory, ignore the order of the
+// diagnoses, so that D1 -> D2 and D2 -> D1 are the same. The measures in this file compare the diagnoses of
+// trajectories as sequences instead.
+
+// longestCommonSubsequence computes the length of the longest common subsequence of two diagnosis sequences.
+func longestCommonSubsequence(ds1, ds2 []int) int {
+	previous, current := make([]int, len(ds2)+1), make([]int, len(ds2)+1)
+	for _, d1 := range ds1 {
+		for j, d2 := range ds2 {
+			if d1 == d2 {
+				current[j+1] = previous[j] + 1
+			} else {
+				current[j+1] = utils.Max(previous[j+1], current[j])
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(ds2)]
+}
+
+// LCSTrajectory computes the similarity of two trajectories as the length of the longest common subsequence of their
+// diagnoses, divided by the length of the longest trajectory. The diagnoses of the subsequence occur in the same order
+// in both trajectories, so that D1 -> D2 -> D3 is more similar to D1 -> D3 than to D3 -> D1.
+func LCSTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	nt1 := len(t1.Diagnoses)
+	nt2 := len(t2.Diagnoses)
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return float64(longestCommonSubsequence(t1.Diagnoses, t2.Diagnoses)) / float64(utils.Max(nt1, nt2))
+}
+
+// editDistance computes the Levenshtein distance between two diagnosis sequences: the minimum number of diagnoses that
+// must be inserted, deleted, or substituted to turn one sequence into the other.
+func editDistance(ds1, ds2 []int) int {
+	previous, current := make([]int, len(ds2)+1), make([]int, len(ds2)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i, d1 := range ds1 {
+		current[0] = i + 1
+		for j, d2 := range ds2 {
+			substitution := previous[j]
+			if d1 != d2 {
+				substitution++
+			}
+			current[j+1] = utils.Min(substitution, utils.Min(previous[j+1], current[j])+1)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(ds2)]
+}
+
+// EditDistanceTrajectory computes the similarity of two trajectories as 1 minus the edit distance between their
+// diagnoses, divided by the length of the longest trajectory. Trajectories that differ in a single diagnosis, e.g.
+// D1 -> D2 -> D3 and D1 -> D4 -> D3, are then closer than the set-based measures imply.
+func EditDistanceTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	nt1 := len(t1.Diagnoses)
+	nt2 := len(t2.Diagnoses)
+	if nt1 == 0 || nt2 == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return 1 - float64(editDistance(t1.Diagnoses, t2.Diagnoses))/float64(utils.Max(nt1, nt2))
+}
+
+// trajectoryTimes computes for each diagnosis of a trajectory the median time since the first diagnosis, in years, over
+// the patients that follow the full trajectory. The times are nil if the dates of the patients are not available, e.g.
+// for trajectories read from a .ptra file.
+func trajectoryTimes(t *trajectory.Trajectory) []float64 {
+	offsets := make([][]float64, len(t.Diagnoses))
+	for _, p := range trajectory.LastPatients(t) {
+		dates := trajectory.TrajectoryDates(p, t.Diagnoses)
+		for i, date := range dates {
+			offsets[i] = append(offsets[i], trajectory.DiagnosisDateToFloat(date)-trajectory.DiagnosisDateToFloat(dates[0]))
+		}
+	}
+	if len(offsets) == 0 || len(offsets[0]) == 0 {
+		return nil
+	}
+	times := make([]float64, len(offsets))
+	for i, xs := range offsets {
+		times[i] = utils.Median(xs)
+	}
+	return times
+}
+
+// dynamicTimeWarping computes the dynamic time warping distance between two diagnosis sequences with the given times.
+// Aligning two diagnoses costs 1 if they differ, and otherwise the difference between their times, relative to the
+// longest time span of both sequences. Without times, aligning equal diagnoses is free.
+func dynamicTimeWarping(ds1 []int, ts1 []float64, ds2 []int, ts2 []float64) float64 {
+	span := 0.0
+	if ts1 != nil && ts2 != nil {
+		span = math.Max(ts1[len(ts1)-1], ts2[len(ts2)-1])
+	}
+	cost := func(i, j int) float64 {
+		if ds1[i] != ds2[j] {
+			return 1
+		}
+		if span <= 0 {
+			return 0
+		}
+		return math.Min(math.Abs(ts1[i]-ts2[j])/span, 1)
+	}
+	previous, current := make([]float64, len(ds2)+1), make([]float64, len(ds2)+1)
+	for j := range previous {
+		previous[j] = math.Inf(1)
+	}
+	previous[0] = 0
+	for i := range ds1 {
+		current[0] = math.Inf(1)
+		for j := range ds2 {
+			current[j+1] = cost(i, j) + math.Min(previous[j], math.Min(previous[j+1], current[j]))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(ds2)]
+}
+
+// dtwSimilarity computes the similarity of two diagnosis sequences with the given times as 1 minus their dynamic time
+// warping distance, divided by the length of the longest sequence.
+func dtwSimilarity(ds1 []int, ts1 []float64, ds2 []int, ts2 []float64) float64 {
+	if len(ds1) == 0 || len(ds2) == 0 { // empty trajectories are not similar to any trajectory
+		return 0
+	}
+	return math.Max(0, 1-dynamicTimeWarping(ds1, ts1, ds2, ts2)/float64(utils.Max(len(ds1), len(ds2))))
+}
+
+// DTWTrajectory computes the similarity of two trajectories with dynamic time warping of their diagnoses on a time
+// axis, cf. dynamicTimeWarping. The time of a diagnosis is the median time since the first diagnosis of the trajectory
+// over its patients, cf. trajectoryTimes. Trajectories that traverse the same diagnoses over similar time spans are
+// then more similar than trajectories that traverse them at a different pace. Without the dates of the patients, only
+// the order of the diagnoses counts.
+func DTWTrajectory(t1, t2 *trajectory.Trajectory) float64 {
+	return dtwSimilarity(t1.Diagnoses, trajectoryTimes(t1), t2.Diagnoses, trajectoryTimes(t2))
+}
+
+// newDTWSimilarity returns DTWTrajectory for the trajectories of an experiment, with the times of the trajectories
+// computed once rather than for each pair of trajectories.
+func newDTWSimilarity(exp *trajectory.Experiment) TrajectorySimilarity {
+	times := make(map[*trajectory.Trajectory][]float64, len(exp.Trajectories))
+	for _, t := range exp.Trajectories {
+		times[t] = trajectoryTimes(t)
+	}
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		ts1, ok1 := times[t1]
+		if !ok1 {
+			ts1 = trajectoryTimes(t1)
+		}
+		ts2, ok2 := times[t2]
+		if !ok2 {
+			ts2 = trajectoryTimes(t2)
+		}
+		return dtwSimilarity(t1.Diagnoses, ts1, t2.Diagnoses, ts2)
+	}
+}
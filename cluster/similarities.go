@@ -0,0 +1,161 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package cluster
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// Pre-computed trajectory similarities, e.g. computed externally with embedding models, can be read from a file
+// instead of being computed by ptra. The trajectories are identified by their index in the trajectories tab file,
+// starting from 0. Two formats are supported:
+// - abc: a line per pair of trajectories with the two indexes and the similarity, separated by white space, as written
+// for mcxload. Pairs that are not listed have similarity 0.
+// - csv: a square matrix with a row and a column per trajectory, optionally preceded by a header row. The matrix is
+// assumed to be symmetric, only the part above the diagonal is used.
+
+// ReadSimilarityFile reads the pre-computed similarities of the trajectories of an experiment, from a csv file if the
+// file has a .csv extension, and from an abc file otherwise. It returns the similarity function that looks up the
+// similarities by trajectory ID, and sets the IDs of the trajectories to their indexes. Only similarities > 0 are
+// kept, since the others mean that the trajectories are not similar.
+func ReadSimilarityFile(exp *trajectory.Experiment, name string) (TrajectorySimilarity, error) {
+	for i, t := range exp.Trajectories {
+		t.ID = i
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	similarities := map[[2]int]float64{}
+	add := func(i, j int, similarity float64) error {
+		n := len(exp.Trajectories)
+		if i < 0 || i >= n || j < 0 || j >= n {
+			return fmt.Errorf("trajectory pair %d %d out of range for %d trajectories", i, j, n)
+		}
+		if i > j {
+			i, j = j, i
+		}
+		if i != j && similarity > 0 {
+			similarities[[2]int{i, j}] = similarity
+		}
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		err = readSimilarityMatrix(file, len(exp.Trajectories), add)
+	} else {
+		err = readSimilarityAbc(file, add)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	utils.Info("Read ", len(similarities), " trajectory similarities from ", name)
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		i, j := t1.ID, t2.ID
+		if i > j {
+			i, j = j, i
+		}
+		return similarities[[2]int{i, j}]
+	}, nil
+}
+
+// readSimilarityAbc reads similarities in abc format and passes them to add.
+func readSimilarityAbc(r io.Reader, add func(i, j int, similarity float64) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: expected 3 fields, got %d", line, len(fields))
+		}
+		i, err1 := strconv.Atoi(fields[0])
+		j, err2 := strconv.Atoi(fields[1])
+		similarity, err3 := strconv.ParseFloat(fields[2], 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return fmt.Errorf("line %d: expected two trajectory indexes and a similarity, got %q", line,
+				scanner.Text())
+		}
+		if err := add(i, j, similarity); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readSimilarityMatrix reads a square csv matrix of similarities for n trajectories and passes the part above the
+// diagonal to add. A first row that does not start with a number is skipped as header.
+func readSimilarityMatrix(r io.Reader, n int, add func(i, j int, similarity float64) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	row := 0
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(record[0]), 64); err != nil {
+				continue // header
+			}
+		}
+		if row >= n {
+			return fmt.Errorf("line %d: more rows than the %d trajectories", line, n)
+		}
+		if len(record) != n {
+			return fmt.Errorf("line %d: expected %d columns, got %d", line, n, len(record))
+		}
+		for j := row + 1; j < n; j++ {
+			similarity, err := strconv.ParseFloat(strings.TrimSpace(record[j]), 64)
+			if err != nil {
+				return fmt.Errorf("line %d, column %d: %v", line, j+1, err)
+			}
+			if err := add(row, j, similarity); err != nil {
+				return err
+			}
+		}
+		row++
+	}
+	if row != n {
+		return fmt.Errorf("expected %d rows, got %d", n, row)
+	}
+	return nil
+}
+
+// similarityFromFile returns the similarity function for the pre-computed similarities in options.SimilarityFile.
+func similarityFromFile(exp *trajectory.Experiment, options Options) TrajectorySimilarity {
+	similarity, err := ReadSimilarityFile(exp, options.SimilarityFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	return similarity
+}
@@ -0,0 +1,76 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"github.com/exascience/pargo/parallel"
+	"ptra/trajectory"
+	"sort"
+)
+
+// assignSoftMemberships turns a hard clustering from MCL into a soft clustering, where trajectories can belong to
+// multiple clusters, since many trajectories straddle disease domains. The affinity of a trajectory with a cluster is
+// its mean similarity with the other trajectories of the cluster. The membership weights are the affinities normalized
+// to sum to 1. A trajectory belongs to the clusters for which its weight is at least the threshold, and always to the
+// cluster MCL assigned it to. The weights of the clusters a trajectory belongs to are normalized again to sum to 1.
+func assignSoftMemberships(exp *trajectory.Experiment, clusters [][]*trajectory.Trajectory,
+	similarity TrajectorySimilarity, threshold float64) {
+	parallel.Range(0, len(exp.Trajectories), 0, func(low, high int) {
+		for _, t := range exp.Trajectories[low:high] {
+			affinities := make([]float64, len(clusters))
+			total := 0.0
+			for cid, members := range clusters {
+				sum, n := 0.0, 0
+				for _, member := range members {
+					if member != t {
+						sum = sum + similarity(t, member)
+						n++
+					}
+				}
+				if n > 0 {
+					affinities[cid] = sum / float64(n)
+				} else if cid == t.Cluster {
+					// a singleton cluster
+					affinities[cid] = 1.0
+				}
+				total = total + affinities[cid]
+			}
+			memberships := []trajectory.Membership{}
+			kept := 0.0
+			for cid, affinity := range affinities {
+				if total > 0 && (affinity/total >= threshold || cid == t.Cluster) {
+					memberships = append(memberships, trajectory.Membership{Cluster: cid, Weight: affinity})
+					kept = kept + affinity
+				}
+			}
+			if kept == 0 {
+				// no similarity with any cluster, not even its own
+				t.Memberships = []trajectory.Membership{{Cluster: t.Cluster, Weight: 1.0}}
+				continue
+			}
+			for i := range memberships {
+				memberships[i].Weight = memberships[i].Weight / kept
+			}
+			sort.Slice(memberships, func(i, j int) bool {
+				return memberships[i].Weight > memberships[j].Weight
+			})
+			t.Memberships = memberships
+		}
+	})
+}
@@ -0,0 +1,114 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// similarityCutoffWriter passes the similarities in abc format that are above a cutoff on to w, so that the graph that
+// is clustered only has the edges between sufficiently similar trajectories. The nodes that lose all their edges are
+// kept as isolated nodes, with a loop of similarity 0, so that they still end up in a cluster of their own.
+type similarityCutoffWriter struct {
+	w       io.Writer
+	cutoff  float64
+	nodes   map[int]bool // per trajectory ID, whether it has an edge above the cutoff
+	kept    int
+	dropped int
+	partial []byte
+	err     error
+}
+
+// Write passes on the complete lines of similarities in p that are above the cutoff.
+func (c *similarityCutoffWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.partial, c.err = writeAbcLines(c.partial, p, c.parseLine)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return len(p), nil
+}
+
+// parseLine passes on a line with two trajectory IDs and their similarity if the similarity is above the cutoff.
+func (c *similarityCutoffWriter) parseLine(line string) error {
+	id1, id2, weight, ok, err := parseAbcLine(line)
+	if !ok {
+		return err
+	}
+	if weight <= c.cutoff {
+		c.dropped++
+		return nil
+	}
+	if _, err := fmt.Fprintln(c.w, line); err != nil {
+		return err
+	}
+	c.nodes[id1], c.nodes[id2] = true, true
+	c.kept++
+	return nil
+}
+
+// flush passes on an incomplete last line, in case the similarities do not end with a newline, and adds the isolated
+// nodes.
+func (c *similarityCutoffWriter) flush(ids []int) error {
+	if c.err != nil {
+		return c.err
+	}
+	line := string(c.partial)
+	c.partial = nil
+	if err := c.parseLine(line); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if !c.nodes[id] {
+			if _, err := fmt.Fprintf(c.w, "%d\t%d\t%f\n", id, id, 0.0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withSimilarityCutoff wraps a writer of similarities in abc format for the trajectories with the given IDs, so that
+// only the similarities above the cutoff are written, cf. similarityCutoffWriter. This sparsifies the graph that is
+// clustered, since most pairs of trajectories have a similarity of 0 or close to 0.
+func withSimilarityCutoff(ids []int, cutoff float64, writeAbc func(w io.Writer)) func(w io.Writer) {
+	return func(w io.Writer) {
+		c := &similarityCutoffWriter{w: w, cutoff: cutoff, nodes: map[int]bool{}}
+		writeAbc(c)
+		if err := c.flush(ids); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Kept ", c.kept, " of ", c.kept+c.dropped, " similarities above ", cutoff)
+	}
+}
+
+// trajectoryIDs returns the IDs of the trajectories of an experiment, which are their positions.
+func trajectoryIDs(exp *trajectory.Experiment) []int {
+	ids := make([]int, len(exp.Trajectories))
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
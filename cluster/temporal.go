@@ -0,0 +1,118 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package cluster
+
+import (
+	"math"
+	"ptra/trajectory"
+	"ptra/utils"
+)
+
+// temporalFeatures are the rate-of-progression features of a trajectory, in years: the median time between consecutive
+// diagnoses and the median total duration, over the patients that follow the full trajectory.
+type temporalFeatures struct {
+	medianGap, duration float64
+}
+
+// computeTemporalFeatures computes the temporal features of a trajectory. The features are NaN if the dates of the
+// patients are not available.
+func computeTemporalFeatures(t *trajectory.Trajectory) temporalFeatures {
+	gaps, durations := []float64{}, []float64{}
+	if len(t.Diagnoses) > 0 {
+		for _, p := range trajectory.LastPatients(t) {
+			dates := trajectory.TrajectoryDates(p, t.Diagnoses)
+			if dates == nil {
+				continue
+			}
+			for i := 1; i < len(dates); i++ {
+				gaps = append(gaps, trajectory.DiagnosisDateToFloat(dates[i])-trajectory.DiagnosisDateToFloat(dates[i-1]))
+			}
+			durations = append(durations,
+				trajectory.DiagnosisDateToFloat(dates[len(dates)-1])-trajectory.DiagnosisDateToFloat(dates[0]))
+		}
+	}
+	return temporalFeatures{medianGap: utils.Median(gaps), duration: utils.Median(durations)}
+}
+
+// featureSimilarity compares two non-negative durations as the ratio of the smallest to the largest, so that a
+// trajectory that progresses twice as fast as another one has similarity 0.5. Unknown features compare as 1, so that
+// they do not affect the clustering.
+func featureSimilarity(x, y float64) float64 {
+	if math.IsNaN(x) || math.IsNaN(y) || x == y {
+		return 1
+	}
+	return math.Min(x, y) / math.Max(x, y)
+}
+
+// withTemporalFeatures combines a trajectory similarity with the similarity of the rate of progression of the
+// trajectories: the mean of the similarities of their median gaps and of their durations, cf. featureSimilarity. The
+// result is (1 - weight) * similarity + weight * temporal similarity. Pairs of trajectories with similarity 0 remain
+// 0, so that unrelated trajectories are not grouped because of their timing only.
+func withTemporalFeatures(exp *trajectory.Experiment, similarity TrajectorySimilarity,
+	weight float64) TrajectorySimilarity {
+	features := make(map[*trajectory.Trajectory]temporalFeatures, len(exp.Trajectories))
+	for _, t := range exp.Trajectories {
+		features[t] = computeTemporalFeatures(t)
+	}
+	return withTemporalSimilarity(similarity, weight, features)
+}
+
+// withTemporalSimilarity combines a trajectory similarity with the similarity of the rate of progression of the
+// trajectories as withTemporalFeatures, with the given features of the trajectories. The features of other
+// trajectories are computed when they are needed.
+func withTemporalSimilarity(similarity TrajectorySimilarity, weight float64,
+	features map[*trajectory.Trajectory]temporalFeatures) TrajectorySimilarity {
+	return func(t1, t2 *trajectory.Trajectory) float64 {
+		s := similarity(t1, t2)
+		if s <= 0 {
+			return s
+		}
+		f1, ok1 := features[t1]
+		if !ok1 {
+			f1 = computeTemporalFeatures(t1)
+		}
+		f2, ok2 := features[t2]
+		if !ok2 {
+			f2 = computeTemporalFeatures(t2)
+		}
+		temporal := (featureSimilarity(f1.medianGap, f2.medianGap) + featureSimilarity(f1.duration, f2.duration)) / 2
+		return (1-weight)*s + weight*temporal
+	}
+}
+
+// clusteringSimilarity returns the trajectory similarity used for clustering with the given options, cf.
+// Options.Similarity, Options.SimilarityFunc, Options.SimilarityFile, Options.TemporalWeight, and
+// Options.PatientWeight.
+func clusteringSimilarity(exp *trajectory.Experiment, options Options) TrajectorySimilarity {
+	var similarity TrajectorySimilarity
+	if options.SimilarityFile != "" {
+		similarity = similarityFromFile(exp, options)
+	} else if options.SimilarityFunc != nil {
+		similarity = options.SimilarityFunc
+	} else {
+		similarity = trajectorySimilarity(exp, options.Similarity)
+	}
+	if options.TemporalWeight > 0 {
+		similarity = withTemporalFeatures(exp, similarity, options.TemporalWeight)
+	}
+	if options.PatientWeight > 0 {
+		similarity = withPatientOverlap(exp, similarity, options.PatientWeight)
+	}
+	return similarity
+}
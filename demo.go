@@ -0,0 +1,110 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"ptra/app"
+	"ptra/cluster"
+	"ptra/server"
+	"ptra/utils"
+	"strings"
+)
+
+const demoHelp = "\nptra demo parameters:\n" +
+	"ptra demo [path] \n" +
+	"[--patients nr]\n" +
+	"[--seed nr]\n" +
+	"[ptra parameters, cf. ptra --help]\n" +
+	outputHelp +
+	profileHelp
+
+// demoDefaults are the parameters of the ptra command that the demo command changes, so that the run finds the
+// progressions of the synthetic cohort within a few seconds, cf. app.DemoProgressions. They can be overridden with the
+// flags of the ptra command.
+var demoDefaults = map[string]string{
+	"minPatients":          "20",
+	"iter":                 "400",
+	"cluster":              "true",
+	"clusterer":            cluster.NativeClusterer,
+	"clusterGranularities": "14,20",
+	"bootstrap":            "100",
+	"name":                 "demo",
+}
+
+// demo implements the ptra demo command, which runs the pipeline on a synthetic cohort with the native MCL, writes an
+// HTML report of the results, and prints pointers for running ptra on real data.
+func demo() {
+	var (
+		cfg         config
+		nofPatients int
+		seed        int64
+		profiling   profiles
+	)
+	var flags flag.FlagSet
+	cfg.addFlags(&flags)
+	for name, value := range demoDefaults {
+		if err := flags.Set(name, value); err != nil {
+			log.Panic(err)
+		}
+	}
+	flags.IntVar(&nofPatients, "patients", 2000, "The number of patients of the synthetic cohort.")
+	flags.Int64Var(&seed, "seed", 1, "The seed of the random generator of the synthetic cohort.")
+	profiling.addFlags(&flags)
+	// the path is optional
+	path, requiredArgs := "ptra-demo", 2
+	if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+		path, requiredArgs = os.Args[2], 3
+	}
+	parseFlags(flags, requiredArgs, demoHelp)
+	path, _ = filepath.Abs(path)
+	utils.Info("Writing a synthetic cohort of ", nofPatients, " patients to ", filepath.Join(path, "input"))
+	var err error
+	if cfg.PatientInfo, cfg.PatientDiagnoses, cfg.DiagnosisInfo, err = app.WriteDemoData(filepath.Join(path, "input"),
+		nofPatients, seed); err != nil {
+		log.Panic(err)
+	}
+	cfg.OutputPath = filepath.Join(path, "output") + string(filepath.Separator)
+	utils.Info("Output path: ", cfg.OutputPath)
+	stopProfiling := profiling.start(cfg.OutputPath)
+	defer stopProfiling()
+	cfg.resolveFileNames()
+	exp, clusteringErr := runPipeline(&cfg)
+	report := filepath.Join(cfg.OutputPath, "report.html")
+	if err := server.WriteReport(cfg.OutputPath, filepath.Base(report)); err != nil {
+		log.Panic(err)
+	}
+	// the pointers are the result of the command, so they are printed on standard output
+	fmt.Println("Found", len(exp.Trajectories), "trajectories in the synthetic cohort.")
+	fmt.Println("Report:", report)
+	fmt.Println("Browse the results:", os.Args[0], "serve", cfg.OutputPath)
+	fmt.Println("Configuration of the run:", configFileName(&cfg))
+	fmt.Println("Equivalent command, to adapt to your own data:")
+	fmt.Println(cfg.command())
+	fmt.Println("For all parameters, see", os.Args[0], "--help and the README.")
+	if clusteringErr != nil {
+		// the deferred functions do not run on exit
+		stopProfiling()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,167 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const diffHelp = "\nptra diff parameters:\n" +
+	"ptra diff pathA pathB \n" +
+	"[--name string]\n" +
+	"[--tolerance nr]\n" +
+	outputHelp +
+	profileHelp
+
+// runName returns the name of the run in an output path, i.e. the name of its saved configuration name.config.json.
+// If name is not empty, the run must exist. Otherwise the output path must contain exactly one run.
+func runName(path, name string) (string, error) {
+	if name != "" {
+		if _, err := os.Stat(filepath.Join(path, name+".config.json")); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	configs, err := filepath.Glob(filepath.Join(path, "*.config.json"))
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, config := range configs {
+		names = append(names, strings.TrimSuffix(filepath.Base(config), ".config.json"))
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("%s: no saved configuration of a ptra run", path)
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("%s: the runs %s are in the same path, select one with --name", path,
+			strings.Join(names, ", "))
+	}
+}
+
+// loadRun loads the saved configuration and the snapshot of a run in an output path. The configuration is loaded as a
+// generic json object rather than as a config, so that configurations of other ptra versions can be compared as
+// well.
+func loadRun(path, name string) (map[string]interface{}, *snapshot) {
+	configFile := filepath.Join(path, name+".config.json")
+	cfg := map[string]interface{}{}
+	loadJSON(&cfg, configFile)
+	snapshotFile := filepath.Join(path, name+".snapshot.json")
+	var snap snapshot
+	loadJSON(&snap, snapshotFile)
+	if err := trajectory.CheckFormatVersion(snapshotFile, "snapshot", snap.FormatVersion, "snapshot",
+		snapshotFormatVersion); err != nil {
+		panic(err)
+	}
+	return cfg, &snap
+}
+
+// diffConfigs prints the parameters that differ between two saved configurations and returns their number. A
+// parameter that is missing from a configuration, e.g. because it was written by another ptra version, is printed as
+// missing. The output path is left out, since it always differs.
+func diffConfigs(a, b map[string]interface{}) int {
+	keys := map[string]bool{}
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	delete(keys, "OutputPath")
+	sorted := []string{}
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	format := func(m map[string]interface{}, key string) string {
+		value, ok := m[key]
+		if !ok {
+			return "missing"
+		}
+		content, err := json.Marshal(value)
+		if err != nil {
+			panic(err)
+		}
+		return string(content)
+	}
+	differences := 0
+	for _, key := range sorted {
+		if !reflect.DeepEqual(a[key], b[key]) {
+			fmt.Printf("DIFF %s: A %s, B %s\n", key, format(a, key), format(b, key))
+			differences++
+		}
+	}
+	return differences
+}
+
+// diff implements the ptra diff command, which compares the saved configurations and the snapshots of the key outputs
+// of two runs, to explain why their results differ.
+func diff() {
+	var (
+		name      string
+		tolerance float64
+		profiling profiles
+	)
+	var flags flag.FlagSet
+	flags.StringVar(&name, "name", "", "The name of the runs to compare, if an output path contains several runs.")
+	flags.Float64Var(&tolerance, "tolerance", 0, "The relative tolerance for differences between the key outputs "+
+		"of both runs.")
+	profiling.addFlags(&flags)
+	parseFlags(flags, 4, diffHelp)
+	pathA := getFileName(os.Args[2], diffHelp)
+	pathB := getFileName(os.Args[3], diffHelp)
+	stopProfiling := profiling.start(".")
+	defer stopProfiling()
+	nameA, err := runName(pathA, name)
+	if err != nil {
+		panic(err)
+	}
+	nameB, err := runName(pathB, name)
+	if err != nil {
+		panic(err)
+	}
+	cfgA, snapA := loadRun(pathA, nameA)
+	cfgB, snapB := loadRun(pathB, nameB)
+	fmt.Printf("A: %s\n", filepath.Join(pathA, nameA))
+	fmt.Printf("B: %s\n", filepath.Join(pathB, nameB))
+	fmt.Println("Configuration:")
+	differences := diffConfigs(cfgA, cfgB)
+	if differences == 0 {
+		fmt.Println("same parameters")
+	}
+	fmt.Println("Key outputs:")
+	c := &snapshotComparison{tolerance: tolerance, names: [2]string{"A", "B"}, statuses: [2]string{"same", "DIFF"}}
+	differences += c.compareSnapshots(snapA, snapB)
+	if differences > 0 {
+		fmt.Printf("The runs differ in %d parameters and outputs.\n", differences)
+		stopProfiling()
+		os.Exit(1)
+	}
+	fmt.Println("The runs are the same.")
+}
@@ -0,0 +1,492 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const exportHelp = "\nptra export parameters:\n" +
+	"ptra export resultFile outputFile \n" +
+	"[--min-support nr]\n" +
+	"[--min-rr nr]\n" +
+	"[--clusters list]\n" +
+	"[--pairs file]\n" +
+	"[--trajectories file]\n" +
+	"[--format gml | graphml | tab | ptra]\n" +
+	"[--literature file]\n" +
+	outputHelp +
+	profileHelp
+
+// exportFilter selects the trajectories that are exported by the export command.
+type exportFilter struct {
+	minSupport int
+	minRR      float64
+	clusters   map[int]bool // nil for all clusters
+}
+
+// keep checks if all transitions of a trajectory have at least minSupport patients and an RR of at least minRR, and if
+// the trajectory belongs to one of the selected clusters.
+func (f exportFilter) keep(t *trajectory.Trajectory, nameMap map[int]string, rrs map[[2]string]float64) bool {
+	if f.clusters != nil && !f.clusters[t.Cluster] {
+		return false
+	}
+	for i, n := range t.PatientNumbers {
+		if n < f.minSupport {
+			return false
+		}
+		if f.minRR > 0 {
+			rr, ok := rrs[[2]string{nameMap[t.Diagnoses[i]], nameMap[t.Diagnoses[i+1]]}]
+			if !ok || rr < f.minRR {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseClusterList parses a comma-separated list of cluster IDs.
+func parseClusterList(s string) map[int]bool {
+	if s == "" {
+		return nil
+	}
+	clusters := map[int]bool{}
+	for _, field := range strings.Split(s, ",") {
+		cid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			log.Panic(fmt.Sprintf("Invalid cluster list %s: %v", s, err))
+		}
+		clusters[cid] = true
+	}
+	return clusters
+}
+
+// legacyDumpFile matches the names of the mcxdump files of a clustering, which earlier ptra versions kept as the only
+// record of the clusters: dump.name.mci.I<granularity>.
+var legacyDumpFile = regexp.MustCompile(`^dump\.(.+)\.mci\.I[0-9]+$`)
+
+// legacyTrajectoriesFile returns the trajectories tab file that belongs to an mcxdump file, which is in the parent
+// directory of the cluster output folder.
+func legacyTrajectoriesFile(dumpFile string) string {
+	name := legacyDumpFile.FindStringSubmatch(filepath.Base(dumpFile))[1]
+	return filepath.Join(filepath.Dir(filepath.Dir(dumpFile)), fmt.Sprintf("%s-trajectories.tab", name))
+}
+
+// findPairsFile looks for the pairs tab file of a run next to a result file, or in its parent directory for the
+// results of a clustering. It returns "" if there is not exactly one such file.
+func findPairsFile(resultFile string) string {
+	dir := filepath.Dir(resultFile)
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		matches, _ := filepath.Glob(filepath.Join(d, "*-pairs.tab"))
+		if len(matches) == 1 {
+			return matches[0]
+		}
+	}
+	return ""
+}
+
+// exportEdge is a transition between two diagnoses in the exported graphs, with the patient number, RR, EOI
+// enrichment, and direction of the transition. The RR and the EOI enrichment are NaN, and the direction is nil, when
+// they are not known.
+type exportEdge struct {
+	source, target, patients int
+	rr, eoiEnrichment        float64
+	direction                *trajectory.Direction
+}
+
+// exportGraph is the graph of the exported trajectories of a cluster.
+type exportGraph struct {
+	cid   int
+	nodes []int
+	edges []exportEdge
+}
+
+// exportGraphs converts the trajectories to a graph per cluster, in increasing cluster order. As in the GML files
+// written by the clustering, a transition is represented by one edge per distinct patient number, and the EOI
+// enrichment of a transition is the maximum over its occurrences in the cluster. The EOI enrichments are only known
+// for trajectories read from a .ptra file, and the directions only from a pairs tab file of format version 2.
+func exportGraphs(ts []*trajectory.Trajectory, nameMap map[int]string, rrs map[[2]string]float64,
+	directions map[[2]string]trajectory.Direction) []*exportGraph {
+	graphs := map[int]*exportGraph{}
+	seenNodes := map[[2]int]bool{}
+	seenEdges := map[[4]int]bool{}
+	enrichments := map[[3]int]float64{}
+	for _, t := range ts {
+		for i, e := range t.EOIEnrichments {
+			if i+1 >= len(t.Diagnoses) {
+				break
+			}
+			key := [3]int{t.Cluster, t.Diagnoses[i], t.Diagnoses[i+1]}
+			if old, ok := enrichments[key]; !math.IsNaN(e) && (!ok || e > old) {
+				enrichments[key] = e
+			}
+		}
+	}
+	for _, t := range ts {
+		g, ok := graphs[t.Cluster]
+		if !ok {
+			g = &exportGraph{cid: t.Cluster}
+			graphs[t.Cluster] = g
+		}
+		for i, d := range t.Diagnoses {
+			if !seenNodes[[2]int{t.Cluster, d}] {
+				seenNodes[[2]int{t.Cluster, d}] = true
+				g.nodes = append(g.nodes, d)
+			}
+			if i == 0 {
+				continue
+			}
+			d1 := t.Diagnoses[i-1]
+			n := t.PatientNumbers[i-1]
+			if key := [4]int{t.Cluster, d1, d, n}; !seenEdges[key] {
+				seenEdges[key] = true
+				rr, ok := rrs[[2]string{nameMap[d1], nameMap[d]}]
+				if !ok {
+					rr = math.NaN()
+				}
+				enrichment, ok := enrichments[[3]int{t.Cluster, d1, d}]
+				if !ok {
+					enrichment = math.NaN()
+				}
+				edge := exportEdge{source: d1, target: d, patients: n, rr: rr, eoiEnrichment: enrichment}
+				if direction, ok := directions[[2]string{nameMap[d1], nameMap[d]}]; ok {
+					edge.direction = &direction
+				}
+				g.edges = append(g.edges, edge)
+			}
+		}
+	}
+	cids := []int{}
+	for cid := range graphs {
+		cids = append(cids, cid)
+	}
+	sort.Ints(cids)
+	result := []*exportGraph{}
+	for _, cid := range cids {
+		result = append(result, graphs[cid])
+	}
+	return result
+}
+
+// writeExportGML writes the graphs in the GML format of the clustering, with a graph per cluster and the patient
+// numbers as edge labels. The RR is added as an rr attribute of the edges when it is known and finite, and the EOI
+// enrichment as an eoiEnrichment attribute and a fill color when it is known, cf. trajectory.EOIEnrichmentColor. The
+// direction of a transition is added as the attributes of the clustering when it is known, cf. trajectory.Direction.
+func writeExportGML(w io.Writer, graphs []*exportGraph, nameMap map[int]string) {
+	for _, g := range graphs {
+		fmt.Fprintf(w, "graph [ \n comment \"cluster %d\" \n directed 1 \n label \"cluster %d\" \n multigraph 1\n",
+			g.cid, g.cid)
+		for _, node := range g.nodes {
+			fmt.Fprintf(w, "node [ id %d\n label \"%s\"\n ]\n", node, nameMap[node])
+		}
+		for _, e := range g.edges {
+			fmt.Fprintf(w, "edge [\nsource %d\ntarget %d\nlabel %d\n", e.source, e.target, e.patients)
+			if !math.IsNaN(e.rr) && !math.IsInf(e.rr, 0) {
+				fmt.Fprintf(w, "rr %s\n", strconv.FormatFloat(e.rr, 'f', 2, 64))
+			}
+			if !math.IsNaN(e.eoiEnrichment) {
+				fmt.Fprintf(w, "eoiEnrichment %s\ngraphics [ fill \"%s\" ]\n",
+					strconv.FormatFloat(e.eoiEnrichment, 'f', 2, 64), trajectory.EOIEnrichmentColor(e.eoiEnrichment))
+			}
+			if d := e.direction; d != nil {
+				fmt.Fprintf(w, "direction %s\ndirectionBefore %d\ndirectionAfter %d\ndirectionP %s\n",
+					strconv.FormatFloat(d.Confidence(), 'f', 4, 64), d.Before, d.After, strconv.FormatFloat(d.P, 'E', 3, 64))
+			}
+			fmt.Fprintf(w, "]\n")
+		}
+		fmt.Fprintf(w, "]\n")
+	}
+}
+
+// xmlEscape escapes a string for use as XML text.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// writeExportGraphML writes the graphs as GraphML, with a graph per cluster. The nodes have a label, and the edges have
+// the number of patients and, when it is known and finite, the RR of the transition. When it is known, the edges also
+// have the EOI enrichment of the transition and its color, cf. trajectory.EOIEnrichmentColor, and the direction of the
+// transition, cf. trajectory.Direction.
+func writeExportGraphML(w io.Writer, graphs []*exportGraph, nameMap map[int]string) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n"+
+		"  <key id=\"label\" for=\"node\" attr.name=\"label\" attr.type=\"string\"/>\n"+
+		"  <key id=\"patients\" for=\"edge\" attr.name=\"patients\" attr.type=\"int\"/>\n"+
+		"  <key id=\"rr\" for=\"edge\" attr.name=\"rr\" attr.type=\"double\"/>\n"+
+		"  <key id=\"eoiEnrichment\" for=\"edge\" attr.name=\"eoiEnrichment\" attr.type=\"double\"/>\n"+
+		"  <key id=\"color\" for=\"edge\" attr.name=\"color\" attr.type=\"string\"/>\n"+
+		"  <key id=\"direction\" for=\"edge\" attr.name=\"direction\" attr.type=\"double\"/>\n"+
+		"  <key id=\"directionBefore\" for=\"edge\" attr.name=\"directionBefore\" attr.type=\"int\"/>\n"+
+		"  <key id=\"directionAfter\" for=\"edge\" attr.name=\"directionAfter\" attr.type=\"int\"/>\n"+
+		"  <key id=\"directionP\" for=\"edge\" attr.name=\"directionP\" attr.type=\"double\"/>\n")
+	for _, g := range graphs {
+		fmt.Fprintf(w, "  <graph id=\"cluster%d\" edgedefault=\"directed\">\n", g.cid)
+		for _, node := range g.nodes {
+			fmt.Fprintf(w, "    <node id=\"c%d-n%d\"><data key=\"label\">%s</data></node>\n", g.cid, node,
+				xmlEscape(nameMap[node]))
+		}
+		for _, e := range g.edges {
+			fmt.Fprintf(w, "    <edge source=\"c%d-n%d\" target=\"c%d-n%d\"><data key=\"patients\">%d</data>",
+				g.cid, e.source, g.cid, e.target, e.patients)
+			if !math.IsNaN(e.rr) && !math.IsInf(e.rr, 0) {
+				fmt.Fprintf(w, "<data key=\"rr\">%s</data>", strconv.FormatFloat(e.rr, 'f', -1, 64))
+			}
+			if !math.IsNaN(e.eoiEnrichment) {
+				fmt.Fprintf(w, "<data key=\"eoiEnrichment\">%s</data><data key=\"color\">%s</data>",
+					strconv.FormatFloat(e.eoiEnrichment, 'f', -1, 64), trajectory.EOIEnrichmentColor(e.eoiEnrichment))
+			}
+			if d := e.direction; d != nil {
+				fmt.Fprintf(w, "<data key=\"direction\">%s</data><data key=\"directionBefore\">%d</data>"+
+					"<data key=\"directionAfter\">%d</data><data key=\"directionP\">%s</data>",
+					strconv.FormatFloat(d.Confidence(), 'f', -1, 64), d.Before, d.After, strconv.FormatFloat(d.P, 'E', -1, 64))
+			}
+			fmt.Fprintf(w, "</edge>\n")
+		}
+		fmt.Fprintf(w, "  </graph>\n")
+	}
+	fmt.Fprintf(w, "</graphml>\n")
+}
+
+// writeEOIColorScale writes the legend of the colors of the EOI enrichments next to an exported graph file, as
+// outputFile.eoi-color-scale.csv without the extension of outputFile, if the trajectories have EOI enrichments.
+func writeEOIColorScale(outputFile string, ts []*trajectory.Trajectory) {
+	for _, t := range ts {
+		if t.EOIEnrichments != nil {
+			trajectory.PrintEOIColorScaleToCSVFile(fmt.Sprintf("%s.eoi-color-scale.csv",
+				strings.TrimSuffix(outputFile, filepath.Ext(outputFile))))
+			return
+		}
+	}
+}
+
+// writeLiterature writes whether the exported trajectories replicate known trajectories from the literature or are
+// novel next to the output file, as outputFile.literature.csv without the extension of outputFile, cf.
+// trajectory.PrintLiteratureToCSVFile.
+func writeLiterature(outputFile, literatureFile string, ts []*trajectory.Trajectory, nameMap, idMap map[int]string) {
+	known, err := trajectory.ReadLiterature(literatureFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	trajectory.PrintLiteratureToCSVFile(ts, nameMap, trajectory.MatchLiterature(known, ts, nameMap, idMap),
+		fmt.Sprintf("%s.literature.csv", strings.TrimSuffix(outputFile, filepath.Ext(outputFile))))
+}
+
+// writeExportTab writes the trajectories in the tab format of PrintTrajectoriesToFile, with its format line, cf.
+// trajectory.TrajectoriesFormat.
+func writeExportTab(w io.Writer, ts []*trajectory.Trajectory, nameMap map[int]string) {
+	if err := trajectory.TrajectoriesFormat.WriteHeader(w); err != nil {
+		log.Panic(err)
+	}
+	for _, t := range ts {
+		names := []string{}
+		for _, d := range t.Diagnoses {
+			names = append(names, nameMap[d])
+		}
+		numbers := []string{}
+		for _, n := range t.PatientNumbers {
+			numbers = append(numbers, strconv.Itoa(n))
+		}
+		fmt.Fprintf(w, "%s\n%s\n", strings.Join(names, "\t"), strings.Join(numbers, "\t"))
+	}
+}
+
+// ptraRRs returns the RRs of the transitions of the trajectories of an experiment read from a .ptra file, keyed by the
+// medical terms of the pairs as in trajectory.ReadPairsFromTabFile.
+func ptraRRs(exp *trajectory.Experiment) map[[2]string]float64 {
+	rrs := map[[2]string]float64{}
+	for _, tr := range exp.AllTransitions() {
+		if !math.IsNaN(tr.RR) {
+			rrs[[2]string{exp.NameMap[tr.From], exp.NameMap[tr.To]}] = tr.RR
+		}
+	}
+	return rrs
+}
+
+// exportExperiment collects the exported trajectories in an experiment, for writing them in the .ptra format. The RR
+// matrix is filled in with the RRs of the pairs, and is NaN for the transitions without a known RR.
+func exportExperiment(name string, ts []*trajectory.Trajectory, nameMap, idMap map[int]string,
+	hierarchy map[int][]string, rrs map[[2]string]float64) *trajectory.Experiment {
+	nofDiagnosisCodes := 0
+	for did := range nameMap {
+		nofDiagnosisCodes = utils.Max(nofDiagnosisCodes, did+1)
+	}
+	exp := &trajectory.Experiment{Name: name, NameMap: nameMap, IdMap: idMap, Hierarchy: hierarchy, Trajectories: ts,
+		NofDiagnosisCodes: nofDiagnosisCodes, DxDRR: trajectory.MakeDxDRR(nofDiagnosisCodes)}
+	for _, t := range ts {
+		for i := 1; i < len(t.Diagnoses); i++ {
+			d1, d2 := t.Diagnoses[i-1], t.Diagnoses[i]
+			rr, ok := rrs[[2]string{nameMap[d1], nameMap[d2]}]
+			if !ok {
+				rr = math.NaN()
+			}
+			exp.DxDRR[d1][d2] = rr
+		}
+	}
+	return exp
+}
+
+// export implements the ptra export command, which re-exports the trajectories of a previous run with filters and in a
+// different format, without recomputing the trajectories or the clustering.
+func export() {
+	var (
+		minSupport int
+		minRR      float64
+		clusters   string
+		pairsFile  string
+		format     string
+		tabFile    string
+		literature string
+		profiling  profiles
+	)
+	var flags flag.FlagSet
+	flags.IntVar(&minSupport, "min-support", 0, "The minimum number of patients for each transition of a trajectory.")
+	flags.Float64Var(&minRR, "min-rr", 0, "The minimum RR for each transition of a trajectory.")
+	flags.StringVar(&clusters, "clusters", "", "A comma-separated list of the clusters to export.")
+	flags.StringVar(&pairsFile, "pairs", "", "The tab file with the diagnosis pairs and their RR. By default, it is "+
+		"looked up next to the result file.")
+	flags.StringVar(&format, "format", "gml", "The output format: gml, graphml, tab, or ptra.")
+	flags.StringVar(&tabFile, "trajectories", "", "The trajectories tab file that belongs to an mcxdump file. By "+
+		"default, it is looked up in the parent directory of the cluster output folder.")
+	flags.StringVar(&literature, "literature", "", "A file with known trajectories from the literature, for "+
+		"flagging which exported trajectories replicate known findings and which are novel.")
+	profiling.addFlags(&flags)
+	parseFlags(flags, 4, exportHelp)
+	resultFile := getFileName(os.Args[2], exportHelp)
+	outputFile := getFileName(os.Args[3], exportHelp)
+	outputDir, _ := filepath.Abs(filepath.Dir(outputFile))
+	defer profiling.start(outputDir)()
+	if format != "gml" && format != "graphml" && format != "tab" && format != "ptra" {
+		log.Panic(fmt.Sprintf("Unknown export format: %s", format))
+	}
+	filter := exportFilter{minSupport: minSupport, minRR: minRR, clusters: parseClusterList(clusters)}
+	var (
+		ts        []*trajectory.Trajectory
+		nameMap   map[int]string
+		idMap     = map[int]string{}
+		hierarchy = map[int][]string{}
+		rrs       map[[2]string]float64
+		clustered = true
+		name      = strings.TrimSuffix(filepath.Base(resultFile), filepath.Ext(resultFile))
+		err       error
+	)
+	switch {
+	case strings.HasSuffix(resultFile, ".ptra"):
+		var exp *trajectory.Experiment
+		var header *trajectory.PtraHeader
+		if exp, header, err = trajectory.ReadPtraFile(resultFile); err == nil {
+			ts, nameMap, idMap, hierarchy, rrs = exp.Trajectories, exp.NameMap, exp.IdMap, exp.Hierarchy, ptraRRs(exp)
+			name, clustered = exp.Name, header.Clustered
+			if filter.clusters != nil && !clustered {
+				log.Panic("--clusters requires a .ptra file with a clustering")
+			}
+		}
+	case strings.HasSuffix(resultFile, ".clustered.trajectories.tab"):
+		ts, nameMap, _, err = trajectory.ReadClusteredTrajectoriesFromTabFile(resultFile)
+	case legacyDumpFile.MatchString(filepath.Base(resultFile)):
+		// the clustering of an older run, which only kept the mcxdump files
+		if tabFile == "" {
+			tabFile = legacyTrajectoriesFile(resultFile)
+		}
+		ts, nameMap, err = trajectory.ReadTrajectoriesFromTabFile(tabFile)
+		if err == nil {
+			ts, err = trajectory.ReadLegacyClustering(resultFile, ts)
+		}
+	case strings.HasSuffix(resultFile, ".gml"):
+		// a curated graph, of which each edge is exported as a trajectory of two diagnoses
+		ts, nameMap, rrs, err = trajectory.ReadClusterGraphsFromGMLFile(resultFile)
+	default:
+		if filter.clusters != nil {
+			log.Panic("--clusters requires a clustered trajectories tab file, an mcxdump file, a .ptra file, or a " +
+				"GML file")
+		}
+		clustered = false
+		ts, nameMap, err = trajectory.ReadTrajectoriesFromTabFile(resultFile)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	// .ptra files contain the RRs of their transitions, the tab files need the pairs file of the run
+	if pairsFile == "" && rrs == nil {
+		pairsFile = findPairsFile(resultFile)
+	}
+	directions := map[[2]string]trajectory.Direction{}
+	if pairsFile != "" {
+		if rrs, err = trajectory.ReadPairsFromTabFile(pairsFile); err != nil {
+			log.Panic(err)
+		}
+		if directions, err = trajectory.ReadPairDirectionsFromTabFile(pairsFile); err != nil {
+			log.Panic(err)
+		}
+	} else if rrs == nil && minRR > 0 {
+		log.Panic("--min-rr requires the pairs tab file of the run, cf. --pairs")
+	} else if rrs == nil {
+		rrs = map[[2]string]float64{}
+	}
+	kept := []*trajectory.Trajectory{}
+	for _, t := range ts {
+		if filter.keep(t, nameMap, rrs) {
+			kept = append(kept, t)
+		}
+	}
+	utils.Info("Exporting ", len(kept), " of ", len(ts), " trajectories to ", outputFile)
+	file, err := os.Create(outputFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Panic(err)
+		}
+	}()
+	switch format {
+	case "gml":
+		writeExportGML(file, exportGraphs(kept, nameMap, rrs, directions), nameMap)
+		writeEOIColorScale(outputFile, kept)
+	case "graphml":
+		writeExportGraphML(file, exportGraphs(kept, nameMap, rrs, directions), nameMap)
+		writeEOIColorScale(outputFile, kept)
+	case "tab":
+		writeExportTab(file, kept, nameMap)
+	case "ptra":
+		exp := exportExperiment(name, kept, nameMap, idMap, hierarchy, rrs)
+		if err := trajectory.WritePtra(file, exp, clustered, map[string]string{"program": programMessage(),
+			"exportedFrom": resultFile}); err != nil {
+			log.Panic(err)
+		}
+	}
+	if literature != "" {
+		writeLiterature(outputFile, literature, kept, nameMap, idMap)
+	}
+}
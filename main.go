@@ -23,6 +23,7 @@ import (
 	"log"
 	"ptra/app"
 	"ptra/cluster"
+	"ptra/server"
 	"ptra/trajectory"
 	"ptra/utils"
 	"strconv"
@@ -31,6 +32,7 @@ import (
 	//"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 
@@ -44,6 +46,21 @@ Ptra is a tool for patient trajectory analysis.
 
 Usage:
 	ptra pfile ifile dfile path [flags]
+	ptra serve path [--addr host:port]
+	ptra verify configFile snapshotFile [--outputPath path] [--tolerance nr]
+	ptra diff pathA pathB [--name string] [--tolerance nr]
+	ptra checksig signatureFile keyFile
+	ptra export resultFile outputFile [--min-support nr] [--min-rr nr] [--clusters list] [--pairs file]
+		[--trajectories file] [--format gml | graphml | tab | ptra]
+	ptra sql databaseFile [--load files] [--query string] [--csv] [--duckdbPath string]
+	ptra demo [path] [--patients nr] [--seed nr] [flags]
+
+All commands also accept the profiling flags [--cpuprofile file] [--memprofile file] [--trace file], and the flags
+[--quiet] [--verbose] for the verbosity of their messages.
+
+The pfile and dfile arguments can be comma-separated lists of files, e.g. yearly extracts of the same database. A
+patient that occurs in several files is merged into one patient, and duplicate diagnoses are removed. The files
+are parsed concurrently and merged in the order of the list, so that the result does not depend on the parallelism.
 
 Example:
 	ptra ICD10 patient.csv icd10cm_tabular_2022.xml diagnosis.csv ./MIBC_tfiltered/ --nofAgeGroups 10 --lvl 2
@@ -64,7 +81,12 @@ The flags are:
 	this chosen level. ICD10 codes of lower levels may be combined into the same code of a higher level. E.g. A00.0
 	Cholera due to Vibrio cholerae 01, biovar cholerae and A00.1 Cholera due to Vibrio cholerae 01, biovar eltor are lvl
 	3 codes and may be collapsed to A00 Cholera in lvl 2, or A00-A09 Intestinal infectious diseases in lvl 1, or A00-B99
-	Certain infectious and parasitic diseases in lvl 0.
+	Certain infectious and parasitic diseases in lvl 0. For Phecodes, lvl 0 rolls up to the integer phecodes (e.g. 250),
+	lvl 1 to the phecodes with one decimal (e.g. 250.2), and higher levels keep the phecodes as they are.
+--grouper icd10 | ccsr | phecode
+	Sets the grouper that maps the ICD10 codes onto the diagnoses for analysis, given by the diagnosisInfoFile: the ICD10
+	hierarchy (an xml file), CCSR categories (a csv file), or Phecodes (a csv file with the columns icd10cm, phecode,
+	and phecode_str). By default, the grouper is derived from the diagnosisInfoFile.
 --minPatients nr
 	Sets the minimum required number of patients in a trajectory.
 --maxYears nr
@@ -84,14 +106,204 @@ The flags are:
 --ICD9ToICD10File file
 	A json file that provides a mapping from ICD9 to ICD10 codes. The input may be mixed ICD9 and ICD10 codes. With this
 	mapping, the tool can automatically convert all diagnosis codes to ICD10 codes for analysis.
+--icd10BaseCodes
+	Maps all ICD10 diagnosis codes onto their WHO base codes, e.g. E11.65 onto E11.6, so that cohorts from countries
+	that use different national modifications of ICD10 (ICD-10-CM, ICD-10-GM, ICD-10-AM, ...) can be combined. Without
+	this flag, only the codes of other modifications that are not in the vocabulary are mapped onto their closest
+	ancestor in the vocabulary.
+--codeValidity file
+	A csv file with the validity periods of the diagnosis codes, with the header code,validFrom,validTo, e.g.
+	U07.1,2020-04-01, for a code introduced in April 2020. The dates are YYYY-MM-DD or YYYY, an empty date is an open
+	bound, and a code applies to all codes below it that have no validity period of their own. With the persontime
+	denominators, only the person-time during which a diagnosis could be recorded is at risk, so that recently
+	introduced codes do not get inflated relative risk ratios.
+--maxGap years
+	Drops the patients that have more than years between two consecutive records, e.g. 3 for at least one record every
+	3 years, since long gaps without healthcare contact bias the timing of the transitions between diagnoses. The
+	dropped patients are listed in the exclusions file with the reason observation_gap. Without this flag, or with 0,
+	patients are not filtered on gaps.
+--bundles file
+	A json file with diagnosis bundles, which combine several diagnoses into a single diagnosis that acts as one step
+	in the trajectories, e.g. metabolic syndrome for 3 of its components within a year. Each bundle has a Name, a list
+	of Codes, optionally MinCodes, the number of different codes a patient needs (default 1), Window, the years within
+	which the patient needs them (default no limit), Code, the code of the bundle in the outputs (default the codes
+	joined by +), and Keep, to keep the codes in the trajectories as well.
+--descriptions file
+	A csv file with the header Code,Description with localized descriptions of the codes, e.g. a translation of the
+	vocabulary, which replace the medical names of the diagnoses in all outputs.
+--messages file
+	A csv file with the header Key,Text with translations of the report texts, e.g. of the narratives of the
+	trajectories. The texts that are not translated stay in English.
+--terminologyServer url
+	Looks up the medical names of the diagnoses that have none in the vocabulary, e.g. for vocabulary files without
+	descriptions, with the $lookup operation of a FHIR terminology server, e.g. https://tx.fhir.org/r4. The names are
+	cached on disk. If the server cannot be reached, the codes are kept as names.
+--terminologySystem uri
+	Sets the code system of the codes that are looked up. The default is http://hl7.org/fhir/sid/icd-10-cm.
+--terminologyCache file
+	Sets the json file in which the looked up names are cached. The default is terminology-cache.json in the ptra
+	folder of the user's cache directory.
 --cluster
 	If this flag is passed, the computed trajectories are clustered and the clusters are outputted to file.
 --mclPath
 	Sets the path where the mcl binaries can be found.
+--mclLimits settings
+	Limits the resources of the MCL processes, so that they do not saturate a shared server. The settings are a
+	comma-separated list of nice=niceness, cpus=list, and memory=bytes, e.g. nice=10,cpus=0-3,memory=8G, which run the
+	processes through nice, taskset, and prlimit respectively. A setting applies to mcxload, mcl, and mcxdump, unless
+	it is prefixed with the name of one of them, e.g. mcl.memory=16G.
+--abcFile
+	By default, the trajectory similarities are streamed directly into mcxload. If this flag is passed, they are first
+	written to an intermediate .abc file in the cluster output folder instead, which is useful for debugging.
+--skipDiskCheck
+	By default, the run refuses to start if the estimated size of the intermediate files of the clustering exceeds the
+	free disk space in the output path, or falls back to streaming when only the .abc file does not fit. The disk space
+	is checked as soon as the cohort is parsed, with --maxTrajectories as the number of trajectories, and again before
+	the clustering starts. If this flag is passed, the run starts regardless.
+--clusterer file | native
+	A JSON adapter config for an external community-detection tool that is used instead of MCL, e.g. Infomap or a label
+	propagation binary. The config gives the command template, the format of the similarities passed to the tool, and
+	the file and format of the clustering it writes, cf. cluster.Clusterer. --clusterer native clusters with the
+	built-in implementation of MCL instead, so that the mcl binaries need not be installed.
+--scorer file
+	An external executable that computes the similarities between trajectories for clustering, instead of the jaccard
+	similarity. This allows using domain-specific metrics without recompiling ptra. The executable reads the
+	trajectories and the pairs to score from stdin and writes a score per pair to stdout, cf. the cluster package.
+--similarities file
+	A file with pre-computed similarities between the trajectories, e.g. computed externally with embedding models,
+	that are used for clustering instead of --similarity. The trajectories are identified by their index in the
+	trajectories tab file, starting from 0. The file is either an abc file with a line per pair of trajectories with
+	both indexes and the similarity, or a csv file with a square similarity matrix. The cohort is still parsed and the
+	trajectories are rebuilt, so that their indexes match the file. Together with --loadRR, the relative risks are not
+	computed again.
+--similarity jaccard | semantic | overlap | dice | lcs | edit | dtw | rrjaccard | patients | hierarchy | bigram | embedding | containment
+	Sets the similarity between trajectories used for clustering. jaccard, the default, is the Jaccard similarity
+	coefficient of the diagnoses in both trajectories. semantic is a Jaccard similarity where related diagnoses
+	contribute a partial overlap, based on their Wu-Palmer similarity in the ICD10 or CCSR hierarchy. E.g. type 2
+	diabetes and diabetes with renal complications are then partially the same diagnosis. overlap is the
+	Szymkiewicz-Simpson overlap coefficient and dice the Sorensen-Dice coefficient of the diagnoses. lcs takes the order
+	of the diagnoses into account: it is the length of the longest common subsequence of the diagnoses, divided by the
+	length of the longest trajectory. edit is 1 minus the edit distance between the diagnoses, divided by the length of
+	the longest trajectory. dtw aligns the diagnoses with dynamic time warping on a time axis, the median time since the
+	first diagnosis of the trajectory over its patients, so that trajectories that traverse the same diagnoses over
+	similar time spans are more similar. rrjaccard is a weighted Jaccard similarity, where each diagnosis of a
+	trajectory is weighted by the highest RR of its transitions in the trajectory, so that sharing a diagnosis of a
+	high-RR transition contributes more than sharing a common diagnosis of a low-RR transition. patients is the
+	Jaccard similarity coefficient of the patients that follow the trajectories, so that clusters reflect shared
+	populations instead of shared diagnoses. hierarchy is a Jaccard similarity where diagnoses with related codes
+	contribute a partial overlap, based on their shared ancestors in a code hierarchy, cf. --codeHierarchy. E.g. the
+	sibling codes C34.1 and C34.9 are then partially the same diagnosis. bigram is the Jaccard similarity coefficient
+	of the transitions of both trajectories, i.e. their pairs of consecutive diagnoses, so that clusters reflect shared
+	transitions instead of shared diagnoses. embedding is a Jaccard similarity where diagnoses contribute a partial
+	overlap, based on the cosine similarity of the embeddings of their codes, cf. --embeddings, so that rare but
+	semantically close codes cluster together. containment is the fraction of the diagnoses of one trajectory that
+	occur in the other, so that nested trajectories, e.g. D1 -> D2 in D1 -> D2 -> D3, are fully contained in the
+	longer ones but not the other way around. Since it is asymmetric, the similarity graph is directed and its edges
+	are not mirrored when loading it into MCL.
+--codeHierarchy file
+	A csv file with the header Code,Parent that maps codes onto their parent codes, for the hierarchy similarity. By
+	default, the ancestors of a code are its prefixes, e.g. C, C3, and C34 for C34.1.
+--embeddings file
+	A csv file with precomputed embeddings of the diagnosis codes, e.g. from cui2vec or node2vec, for the embedding
+	similarity. After a header, each line has a code followed by the components of its embedding.
+--minClusterSize nr
+	Merges the clusters with fewer trajectories into the cluster with the most similar trajectories.
+--maxClusterSize nr
+	Re-clusters the clusters with more trajectories recursively with MCL at a higher inflation.
+--softClusters threshold
+	Enables soft clustering, where trajectories can belong to multiple clusters, e.g. 0.2. The membership weight of a
+	trajectory for a cluster is its mean similarity with the cluster's trajectories, normalized over all clusters. A
+	trajectory belongs to the cluster MCL assigns it to, and to all clusters for which its weight is at least the
+	threshold. The weights are added to the clustered trajectories tab file, the clusters csv file, and the GML files.
+--temporalWeight weight
+	Adds the rate of progression of the trajectories to the similarity used for clustering, with the given weight
+	between 0 and 1, e.g. 0.3. The rate of progression of a trajectory is given by the median time between its
+	diagnoses and its median total duration, so that fast- and slow-progressing trajectories with the same diagnoses
+	can end up in different clusters.
+--patientWeight weight
+	Combines the similarity used for clustering with the overlap of the patients that follow the trajectories, cf.
+	--similarity patients, with the given weight between 0 and 1, e.g. 0.3 for 0.7 * similarity + 0.3 * patient
+	similarity, so that the clusters capture both the diagnoses of the trajectories and the populations that follow
+	them.
+--splitGraphs
+	Writes the graph of each cluster to its own GML file, with an index.tsv manifest, instead of concatenating all
+	cluster graphs in one GML file. Most graph viewers only render the first graph of a concatenated GML file.
+--bundleEdges
+	Writes one edge per transition in the cluster graphs, with the summed patient numbers, the maximum RR, and the
+	number of trajectories in which the transition occurs as attributes, instead of one edge per trajectory.
+--graphml
+	Also writes the trajectory similarity graph that is clustered as a GraphML file, <name>.similarities.graphml, with a
+	node per trajectory and an edge per pair of trajectories with a similarity above --graphmlThreshold, for running
+	other community detection algorithms or visualizations on the same graph.
+--graphmlThreshold similarity
+	The similarity above which pairs of trajectories are edges in the GraphML similarity graph, 0 by default.
+--similarityMatrix formats
+	Also writes the trajectory similarity matrix that is clustered to <name>.similarities.npy and/or
+	<name>.similarities.parquet, for a comma-separated list of the formats npy, the full matrix as a NumPy array, and
+	parquet, the sparse matrix as a Parquet table with the columns i, j, and similarity, e.g. npy,parquet.
+--minSimilarity similarity
+	Only clusters the similarities between pairs of trajectories above the given similarity, which keeps the input of
+	MCL small, since most pairs of trajectories are hardly similar. Trajectories without any similarity above it end up
+	in a cluster of their own. The cutoff is recorded in the .ptra files of the clusterings. The default is 0, which
+	clusters all similarities.
+--nullPercentile percentile
+	Only clusters the similarities above the given percentile, e.g. 95, of a null distribution of the similarities,
+	which is estimated from random pairs of trajectories of which the diagnoses are shuffled across the trajectories.
+	This drops the edges that are not more similar than unrelated trajectories, which reduces the noise fed to MCL.
+	Together with --minSimilarity, the highest cutoff applies. The percentile must be below 100. The default is 0,
+	which does not use a null model.
+--lsh bands,rows
+	Only computes the similarities of the candidate pairs of trajectories found with MinHash locality-sensitive
+	hashing, instead of the similarities of all pairs, for clustering experiments with 100k trajectories or more. The
+	MinHash signatures of the diagnoses of the trajectories are split into bands of rows, and trajectories that agree
+	on a band are candidates. More bands find more similar pairs, more rows compute fewer dissimilar pairs. E.g. 20,5
+	finds most pairs with a Jaccard similarity above 0.6.
+--threads nr
+	The number of threads that compute the similarities of all pairs of trajectories for the clustering in parallel.
+	The default is 0, which uses as many threads as ptra, cf. --nrOfThreads.
+--similarityCache dir
+	Caches the trajectory similarities in the given directory, in a file named after a hash of the trajectories and the
+	similarity flags, so that later runs with the same trajectories and similarity flags, e.g. with other
+	granularities, reuse them instead of computing them again.
+--similarityCheckpoints dir
+	Writes the trajectory similarities to checkpoints in the given directory while they are computed, in chunks whose
+	sizes and CRCs are listed in a manifest, so that an interrupted run resumes from the last valid chunk instead of
+	computing all the similarities again. The checkpoints are removed once all the similarities are computed.
+--bootstrap nr
+	Sets the number of bootstrap runs for the confidence intervals of the cluster statistics: the percentage of males,
+	the percentage of patients with an event of interest, and the mean RR. The default is 1000. 0 skips the statistics.
+--figures nr
+	Writes a PDF figure bundle of the nr largest clusters, with one page per cluster showing the graph of the cluster,
+	a summary table, and the Kaplan-Meier curve of the survival of its patients after the trajectories. 0, the
+	default, skips the figures.
+--omopConcepts file
+	The CONCEPT table of the OMOP vocabularies, as downloaded from Athena. With this file, the consensus of each
+	cluster is written as an ATLAS cohort definition to a .clustered.cohorts directory, so that the cluster can be
+	instantiated as a cohort on other OMOP databases for external validation.
+--clusterNames file
+	The naming sheet of the clusters of a previous run, cf. .clustered.names.csv. Each clustering writes a naming sheet
+	with the header Cluster,ID,Name,Medoid,Similarity, with a stable ID, a name, and a medoid trajectory per cluster.
+	With --clusterNames, the clusters are matched to the named clusters by the similarity of their medoids, and the
+	matched clusters keep their IDs and names, so that dashboards that monitor the clusters survive a data refresh.
 --iter nr
 	Sets the number of iterations to be used in the sampling experiments for calculating relative risk ratios. If iter
 	is 400, the calculated p-values are within 0.05 of the true p-values. For iter = 10000, the true p-values are within
 	0.01 of the true p-values. The higher the number of iterations, the higher the runtime.
+--rrDenominator persontime | count
+	Sets the denominators of the relative risk ratios. persontime, the default, divides the numbers of patients with
+	the second diagnosis of a pair in the exposed and comparison groups by their person-time at risk, computed from the
+	follow-up intervals of the patients, which gives incidence rate ratios. This corrects the bias when the groups have
+	different follow-up lengths. count divides by the numbers of patients in the groups, as in earlier versions of ptra.
+--rng reference | alternate
+	Sets the random generators of the sampling experiments and the bootstrap. reference, the default, uses the
+	generators of math/rand and fastrand. alternate uses the PCG and ChaCha8 generators of math/rand/v2, so that a
+	validation run can show that the results do not depend on the random generators.
+--statistics reference | alternate | crosscheck
+	Sets the implementation of the statistical tests: Fisher's exact test, the binomial test of the direction of the
+	pairs, the Mann-Whitney U test, and the Benjamini-Hochberg q-values. alternate computes them with other algorithms
+	than reference, the default. crosscheck computes each test with both, reports the results on which they disagree
+	as warnings, and uses the results of reference. Validation builds, built with go build -tags validation,
+	crosscheck by default.
 --saveRR file
 	Save the RR matrix, a matrix that represents the RR calculated from the population for each possible combination of
 	ICD10 diagnosis pairs. This matrix can be loaded in other ptra runs to avoid recalculating the RR scores. This can
@@ -100,11 +312,38 @@ The flags are:
 	scores, such as maxTrajectoryLenght, minTrajectoryLength, minPatients, RR etc might be explored in other runs.
 --loadRR file
 	Load the RR matrix from file. Such a file must be created by a previous run of ptra with the --saveRR flag.
---pfilters age70+ | age70- | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |NMIBC | MIBC | mUC
-	A list of filters for selecting patients from whitch to derive trajectories.
+--pfilters age70+ | age70- | age:min-max | biomarker:name op value | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |NMIBC | MIBC | mUC
+	A list of filters for selecting patients from whitch to derive trajectories. age:min-max is an age window, e.g.
+	age:0-18, that only keeps the diagnoses patients get from age min until age max, for analysing trajectories in
+	age-time, e.g. in congenital and pediatric cohorts. biomarker:name op value selects the patients by a biomarker of
+	--biomarkers, e.g. biomarker:KRAS=mutant or biomarker:PDL1>=50, with op one of =, !=, <, <=, >, and >=.
 --tumorInfo file
 	A file with information about patients and their tumors. This file contains annotations about the stage of the
 	bladder cancer at a specific time. Cf. TriNetX tumor table. This information is used by filters.
+--biomarkers file
+	A csv file with biomarkers of the patients, e.g. mutation status, with the header patient_id followed by the names
+	of the biomarkers. The biomarkers can stratify the trajectory discovery with --pfilters, and each trajectory is
+	tested for enrichment of each biomarker among its patients compared to the other patients, with Fisher's exact test
+	for categorical biomarkers and the Mann-Whitney U test for numeric ones. The tests are written to
+	name-biomarker-enrichment.csv.
+--literature file
+	A csv file with known trajectories from the literature, with the header trajectory,reference, e.g.
+	"E11 -> I10 -> N18",Doe et al. 2020. The diagnoses are codes or medical terms of the run, separated by arrows.
+	Each trajectory is flagged as known if it replicates a known trajectory, i.e. has its diagnoses in the same order,
+	and as novel otherwise, in name-trajectories-literature.csv, the clustering outputs, and the figures. The
+	replication of each known trajectory is written to name-literature-replication.csv.
+--excludeTransitions file
+	A csv file with diagnosis transitions to ignore, with the header from,to, e.g. Z12,C18 for a screening followed by
+	the disease that is screened for. The diagnoses are codes or medical terms of the run, and a code also matches its
+	subcodes. The relative risk ratios of the excluded transitions are not computed, and they are never part of a
+	trajectory. The excluded transitions and their numbers of patients are written to
+	name-excluded-transitions.csv.
+--review file
+	A review sheet of the trajectories, curated by clinicians, cf. name-trajectories-review.csv. Each run writes a
+	review sheet with the header Trajectory,Patients,Decision,MergeInto,Comment, in which the trajectories can be
+	marked to accept, reject, or merge into another trajectory, given in the MergeInto column. With --review, the
+	rejected and merged trajectories are removed before the trajectories are written, reported, and clustered, and the
+	decisions are copied into the new review sheet, so that the review can be continued.
 --tfilters neoplasm | bc
 	A list of filters for reducing the output of trajectories. E.g. neoplasm only outputs trajectories where there is at
 	least one diagnosis related to cancer. bc only outputs trajectories where one diagnosis is (assuming) related to
@@ -112,6 +351,189 @@ The flags are:
 --treatmentInfo file
 	A file with information about patients and their treatments, e.g. MVAC,radical cystectomy, etc. If this file is
 	passed, the treatments will be used as diagnostic codes to calculated trajectories.
+--compareCohort filters
+	Compares the support for the trajectories between a case cohort and a comparator cohort, e.g. patients exposed
+	and not exposed to a drug. The case cohort consists of the patients that pass the given list of patient filters,
+	with the same syntax as --pfilters, and the comparator cohort of the other patients. For each trajectory, the
+	numbers of patients that follow it in both cohorts are compared with Fisher's exact test, with the relative risk as
+	effect size and a Benjamini-Hochberg FDR correction. The comparison table is written to name-cohort-comparison.csv,
+	and a diff graph of the trajectories with a q-value below 0.05 to name-cohort-comparison.gml.
+--sexSpecific
+	Computes the relative risk ratios of the transitions of the trajectories separately for males and females, with
+	comparison groups sampled from the patients of the same sex, since some trajectories differ strongly by sex, which
+	the pooled relative risk ratios hide. The pooled and sex-specific relative risk ratios, their p-values, and the
+	ratios of the male to the female relative risk ratios are written to name-transitions-by-sex.csv.
+--sexSplitEdges
+	Implies --sexSpecific, and writes a graph of the trajectories to name-trajectories-by-sex.gml with split edges:
+	each transition has a male and a female edge, labeled with the relative risk ratio for that sex, for the sexes for
+	which the relative risk ratio is significant.
+--standardize file
+	Standardizes the support for the trajectories to the age and sex structure of a reference population (direct
+	standardization), so that the prevalence of trajectories can be compared across cohorts with different
+	demographics. The file is a csv file with the header AgeMin,AgeMax,Sex,Population. The crude and standardized
+	support rates are written to name-trajectories-standardized.csv.
+--eras window,step
+	Repeats the trajectory discovery over sliding calendar windows of window years, stepped by step years, e.g. 5,1 for
+	5-year windows stepped yearly, to track which trajectories emerge and disappear over the eras. The number of
+	patients per trajectory and era is written to name-era-evolution.csv, and the graphs of the eras to
+	name-era-evolution.json, for animated graphs.
+--eoiStrata years
+	Splits the patients with an event of interest into an early and a late outcome stratum, with a time from their first
+	diagnosis to the event of interest of at most years, e.g. 2, or more, and discovers the trajectories separately in
+	each stratum. The trajectories of the strata are written as for the whole run, with the names name-eoi-early and
+	name-eoi-late, and the trajectories that discriminate the strata are reported in name-eoi-strata.csv, with Fisher's
+	exact test on the numbers of patients of both strata that follow each trajectory.
+--delta
+	Only rewrites the output files that changed since the previous run into the same output directory, e.g. when
+	re-running with slightly different parameters. Each output file is compared with the previous file while it is
+	written, and left untouched when it is identical. The content hashes of the output files are saved in
+	name.manifest.json, and name.changelog.csv lists for each output file whether it is added, changed, unchanged, or
+	stale, i.e. written by the previous run but not by this run.
+--sign keyFile
+	Signs the output files at the end of the run, so that the recipients of the results can verify that they were not
+	altered, cf. the checksig command. The SHA-256 hashes of all files in the output path are written to
+	name.signature.json, with an HMAC-SHA256 signature if the key file holds a shared secret, or an ed25519 signature
+	if it holds a PEM-encoded ed25519 private key.
+--duckdb file
+	Loads the trajectories and the clusters of the run into the tables of a DuckDB database file at the end of the
+	run, for querying them with SQL, cf. the sql command. The file is created if it does not exist.
+--duckdbPath string
+	The path to the duckdb binary. The default is duckdb, which is looked up in the PATH.
+--chunkByChapter
+	Builds the trajectories chapter by chapter, where the chapter of a trajectory is the ICD10 chapter or CCSR body
+	system of its first diagnosis. Only the trajectories that start in one chapter are held in memory while they are
+	extended, and the trajectories of all chapters are merged at the end. This trades run time for a lower peak memory
+	usage, for large cohorts on memory-constrained machines. The resulting trajectories are the same.
+--maxTrajectories nr
+	Keeps only the nr highest scoring trajectories, i.e. followed by the most patients, while building the
+	trajectories, rather than all qualifying trajectories. The trajectory filters are applied before selecting the
+	highest scoring trajectories. This bounds the memory usage for exploratory runs on modest machines. The default is
+	0, which keeps all trajectories.
+--maxPerPatient nr
+	Lets each patient support at most nr trajectories, so that a few patients with hundreds of diagnoses do not
+	dominate the numbers of patients of the trajectories and the similarities between them. A patient that follows more
+	trajectories is only counted for the nr trajectories with the most patients. The trajectories that are left with
+	fewer than --minPatients patients are removed. The default is 0, which does not cap the contributions.
+--incidentLookback years
+	Restricts the trajectories to incident index cases, so that they describe the onset of diseases rather than the
+	follow-up of prevalent cases. A patient only counts for a trajectory if the patient has records for at least the
+	given number of years before the first diagnosis of the first diagnosis of the trajectory. The numbers of incident
+	and prevalent patients per index diagnosis are written to name-index-cases.csv. The default is 0, which counts all
+	patients.
+--statusAddr host:port
+	Serves a status page on the given address while ptra is running. The page shows the progress of the stages of the
+	run, the current memory usage, and the recent log lines. This is useful to follow long runs on remote machines,
+	e.g. through ssh port forwarding.
+--tui
+	Shows a terminal UI with the progress of the stages of the run, the current memory usage, and the recent log lines,
+	instead of printing the messages, for following long runs over ssh. The + and - keys adjust the verbosity of the
+	messages, and while the relative risk ratios are computed, the c key requests an early checkpoint: the relative
+	risk ratios are saved to name.checkpoint-rr.tab as soon as they are computed, so that the run can be resumed with
+	--loadRR.
+
+The serve command hosts a local web UI over a results directory, i.e. the output path of a previous ptra run. The UI
+lists the trajectory and cluster files, shows the trajectories with filters on the number of patients and the
+diagnoses, shows the clusters with a rendered graph per cluster, and allows downloading the filtered trajectories.
+
+--addr host:port
+	Sets the address the web UI listens on. The default is localhost:8080.
+
+Each ptra run saves its configuration as name.config.json and a snapshot of its key outputs (trajectory counts, cluster
+sizes, RR distribution) as name.snapshot.json in the output path. The verify command reruns the pipeline with a saved
+configuration and compares the key outputs against a reference snapshot, e.g. to validate an upgrade of ptra. It exits
+with status 1 if an output differs more than the tolerance from the reference.
+
+--outputPath path
+	Sets the path where the outputs of the rerun are written. By default, a temporary directory is used.
+--tolerance nr
+	Sets the relative tolerance for the differences between the reference and the rerun. The default is 0.05. Some
+	tolerance is needed since the RR calculation uses random sampling.
+
+The diff command compares two runs, given by their output paths, to explain why their results differ. It prints the
+parameters that differ between their saved configurations, and compares the key outputs in their snapshots. It exits
+with status 1 if the runs differ.
+
+--name string
+	Selects the run to compare if an output path contains several runs, e.g. exp1.
+--tolerance nr
+	Sets the relative tolerance for the differences between the key outputs of both runs. The default is 0, so that
+	all differences are reported.
+
+The checksig command verifies the output files of a run signed with --sign, e.g. after receiving them from a secure
+environment. It checks the signature in the signature file name.signature.json with the key file, i.e. the shared
+secret or the ed25519 public key, and compares the files next to the signature file with the signed hashes. It prints
+the files that were changed, are missing, or were not signed, and exits with status 1 if the signature is invalid, or if
+a signed file was changed or is missing.
+
+The export command re-exports the trajectories of a previous run from a trajectories tab file or a clustered
+trajectories tab file, without recomputing the trajectories or the clustering, e.g. to generate a variant of a figure.
+It also reads the mcxdump files dump.name.mci.I<gran> of older runs, which were the only record of their clusterings,
+and GML graphs, e.g. cluster graphs that were curated in Cytoscape, of which each edge is exported as a trajectory of
+two diagnoses with the patient number and the RR of the edge.
+
+--min-support nr
+	Only exports trajectories with at least nr patients for each transition.
+--min-rr nr
+	Only exports trajectories with an RR of at least nr for each transition.
+--clusters list
+	Only exports the trajectories of the given clusters, e.g. 3,7. Requires a clustered trajectories tab file.
+--pairs file
+	The pairs tab file of the run with the RR scores of the diagnosis pairs. By default, it is looked up next to the
+	result file and in its parent directory.
+--trajectories file
+	The trajectories tab file that belongs to an mcxdump file. By default, it is looked up in the parent directory of
+	the cluster output folder.
+--format gml | graphml | tab
+	Sets the output format. gml and graphml write a graph per cluster, tab writes the trajectories in the format of the
+	trajectories tab file. The default is gml.
+
+The sql command loads the .ptra files of runs into a DuckDB database file, with the tables runs, diagnoses,
+trajectories, transitions, and clusters, and runs SQL queries against it with the duckdb binary. Without --load and
+--query, it starts the interactive duckdb shell on the database.
+
+--load files
+	Loads a comma-separated list of .ptra files into the database, replacing the tables that already exist.
+--query string
+	Runs an SQL query against the database and prints the result.
+--csv
+	Prints the result of the query as csv.
+--duckdbPath string
+	The path to the duckdb binary. The default is duckdb, which is looked up in the PATH.
+
+All commands accept flags for profiling, so that profiles can be attached to reports of performance issues. Relative
+file names are relative to the output path of the command: the output path of a ptra run, the results path for serve,
+the output path of the rerun for verify, the directory of the output file for export, and the current directory for
+diff and checksig. The profiles are also written when a command is interrupted, e.g. to stop ptra serve.
+
+--cpuprofile file
+	Writes a pprof CPU profile of the command to file.
+--memprofile file
+	Writes a pprof heap profile to file at the end of the command.
+--trace file
+	Writes an execution trace of the command to file, for viewing with go tool trace.
+
+All commands print their progress messages and warnings on standard error, so that standard output only contains the
+data written by the command, e.g. the query results of ptra sql or the report of ptra verify, and can be piped.
+
+--quiet
+	Only prints warnings and errors.
+--verbose
+	Also prints details, e.g. the collected trajectories, the cohorts, and the commands of the external tools.
+
+The demo command writes a synthetic cohort with a few built-in disease progressions to path/input, e.g.
+obesity, diabetes, chronic kidney disease, and anemia, runs ptra on it with the native MCL, and writes an HTML report
+of the trajectories and clusters to path/output/report.html. It needs no data and no external tools, and prints the
+equivalent ptra command and the saved configuration, as a starting point for running ptra on real data. The default
+path is ptra-demo. The demo command accepts the flags of the ptra command, with defaults for the synthetic cohort.
+
+--patients nr
+	Sets the number of patients of the synthetic cohort. The default is 2000.
+--seed nr
+	Sets the seed of the random generator of the synthetic cohort. The default is 1.
+
+The ptra, verify, and sql commands export OpenTelemetry traces of the stages of the pipeline and of the external
+processes they run when OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. A W3C trace context
+in TRACEPARENT makes the run part of an existing trace.
 */
 
 const (
@@ -127,6 +549,7 @@ const ptraHelp = "\nptra parameters:\n" +
 	"ptra patientInfoFile diagnosisInfoFile diagnosesFile outputPath \n" +
 	"[--nofAgeGroups nr]\n" +
 	"[--lvl nr]\n" +
+	"[--grouper icd10 | ccsr | phecode]\n" +
 	"[--minPatients nr]\n" +
 	"[--maxYears nr]\n" +
 	"[--minYears nr]\n" +
@@ -134,19 +557,87 @@ const ptraHelp = "\nptra parameters:\n" +
 	"[--minTrajectoryLength nr]\n" +
 	"[--name string]\n" +
 	"[--ICD9ToICD10File file]\n" +
+	"[--icd10BaseCodes]\n" +
+	"[--codeValidity file]\n" +
+	"[--maxGap years]\n" +
+	"[--bundles file]\n" +
+	"[--descriptions file]\n" +
+	"[--messages file]\n" +
+	"[--terminologyServer url]\n" +
+	"[--terminologySystem uri]\n" +
+	"[--terminologyCache file]\n" +
 	"[--cluster]\n" +
 	"[--mclPath string]\n" +
+	"[--mclLimits settings]\n" +
+	"[--abcFile]\n" +
+	"[--skipDiskCheck]\n" +
+	"[--clusterer file | native]\n" +
+	"[--scorer file]\n" +
+	"[--similarities file]\n" +
+	"[--similarity jaccard | semantic | overlap | dice | lcs | edit | dtw | rrjaccard | patients | hierarchy | bigram | embedding | containment]\n" +
+	"[--codeHierarchy file]\n" +
+	"[--embeddings file]\n" +
+	"[--minClusterSize nr]\n" +
+	"[--maxClusterSize nr]\n" +
+	"[--softClusters threshold]\n" +
+	"[--temporalWeight weight]\n" +
+	"[--patientWeight weight]\n" +
+	"[--splitGraphs]\n" +
+	"[--bundleEdges]\n" +
+	"[--graphml]\n" +
+	"[--graphmlThreshold similarity]\n" +
+	"[--similarityMatrix formats]\n" +
+	"[--minSimilarity similarity]\n" +
+	"[--nullPercentile percentile]\n" +
+	"[--lsh bands,rows]\n" +
+	"[--threads nr]\n" +
+	"[--similarityCache dir]\n" +
+	"[--similarityCheckpoints dir]\n" +
+	"[--bootstrap nr]\n" +
+	"[--figures nr]\n" +
+	"[--omopConcepts file]\n" +
+	"[--clusterNames file]\n" +
 	"[--iter nr]\n" +
+	"[--rrDenominator persontime | count]\n" +
+	"[--rng reference | alternate]\n" +
+	"[--statistics reference | alternate | crosscheck]\n" +
 	"[--saveRR file]\n" +
 	"[--loadRR file]\n" +
-	"[--pfilters age70+ | age70- | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |" +
+	"[--pfilters age70+ | age70- | age:min-max | biomarker:name op value | male | female | Ta | T0 | Tis | T1 | T2 | T3 | T4 | N0 | N1 | N2 | N3 | M0 | M1 |" +
 	"NMIBC | MIBC | mUC ]\n" +
 	"[--tumorInfo file]\n" +
+	"[--biomarkers file]\n" +
+	"[--literature file]\n" +
+	"[--excludeTransitions file]\n" +
+	"[--review file]\n" +
 	"[--tfilters neoplasm | bc]\n" +
 	"[--treatmentInfo file]\n" +
-	"[--nrOfThreads nr]\n"
+	"[--nrOfThreads nr]\n" +
+	"[--chunkByChapter]\n" +
+	"[--maxTrajectories nr]\n" +
+	"[--maxPerPatient nr]\n" +
+	"[--incidentLookback years]\n" +
+	"[--compareCohort filters]\n" +
+	"[--sexSpecific]\n" +
+	"[--sexSplitEdges]\n" +
+	"[--standardize file]\n" +
+	"[--eras window,step]\n" +
+	"[--eoiStrata years]\n" +
+	"[--delta]\n" +
+	"[--sign keyFile]\n" +
+	"[--duckdb file]\n" +
+	"[--duckdbPath string]\n" +
+	"[--statusAddr host:port]\n" +
+	"[--tui]\n" +
+	outputHelp +
+	profileHelp
 
+// parseFlags parses the optional arguments of a ptra command, which start after the required arguments. It adds the
+// --quiet and --verbose flags that every ptra command accepts, and sets the verbosity accordingly, cf.
+// utils.SetVerbosity.
 func parseFlags(flags flag.FlagSet, requiredArgs int, help string) {
+	quiet := flags.Bool("quiet", false, "Only print warnings and errors.")
+	verbose := flags.Bool("verbose", false, "Also print details, e.g. the collected trajectories.")
 	if len(os.Args) < requiredArgs {
 		fmt.Fprintln(os.Stderr, "Incorrect number of parameters.")
 		fmt.Fprint(os.Stderr, help)
@@ -166,6 +657,16 @@ func parseFlags(flags flag.FlagSet, requiredArgs int, help string) {
 		fmt.Fprint(os.Stderr, help)
 		os.Exit(1)
 	}
+	switch {
+	case *quiet && *verbose:
+		fmt.Fprintln(os.Stderr, "--quiet and --verbose cannot be combined.")
+		fmt.Fprint(os.Stderr, help)
+		os.Exit(1)
+	case *quiet:
+		utils.SetVerbosity(utils.Quiet)
+	case *verbose:
+		utils.SetVerbosity(utils.Verbose)
+	}
 }
 
 func getFileName(s, help string) string {
@@ -177,8 +678,15 @@ func getFileName(s, help string) string {
 	return s
 }
 
-func getPatientFilter(s string, tinfo map[string][]*app.TumorInfo) trajectory.PatientFilter {
+func getPatientFilter(s string, tinfo map[string][]*app.TumorInfo,
+	biomarkers *trajectory.Biomarkers) trajectory.PatientFilter {
 	id := func(p *trajectory.Patient) bool { return true }
+	if strings.HasPrefix(s, "age:") {
+		return getAgeWindowFilter(s)
+	}
+	if strings.HasPrefix(s, "biomarker:") {
+		return getBiomarkerFilter(s, biomarkers)
+	}
 	switch s {
 	case "id":
 		return id
@@ -229,11 +737,42 @@ func getPatientFilter(s string, tinfo map[string][]*app.TumorInfo) trajectory.Pa
 	}
 }
 
-func getPatientFilters(f string, tinfo map[string][]*app.TumorInfo) []trajectory.PatientFilter {
+// getAgeWindowFilter parses an age window filter of the form age:min-max, cf. trajectory.AgeWindowFilter.
+func getAgeWindowFilter(s string) trajectory.PatientFilter {
+	bounds := strings.Split(strings.TrimPrefix(s, "age:"), "-")
+	if len(bounds) != 2 {
+		log.Panic(fmt.Sprintf("Invalid age window, expected age:min-max: %s", s))
+	}
+	minAge, err := strconv.ParseFloat(bounds[0], 64)
+	if err != nil {
+		log.Panic(fmt.Sprintf("Invalid age window %s: %v", s, err))
+	}
+	maxAge, err := strconv.ParseFloat(bounds[1], 64)
+	if err != nil {
+		log.Panic(fmt.Sprintf("Invalid age window %s: %v", s, err))
+	}
+	return trajectory.AgeWindowFilter(minAge, maxAge)
+}
+
+// getBiomarkerFilter parses a biomarker filter of the form biomarker:name op value, cf.
+// trajectory.ParseBiomarkerFilter.
+func getBiomarkerFilter(s string, biomarkers *trajectory.Biomarkers) trajectory.PatientFilter {
+	if biomarkers == nil {
+		log.Panic(fmt.Sprintf("The biomarker filter %s requires --biomarkers", s))
+	}
+	filter, err := trajectory.ParseBiomarkerFilter(biomarkers, strings.TrimPrefix(s, "biomarker:"))
+	if err != nil {
+		log.Panic(err)
+	}
+	return filter
+}
+
+func getPatientFilters(f string, tinfo map[string][]*app.TumorInfo,
+	biomarkers *trajectory.Biomarkers) []trajectory.PatientFilter {
 	fs := strings.Split(f, ",")
 	result := []trajectory.PatientFilter{}
 	for _, f := range fs {
-		result = append(result, getPatientFilter(f, tinfo))
+		result = append(result, getPatientFilter(f, tinfo, biomarkers))
 	}
 	return result
 }
@@ -259,166 +798,1042 @@ func getTrajectoryFilters(f string, exp *trajectory.Experiment) []trajectory.Tra
 	return result
 }
 
-func main() {
-	var (
-		// required parameters
-		patientInfo      string //The file with patient information (ID, gender," + birthyear, etc)
-		diagnosisInfo    string //The file with diagnosis information (ID,descriptor, hierarchy, etc)
-		patientDiagnoses string //The file with patient diagnoses.
-		outputPath       string //The path where output files are written.
-		// optional flags
-		nofAgeGroups         int
-		lvl                  int
-		maxYears             float64
-		minYears             float64
-		minPatients          int
-		maxTrajectoryLength  int
-		minTrajectoryLength  int
-		name                 string
-		ICD9ToICD10File      string
-		clust                bool
-		mclPath              string
-		clusterGranularities string
-		iter                 int
-		rr                   float64
-		saveRR               string
-		loadRR               string
-		pfilters             string
-		tfilters             string
-		tumorInfo            string
-		treatmentInfo        string
-		nrOfThreads          int
-	)
-	var flags flag.FlagSet
-	// options for the ptra command
-	flags.IntVar(&nofAgeGroups, "nofAgeGroups", 6, "The population data is divided in cohorts in"+
+// config contains the parameters of a ptra run. It is saved as json with the outputs of the run, so that the run can
+// be repeated later, e.g. by the verify command.
+type config struct {
+	// required parameters
+	PatientInfo      string // The file with patient information (ID, gender," + birthyear, etc)
+	DiagnosisInfo    string // The file with diagnosis information (ID,descriptor, hierarchy, etc)
+	PatientDiagnoses string // The file with patient diagnoses.
+	OutputPath       string // The path where output files are written.
+	// optional flags
+	NofAgeGroups         int
+	Lvl                  int
+	Grouper              string
+	MaxYears             float64
+	MinYears             float64
+	MinPatients          int
+	MaxTrajectoryLength  int
+	MinTrajectoryLength  int
+	Name                 string
+	ICD9ToICD10File      string
+	ICD10BaseCodes       bool
+	CodeValidity         string
+	MaxGap               float64
+	Bundles              string
+	Cluster              bool
+	MclPath              string
+	MclLimits            string
+	AbcFile              bool
+	SkipDiskCheck        bool
+	Scorer               string
+	SimilarityFile       string
+	Clusterer            string
+	Similarity           string
+	CodeHierarchy        string
+	Embeddings           string
+	SoftClusters         float64
+	MinClusterSize       int
+	MaxClusterSize       int
+	TemporalWeight       float64
+	PatientWeight        float64
+	SplitGraphs          bool
+	BundleEdges          bool
+	GraphML              bool
+	GraphMLThreshold     float64
+	SimilarityMatrix     string
+	MinSimilarity        float64
+	NullPercentile       float64
+	LSH                  string
+	Threads              int
+	SimilarityCache      string
+	CheckpointDir        string
+	Bootstrap            int
+	Figures              int
+	ClusterGranularities string
+	OMOPConcepts         string
+	ClusterNames         string
+	Iter                 int
+	RRDenominator        string
+	RNG                  string
+	Statistics           string
+	RR                   float64
+	SaveRR               string
+	LoadRR               string
+	Pfilters             string
+	Tfilters             string
+	TumorInfo            string
+	Biomarkers           string
+	Literature           string
+	ExcludeTransitions   string
+	Review               string
+	TreatmentInfo        string
+	NrOfThreads          int
+	ChunkByChapter       bool
+	MaxTrajectories      int
+	MaxPerPatient        int
+	IncidentLookback     float64
+	CompareCohort        string
+	SexSpecific          bool
+	SexSplitEdges        bool
+	Standardize          string
+	Eras                 string
+	EOIStrata            float64
+	Descriptions         string
+	Messages             string
+	TerminologyServer    string
+	TerminologySystem    string
+	TerminologyCache     string
+	Delta                bool
+	Sign                 string
+	DuckDB               string
+	DuckDBPath           string
+	// the format version of a saved configuration, cf. saveConfig
+	FormatVersion int
+}
+
+// command builds the command line that corresponds to a configuration, for printing.
+func (cfg *config) command() string {
+	var command bytes.Buffer
+	fmt.Fprint(&command, os.Args[0], " ", cfg.PatientInfo, " ", cfg.DiagnosisInfo, " ", cfg.PatientDiagnoses,
+		" ", cfg.OutputPath)
+	fmt.Fprint(&command, " --nofAgeGroups ", cfg.NofAgeGroups)
+	fmt.Fprint(&command, " --lvl ", cfg.Lvl)
+	fmt.Fprint(&command, " --grouper ", app.DiagnosisGrouper(cfg.DiagnosisInfo, cfg.Grouper))
+	fmt.Fprint(&command, " --maxYears ", cfg.MaxYears)
+	fmt.Fprint(&command, " --minYears ", cfg.MinYears)
+	fmt.Fprint(&command, " --minPatients ", cfg.MinPatients)
+	fmt.Fprint(&command, " --maxTrajectoryLength ", cfg.MaxTrajectoryLength)
+	fmt.Fprint(&command, " --minTrajectoryLength ", cfg.MinTrajectoryLength)
+	fmt.Fprint(&command, " --name ", cfg.Name)
+	fmt.Fprint(&command, " --ICD9ToICD10File ", cfg.ICD9ToICD10File)
+	if cfg.Descriptions != "" {
+		fmt.Fprint(&command, " --descriptions ", cfg.Descriptions)
+	}
+	if cfg.Messages != "" {
+		fmt.Fprint(&command, " --messages ", cfg.Messages)
+	}
+	if cfg.TerminologyServer != "" {
+		fmt.Fprint(&command, " --terminologyServer ", cfg.TerminologyServer)
+		fmt.Fprint(&command, " --terminologySystem ", cfg.TerminologySystem)
+		fmt.Fprint(&command, " --terminologyCache ", cfg.TerminologyCache)
+	}
+	if cfg.ICD10BaseCodes {
+		fmt.Fprint(&command, " --icd10BaseCodes")
+	}
+	if cfg.CodeValidity != "" {
+		fmt.Fprint(&command, " --codeValidity ", cfg.CodeValidity)
+	}
+	if cfg.MaxGap > 0 {
+		fmt.Fprint(&command, " --maxGap ", cfg.MaxGap)
+	}
+	if cfg.Bundles != "" {
+		fmt.Fprint(&command, " --bundles ", cfg.Bundles)
+	}
+	fmt.Fprint(&command, " --iter ", cfg.Iter)
+	fmt.Fprint(&command, " --rrDenominator ", cfg.rrDenominator())
+	if cfg.RNG != "" {
+		fmt.Fprint(&command, " --rng ", cfg.RNG)
+	}
+	if cfg.Statistics != "" {
+		fmt.Fprint(&command, " --statistics ", cfg.Statistics)
+	}
+	fmt.Fprint(&command, " --RR ", cfg.RR)
+	fmt.Fprint(&command, " --tumorInfo ", cfg.TumorInfo)
+	if cfg.Biomarkers != "" {
+		fmt.Fprint(&command, " --biomarkers ", cfg.Biomarkers)
+	}
+	if cfg.Literature != "" {
+		fmt.Fprint(&command, " --literature ", cfg.Literature)
+	}
+	if cfg.ExcludeTransitions != "" {
+		fmt.Fprint(&command, " --excludeTransitions ", cfg.ExcludeTransitions)
+	}
+	if cfg.Review != "" {
+		fmt.Fprint(&command, " --review ", cfg.Review)
+	}
+	fmt.Fprint(&command, " --treatmentInfo ", cfg.TreatmentInfo)
+	if cfg.SaveRR != "" {
+		fmt.Fprint(&command, " --saveRR ", cfg.SaveRR)
+	}
+	if cfg.LoadRR != "" {
+		fmt.Fprint(&command, " --loadRR ", cfg.LoadRR)
+	}
+	if cfg.ChunkByChapter {
+		fmt.Fprint(&command, " --chunkByChapter")
+	}
+	if cfg.MaxTrajectories > 0 {
+		fmt.Fprint(&command, " --maxTrajectories ", cfg.MaxTrajectories)
+	}
+	if cfg.MaxPerPatient > 0 {
+		fmt.Fprint(&command, " --maxPerPatient ", cfg.MaxPerPatient)
+	}
+	if cfg.IncidentLookback > 0 {
+		fmt.Fprint(&command, " --incidentLookback ", cfg.IncidentLookback)
+	}
+	if cfg.CompareCohort != "" {
+		fmt.Fprint(&command, " --compareCohort ", cfg.CompareCohort)
+	}
+	if cfg.SexSpecific {
+		fmt.Fprint(&command, " --sexSpecific")
+	}
+	if cfg.SexSplitEdges {
+		fmt.Fprint(&command, " --sexSplitEdges")
+	}
+	if cfg.Standardize != "" {
+		fmt.Fprint(&command, " --standardize ", cfg.Standardize)
+	}
+	if cfg.Eras != "" {
+		fmt.Fprint(&command, " --eras ", cfg.Eras)
+	}
+	if cfg.EOIStrata > 0 {
+		fmt.Fprint(&command, " --eoiStrata ", cfg.EOIStrata)
+	}
+	if cfg.Delta {
+		fmt.Fprint(&command, " --delta")
+	}
+	if cfg.Sign != "" {
+		fmt.Fprint(&command, " --sign ", cfg.Sign)
+	}
+	if cfg.DuckDB != "" {
+		fmt.Fprint(&command, " --duckdb ", cfg.DuckDB)
+		fmt.Fprint(&command, " --duckdbPath ", cfg.DuckDBPath)
+	}
+	if cfg.Cluster {
+		fmt.Fprint(&command, " --cluster")
+		fmt.Fprint(&command, " --mclPath ", cfg.MclPath)
+		fmt.Fprint(&command, " --clusterGranularities ", cfg.ClusterGranularities)
+		if cfg.MclLimits != "" {
+			fmt.Fprint(&command, " --mclLimits ", cfg.MclLimits)
+		}
+		if cfg.AbcFile {
+			fmt.Fprint(&command, " --abcFile")
+		}
+		if cfg.SkipDiskCheck {
+			fmt.Fprint(&command, " --skipDiskCheck")
+		}
+		if cfg.Scorer != "" {
+			fmt.Fprint(&command, " --scorer ", cfg.Scorer)
+		}
+		if cfg.SimilarityFile != "" {
+			fmt.Fprint(&command, " --similarities ", cfg.SimilarityFile)
+		}
+		if cfg.Clusterer != "" {
+			fmt.Fprint(&command, " --clusterer ", cfg.Clusterer)
+		}
+		fmt.Fprint(&command, " --similarity ", cfg.Similarity)
+		if cfg.CodeHierarchy != "" {
+			fmt.Fprint(&command, " --codeHierarchy ", cfg.CodeHierarchy)
+		}
+		if cfg.Embeddings != "" {
+			fmt.Fprint(&command, " --embeddings ", cfg.Embeddings)
+		}
+		if cfg.MinClusterSize > 0 {
+			fmt.Fprint(&command, " --minClusterSize ", cfg.MinClusterSize)
+		}
+		if cfg.MaxClusterSize > 0 {
+			fmt.Fprint(&command, " --maxClusterSize ", cfg.MaxClusterSize)
+		}
+		if cfg.SoftClusters > 0 {
+			fmt.Fprint(&command, " --softClusters ", cfg.SoftClusters)
+		}
+		if cfg.TemporalWeight > 0 {
+			fmt.Fprint(&command, " --temporalWeight ", cfg.TemporalWeight)
+		}
+		if cfg.PatientWeight > 0 {
+			fmt.Fprint(&command, " --patientWeight ", cfg.PatientWeight)
+		}
+		if cfg.SplitGraphs {
+			fmt.Fprint(&command, " --splitGraphs")
+		}
+		if cfg.BundleEdges {
+			fmt.Fprint(&command, " --bundleEdges")
+		}
+		if cfg.GraphML {
+			fmt.Fprint(&command, " --graphml --graphmlThreshold ", cfg.GraphMLThreshold)
+		}
+		if cfg.SimilarityMatrix != "" {
+			fmt.Fprint(&command, " --similarityMatrix ", cfg.SimilarityMatrix)
+		}
+		if cfg.MinSimilarity > 0 {
+			fmt.Fprint(&command, " --minSimilarity ", cfg.MinSimilarity)
+		}
+		if cfg.NullPercentile > 0 {
+			fmt.Fprint(&command, " --nullPercentile ", cfg.NullPercentile)
+		}
+		if cfg.LSH != "" {
+			fmt.Fprint(&command, " --lsh ", cfg.LSH)
+		}
+		if cfg.Threads > 0 {
+			fmt.Fprint(&command, " --threads ", cfg.Threads)
+		}
+		if cfg.SimilarityCache != "" {
+			fmt.Fprint(&command, " --similarityCache ", cfg.SimilarityCache)
+		}
+		if cfg.CheckpointDir != "" {
+			fmt.Fprint(&command, " --similarityCheckpoints ", cfg.CheckpointDir)
+		}
+		fmt.Fprint(&command, " --bootstrap ", cfg.Bootstrap)
+		if cfg.Figures > 0 {
+			fmt.Fprint(&command, " --figures ", cfg.Figures)
+		}
+		if cfg.OMOPConcepts != "" {
+			fmt.Fprint(&command, " --omopConcepts ", cfg.OMOPConcepts)
+		}
+		if cfg.ClusterNames != "" {
+			fmt.Fprint(&command, " --clusterNames ", cfg.ClusterNames)
+		}
+	}
+	fmt.Fprint(&command, " --pfilters ", cfg.Pfilters)
+	fmt.Fprint(&command, " --tfilters ", cfg.Tfilters)
+	if cfg.NrOfThreads > 0 {
+		fmt.Fprint(&command, " --nrOfThreads ", cfg.NrOfThreads)
+	}
+	return command.String()
+}
+
+// rrDenominator returns the denominator of the relative risk ratios. Configurations saved by earlier versions of ptra
+// do not have one, and used the numbers of patients.
+func (cfg *config) rrDenominator() string {
+	if cfg.RRDenominator == "" {
+		return trajectory.RRCount
+	}
+	return cfg.RRDenominator
+}
+
+// setBackends sets the backends of the random generators and the statistical tests. Configurations saved by earlier
+// versions of ptra do not have them, and used the reference backends.
+func (cfg *config) setBackends() {
+	rng, statistics := cfg.RNG, cfg.Statistics
+	if rng == "" {
+		rng = utils.ReferenceBackend
+	}
+	if statistics == "" {
+		statistics = utils.ReferenceBackend
+	}
+	randomBackend, err := utils.RandomBackendByName(rng)
+	if err != nil {
+		log.Panic(err)
+	}
+	statisticsBackend, err := utils.StatisticsBackendByName(statistics)
+	if err != nil {
+		log.Panic(err)
+	}
+	utils.SetRandomBackend(randomBackend)
+	utils.SetStatisticsBackend(statisticsBackend)
+}
+
+// clusterGranularityList parses the comma-separated cluster granularities.
+func (cfg *config) clusterGranularityList() []int {
+	var clusterGranularityList []int
+	for _, g := range strings.Split(cfg.ClusterGranularities, ",") {
+		gi, _ := strconv.ParseInt(g, 10, 0)
+		clusterGranularityList = append(clusterGranularityList, int(gi))
+	}
+	return clusterGranularityList
+}
+
+// eraWindow parses the window and step in years of --eras.
+func (cfg *config) eraWindow() (int, int) {
+	values := strings.Split(cfg.Eras, ",")
+	if len(values) != 2 {
+		log.Panic(fmt.Sprintf("Invalid eras, expected window,step: %s", cfg.Eras))
+	}
+	window, err := strconv.Atoi(values[0])
+	if err != nil {
+		log.Panic(fmt.Sprintf("Invalid eras %s: %v", cfg.Eras, err))
+	}
+	step, err := strconv.Atoi(values[1])
+	if err != nil {
+		log.Panic(fmt.Sprintf("Invalid eras %s: %v", cfg.Eras, err))
+	}
+	return window, step
+}
+
+// lshBands returns the number of bands and rows per band of --lsh.
+func (cfg *config) lshBands() (int, int) {
+	values := strings.Split(cfg.LSH, ",")
+	if len(values) != 2 {
+		log.Panic(fmt.Sprintf("Invalid lsh, expected bands,rows: %s", cfg.LSH))
+	}
+	bands, err := strconv.Atoi(values[0])
+	if err != nil || bands <= 0 {
+		log.Panic(fmt.Sprintf("Invalid lsh %s, expected a positive number of bands", cfg.LSH))
+	}
+	rows, err := strconv.Atoi(values[1])
+	if err != nil || rows <= 0 {
+		log.Panic(fmt.Sprintf("Invalid lsh %s, expected a positive number of rows", cfg.LSH))
+	}
+	return bands, rows
+}
+
+// discoverEraTrajectories repeats the trajectory discovery of a run for the patients in sliding calendar windows, cf.
+// --eras, and writes the evolution of the trajectories over the eras.
+func discoverEraTrajectories(cfg *config, exp *trajectory.Experiment, patients *trajectory.PatientMap) {
+	window, step := cfg.eraWindow()
+	eras := trajectory.SlidingEras(patients, window, step)
+	exps := []*trajectory.Experiment{}
+	for _, era := range eras {
+		utils.StartStage(fmt.Sprint("Discovering trajectories in era ", era), 0)
+		eraExp, _ := trajectory.EraExperiment(exp, patients, era)
+		trajectory.InitializeRelativeRiskRatiosAndPairs(eraExp, cfg.MinYears, cfg.MaxYears, cfg.Iter,
+			cfg.rrDenominator(), cfg.MinPatients, cfg.RR, true)
+		eraExp.Cohorts = nil
+		eraExp.DPatients = nil
+		buildTrajectories := trajectory.BuildTrajectories
+		if cfg.ChunkByChapter {
+			buildTrajectories = trajectory.BuildTrajectoriesByChapter
+		}
+		buildTrajectories(eraExp, cfg.MinPatients, cfg.MaxTrajectoryLength, cfg.MinTrajectoryLength, cfg.MinYears,
+			cfg.MaxYears, cfg.RR, getTrajectoryFilters(cfg.Tfilters, eraExp))
+		trajectory.CapPatientContributions(eraExp, cfg.MaxPerPatient, cfg.MinPatients)
+		eraExp.DxDPatients = nil
+		utils.Info("Era ", era, ": ", len(eraExp.Trajectories), " trajectories.")
+		exps = append(exps, eraExp)
+	}
+	evolutions := trajectory.EraEvolution(exps)
+	trajectory.PrintEraEvolutionToCSVFile(exp, eras, evolutions, filepath.Join(cfg.OutputPath,
+		fmt.Sprintf("%s-era-evolution.csv", exp.Name)))
+	trajectory.PrintEraEvolutionToJSONFile(exp, eras, exps, evolutions, filepath.Join(cfg.OutputPath,
+		fmt.Sprintf("%s-era-evolution.json", exp.Name)))
+}
+
+// discoverEOIStrataTrajectories repeats the trajectory discovery of a run for the patients that reach the event of
+// interest early and late, cf. --eoiStrata, and writes the trajectories of both strata and their comparison.
+func discoverEOIStrataTrajectories(cfg *config, exp *trajectory.Experiment, patients *trajectory.PatientMap) {
+	early, late := trajectory.EOIStrata(patients, cfg.EOIStrata)
+	utils.Info("EOI strata: ", len(early), " patients with an early event of interest, ", len(late),
+		" patients with a late event of interest.")
+	exps := map[string]*trajectory.Experiment{}
+	stratumPatients := map[string]*trajectory.PatientMap{}
+	for _, stratum := range []string{trajectory.EarlyEOI, trajectory.LateEOI} {
+		utils.StartStage(fmt.Sprint("Discovering trajectories in the ", stratum, " EOI stratum"), 0)
+		pids := early
+		if stratum == trajectory.LateEOI {
+			pids = late
+		}
+		stratumExp, ps := trajectory.StratumExperiment(exp, patients, stratum, pids)
+		trajectory.InitializeRelativeRiskRatiosAndPairs(stratumExp, cfg.MinYears, cfg.MaxYears, cfg.Iter,
+			cfg.rrDenominator(), cfg.MinPatients, cfg.RR, true)
+		stratumExp.Cohorts = nil
+		stratumExp.DPatients = nil
+		buildTrajectories := trajectory.BuildTrajectories
+		if cfg.ChunkByChapter {
+			buildTrajectories = trajectory.BuildTrajectoriesByChapter
+		}
+		buildTrajectories(stratumExp, cfg.MinPatients, cfg.MaxTrajectoryLength, cfg.MinTrajectoryLength,
+			cfg.MinYears, cfg.MaxYears, cfg.RR, getTrajectoryFilters(cfg.Tfilters, stratumExp))
+		trajectory.CapPatientContributions(stratumExp, cfg.MaxPerPatient, cfg.MinPatients)
+		stratumExp.DxDPatients = nil
+		utils.Info("EOI stratum ", stratum, ": ", len(stratumExp.Trajectories), " trajectories.")
+		trajectory.PrintTrajectoriesToFile(stratumExp, cfg.OutputPath)
+		exps[stratum], stratumPatients[stratum] = stratumExp, ps
+	}
+	comparisons := trajectory.CompareEOIStrata(exps[trajectory.EarlyEOI], exps[trajectory.LateEOI],
+		stratumPatients[trajectory.EarlyEOI], stratumPatients[trajectory.LateEOI])
+	trajectory.PrintEOIStrataComparisonToCSVFile(exp, comparisons, filepath.Join(cfg.OutputPath,
+		fmt.Sprintf("%s-eoi-strata.csv", exp.Name)))
+}
+
+// runPipeline executes a ptra run for the given configuration and returns the resulting experiment. If the clustering
+// fails, the other outputs are still written, and the error is returned, so that the command can exit with a failure.
+func runPipeline(cfg *config) (*trajectory.Experiment, error) {
+	// create output directory
+	err := os.MkdirAll(filepath.Dir(cfg.OutputPath), 0700)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.NrOfThreads > 0 {
+		runtime.GOMAXPROCS(cfg.NrOfThreads)
+	}
+	cfg.setBackends()
+	if cfg.Delta {
+		if err := utils.StartDelta(manifestFileName(cfg)); err != nil {
+			log.Panic(err)
+		}
+	}
+	// start execution
+	utils.Info(programMessage())
+	utils.Info("Executing command:\n", cfg.command())
+	saveConfig(cfg, configFileName(cfg))
+	//1. Parse inputs into experiment
+	// Parse Tumor info
+	utils.StartStage("Parsing input", 0)
+	tinfo := map[string][]*app.TumorInfo{} // filterInfo is a variable to pass around filter-specific information. E.g. parsed tumor data for the tumor stage filter.
+	if cfg.TumorInfo != "" {
+		tinfo = app.ParsetTriNetXTumorData(cfg.TumorInfo) // need parsed patients to be able to parse tumor data file
+	}
+	var biomarkers *trajectory.Biomarkers
+	if cfg.Biomarkers != "" {
+		if biomarkers, err = trajectory.ReadBiomarkers(cfg.Biomarkers); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Parsed ", len(biomarkers.Names), " biomarkers for ", len(biomarkers.Values), " patients.")
+	}
+	var literature []*trajectory.KnownTrajectory
+	if cfg.Literature != "" {
+		if literature, err = trajectory.ReadLiterature(cfg.Literature); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Parsed ", len(literature), " known trajectories.")
+	}
+	var omopConcepts trajectory.OMOPConcepts
+	if cfg.Cluster && cfg.OMOPConcepts != "" {
+		if omopConcepts, err = trajectory.ReadOMOPConcepts(cfg.OMOPConcepts); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Parsed ", len(omopConcepts), " OMOP concepts.")
+	}
+	var clusterNames trajectory.ClusterNames
+	if cfg.Cluster && cfg.ClusterNames != "" {
+		if clusterNames, err = trajectory.ReadClusterNames(cfg.ClusterNames); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Parsed ", len(clusterNames), " named clusters.")
+	}
+	var review trajectory.Review
+	if cfg.Review != "" {
+		if review, err = trajectory.ReadReview(cfg.Review); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Parsed ", len(review), " reviewed trajectories.")
+	}
+	exp, patients := app.ParseTriNetXData("exp1", cfg.PatientInfo, cfg.PatientDiagnoses, cfg.DiagnosisInfo, cfg.Grouper,
+		cfg.TreatmentInfo, cfg.NofAgeGroups, cfg.Lvl, cfg.MinYears, cfg.MaxYears, cfg.ICD9ToICD10File,
+		cfg.ICD10BaseCodes, getPatientFilters(cfg.Pfilters, tinfo, biomarkers), cfg.CodeValidity, cfg.MaxGap,
+		cfg.Bundles)
+	exp.MaxTrajectories = cfg.MaxTrajectories
+	exp.IncidentLookback = cfg.IncidentLookback
+	if cfg.Cluster {
+		// refuse to start the expensive stages without enough disk space for the clustering, which is checked again
+		// once the number of trajectories is known
+		options := cluster.Options{Granularities: cfg.clusterGranularityList(), AbcFile: cfg.AbcFile,
+			Similarity: cfg.Similarity, SkipDiskCheck: cfg.SkipDiskCheck,
+			Native: cfg.Clusterer == cluster.NativeClusterer}
+		if err := cluster.PreflightDiskSpace(cfg.OutputPath, cfg.MaxTrajectories, exp.PatientCtr, &options); err != nil {
+			log.Panic(err)
+		}
+		cfg.AbcFile = options.AbcFile
+	}
+	if cfg.CodeHierarchy != "" {
+		parents, err := trajectory.ReadCodeHierarchy(cfg.CodeHierarchy)
+		if err != nil {
+			log.Panic(err)
+		}
+		if err := trajectory.ApplyCodeHierarchy(exp, parents); err != nil {
+			log.Panic(fmt.Sprintf("%s: %v", cfg.CodeHierarchy, err))
+		}
+		utils.Info("Parsed a code hierarchy of ", len(parents), " codes.")
+	}
+	if cfg.Embeddings != "" {
+		embeddings, err := trajectory.ReadEmbeddings(cfg.Embeddings)
+		if err != nil {
+			log.Panic(err)
+		}
+		n := trajectory.ApplyEmbeddings(exp, embeddings)
+		utils.Info("Parsed the embeddings of ", len(embeddings), " codes, of which ", n, " diagnoses have an embedding.")
+		if n == 0 {
+			utils.Warning("none of the diagnosis codes have an embedding in ", cfg.Embeddings)
+		}
+	}
+	if cfg.ExcludeTransitions != "" {
+		transitions, err := trajectory.ReadExcludedTransitions(cfg.ExcludeTransitions)
+		if err != nil {
+			log.Panic(err)
+		}
+		trajectory.ExcludeTransitions(exp, transitions, cfg.MinYears, cfg.MaxYears)
+		trajectory.PrintExcludedTransitionsToCSVFile(exp, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-excluded-transitions.csv", exp.Name)))
+	}
+	// the localized descriptions replace the names before the terminology server fills in the missing ones
+	if cfg.Descriptions != "" {
+		descriptions, err := app.ReadDescriptions(cfg.Descriptions)
+		if err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Localized ", app.LocalizeNames(descriptions, exp.NameMap, exp.IdMap, exp.Hierarchy),
+			" diagnosis names with ", cfg.Descriptions)
+	}
+	if cfg.Messages != "" {
+		messages, err := trajectory.ReadMessages(cfg.Messages)
+		if err != nil {
+			log.Panic(err)
+		}
+		exp.Messages = messages
+	}
+	if cfg.TerminologyServer != "" {
+		client, err := app.NewTerminologyClient(cfg.TerminologyServer, cfg.TerminologySystem, cfg.TerminologyCache)
+		if err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Resolved ", app.ResolveNames(client, exp.NameMap, exp.IdMap, exp.Hierarchy),
+			" diagnosis names with ", cfg.TerminologyServer)
+	}
+	trajectory.PrintExclusionsToCSVFile(patients.Exclusions, filepath.Join(cfg.OutputPath,
+		fmt.Sprintf("%s-exclusions.csv", exp.Name)))
+	trajectory.PrintDiagnosisIDsToCSVFile(exp, filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-diagnosis-ids.csv",
+		exp.Name)))
+	var cases map[int]bool // the case cohort for comparing trajectories, if any
+	if cfg.CompareCohort != "" {
+		cases = trajectory.CaseCohort(patients, getPatientFilters(cfg.CompareCohort, tinfo, biomarkers))
+		utils.Info("Case cohort: ", len(cases), " patients, comparator cohort: ", len(patients.PIDMap)-len(cases),
+			" patients.")
+	}
+	var standardization *trajectory.Standardization // the reference population for standardizing the support, if any
+	if cfg.Standardize != "" {
+		strata, err := trajectory.ReadReferencePopulation(cfg.Standardize)
+		if err != nil {
+			log.Panic(err)
+		}
+		standardization = trajectory.NewStandardization(strata, patients)
+	}
+	//2. Initialise relative risk ratios or load them from file from a previous run
+	// an early checkpoint can be requested, e.g. from the terminal UI, until the relative risk ratios are computed
+	checkpoints := utils.CheckpointsAllowed() && cfg.LoadRR == ""
+	utils.AllowCheckpoints(checkpoints)
+	if cfg.LoadRR != "" {
+		utils.StartStage("Loading relative risk ratios", 0)
+		trajectory.LoadRRMatrix(exp, cfg.LoadRR)
+		trajectory.LoadDxDPatients(exp, patients, fmt.Sprintf("%s.patients.csv", cfg.LoadRR))
+	} else {
+		// the diagnosis pairs are selected while the relative risk ratios are computed, and the patients of the pairs
+		// that are not selected are released, unless they need to be saved, also in an early checkpoint, so that the
+		// run can be resumed with other selection thresholds
+		trajectory.InitializeRelativeRiskRatiosAndPairs(exp, cfg.MinYears, cfg.MaxYears, cfg.Iter,
+			cfg.rrDenominator(), cfg.MinPatients, cfg.RR, cfg.SaveRR == "" && !checkpoints)
+	}
+	if cfg.SaveRR != "" { //save RR matrix to file + DPatients
+		trajectory.SaveRRMatrix(exp, cfg.SaveRR)
+		trajectory.SaveDxDPatients(exp, fmt.Sprintf("%s.patients.csv", cfg.SaveRR))
+	}
+	if utils.CheckpointRequested() {
+		// the run can be resumed from the checkpoint with --loadRR
+		trajectory.SaveRRMatrix(exp, checkpointFileName(cfg))
+		trajectory.SaveDxDPatients(exp, fmt.Sprintf("%s.patients.csv", checkpointFileName(cfg)))
+		utils.Info("Wrote a checkpoint of the relative risk ratios to ", checkpointFileName(cfg))
+	}
+	// the later stages write their outputs as soon as they are done
+	utils.AllowCheckpoints(false)
+	// assist the gc and nil some exp data that is no longer needed after initializing RR, unless the sex-specific
+	// relative risk ratios still need to be computed
+	sexSpecific := cfg.SexSpecific || cfg.SexSplitEdges
+	if !sexSpecific {
+		exp.Cohorts = nil
+		exp.DPatients = nil
+	}
+	//3. Build the trajectories
+	buildTrajectories := trajectory.BuildTrajectories
+	if cfg.ChunkByChapter {
+		buildTrajectories = trajectory.BuildTrajectoriesByChapter
+	}
+	buildTrajectories(exp, cfg.MinPatients, cfg.MaxTrajectoryLength, cfg.MinTrajectoryLength, cfg.MinYears,
+		cfg.MaxYears, cfg.RR, getTrajectoryFilters(cfg.Tfilters, exp))
+	//4. Plot trajectories to file
+	utils.StartStage("Writing trajectories", 0)
+	// the review sheet has all trajectories, so that the decisions can be revised
+	trajectory.PrintReviewSheetToCSVFile(exp, review, filepath.Join(cfg.OutputPath,
+		fmt.Sprintf("%s-trajectories-review.csv", exp.Name)))
+	if review != nil {
+		if err := trajectory.ApplyReview(exp, review); err != nil {
+			log.Panic(err)
+		}
+	}
+	trajectory.CapPatientContributions(exp, cfg.MaxPerPatient, cfg.MinPatients)
+	trajectory.PrintTrajectoriesToFile(exp, cfg.OutputPath)
+	trajectory.PrintCoverageToFile(exp, cfg.OutputPath)
+	if exp.IndexCases != nil {
+		trajectory.PrintIndexCasesToCSVFile(exp, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-index-cases.csv", exp.Name)))
+	}
+	metadata := map[string]string{"program": programMessage(), "command": cfg.command()}
+	if err := trajectory.WritePtraFile(filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-trajectories.ptra", exp.Name)),
+		exp, false, metadata); err != nil {
+		log.Panic(err)
+	}
+	utils.Detail("Collected trajectories: ")
+	for i := 0; i < utils.Min(len(exp.Trajectories), 100); i++ {
+		trajectory.PrintTrajectory(exp.Trajectories[i], exp)
+	}
+	if cases != nil {
+		comparisons := trajectory.CompareCohorts(exp, cases, len(cases), len(patients.PIDMap)-len(cases))
+		trajectory.PrintCohortComparisonToCSVFile(exp, comparisons, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-cohort-comparison.csv", exp.Name)))
+		trajectory.PrintCohortComparisonGraphToFile(exp, comparisons, 0.05, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-cohort-comparison.gml", exp.Name)))
+	}
+	if sexSpecific {
+		transitions := trajectory.SexSpecificRelativeRiskRatios(exp, cfg.MinYears, cfg.MaxYears, cfg.Iter,
+			cfg.rrDenominator())
+		exp.Cohorts = nil
+		exp.DPatients = nil
+		trajectory.PrintSexSpecificTransitionsToCSVFile(exp, transitions, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-transitions-by-sex.csv", exp.Name)))
+		if cfg.SexSplitEdges {
+			trajectory.PrintSexSpecificGraphToFile(exp, transitions, filepath.Join(cfg.OutputPath,
+				fmt.Sprintf("%s-trajectories-by-sex.gml", exp.Name)))
+		}
+	}
+	if biomarkers != nil {
+		trajectory.PrintBiomarkerEnrichmentToCSVFile(exp, trajectory.BiomarkerEnrichments(exp, biomarkers, patients),
+			filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-biomarker-enrichment.csv", exp.Name)))
+	}
+	if literature != nil {
+		trajectory.AnnotateLiterature(exp, literature)
+		trajectory.PrintLiteratureToCSVFile(exp.Trajectories, exp.NameMap, exp.Literature,
+			filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-trajectories-literature.csv", exp.Name)))
+		trajectory.PrintLiteratureReplicationToCSVFile(literature, exp.Literature,
+			filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-literature-replication.csv", exp.Name)))
+	}
+	if standardization != nil {
+		trajectory.PrintStandardizedSupportToCSVFile(exp, standardization, filepath.Join(cfg.OutputPath,
+			fmt.Sprintf("%s-trajectories-standardized.csv", exp.Name)))
+	}
+	if cfg.Eras != "" {
+		discoverEraTrajectories(cfg, exp, patients)
+	}
+	if cfg.EOIStrata > 0 {
+		discoverEOIStrataTrajectories(cfg, exp, patients)
+	}
+	//5. Perform clustering
+	var clusteringErr error
+	if cfg.Cluster {
+		utils.Info("MCL Clustering:")
+		options := cluster.Options{Granularities: cfg.clusterGranularityList(), MclPath: cfg.MclPath,
+			AbcFile: cfg.AbcFile, ScorerPath: cfg.Scorer, Similarity: cfg.Similarity, SimilarityFile: cfg.SimilarityFile,
+			SoftThreshold: cfg.SoftClusters, SplitGraphs: cfg.SplitGraphs, BundleEdges: cfg.BundleEdges,
+			GraphML: cfg.GraphML, GraphThreshold: cfg.GraphMLThreshold, MinSimilarity: cfg.MinSimilarity,
+			MinClusterSize: cfg.MinClusterSize, MaxClusterSize: cfg.MaxClusterSize, Threads: cfg.Threads,
+			BootstrapRuns: cfg.Bootstrap, Figures: cfg.Figures, TemporalWeight: cfg.TemporalWeight,
+			PatientWeight: cfg.PatientWeight, SkipDiskCheck: cfg.SkipDiskCheck, NullPercentile: cfg.NullPercentile,
+			Metadata: metadata, OMOPConcepts: omopConcepts, ClusterNames: clusterNames, CacheDir: cfg.SimilarityCache,
+			CheckpointDir: cfg.CheckpointDir}
+		mclLimits, err := cluster.ParseMclLimits(cfg.MclLimits)
+		if err != nil {
+			log.Panic(err)
+		}
+		options.MclLimits = mclLimits
+		if options.MatrixFormats, err = cluster.ParseMatrixFormats(cfg.SimilarityMatrix); err != nil {
+			log.Panic(err)
+		}
+		if cfg.LSH != "" {
+			options.LSHBands, options.LSHRows = cfg.lshBands()
+		}
+		if cfg.Clusterer == cluster.NativeClusterer {
+			options.Native = true
+		} else if cfg.Clusterer != "" {
+			clusterer, err := cluster.LoadClusterer(cfg.Clusterer)
+			if err != nil {
+				log.Panic(err)
+			}
+			options.Clusterer = clusterer
+		}
+		//ClusterTrajectories(exp, cfg.OutputPath, options)
+		if err := cluster.ClusterTrajectoriesDirectly(exp, cfg.OutputPath, options); err != nil {
+			// the trajectories are still valid, so report the failure and finish the run
+			log.Println("Error: clustering failed: ", err)
+			clusteringErr = fmt.Errorf("clustering failed: %v", err)
+		}
+	}
+	//6. Load the results into a DuckDB database
+	if cfg.DuckDB != "" {
+		utils.StartStage("Writing the DuckDB database", 0)
+		if err := loadDuckDB(cfg.DuckDBPath, cfg.DuckDB, ptraResultFiles(cfg.OutputPath, exp.Name)); err != nil {
+			// the results are still valid, so report the failure and finish the run
+			log.Println("Error: writing the DuckDB database failed: ", err)
+		}
+	}
+	utils.FinishStages()
+	if crossChecked, ok := utils.Stats().(*utils.CrossCheckedStatistics); ok {
+		utils.Info("Cross-checked ", crossChecked.Checks(), " statistical results, of which ",
+			crossChecked.Discrepancies(), " differ between the statistics backends.")
+	}
+	saveSnapshot(takeSnapshot(exp, cfg), snapshotFileName(cfg))
+	if cfg.Delta {
+		if err := utils.FinishDelta(manifestFileName(cfg), changelogFileName(cfg)); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Wrote the changes since the previous run to ", changelogFileName(cfg))
+	}
+	if cfg.Sign != "" {
+		if err := utils.SignOutputs(signatureFileName(cfg), cfg.Sign); err != nil {
+			log.Panic(err)
+		}
+		utils.Info("Signed the output files in ", signatureFileName(cfg))
+	}
+	return exp, clusteringErr
+}
+
+// addFlags adds the optional arguments of the ptra command for the fields of a config, with their defaults.
+func (cfg *config) addFlags(flags *flag.FlagSet) {
+	flags.IntVar(&cfg.NofAgeGroups, "nofAgeGroups", 6, "The population data is divided in cohorts in"+
 		"terms of age groups to calculate relative risk ratios of diagnosis pairs. This parameters configures how"+
 		"many age groups to use")
-	flags.IntVar(&nrOfThreads, "nrOfThreads", 0, "The number of threads ptra uses.")
-	flags.IntVar(&lvl, "lvl", 3, "Diagnosis codes are organised in a hierarchy of diagnosis "+
+	flags.IntVar(&cfg.NrOfThreads, "nrOfThreads", 0, "The number of threads ptra uses.")
+	flags.StringVar(&cfg.CompareCohort, "compareCohort", "", "A list of pfilters that select the case cohort for "+
+		"comparing the support for the trajectories with the other patients.")
+	flags.BoolVar(&cfg.SexSpecific, "sexSpecific", false, "Compute the relative risk ratios of the transitions of "+
+		"the trajectories separately for males and females.")
+	flags.BoolVar(&cfg.SexSplitEdges, "sexSplitEdges", false, "Write a graph of the trajectories with split male "+
+		"and female edges, implies --sexSpecific.")
+	flags.StringVar(&cfg.Standardize, "standardize", "", "A csv file with the age and sex structure of a reference "+
+		"population, to which the support for the trajectories is standardized.")
+	flags.StringVar(&cfg.Eras, "eras", "", "The window and step in years of the sliding calendar windows over which "+
+		"the trajectory discovery is repeated, e.g. 5,1.")
+	flags.Float64Var(&cfg.EOIStrata, "eoiStrata", 0, "The cutoff in years of the time to the event of interest "+
+		"between the early and late outcome strata, in which the trajectories are discovered separately.")
+	flags.BoolVar(&cfg.Delta, "delta", false, "Only rewrite the output files that changed since the previous run "+
+		"into the same output directory.")
+	flags.StringVar(&cfg.Sign, "sign", "", "A key file with a shared secret or an ed25519 private key, with which "+
+		"the hashes of the output files are signed at the end of the run.")
+	flags.StringVar(&cfg.DuckDB, "duckdb", "", "A DuckDB database file into which the results are loaded for "+
+		"querying with SQL.")
+	flags.StringVar(&cfg.DuckDBPath, "duckdbPath", "duckdb", "The path to the duckdb binary.")
+	flags.BoolVar(&cfg.ChunkByChapter, "chunkByChapter", false, "Build the trajectories chapter by chapter of "+
+		"their first diagnosis, to lower the peak memory usage.")
+	flags.IntVar(&cfg.MaxTrajectories, "maxTrajectories", 0, "The maximum number of highest scoring trajectories "+
+		"that are kept while building the trajectories, 0 for no maximum.")
+	flags.IntVar(&cfg.MaxPerPatient, "maxPerPatient", 0, "The maximum number of trajectories that a patient "+
+		"supports, 0 for no maximum.")
+	flags.Float64Var(&cfg.IncidentLookback, "incidentLookback", 0, "The number of years of records before the "+
+		"first diagnosis of a trajectory for a patient to be an incident index case, 0 to count all patients.")
+	flags.IntVar(&cfg.Lvl, "lvl", 3, "Diagnosis codes are organised in a hierarchy of diagnosis "+
 		"descriptors. The level says which descriptor in the hiearchy to use for trajectory building.")
-	flags.Float64Var(&maxYears, "maxYears", 5.0, "The maximum number of years between diagnosis "+
+	flags.StringVar(&cfg.Grouper, "grouper", "", "The grouper that maps the ICD10 codes onto diagnoses: icd10, "+
+		"ccsr, or phecode. By default, the grouper is derived from the diagnosisInfoFile.")
+	flags.Float64Var(&cfg.MaxYears, "maxYears", 5.0, "The maximum number of years between diagnosis "+
 		"A and B to consider the diagnosis pair A->B in a trajectory.")
-	flags.Float64Var(&minYears, "minYears", 0.5, "The minimum number of years between diagnisis "+
+	flags.Float64Var(&cfg.MinYears, "minYears", 0.5, "The minimum number of years between diagnisis "+
 		"A and B to consider the diagnosis pair A->B in a trajectory.")
-	flags.IntVar(&minPatients, "minPatients", 1000, "The minimum number of patients for the last "+
+	flags.IntVar(&cfg.MinPatients, "minPatients", 1000, "The minimum number of patients for the last "+
 		"diagnosis in a trajectory")
-	flags.IntVar(&maxTrajectoryLength, "maxTrajectoryLength", 5, "The maximum number of diagnoses"+
+	flags.IntVar(&cfg.MaxTrajectoryLength, "maxTrajectoryLength", 5, "The maximum number of diagnoses"+
 		" in a trajectory")
-	flags.IntVar(&minTrajectoryLength, "minTrajectoryLength", 3, "The minimum number of "+
+	flags.IntVar(&cfg.MinTrajectoryLength, "minTrajectoryLength", 3, "The minimum number of "+
 		"diagnoses in a trajectory")
-	flags.StringVar(&name, "name", "exp1", "The name of the run. This is used to generate the "+
+	flags.StringVar(&cfg.Name, "name", "exp1", "The name of the run. This is used to generate the "+
 		"names of the output files.")
-	flags.StringVar(&ICD9ToICD10File, "ICD9ToICD10File", "", "A json file that maps ICD9 to "+
+	flags.StringVar(&cfg.ICD9ToICD10File, "ICD9ToICD10File", "", "A json file that maps ICD9 to "+
 		"ICD10 codes.")
-	flags.BoolVar(&clust, "cluster", false, "Cluster the trajectories using MCL and output "+
+	flags.BoolVar(&cfg.ICD10BaseCodes, "icd10BaseCodes", false, "Map all ICD10 codes onto their WHO base "+
+		"codes, for combining cohorts that use different national modifications of ICD10.")
+	flags.StringVar(&cfg.CodeValidity, "codeValidity", "", "A file with the validity periods of the diagnosis "+
+		"codes, for only counting the person-time at risk during which a diagnosis could be recorded.")
+	flags.Float64Var(&cfg.MaxGap, "maxGap", 0, "The maximum number of years between two consecutive records "+
+		"of a patient, for dropping patients with long gaps in their follow-up. 0 means no maximum.")
+	flags.StringVar(&cfg.Bundles, "bundles", "", "A json file with diagnosis bundles, which combine several "+
+		"diagnoses into a single diagnosis in the trajectories.")
+	flags.StringVar(&cfg.Descriptions, "descriptions", "", "A csv file with localized descriptions of the codes, "+
+		"which replace the medical names of the diagnoses.")
+	flags.StringVar(&cfg.Messages, "messages", "", "A csv file with translations of the report texts, e.g. of "+
+		"the narratives.")
+	flags.StringVar(&cfg.TerminologyServer, "terminologyServer", "", "The base URL of a FHIR terminology server "+
+		"for looking up the names of diagnoses without a name in the vocabulary.")
+	flags.StringVar(&cfg.TerminologySystem, "terminologySystem", app.DefaultTerminologySystem, "The code system "+
+		"of the codes that are looked up on the terminology server.")
+	flags.StringVar(&cfg.TerminologyCache, "terminologyCache", app.DefaultTerminologyCacheFile(), "The file in "+
+		"which the names looked up on the terminology server are cached.")
+	flags.BoolVar(&cfg.Cluster, "cluster", false, "Cluster the trajectories using MCL and output "+
 		"the results")
-	flags.StringVar(&mclPath, "mclPath", "/usr/bin/mcl", "The path to the mcl binary.")
-	flags.StringVar(&clusterGranularities, "clusterGranularities", "40,60,80,100", "The "+
+	flags.StringVar(&cfg.MclPath, "mclPath", "/usr/bin/mcl", "The path to the mcl binary.")
+	flags.StringVar(&cfg.MclLimits, "mclLimits", "", "The resource limits of the MCL processes, e.g. "+
+		"nice=10,cpus=0-3,memory=8G, optionally per tool, e.g. mcl.memory=16G.")
+	flags.BoolVar(&cfg.AbcFile, "abcFile", false, "Write the trajectory similarities to an intermediate .abc file "+
+		"instead of streaming them into mcxload.")
+	flags.BoolVar(&cfg.SkipDiskCheck, "skipDiskCheck", false, "Start the clustering even if the estimated size of "+
+		"its intermediate files exceeds the free disk space.")
+	flags.StringVar(&cfg.Clusterer, "clusterer", "", "A JSON adapter config for an external clusterer that is "+
+		"used instead of mcl, e.g. Infomap, or native for the built-in MCL.")
+	flags.StringVar(&cfg.Scorer, "scorer", "", "An external executable that computes the trajectory "+
+		"similarities for clustering.")
+	flags.StringVar(&cfg.SimilarityFile, "similarities", "", "A file with pre-computed trajectory similarities "+
+		"for clustering, in abc or csv format.")
+	flags.StringVar(&cfg.Similarity, "similarity", cluster.JaccardSimilarity, "The trajectory similarity "+
+		"used for clustering: jaccard, semantic, overlap, dice, lcs, edit, dtw, rrjaccard, patients, hierarchy, "+
+		"bigram, embedding, or containment.")
+	flags.StringVar(&cfg.CodeHierarchy, "codeHierarchy", "", "A csv file that maps codes onto their parent codes, "+
+		"for the hierarchy similarity.")
+	flags.StringVar(&cfg.Embeddings, "embeddings", "", "A csv file with precomputed embeddings of the diagnosis "+
+		"codes, for the embedding similarity.")
+	flags.IntVar(&cfg.MinClusterSize, "minClusterSize", 0, "Merge clusters with fewer trajectories into their "+
+		"nearest neighbor.")
+	flags.IntVar(&cfg.MaxClusterSize, "maxClusterSize", 0, "Re-cluster clusters with more trajectories at a "+
+		"higher inflation.")
+	flags.Float64Var(&cfg.SoftClusters, "softClusters", 0, "Soft clustering: trajectories also belong to other "+
+		"clusters for which their membership weight is at least this threshold.")
+	flags.Float64Var(&cfg.TemporalWeight, "temporalWeight", 0, "The weight of the rate of progression of the "+
+		"trajectories in the similarity used for clustering.")
+	flags.Float64Var(&cfg.PatientWeight, "patientWeight", 0, "The weight of the overlap of the patients of the "+
+		"trajectories in the similarity used for clustering.")
+	flags.BoolVar(&cfg.SplitGraphs, "splitGraphs", false, "Write the graph of each cluster to its own GML file "+
+		"instead of concatenating all cluster graphs in one GML file.")
+	flags.BoolVar(&cfg.BundleEdges, "bundleEdges", false, "Write one edge per transition in the cluster graphs "+
+		"instead of one edge per trajectory in which the transition occurs.")
+	flags.BoolVar(&cfg.GraphML, "graphml", false, "Also write the trajectory similarity graph that is clustered "+
+		"as a GraphML file.")
+	flags.Float64Var(&cfg.GraphMLThreshold, "graphmlThreshold", 0, "The similarity above which pairs of "+
+		"trajectories are edges in the GraphML similarity graph.")
+	flags.StringVar(&cfg.SimilarityMatrix, "similarityMatrix", "", "Also write the trajectory similarity matrix "+
+		"that is clustered in the given comma-separated formats, npy and/or parquet.")
+	flags.Float64Var(&cfg.MinSimilarity, "minSimilarity", 0, "The similarity above which pairs of trajectories "+
+		"are clustered, 0 to cluster all similarities.")
+	flags.Func("nullPercentile", "The percentile of a null model of shuffled trajectories above which "+
+		"similarities are clustered, e.g. 95, 0 for no null model.", func(s string) error {
+		percentile, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if percentile < 0 || percentile >= 100 {
+			return fmt.Errorf("expected a percentile between 0 and 100, got %s", s)
+		}
+		cfg.NullPercentile = percentile
+		return nil
+	})
+	flags.StringVar(&cfg.LSH, "lsh", "", "Only compute the similarities of the candidate pairs of MinHash "+
+		"locality-sensitive hashing with the given bands,rows, e.g. 20,5.")
+	flags.IntVar(&cfg.Threads, "threads", 0, "The number of threads that compute the trajectory similarities for "+
+		"the clustering, 0 for as many threads as ptra.")
+	flags.StringVar(&cfg.SimilarityCache, "similarityCache", "", "A directory in which the trajectory similarities "+
+		"are cached, for reusing them in later runs with the same trajectories.")
+	flags.StringVar(&cfg.CheckpointDir, "similarityCheckpoints", "", "A directory in which the trajectory "+
+		"similarities are checkpointed while they are computed, for resuming an interrupted run.")
+	flags.IntVar(&cfg.Bootstrap, "bootstrap", 1000, "The number of bootstrap runs for the confidence intervals of "+
+		"the cluster statistics.")
+	flags.IntVar(&cfg.Figures, "figures", 0, "The number of largest clusters for which to write a PDF figure bundle.")
+	flags.StringVar(&cfg.OMOPConcepts, "omopConcepts", "", "The CONCEPT table of the OMOP vocabularies, for "+
+		"writing the clusters as ATLAS cohort definitions.")
+	flags.StringVar(&cfg.ClusterNames, "clusterNames", "", "The naming sheet of the clusters of a previous run, "+
+		"whose cluster IDs and names are carried over to the matching clusters.")
+	flags.StringVar(&cfg.ClusterGranularities, "clusterGranularities", "40,60,80,100", "The "+
 		"granularities used for the mcl clustering step.") // recommended 14,20,40,60
-	flags.IntVar(&iter, "iter", 10000, "The minimum number of sampling iterations "+
+	flags.IntVar(&cfg.Iter, "iter", 10000, "The minimum number of sampling iterations "+
 		"diagnosis in a trajectory")
-	flags.Float64Var(&rr, "RR", 1.0, "The minimum RR score for considering pairs.")
-	flags.StringVar(&saveRR, "saveRR", "", "Save the RR matrix to a file so it can be loaded for "+
+	flags.StringVar(&cfg.RRDenominator, "rrDenominator", trajectory.RRPersonTime, "The denominators of the "+
+		"relative risk ratios: persontime for incidence rate ratios, or count for risk ratios.")
+	flags.StringVar(&cfg.RNG, "rng", utils.ReferenceBackend, "The random generators: reference, or alternate for "+
+		"validating the results.")
+	flags.StringVar(&cfg.Statistics, "statistics", utils.DefaultStatisticsBackend, "The implementation of the "+
+		"statistical tests: reference, alternate, or crosscheck to compare both.")
+	flags.Float64Var(&cfg.RR, "RR", 1.0, "The minimum RR score for considering pairs.")
+	flags.StringVar(&cfg.SaveRR, "saveRR", "", "Save the RR matrix to a file so it can be loaded for "+
 		"later runs")
-	flags.StringVar(&loadRR, "loadRR", "", "Load the RR matrix from a given file instead of "+
+	flags.StringVar(&cfg.LoadRR, "loadRR", "", "Load the RR matrix from a given file instead of "+
 		"calculating it from scratch.")
-	flags.StringVar(&pfilters, "pfilters", "id", "A list of pfilters to restrict analysis on specific "+
+	flags.StringVar(&cfg.Pfilters, "pfilters", "id", "A list of pfilters to restrict analysis on specific "+
 		"patients.")
-	flags.StringVar(&tumorInfo, "tumorInfo", "", "A file with information about the tumor stages.")
-	flags.StringVar(&treatmentInfo, "treatmentInfo", "", "A file with information about patient cancer stages.")
-	flags.StringVar(&tfilters, "tfilters", "id", "A list of pfilters to restrict output of trajectories")
-	// parse optional arguments
-	parseFlags(flags, 5, ptraHelp)
-	// parse required arguments
-	patientInfo = getFileName(os.Args[1], ptraHelp)
-	diagnosisInfo = getFileName(os.Args[2], ptraHelp)
-	patientDiagnoses = getFileName(os.Args[3], ptraHelp)
-	outputPath, _ = filepath.Abs(getFileName(os.Args[4], ptraHelp))
-	outputPath = outputPath + string(filepath.Separator)
-	fmt.Println("Output path: ", outputPath)
-	// create output directory
-	err := os.MkdirAll(filepath.Dir(outputPath), 0700)
-	if err != nil {
-		panic(err)
-	}
-	// build an output command line
-	var command bytes.Buffer
-	fmt.Fprint(&command, os.Args[0], " ", patientInfo, " ", diagnosisInfo, " ", patientDiagnoses,
-		" ", outputPath)
-	fmt.Fprint(&command, " --nofAgeGroups ", nofAgeGroups)
-	fmt.Fprint(&command, " --lvl ", lvl)
-	fmt.Fprint(&command, " --maxYears ", maxYears)
-	fmt.Fprint(&command, " --minYears ", minYears)
-	fmt.Fprint(&command, " --minPatients ", minPatients)
-	fmt.Fprint(&command, " --maxTrajectoryLength ", maxTrajectoryLength)
-	fmt.Fprint(&command, " --minTrajectoryLength ", minTrajectoryLength)
-	fmt.Fprint(&command, " --name ", name)
-	fmt.Fprint(&command, " --ICD9ToICD10File ", ICD9ToICD10File)
-	fmt.Fprint(&command, " --iter ", iter)
-	fmt.Fprint(&command, " --RR ", rr)
-	fmt.Fprint(&command, " --tumorInfo ", tumorInfo)
-	fmt.Fprint(&command, " --treatmentInfo ", treatmentInfo)
-	if saveRR != "" {
-		fmt.Fprint(&command, " --saveRR ", saveRR)
-	}
-	if loadRR != "" {
-		fmt.Fprint(&command, " --loadRR ", loadRR)
-	}
-	if clust {
-		fmt.Fprint(&command, " --cluster")
-		fmt.Fprint(&command, " --mclPath ", mclPath)
-		fmt.Fprint(&command, " --clusterGranularities ", clusterGranularities)
-	}
-	fmt.Fprint(&command, " --pfilters ", pfilters)
-	fmt.Fprint(&command, " --tfilters ", tfilters)
-	if nrOfThreads > 0 {
-		runtime.GOMAXPROCS(nrOfThreads)
-		fmt.Fprint(&command, " --nrOfThreads ", nrOfThreads)
+	flags.StringVar(&cfg.TumorInfo, "tumorInfo", "", "A file with information about the tumor stages.")
+	flags.StringVar(&cfg.Biomarkers, "biomarkers", "", "A file with biomarkers of the patients, for filtering "+
+		"patients and testing trajectories for biomarker enrichment.")
+	flags.StringVar(&cfg.Literature, "literature", "", "A file with known trajectories from the literature, for "+
+		"flagging which trajectories replicate known findings and which are novel.")
+	flags.StringVar(&cfg.ExcludeTransitions, "excludeTransitions", "", "A file with diagnosis transitions that are "+
+		"ignored when computing the relative risk ratios and building the trajectories.")
+	flags.StringVar(&cfg.Review, "review", "", "A review sheet with the clinicians' decisions to accept, reject, or "+
+		"merge trajectories.")
+	flags.StringVar(&cfg.TreatmentInfo, "treatmentInfo", "", "A file with information about patient cancer stages.")
+	flags.StringVar(&cfg.Tfilters, "tfilters", "id", "A list of pfilters to restrict output of trajectories")
+}
+
+// resolveFileNames checks the file names of a config and makes the ones that are passed to the clustering and the
+// external tools absolute, so that they do not depend on the working dir of the tools, and the saved configuration
+// can be rerun from another directory.
+func (cfg *config) resolveFileNames() {
+	if strings.ContainsRune(cfg.Scorer, filepath.Separator) {
+		// relative paths to the scorer must be resolved, but not the names of executables in the PATH
+		cfg.Scorer = absFileName(cfg.Scorer)
 	}
-	// start execution
-	log.Println(programMessage())
-	log.Println("Executing command:\n", command.String())
-	//1. Parse inputs into experiment
-	// Parse Tumor info
-	tinfo := map[string][]*app.TumorInfo{} // filterInfo is a variable to pass around filter-specific information. E.g. parsed tumor data for the tumor stage filter.
-	if tumorInfo != "" {
-		tinfo = app.ParsetTriNetXTumorData(tumorInfo) // need parsed patients to be able to parse tumor data file
+	if cfg.SimilarityFile != "" && cfg.Scorer != "" {
+		log.Panic("--similarities and --scorer cannot be combined")
 	}
-	exp, patients := app.ParseTriNetXData("exp1", patientInfo, patientDiagnoses, diagnosisInfo,
-		treatmentInfo, nofAgeGroups, lvl, minYears, maxYears, ICD9ToICD10File, getPatientFilters(pfilters, tinfo))
-	//2. Initialise relative risk ratios or load them from file from a previous run
-	if loadRR != "" {
-		trajectory.LoadRRMatrix(exp, loadRR)
-		trajectory.LoadDxDPatients(exp, patients, fmt.Sprintf("%s.patients.csv", loadRR))
-	} else {
-		trajectory.InitializeExperimentRelativeRiskRatios(exp, minYears, maxYears, iter)
+	cfg.SimilarityFile = absFileName(cfg.SimilarityFile)
+	// the same holds for the DuckDB database file
+	cfg.DuckDB = absFileName(cfg.DuckDB)
+	if strings.ContainsRune(cfg.DuckDBPath, filepath.Separator) {
+		cfg.DuckDBPath = absFileName(cfg.DuckDBPath)
 	}
-	if saveRR != "" { //save RR matrix to file + DPatients
-		trajectory.SaveRRMatrix(exp, saveRR)
-		trajectory.SaveDxDPatients(exp, fmt.Sprintf("%s.patients.csv", saveRR))
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve()
+			return
+		case "verify":
+			verify()
+			return
+		case "diff":
+			diff()
+			return
+		case "checksig":
+			checksig()
+			return
+		case "export":
+			export()
+			return
+		case "sql":
+			sql()
+			return
+		case "demo":
+			demo()
+			return
+		}
 	}
-	// assist the gc and nil some exp data that is no longer needed after initializing RR
-	exp.Cohorts = nil
-	exp.DPatients = nil
-	//3. Build the trajectories
-	trajectory.BuildTrajectories(exp, minPatients, maxTrajectoryLength, minTrajectoryLength, minYears, maxYears, rr,
-		getTrajectoryFilters(tfilters, exp))
-	//4. Plot trajectories to file
-	trajectory.PrintTrajectoriesToFile(exp, outputPath)
-	fmt.Println("Collected trajectories: ")
-	for i := 0; i < utils.MinInt(len(exp.Trajectories), 100); i++ {
-		trajectory.PrintTrajectory(exp.Trajectories[i], exp)
+	var (
+		cfg        config
+		statusAddr string
+		tui        bool
+		profiling  profiles
+	)
+	var flags flag.FlagSet
+	cfg.addFlags(&flags)
+	flags.StringVar(&statusAddr, "statusAddr", "", "Serve a status page with the progress of the run on this "+
+		"address, e.g. localhost:8081.")
+	flags.BoolVar(&tui, "tui", false, "Show a terminal UI with the progress of the run, with keys for adjusting the "+
+		"verbosity and requesting an early checkpoint.")
+	profiling.addFlags(&flags)
+	// parse optional arguments
+	parseFlags(flags, 5, ptraHelp)
+	// parse required arguments
+	cfg.PatientInfo = getFileName(os.Args[1], ptraHelp)
+	cfg.DiagnosisInfo = getFileName(os.Args[2], ptraHelp)
+	cfg.PatientDiagnoses = getFileName(os.Args[3], ptraHelp)
+	cfg.OutputPath, _ = filepath.Abs(getFileName(os.Args[4], ptraHelp))
+	cfg.OutputPath = cfg.OutputPath + string(filepath.Separator)
+	utils.Info("Output path: ", cfg.OutputPath)
+	stopProfiling := profiling.start(cfg.OutputPath)
+	defer stopProfiling()
+	stopTracing := utils.StartTracing("ptra", programMessage())
+	defer stopTracing()
+	cfg.resolveFileNames()
+	stopTUI := func() {}
+	if statusAddr != "" || tui {
+		logs := server.NewLogBuffer(200)
+		output := io.MultiWriter(os.Stderr, logs)
+		if tui {
+			// the terminal UI shows the recent log lines itself
+			output = logs
+		}
+		log.SetOutput(output)
+		utils.SetOutput(output)
+		if statusAddr != "" {
+			server.ServeStatus(statusAddr, logs)
+		}
+		if tui {
+			// the terminal UI can request an early checkpoint
+			utils.AllowCheckpoints(true)
+			stop, err := server.StartTUI(logs)
+			if err != nil {
+				log.Panic(err)
+			}
+			stopTUI = stop
+			defer stop()
+		}
 	}
-	//5. Perform clustering
-	if clust {
-		var clusterGranularityList []int
-		for _, g := range strings.Split(clusterGranularities, ",") {
-			gi, _ := strconv.ParseInt(g, 10, 0)
-			clusterGranularityList = append(clusterGranularityList, int(gi))
-		}
-		fmt.Println("MCL Clustering:")
-		//ClusterTrajectories(exp, clusterGranularityList, outputPath, mclPath)
-		cluster.ClusterTrajectoriesDirectly(exp, clusterGranularityList, outputPath, mclPath)
+	if _, err := runPipeline(&cfg); err != nil {
+		// the deferred functions do not run on exit
+		stopTUI()
+		stopTracing()
+		stopProfiling()
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,136 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+// outputHelp lists the flags for the verbosity of the messages that every ptra command accepts, cf. parseFlags.
+const outputHelp = "[--quiet]\n" +
+	"[--verbose]\n"
+
+const profileHelp = "[--cpuprofile file]\n" +
+	"[--memprofile file]\n" +
+	"[--trace file]\n"
+
+// profiles holds the profiling flags that every ptra command accepts. Users can attach the profiles to performance
+// issue reports, e.g. from secure environments where the issue cannot be reproduced.
+type profiles struct {
+	cpuProfile, memProfile, trace string
+}
+
+// addFlags adds the profiling flags to a flag set.
+func (p *profiles) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&p.cpuProfile, "cpuprofile", "", "Write a pprof CPU profile to this file.")
+	flags.StringVar(&p.memProfile, "memprofile", "", "Write a pprof heap profile to this file at the end of the run.")
+	flags.StringVar(&p.trace, "trace", "", "Write an execution trace to this file.")
+}
+
+// profileFileName resolves the name of a profile file. Relative names are relative to the output directory of the
+// command, so that the profiles end up next to the other outputs.
+func profileFileName(name, dir string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// createProfileFile creates a profile file, and the directory it is in.
+func createProfileFile(name string) *os.File {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		log.Panic(err)
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		log.Panic(err)
+	}
+	return file
+}
+
+// start starts the requested CPU profile and execution trace, with relative file names resolved in the given output
+// directory. It returns a function that stops them and writes the heap profile. This function may be called more than
+// once, e.g. before calling os.Exit. The profiles are also written when the command is interrupted, which is the only
+// way to stop ptra serve.
+func (p *profiles) start(dir string) func() {
+	if p.cpuProfile == "" && p.memProfile == "" && p.trace == "" {
+		return func() {}
+	}
+	var cpuFile, traceFile *os.File
+	if p.cpuProfile != "" {
+		cpuFile = createProfileFile(profileFileName(p.cpuProfile, dir))
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			log.Panic(err)
+		}
+	}
+	if p.trace != "" {
+		traceFile = createProfileFile(profileFileName(p.trace, dir))
+		if err := trace.Start(traceFile); err != nil {
+			log.Panic(err)
+		}
+	}
+	// the clustering changes the working directory, so the name of the heap profile must be resolved now
+	memProfile := ""
+	if p.memProfile != "" {
+		memProfile, _ = filepath.Abs(profileFileName(p.memProfile, dir))
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				closeProfileFile(cpuFile)
+			}
+			if traceFile != nil {
+				trace.Stop()
+				closeProfileFile(traceFile)
+			}
+			if memProfile != "" {
+				file := createProfileFile(memProfile)
+				runtime.GC() // get up-to-date statistics
+				if err := pprof.WriteHeapProfile(file); err != nil {
+					log.Panic(err)
+				}
+				closeProfileFile(file)
+			}
+		})
+	}
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		stop()
+		os.Exit(1)
+	}()
+	return stop
+}
+
+func closeProfileFile(file *os.File) {
+	if err := file.Close(); err != nil {
+		log.Panic(err)
+	}
+}
@@ -19,10 +19,44 @@
 package ptra_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"ptra/app"
+	"ptra/cluster"
+	"ptra/server"
 	"ptra/trajectory"
+	"ptra/utils"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 func TestParseIcd10XML(t *testing.T) {
@@ -63,7 +97,7 @@ func TestInitializeCohorts(t *testing.T) {
 	file3 := "./icd10cm_tabular_2022.xml"
 	level := 0
 	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(file3, level)
-	app.ParseTrinetXPatientDiagnoses(file2, "", patients, analysisMaps, map[string]string{})
+	app.ParseTrinetXPatientDiagnoses(file2, "", patients, analysisMaps, map[string]string{}, false)
 	nofDiagnosisCodes := analysisMaps.NofDiagnosisCodes
 	nofRegions := 1
 	cohorts := trajectory.InitializeCohorts(patients, nofCohortAges, nofRegions, nofDiagnosisCodes)
@@ -99,7 +133,7 @@ func TestParseTrinetXPatientDiagnoses(t *testing.T) {
 	file3 := "./icd10cm_tabular_2022.xml"
 	level := 0
 	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML(file3, level)
-	app.ParseTrinetXPatientDiagnoses(file2, "", patients, analysisMaps, map[string]string{})
+	app.ParseTrinetXPatientDiagnoses(file2, "", patients, analysisMaps, map[string]string{}, false)
 	fmt.Println("First 5 patients: ")
 	ctr := 0
 	for _, patient := range patients.PIDMap {
@@ -113,6 +147,76 @@ func TestParseTrinetXPatientDiagnoses(t *testing.T) {
 	}
 }
 
+func TestIcd10Modifications(t *testing.T) {
+	if base := app.Icd10WHOBaseCode("E11.65"); base != "E11.6" {
+		t.Errorf("WHO base code of E11.65: got %s, want E11.6", base)
+	}
+	if base := app.Icd10WHOBaseCode("e1190+"); base != "E11.9" {
+		t.Errorf("WHO base code of e1190+: got %s, want E11.9", base)
+	}
+	// E11.6x map onto the same analysis DID, E11.9 and E11.0 onto different ones
+	vocabulary := map[string]string{"E11.65": "1", "E11.69": "1", "E11.9": "2", "E11.0": "3"}
+	resolver := app.NewIcd10CodeResolver(vocabulary, false)
+	for _, test := range []struct {
+		system, code, want string
+		ok                 bool
+	}{
+		{"ICD-10-CM", "E11.65", "E11.65", true},
+		{"ICD-10-CM", "E11.6", "E11.6", false}, // ICD-10-CM codes are looked up as they are
+		{"ICD-10-GM", "E11.60", "E11.65", true},
+		{"ICD-10-GM", "E11.90 G", "E11.9", true},
+		{"ICD-10-AM", "E11.1", "E11.1", false}, // E11 is ambiguous
+	} {
+		got, ok := app.ResolveIcd10Code(resolver, test.system, test.code)
+		if got != test.want || ok != test.ok {
+			t.Errorf("resolving %s %s: got %s %v, want %s %v", test.system, test.code, got, ok, test.want, test.ok)
+		}
+	}
+	resolver = app.NewIcd10CodeResolver(vocabulary, true)
+	if got, ok := app.ResolveIcd10Code(resolver, "ICD-10-CM", "E11.69"); !ok || got != "E11.65" {
+		t.Errorf("resolving ICD-10-CM E11.69 to its base code: got %s %v, want E11.65 true", got, ok)
+	}
+}
+
+func TestPhecodeGrouper(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "phecodes.csv")
+	mapping := "icd10cm,icd10cm_str,phecode,phecode_str\n" +
+		"E11.10,Type 2 diabetes mellitus with ketoacidosis without coma,250.21,Type 2 diabetes with ketoacidosis\n" +
+		"E11.9,Type 2 diabetes mellitus without complications,250.2,Type 2 diabetes\n" +
+		"E10.9,Type 1 diabetes mellitus without complications,250.1,Type 1 diabetes\n" +
+		"R73.9,\"Hyperglycemia, unspecified\",250.4,Abnormal glucose\n"
+	if err := os.WriteFile(file, []byte(mapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if grouper := app.DiagnosisGrouper(file, ""); grouper != app.GrouperPhecode {
+		t.Fatalf("grouper: got %s, want %s", grouper, app.GrouperPhecode)
+	}
+	for _, test := range []struct {
+		level int
+		names []string // the names of E11.10, E11.9, and E10.9
+	}{
+		{0, []string{"Phecode 250", "Phecode 250", "Phecode 250"}},
+		{1, []string{"Type 2 diabetes", "Type 2 diabetes", "Type 1 diabetes"}},
+		{2, []string{"Type 2 diabetes with ketoacidosis", "Type 2 diabetes", "Type 1 diabetes"}},
+	} {
+		maps := app.InitializeIcd10AnalysisMapsFromPhecodes(file, test.level)
+		if _, ok := maps.DIDMap["R73.9"]; ok {
+			t.Errorf("level %d: R73.9 should be excluded from the analysis", test.level)
+		}
+		for i, code := range []string{"E11.10", "E11.9", "E10.9"} {
+			if dids := maps.DIDMap[code]; len(dids) != 1 || maps.NameMap[dids[0]] != test.names[i] {
+				t.Errorf("level %d: %s maps onto %v, want %s", test.level, code, dids, test.names[i])
+			}
+		}
+		// the codes that are added to the analysis get the last IDs, in the order of their codes in each run
+		for i, code := range []string{"C100", "C98", "C99"} {
+			if dids := maps.DIDMap[code]; len(dids) != 1 || dids[0] != maps.NofDiagnosisCodes-3+i {
+				t.Errorf("level %d: %s maps onto %v, want %d", test.level, code, dids, maps.NofDiagnosisCodes-3+i)
+			}
+		}
+	}
+}
+
 func TestInitCohortsWithFakePatients(t *testing.T) {
 	n := 100
 	patients := []*trajectory.Patient{}
@@ -256,7 +360,7 @@ func TestInitCohortsWithFakePatients(t *testing.T) {
 		Trajectories:      nil,
 	}
 	//initializeExperimentRelativeRiskRatios(exp, 0.5, 5.0)
-	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5.0, 10)
+	trajectory.InitializeExperimentRelativeRiskRatios(exp, 0.5, 5.0, 10, trajectory.RRPersonTime)
 	fmt.Println("Relative risk ratios: [")
 	for _, rr := range exp.DxDRR {
 		fmt.Print(rr, ", ")
@@ -278,4 +382,4306 @@ func TestInitCohortsWithFakePatients(t *testing.T) {
 	//Smoking -- 200 --> Drinking
 	//Smoking -- 200 --> Liver cancer
 	//Drinking -- 200 --> Liver cancer
+	exp.Hierarchy = map[int][]string{0: {"Lifestyle", "Smoking"}, 1: {"Neoplasms", "Lung cancer"},
+		2: {"Lifestyle", "Drinking"}, 3: {"Neoplasms", "Liver cancer"}}
+	chunked := trajectory.BuildTrajectoriesByChapter(exp, 5, 3, 2, 1, 5, 1.0, []trajectory.TrajectoryFilter{})
+	if len(chunked) != len(trajectories) {
+		t.Fatalf("expected %d trajectories when building by chapter, got %d", len(trajectories), len(chunked))
+	}
+	for i, traj := range chunked {
+		if !reflect.DeepEqual(traj.Diagnoses, trajectories[i].Diagnoses) ||
+			!reflect.DeepEqual(traj.PatientNumbers, trajectories[i].PatientNumbers) ||
+			!reflect.DeepEqual(traj.Patients, trajectories[i].Patients) {
+			t.Errorf("expected trajectory %d to be %v %v when building by chapter, got %v %v", i,
+				trajectories[i].Diagnoses, trajectories[i].PatientNumbers, traj.Diagnoses, traj.PatientNumbers)
+		}
+		if traj.TrajMap != nil {
+			t.Errorf("expected the patient indexes of trajectory %d to be released", i)
+		}
+	}
+}
+
+// makeFakeExperiment creates an experiment for patients with the given ids that are diagnosed with smoking followed by
+// lung cancer in the given year.
+func makeFakeExperiment(ids []int, year int) *trajectory.Experiment {
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*trajectory.Patient{}}
+	for _, id := range ids {
+		pMap.Ctr++
+		p := &trajectory.Patient{PID: pMap.Ctr, PIDString: fmt.Sprint(id), YOB: 1900 + id%100, Sex: id % 2}
+		d1 := &trajectory.Diagnosis{PID: p.PID, DID: 0, Date: trajectory.DiagnosisDate{Year: year, Month: 1, Day: 1}}
+		d2 := &trajectory.Diagnosis{PID: p.PID, DID: 1, Date: trajectory.DiagnosisDate{Year: year + 1, Month: 1, Day: 1}}
+		p.Diagnoses = []*trajectory.Diagnosis{d1, d2}
+		pMap.PIDMap[p.PID] = p
+		pMap.PIDStringMap[p.PIDString] = p.PID
+	}
+	trajectory.AssignCohortAges(pMap, 2)
+	cohorts := trajectory.InitializeCohorts(pMap, 2, 1, 2)
+	return &trajectory.Experiment{
+		NofAgeGroups:      2,
+		NofRegions:        1,
+		NofDiagnosisCodes: 2,
+		DxDRR:             trajectory.MakeDxDRR(2),
+		DxDPatients:       trajectory.MakeDxDPatients(2),
+		Cohorts:           cohorts,
+		Name:              "exp",
+		NameMap:           map[int]string{0: "Smoking", 1: "Lung cancer"},
+		IdMap:             map[int]string{0: "F17", 1: "C34"},
+	}
+}
+
+func TestMergeExperiments(t *testing.T) {
+	ids1, ids2 := []int{}, []int{}
+	for i := 0; i < 100; i++ {
+		ids1 = append(ids1, i)
+		ids2 = append(ids2, i+50)
+	}
+	exp1 := makeFakeExperiment(ids1, 2019)
+	exp2 := makeFakeExperiment(ids2, 2021)
+	merged, patients := trajectory.MergeExperiments(exp1, exp2, 0.5, 5.0, 10, trajectory.RRPersonTime)
+	if len(patients.PIDMap) != 150 {
+		t.Errorf("expected 150 merged patients, got %d", len(patients.PIDMap))
+	}
+	if len(merged.DPatients[0]) != 150 {
+		t.Errorf("expected 150 patients diagnosed with smoking, got %d", len(merged.DPatients[0]))
+	}
+	p, _ := trajectory.GetPatient("60", patients)
+	if len(p.Diagnoses) != 4 {
+		t.Errorf("expected the histories of patient 60 to be merged, got %d diagnoses", len(p.Diagnoses))
+	}
+	p, _ = trajectory.GetPatient("10", patients)
+	if len(p.Diagnoses) != 2 {
+		t.Errorf("expected 2 diagnoses for patient 10, got %d", len(p.Diagnoses))
+	}
+	// the diagnoses are matched on their codes, not on their names
+	exp2 = makeFakeExperiment(ids2, 2021)
+	exp2.NameMap = map[int]string{0: "Nicotine dependence", 1: "Smoking"}
+	exp2.IdMap = map[int]string{0: "F17", 1: "Z72.0"}
+	merged, _ = trajectory.MergeExperiments(exp1, exp2, 0.5, 5.0, 10, trajectory.RRPersonTime)
+	if merged.NofDiagnosisCodes != 3 || merged.IdMap[2] != "Z72.0" || merged.NameMap[0] != "Smoking" {
+		t.Errorf("expected the codes F17, C34 and Z72.0, got %v", merged.IdMap)
+	}
+	if len(merged.DPatients[0]) != 150 || len(merged.DPatients[2]) != 100 {
+		t.Errorf("expected 150 patients with F17 and 100 with Z72.0, got %d and %d", len(merged.DPatients[0]),
+			len(merged.DPatients[2]))
+	}
+}
+
+func TestWuPalmerSimilarity(t *testing.T) {
+	exp := &trajectory.Experiment{Hierarchy: map[int][]string{
+		0: {"Endocrine diseases", "Diabetes mellitus", "Type 2 diabetes mellitus"},
+		1: {"Endocrine diseases", "Diabetes mellitus", "Diabetes with renal complications"},
+		2: {"Neoplasms", "Malignant neoplasms of urinary tract"},
+	}}
+	if sim := trajectory.WuPalmerSimilarity(exp, 0, 1); sim != 0.75 {
+		t.Errorf("expected similarity 0.75 for related diabetes diagnoses, got %f", sim)
+	}
+	if sim := trajectory.WuPalmerSimilarity(exp, 0, 2); sim != 2.0/7.0 {
+		t.Errorf("expected similarity 2/7 for diagnoses in different chapters, got %f", sim)
+	}
+	if sim := trajectory.WuPalmerSimilarity(exp, 2, 3); sim != 0 {
+		t.Errorf("expected similarity 0 for a diagnosis outside the hierarchy, got %f", sim)
+	}
+}
+
+func TestCollectSoftClusters(t *testing.T) {
+	t1 := &trajectory.Trajectory{ID: 0, Cluster: 0}
+	t2 := &trajectory.Trajectory{ID: 1, Cluster: 1, Memberships: []trajectory.Membership{{Cluster: 1, Weight: 0.7},
+		{Cluster: 0, Weight: 0.3}}}
+	exp := &trajectory.Experiment{Trajectories: []*trajectory.Trajectory{t1, t2}}
+	if !trajectory.SoftClustered(exp) {
+		t.Errorf("expected a soft clustering")
+	}
+	clusters := trajectory.CollectClusters(exp)
+	if len(clusters[0]) != 2 || len(clusters[1]) != 1 {
+		t.Errorf("expected 2 trajectories in cluster 0 and 1 in cluster 1, got %d and %d", len(clusters[0]),
+			len(clusters[1]))
+	}
+}
+
+func TestBootstrapClusterStatistics(t *testing.T) {
+	patients := []*trajectory.Patient{}
+	for i := 0; i < 10; i++ {
+		p := &trajectory.Patient{PID: i, Sex: trajectory.Male}
+		if i%2 == 0 {
+			p.Sex = trajectory.Female
+		}
+		patients = append(patients, p)
+	}
+	// patient 0 follows both trajectories and is counted once
+	t1 := &trajectory.Trajectory{ID: 0, Cluster: 0, Diagnoses: []int{0, 1},
+		Patients: [][]*trajectory.Patient{patients, patients}}
+	t2 := &trajectory.Trajectory{ID: 1, Cluster: 0, Diagnoses: []int{1, 0},
+		Patients: [][]*trajectory.Patient{patients[:1], patients[:1]}}
+	exp := &trajectory.Experiment{Trajectories: []*trajectory.Trajectory{t1, t2},
+		DxDRR: [][]float64{{1, 2}, {2, 1}}}
+	stats := trajectory.BootstrapClusterStatistics(exp, 200)
+	s := stats[0]
+	if s.Patients != 10 || s.Males.Value != 50 || s.MeanRR.Value != 2 {
+		t.Errorf("expected 10 patients, 50%% males and mean RR 2, got %d, %f, %f", s.Patients, s.Males.Value,
+			s.MeanRR.Value)
+	}
+	if !(s.Males.Low < 50 && s.Males.High > 50) {
+		t.Errorf("expected a confidence interval around 50%%, got [%f, %f]", s.Males.Low, s.Males.High)
+	}
+	if s.MeanRR.Low != 2 || s.MeanRR.High != 2 {
+		t.Errorf("expected a degenerate confidence interval for the mean RR, got [%f, %f]", s.MeanRR.Low,
+			s.MeanRR.High)
+	}
+}
+
+func TestAlignCluster(t *testing.T) {
+	ts := []*trajectory.Trajectory{
+		{ID: 0, Diagnoses: []int{0, 1, 2}},
+		{ID: 1, Diagnoses: []int{0, 2}},
+		{ID: 2, Diagnoses: []int{1, 2, 3}},
+	}
+	alignment := trajectory.AlignCluster(0, ts)
+	if len(alignment.Columns) != 4 {
+		t.Fatalf("expected 4 columns, got %v", alignment.Columns)
+	}
+	consensus := alignment.Consensus(0.5)
+	expected := []int{0, 1, 2}
+	if len(consensus) != len(expected) {
+		t.Fatalf("expected consensus %v, got %v", expected, consensus)
+	}
+	for i, c := range consensus {
+		if c.Diagnosis != expected[i] {
+			t.Errorf("expected consensus %v, got %v", expected, consensus)
+		}
+	}
+	if consensus[2].Frequency != 1 {
+		t.Errorf("expected diagnosis 2 in all trajectories, got frequency %f", consensus[2].Frequency)
+	}
+}
+
+func TestAgeWindowFilter(t *testing.T) {
+	p := &trajectory.Patient{PID: 0, YOB: 2000, Diagnoses: []*trajectory.Diagnosis{
+		{DID: 0, Date: trajectory.DiagnosisDate{Year: 2005, Month: 1, Day: 1}},
+		{DID: 1, Date: trajectory.DiagnosisDate{Year: 2010, Month: 1, Day: 1}},
+		{DID: 2, Date: trajectory.DiagnosisDate{Year: 2020, Month: 1, Day: 1}}}}
+	if !trajectory.AgeWindowFilter(0, 18)(p) {
+		t.Fatalf("expected the patient to have diagnoses between 0 and 18")
+	}
+	if len(p.Diagnoses) != 2 {
+		t.Errorf("expected 2 diagnoses between 0 and 18, got %d", len(p.Diagnoses))
+	}
+	traj := &trajectory.Trajectory{Diagnoses: []int{0, 1}, Patients: [][]*trajectory.Patient{{p}}}
+	ages := trajectory.MedianAgesFromTrajectory(traj)
+	if math.Abs(ages[0]-5.09) > 0.01 || math.Abs(ages[1]-10.09) > 0.01 {
+		t.Errorf("expected median ages 5.09 and 10.09, got %v", ages)
+	}
+	if trajectory.AgeWindowFilter(30, 40)(p) {
+		t.Errorf("expected the patient to have no diagnoses between 30 and 40")
+	}
+}
+
+func TestReadLegacyClustering(t *testing.T) {
+	dir := t.TempDir()
+	tabFile := filepath.Join(dir, "exp1-trajectories.tab")
+	dumpFile := filepath.Join(dir, "dump.exp1.mci.I40")
+	if err := os.WriteFile(tabFile, []byte("A\tB\n5\nB\tC\n4\nA\tC\n3\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dumpFile, []byte("0\t2\n1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ts, _, err := trajectory.ReadTrajectoriesFromTabFile(tabFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clustered, err := trajectory.ReadLegacyClustering(dumpFile, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clustered) != 3 || ts[0].Cluster != 0 || ts[2].Cluster != 0 || ts[1].Cluster != 1 {
+		t.Errorf("expected trajectories 0 and 2 in cluster 0 and trajectory 1 in cluster 1")
+	}
+}
+
+func TestReadMclDumpFile(t *testing.T) {
+	dir := t.TempDir()
+	dumpFile := filepath.Join(dir, "dump.exp1.mci.I40")
+	// the dialects of different MCL versions: tabs, spaces, trailing separators, commas, and empty lines
+	if err := os.WriteFile(dumpFile, []byte("0\t2\t\n\n1  3 \r\n4,5;\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := trajectory.ReadMclDumpFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{{0, 2}, {1, 3}, {4, 5}}; !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("expected clusters %v, got %v", expected, clusters)
+	}
+	if err := os.WriteFile(dumpFile, []byte("0\t2\n1\tx3\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = trajectory.ReadMclDumpFile(dumpFile)
+	if err == nil || !strings.Contains(err.Error(), dumpFile+":2:") || !strings.Contains(err.Error(), `"1\tx3"`) {
+		t.Errorf("expected an error that quotes the file and the bad line, got %v", err)
+	}
+}
+
+func TestRemoveInvalidTrajectories(t *testing.T) {
+	ts := []*trajectory.Trajectory{
+		{ID: 0, Diagnoses: []int{1, 2}, PatientNumbers: []int{3}},
+		{ID: 1, Diagnoses: []int{}},
+		{ID: 2, Diagnoses: []int{1, 2}},
+	}
+	valid := trajectory.RemoveInvalidTrajectories(ts)
+	if len(valid) != 1 || valid[0].ID != 0 {
+		t.Errorf("expected only trajectory 0 to be valid, got %d trajectories", len(valid))
+	}
+	if n := trajectory.CountEmptyTrajectories(ts); n != 1 {
+		t.Errorf("expected 1 empty trajectory, got %d", n)
+	}
+	if trajectory.LastPatients(ts[1]) != nil {
+		t.Errorf("expected no patients for an empty trajectory")
+	}
+}
+
+func TestInterner(t *testing.T) {
+	interner := utils.NewInterner()
+	line := "I10\tE11"
+	a := interner.Intern(strings.Split(line, "\t")[0])
+	b := interner.Intern("I1" + "0")
+	if a != b || interner.Len() != 1 {
+		t.Errorf("expected a single interned string, got %d", interner.Len())
+	}
+	if interner.Intern("E11") == a || interner.Len() != 2 {
+		t.Errorf("expected two distinct interned strings, got %d", interner.Len())
+	}
+}
+
+func TestPatientExclusions(t *testing.T) {
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{"p1": 1, "p2": 2}, PIDMap: map[int]*trajectory.Patient{
+		1: {PID: 1, PIDString: "p1", Sex: trajectory.Male},
+		2: {PID: 2, PIDString: "p2", Sex: trajectory.Female},
+	}}
+	trajectory.ExcludePatient(pMap, "p0", trajectory.ExcludedMissingBirthYear, "")
+	filtered := trajectory.ApplyPatientFilters([]trajectory.PatientFilter{trajectory.FemaleFilter()}, pMap)
+	if len(filtered.PIDMap) != 1 || len(filtered.Exclusions) != 2 {
+		t.Fatalf("expected 1 patient and 2 exclusions, got %d and %d", len(filtered.PIDMap), len(filtered.Exclusions))
+	}
+	if e := filtered.Exclusions[1]; e.Reason != trajectory.ExcludedByPatientFilter || e.Detail != "pfilter 1" {
+		t.Errorf("expected an exclusion by pfilter 1, got %v", e)
+	}
+	name := filepath.Join(t.TempDir(), "exclusions.csv")
+	trajectory.PrintExclusionsToCSVFile(filtered.Exclusions, name)
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), "PIDString,Reason,Detail\np0,missing_birth_year,\n") {
+		t.Errorf("unexpected exclusions file: %s", content)
+	}
+}
+
+func TestCompactDiagnosisIDs(t *testing.T) {
+	p := &trajectory.Patient{PID: 1, PIDString: "p1", Diagnoses: []*trajectory.Diagnosis{
+		{PID: 1, DID: 5, Date: trajectory.DiagnosisDate{Year: 2019, Month: 1, Day: 1}},
+		{PID: 1, DID: 2, Date: trajectory.DiagnosisDate{Year: 2020, Month: 1, Day: 1}},
+	}}
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{"p1": 1}, PIDMap: map[int]*trajectory.Patient{1: p}}
+	oldIDs := trajectory.CompactDiagnosisIDs(pMap, 8)
+	if len(oldIDs) != 2 || oldIDs[0] != 2 || oldIDs[1] != 5 {
+		t.Fatalf("expected old IDs [2 5], got %v", oldIDs)
+	}
+	if p.Diagnoses[0].DID != 1 || p.Diagnoses[1].DID != 0 {
+		t.Errorf("expected the diagnoses to be remapped to 1 and 0, got %d and %d", p.Diagnoses[0].DID,
+			p.Diagnoses[1].DID)
+	}
+	nameMap := trajectory.CompactNameMap(map[int]string{2: "Smoking", 3: "Drinking", 5: "Lung cancer"}, oldIDs)
+	if len(nameMap) != 2 || nameMap[0] != "Smoking" || nameMap[1] != "Lung cancer" {
+		t.Errorf("unexpected compacted name map %v", nameMap)
+	}
+}
+
+func TestFisherExactTest(t *testing.T) {
+	// the tea tasting experiment, for which R's fisher.test gives a two-sided p-value of 0.4857
+	if p := utils.FisherExactTest(3, 1, 1, 3); math.Abs(p-0.4857) > 0.0001 {
+		t.Errorf("expected p-value 0.4857, got %f", p)
+	}
+	qs := utils.BenjaminiHochberg([]float64{0.01, 0.04, 0.03, 0.5})
+	expected := []float64{0.04, 0.04 * 4 / 3, 0.04 * 4 / 3, 0.5}
+	for i, q := range qs {
+		if math.Abs(q-expected[i]) > 1e-9 {
+			t.Errorf("expected q-values %v, got %v", expected, qs)
+			break
+		}
+	}
+}
+
+func TestTrajectoryNarrative(t *testing.T) {
+	patients := []*trajectory.Patient{}
+	for i, months := range []int{6, 8, 10} {
+		d1 := &trajectory.Diagnosis{PID: i, DID: 0, Date: trajectory.DiagnosisDate{Year: 2010, Month: 1, Day: 1}}
+		d2 := &trajectory.Diagnosis{PID: i, DID: 1, Date: trajectory.DiagnosisDate{Year: 2010, Month: 1 + months, Day: 1}}
+		patients = append(patients, &trajectory.Patient{PID: i, Diagnoses: []*trajectory.Diagnosis{d1, d2}})
+	}
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{3},
+		Patients: [][]*trajectory.Patient{patients}}
+	exp := &trajectory.Experiment{NameMap: map[int]string{0: "Cough", 1: "COPD"}, DxDRR: [][]float64{{1, 2.14}, {1, 1}}}
+	expected := "Patients diagnosed with Cough are at 2.1-fold increased risk of COPD within a median of 8 months (n=3)."
+	if narrative := trajectory.TrajectoryNarrative(exp, tr); narrative != expected {
+		t.Errorf("expected %q, got %q", expected, narrative)
+	}
+}
+
+func TestReadSimilarityFile(t *testing.T) {
+	ts := []*trajectory.Trajectory{{Diagnoses: []int{0, 1}}, {Diagnoses: []int{1, 2}}, {Diagnoses: []int{2, 3}}}
+	exp := &trajectory.Experiment{Trajectories: ts}
+	dir := t.TempDir()
+	files := map[string]string{
+		"similarities.abc": "# i j similarity\n0 1 0.5\n2 1 0.25\n",
+		"similarities.csv": "t0,t1,t2\n1,0.5,0\n0.5,1,0.25\n0,0.25,1\n",
+	}
+	for name, contents := range files {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		similarity, err := cluster.ReadSimilarityFile(exp, file)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if s := similarity(ts[1], ts[0]); s != 0.5 {
+			t.Errorf("%s: expected similarity 0.5 for trajectories 0 and 1, got %f", name, s)
+		}
+		if s := similarity(ts[1], ts[2]); s != 0.25 {
+			t.Errorf("%s: expected similarity 0.25 for trajectories 1 and 2, got %f", name, s)
+		}
+		if s := similarity(ts[0], ts[2]); s != 0 {
+			t.Errorf("%s: expected similarity 0 for trajectories 0 and 2, got %f", name, s)
+		}
+	}
+	file := filepath.Join(dir, "out-of-range.abc")
+	if err := os.WriteFile(file, []byte("0 3 0.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cluster.ReadSimilarityFile(exp, file); err == nil {
+		t.Errorf("expected an error for a trajectory index out of range")
+	}
+}
+
+func TestTrajectoryCoverage(t *testing.T) {
+	eoi := &trajectory.DiagnosisDate{Year: 2012, Month: 1, Day: 1}
+	p1 := &trajectory.Patient{PID: 1, EOIDate: eoi}
+	p2 := &trajectory.Patient{PID: 2}
+	p3 := &trajectory.Patient{PID: 3, EOIDate: eoi}
+	ts := []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1}, Patients: [][]*trajectory.Patient{{p1, p2}}},
+		{Diagnoses: []int{1, 2}, Patients: [][]*trajectory.Patient{{p2, p3}}},
+	}
+	c := trajectory.TrajectoryCoverage(ts)
+	if c.Trajectories != 2 || c.Patients != 3 || c.EOIPatients != 2 {
+		t.Errorf("expected coverage {2 3 2}, got %v", c)
+	}
+	// the percentage of patients is relative to all patients, not only to those that are counted as male or female
+	exp := &trajectory.Experiment{MCtr: 2, FCtr: 2, PatientCtr: 6, EOICtr: 4}
+	if patients, eoiPatients := trajectory.CoveragePercentages(exp, c); patients != 50 || eoiPatients != 50 {
+		t.Errorf("expected coverage of 50%% of patients and EOI patients, got %f%% and %f%%", patients, eoiPatients)
+	}
+}
+
+func TestExperimentIterators(t *testing.T) {
+	ts := []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{5, 3}, Cluster: 1},
+		{Diagnoses: []int{1, 2}, PatientNumbers: []int{4}, Cluster: 0},
+		{Diagnoses: []int{0, 2}, PatientNumbers: []int{2}, Cluster: 1},
+	}
+	exp := &trajectory.Experiment{Trajectories: ts, DxDRR: [][]float64{{1, 2, 3}, {1, 1, 4}, {1, 1, 1}}}
+	ctr := 0
+	for i, tr := range exp.AllTrajectories() {
+		if tr != ts[i] {
+			t.Errorf("expected trajectory %d in order", i)
+		}
+		ctr++
+	}
+	if ctr != 3 {
+		t.Errorf("expected 3 trajectories, got %d", ctr)
+	}
+	transitions := []trajectory.Transition{}
+	for tr := range exp.Transitions(ts[0]) {
+		transitions = append(transitions, tr)
+	}
+	if len(transitions) != 2 || transitions[1].From != 1 || transitions[1].To != 2 || transitions[1].NofPatients != 3 ||
+		transitions[1].RR != 4 {
+		t.Errorf("unexpected transitions %v", transitions)
+	}
+	ctr = 0
+	for range exp.AllTransitions() {
+		ctr++
+		if ctr == 3 {
+			break
+		}
+	}
+	if ctr != 3 {
+		t.Errorf("expected to stop after 3 transitions, got %d", ctr)
+	}
+	cids := []int{}
+	for cid := range exp.ClusterIDs() {
+		cids = append(cids, cid)
+	}
+	if len(cids) != 2 || cids[0] != 0 || cids[1] != 1 {
+		t.Errorf("expected cluster IDs [0 1], got %v", cids)
+	}
+	members := []*trajectory.Trajectory{}
+	for tr, weight := range exp.ClusterMembers(1) {
+		if weight != 1 {
+			t.Errorf("expected weight 1 for hard clustering, got %f", weight)
+		}
+		members = append(members, tr)
+	}
+	if len(members) != 2 || members[0] != ts[0] || members[1] != ts[2] {
+		t.Errorf("unexpected members of cluster 1: %v", members)
+	}
+}
+
+func TestStableOrdering(t *testing.T) {
+	clusters := [][]int{{7}, {5, 2}, {3, 9, 1}, {4}}
+	trajectory.SortClusters(clusters)
+	if fmt.Sprint(clusters[0]) != "[1 3 9]" || fmt.Sprint(clusters[1]) != "[2 5]" {
+		t.Errorf("expected clusters sorted by size with sorted IDs, got %v", clusters)
+	}
+	reversed := [][]int{{4}, {7}}
+	trajectory.SortClusters(reversed)
+	if fmt.Sprint(reversed) != fmt.Sprint(clusters[2:]) {
+		t.Errorf("expected the same order for clusters of the same size, got %v and %v", reversed, clusters[2:])
+	}
+	ts := []*trajectory.Trajectory{
+		{Diagnoses: []int{2, 3}, PatientNumbers: []int{5}},
+		{Diagnoses: []int{1, 4, 2}, PatientNumbers: []int{9, 7}},
+		{Diagnoses: []int{1, 3}, PatientNumbers: []int{5}},
+	}
+	trajectory.SortTrajectories(ts)
+	if fmt.Sprint(ts[0].Diagnoses, ts[1].Diagnoses, ts[2].Diagnoses) != "[1 4 2] [1 3] [2 3]" {
+		t.Errorf("expected trajectories sorted by score then diagnoses, got %v %v %v", ts[0].Diagnoses,
+			ts[1].Diagnoses, ts[2].Diagnoses)
+	}
+}
+
+func TestEstimateClusteringDiskUsage(t *testing.T) {
+	options := cluster.Options{Granularities: []int{40}}
+	streaming := cluster.EstimateClusteringDiskUsage(1000, 100, options)
+	options.AbcFile = true
+	materialized := cluster.EstimateClusteringDiskUsage(1000, 100, options)
+	if streaming == 0 || materialized <= streaming {
+		t.Errorf("expected the abc file to add to the disk usage, got %d and %d", streaming, materialized)
+	}
+	if quadrupled := cluster.EstimateClusteringDiskUsage(2000, 100, options); quadrupled < 3*materialized {
+		t.Errorf("expected the disk usage to grow quadratically, got %d and %d", materialized, quadrupled)
+	}
+}
+
+func TestPtraRoundTrip(t *testing.T) {
+	ts := []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{5, 3}, Cluster: 1},
+		{Diagnoses: []int{2, 0}, PatientNumbers: []int{4}, Cluster: 0,
+			Memberships: []trajectory.Membership{{Cluster: 0, Weight: 0.75}, {Cluster: 1, Weight: 0.25}}},
+	}
+	rr := trajectory.MakeDxDRR(3)
+	rr[0][1], rr[1][2], rr[2][0] = 2.5, 1.5, 3
+	exp := &trajectory.Experiment{Name: "exp1", Trajectories: ts, DxDRR: rr, NofDiagnosisCodes: 3,
+		NameMap:   map[int]string{0: "Cough", 1: "Dyspnea", 2: "COPD"},
+		IdMap:     map[int]string{0: "R05", 1: "R06.0", 2: "J44"},
+		Hierarchy: map[int][]string{2: {"Diseases of the respiratory system", "COPD"}}}
+	var buf bytes.Buffer
+	if err := trajectory.WritePtra(&buf, exp, true, map[string]string{"granularity": "40"}); err != nil {
+		t.Fatal(err)
+	}
+	read, header, err := trajectory.ReadPtra(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.FormatVersion != trajectory.PtraFormatVersion || !header.Clustered || header.Metadata["granularity"] != "40" {
+		t.Errorf("unexpected header %v", header)
+	}
+	if read.Name != "exp1" || read.IdMap[1] != "R06.0" || read.NameMap[2] != "COPD" || len(read.Hierarchy[2]) != 2 {
+		t.Errorf("unexpected diagnoses %v %v %v", read.NameMap, read.IdMap, read.Hierarchy)
+	}
+	if len(read.Trajectories) != 2 {
+		t.Fatalf("expected 2 trajectories, got %d", len(read.Trajectories))
+	}
+	t0, t1 := read.Trajectories[0], read.Trajectories[1]
+	if fmt.Sprint(t0.Diagnoses, t0.PatientNumbers, t0.Cluster) != "[0 1 2] [5 3] 1" {
+		t.Errorf("unexpected trajectory %v %v %d", t0.Diagnoses, t0.PatientNumbers, t0.Cluster)
+	}
+	if len(t1.Memberships) != 2 || t1.Memberships[0].Weight != 0.75 || t1.ID != 1 {
+		t.Errorf("unexpected soft memberships %v", t1.Memberships)
+	}
+	if read.DxDRR[0][1] != 2.5 || read.DxDRR[2][0] != 3 {
+		t.Errorf("expected the RRs of the transitions, got %v", read.DxDRR)
+	}
+}
+
+func TestStandardizedSupport(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reference.csv")
+	if err := os.WriteFile(file, []byte("AgeMin,AgeMax,Sex,Population\n0,49,M,75\n50,,M,25\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	strata, err := trajectory.ReadReferencePopulation(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a cohort with 2 young and 8 old men, where 1 young and 2 old men follow the trajectory
+	patients := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{}}
+	followers := []*trajectory.Patient{}
+	for i := 0; i < 10; i++ {
+		yob := 1930
+		if i < 2 {
+			yob = 1980
+		}
+		d := &trajectory.Diagnosis{PID: i, Date: trajectory.DiagnosisDate{Year: 2010, Month: 1, Day: 1}}
+		p := &trajectory.Patient{PID: i, YOB: yob, Sex: trajectory.Male, Diagnoses: []*trajectory.Diagnosis{d}}
+		patients.PIDMap[i] = p
+		if i == 0 || i == 2 || i == 3 {
+			followers = append(followers, p)
+		}
+	}
+	s := trajectory.NewStandardization(strata, patients)
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{3},
+		Patients: [][]*trajectory.Patient{followers}}
+	crude, standardized := s.StandardizedSupport(tr)
+	// crude: 3/10, standardized: 0.75 * 1/2 + 0.25 * 2/8
+	if math.Abs(crude-30) > 1e-9 || math.Abs(standardized.Value-43.75) > 1e-9 {
+		t.Errorf("expected crude 30%% and standardized 43.75%%, got %f%% and %f%%", crude, standardized.Value)
+	}
+	if !(standardized.Low < standardized.Value && standardized.Value < standardized.High) {
+		t.Errorf("expected the confidence interval to contain the rate, got %v", standardized)
+	}
+}
+
+func TestSQLTables(t *testing.T) {
+	dir := t.TempDir()
+	ts := []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1}, PatientNumbers: []int{5}, Cluster: 2},
+		{Diagnoses: []int{1, 0}, PatientNumbers: []int{4}, Cluster: 2},
+	}
+	rr := trajectory.MakeDxDRR(2)
+	rr[0][1] = 2.5
+	exp := &trajectory.Experiment{Name: "exp1", Trajectories: ts, DxDRR: rr, NofDiagnosisCodes: 2,
+		NameMap: map[int]string{0: "Cough", 1: "Dyspnea"}, IdMap: map[int]string{0: "R05", 1: "R06.0"},
+		Hierarchy: map[int][]string{0: {"Symptoms", "Cough"}}}
+	file := filepath.Join(dir, "exp1.clustered.ptra")
+	if err := trajectory.WritePtraFile(file, exp, true, map[string]string{"granularity": "40"}); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := trajectory.WriteSQLTables(dir, []string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, table := range tables {
+		b, err := os.ReadFile(table.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[table.Name] = string(b)
+	}
+	expected := map[string]string{
+		"runs":         "run,name,file,clustered,granularity,trajectories\n1,exp1," + file + ",true,40,2\n",
+		"diagnoses":    "run,did,code,name,chapter\n1,0,R05,Cough,Symptoms\n1,1,R06.0,Dyspnea,\n",
+		"trajectories": "run,tid,length,patients,diagnoses\n1,0,2,5,Cough -> Dyspnea\n1,1,2,4,Dyspnea -> Cough\n",
+		"transitions":  "run,tid,step,from_did,to_did,patients,rr\n1,0,0,0,1,5,2.5\n1,1,0,1,0,4,1\n",
+		"clusters":     "run,tid,cid,weight\n1,0,2,1\n1,1,2,1\n",
+	}
+	for name, content := range expected {
+		if contents[name] != content {
+			t.Errorf("unexpected %s table:\n%s", name, contents[name])
+		}
+	}
+	script := trajectory.DuckDBLoadScript(tables)
+	if !strings.Contains(script, "CREATE OR REPLACE TABLE transitions AS SELECT * FROM read_csv(") ||
+		!strings.Contains(script, "'rr': 'DOUBLE'") {
+		t.Errorf("unexpected load script:\n%s", script)
+	}
+}
+
+func TestEOIEnrichment(t *testing.T) {
+	eoi := &trajectory.DiagnosisDate{Year: 2015, Month: 1, Day: 1}
+	withEOI := &trajectory.Patient{PID: 0, EOIDate: eoi}
+	withoutEOI := &trajectory.Patient{PID: 1}
+	// a cohort of 10 patients, of which 2 have an event of interest
+	exp := &trajectory.Experiment{MCtr: 6, FCtr: 4, EOICtr: 2, DxDRR: trajectory.MakeDxDRR(3), NofDiagnosisCodes: 3,
+		NameMap: map[int]string{0: "Cough", 1: "Dyspnea", 2: "COPD"}}
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{4, 2},
+		Patients: [][]*trajectory.Patient{{withEOI, withoutEOI, withoutEOI, withoutEOI}, {withEOI, withEOI}}}
+	enrichments := trajectory.TransitionEOIEnrichments(exp, tr)
+	if len(enrichments) != 2 || math.Abs(enrichments[0]-1.25) > 1e-9 || math.Abs(enrichments[1]-5) > 1e-9 {
+		t.Errorf("expected enrichments 1.25 and 5, got %v", enrichments)
+	}
+	if c := trajectory.EOIEnrichmentColor(1); c != "#f7f7f7" {
+		t.Errorf("expected white for the cohort rate, got %s", c)
+	}
+	if c := trajectory.EOIEnrichmentColor(5); c != "#b2182b" {
+		t.Errorf("expected the end of the scale, got %s", c)
+	}
+	if c := trajectory.EOIEnrichmentColor(math.Sqrt2); c != "#f6cebd" {
+		t.Errorf("expected an interpolated color, got %s", c)
+	}
+	exp.Trajectories = []*trajectory.Trajectory{tr}
+	var buf bytes.Buffer
+	if err := trajectory.WritePtra(&buf, exp, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	read, _, err := trajectory.ReadPtra(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(read.Trajectories[0].EOIEnrichments) != "[1.25 5]" {
+		t.Errorf("expected the enrichments in the .ptra file, got %v", read.Trajectories[0].EOIEnrichments)
+	}
+}
+
+func TestTerminologyClient(t *testing.T) {
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/CodeSystem/$lookup" || r.URL.Query().Get("system") != app.DefaultTerminologySystem {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		switch r.URL.Query().Get("code") {
+		case "A00.0":
+		case "Y99.9":
+			http.Error(w, `{"resourceType":"OperationOutcome","issue":[{"code":"not-found"}]}`, http.StatusBadRequest)
+			return
+		case "invalid":
+			http.Error(w, `{"resourceType":"OperationOutcome","issue":[{"code":"invalid"}]}`, http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, `{"resourceType":"OperationOutcome"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"resourceType":"Parameters","parameter":[{"name":"name","valueString":"ICD-10-CM"},`+
+			`{"name":"display","valueString":"Cholera due to Vibrio cholerae 01, biovar cholerae"}]}`)
+	}))
+	defer server.Close()
+	cacheFile := filepath.Join(t.TempDir(), "cache", "terminology.json")
+	client, err := app.NewTerminologyClient(server.URL, app.DefaultTerminologySystem, cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameMap := map[int]string{0: "A00.0", 1: "", 2: "Typhoid fever"}
+	idMap := map[int]string{0: "A00.0", 1: "X99.9", 2: "A01.0"}
+	hierarchy := map[int][]string{0: {"Certain infectious and parasitic diseases", "A00.0"}}
+	if n := app.ResolveNames(client, nameMap, idMap, hierarchy); n != 1 || lookups != 2 {
+		t.Errorf("expected 1 name resolved with 2 lookups, got %d with %d", n, lookups)
+	}
+	if nameMap[0] != "Cholera due to Vibrio cholerae 01, biovar cholerae" || hierarchy[0][1] != nameMap[0] ||
+		nameMap[1] != "" || nameMap[2] != "Typhoid fever" {
+		t.Errorf("unexpected names %v %v", nameMap, hierarchy)
+	}
+	// the names, and the unknown codes, are looked up in the cache by a new client
+	client, err = app.NewTerminologyClient(server.URL, app.DefaultTerminologySystem, cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameMap = map[int]string{0: "", 1: "", 2: "Typhoid fever"}
+	if n := app.ResolveNames(client, nameMap, idMap, hierarchy); n != 1 || lookups != 2 {
+		t.Errorf("expected 1 name resolved from the cache, got %d with %d lookups", n, lookups)
+	}
+	// a bad request is only cached if it reports the code as not found
+	for _, code := range []string{"Y99.9", "Y99.9", "invalid", "invalid"} {
+		if _, err := client.Display(code); (err != nil) != (code == "invalid") {
+			t.Errorf("unexpected error for %s: %v", code, err)
+		}
+	}
+	if lookups != 5 {
+		t.Errorf("expected 3 more lookups for the bad requests, got %d", lookups-2)
+	}
+}
+
+func TestPersonTime(t *testing.T) {
+	death := trajectory.DiagnosisDate{Year: 2012, Month: 1, Day: 1}
+	p := &trajectory.Patient{PID: 1, Diagnoses: []*trajectory.Diagnosis{
+		{PID: 1, DID: 0, Date: trajectory.DiagnosisDate{Year: 2000, Month: 1, Day: 1}},
+		{PID: 1, DID: 1, Date: trajectory.DiagnosisDate{Year: 2005, Month: 1, Day: 1}}}, DeathDate: &death}
+	start, end := trajectory.FollowUp(p)
+	if math.Abs(end-start-12) > 0.01 {
+		t.Errorf("expected a follow-up of 12 years until death, got %f-%f", start, end)
+	}
+	// 10 events in 100 years at risk against 10 events in 400 years at risk
+	if irr := trajectory.IncidenceRateRatio(10, 100, 10, 400); math.Abs(irr-4) > 1e-9 {
+		t.Errorf("expected an IRR of 4, got %f", irr)
+	}
+	if irr := trajectory.IncidenceRateRatio(10, 0, 10, 400); !math.IsNaN(irr) {
+		t.Errorf("expected NaN without person-time at risk, got %f", irr)
+	}
+}
+
+func TestClusterFigures(t *testing.T) {
+	curve := trajectory.KaplanMeier([]float64{1, 2, 2, 3, 4}, []bool{true, true, false, true, false})
+	survival := []float64{}
+	for _, p := range curve {
+		survival = append(survival, math.Round(p.Survival*100)/100)
+	}
+	if fmt.Sprint(survival) != "[1 0.8 0.6 0.3]" {
+		t.Errorf("expected survival [1 0.8 0.6 0.3], got %v", survival)
+	}
+	if median, ok := trajectory.KMMedian(curve); !ok || median != 3 {
+		t.Errorf("expected a median survival of 3, got %f", median)
+	}
+	death := trajectory.DiagnosisDate{Year: 2012, Month: 1, Day: 1}
+	p := &trajectory.Patient{PID: 0, YOB: 1950, Sex: trajectory.Male, DeathDate: &death,
+		Diagnoses: []*trajectory.Diagnosis{
+			{PID: 0, DID: 0, Date: trajectory.DiagnosisDate{Year: 2000, Month: 1, Day: 1}},
+			{PID: 0, DID: 1, Date: trajectory.DiagnosisDate{Year: 2002, Month: 1, Day: 1}}}}
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{1},
+		Patients: [][]*trajectory.Patient{{p}}}
+	times, events, deaths := trajectory.SurvivalAfterTrajectories([]*trajectory.Trajectory{tr})
+	if deaths != 1 || !events[0] || math.Abs(times[0]-10) > 0.01 {
+		t.Errorf("expected a death 10 years after the trajectory, got %v %v", times, events)
+	}
+	exp := &trajectory.Experiment{Name: "figures", MCtr: 1, DxDRR: trajectory.MakeDxDRR(2), NofDiagnosisCodes: 2,
+		NameMap:      map[int]string{0: "Cough", 1: "Chronic obstructive pulmonary disease"},
+		Trajectories: []*trajectory.Trajectory{tr}}
+	name := filepath.Join(t.TempDir(), "figures.pdf")
+	trajectory.PrintClusterFiguresToPDFFile(exp, name, 5)
+	pdf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) {
+		t.Errorf("expected a PDF file")
+	}
+}
+
+func TestPatientsMatchingPrefix(t *testing.T) {
+	patient := func(pid int, diagnoses ...[2]int) *trajectory.Patient {
+		p := &trajectory.Patient{PID: pid}
+		for _, d := range diagnoses {
+			p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: pid, DID: d[0],
+				Date: trajectory.DiagnosisDate{Year: d[1], Month: 1, Day: 1}})
+		}
+		return p
+	}
+	p1 := patient(1, [2]int{0, 2000}, [2]int{1, 2001}, [2]int{2, 2003})
+	p2 := patient(2, [2]int{0, 2000}, [2]int{1, 2010}, [2]int{2, 2011})
+	p3 := patient(3, [2]int{1, 2000}, [2]int{0, 2001})
+	exp := &trajectory.Experiment{NofDiagnosisCodes: 3, DPatients: [][]*trajectory.Patient{{p3, p2, p1},
+		{p1, p2, p3}, {p1, p2}}, MinTime: 0.5, MaxTime: 5}
+	pids := func(ps []*trajectory.Patient) string {
+		s := []int{}
+		for _, p := range ps {
+			s = append(s, p.PID)
+		}
+		return fmt.Sprint(s)
+	}
+	if got := pids(exp.PatientsMatchingPrefix([]int{0})); got != "[1 2 3]" {
+		t.Errorf("expected patients [1 2 3] for a prefix of one diagnosis, got %s", got)
+	}
+	// patient 2 gets the second diagnosis too late, and patient 3 in the wrong order
+	if got := pids(exp.PatientsMatchingPrefix([]int{0, 1, 2})); got != "[1]" {
+		t.Errorf("expected patients [1], got %s", got)
+	}
+	exp.MinTime, exp.MaxTime = 0, 0
+	if got := pids(exp.PatientsMatchingPrefix([]int{0, 1})); got != "[1 2]" {
+		t.Errorf("expected patients [1 2] without a time window, got %s", got)
+	}
+}
+
+func TestMergeDuplicatePatients(t *testing.T) {
+	nofCohortAges := 10
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML("./icd10cm_tabular_2022.xml", 0)
+	patients, _ := app.ParseTriNetXPatientData("./patient.csv", nofCohortAges)
+	app.ParseTrinetXPatientDiagnoses("./diagnosis.csv", "", patients, analysisMaps, map[string]string{}, false)
+	// the same extract twice must give the same patients and diagnoses
+	merged, _ := app.ParseTriNetXPatientData("./patient.csv,./patient.csv", nofCohortAges)
+	app.ParseTrinetXPatientDiagnoses("./diagnosis.csv,./diagnosis.csv", "", merged, analysisMaps, map[string]string{},
+		false)
+	if merged.Ctr != patients.Ctr || merged.MaleCtr != patients.MaleCtr || merged.FemaleCtr != patients.FemaleCtr ||
+		len(merged.Exclusions) != len(patients.Exclusions) {
+		t.Fatalf("expected %d patients after merging, got %d", patients.Ctr, merged.Ctr)
+	}
+	for pidString, pid := range patients.PIDStringMap {
+		p := patients.PIDMap[pid]
+		m, ok := trajectory.GetPatient(pidString, merged)
+		if !ok || len(m.Diagnoses) != len(p.Diagnoses) {
+			t.Errorf("expected the diagnoses of patient %s to be merged", pidString)
+		}
+	}
+}
+
+func TestBiomarkers(t *testing.T) {
+	if p := utils.MannWhitneyUTest([]float64{1, 2, 3}, []float64{4, 5, 6}); math.Abs(p-0.0495) > 0.0001 {
+		t.Errorf("expected a Mann-Whitney p-value of 0.0495, got %f", p)
+	}
+	name := filepath.Join(t.TempDir(), "biomarkers.csv")
+	if err := os.WriteFile(name, []byte("patient_id,KRAS,PDL1\np1,mutant,60\np2,mutant,70\np3,wildtype,NA\n"+
+		"p4,wildtype,10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := trajectory.ReadBiomarkers(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Numeric("KRAS") || !b.Numeric("PDL1") {
+		t.Errorf("expected KRAS to be categorical and PDL1 numeric")
+	}
+	patients := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{}, PIDStringMap: map[string]int{}}
+	for i := 1; i <= 4; i++ {
+		patients.PIDMap[i] = &trajectory.Patient{PID: i, PIDString: fmt.Sprint("p", i)}
+	}
+	filter, err := trajectory.ParseBiomarkerFilter(b, "PDL1>=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter(patients.PIDMap[1]) || filter(patients.PIDMap[3]) || filter(patients.PIDMap[4]) {
+		t.Errorf("expected PDL1>=50 to only select the patients with a known PDL1 of at least 50")
+	}
+	if _, err := trajectory.ParseBiomarkerFilter(b, "KRAS>1"); err == nil {
+		t.Errorf("expected an error for an order operator on a categorical biomarker")
+	}
+	// patients 1 and 2 follow the trajectory
+	exp := &trajectory.Experiment{NameMap: map[int]string{0: "Cough", 1: "COPD"}, Trajectories: []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1}, PatientNumbers: []int{2},
+			Patients: [][]*trajectory.Patient{{patients.PIDMap[1], patients.PIDMap[2]}}}}}
+	enrichments := trajectory.BiomarkerEnrichments(exp, b, patients)
+	if len(enrichments) != 3 {
+		t.Fatalf("expected 3 tests, got %d", len(enrichments))
+	}
+	for _, e := range enrichments {
+		if e.Biomarker == "KRAS" && e.Level == "mutant" && (e.TrajectoryValue != 100 || e.OtherValue != 0 ||
+			math.Abs(e.PValue-0.3333) > 0.0001) {
+			t.Errorf("unexpected KRAS enrichment %+v", e)
+		}
+		if e.Biomarker == "PDL1" && (e.TrajectoryPatients != 2 || e.OtherPatients != 1 || e.Effect != 55) {
+			t.Errorf("unexpected PDL1 enrichment %+v", e)
+		}
+	}
+}
+
+func TestEraEvolution(t *testing.T) {
+	patients := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{1: {PID: 1, Diagnoses: []*trajectory.Diagnosis{
+		{PID: 1, DID: 0, Date: trajectory.DiagnosisDate{Year: 2000, Month: 1, Day: 1}},
+		{PID: 1, DID: 1, Date: trajectory.DiagnosisDate{Year: 2011, Month: 1, Day: 1}}}}}}
+	eras := trajectory.SlidingEras(patients, 5, 3)
+	if fmt.Sprint(eras) != "[2000-2004 2003-2007 2006-2010 2009-2013]" {
+		t.Errorf("unexpected eras %v", eras)
+	}
+	era := func(ts ...*trajectory.Trajectory) *trajectory.Experiment {
+		return &trajectory.Experiment{Trajectories: ts, DxDRR: trajectory.MakeDxDRR(3)}
+	}
+	ab := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{10}}
+	bc := &trajectory.Trajectory{Diagnoses: []int{1, 2}, PatientNumbers: []int{5}}
+	evolutions := trajectory.EraEvolution([]*trajectory.Experiment{era(ab), era(ab, bc), era(bc), era(bc)})
+	if len(evolutions) != 2 {
+		t.Fatalf("expected 2 trajectories, got %d", len(evolutions))
+	}
+	if e := evolutions[0]; fmt.Sprint(e.Diagnoses, e.Patients, e.Emerged, e.Disappeared) != "[0 1] [10 10 0 0] 0 2" {
+		t.Errorf("unexpected evolution %v", e)
+	}
+	if e := evolutions[1]; fmt.Sprint(e.Diagnoses, e.Patients, e.Emerged, e.Disappeared) != "[1 2] [0 5 5 5] 1 -1" {
+		t.Errorf("unexpected evolution %v", e)
+	}
+}
+
+// splitFile splits a file into chunks of at most n lines, and returns the names of the chunks as a comma-separated list.
+func splitFile(t *testing.T, name string, n int) string {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	names := []string{}
+	for i := 0; i < len(lines); i += n {
+		chunk := filepath.Join(t.TempDir(), fmt.Sprint(len(names), filepath.Base(name)))
+		if err := os.WriteFile(chunk, []byte(strings.Join(lines[i:utils.Min(i+n, len(lines))], "")), 0600); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, chunk)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestParallelFileParsing(t *testing.T) {
+	nofCohortAges := 10
+	analysisMaps := app.InitializeIcd10AnalysisMapsFromXML("./icd10cm_tabular_2022.xml", 0)
+	patients, _ := app.ParseTriNetXPatientData("./patient.csv", nofCohortAges)
+	app.ParseTrinetXPatientDiagnoses("./diagnosis.csv", "", patients, analysisMaps, map[string]string{}, false)
+	// the files are parsed concurrently, but the patients must get the same IDs and diagnoses as for a single file
+	split, _ := app.ParseTriNetXPatientData(splitFile(t, "./patient.csv", 150), nofCohortAges)
+	app.ParseTrinetXPatientDiagnoses(splitFile(t, "./diagnosis.csv", 1000), "", split, analysisMaps,
+		map[string]string{}, false)
+	if split.Ctr != patients.Ctr || len(split.Exclusions) != len(patients.Exclusions) {
+		t.Fatalf("expected %d patients after parsing the split files, got %d", patients.Ctr, split.Ctr)
+	}
+	for pidString, pid := range patients.PIDStringMap {
+		if split.PIDStringMap[pidString] != pid {
+			t.Fatalf("expected patient %s to have ID %d, got %d", pidString, pid, split.PIDStringMap[pidString])
+		}
+		p, s := patients.PIDMap[pid], split.PIDMap[pid]
+		if len(s.Diagnoses) != len(p.Diagnoses) {
+			t.Fatalf("expected %d diagnoses for patient %s, got %d", len(p.Diagnoses), pidString, len(s.Diagnoses))
+		}
+		for i, d := range p.Diagnoses {
+			if s.Diagnoses[i].DID != d.DID || s.Diagnoses[i].Date != d.Date {
+				t.Errorf("expected the same diagnoses for patient %s", pidString)
+			}
+		}
+	}
+}
+
+func TestRelativeRiskPipeline(t *testing.T) {
+	exp, _ := app.ParseTriNetXData("exp1", "./patient.csv", "./diagnosis.csv", "./icd10cm_tabular_2022.xml", "", "",
+		10, 3, 0, 5, "", false, []trajectory.PatientFilter{}, "", 0, "")
+	trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0, 5, 20, trajectory.RRPersonTime, 1, 1.0, true)
+	pairs := exp.Pairs
+	if len(pairs) == 0 {
+		t.Fatal("expected diagnosis pairs to be selected while computing the relative risk ratios")
+	}
+	// selecting the pairs afterwards must give the same pairs in the same order, also after releasing the patients of
+	// the pairs that are not selected
+	exp.Pairs = nil
+	trajectories := trajectory.BuildTrajectories(exp, 1, 5, 2, 0, 5, 1.0, []trajectory.TrajectoryFilter{})
+	if len(exp.Pairs) != len(pairs) {
+		t.Fatalf("expected %d pairs, got %d", len(pairs), len(exp.Pairs))
+	}
+	for i, pair := range pairs {
+		if *exp.Pairs[i] != *pair {
+			t.Fatalf("expected pair %v at position %d, got %v", *pair, i, *exp.Pairs[i])
+		}
+	}
+	if len(trajectories) == 0 {
+		t.Errorf("expected trajectories from the selected pairs")
+	}
+}
+
+// keptSpans is an in-memory span exporter that keeps the spans when it is shut down at the end of the tracing.
+type keptSpans struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keptSpans) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	exporter := keptSpans{tracetest.NewInMemoryExporter()}
+	stop := utils.StartTracingTo(exporter, "ptra", "test")
+	utils.StartStage("Parsing input", 1)
+	cmd := exec.Command("sh", "-c", "echo $TRACEPARENT")
+	end := utils.TraceCommand(cmd)
+	output, err := cmd.Output()
+	end(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	run, stage, exec := spans["ptra"], spans["Parsing input"], spans["exec sh"]
+	if run.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the run to join the trace of TRACEPARENT, got %v", run.SpanContext.TraceID())
+	}
+	if stage.Parent.SpanID() != run.SpanContext.SpanID() || exec.Parent.SpanID() != stage.SpanContext.SpanID() {
+		t.Errorf("expected the command to be traced within the stage, and the stage within the run")
+	}
+	if !strings.Contains(string(output), exec.SpanContext.SpanID().String()) {
+		t.Errorf("expected the trace context of the command in its environment, got %s", output)
+	}
+}
+
+func TestLiterature(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "literature.csv")
+	if err := os.WriteFile(name, []byte("trajectory,reference\nE11 -> N18,Doe 2020\nCOPD -> Cough,Roe 2019\n"+
+		"Hypertension -> E11 -> N18,Poe 2021\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	known, err := trajectory.ReadLiterature(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(known) != 3 || known[2].String() != "Hypertension -> E11 -> N18" || known[0].Reference != "Doe 2020" {
+		t.Fatalf("unexpected known trajectories %v", known)
+	}
+	nameMap := map[int]string{0: "Type 2 diabetes", 1: "Hypertension", 2: "Chronic kidney disease", 3: "Cough"}
+	idMap := map[int]string{0: "E11.9", 1: "I10", 2: "N18", 3: "R05"}
+	t1 := &trajectory.Trajectory{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{5, 4}}
+	t2 := &trajectory.Trajectory{Diagnoses: []int{2, 0}, PatientNumbers: []int{5}}
+	matches := trajectory.MatchLiterature(known, []*trajectory.Trajectory{t1, t2}, nameMap, idMap)
+	// E11 matches E11.9 with a diagnosis in between, the order of the other known trajectories does not match
+	if len(matches[t1]) != 1 || matches[t1][0] != known[0] || len(matches[t2]) != 0 {
+		t.Errorf("expected only the first trajectory to replicate Doe 2020, got %v", matches)
+	}
+	out := filepath.Join(dir, "out.csv")
+	trajectory.PrintLiteratureToCSVFile([]*trajectory.Trajectory{t1, t2}, nameMap, matches, out)
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Trajectory,Status,KnownTrajectories,References\n" +
+		"Type 2 diabetes -> Hypertension -> Chronic kidney disease,known,E11 -> N18,Doe 2020\n" +
+		"Chronic kidney disease -> Type 2 diabetes,novel,,\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+	if err := os.WriteFile(name, []byte("trajectory,reference\nE11,Doe 2020\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trajectory.ReadLiterature(name); err == nil {
+		t.Errorf("expected an error for a known trajectory with one diagnosis")
+	}
+}
+
+func TestValidateExperiment(t *testing.T) {
+	newExperiment := func() *trajectory.Experiment {
+		return &trajectory.Experiment{Name: "exp1", NofDiagnosisCodes: 3, DxDRR: trajectory.MakeDxDRR(3),
+			NameMap:      map[int]string{0: "Cough", 1: "Dyspnea", 2: "COPD"},
+			Trajectories: []*trajectory.Trajectory{{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{5, 3}}}}
+	}
+	if err := trajectory.ValidateExperiment(newExperiment()); err != nil {
+		t.Fatal(err)
+	}
+	exp := newExperiment()
+	exp.Trajectories[0].Diagnoses[2] = 3
+	if err := trajectory.ValidateExperiment(exp); err == nil || !strings.Contains(err.Error(), "diagnosis ID 3") {
+		t.Errorf("expected an error for diagnosis ID 3, got %v", err)
+	}
+	exp = newExperiment()
+	delete(exp.NameMap, 1)
+	if err := trajectory.ValidateExperiment(exp); err == nil || !strings.Contains(err.Error(), "diagnosis ID 1") {
+		t.Errorf("expected an error for the missing medical term of diagnosis ID 1, got %v", err)
+	}
+	exp = newExperiment()
+	exp.DxDRR = trajectory.MakeDxDRR(2)
+	if err := trajectory.ValidateExperiment(exp); err == nil {
+		t.Errorf("expected an error for an RR matrix of the wrong size")
+	}
+	if err := trajectory.ValidateClusters(exp, [][]int{{0}, {1}}); err == nil ||
+		!strings.Contains(err.Error(), "trajectory 1") {
+		t.Errorf("expected an error for trajectory 1, got %v", err)
+	}
+	// a .ptra file with a trajectory that refers to a diagnosis without a medical term
+	exp = newExperiment()
+	exp.Trajectories = append(exp.Trajectories, &trajectory.Trajectory{Diagnoses: []int{0, 5}, PatientNumbers: []int{2}})
+	var buf bytes.Buffer
+	if err := trajectory.WritePtra(&buf, exp, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := trajectory.ReadPtra(&buf); err == nil || !strings.Contains(err.Error(), "diagnosis ID 5") {
+		t.Errorf("expected an error for diagnosis ID 5, got %v", err)
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	var messages, warnings bytes.Buffer
+	utils.SetOutput(&messages)
+	log.SetOutput(&warnings)
+	defer func() {
+		utils.SetOutput(os.Stderr)
+		log.SetOutput(os.Stderr)
+		utils.SetVerbosity(utils.Normal)
+	}()
+	exp := &trajectory.Experiment{NameMap: map[int]string{0: "Cough", 1: "COPD"}}
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{3}}
+	report := func() {
+		utils.Info("progress")
+		trajectory.PrintTrajectory(tr, exp)
+		trajectory.WarnSkippedTrajectories(1, "testing")
+	}
+	for _, c := range []struct {
+		verbosity        utils.Verbosity
+		progress, detail bool
+		warning          bool
+	}{
+		{utils.Silent, false, false, false},
+		{utils.Quiet, false, false, true},
+		{utils.Normal, true, false, true},
+		{utils.Verbose, true, true, true},
+	} {
+		messages.Reset()
+		warnings.Reset()
+		utils.SetVerbosity(c.verbosity)
+		report()
+		if strings.Contains(messages.String(), "progress") != c.progress ||
+			strings.Contains(messages.String(), "Cough -- 3 --> COPD") != c.detail ||
+			strings.Contains(warnings.String(), "Warning: skipped") != c.warning {
+			t.Errorf("unexpected output for verbosity %d: %q, %q", c.verbosity, messages.String(), warnings.String())
+		}
+	}
+}
+
+func TestFormatVersions(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "exp1-trajectories.tab")
+	read := func(contents string) error {
+		if err := os.WriteFile(name, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := trajectory.ReadTrajectoriesFromTabFile(name)
+		return err
+	}
+	if err := read("Cough\tCOPD\n3\n"); err != nil {
+		t.Errorf("expected a file without format version to be read, got %v", err)
+	}
+	if err := read("# ptra trajectories format 1\nCough\tCOPD\n3\n"); err != nil {
+		t.Error(err)
+	}
+	if err := read("# ptra trajectories format 2\nCough\tCOPD\n3\n"); err == nil ||
+		!strings.Contains(err.Error(), "upgrade ptra") {
+		t.Errorf("expected an upgrade error for a newer format version, got %v", err)
+	}
+	if err := read("# ptra pairs format 1\nCough\tCOPD\t2.5\n"); err == nil ||
+		!strings.Contains(err.Error(), "is a pairs file") {
+		t.Errorf("expected an error for a pairs file, got %v", err)
+	}
+	// the saved RR matrix round trips with its format line, but is rejected as patients of the diagnosis pairs
+	exp := &trajectory.Experiment{NofDiagnosisCodes: 2, NameMap: map[int]string{0: "Cough", 1: "COPD"},
+		DxDRR: trajectory.MakeDxDRR(2), DxDPatients: trajectory.MakeDxDPatients(2)}
+	exp.DxDRR[0][1] = 2.5
+	rrFile := filepath.Join(dir, "rr.tab")
+	trajectory.SaveRRMatrix(exp, rrFile)
+	loaded := &trajectory.Experiment{NofDiagnosisCodes: 2, NameMap: exp.NameMap, DxDRR: trajectory.MakeDxDRR(2)}
+	trajectory.LoadRRMatrix(loaded, rrFile)
+	if loaded.DxDRR[0][1] != 2.5 {
+		t.Errorf("expected RR 2.5, got %f", loaded.DxDRR[0][1])
+	}
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "is a rr-matrix file") {
+			t.Errorf("expected a panic for an RR matrix loaded as DxD patients, got %v", r)
+		}
+	}()
+	trajectory.LoadDxDPatients(loaded, &trajectory.PatientMap{}, rrFile)
+}
+
+func TestSexSpecificRelativeRiskRatios(t *testing.T) {
+	// diabetes is followed by kidney disease in most exposed males, but as often in females with and without diabetes
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*trajectory.Patient{}}
+	dPatients := make([][]*trajectory.Patient, 2)
+	for i := 0; i < 400; i++ {
+		p := &trajectory.Patient{PID: i, PIDString: fmt.Sprint(i), YOB: 1950 + i%20, Sex: trajectory.Male}
+		if i >= 200 {
+			p.Sex = trajectory.Female
+		}
+		exposed := i%2 == 0
+		if exposed {
+			p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: i, DID: 0,
+				Date: trajectory.DiagnosisDate{Year: 2000, Month: 1, Day: 1}})
+		}
+		var followed bool
+		if p.Sex == trajectory.Male {
+			followed = (exposed && i%10 != 0) || (!exposed && i%10 == 1)
+		} else {
+			followed = i%4 < 2
+		}
+		if followed {
+			p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: i, DID: 1,
+				Date: trajectory.DiagnosisDate{Year: 2001, Month: 1, Day: 1}})
+		}
+		for _, d := range p.Diagnoses {
+			dPatients[d.DID] = append(dPatients[d.DID], p)
+		}
+		pMap.PIDMap[i] = p
+		pMap.PIDStringMap[p.PIDString] = i
+		pMap.Ctr++
+	}
+	trajectory.AssignCohortAges(pMap, 2)
+	cohorts := trajectory.InitializeCohorts(pMap, 2, 1, 2)
+	exp := &trajectory.Experiment{NofAgeGroups: 2, NofRegions: 1, NofDiagnosisCodes: 2, DxDRR: trajectory.MakeDxDRR(2),
+		DxDPatients: trajectory.MakeDxDPatients(2), Cohorts: cohorts,
+		DPatients: dPatients, Name: "exp",
+		NameMap:      map[int]string{0: "Diabetes", 1: "Kidney disease"},
+		Trajectories: []*trajectory.Trajectory{{Diagnoses: []int{0, 1}, PatientNumbers: []int{130}}}}
+	transitions := trajectory.SexSpecificRelativeRiskRatios(exp, 0, 5, 50, trajectory.RRCount)
+	if len(transitions) != 1 {
+		t.Fatalf("expected 1 transition, got %d", len(transitions))
+	}
+	tr := transitions[0]
+	if tr.Male.Exposed != 100 || tr.Male.Followed != 80 || tr.Female.Exposed != 100 || tr.Female.Followed != 50 {
+		t.Fatalf("unexpected exposed and followed patients %+v", tr)
+	}
+	if !tr.Male.Significant() || math.Abs(tr.Male.RR-4) > 0.1 {
+		t.Errorf("expected a significant male RR of 4, got %+v", tr.Male)
+	}
+	if tr.Female.Significant() || math.Abs(tr.Female.RR-1) > 0.1 {
+		t.Errorf("expected a non-significant female RR of about 1, got %+v", tr.Female)
+	}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "exp-trajectories-by-sex.gml")
+	trajectory.PrintSexSpecificGraphToFile(exp, transitions, name)
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "label \"M ") || strings.Contains(string(content), "label \"F ") {
+		t.Errorf("expected only a male edge, got %s", content)
+	}
+	trajectory.PrintSexSpecificTransitionsToCSVFile(exp, transitions, filepath.Join(dir, "exp-transitions-by-sex.csv"))
+}
+
+func TestSetOperations(t *testing.T) {
+	if utils.Min(3, 2) != 2 || utils.Max(2.5, 1.0) != 2.5 || utils.Min("b", "a") != "a" {
+		t.Errorf("unexpected Min or Max")
+	}
+	if !utils.Member("I10", []string{"E11", "I10"}) || utils.Member(3, []int{1, 2}) || utils.Member(1, nil) {
+		t.Errorf("unexpected Member")
+	}
+	if unique := utils.Unique([]int{3, 1, 3, 2, 1}); !reflect.DeepEqual(unique, []int{3, 1, 2}) {
+		t.Errorf("expected the first occurrences in order, got %v", unique)
+	}
+	// duplicates are counted once
+	if n := utils.IntersectionSize([]int{1, 2, 2, 3}, []int{2, 3, 3, 4}); n != 2 {
+		t.Errorf("expected an intersection of 2 elements, got %d", n)
+	}
+	if common := utils.SortedIntersection([]int{1, 2, 2, 5, 7}, []int{2, 2, 3, 5, 8}); !reflect.DeepEqual(common,
+		[]int{2, 5}) {
+		t.Errorf("expected [2 5], got %v", common)
+	}
+	if common := utils.SortedIntersection([]int{1}, []int{}); len(common) != 0 {
+		t.Errorf("expected an empty intersection, got %v", common)
+	}
+	set := utils.NewSet(1, 2)
+	set.Add(3)
+	if !set.Contains(3) || set.Contains(4) || len(set) != 3 {
+		t.Errorf("unexpected set %v", set)
+	}
+}
+
+func TestReview(t *testing.T) {
+	exp := &trajectory.Experiment{Name: "exp", NameMap: map[int]string{0: "Cough", 1: "Dyspnea", 2: "COPD"},
+		Trajectories: []*trajectory.Trajectory{{Diagnoses: []int{0, 1, 2}, PatientNumbers: []int{5, 3}},
+			{Diagnoses: []int{0, 2}, PatientNumbers: []int{4}}, {Diagnoses: []int{1, 2}, PatientNumbers: []int{6}}}}
+	dir := t.TempDir()
+	sheet := filepath.Join(dir, "exp-trajectories-review.csv")
+	trajectory.PrintReviewSheetToCSVFile(exp, nil, sheet)
+	content, err := os.ReadFile(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Trajectory,Patients,Decision,MergeInto,Comment\nCough -> Dyspnea -> COPD,3,,,\nCough -> COPD,4,,,\n" +
+		"Dyspnea -> COPD,6,,,\n"
+	if string(content) != expected {
+		t.Fatalf("expected %q, got %q", expected, content)
+	}
+	// a sheet as edited in a spreadsheet, without the trailing empty columns
+	if err := os.WriteFile(sheet, []byte("Trajectory,Patients,Decision,MergeInto,Comment\n"+
+		"Cough -> Dyspnea -> COPD,3,Merge,Cough -> COPD,same pathway\nDyspnea -> COPD,6,reject\n"+
+		"Cough -> Fever,2,accept\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	review, err := trajectory.ReadReview(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trajectory.ApplyReview(exp, review); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.Trajectories) != 1 || len(exp.Trajectories[0].Diagnoses) != 2 {
+		t.Errorf("expected only Cough -> COPD to be kept, got %d trajectories", len(exp.Trajectories))
+	}
+	// merging into a rejected trajectory is an error
+	review["Cough -> COPD"] = &trajectory.ReviewDecision{Trajectory: "Cough -> COPD", Decision: trajectory.ReviewReject}
+	review["Dyspnea -> COPD"] = &trajectory.ReviewDecision{Trajectory: "Dyspnea -> COPD",
+		Decision: trajectory.ReviewMerge, MergeInto: "Cough -> COPD"}
+	exp.Trajectories = append(exp.Trajectories, &trajectory.Trajectory{Diagnoses: []int{1, 2}, PatientNumbers: []int{6}})
+	if err := trajectory.ApplyReview(exp, review); err == nil || !strings.Contains(err.Error(), "marked reject") {
+		t.Errorf("expected an error for merging into a rejected trajectory, got %v", err)
+	}
+	if err := os.WriteFile(sheet, []byte("Trajectory,Patients,Decision\nCough -> COPD,4,maybe\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trajectory.ReadReview(sheet); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for an unknown decision on line 2, got %v", err)
+	}
+}
+
+func TestDeltaExports(t *testing.T) {
+	dir := t.TempDir()
+	manifest, changelog := filepath.Join(dir, "r1.manifest.json"), filepath.Join(dir, "r1.changelog.csv")
+	write := func(name string, parts ...string) {
+		file, err := utils.CreateFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range parts {
+			if _, err := fmt.Fprint(file, part); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(files map[string][]string) string {
+		if err := utils.StartDelta(manifest); err != nil {
+			t.Fatal(err)
+		}
+		for name, parts := range files {
+			write(name, parts...)
+		}
+		if err := utils.FinishDelta(manifest, changelog); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(changelog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[1:] {
+			fields := strings.Split(line, ",")
+			statuses = append(statuses, fields[0]+":"+fields[1])
+		}
+		return strings.Join(statuses, " ")
+	}
+	if statuses := run(map[string][]string{"same.tab": {"a\t", "b\n"}, "longer.tab": {"a\n"},
+		"shorter.tab": {"a\n", "b\n"}, "old.tab": {"x"}}); statuses !=
+		"longer.tab:added old.tab:added same.tab:added shorter.tab:added" {
+		t.Fatalf("unexpected statuses %s", statuses)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "same.tab"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := run(map[string][]string{"same.tab": {"a\tb", "\n"}, "longer.tab": {"a\n", "b\n"},
+		"shorter.tab": {"a\n"}}); statuses != "longer.tab:changed old.tab:stale same.tab:unchanged shorter.tab:changed" {
+		t.Fatalf("unexpected statuses %s", statuses)
+	}
+	for name, expected := range map[string]string{"same.tab": "a\tb\n", "longer.tab": "a\nb\n", "shorter.tab": "a\n"} {
+		if content, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != expected {
+			t.Errorf("expected %s to contain %q, got %q (%v)", name, expected, content, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "same.tab")); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("expected the unchanged file to be left untouched")
+	}
+	// without delta exports, the files are simply created
+	write("same.tab", "c\n")
+	if content, _ := os.ReadFile(filepath.Join(dir, "same.tab")); string(content) != "c\n" {
+		t.Errorf("expected the file to be rewritten, got %q", content)
+	}
+}
+
+func TestCodeValidity(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "validity.csv")
+	if err := os.WriteFile(name, []byte("code,validFrom,validTo\nU07,2019,\nU07.2,2019-06-01,2021\nX99,,2010\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	codeValidity, err := trajectory.ReadCodeValidity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	year := func(y, m, d int) float64 {
+		return trajectory.DiagnosisDateToFloat(trajectory.DiagnosisDate{Year: y, Month: m, Day: d})
+	}
+	// U07.1 gets the validity period of U07, and X99.1 and U07.2 are grouped into a diagnosis spanning both
+	validity := trajectory.DiagnosisValidity(map[string][]int{"E11": {0}, "U07.1": {1}, "U07.2": {2}, "X99.1": {2}},
+		codeValidity, 4)
+	expected := []trajectory.ValidityPeriod{trajectory.AlwaysValid, {From: year(2019, 1, 1), To: math.Inf(1)},
+		{From: math.Inf(-1), To: year(2021, 12, 31)}, trajectory.AlwaysValid}
+	if !reflect.DeepEqual(validity, expected) {
+		t.Fatalf("expected validity periods %v, got %v", expected, validity)
+	}
+	if compacted := trajectory.CompactValidity(validity, []int{1, 2}); !reflect.DeepEqual(compacted, expected[1:3]) {
+		t.Errorf("expected compacted validity periods %v, got %v", expected[1:3], compacted)
+	}
+	if err := os.WriteFile(name, []byte("code,validFrom,validTo\nU07,2021,2019\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trajectory.ReadCodeValidity(name); err == nil {
+		t.Errorf("expected an error for a code that is retired before it is introduced")
+	}
+	// all patients are diagnosed with U07.1 in 2020, but are followed up since 2000 without exposure to diabetes
+	rr := func(validity []trajectory.ValidityPeriod) float64 {
+		pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*trajectory.Patient{}}
+		dPatients := make([][]*trajectory.Patient, 3)
+		for i := 0; i < 200; i++ {
+			p := &trajectory.Patient{PID: i, PIDString: fmt.Sprint(i), YOB: 1950 + i%20, Sex: trajectory.Male}
+			diagnose := func(did, year int) {
+				p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: i, DID: did,
+					Date: trajectory.DiagnosisDate{Year: year, Month: 1, Day: 1}})
+			}
+			if i%2 == 0 {
+				diagnose(0, 2018)
+				diagnose(1, 2020)
+			} else {
+				diagnose(2, 2000)
+				if i%4 == 1 {
+					diagnose(1, 2020)
+				} else {
+					diagnose(2, 2020)
+				}
+			}
+			for _, d := range p.Diagnoses {
+				dPatients[d.DID] = append(dPatients[d.DID], p)
+			}
+			pMap.PIDMap[i] = p
+			pMap.PIDStringMap[p.PIDString] = i
+			pMap.Ctr++
+		}
+		trajectory.AssignCohortAges(pMap, 2)
+		exp := &trajectory.Experiment{NofAgeGroups: 2, NofRegions: 1, NofDiagnosisCodes: 3,
+			DxDRR: trajectory.MakeDxDRR(3), DxDPatients: trajectory.MakeDxDPatients(3),
+			Cohorts: trajectory.InitializeCohorts(pMap, 2, 1, 3), DPatients: dPatients, Name: "exp",
+			Trajectories: []*trajectory.Trajectory{{Diagnoses: []int{0, 1}, PatientNumbers: []int{100}}},
+			Validity:     validity}
+		return trajectory.SexSpecificRelativeRiskRatios(exp, 0, 5, 50, trajectory.RRPersonTime)[0].Male.RR
+	}
+	// 100 events in 200 years against about 50 events in 2000 years, and in 100 years within the validity period
+	if withoutValidity := rr(nil); withoutValidity < 10 {
+		t.Errorf("expected an inflated RR of about 20 without validity periods, got %f", withoutValidity)
+	}
+	if withValidity := rr(validity[:3]); withValidity < 1.5 || withValidity > 3 {
+		t.Errorf("expected an RR of about 2 with validity periods, got %f", withValidity)
+	}
+}
+
+func TestClusterCohortDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	conceptFile := filepath.Join(dir, "CONCEPT.csv")
+	if err := os.WriteFile(conceptFile, []byte("concept_id\tconcept_name\tdomain_id\tvocabulary_id\t"+
+		"concept_class_id\tstandard_concept\tconcept_code\tvalid_start_date\tvalid_end_date\tinvalid_reason\n"+
+		"1567956\tType 2 diabetes mellitus\tCondition\tICD10CM\t3-char nonbill code\t\tE11\t19700101\t20991231\t\n"+
+		"45533022\tType 2 diabetes mellitus with hyperglycemia\tCondition\tICD10CM\t5-char billing code\t\tE11.65\t"+
+		"20071001\t20991231\t\n"+
+		"1567940\tType 1 diabetes mellitus\tCondition\tICD10CM\t3-char nonbill code\t\tE10\t19700101\t20991231\t\n"+
+		"201826\tType 2 diabetes mellitus\tCondition\tSNOMED\tClinical Finding\tS\t44054006\t19700101\t20991231\t\n"+
+		"1569178\tChronic kidney disease\tCondition\tICD10CM\t3-char nonbill code\t\tN18\t19700101\t20991231\t\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	concepts, err := trajectory.ReadOMOPConcepts(conceptFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(concepts) != 4 {
+		t.Fatalf("expected the 4 ICD10CM concepts, got %d", len(concepts))
+	}
+	if matching := concepts.Matching("E11"); len(matching) != 2 || matching[0].Code != "E11" ||
+		matching[1].Code != "E11.65" {
+		t.Errorf("expected the concepts of E11 and E11.65, got %v", matching)
+	}
+	exp := &trajectory.Experiment{Name: "exp", MinTime: 0.5, MaxTime: 5,
+		NameMap: map[int]string{0: "Diabetes", 1: "Hypertension", 2: "Kidney disease"},
+		IdMap:   map[int]string{0: "E11", 1: "I10", 2: "N18"},
+		Trajectories: []*trajectory.Trajectory{{ID: 0, Diagnoses: []int{0, 1, 2}, Cluster: 0},
+			{ID: 1, Diagnoses: []int{0, 2}, Cluster: 0}, {ID: 2, Diagnoses: []int{0, 2}, Cluster: 0}}}
+	trajectory.PrintClusterCohortDefinitionsToFiles(exp, concepts, filepath.Join(dir, "cohorts"))
+	content, err := os.ReadFile(filepath.Join(dir, "cohorts", "cluster-0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the consensus is diabetes -> kidney disease, since only one of the trajectories has hypertension
+	var cohort struct {
+		ConceptSets []struct {
+			ID         int `json:"id"`
+			Expression struct {
+				Items []struct {
+					Concept struct {
+						ConceptID int64 `json:"CONCEPT_ID"`
+					} `json:"concept"`
+				} `json:"items"`
+			} `json:"expression"`
+		}
+		PrimaryCriteria struct {
+			CriteriaList []struct {
+				ConditionOccurrence struct {
+					ConditionSourceConcept int
+					First                  bool
+				}
+			}
+		}
+		InclusionRules []struct {
+			Expression struct {
+				CriteriaList []struct {
+					Criteria struct {
+						ConditionOccurrence struct {
+							ConditionSourceConcept int
+						}
+					}
+					StartWindow struct {
+						Start, End struct {
+							Days *int
+						}
+					}
+				}
+			} `json:"expression"`
+		} `json:"InclusionRules"`
+	}
+	if err := json.Unmarshal(content, &cohort); err != nil {
+		t.Fatal(err)
+	}
+	if len(cohort.ConceptSets) != 2 || len(cohort.ConceptSets[0].Expression.Items) != 2 ||
+		cohort.ConceptSets[1].Expression.Items[0].Concept.ConceptID != 1569178 {
+		t.Fatalf("expected concept sets for E11 and N18, got %s", content)
+	}
+	if index := cohort.PrimaryCriteria.CriteriaList[0].ConditionOccurrence; index.ConditionSourceConcept != 0 ||
+		!index.First {
+		t.Errorf("expected the first diabetes diagnosis as index event, got %+v", index)
+	}
+	if len(cohort.InclusionRules) != 1 {
+		t.Fatalf("expected 1 inclusion rule, got %d", len(cohort.InclusionRules))
+	}
+	next := cohort.InclusionRules[0].Expression.CriteriaList[0]
+	if next.Criteria.ConditionOccurrence.ConditionSourceConcept != 1 || next.StartWindow.Start.Days == nil ||
+		*next.StartWindow.Start.Days != 183 || next.StartWindow.End.Days == nil || *next.StartWindow.End.Days != 1826 {
+		t.Errorf("expected kidney disease 183 to 1826 days after diabetes, got %+v", next)
+	}
+	index, err := os.ReadFile(filepath.Join(dir, "cohorts", "index.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(index), "0\tcluster-0.json\t3\tDiabetes -> Kidney disease") {
+		t.Errorf("unexpected index %s", index)
+	}
+}
+
+func TestClusterChapterCompositions(t *testing.T) {
+	exp := &trajectory.Experiment{Name: "exp",
+		Hierarchy: map[int][]string{0: {"Endocrine", "Diabetes"}, 1: {"Circulatory", "Hypertension"},
+			2: {"Genitourinary", "Kidney disease"}, 3: {"Endocrine", "Obesity"}},
+		Trajectories: []*trajectory.Trajectory{{ID: 0, Diagnoses: []int{3, 0, 2}, Cluster: 0},
+			{ID: 1, Diagnoses: []int{0, 2}, Cluster: 0}, {ID: 2, Diagnoses: []int{1, 4}, Cluster: 1}}}
+	compositions := trajectory.ClusterChapterCompositions(exp)
+	expected := []trajectory.ChapterComposition{
+		{Cluster: 0, Chapters: []trajectory.ChapterShare{{Chapter: "Endocrine", Diagnoses: 2, Occurrences: 3,
+			Percentage: 60}, {Chapter: "Genitourinary", Diagnoses: 1, Occurrences: 2, Percentage: 40}}},
+		// diagnosis 4 is outside the hierarchy
+		{Cluster: 1, Chapters: []trajectory.ChapterShare{{Chapter: "Circulatory", Diagnoses: 1, Occurrences: 1,
+			Percentage: 50}, {Chapter: "Other", Diagnoses: 1, Occurrences: 1, Percentage: 50}}},
+	}
+	if !reflect.DeepEqual(compositions, expected) {
+		t.Errorf("expected compositions %v, got %v", expected, compositions)
+	}
+	dir := t.TempDir()
+	trajectory.PrintClusterChapterCompositionsToFiles(exp, filepath.Join(dir, "chapters.csv"),
+		filepath.Join(dir, "chapters.json"))
+	content, err := os.ReadFile(filepath.Join(dir, "chapters.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "0,Endocrine,2,3,60.00\n") {
+		t.Errorf("expected the share of the endocrine chapter in cluster 0, got %s", content)
+	}
+	content, err = os.ReadFile(filepath.Join(dir, "chapters.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []trajectory.ChapterComposition
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected the compositions in the json file, got %v", decoded)
+	}
+}
+
+func TestEOIStrata(t *testing.T) {
+	date := func(year int) trajectory.DiagnosisDate { return trajectory.DiagnosisDate{Year: year, Month: 1, Day: 1} }
+	patient := func(pid, eoiYear int, dids ...int) *trajectory.Patient {
+		p := &trajectory.Patient{PID: pid, PIDString: fmt.Sprint(pid), YOB: 1950}
+		for i, did := range dids {
+			p.Diagnoses = append(p.Diagnoses, &trajectory.Diagnosis{PID: pid, DID: did, Date: date(2000 + 2*i)})
+		}
+		if eoiYear > 0 {
+			eoiDate := date(eoiYear)
+			p.EOIDate = &eoiDate
+		}
+		return p
+	}
+	// patients 1 and 2 reach the event of interest within 3 years and follow 0 -> 1, patient 3 later and follows
+	// 0 -> 2, and patient 4 has no event of interest
+	patients := &trajectory.PatientMap{PIDMap: map[int]*trajectory.Patient{1: patient(1, 2003, 0, 1),
+		2: patient(2, 2002, 0, 1), 3: patient(3, 2010, 0, 2), 4: patient(4, 0, 0, 1)}}
+	if years, ok := trajectory.TimeToEOI(patients.PIDMap[3]); !ok || years != 10 {
+		t.Errorf("expected 10 years to the event of interest, got %v", years)
+	}
+	early, late := trajectory.EOIStrata(patients, 3)
+	if !reflect.DeepEqual(early, map[int]bool{1: true, 2: true}) || !reflect.DeepEqual(late, map[int]bool{3: true}) {
+		t.Fatalf("expected patients 1 and 2 in the early stratum and patient 3 in the late stratum, got %v and %v",
+			early, late)
+	}
+	exp := &trajectory.Experiment{Name: "exp", NofAgeGroups: 1, NofRegions: 1, NofDiagnosisCodes: 3,
+		NameMap: map[int]string{0: "A", 1: "B", 2: "C"}}
+	earlyExp, earlyPatients := trajectory.StratumExperiment(exp, patients, trajectory.EarlyEOI, early)
+	lateExp, latePatients := trajectory.StratumExperiment(exp, patients, trajectory.LateEOI, late)
+	if earlyExp.Name != "exp-eoi-early" || len(earlyPatients.PIDMap) != 2 || len(latePatients.PIDMap) != 1 {
+		t.Fatalf("unexpected strata %s with %d and %d patients", earlyExp.Name, len(earlyPatients.PIDMap),
+			len(latePatients.PIDMap))
+	}
+	earlyExp.MinTime, earlyExp.MaxTime, lateExp.MinTime, lateExp.MaxTime = 1, 5, 1, 5
+	earlyExp.Trajectories = []*trajectory.Trajectory{{Diagnoses: []int{0, 1}}}
+	lateExp.Trajectories = []*trajectory.Trajectory{{Diagnoses: []int{0, 2}}, {Diagnoses: []int{0, 1}}}
+	comparisons := trajectory.CompareEOIStrata(earlyExp, lateExp, earlyPatients, latePatients)
+	if len(comparisons) != 2 {
+		t.Fatalf("expected 2 compared trajectories, got %d", len(comparisons))
+	}
+	for _, c := range comparisons {
+		switch fmt.Sprint(c.Trajectory.Diagnoses) {
+		case "[0 1]":
+			if c.Discovered != "both" || c.Case != 2 || c.Comparator != 0 {
+				t.Errorf("expected 0 -> 1 in both strata, followed by 2 early patients, got %+v", c)
+			}
+		case "[0 2]":
+			if c.Discovered != trajectory.LateEOI || c.Case != 0 || c.Comparator != 1 {
+				t.Errorf("expected 0 -> 2 in the late stratum, followed by 1 late patient, got %+v", c)
+			}
+		}
+	}
+}
+
+// demoExperiment builds the trajectories of a synthetic cohort, cf. app.WriteDemoData, and writes them to an output
+// directory in dir, which it returns.
+func demoExperiment(t *testing.T, dir string, nofPatients int) (*trajectory.Experiment, string) {
+	patientFile, diagnosisFile, vocabularyFile, err := app.WriteDemoData(filepath.Join(dir, "input"), nofPatients, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := app.ParseTriNetXData("exp1", patientFile, diagnosisFile, vocabularyFile, "", "", 6, 3, 0.5, 5, "",
+		false, []trajectory.PatientFilter{}, "", 0, "")
+	trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0.5, 5, 100, trajectory.RRPersonTime, 10, 1.0, true)
+	trajectory.BuildTrajectories(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	if len(exp.Trajectories) == 0 {
+		t.Fatal("expected trajectories for the progressions of the synthetic cohort")
+	}
+	output := filepath.Join(dir, "output") + string(filepath.Separator)
+	if err := os.MkdirAll(output, 0700); err != nil {
+		t.Fatal(err)
+	}
+	trajectory.PrintTrajectoriesToFile(exp, output)
+	return exp, output
+}
+
+func TestSimilarityFunc(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	var calls atomic.Int64 // the similarities are computed in parallel
+	options := cluster.Options{Granularities: []int{20}, Native: true,
+		SimilarityFunc: func(t1, t2 *trajectory.Trajectory) float64 {
+			calls.Add(1)
+			return 0
+		}}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() == 0 {
+		t.Fatal("expected the custom similarity to be used")
+	}
+	// without similar trajectories, each trajectory is its own cluster
+	clusters := trajectory.CollectClusters(exp)
+	if len(clusters) != len(exp.Trajectories) {
+		t.Errorf("expected %d singleton clusters, got %d clusters", len(exp.Trajectories), len(clusters))
+	}
+	t1 := &trajectory.Trajectory{Diagnoses: []int{0, 1, 2}}
+	t2 := &trajectory.Trajectory{Diagnoses: []int{1, 2}}
+	if s := cluster.SzymkiewiczSimpsonTrajectory(t1, t2); s != 1 {
+		t.Errorf("expected an overlap of 1 for a contained trajectory, got %v", s)
+	}
+	if s := cluster.SorensenDiceTrajectory(t1, t2); s != 0.8 {
+		t.Errorf("expected a Sorensen-Dice coefficient of 0.8, got %v", s)
+	}
+}
+
+func TestDemo(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	options := cluster.Options{Granularities: []int{14}, Native: true, Similarity: cluster.JaccardSimilarity}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	ts, _, summaries, err := trajectory.ReadClusteredTrajectoriesFromTabFile(filepath.Join(output,
+		"exp1-clusters-directly", "dump.exp1.mci.I14.clustered.trajectories.tab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != len(exp.Trajectories) || len(summaries) == 0 {
+		t.Fatalf("expected %d clustered trajectories, got %d in %d clusters", len(exp.Trajectories), len(ts),
+			len(summaries))
+	}
+	// trajectories with the same diagnoses must end up in the same cluster
+	clusters := map[string]int{}
+	for _, tr := range ts {
+		key := fmt.Sprint(tr.Diagnoses)
+		if cid, ok := clusters[key]; ok && cid != tr.Cluster {
+			t.Errorf("expected trajectory %v in cluster %d, got %d", tr.Diagnoses, cid, tr.Cluster)
+		}
+		clusters[key] = tr.Cluster
+	}
+	if err := server.WriteReport(output, "report.html"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := os.ReadFile(filepath.Join(output, "report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(report), "<svg") || !strings.Contains(string(report), "Type 2 diabetes mellitus") {
+		t.Errorf("expected the cluster graphs and the trajectories in the report")
+	}
+}
+
+func TestStatisticsBackends(t *testing.T) {
+	reference, err := utils.StatisticsBackendByName(utils.ReferenceBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alternate, err := utils.StatisticsBackendByName(utils.AlternateBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.StatisticsBackendByName("R"); err == nil {
+		t.Error("expected an error for an unknown statistics backend")
+	}
+	checked := utils.NewCrossCheckedStatistics(reference, alternate)
+	for _, table := range [][4]int{{3, 1, 1, 3}, {0, 10, 10, 0}, {12, 5, 7, 30}, {1, 200, 40, 3000}, {0, 0, 0, 0}} {
+		checked.FisherExactTest(table[0], table[1], table[2], table[3])
+	}
+	for _, trials := range [][2]int{{10, 7}, {20, 10}, {101, 80}, {2000, 1050}, {5, 0}} {
+		checked.BinomialCdf(0.5, trials[0], trials[1])
+	}
+	xs, ys := []float64{1, 2, 2, 3, 5, 8, 13, 21, 34, 55, 89}, []float64{2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37}
+	checked.MannWhitneyUTest(xs, ys)
+	checked.MannWhitneyUTest(ys, []float64{1, 1})
+	checked.MannWhitneyUTest(xs, nil)
+	checked.BenjaminiHochberg([]float64{0.01, 0.04, 0.03, 0.5, 0.04, 0.001})
+	if checked.Discrepancies() != 0 || checked.Checks() != 19 {
+		t.Errorf("expected 19 checks without discrepancies, got %d of %d", checked.Discrepancies(), checked.Checks())
+	}
+	// the seeded generators give the same numbers for the same seed
+	for _, name := range []string{utils.ReferenceBackend, utils.AlternateBackend} {
+		backend, err := utils.RandomBackendByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r1, r2 := backend.New(42), backend.New(42)
+		for i := 0; i < 10; i++ {
+			if x1, x2 := r1.Intn(1000), r2.Intn(1000); x1 != x2 {
+				t.Errorf("expected the same random numbers of %s for the same seed, got %d and %d", name, x1, x2)
+			}
+		}
+		if x := backend.Shared().Float64(); x < 0 || x >= 1 {
+			t.Errorf("expected a random number of %s in [0, 1), got %v", name, x)
+		}
+	}
+}
+
+func TestExperimentStore(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := trajectory.NewExperimentStore(exp)
+	done := make(chan bool)
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				published := store.Load()
+				for _, tr := range published.AllTransitions() {
+					_ = tr.RR
+				}
+				for cid := range published.ClusterIDs() {
+					for range published.ClusterMembers(cid) {
+					}
+				}
+				published.PatientsMatchingPrefix(published.Trajectories[0].Diagnoses[:2])
+				trajectory.CollectClusters(published)
+			}
+		}()
+	}
+	err = store.Update(func(exp *trajectory.Experiment) error {
+		return cluster.ClusterTrajectoriesDirectly(exp, output, cluster.Options{Granularities: []int{14}, Native: true,
+			Similarity: cluster.JaccardSimilarity})
+	})
+	close(done)
+	readers.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clustered := store.Load()
+	if clustered == exp || len(clustered.Trajectories) != len(exp.Trajectories) {
+		t.Fatal("expected a clustered copy of the experiment to be published")
+	}
+	if len(trajectory.CollectClusters(clustered)) < 2 {
+		t.Error("expected the published experiment to be clustered")
+	}
+	if len(trajectory.CollectClusters(exp)) != 1 {
+		t.Error("expected the clustering to leave the previously published experiment unchanged")
+	}
+	if dir, err := os.Getwd(); err != nil || dir != wd {
+		t.Errorf("expected the clustering to leave the working directory %s unchanged, got %s", wd, dir)
+	}
+}
+
+func TestLCSTrajectory(t *testing.T) {
+	t1 := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	for _, test := range []struct {
+		diagnoses []int
+		expected  float64
+	}{
+		{[]int{1, 2, 3}, 1},
+		{[]int{1, 3}, 2.0 / 3},
+		{[]int{1, 4, 3}, 2.0 / 3},
+		{[]int{3, 2, 1}, 1.0 / 3},
+		{[]int{4, 5}, 0},
+		{[]int{}, 0},
+	} {
+		t2 := &trajectory.Trajectory{Diagnoses: test.diagnoses}
+		if s := cluster.LCSTrajectory(t1, t2); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("expected an LCS similarity of %v for %v, got %v", test.expected, test.diagnoses, s)
+		}
+		if s1, s2 := cluster.LCSTrajectory(t1, t2), cluster.LCSTrajectory(t2, t1); s1 != s2 {
+			t.Errorf("expected a symmetric LCS similarity for %v, got %v and %v", test.diagnoses, s1, s2)
+		}
+	}
+}
+
+func TestEditDistanceTrajectory(t *testing.T) {
+	t1 := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	for _, test := range []struct {
+		diagnoses []int
+		expected  float64
+	}{
+		{[]int{1, 2, 3}, 1},
+		{[]int{1, 4, 3}, 2.0 / 3},
+		{[]int{1, 3}, 2.0 / 3},
+		{[]int{1, 2, 3, 4}, 3.0 / 4},
+		{[]int{3, 2, 1}, 1.0 / 3},
+		{[]int{4, 5, 6}, 0},
+		{[]int{}, 0},
+	} {
+		t2 := &trajectory.Trajectory{Diagnoses: test.diagnoses}
+		if s := cluster.EditDistanceTrajectory(t1, t2); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("expected an edit distance similarity of %v for %v, got %v", test.expected, test.diagnoses, s)
+		}
+	}
+	// a substitution is closer than the set-based measures imply
+	t2 := &trajectory.Trajectory{Diagnoses: []int{1, 4, 3}}
+	if cluster.EditDistanceTrajectory(t1, t2) <= cluster.JaccardTrajectory(t1, t2) {
+		t.Error("expected the edit distance similarity to exceed the Jaccard similarity for a substitution")
+	}
+}
+
+func TestObservationGapFilter(t *testing.T) {
+	date := func(year, month int) *trajectory.Diagnosis {
+		return &trajectory.Diagnosis{Date: trajectory.DiagnosisDate{Year: year, Month: month, Day: 1}}
+	}
+	continuous := &trajectory.Patient{PID: 1, PIDString: "p1", Diagnoses: []*trajectory.Diagnosis{
+		date(2015, 1), date(2017, 1), date(2019, 1)}}
+	gapped := &trajectory.Patient{PID: 2, PIDString: "p2", Diagnoses: []*trajectory.Diagnosis{
+		date(2015, 1), date(2015, 6), date(2020, 1)}}
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{"p1": 1, "p2": 2},
+		PIDMap: map[int]*trajectory.Patient{1: continuous, 2: gapped}}
+	if gap, before := trajectory.LargestObservationGap(gapped); gap < 4.5 || gap > 4.6 ||
+		before != gapped.Diagnoses[1].Date {
+		t.Errorf("expected a gap of about 4.6 years after 2015-06-01, got %f after %v", gap, before)
+	}
+	filtered := trajectory.ApplyObservationGapFilter(pMap, 3)
+	if len(filtered.PIDMap) != 1 || filtered.PIDMap[1] != continuous || filtered.PIDStringMap["p1"] != 1 {
+		t.Fatalf("expected only patient p1 to remain, got %v", filtered.PIDStringMap)
+	}
+	if len(filtered.Exclusions) != 1 {
+		t.Fatalf("expected 1 exclusion, got %v", filtered.Exclusions)
+	}
+	if e := filtered.Exclusions[0]; e.PIDString != "p2" || e.Reason != trajectory.ExcludedObservationGap ||
+		e.Detail != "4.6 years after 2015-06-01" {
+		t.Errorf("unexpected exclusion %v", e)
+	}
+	if filtered = trajectory.ApplyObservationGapFilter(pMap, 5); len(filtered.PIDMap) != 2 {
+		t.Errorf("expected both patients to remain with a maximum gap of 5 years, got %d", len(filtered.PIDMap))
+	}
+}
+
+func TestDTWTrajectory(t *testing.T) {
+	// a trajectory D1 -> D2 whose patients get D2 the given number of years after D1
+	timed := func(years ...int) *trajectory.Trajectory {
+		patients := []*trajectory.Patient{}
+		for i, y := range years {
+			patients = append(patients, &trajectory.Patient{PID: i, Diagnoses: []*trajectory.Diagnosis{
+				{PID: i, DID: 1, Date: trajectory.DiagnosisDate{Year: 2010, Month: 1, Day: 1}},
+				{PID: i, DID: 2, Date: trajectory.DiagnosisDate{Year: 2010 + y, Month: 1, Day: 1}},
+			}})
+		}
+		return &trajectory.Trajectory{Diagnoses: []int{1, 2}, PatientNumbers: []int{len(patients)},
+			Patients: [][]*trajectory.Patient{patients}}
+	}
+	fast, slow := timed(1, 1, 2), timed(4, 4, 5)
+	if s := cluster.DTWTrajectory(fast, timed(1)); math.Abs(s-1) > 1e-2 {
+		t.Errorf("expected a DTW similarity of 1 for the same median timing, got %v", s)
+	}
+	if s := cluster.DTWTrajectory(fast, slow); math.Abs(s-0.625) > 1e-2 {
+		t.Errorf("expected a DTW similarity of 0.625 for durations of 1 and 4 years, got %v", s)
+	}
+	if cluster.DTWTrajectory(fast, slow) >= cluster.LCSTrajectory(fast, slow) {
+		t.Error("expected the DTW similarity to be below the LCS similarity for a different pace")
+	}
+	// without dates, only the order of the diagnoses counts
+	t1 := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	for _, test := range []struct {
+		diagnoses []int
+		expected  float64
+	}{
+		{[]int{1, 2, 3}, 1},
+		{[]int{1, 1, 2, 2, 3}, 1},
+		{[]int{1, 4, 3}, 2.0 / 3},
+		{[]int{4, 5, 6}, 0},
+		{[]int{}, 0},
+	} {
+		t2 := &trajectory.Trajectory{Diagnoses: test.diagnoses}
+		if s := cluster.DTWTrajectory(t1, t2); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("expected a DTW similarity of %v for %v, got %v", test.expected, test.diagnoses, s)
+		}
+	}
+}
+
+func TestDiagnosisBundles(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bundles.json")
+	if err := os.WriteFile(name, []byte(`[
+  {"Name": "Metabolic syndrome", "Codes": ["E66", "I10", "E78"], "MinCodes": 2, "Window": 1},
+  {"Name": "Asthma or COPD", "Code": "RESP", "Codes": ["J45", "J44"], "Keep": true}
+]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bundles, err := trajectory.LoadDiagnosisBundles(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundles[0].Code != "E66+I10+E78" || bundles[1].MinCodes != 1 {
+		t.Errorf("unexpected defaults %v and %v", bundles[0], bundles[1])
+	}
+	codeDIDs := map[string][]int{"E66.0": {0}, "I10": {1}, "E78.5": {2}, "J45.9": {3}, "J44": {4}, "C67": {5}}
+	date := func(did, year int) *trajectory.Diagnosis {
+		return &trajectory.Diagnosis{DID: did, Date: trajectory.DiagnosisDate{Year: year, Month: 1, Day: 1}}
+	}
+	within := &trajectory.Patient{PID: 1, PIDString: "p1", Diagnoses: []*trajectory.Diagnosis{
+		date(0, 2010), date(5, 2011), date(1, 2015), date(2, 2015), date(4, 2016)}}
+	apart := &trajectory.Patient{PID: 2, PIDString: "p2", Diagnoses: []*trajectory.Diagnosis{
+		date(0, 2010), date(1, 2013)}}
+	pMap := &trajectory.PatientMap{PIDStringMap: map[string]int{"p1": 1, "p2": 2},
+		PIDMap: map[int]*trajectory.Patient{1: within, 2: apart}}
+	if n := trajectory.ApplyDiagnosisBundles(pMap, bundles, codeDIDs, 6); n != 8 {
+		t.Errorf("expected 8 diagnosis codes including the bundles, got %d", n)
+	}
+	// metabolic syndrome replaces its diagnoses at the date of the second one within a year, and the respiratory
+	// bundle is added next to its diagnosis
+	dids := []int{}
+	for _, d := range within.Diagnoses {
+		dids = append(dids, d.DID)
+	}
+	if len(dids) != 4 || dids[0] != 5 || dids[1] != 6 || within.Diagnoses[1].Date.Year != 2015 ||
+		within.Diagnoses[2].Date.Year != 2016 || within.Diagnoses[3].Date.Year != 2016 {
+		t.Errorf("unexpected bundled diagnoses %v", dids)
+	}
+	if len(apart.Diagnoses) != 2 || apart.Diagnoses[0].DID != 0 || apart.Diagnoses[1].DID != 1 {
+		t.Errorf("expected the diagnoses more than a year apart not to be bundled, got %v", apart.Diagnoses)
+	}
+	if err := os.WriteFile(name, []byte(`[{"Name": "Empty", "Codes": ["E66"], "MinCodes": 2}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trajectory.LoadDiagnosisBundles(name); err == nil {
+		t.Error("expected an error for a bundle that needs more codes than it has")
+	}
+}
+
+func TestSimilarityGraphML(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		GraphML: true, GraphThreshold: 0.3}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Nodes []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"graph>node"`
+		Edges []struct {
+			Source     string  `xml:"source,attr"`
+			Target     string  `xml:"target,attr"`
+			Similarity float64 `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	if len(graphml.Nodes) != len(exp.Trajectories) {
+		t.Errorf("expected a node per trajectory, got %d nodes for %d trajectories", len(graphml.Nodes),
+			len(exp.Trajectories))
+	}
+	if len(graphml.Edges) == 0 {
+		t.Fatal("expected edges in the similarity graph")
+	}
+	for _, e := range graphml.Edges {
+		var i, j int
+		if _, err := fmt.Sscanf(e.Source+" "+e.Target, "t%d t%d", &i, &j); err != nil {
+			t.Fatal(err)
+		}
+		s := cluster.JaccardTrajectory(exp.Trajectories[i], exp.Trajectories[j])
+		if e.Similarity <= 0.3 || math.Abs(e.Similarity-s) > 1e-6 {
+			t.Errorf("expected edge %s-%s to have the Jaccard similarity %f above 0.3, got %f", e.Source, e.Target, s,
+				e.Similarity)
+		}
+	}
+}
+
+func TestPatientJaccardTrajectory(t *testing.T) {
+	patients := []*trajectory.Patient{{PID: 1}, {PID: 2}, {PID: 3}, {PID: 4}}
+	followed := func(diagnoses []int, ps ...*trajectory.Patient) *trajectory.Trajectory {
+		return &trajectory.Trajectory{Diagnoses: diagnoses, PatientNumbers: []int{len(ps)},
+			Patients: [][]*trajectory.Patient{ps}}
+	}
+	t1 := followed([]int{0, 1}, patients[0], patients[1], patients[2])
+	t2 := followed([]int{2, 3}, patients[1], patients[2], patients[3])
+	t3 := followed([]int{0, 1}, patients[3])
+	if s := cluster.PatientJaccardTrajectory(t1, t2); math.Abs(s-0.5) > 1e-9 {
+		t.Errorf("expected a patient similarity of 0.5 for trajectories without shared diagnoses, got %v", s)
+	}
+	if s := cluster.PatientJaccardTrajectory(t1, t3); s != 0 {
+		t.Errorf("expected a patient similarity of 0 for the same diagnoses in other patients, got %v", s)
+	}
+	if s := cluster.PatientJaccardTrajectory(t1, &trajectory.Trajectory{Diagnoses: []int{0, 1}}); s != 0 {
+		t.Errorf("expected a patient similarity of 0 for a trajectory without patients, got %v", s)
+	}
+	if n := utils.SortedIntersectionSize([]int{1, 2, 2, 3, 5}, []int{2, 2, 3, 4, 5}); n != 3 {
+		t.Errorf("expected 3 distinct shared elements, got %d", n)
+	}
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, cluster.Options{Granularities: []int{20}, Native: true,
+		Similarity: cluster.PatientSimilarity}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range exp.Trajectories {
+		if s := cluster.PatientJaccardTrajectory(tr, tr); s != 1 {
+			t.Errorf("expected a patient similarity of 1 of a trajectory with itself, got %v", s)
+		}
+	}
+}
+
+func TestPatientWeight(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, PatientWeight: 0.3, GraphML: true,
+		SimilarityFunc: func(t1, t2 *trajectory.Trajectory) float64 { return 0.5 }}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Edges []struct {
+			Source     string  `xml:"source,attr"`
+			Target     string  `xml:"target,attr"`
+			Similarity float64 `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	n := len(exp.Trajectories)
+	if len(graphml.Edges) != n*(n-1)/2 {
+		t.Fatalf("expected an edge for each of the %d pairs of trajectories, got %d", n*(n-1)/2, len(graphml.Edges))
+	}
+	for _, e := range graphml.Edges {
+		var i, j int
+		if _, err := fmt.Sscanf(e.Source+" "+e.Target, "t%d t%d", &i, &j); err != nil {
+			t.Fatal(err)
+		}
+		expected := 0.7*0.5 + 0.3*cluster.PatientJaccardTrajectory(exp.Trajectories[i], exp.Trajectories[j])
+		if math.Abs(e.Similarity-expected) > 1e-6 {
+			t.Errorf("expected the similarity %f for edge %s-%s, got %f", expected, e.Source, e.Target, e.Similarity)
+		}
+	}
+}
+
+func TestMaxTrajectories(t *testing.T) {
+	exp, _ := demoExperiment(t, t.TempDir(), 1000)
+	odd := func(t *trajectory.Trajectory) bool { return t.Diagnoses[0]%2 == 1 }
+	all := trajectory.BuildTrajectories(exp, 10, 5, 2, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{odd})
+	if len(all) < 4 {
+		t.Fatalf("expected at least 4 trajectories, got %d", len(all))
+	}
+	max := len(all) / 2
+	exp.MaxTrajectories = max
+	for _, build := range []func(*trajectory.Experiment, int, int, int, float64, float64, float64,
+		[]trajectory.TrajectoryFilter) []*trajectory.Trajectory{trajectory.BuildTrajectories,
+		trajectory.BuildTrajectoriesByChapter} {
+		top := build(exp, 10, 5, 2, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{odd})
+		if len(top) != max {
+			t.Fatalf("expected %d trajectories, got %d", max, len(top))
+		}
+		for i, traj := range top {
+			if fmt.Sprint(traj.Diagnoses) != fmt.Sprint(all[i].Diagnoses) ||
+				fmt.Sprint(traj.PatientNumbers) != fmt.Sprint(all[i].PatientNumbers) {
+				t.Errorf("expected trajectory %d to be %v %v, got %v %v", i, all[i].Diagnoses, all[i].PatientNumbers,
+					traj.Diagnoses, traj.PatientNumbers)
+			}
+		}
+	}
+}
+
+func TestMclLimits(t *testing.T) {
+	limits, err := cluster.ParseMclLimits("nice=10,cpus=0-3,8,mcl.memory=16G,mcl.nice=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]cluster.ProcessLimits{
+		cluster.Mcxload: {Nice: 10, CPUs: "0-3,8"},
+		cluster.Mcl:     {Nice: 5, CPUs: "0-3,8", Memory: 16 << 30},
+		cluster.Mcxdump: {Nice: 10, CPUs: "0-3,8"},
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected the MCL limits %v, got %v", expected, limits)
+	}
+	for _, invalid := range []string{"nice=20", "cpus=a", "memory=lots", "mcs.nice=1", "threads=4", "nice"} {
+		if _, err := cluster.ParseMclLimits(invalid); err == nil {
+			t.Errorf("expected an error for the MCL limits %s", invalid)
+		}
+	}
+}
+
+func TestMinSimilarity(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		GraphML: true, MinSimilarity: 0.4}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(output, "exp1-clusters-directly")
+	content, err := os.ReadFile(filepath.Join(dir, "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Edges []struct {
+			Similarity float64 `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range graphml.Edges {
+		if e.Similarity <= 0.4 {
+			t.Errorf("expected only similarities above the cutoff 0.4, got %f", e.Similarity)
+		}
+	}
+	_, header, err := trajectory.ReadPtraFile(filepath.Join(dir, "dump.exp1.mci.I20.clustered.ptra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Metadata["minSimilarity"] != "0.4" {
+		t.Errorf("expected the cutoff 0.4 in the metadata, got %q", header.Metadata["minSimilarity"])
+	}
+	clusters, err := trajectory.ReadMclDumpFile(filepath.Join(dir, "dump.exp1.mci.I20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clustered := 0
+	for _, ids := range clusters {
+		clustered += len(ids)
+	}
+	if clustered != len(exp.Trajectories) {
+		t.Errorf("expected all %d trajectories to be clustered, got %d", len(exp.Trajectories), clustered)
+	}
+}
+
+func TestLSHClustering(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		LSHBands: 20, LSHRows: 5}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := trajectory.ReadMclDumpFile(filepath.Join(output, "exp1-clusters-directly", "dump.exp1.mci.I20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clustered := 0
+	for _, ids := range clusters {
+		clustered += len(ids)
+	}
+	if clustered != len(exp.Trajectories) {
+		t.Errorf("expected all %d trajectories to be clustered, got %d", len(exp.Trajectories), clustered)
+	}
+}
+
+func TestExcludeTransitions(t *testing.T) {
+	baseline, _ := demoExperiment(t, t.TempDir(), 500)
+	d1, d2 := baseline.Trajectories[0].Diagnoses[0], baseline.Trajectories[0].Diagnoses[1]
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "excluded.csv")
+	content := fmt.Sprintf("from,to\n%s,%s\nUNKNOWN,%s\n", baseline.IdMap[d1], baseline.IdMap[d2], baseline.IdMap[d2])
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	transitions, err := trajectory.ReadExcludedTransitions(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transitions) != 2 {
+		t.Fatalf("expected 2 excluded transitions, got %d", len(transitions))
+	}
+	patientFile, diagnosisFile, vocabularyFile, err := app.WriteDemoData(filepath.Join(dir, "input"), 500, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := app.ParseTriNetXData("exp1", patientFile, diagnosisFile, vocabularyFile, "", "", 6, 3, 0.5, 5, "",
+		false, []trajectory.PatientFilter{}, "", 0, "")
+	if n := trajectory.ExcludeTransitions(exp, transitions, 0.5, 5); n != 1 {
+		t.Fatalf("expected 1 excluded transition in the vocabulary, got %d", n)
+	}
+	pair := trajectory.Pair{First: d1, Second: d2}
+	if exp.ExcludedTransitions[pair] < baseline.Trajectories[0].PatientNumbers[0] {
+		t.Errorf("expected at least %d patients with the excluded transition, got %d",
+			baseline.Trajectories[0].PatientNumbers[0], exp.ExcludedTransitions[pair])
+	}
+	trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0.5, 5, 100, trajectory.RRPersonTime, 10, 1.0, true)
+	if len(exp.DxDPatients[d1][d2]) != 0 {
+		t.Errorf("expected no patients for the excluded transition, got %d", len(exp.DxDPatients[d1][d2]))
+	}
+	trajectories := trajectory.BuildTrajectories(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	for _, traj := range trajectories {
+		for i := 1; i < len(traj.Diagnoses); i++ {
+			if traj.Diagnoses[i-1] == d1 && traj.Diagnoses[i] == d2 {
+				t.Errorf("expected no trajectory with the excluded transition, got %v", traj.Diagnoses)
+			}
+		}
+	}
+	output := filepath.Join(dir, "excluded-transitions.csv")
+	trajectory.PrintExcludedTransitionsToCSVFile(exp, output)
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("From,To,FromName,ToName,Patients\n%s,%s,", baseline.IdMap[d1], baseline.IdMap[d2])
+	if !strings.HasPrefix(string(written), expected) {
+		t.Errorf("unexpected excluded transitions file: %s", written)
+	}
+}
+
+func TestParallelSimilarities(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	// replicate the trajectories, so that the similarity matrix has several blocks
+	for n := len(exp.Trajectories); len(exp.Trajectories) < 600; {
+		copied := *exp.Trajectories[len(exp.Trajectories)%n]
+		exp.Trajectories = append(exp.Trajectories, &copied)
+	}
+	var graphs []string
+	for _, threads := range []int{1, 4} {
+		options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+			GraphML: true, Threads: threads}
+		dir := filepath.Join(output, fmt.Sprint(threads))
+		if err := cluster.ClusterTrajectoriesDirectly(exp, dir, options); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, "exp1-clusters-directly", "exp1.similarities.graphml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		graphs = append(graphs, string(content))
+	}
+	if graphs[0] != graphs[1] {
+		t.Error("expected the same similarities in the same order with 1 and 4 threads")
+	}
+	if edges := strings.Count(graphs[0], "<edge "); edges == 0 {
+		t.Error("expected edges in the similarity graph")
+	}
+}
+
+func TestSignOutputs(t *testing.T) {
+	dir := t.TempDir()
+	outputs := filepath.Join(dir, "outputs")
+	if err := os.MkdirAll(filepath.Join(outputs, "clusters"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"exp1-trajectories.tab": "1\t2\n", "clusters/exp1.gml": "graph\n"} {
+		if err := os.WriteFile(filepath.Join(outputs, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("shared secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := filepath.Join(dir, "private.pem")
+	if err := os.WriteFile(privateKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if der, err = x509.MarshalPKIXPublicKey(private.Public()); err != nil {
+		t.Fatal(err)
+	}
+	publicKey := filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(publicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	signature := filepath.Join(outputs, "exp1.signature.json")
+	for _, keys := range [][2]string{{secret, secret}, {privateKey, publicKey}} {
+		if err := utils.SignOutputs(signature, keys[0]); err != nil {
+			t.Fatal(err)
+		}
+		differences, err := utils.VerifySignedOutputs(signature, keys[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(differences) != 0 {
+			t.Errorf("expected unaltered outputs, got %v", differences)
+		}
+	}
+	if err := utils.SignOutputs(signature, publicKey); err == nil {
+		t.Error("expected an error when signing with a public key")
+	}
+	if _, err := utils.VerifySignedOutputs(signature, secret); !errors.Is(err, utils.ErrInvalidSignature) {
+		t.Errorf("expected an invalid signature with another key, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outputs, "clusters/exp1.gml"), []byte("graph altered\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(outputs, "exp1-trajectories.tab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputs, "cpu.pprof"), []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	differences, err := utils.VerifySignedOutputs(signature, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"clusters/exp1.gml":     utils.SignatureChanged,
+		"exp1-trajectories.tab": utils.SignatureMissing,
+		"cpu.pprof":             utils.SignatureUnsigned,
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Errorf("expected differences %v, got %v", expected, differences)
+	}
+	content, err := os.ReadFile(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(content), `"exp1-trajectories.tab": "`, `"exp1-trajectories.tab": "0`, 1)
+	if err := os.WriteFile(signature, []byte(tampered), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.VerifySignedOutputs(signature, publicKey); !errors.Is(err, utils.ErrInvalidSignature) {
+		t.Errorf("expected an invalid signature for altered hashes, got %v", err)
+	}
+}
+
+func TestTUI(t *testing.T) {
+	defer utils.SetVerbosity(utils.GetVerbosity())
+	utils.SetVerbosity(utils.Normal)
+	logs := server.NewLogBuffer(10)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(logs, "log line %d\n", i)
+	}
+	stage := utils.StartStage("Testing the terminal UI", 10)
+	stage.Add(5)
+	defer utils.FinishStages()
+	tui := server.NewTUI(logs, 13, 120)
+	var frame bytes.Buffer
+	tui.Render(&frame)
+	lines := strings.Split(strings.TrimSuffix(frame.String(), "\n"), "\n")
+	if len(lines) > 13 {
+		t.Errorf("expected at most 13 lines, got %d", len(lines))
+	}
+	if !strings.Contains(frame.String(), "[##########..........] 5/10") {
+		t.Errorf("expected the progress of the stage, got %s", frame.String())
+	}
+	if !strings.Contains(frame.String(), "log line 4") || strings.Contains(frame.String(), "log line 0") {
+		t.Errorf("expected only the most recent log lines, got %s", frame.String())
+	}
+	if tui.Handle('+') || utils.GetVerbosity() != utils.Verbose {
+		t.Errorf("expected verbose messages, got %d", utils.GetVerbosity())
+	}
+	tui.Handle('-')
+	tui.Handle('-')
+	tui.Handle('-')
+	if utils.GetVerbosity() != utils.Quiet {
+		t.Errorf("expected quiet messages, got %d", utils.GetVerbosity())
+	}
+	utils.AllowCheckpoints(true)
+	tui.Handle('c')
+	if !utils.CheckpointRequested() || utils.CheckpointRequested() {
+		t.Error("expected a single checkpoint request")
+	}
+	// after the relative risk ratios, the checkpoint key is no longer offered
+	utils.AllowCheckpoints(false)
+	tui.Handle('c')
+	if utils.CheckpointRequested() {
+		t.Error("expected no checkpoint request after the relative risk ratios are computed")
+	}
+	frame.Reset()
+	tui.Render(&frame)
+	if strings.Contains(frame.String(), "c checkpoint") {
+		t.Errorf("expected the checkpoint key not to be offered, got %s", frame.String())
+	}
+	if !tui.Handle(3) {
+		t.Error("expected ctrl-c to interrupt")
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	patientFile, diagnosisFile, vocabularyFile, err := app.WriteDemoData(filepath.Join(dir, "input"), 500, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func() (*trajectory.Experiment, *trajectory.PatientMap) {
+		return app.ParseTriNetXData("exp1", patientFile, diagnosisFile, vocabularyFile, "", "", 6, 3, 0.5, 5, "",
+			false, []trajectory.PatientFilter{}, "", 0, "")
+	}
+	trajectories := func(exp *trajectory.Experiment) []string {
+		result := []string{}
+		for _, traj := range exp.Trajectories {
+			result = append(result, fmt.Sprint(traj.Diagnoses, traj.PatientNumbers))
+		}
+		sort.Strings(result)
+		return result
+	}
+	// the checkpointed run selects fewer pairs than the run that resumes from its checkpoint, so that the latter needs
+	// the patients of the pairs that are not selected
+	checkpoint := func(release bool) string {
+		exp, _ := parse()
+		trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0.5, 5, 100, trajectory.RRPersonTime, 60, 2.0, release)
+		rrFile := filepath.Join(dir, fmt.Sprintf("exp1-%t.checkpoint-rr.tab", release))
+		trajectory.SaveRRMatrix(exp, rrFile)
+		trajectory.SaveDxDPatients(exp, rrFile+".patients.csv")
+		return rrFile
+	}
+	resume := func(rrFile string) []string {
+		exp, patients := parse()
+		trajectory.LoadRRMatrix(exp, rrFile)
+		trajectory.LoadDxDPatients(exp, patients, rrFile+".patients.csv")
+		trajectory.BuildTrajectories(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+		return trajectories(exp)
+	}
+	exp, _ := parse()
+	trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0.5, 5, 100, trajectory.RRPersonTime, 10, 1.0, true)
+	trajectory.BuildTrajectories(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	expected := trajectories(exp)
+	if len(expected) == 0 {
+		t.Fatal("expected trajectories for the progressions of the synthetic cohort")
+	}
+	if resumed := resume(checkpoint(false)); !reflect.DeepEqual(resumed, expected) {
+		t.Errorf("expected the trajectories of a run with the other thresholds %v, got %v", expected, resumed)
+	}
+	// a checkpoint without the patients of the pairs that are not selected cannot be resumed with other thresholds
+	if resumed := resume(checkpoint(true)); reflect.DeepEqual(resumed, expected) {
+		t.Error("expected other trajectories when the patients of the pairs that are not selected are released")
+	}
+}
+
+func TestReadClusterGraphsFromGMLFile(t *testing.T) {
+	dir := t.TempDir()
+	// a curated graph as exported by Cytoscape: renumbered nodes, extra attributes, and no cluster comment
+	curated := `Creator "Cytoscape"
+Version 1.0
+graph	[
+	directed	1
+	node	[
+		root_index	-12
+		id	-12
+		graphics	[ x 10.0 y 20.0 ]
+		label	"Essential (primary) hypertension"
+	]
+	node	[
+		root_index	-11
+		id	-11
+		label	"Type 2 diabetes mellitus"
+	]
+	node	[
+		id	-10
+		label	"Heart failure &amp; edema"
+	]
+	node	[
+		id	-9
+		label	"Removed from the curated graph"
+	]
+	edge	[
+		source	-12
+		target	-11
+		label	"120"
+		rr	2.50
+	]
+	edge	[
+		source	-11
+		target	-10
+		label	"RR 1.80"
+		patients	45
+		rr	1.80
+	]
+]
+`
+	name := filepath.Join(dir, "cluster-7.gml")
+	if err := os.WriteFile(name, []byte(curated), 0666); err != nil {
+		t.Fatal(err)
+	}
+	ts, nameMap, rrs, err := trajectory.ReadClusterGraphsFromGMLFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || len(nameMap) != 3 {
+		t.Fatalf("expected 2 trajectories with 3 diagnoses, got %d with %d", len(ts), len(nameMap))
+	}
+	expected := [][3]string{
+		{"Essential (primary) hypertension", "Type 2 diabetes mellitus", "120"},
+		{"Type 2 diabetes mellitus", "Heart failure & edema", "45"},
+	}
+	for i, tr := range ts {
+		got := [3]string{nameMap[tr.Diagnoses[0]], nameMap[tr.Diagnoses[1]], fmt.Sprint(tr.PatientNumbers[0])}
+		if got != expected[i] || tr.Cluster != 7 {
+			t.Errorf("expected %v in cluster 7, got %v in cluster %d", expected[i], got, tr.Cluster)
+		}
+	}
+	if rr := rrs[[2]string{"Type 2 diabetes mellitus", "Heart failure & edema"}]; rr != 1.8 {
+		t.Errorf("expected an RR of 1.8, got %v", rr)
+	}
+	// graphs written by ptra, with cluster comments and without RRs
+	written := "graph [ \n comment \"cluster 3\" \n directed 1 \n label \"cluster 3\" \n multigraph 1\n" +
+		"node [ id 0\n label \"A\"\n ]\nnode [ id 1\n label \"B\"\n ]\nedge [\nsource 0\ntarget 1\nlabel 12\n]\n]\n" +
+		"graph [ \n comment \"cluster 5\" \n directed 1 \n label \"cluster 5\" \n multigraph 1\n" +
+		"node [ id 1\n label \"B\"\n ]\nnode [ id 2\n label \"C\"\n ]\nedge [\nsource 1\ntarget 2\nlabel 8\n]\n]\n"
+	name = filepath.Join(dir, "exp1-clusters.gml")
+	if err := os.WriteFile(name, []byte(written), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _, rrs, err = trajectory.ReadClusterGraphsFromGMLFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 || ts[0].Cluster != 3 || ts[1].Cluster != 5 || rrs != nil {
+		t.Errorf("expected 2 trajectories in clusters 3 and 5 without RRs, got %d, %v", len(ts), rrs)
+	}
+	if err := os.WriteFile(name, []byte("graph [ node [ id 0 label \"A\" ] edge [ source 0 target 1 ] ]"),
+		0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := trajectory.ReadClusterGraphsFromGMLFile(name); err == nil {
+		t.Error("expected an error for an edge to an unknown node")
+	}
+}
+
+func TestNearestTrajectories(t *testing.T) {
+	exp, _ := demoExperiment(t, t.TempDir(), 1000)
+	if len(exp.Trajectories) < 4 {
+		t.Fatalf("expected at least 4 trajectories, got %d", len(exp.Trajectories))
+	}
+	query := exp.Trajectories[1]
+	for _, tr := range exp.Trajectories {
+		tr.ID = -1
+	}
+	neighbors, err := cluster.NearestTrajectories(exp, 1, 3, cluster.LCSSimilarity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(neighbors) != 3 {
+		t.Fatalf("expected 3 nearest trajectories, got %d", len(neighbors))
+	}
+	for _, other := range exp.Trajectories {
+		if other.ID != -1 {
+			t.Fatalf("expected the experiment to be left as it is, got trajectory ID %d", other.ID)
+		}
+	}
+	for i, n := range neighbors {
+		if n.Trajectory == query {
+			t.Error("expected the query trajectory to be left out")
+		}
+		if exp.Trajectories[n.Index] != n.Trajectory {
+			t.Errorf("expected neighbor %d to be trajectory %d of the experiment", i, n.Index)
+		}
+		if s := cluster.LCSTrajectory(query, n.Trajectory); s != n.Similarity {
+			t.Errorf("expected similarity %v, got %v", s, n.Similarity)
+		}
+		if i > 0 && n.Similarity > neighbors[i-1].Similarity {
+			t.Errorf("expected decreasing similarities, got %v after %v", n.Similarity, neighbors[i-1].Similarity)
+		}
+	}
+	for _, other := range exp.Trajectories {
+		if other != query && cluster.LCSTrajectory(query, other) > neighbors[2].Similarity {
+			found := false
+			for _, n := range neighbors {
+				found = found || n.Trajectory == other
+			}
+			if !found {
+				t.Errorf("expected trajectory %v among the nearest trajectories", other.Diagnoses)
+			}
+		}
+	}
+	all, err := cluster.NearestTrajectories(exp, 1, len(exp.Trajectories)+10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(exp.Trajectories)-1 {
+		t.Errorf("expected %d trajectories, got %d", len(exp.Trajectories)-1, len(all))
+	}
+	if _, err := cluster.NearestTrajectories(exp, 1, 3, "unknown"); err == nil {
+		t.Error("expected an error for an unknown metric")
+	}
+	if _, err := cluster.NearestTrajectories(exp, len(exp.Trajectories), 3, ""); err == nil {
+		t.Error("expected an error for an unknown trajectory")
+	}
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		MatrixFormats: []string{cluster.NpyMatrix, cluster.ParquetMatrix}}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	n := len(exp.Trajectories)
+	npy, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.npy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(npy, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatal("expected the magic string of an npy file")
+	}
+	headerSize := 10 + int(binary.LittleEndian.Uint16(npy[8:10]))
+	header := string(npy[10:headerSize])
+	if headerSize%64 != 0 || !strings.Contains(header, "'<f4'") ||
+		!strings.Contains(header, fmt.Sprintf("(%d, %d)", n, n)) {
+		t.Fatalf("unexpected npy header %q", header)
+	}
+	if len(npy) != headerSize+n*n*4 {
+		t.Fatalf("expected %d bytes of %dx%d float32 values, got %d", n*n*4, n, n, len(npy)-headerSize)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			s := math.Float32frombits(binary.LittleEndian.Uint32(npy[headerSize+(i*n+j)*4:]))
+			expected := float32(1)
+			if i != j {
+				expected = float32(cluster.JaccardTrajectory(exp.Trajectories[i], exp.Trajectories[j]))
+			}
+			if math.Abs(float64(s-expected)) > 1e-6 {
+				t.Errorf("expected similarity %f of trajectories %d and %d, got %f", expected, i, j, s)
+			}
+		}
+	}
+	parquet, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parquet) < 12 || string(parquet[:4]) != "PAR1" || string(parquet[len(parquet)-4:]) != "PAR1" {
+		t.Fatal("expected the magic string of a Parquet file at its start and end")
+	}
+	footer := int(binary.LittleEndian.Uint32(parquet[len(parquet)-8:]))
+	if footer <= 0 || footer > len(parquet)-12 {
+		t.Fatalf("invalid Parquet footer length %d", footer)
+	}
+	pos := len(parquet) - 8 - footer
+	meta := readThriftStruct(t, parquet, &pos)
+	if pos != len(parquet)-8 {
+		t.Fatalf("expected the FileMetaData to end at the footer length, got %d bytes", pos-len(parquet)+8+footer)
+	}
+	schema := meta[2].([]interface{})
+	if len(schema) != 4 || schema[0].(thriftStruct)[5] != int64(3) {
+		t.Fatalf("expected a schema with 3 columns, got %v", schema)
+	}
+	for c, column := range []utils.ParquetColumn{{Name: "i", Type: utils.ParquetInt32},
+		{Name: "j", Type: utils.ParquetInt32}, {Name: "similarity", Type: utils.ParquetDouble}} {
+		element := schema[c+1].(thriftStruct)
+		if element[4] != column.Name || element[1] != int64(column.Type) || element[3] != int64(0) {
+			t.Errorf("expected the required column %v, got %v", column, element)
+		}
+	}
+	// the rows of the sparse matrix, cf. the pairs of trajectories with a similarity above 0
+	is, js, similarities := []int32{}, []int32{}, []float64{}
+	rows := int64(0)
+	for _, group := range meta[4].([]interface{}) {
+		rowGroup := group.(thriftStruct)
+		rows += rowGroup[3].(int64)
+		for c, chunk := range rowGroup[1].([]interface{}) {
+			columnMeta := chunk.(thriftStruct)[3].(thriftStruct)
+			pos := int(columnMeta[9].(int64))
+			page := readThriftStruct(t, parquet, &pos)
+			values := parquet[pos : pos+int(page[3].(int64))]
+			if page[5].(thriftStruct)[1] != rowGroup[3] || columnMeta[5] != rowGroup[3] {
+				t.Fatalf("expected %d values in the data page, got %v", rowGroup[3], page)
+			}
+			for k := 0; k < int(rowGroup[3].(int64)); k++ {
+				switch c {
+				case 0:
+					is = append(is, int32(binary.LittleEndian.Uint32(values[k*4:])))
+				case 1:
+					js = append(js, int32(binary.LittleEndian.Uint32(values[k*4:])))
+				default:
+					similarities = append(similarities, math.Float64frombits(binary.LittleEndian.Uint64(values[k*8:])))
+				}
+			}
+		}
+	}
+	if meta[3] != rows || int64(len(similarities)) != rows || len(is) != len(js) || len(js) != len(similarities) {
+		t.Fatalf("expected %v rows in the row groups, got %d", meta[3], rows)
+	}
+	pairs := 0
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if cluster.JaccardTrajectory(exp.Trajectories[i], exp.Trajectories[j]) > 0 {
+				pairs++
+			}
+		}
+	}
+	if int(rows) != pairs {
+		t.Errorf("expected a row per pair of trajectories with a similarity above 0, %d, got %d", pairs, rows)
+	}
+	for k, s := range similarities {
+		if expected := cluster.JaccardTrajectory(exp.Trajectories[is[k]], exp.Trajectories[js[k]]); s != expected {
+			t.Errorf("expected similarity %f of trajectories %d and %d, got %f", expected, is[k], js[k], s)
+		}
+	}
+}
+
+// thriftStruct is a Thrift struct decoded from the compact protocol, with its values per field ID: int64 for integers,
+// string for binaries, []interface{} for lists, and thriftStruct for structs.
+type thriftStruct map[int16]interface{}
+
+func readThriftVarint(t *testing.T, b []byte, pos *int) int64 {
+	v, n := binary.Uvarint(b[*pos:])
+	if n <= 0 {
+		t.Fatalf("invalid varint at %d", *pos)
+	}
+	*pos += n
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func readThriftValue(t *testing.T, b []byte, pos *int, typ byte) interface{} {
+	switch typ {
+	case 5, 6: // i32, i64
+		return readThriftVarint(t, b, pos)
+	case 8: // binary
+		v, n := binary.Uvarint(b[*pos:])
+		*pos += n
+		s := string(b[*pos : *pos+int(v)])
+		*pos += int(v)
+		return s
+	case 9: // list
+		header := b[*pos]
+		*pos++
+		size := int(header >> 4)
+		if size == 15 {
+			v, n := binary.Uvarint(b[*pos:])
+			*pos += n
+			size = int(v)
+		}
+		list := []interface{}{}
+		for i := 0; i < size; i++ {
+			list = append(list, readThriftValue(t, b, pos, header&0x0f))
+		}
+		return list
+	case 12: // struct
+		return readThriftStruct(t, b, pos)
+	}
+	t.Fatalf("unexpected Thrift type %d at %d", typ, *pos)
+	return nil
+}
+
+func readThriftStruct(t *testing.T, b []byte, pos *int) thriftStruct {
+	s := thriftStruct{}
+	id := int16(0)
+	for {
+		header := b[*pos]
+		*pos++
+		if header == 0 {
+			return s
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(readThriftVarint(t, b, pos))
+		}
+		s[id] = readThriftValue(t, b, pos, header&0x0f)
+	}
+}
+
+func TestClusterNames(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	sheet := filepath.Join(output, "exp1-clusters-directly", "dump.exp1.mci.I20.clustered.names.csv")
+	names, err := trajectory.ReadClusterNames(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nofClusters := len(trajectory.ClusterMedoids(exp))
+	if len(names) != nofClusters || nofClusters < 2 {
+		t.Fatalf("expected a name for each of the %d clusters, got %d", nofClusters, len(names))
+	}
+	for i, name := range names {
+		if name.ID != i || name.Name != "" || name.Medoid == "" {
+			t.Fatalf("expected cluster %d to have ID %d, no name, and a medoid, got %+v", i, i, name)
+		}
+		name.Name = fmt.Sprintf("named %d", i)
+	}
+	// the first cluster is not in the previous sheet, and a retired cluster is
+	previous := append(names[1:], &trajectory.ClusterName{ID: 100, Name: "retired", Medoid: "X -> Y"})
+	options.ClusterNames = previous
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != nofClusters+2 {
+		t.Fatalf("expected a line per cluster and a retired cluster, got %q", lines)
+	}
+	if expected := "0,101,,"; !strings.HasPrefix(lines[1], expected) {
+		t.Errorf("expected the unmatched cluster to get a new ID, %q, got %q", expected, lines[1])
+	}
+	for i := 1; i < nofClusters; i++ {
+		if expected := fmt.Sprintf("%d,%d,named %d,", i, i, i); !strings.HasPrefix(lines[i+1], expected) ||
+			!strings.HasSuffix(lines[i+1], ",1.000") {
+			t.Errorf("expected the matched cluster %q, got %q", expected, lines[i+1])
+		}
+	}
+	if expected := ",100,retired,X -> Y,"; lines[len(lines)-1] != expected {
+		t.Errorf("expected the retired cluster %q, got %q", expected, lines[len(lines)-1])
+	}
+}
+
+func TestCapPatientContributions(t *testing.T) {
+	exp, _ := demoExperiment(t, t.TempDir(), 1000)
+	counts := map[*trajectory.Patient]int{}
+	for _, tr := range exp.Trajectories {
+		for _, p := range trajectory.LastPatients(tr) {
+			counts[p]++
+		}
+	}
+	heavy := 0
+	for _, n := range counts {
+		if n > 1 {
+			heavy++
+		}
+	}
+	if heavy == 0 {
+		t.Fatal("expected patients that follow several trajectories")
+	}
+	trajectory.CapPatientContributions(exp, 1, 10)
+	counts = map[*trajectory.Patient]int{}
+	for i, tr := range exp.Trajectories {
+		for k, ps := range tr.Patients {
+			if tr.PatientNumbers[k] != len(ps) {
+				t.Errorf("expected %d patients for transition %d of trajectory %d, got %d", len(ps), k, i,
+					tr.PatientNumbers[k])
+			}
+		}
+		if n := len(trajectory.LastPatients(tr)); n < 10 {
+			t.Errorf("expected trajectory %d with %d patients to be removed", i, n)
+		}
+		if i > 0 && tr.PatientNumbers[len(tr.PatientNumbers)-1] >
+			exp.Trajectories[i-1].PatientNumbers[len(exp.Trajectories[i-1].PatientNumbers)-1] {
+			t.Errorf("expected the trajectories to be sorted by their numbers of patients")
+		}
+		for _, p := range trajectory.LastPatients(tr) {
+			counts[p]++
+			if counts[p] > 1 {
+				t.Fatalf("expected patient %d to support at most 1 trajectory", p.PID)
+			}
+		}
+	}
+}
+
+func TestSimilarityCache(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	cache := filepath.Join(t.TempDir(), "cache")
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		CacheDir: cache, GraphML: true}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(cache, "*.abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected a cache file, got %v", files)
+	}
+	// a run with the same similarities reuses the cache file, which is tampered with to tell
+	var tampered strings.Builder
+	for i := range exp.Trajectories {
+		for j := i + 1; j < len(exp.Trajectories); j++ {
+			fmt.Fprintf(&tampered, "%d\t%d\t0.125\n", i, j)
+		}
+	}
+	if err := os.WriteFile(files[0], []byte(tampered.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	options.Granularities = []int{40}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(exp.Trajectories)
+	if edges := strings.Count(string(content), "<data key=\"similarity\">0.125</data>"); edges != n*(n-1)/2 {
+		t.Errorf("expected the %d cached similarities in the similarity graph, got %d", n*(n-1)/2, edges)
+	}
+	// other similarity options have their own cache file
+	options.Similarity = cluster.SorensenDiceSimilarity
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = filepath.Glob(filepath.Join(cache, "*")); err != nil || len(files) != 2 {
+		t.Errorf("expected a second cache file, got %v", files)
+	}
+}
+
+func TestHierarchySimilarity(t *testing.T) {
+	exp := &trajectory.Experiment{IdMap: map[int]string{0: "C34.1", 1: "C34.9", 2: "D50"},
+		NameMap: map[int]string{0: "lung 1", 1: "lung 9", 2: "anemia"}}
+	for _, c := range []struct {
+		d1, d2   int
+		expected float64
+	}{{0, 0, 1}, {0, 1, 0.75}, {0, 2, 0}} {
+		if s := trajectory.AncestorSimilarity(exp, c.d1, c.d2); math.Abs(s-c.expected) > 1e-9 {
+			t.Errorf("expected the ICD10 prefix similarity %f of %d and %d, got %f", c.expected, c.d1, c.d2, s)
+		}
+	}
+	exp.Trajectories = []*trajectory.Trajectory{{Diagnoses: []int{0, 2}, PatientNumbers: []int{10}},
+		{Diagnoses: []int{1, 2}, PatientNumbers: []int{10}}}
+	neighbors, err := cluster.NearestTrajectories(exp, 0, 1, cluster.HierarchySimilarity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1.75 / (4 - 1.75); len(neighbors) != 1 || math.Abs(neighbors[0].Similarity-expected) > 1e-9 {
+		t.Errorf("expected the similarity %f of the trajectories with sibling codes, got %v", expected, neighbors)
+	}
+	name := filepath.Join(t.TempDir(), "hierarchy.csv")
+	if err := os.WriteFile(name, []byte("Code,Parent\nC34.1,C34\nC34.9,C34\nC34,C30-C39\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	parents, err := trajectory.ReadCodeHierarchy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trajectory.ApplyCodeHierarchy(exp, parents); err != nil {
+		t.Fatal(err)
+	}
+	if s := trajectory.AncestorSimilarity(exp, 0, 1); math.Abs(s-2.0/3) > 1e-9 {
+		t.Errorf("expected the similarity 2/3 of siblings in the code hierarchy, got %f", s)
+	}
+	if s := trajectory.AncestorSimilarity(exp, 0, 2); s != 0 {
+		t.Errorf("expected no similarity for a code outside the code hierarchy, got %f", s)
+	}
+	if err := trajectory.ApplyCodeHierarchy(exp, map[string]string{"C34.1": "C34", "C34": "C34.1"}); err == nil {
+		t.Error("expected an error for a code hierarchy with a cycle")
+	}
+}
+
+func TestIncidentLookback(t *testing.T) {
+	dir := t.TempDir()
+	patientFile, diagnosisFile, vocabularyFile, err := app.WriteDemoData(filepath.Join(dir, "input"), 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := app.ParseTriNetXData("exp1", patientFile, diagnosisFile, vocabularyFile, "", "", 6, 3, 0.5, 5, "",
+		false, []trajectory.PatientFilter{}, "", 0, "")
+	trajectory.InitializeRelativeRiskRatiosAndPairs(exp, 0.5, 5, 100, trajectory.RRPersonTime, 10, 1.0, true)
+	exp.IncidentLookback = 1
+	trajectory.BuildTrajectories(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	if len(exp.IndexCases) == 0 {
+		t.Fatal("expected the index cases of the index diagnoses")
+	}
+	prevalent := 0
+	for _, cases := range exp.IndexCases {
+		prevalent += cases.Prevalent
+	}
+	if prevalent == 0 {
+		t.Error("expected prevalent index cases in the synthetic cohort")
+	}
+	for _, tr := range exp.Trajectories {
+		for _, p := range tr.Patients[0] {
+			for _, d := range p.Diagnoses {
+				if d.DID == tr.Diagnoses[0] {
+					if lookback := trajectory.DiagnosisDateToFloat(d.Date) -
+						trajectory.DiagnosisDateToFloat(p.Diagnoses[0].Date); lookback < 1 {
+						t.Fatalf("expected incident index cases only, got patient %d with a look-back of %f", p.PID,
+							lookback)
+					}
+					break
+				}
+			}
+		}
+	}
+	name := filepath.Join(dir, "exp1-index-cases.csv")
+	trajectory.PrintIndexCasesToCSVFile(exp, name)
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if lines[0] != "DID,Name,Incident,Prevalent,Incident%" || len(lines) != len(exp.IndexCases)+1 {
+		t.Errorf("unexpected index cases %q", lines)
+	}
+}
+
+func TestPairDirections(t *testing.T) {
+	dir := t.TempDir()
+	exp, output := demoExperiment(t, dir, 500)
+	if len(exp.Pairs) == 0 || len(exp.Directions) != len(exp.Pairs) {
+		t.Fatalf("expected a direction per selected pair, got %d directions for %d pairs", len(exp.Directions),
+			len(exp.Pairs))
+	}
+	for _, pair := range exp.Pairs {
+		d, ok := trajectory.TransitionDirection(exp, pair.First, pair.Second)
+		if !ok || d.Before != len(exp.DxDPatients[pair.First][pair.Second]) || d.P <= 0 || d.P > 1 {
+			t.Fatalf("unexpected direction %+v of pair %d -> %d", d, pair.First, pair.Second)
+		}
+		if c := d.Confidence(); c <= 0 || c > 1 {
+			t.Errorf("unexpected confidence %f of pair %d -> %d", c, pair.First, pair.Second)
+		}
+	}
+	directions, err := trajectory.ReadPairDirectionsFromTabFile(filepath.Join(output, "exp1-pairs.tab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(directions) != len(exp.Pairs) {
+		t.Fatalf("expected %d directions in the pairs tab file, got %d", len(exp.Pairs), len(directions))
+	}
+	for _, pair := range exp.Pairs {
+		d := directions[[2]string{exp.NameMap[pair.First], exp.NameMap[pair.Second]}]
+		if want := exp.Directions[*pair]; d != want {
+			t.Errorf("expected direction %+v of pair %d -> %d, got %+v", want, pair.First, pair.Second, d)
+		}
+	}
+	if s := (trajectory.Direction{Before: 170, After: 30, P: 1e-24}).String(); s != "85% (170/200) before, p = 1.0E-24" {
+		t.Errorf("unexpected direction %q", s)
+	}
+}
+
+func TestBigramTrajectory(t *testing.T) {
+	t1 := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	for _, test := range []struct {
+		diagnoses []int
+		expected  float64
+	}{
+		{[]int{1, 2, 3}, 1},
+		{[]int{1, 2, 4}, 1.0 / 3},
+		{[]int{0, 1, 2, 3}, 2.0 / 3},
+		{[]int{3, 2, 1}, 0},
+		{[]int{1}, 0},
+		{[]int{}, 0},
+	} {
+		t2 := &trajectory.Trajectory{Diagnoses: test.diagnoses}
+		if s := cluster.BigramTrajectory(t1, t2); math.Abs(s-test.expected) > 1e-9 {
+			t.Errorf("expected a bigram similarity of %v for %v, got %v", test.expected, test.diagnoses, s)
+		}
+		if s1, s2 := cluster.BigramTrajectory(t1, t2), cluster.BigramTrajectory(t2, t1); s1 != s2 {
+			t.Errorf("expected a symmetric bigram similarity for %v, got %v and %v", test.diagnoses, s1, s2)
+		}
+	}
+	if cluster.JaccardTrajectory(t1, &trajectory.Trajectory{Diagnoses: []int{3, 2, 1}}) != 1 {
+		t.Error("expected the reversed trajectory to have the same diagnoses")
+	}
+}
+
+func TestEmbeddingSimilarity(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "embeddings.csv")
+	if err := os.WriteFile(name, []byte("Code,V1,V2\nC34.1,1,0\nC34.9,0.6,0.8\nD50,-1,0\nI10,0,0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	embeddings, err := trajectory.ReadEmbeddings(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &trajectory.Experiment{IdMap: map[int]string{0: "C34.1", 1: "C34.9", 2: "D50", 3: "I10", 4: "E11"},
+		NameMap: map[int]string{0: "lung 1", 1: "lung 9", 2: "anemia", 3: "hypertension", 4: "diabetes"}}
+	if n := trajectory.ApplyEmbeddings(exp, embeddings); n != 4 {
+		t.Errorf("expected embeddings for 4 diagnoses, got %d", n)
+	}
+	for _, c := range []struct {
+		d1, d2   int
+		expected float64
+	}{{0, 0, 1}, {0, 1, 0.6}, {0, 2, 0}, {0, 3, 0}, {0, 4, 0}, {4, 4, 1}} {
+		if s := trajectory.EmbeddingCosineSimilarity(exp, c.d1, c.d2); math.Abs(s-c.expected) > 1e-9 {
+			t.Errorf("expected the embedding similarity %f of %d and %d, got %f", c.expected, c.d1, c.d2, s)
+		}
+	}
+	exp.Trajectories = []*trajectory.Trajectory{{Diagnoses: []int{0, 4}, PatientNumbers: []int{10}},
+		{Diagnoses: []int{1, 4}, PatientNumbers: []int{10}}}
+	neighbors, err := cluster.NearestTrajectories(exp, 0, 1, cluster.EmbeddingSimilarity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1.6 / (4 - 1.6); len(neighbors) != 1 || math.Abs(neighbors[0].Similarity-expected) > 1e-9 {
+		t.Errorf("expected the similarity %f of the trajectories with close codes, got %v", expected, neighbors)
+	}
+	if err := os.WriteFile(name, []byte("Code,V1,V2\nC34.1,1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := trajectory.ReadEmbeddings(name); err == nil {
+		t.Error("expected an error for an embedding of the wrong dimension")
+	}
+}
+
+func TestClusterPatientOverlap(t *testing.T) {
+	p1, p2, p3 := &trajectory.Patient{PID: 1}, &trajectory.Patient{PID: 2}, &trajectory.Patient{PID: 3}
+	exp := &trajectory.Experiment{Name: "exp1", Trajectories: []*trajectory.Trajectory{
+		{Diagnoses: []int{0, 1}, Patients: [][]*trajectory.Patient{{p1, p2}}, Cluster: 0},
+		{Diagnoses: []int{1, 2}, Patients: [][]*trajectory.Patient{{p1, p2, p3}}, Cluster: 0},
+		{Diagnoses: []int{2, 3}, Patients: [][]*trajectory.Patient{{p2, p3}}, Cluster: 1},
+		{Diagnoses: []int{3, 4}, Patients: [][]*trajectory.Patient{{p3}}, Cluster: 2},
+	}}
+	overlap := trajectory.ClusterPatientOverlap(exp)
+	if expected := [][]int{{3, 2, 1}, {2, 2, 1}, {1, 1, 1}}; !reflect.DeepEqual(overlap.Shared, expected) {
+		t.Errorf("expected the overlap matrix %v, got %v", expected, overlap.Shared)
+	}
+	if memberships, shared := overlap.Memberships(); memberships != 6 || shared != 2 {
+		t.Errorf("expected 6 memberships of which 2 patients in several clusters, got %d and %d", memberships, shared)
+	}
+	dir := t.TempDir()
+	matrix, patients := filepath.Join(dir, "overlap.csv"), filepath.Join(dir, "patient-clusters.csv")
+	trajectory.PrintClusterOverlapToCSVFiles(exp, matrix, patients)
+	for name, expected := range map[string]string{
+		matrix:   "CID,0,1,2\n0,3,2,1\n1,2,2,1\n2,1,1,1\n",
+		patients: "PID,Clusters,CIDs\n1,1,0\n2,2,0;1\n3,3,0;1;2\n",
+	} {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("expected %s to be %q, got %q", name, expected, content)
+		}
+	}
+}
+
+func TestLocalizedNarrative(t *testing.T) {
+	dir := t.TempDir()
+	descriptions, messages := filepath.Join(dir, "descriptions.csv"), filepath.Join(dir, "messages.csv")
+	if err := os.WriteFile(descriptions, []byte("Code,Description\nR05,Hoest\nJ44,COPD\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(messages, []byte("Key,Text\nnarrative.subject,Patiënten\n"+
+		"narrative.transition,%[1]s met %[2]s hebben een %[3]s op %[4]s%[5]s (n=%[6]d).\n"+
+		"narrative.foldIncreased,%s-voudig verhoogd risico\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	exp := &trajectory.Experiment{NameMap: map[int]string{0: "Cough", 1: "COPD", 2: "Asthma"},
+		IdMap: map[int]string{0: "R05", 1: "J44", 2: "J45"}, DxDRR: [][]float64{{1, 2.14}, {1, 1}},
+		Hierarchy: map[int][]string{0: {"Symptoms", "Cough"}}}
+	names, err := app.ReadDescriptions(descriptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := app.LocalizeNames(names, exp.NameMap, exp.IdMap, exp.Hierarchy); n != 2 {
+		t.Errorf("expected 2 localized names, got %d", n)
+	}
+	if exp.NameMap[0] != "Hoest" || exp.NameMap[2] != "Asthma" || exp.Hierarchy[0][1] != "Hoest" {
+		t.Errorf("unexpected localized names %v and hierarchy %v", exp.NameMap, exp.Hierarchy)
+	}
+	if exp.Messages, err = trajectory.ReadMessages(messages); err != nil {
+		t.Fatal(err)
+	}
+	tr := &trajectory.Trajectory{Diagnoses: []int{0, 1}, PatientNumbers: []int{3}}
+	expected := "Patiënten met Hoest hebben een 2.1-voudig verhoogd risico op COPD (n=3)."
+	if narrative := trajectory.TrajectoryNarrative(exp, tr); narrative != expected {
+		t.Errorf("expected %q, got %q", expected, narrative)
+	}
+	for _, text := range []string{"Key,Text\nnarrative.unknown,x\n", "Key,Text\nnarrative.within,%d maanden\n",
+		"Key,Text\nnarrative.transition,%s met %s\n"} {
+		if err := os.WriteFile(messages, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := trajectory.ReadMessages(messages); err == nil {
+			t.Errorf("expected an error for the messages %q", text)
+		}
+	}
+}
+
+func TestNullPercentile(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.JaccardSimilarity,
+		GraphML: true, NullPercentile: 95}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(output, "exp1-clusters-directly")
+	_, header, err := trajectory.ReadPtraFile(filepath.Join(dir, "dump.exp1.mci.I20.clustered.ptra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cutoff float64
+	if _, err := fmt.Sscan(header.Metadata["minSimilarity"], &cutoff); err != nil || cutoff <= 0 || cutoff >= 1 || header.Metadata["nullPercentile"] != "95" {
+		t.Fatalf("expected the cutoff of the null model in the metadata, got %v", header.Metadata)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Edges []struct {
+			Similarity float64 `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range graphml.Edges {
+		if e.Similarity <= cutoff {
+			t.Errorf("expected only similarities above the cutoff %f of the null model, got %f", cutoff, e.Similarity)
+		}
+	}
+	minSimilarity := func(options cluster.Options) float64 {
+		if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+			t.Fatal(err)
+		}
+		_, header, err := trajectory.ReadPtraFile(filepath.Join(dir, "dump.exp1.mci.I20.clustered.ptra"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var minSimilarity float64
+		if s, ok := header.Metadata["minSimilarity"]; ok {
+			if _, err := fmt.Sscan(s, &minSimilarity); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return minSimilarity
+	}
+	// the shuffled trajectories keep the rate of progression of the trajectories they replace, so that not all pairs
+	// of unrelated trajectories progress at the same rate, which would give the cutoff (1 - weight) * cutoff + weight
+	options.TemporalWeight = 0.5
+	if temporal := minSimilarity(options); temporal <= 0 || temporal >= 0.5*cutoff+0.5 {
+		t.Errorf("expected a cutoff below %f with the rate of progression, got %f", 0.5*cutoff+0.5, temporal)
+	}
+	// the null model does not shuffle the patients of the trajectories
+	options.TemporalWeight = 0
+	options.PatientWeight = 0.5
+	if patients := minSimilarity(options); patients != 0 {
+		t.Errorf("expected no null model with the patient overlap, got the cutoff %f", patients)
+	}
+	options.PatientWeight = 0
+	options.NullPercentile = 150
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err == nil ||
+		!strings.Contains(err.Error(), "between 0 and 100") {
+		t.Errorf("expected an error for a percentile above 100, got %v", err)
+	}
+}
+
+func TestContainmentSimilarity(t *testing.T) {
+	short := &trajectory.Trajectory{Diagnoses: []int{1, 2}}
+	long := &trajectory.Trajectory{Diagnoses: []int{1, 2, 3}}
+	if s := cluster.ContainmentTrajectory(short, long); s != 1 {
+		t.Errorf("expected D1 -> D2 to be contained in D1 -> D2 -> D3, got %v", s)
+	}
+	if s := cluster.ContainmentTrajectory(long, short); math.Abs(s-2.0/3) > 1e-9 {
+		t.Errorf("expected D1 -> D2 -> D3 to be contained in D1 -> D2 for 2/3, got %v", s)
+	}
+	if s := cluster.ContainmentTrajectory(short, &trajectory.Trajectory{}); s != 0 {
+		t.Errorf("expected no containment in an empty trajectory, got %v", s)
+	}
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, Similarity: cluster.ContainmentSimilarity,
+		GraphML: true}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Graph struct {
+			EdgeDefault string `xml:"edgedefault,attr"`
+			Edges       []struct {
+				Source     string  `xml:"source,attr"`
+				Target     string  `xml:"target,attr"`
+				Similarity float64 `xml:"data"`
+			} `xml:"edge"`
+		} `xml:"graph"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	if graphml.Graph.EdgeDefault != "directed" {
+		t.Errorf("expected a directed similarity graph, got %q", graphml.Graph.EdgeDefault)
+	}
+	edges := map[[2]string]float64{}
+	for _, e := range graphml.Graph.Edges {
+		edges[[2]string{e.Source, e.Target}] = e.Similarity
+	}
+	asymmetric := false
+	for e, s := range edges {
+		if edges[[2]string{e[1], e[0]}] != s {
+			asymmetric = true
+		}
+	}
+	if len(edges) == 0 || !asymmetric {
+		t.Errorf("expected asymmetric edges in both directions, got %v", edges)
+	}
+}
+
+func corruptPtra(t *testing.T, header []byte, size uint64) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(protowire.AppendVarint(nil, size))
+	zw.Write(header)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestReadCorruptPtra(t *testing.T) {
+	diagnosis := func(id int) []byte {
+		d := protowire.AppendTag(nil, 1, protowire.VarintType)
+		d = protowire.AppendVarint(d, uint64(id))
+		d = protowire.AppendTag(d, 3, protowire.BytesType)
+		return protowire.AppendBytes(d, []byte("term"))
+	}
+	header := protowire.AppendTag(nil, 1, protowire.VarintType)
+	header = protowire.AppendVarint(header, 1)
+	header = protowire.AppendTag(header, 3, protowire.BytesType)
+	header = protowire.AppendBytes(header, diagnosis(0))
+	valid := header
+	header = protowire.AppendTag(header, 3, protowire.BytesType)
+	header = protowire.AppendBytes(header, diagnosis(1<<30))
+	if _, _, err := trajectory.ReadPtra(corruptPtra(t, header, uint64(len(header)))); err == nil ||
+		!strings.Contains(err.Error(), "out of range") {
+		t.Errorf("expected a diagnosis ID beyond the header to be rejected, got %v", err)
+	}
+	if _, _, err := trajectory.ReadPtra(corruptPtra(t, valid, 1<<62)); err == nil ||
+		!strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("expected an oversized message to be rejected, got %v", err)
+	}
+	if _, _, err := trajectory.ReadPtra(corruptPtra(t, valid, 1<<20)); err == nil {
+		t.Error("expected a truncated message to be rejected")
+	}
+	exp, _, err := trajectory.ReadPtra(corruptPtra(t, valid, uint64(len(valid))))
+	if err != nil || exp.NofDiagnosisCodes != 1 {
+		t.Errorf("expected a header with a single diagnosis, got %v", err)
+	}
+}
+
+func TestMissingSexAndDiagnosesExclusions(t *testing.T) {
+	dir := t.TempDir()
+	patientFile, diagnosisFile, vocabularyFile, err := app.WriteDemoData(filepath.Join(dir, "input"), 200, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(patientFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a patient of unknown sex, and a patient without any diagnoses
+	if _, err := f.WriteString("unknownSex,U,,,1970,,,,,,,\nnoDiagnoses,F,,,1970,,,,,,,\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, patients := app.ParseTriNetXData("exp1", patientFile, diagnosisFile, vocabularyFile, "", "", 6, 3, 0.5, 5, "",
+		false, []trajectory.PatientFilter{}, "", 0, "")
+	reasons := map[string]trajectory.Exclusion{}
+	for _, e := range patients.Exclusions {
+		reasons[e.PIDString] = e
+	}
+	if e := reasons["unknownSex"]; e.Reason != trajectory.ExcludedMissingSex || e.Detail != "U" {
+		t.Errorf("expected the patient of unknown sex to be excluded as %s, got %v", trajectory.ExcludedMissingSex, e)
+	}
+	if e := reasons["noDiagnoses"]; e.Reason != trajectory.ExcludedNoDiagnoses {
+		t.Errorf("expected the patient without diagnoses to be excluded as %s, got %v", trajectory.ExcludedNoDiagnoses,
+			e)
+	}
+	for _, p := range patients.PIDMap {
+		if len(p.Diagnoses) == 0 || (p.Sex != trajectory.Male && p.Sex != trajectory.Female) {
+			t.Fatalf("expected only patients with a sex and diagnoses, got %v", p.PIDString)
+		}
+	}
+	if patients.MaleCtr+patients.FemaleCtr != len(patients.PIDMap) {
+		t.Errorf("expected %d male and female patients, got %d", len(patients.PIDMap),
+			patients.MaleCtr+patients.FemaleCtr)
+	}
+}
+
+func TestPreflightDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	options := cluster.Options{Granularities: []int{40}}
+	if err := cluster.PreflightDiskSpace(dir, 0, 1000, &options); err != nil {
+		t.Errorf("expected enough disk space for the outputs of 1000 patients, got %v", err)
+	}
+	// the quadratic matrix of 100 million trajectories does not fit on any test machine
+	err := cluster.PreflightDiskSpace(dir, 100000000, 1000, &options)
+	if err == nil || !strings.Contains(err.Error(), "not enough disk space") {
+		t.Errorf("expected the run to be refused, got %v", err)
+	}
+	options.SkipDiskCheck = true
+	if err := cluster.PreflightDiskSpace(dir, 100000000, 1000, &options); err != nil {
+		t.Errorf("expected the check to be skipped, got %v", err)
+	}
+}
+
+func TestBuildTrajectoriesByChapter(t *testing.T) {
+	exp, _ := demoExperiment(t, t.TempDir(), 1000)
+	all := exp.Trajectories
+	chapters := map[string]bool{}
+	for _, traj := range all {
+		chapters[trajectory.DiagnosisChapter(exp, traj.Diagnoses[0])] = true
+	}
+	if len(chapters) < 2 {
+		t.Fatalf("expected trajectories that start in several chapters, got %v", chapters)
+	}
+	chunked := trajectory.BuildTrajectoriesByChapter(exp, 10, 5, 3, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	if len(chunked) != len(all) {
+		t.Fatalf("expected %d trajectories when building by chapter, got %d", len(all), len(chunked))
+	}
+	for i, traj := range chunked {
+		if !reflect.DeepEqual(traj.Diagnoses, all[i].Diagnoses) ||
+			!reflect.DeepEqual(traj.PatientNumbers, all[i].PatientNumbers) ||
+			!reflect.DeepEqual(traj.Patients, all[i].Patients) {
+			t.Errorf("expected trajectory %d to be %v %v when building by chapter, got %v %v", i, all[i].Diagnoses,
+				all[i].PatientNumbers, traj.Diagnoses, traj.PatientNumbers)
+		}
+	}
+}
+
+// buildPtra builds the ptra command in dir, to test its subcommands.
+func buildPtra(t *testing.T, dir string) string {
+	ptra := filepath.Join(dir, "ptra")
+	if output, err := exec.Command("go", "build", "-o", ptra, "..").CombinedOutput(); err != nil {
+		t.Fatalf("cannot build ptra: %v\n%s", err, output)
+	}
+	return ptra
+}
+
+func TestDiffRuns(t *testing.T) {
+	dir := t.TempDir()
+	ptra := buildPtra(t, dir)
+	writeRun := func(path string, minPatients, trajectories int) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		config := fmt.Sprintf(`{"FormatVersion":1,"Name":"run","OutputPath":%q,"MinPatients":%d,"RR":1}`,
+			path+"/", minPatients)
+		snapshot := fmt.Sprintf(`{"FormatVersion":1,"Version":"test","Trajectories":%d,`+
+			`"TrajectoryLengths":{"2":%d},"Pairs":30,"RRPairs":20,"RRQuantiles":[1,1.5,2,3,5],`+
+			`"ClusterSizes":{"4":[8,4]}}`, trajectories, trajectories)
+		if err := os.WriteFile(filepath.Join(path, "run.config.json"), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "run.snapshot.json"), []byte(snapshot), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pathA, pathB, pathC := filepath.Join(dir, "A"), filepath.Join(dir, "B"), filepath.Join(dir, "C")
+	writeRun(pathA, 5, 12)
+	writeRun(pathB, 10, 13)
+	writeRun(pathC, 5, 12)
+	// the runs differ in one parameter and in the trajectory counts, which are not within the default tolerance
+	output, err := exec.Command(ptra, "diff", pathA, pathB).Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("expected exit status 1 for differing runs, got %v", err)
+	}
+	report := string(output)
+	for _, line := range []string{"DIFF MinPatients: A 5, B 10\n", "DIFF trajectories: A 12, B 13\n",
+		"DIFF trajectories of length 2: A 12, B 13\n", "same diagnosis pairs: A 30, B 30\n",
+		"same size of cluster 1 for granularity 4: A 8, B 8\n", "The runs differ in 3 parameters and outputs.\n"} {
+		if !strings.Contains(report, line) {
+			t.Errorf("expected %q in the report:\n%s", line, report)
+		}
+	}
+	if strings.Contains(report, "OutputPath") || strings.Contains(report, "DIFF RR") {
+		t.Errorf("expected only the differing parameters in the report:\n%s", report)
+	}
+	// a relative tolerance of 10% accepts the trajectory counts
+	output, err = exec.Command(ptra, "diff", pathA, pathB, "--tolerance", "0.1").Output()
+	if err == nil || !strings.Contains(string(output), "The runs differ in 1 parameters and outputs.\n") {
+		t.Errorf("expected only the parameter to differ with a tolerance, got %v:\n%s", err, output)
+	}
+	output, err = exec.Command(ptra, "diff", pathA, pathC).Output()
+	if err != nil || !strings.Contains(string(output), "same parameters\n") ||
+		!strings.Contains(string(output), "The runs are the same.\n") {
+		t.Errorf("expected the same runs, got %v:\n%s", err, output)
+	}
+}
+
+func TestLoadClusterer(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "infomap.json")
+	config := `{"Command":["Infomap","{input}","{dir}","--two-level"],"Output":"infomap.clu","OutputFormat":"pairs"}`
+	if err := os.WriteFile(fileName, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clusterer, err := cluster.LoadClusterer(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusterer.Name != "Infomap" || clusterer.Input != "abc" || clusterer.OutputFormat != "pairs" {
+		t.Errorf("expected the name of the command and the abc input by default, got %+v", clusterer)
+	}
+	for _, test := range []struct {
+		config, expected string
+	}{
+		{`{"Output":"out.txt"}`, "a clusterer needs a command and an output file"},
+		{`{"Command":["lpa"]}`, "a clusterer needs a command and an output file"},
+		{`{"Command":["lpa"],"Output":"out.txt","Input":"csv"}`, "unknown input format csv"},
+		{`{"Command":["lpa"],"Output":"out.txt","OutputFormat":"json"}`, "unknown output format json"},
+	} {
+		if err := os.WriteFile(fileName, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cluster.LoadClusterer(fileName); err == nil || err.Error() != fileName+": "+test.expected {
+			t.Errorf("expected the error %s for %s, got %v", test.expected, test.config, err)
+		}
+	}
+}
+
+func TestStreamAbcIntoMcxload(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	// a fake mcxload that keeps a copy of its abc input, and then fails so that the clustering stops
+	mclPath := t.TempDir() + string(filepath.Separator)
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do if [ \"$1\" = -abc ]; then input=$2; fi; shift; done\n" +
+		"cat \"$input\" > received.abc\necho reading abc\necho loading\necho out of memory >&2\nexit 3\n"
+	if err := os.WriteFile(mclPath+"mcxload", []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	workingDir := filepath.Join(output, "exp1-clusters")
+	received := map[bool][]byte{}
+	for _, abcFile := range []bool{false, true} {
+		err := cluster.ClusterTrajectories(exp, output, cluster.Options{Granularities: []int{20}, MclPath: mclPath,
+			AbcFile: abcFile})
+		var mclErr *cluster.MclError
+		if !errors.As(err, &mclErr) || mclErr.ExitCode != 3 {
+			t.Fatalf("expected the exit code of the fake mcxload, got %v", err)
+		}
+		if received[abcFile], err = os.ReadFile(filepath.Join(workingDir, "received.abc")); err != nil {
+			t.Fatal(err)
+		}
+		// the diagnostics bundle of the failed mcxload
+		abcInput := "-"
+		if abcFile {
+			abcInput = filepath.Join(workingDir, "exp1.abc")
+		}
+		if mclErr.Bundle != filepath.Join(workingDir, "mcl-diagnostics") ||
+			!strings.HasSuffix(mclErr.Error(), "out of memory (diagnostics in "+mclErr.Bundle+")") {
+			t.Errorf("expected the diagnostics bundle in the error, got %v", mclErr)
+		}
+		bundle := map[string]string{}
+		for _, name := range []string{"command.txt", "stdout.txt", "stderr.txt", "inputs.txt"} {
+			contents, err := os.ReadFile(filepath.Join(mclErr.Bundle, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bundle[name] = string(contents)
+		}
+		if len(mclErr.Command) < 3 || mclErr.Command[0] != mclPath+"mcxload" || mclErr.Command[1] != "-abc" ||
+			mclErr.Command[2] != abcInput || !strings.HasPrefix(bundle["command.txt"],
+			strings.Join(mclErr.Command, " ")+"\nexit code: 3\nerror: exit status 3\n") {
+			t.Errorf("expected the command line of mcxload with input %s, got %q", abcInput, bundle["command.txt"])
+		}
+		if bundle["stdout.txt"] != "reading abc\nloading\n" || bundle["stderr.txt"] != "out of memory\n" {
+			t.Errorf("expected the output of mcxload, got %q and %q", bundle["stdout.txt"], bundle["stderr.txt"])
+		}
+		inputs := ""
+		if abcFile {
+			inputs = fmt.Sprintf("%s\t%d bytes\tmodified ", abcInput, len(received[abcFile]))
+		}
+		if !strings.HasPrefix(bundle["inputs.txt"], inputs) || (inputs == "") != (bundle["inputs.txt"] == "") {
+			t.Errorf("expected the stats of the input files %q, got %q", inputs, bundle["inputs.txt"])
+		}
+		_, err = os.Stat(filepath.Join(workingDir, "exp1.abc"))
+		if abcFile != (err == nil) {
+			t.Errorf("expected an intermediate abc file only with AbcFile %v, got %v", abcFile, err)
+		}
+		if abcFile {
+			if abc, err := os.ReadFile(filepath.Join(workingDir, "exp1.abc")); err != nil ||
+				!bytes.Equal(abc, received[abcFile]) {
+				t.Errorf("expected mcxload to read the intermediate abc file, got %v", err)
+			}
+		}
+	}
+	if len(received[false]) == 0 || !bytes.Equal(received[false], received[true]) {
+		t.Errorf("expected the same similarities streamed into mcxload as in the abc file, got %d and %d bytes",
+			len(received[false]), len(received[true]))
+	}
+}
+
+func TestUndefinedStatistics(t *testing.T) {
+	if r, ok := utils.Ratio(3, 0); ok || !math.IsNaN(r) {
+		t.Errorf("expected NaN for a division by zero, got %v", r)
+	}
+	if p, ok := utils.Percentage(1, 4); !ok || p != 25 {
+		t.Errorf("expected 25%%, got %v", p)
+	}
+	// sums beyond 32 bits
+	if r, ok := utils.Ratio(1<<40, 1<<38); !ok || r != 4 {
+		t.Errorf("expected a ratio of 4, got %v", r)
+	}
+	s := utils.FormatStat(math.NaN(), 2) + " " + utils.FormatStat(math.Inf(1), 2) + " " + utils.FormatStat(1.5, 2)
+	if s != "NA NA 1.50" {
+		t.Errorf("expected undefined statistics as NA, got %s", s)
+	}
+	ageMean, sd, ageEOIMean, sdEOI, males, females := trajectory.MetricsFromTrajectories(nil)
+	if !math.IsNaN(ageMean) || !math.IsNaN(sd) || !math.IsNaN(ageEOIMean) || !math.IsNaN(sdEOI) || males+females != 0 {
+		t.Errorf("expected NaN statistics without patients, got %v %v %v %v %d %d", ageMean, sd, ageEOIMean, sdEOI,
+			males, females)
+	}
+	exp, _ := demoExperiment(t, t.TempDir(), 500)
+	tr := exp.Trajectories[0]
+	patients := tr.Patients[len(tr.Patients)-1]
+	for _, p := range patients {
+		p.EOIDate = nil
+	}
+	ageMean, sd, ageEOIMean, sdEOI, males, females = trajectory.MetricsFromTrajectories([]*trajectory.Trajectory{tr})
+	if math.IsNaN(ageMean) || math.IsNaN(sd) || !math.IsNaN(ageEOIMean) || !math.IsNaN(sdEOI) ||
+		males+females != int64(len(patients)) {
+		t.Errorf("expected NaN EOI statistics without patients with an EOI, got %v %v %v %v %d %d", ageMean, sd,
+			ageEOIMean, sdEOI, males, females)
+	}
+	patients[0].EOIDate = &trajectory.DiagnosisDate{Year: patients[0].YOB + 60, Month: 1, Day: 1}
+	_, _, ageEOIMean, sdEOI, _, _ = trajectory.MetricsFromTrajectories([]*trajectory.Trajectory{tr})
+	if ageEOIMean != 60 || sdEOI != 0 {
+		t.Errorf("expected a mean EOI age of 60 for a single patient with an EOI, got %v %v", ageEOIMean, sdEOI)
+	}
+}
+
+func TestServeResults(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 500)
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, cluster.Options{Granularities: []int{20},
+		Native: true}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.NewServer(output).Handler())
+	defer ts.Close()
+	get := func(path string, query url.Values) (int, string) {
+		resp, err := http.Get(ts.URL + path + "?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+	trajectoriesFile := "exp1-trajectories.tab"
+	clusteredFile := "exp1-clusters-directly/dump.exp1.mci.I20.clustered.trajectories.tab"
+	if status, body := get("/", nil); status != http.StatusOK || !strings.Contains(body, ">"+trajectoriesFile+"</a>") ||
+		!strings.Contains(body, ">"+clusteredFile+"</a>") {
+		t.Errorf("expected links to the trajectories and clusters on the index page, got %d:\n%s", status, body)
+	}
+	// filter on the number of patients of all transitions, and on a diagnosis name
+	minPatients := exp.Trajectories[0].PatientNumbers[0]
+	for _, n := range exp.Trajectories[0].PatientNumbers {
+		minPatients = utils.MinInt(minPatients, n)
+	}
+	name := exp.NameMap[exp.Trajectories[0].Diagnoses[0]]
+	kept := 0
+	for _, tr := range exp.Trajectories {
+		contains, enough := false, true
+		for _, d := range tr.Diagnoses {
+			contains = contains || strings.Contains(strings.ToLower(exp.NameMap[d]), strings.ToLower(name))
+		}
+		for _, n := range tr.PatientNumbers {
+			enough = enough && n >= minPatients
+		}
+		if contains && enough {
+			kept++
+		}
+	}
+	query := url.Values{"file": {trajectoriesFile}, "minPatients": {strconv.Itoa(minPatients)}, "contains": {name}}
+	if status, body := get("/trajectories", query); status != http.StatusOK ||
+		!strings.Contains(body, fmt.Sprintf("<p>%d trajectories.", kept)) {
+		t.Errorf("expected %d filtered trajectories, got %d:\n%s", kept, status, body)
+	}
+	status, export := get("/export", query)
+	if lines := strings.Split(strings.TrimSuffix(export, "\n"), "\n"); status != http.StatusOK || kept == 0 ||
+		len(lines) != 2*kept || !strings.Contains(lines[0], name) {
+		t.Errorf("expected %d exported trajectories containing %s, got %d:\n%s", kept, name, status, export)
+	}
+	// a cluster page lists the trajectories of the cluster, and links its graph
+	cid := exp.Trajectories[0].Cluster
+	members := 0
+	for _, tr := range exp.Trajectories {
+		if tr.Cluster == cid {
+			members++
+		}
+	}
+	query = url.Values{"file": {clusteredFile}, "cid": {strconv.Itoa(cid)}}
+	if status, body := get("/cluster", query); status != http.StatusOK ||
+		strings.Count(body, "<tr><td>") != members || !strings.Contains(body, "/graph.svg?") {
+		t.Errorf("expected the %d trajectories of cluster %d, got %d:\n%s", members, cid, status, body)
+	}
+	if status, body := get("/graph.svg", query); status != http.StatusOK || !strings.Contains(body, "<svg") {
+		t.Errorf("expected the graph of cluster %d, got %d:\n%s", cid, status, body)
+	}
+	// files outside the results directory are refused
+	status, _ = get("/trajectories", url.Values{"file": {"../input/patients.csv"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a bad request for a file outside the results, got %d", status)
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	logs := server.NewLogBuffer(3)
+	server.ServeStatus(addr, logs)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(logs, "log line %d\n", i)
+	}
+	fmt.Fprint(logs, "partial line")
+	utils.StartStage("Finished stage", 2)
+	stage := utils.StartStage("Running stage", 8)
+	stage.Add(3)
+	defer utils.FinishStages()
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(body)
+	for _, expected := range []string{"<td>Finished stage</td>\n<td>done</td>",
+		`<td>Running stage</td>
+<td><progress value="3" max="8"></progress> 3/8</td>`, "log line 4", " MB heap"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q on the status page, got\n%s", expected, page)
+		}
+	}
+	// only the last complete log lines are shown
+	if strings.Contains(page, "log line 1") || strings.Contains(page, "partial line") {
+		t.Errorf("expected only the 3 most recent log lines, got\n%s", page)
+	}
+}
+
+func TestVerifyRun(t *testing.T) {
+	dir := t.TempDir()
+	ptra := buildPtra(t, dir)
+	demo := filepath.Join(dir, "demo")
+	if output, err := exec.Command(ptra, "demo", demo, "--patients", "500", "--quiet").CombinedOutput(); err != nil {
+		t.Fatalf("the demo run failed: %v\n%s", err, output)
+	}
+	configFile := filepath.Join(demo, "output", "demo.config.json")
+	snapshotFile := filepath.Join(demo, "output", "demo.snapshot.json")
+	// a rerun with the same configuration reproduces the snapshot
+	output, err := exec.Command(ptra, "verify", configFile, snapshotFile, "--outputPath",
+		filepath.Join(dir, "rerun")).Output()
+	if err != nil || !strings.Contains(string(output), "OK   trajectories: reference") ||
+		!strings.Contains(string(output), "Verification succeeded.\n") {
+		t.Errorf("expected the rerun to reproduce the snapshot, got %v:\n%s", err, output)
+	}
+	// against a snapshot with many more trajectories, the verification fails
+	var reference map[string]interface{}
+	content, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &reference); err != nil {
+		t.Fatal(err)
+	}
+	trajectories := int(reference["Trajectories"].(float64))
+	reference["Trajectories"] = trajectories + 10
+	if content, err = json.Marshal(reference); err != nil {
+		t.Fatal(err)
+	}
+	altered := filepath.Join(dir, "altered.snapshot.json")
+	if err := os.WriteFile(altered, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err = exec.Command(ptra, "verify", configFile, altered, "--outputPath",
+		filepath.Join(dir, "rerun2")).Output()
+	expected := fmt.Sprintf("FAIL trajectories: reference %d, verified %d\n", trajectories+10, trajectories)
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 ||
+		!strings.Contains(string(output), expected) ||
+		!strings.Contains(string(output), "Verification failed: 1 outputs differ more than the tolerance.\n") {
+		t.Errorf("expected the verification to fail on the trajectory count, got %v:\n%s", err, output)
+	}
+}
+
+// testScorer is an external scorer that logs the diagnoses and the counts it receives to the file in PTRA_SCORER_LOG,
+// and scores a pair of trajectories as 1 / (1 + the difference of their lengths).
+const testScorer = `package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	r := bufio.NewReader(os.Stdin)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	read := func(v interface{}) {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	readString := func() string {
+		var n uint32
+		read(&n)
+		s := make([]byte, n)
+		if _, err := io.ReadFull(r, s); err != nil {
+			panic(err)
+		}
+		return string(s)
+	}
+	log, err := os.Create(os.Getenv("PTRA_SCORER_LOG"))
+	if err != nil {
+		panic(err)
+	}
+	defer log.Close()
+	magic := make([]byte, 4)
+	var version, nofDiagnoses, nofTrajectories uint32
+	read(magic)
+	read(&version)
+	fmt.Fprintf(log, "%s %d\n", magic, version)
+	read(&nofDiagnoses)
+	for i := uint32(0); i < nofDiagnoses; i++ {
+		var did int32
+		read(&did)
+		code := readString()
+		fmt.Fprintf(log, "%d\t%s\t%s\n", did, code, readString())
+	}
+	read(&nofTrajectories)
+	lengths := make([]uint32, nofTrajectories)
+	for i := range lengths {
+		read(&lengths[i])
+		read(make([]int32, lengths[i]))
+	}
+	var nofPairs uint64
+	read(&nofPairs)
+	fmt.Fprintf(log, "%d trajectories, %d pairs\n", nofTrajectories, nofPairs)
+	for k := uint64(0); k < nofPairs; k++ {
+		var pair [2]uint32
+		read(&pair)
+		d := int(lengths[pair[0]]) - int(lengths[pair[1]])
+		if d < 0 {
+			d = -d
+		}
+		if err := binary.Write(w, binary.LittleEndian, 1/float64(1+d)); err != nil {
+			panic(err)
+		}
+	}
+}
+`
+
+func TestExternalScorer(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "scorer.go"), []byte(testScorer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scorer := filepath.Join(dir, "scorer")
+	build := exec.Command("go", "build", "-o", scorer, filepath.Join(dir, "scorer.go"))
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("cannot build the scorer: %v\n%s", err, output)
+	}
+	scorerLog := filepath.Join(dir, "scorer.log")
+	t.Setenv("PTRA_SCORER_LOG", scorerLog)
+	exp, output := demoExperiment(t, dir, 500)
+	options := cluster.Options{Granularities: []int{20}, Native: true, ScorerPath: scorer, GraphML: true}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	// the scorer receives the diagnoses with their codes and names, and all pairs of trajectories
+	content, err := os.ReadFile(scorerLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	n := len(exp.Trajectories)
+	d := exp.Trajectories[0].Diagnoses[0]
+	if len(lines) != len(exp.NameMap)+2 || lines[0] != "PTRA 1" ||
+		lines[len(lines)-1] != fmt.Sprintf("%d trajectories, %d pairs", n, n*(n-1)/2) ||
+		!strings.Contains(string(content), fmt.Sprintf("\n%d\t%s\t%s\n", d, exp.IdMap[d], exp.NameMap[d])) {
+		t.Errorf("unexpected input of the scorer:\n%s", content)
+	}
+	// the scores of the scorer are the similarities that are clustered
+	similarities := readSimilarityGraph(t, filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	if len(similarities) != n*(n-1)/2 {
+		t.Fatalf("expected an edge for each of the %d pairs of trajectories, got %d", n*(n-1)/2, len(similarities))
+	}
+	for pair, s := range similarities {
+		l1, l2 := len(exp.Trajectories[pair[0]].Diagnoses), len(exp.Trajectories[pair[1]].Diagnoses)
+		if expected := 1 / (1 + math.Abs(float64(l1-l2))); math.Abs(s-expected) > 1e-6 {
+			t.Errorf("expected the score %f for the trajectories %v, got %f", expected, pair, s)
+		}
+	}
+}
+
+// readSimilarityGraph reads the similarities of the pairs of trajectories in a GraphML similarity graph, cf.
+// Options.GraphML.
+func readSimilarityGraph(t *testing.T, fileName string) map[[2]int]float64 {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphml struct {
+		Edges []struct {
+			Source     string  `xml:"source,attr"`
+			Target     string  `xml:"target,attr"`
+			Similarity float64 `xml:"data"`
+		} `xml:"graph>edge"`
+	}
+	if err := xml.Unmarshal(content, &graphml); err != nil {
+		t.Fatal(err)
+	}
+	similarities := map[[2]int]float64{}
+	for _, e := range graphml.Edges {
+		var i, j int
+		if _, err := fmt.Sscanf(e.Source+" "+e.Target, "t%d t%d", &i, &j); err != nil {
+			t.Fatal(err)
+		}
+		similarities[[2]int{i, j}] = e.Similarity
+	}
+	return similarities
+}
+
+func TestSplitGraphs(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	single, split := filepath.Join(output, "single"), filepath.Join(output, "split")
+	for _, path := range []string{single, split} {
+		options := cluster.Options{Granularities: []int{20}, Native: true, SplitGraphs: path == split}
+		if err := cluster.ClusterTrajectoriesDirectly(exp, path, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clusters := trajectory.CollectClusters(exp)
+	if len(clusters) < 2 {
+		t.Fatalf("expected several clusters, got %d", len(clusters))
+	}
+	for _, graphs := range []string{"trajectories", "trajectories.RR"} {
+		name := filepath.Join("exp1-clusters-directly", "dump.exp1.mci.I20."+graphs)
+		concatenated, err := os.ReadFile(filepath.Join(single, name+".gml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(split, name+".gml")); !os.IsNotExist(err) {
+			t.Errorf("expected no concatenated %s graphs when splitting them, got %v", graphs, err)
+		}
+		index, err := os.ReadFile(filepath.Join(split, name, "index.tsv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(index), "\n"), "\n")
+		if len(lines) != len(clusters)+1 || lines[0] != "CID\tFile\tTrajectories\tDiagnoses" {
+			t.Fatalf("expected an index of the %d clusters, got\n%s", len(clusters), index)
+		}
+		// the graphs in the separate files are the graphs in the concatenated file
+		var graphsOfClusters []byte
+		for cid, line := range lines[1:] {
+			fields := strings.Split(line, "\t")
+			if fields[0] != strconv.Itoa(cid) || fields[1] != fmt.Sprintf("cluster-%d.gml", cid) ||
+				fields[2] != strconv.Itoa(len(clusters[cid])) {
+				t.Errorf("unexpected index line %s for cluster %d with %d trajectories", line, cid,
+					len(clusters[cid]))
+			}
+			graph, err := os.ReadFile(filepath.Join(split, name, fields[1]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			graphsOfClusters = append(graphsOfClusters, graph...)
+		}
+		if !bytes.Equal(graphsOfClusters, concatenated) {
+			t.Errorf("expected the separate %s graphs to make up the concatenated graphs", graphs)
+		}
+	}
+}
+
+func TestTemporalWeight(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	options := cluster.Options{Granularities: []int{20}, Native: true, TemporalWeight: 0.4, GraphML: true,
+		SimilarityFunc: func(t1, t2 *trajectory.Trajectory) float64 {
+			if t1.Diagnoses[0] == t2.Diagnoses[0] {
+				return 0
+			}
+			return 0.5
+		}}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	// the median gap between the diagnoses and the median duration of a trajectory, over its patients
+	features := func(tr *trajectory.Trajectory) (float64, float64) {
+		gaps, durations := []float64{}, []float64{}
+		for _, p := range trajectory.LastPatients(tr) {
+			dates := trajectory.TrajectoryDates(p, tr.Diagnoses)
+			for i := 1; i < len(dates); i++ {
+				gaps = append(gaps, trajectory.DiagnosisDateToFloat(dates[i])-
+					trajectory.DiagnosisDateToFloat(dates[i-1]))
+			}
+			durations = append(durations, trajectory.DiagnosisDateToFloat(dates[len(dates)-1])-
+				trajectory.DiagnosisDateToFloat(dates[0]))
+		}
+		return utils.Median(gaps), utils.Median(durations)
+	}
+	ratio := func(x, y float64) float64 { return math.Min(x, y) / math.Max(x, y) }
+	similarities := readSimilarityGraph(t, filepath.Join(output, "exp1-clusters-directly", "exp1.similarities.graphml"))
+	slower := 0
+	for i, t1 := range exp.Trajectories {
+		for j := i + 1; j < len(exp.Trajectories); j++ {
+			t2 := exp.Trajectories[j]
+			s, ok := similarities[[2]int{i, j}]
+			// unrelated trajectories are not grouped because of their timing only
+			if t1.Diagnoses[0] == t2.Diagnoses[0] {
+				if ok {
+					t.Errorf("expected no edge between the unrelated trajectories %d and %d, got %f", i, j, s)
+				}
+				continue
+			}
+			gap1, duration1 := features(t1)
+			gap2, duration2 := features(t2)
+			temporal := (ratio(gap1, gap2) + ratio(duration1, duration2)) / 2
+			if expected := 0.6*0.5 + 0.4*temporal; !ok || math.Abs(s-expected) > 1e-6 {
+				t.Errorf("expected the similarity %f for the trajectories %d and %d, got %f", expected, i, j, s)
+			}
+			if temporal < 0.9 {
+				slower++
+			}
+		}
+	}
+	if slower == 0 {
+		t.Error("expected trajectories that progress at a different rate")
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	dir := t.TempDir()
+	ptra := buildPtra(t, dir)
+	demo := filepath.Join(dir, "demo")
+	if output, err := exec.Command(ptra, "demo", demo, "--patients", "1000", "--quiet").CombinedOutput(); err != nil {
+		t.Fatalf("the demo run failed: %v\n%s", err, output)
+	}
+	output := filepath.Join(demo, "output")
+	resultFile := filepath.Join(output, "exp1-clusters-directly", "dump.exp1.mci.I20.clustered.trajectories.tab")
+	ts, nameMap, _, err := trajectory.ReadClusteredTrajectoriesFromTabFile(resultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs, err := trajectory.ReadPairsFromTabFile(filepath.Join(output, "exp1-pairs.tab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// select the cluster of the first trajectory and one more, and the support and the RR of its weakest transition
+	minSupport, minRR := ts[0].PatientNumbers[0], math.Inf(1)
+	for i, n := range ts[0].PatientNumbers {
+		minSupport = utils.MinInt(minSupport, n)
+		minRR = math.Min(minRR, rrs[[2]string{nameMap[ts[0].Diagnoses[i]], nameMap[ts[0].Diagnoses[i+1]]}])
+	}
+	clusters := map[int]bool{ts[0].Cluster: true, ts[len(ts)-1].Cluster: true}
+	expected, keptClusters := []string{}, map[int]bool{}
+	for _, tr := range ts {
+		keep := clusters[tr.Cluster]
+		for i, n := range tr.PatientNumbers {
+			rr, ok := rrs[[2]string{nameMap[tr.Diagnoses[i]], nameMap[tr.Diagnoses[i+1]]}]
+			keep = keep && n >= minSupport && ok && rr >= minRR
+		}
+		if keep {
+			names := []string{}
+			for _, d := range tr.Diagnoses {
+				names = append(names, nameMap[d])
+			}
+			expected = append(expected, strings.Join(names, " -> "))
+			keptClusters[tr.Cluster] = true
+		}
+	}
+	if len(expected) == 0 || len(expected) == len(ts) {
+		t.Fatalf("expected the filters to select some of the %d trajectories, got %d", len(ts), len(expected))
+	}
+	exported := filepath.Join(dir, "exported.tab")
+	args := []string{"export", resultFile, exported, "--min-support", strconv.Itoa(minSupport), "--min-rr",
+		strconv.FormatFloat(minRR, 'f', -1, 64), "--clusters",
+		fmt.Sprintf("%d,%d", ts[0].Cluster, ts[len(ts)-1].Cluster), "--format", "tab", "--quiet"}
+	if output, err := exec.Command(ptra, args...).CombinedOutput(); err != nil {
+		t.Fatalf("the export failed: %v\n%s", err, output)
+	}
+	kept, keptNames, err := trajectory.ReadTrajectoriesFromTabFile(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, tr := range kept {
+		names := []string{}
+		for _, d := range tr.Diagnoses {
+			names = append(names, keptNames[d])
+		}
+		got = append(got, strings.Join(names, " -> "))
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the filtered trajectories\n%s\ngot\n%s", strings.Join(expected, "\n"),
+			strings.Join(got, "\n"))
+	}
+	// the same selection as a graph per cluster
+	args[2], args[len(args)-2] = filepath.Join(dir, "exported.graphml"), "graphml"
+	if output, err := exec.Command(ptra, args...).CombinedOutput(); err != nil {
+		t.Fatalf("the export failed: %v\n%s", err, output)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "exported.graphml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "<graph "); n != len(keptClusters) {
+		t.Errorf("expected a graph for each of the %d clusters with selected trajectories, got %d", len(keptClusters),
+			n)
+	}
+}
+
+func TestProfilingFlags(t *testing.T) {
+	dir := t.TempDir()
+	ptra := buildPtra(t, dir)
+	demo := filepath.Join(dir, "demo")
+	heap := filepath.Join(dir, "profiles", "heap.pprof")
+	args := []string{"demo", demo, "--patients", "500", "--quiet", "--cpuprofile", "cpu.pprof", "--memprofile", heap,
+		"--trace", "run.trace"}
+	if output, err := exec.Command(ptra, args...).CombinedOutput(); err != nil {
+		t.Fatalf("the demo run failed: %v\n%s", err, output)
+	}
+	// relative profile names are in the output directory, the pprof profiles are gzipped, the trace has a header
+	output := filepath.Join(demo, "output")
+	for file, prefix := range map[string]string{filepath.Join(output, "cpu.pprof"): "\x1f\x8b", heap: "\x1f\x8b",
+		filepath.Join(output, "run.trace"): "go 1."} {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Error(err)
+		} else if !strings.HasPrefix(string(content), prefix) {
+			t.Errorf("expected %s to start with %q, got %q", file, prefix, content[:utils.MinInt(len(content), 8)])
+		}
+	}
+	// other commands accept the flags as well
+	run := filepath.Join(output, "demo.config.json")
+	snapshot := filepath.Join(output, "demo.snapshot.json")
+	args = []string{"verify", run, snapshot, "--outputPath", filepath.Join(dir, "rerun"), "--quiet", "--memprofile",
+		"verify.pprof"}
+	if output, err := exec.Command(ptra, args...).CombinedOutput(); err != nil {
+		t.Fatalf("the verification failed: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rerun", "verify.pprof")); err != nil {
+		t.Errorf("expected the heap profile of verify in its output path: %v", err)
+	}
+}
+
+func TestBundleEdges(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	options := cluster.Options{Granularities: []int{20}, Native: true, SplitGraphs: true, BundleEdges: true}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	edgePattern := regexp.MustCompile(`edge \[\nsource (\d+)\ntarget (\d+)\nlabel \S+\npatients (\d+)\nrr (\S+)\n` +
+		`trajectories (\d+)\n`)
+	parallel := false
+	for cid, collected := range trajectory.CollectClusters(exp) {
+		// the bundled edges of the transitions in the cluster: the summed patients, the maximum RR, and the number of
+		// trajectories
+		type bundle struct {
+			patients, trajectories int
+			rr                     float64
+		}
+		bundles := map[string]*bundle{}
+		occurrences := 0
+		for _, tr := range collected {
+			for i := 1; i < len(tr.Diagnoses); i++ {
+				occurrences++
+				key := fmt.Sprintf("%d->%d", tr.Diagnoses[i-1], tr.Diagnoses[i])
+				if bundles[key] == nil {
+					bundles[key] = &bundle{rr: math.Inf(-1)}
+				}
+				b := bundles[key]
+				b.patients += tr.PatientNumbers[i-1]
+				b.trajectories++
+				b.rr = math.Max(b.rr, exp.DxDRR[tr.Diagnoses[i-1]][tr.Diagnoses[i]])
+			}
+		}
+		expected := map[string]string{}
+		for key, b := range bundles {
+			expected[key] = fmt.Sprintf("%d %.2f %d", b.patients, b.rr, b.trajectories)
+		}
+		parallel = parallel || occurrences > len(bundles)
+		content, err := os.ReadFile(filepath.Join(output, "exp1-clusters-directly", "dump.exp1.mci.I20.trajectories",
+			fmt.Sprintf("cluster-%d.gml", cid)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		edges := map[string]string{}
+		for _, m := range edgePattern.FindAllStringSubmatch(string(content), -1) {
+			key := m[1] + "->" + m[2]
+			if _, ok := edges[key]; ok {
+				t.Errorf("expected one edge for the transition %s in cluster %d", key, cid)
+			}
+			edges[key] = m[3] + " " + m[4] + " " + m[5]
+		}
+		if !reflect.DeepEqual(edges, expected) {
+			t.Errorf("expected the bundled edges %v in cluster %d, got %v", expected, cid, edges)
+		}
+	}
+	if !parallel {
+		t.Error("expected transitions that occur in several trajectories of a cluster")
+	}
+}
+
+func TestClusterSizeConstraints(t *testing.T) {
+	exp, output := demoExperiment(t, t.TempDir(), 1000)
+	trajectory.BuildTrajectories(exp, 5, 5, 2, 0.5, 5, 1.0, []trajectory.TrajectoryFilter{})
+	// all trajectories are somewhat similar, so that MCL puts them in one giant cluster at inflation 1.4
+	options := cluster.Options{Granularities: []int{14}, Native: true, MinClusterSize: 4, MaxClusterSize: 10,
+		SimilarityFunc: func(t1, t2 *trajectory.Trajectory) float64 {
+			return 0.1 + 0.9*cluster.JaccardTrajectory(t1, t2)
+		}}
+	if err := cluster.ClusterTrajectoriesDirectly(exp, output, options); err != nil {
+		t.Fatal(err)
+	}
+	dumpFile := filepath.Join(output, "exp1-clusters-directly", "dump.exp1.mci.I14")
+	unconstrained, err := trajectory.ReadMclDumpFile(dumpFile + ".unconstrained")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unconstrained) != 1 || len(unconstrained[0]) != len(exp.Trajectories) {
+		t.Fatalf("expected one giant cluster of the %d trajectories, got %v", len(exp.Trajectories), unconstrained)
+	}
+	// the giant cluster is re-split, and the small parts are merged
+	constrained, err := trajectory.ReadMclDumpFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(constrained) < 2 {
+		t.Errorf("expected the giant cluster to be split, got %v", constrained)
+	}
+	seen := map[int]bool{}
+	for _, c := range constrained {
+		if len(c) < options.MinClusterSize || len(c) > options.MaxClusterSize {
+			t.Errorf("expected clusters of %d to %d trajectories, got %v", options.MinClusterSize,
+				options.MaxClusterSize, constrained)
+		}
+		for _, id := range c {
+			if seen[id] {
+				t.Errorf("expected trajectory %d in only one cluster, got %v", id, constrained)
+			}
+			seen[id] = true
+		}
+	}
+	if len(seen) != len(exp.Trajectories) {
+		t.Errorf("expected all %d trajectories to be clustered, got %d", len(exp.Trajectories), len(seen))
+	}
+	// the outputs are written for the constrained clustering
+	if clusters := trajectory.CollectClusters(exp); len(clusters) != len(constrained) {
+		t.Errorf("expected the %d constrained clusters in the outputs, got %d", len(constrained), len(clusters))
+	}
 }
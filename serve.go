@@ -0,0 +1,50 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"ptra/server"
+)
+
+const serveHelp = "\nptra serve parameters:\n" +
+	"ptra serve resultsPath \n" +
+	"[--addr host:port]\n" +
+	outputHelp +
+	profileHelp
+
+// serve implements the ptra serve command, which hosts a local web UI for browsing the results in a results directory.
+func serve() {
+	var (
+		addr      string
+		profiling profiles
+	)
+	var flags flag.FlagSet
+	flags.StringVar(&addr, "addr", "localhost:8080", "The address the web UI listens on.")
+	profiling.addFlags(&flags)
+	parseFlags(flags, 3, serveHelp)
+	dir, _ := filepath.Abs(getFileName(os.Args[2], serveHelp))
+	defer profiling.start(dir)()
+	if err := server.Serve(dir, addr); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,101 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"ptra/trajectory"
+)
+
+// graphEdge is a transition between two diagnoses in a rendered graph.
+type graphEdge struct {
+	from, to int
+}
+
+// writeGraphSVG renders the trajectories as a directed graph in SVG format. The diagnoses are the nodes and are placed
+// on a circle, the transitions are the edges and are labeled with the number of patients. This is the same graph as
+// the one in the GML files produced by ptra, with a layout computed by the server so no external tool is needed.
+func writeGraphSVG(w io.Writer, ts []*trajectory.Trajectory, nameMap map[int]string) {
+	nodes := []int{}
+	nodeIndex := map[int]int{}
+	edges := []graphEdge{}
+	edgePatients := map[graphEdge]int{}
+	for _, t := range ts {
+		for _, d := range t.Diagnoses {
+			if _, ok := nodeIndex[d]; !ok {
+				nodeIndex[d] = len(nodes)
+				nodes = append(nodes, d)
+			}
+		}
+		for i := 0; i < len(t.Diagnoses)-1; i++ {
+			edge := graphEdge{from: t.Diagnoses[i], to: t.Diagnoses[i+1]}
+			if _, ok := edgePatients[edge]; !ok {
+				edges = append(edges, edge)
+			}
+			// transitions shared by several trajectories are counted once, with the largest patient number
+			if t.PatientNumbers[i] > edgePatients[edge] {
+				edgePatients[edge] = t.PatientNumbers[i]
+			}
+		}
+	}
+	const size, radius, nodeRadius = 800.0, 300.0, 6.0
+	x := make([]float64, len(nodes))
+	y := make([]float64, len(nodes))
+	for i := range nodes {
+		angle := 2 * math.Pi * float64(i) / float64(len(nodes))
+		x[i] = size/2 + radius*math.Cos(angle)
+		y[i] = size/2 + radius*math.Sin(angle)
+	}
+	bw := bufio.NewWriter(w)
+	defer func() {
+		if err := bw.Flush(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprintf(bw, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%v\" height=\"%v\" font-family=\"sans-serif\" font-size=\"11\">\n", size, size)
+	fmt.Fprintf(bw, "<defs><marker id=\"arrow\" viewBox=\"0 0 10 10\" refX=\"10\" refY=\"5\" markerWidth=\"6\" markerHeight=\"6\" orient=\"auto\"><path d=\"M0,0 L10,5 L0,10 z\" fill=\"#888\"/></marker></defs>\n")
+	for _, edge := range edges {
+		x1, y1 := x[nodeIndex[edge.from]], y[nodeIndex[edge.from]]
+		x2, y2 := x[nodeIndex[edge.to]], y[nodeIndex[edge.to]]
+		// stop the line at the border of the target node so the arrow head is visible
+		if l := math.Hypot(x2-x1, y2-y1); l > 0 {
+			x2 -= (x2 - x1) * nodeRadius / l
+			y2 -= (y2 - y1) * nodeRadius / l
+		}
+		fmt.Fprintf(bw, "<line x1=\"%.1f\" y1=\"%.1f\" x2=\"%.1f\" y2=\"%.1f\" stroke=\"#888\" marker-end=\"url(#arrow)\"/>\n", x1, y1, x2, y2)
+		fmt.Fprintf(bw, "<text x=\"%.1f\" y=\"%.1f\" fill=\"#555\">%d</text>\n", (x1+x2)/2, (y1+y2)/2, edgePatients[edge])
+	}
+	for i, d := range nodes {
+		fmt.Fprintf(bw, "<circle cx=\"%.1f\" cy=\"%.1f\" r=\"%v\" fill=\"#4a7ebb\"/>\n", x[i], y[i], nodeRadius)
+		anchor := "start"
+		if x[i] < size/2 {
+			anchor = "end"
+		}
+		dx := 2 * nodeRadius
+		if anchor == "end" {
+			dx = -dx
+		}
+		fmt.Fprintf(bw, "<text x=\"%.1f\" y=\"%.1f\" text-anchor=\"%s\">%s</text>\n", x[i]+dx, y[i], anchor, html.EscapeString(nameMap[d]))
+	}
+	fmt.Fprintf(bw, "</svg>\n")
+}
@@ -0,0 +1,135 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package server
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"strings"
+)
+
+// A static HTML report of the results in a results directory, with the same content as the web UI, so that the results
+// can be viewed and shared without running ptra serve.
+
+// reportTemplate is the template of the static report. The links are relative to the results directory, in which the
+// report is written.
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>PTRA report</title>
+` + pageStyle + `</head><body>
+<h1>PTRA report</h1>
+<p>Results in {{.Dir}}</p>
+{{range .Trajectories}}<h2>Trajectories: {{.File}}</h2>
+<p>{{len .Trajectories}} trajectories.</p>
+{{template "trajectoryTable" .Trajectories}}
+{{end}}{{range .Clusterings}}{{$file := .File}}<h2>Clusters: {{.File}}</h2>
+<table><tr><th>Cluster</th><th>Trajectories</th><th>Mean age</th><th>Mean age EOI</th><th>Males</th><th>Females</th></tr>
+{{range .Summaries}}<tr><td><a href="#{{$file}}-{{.CID}}">{{.CID}}</a></td>
+<td>{{.Trajectories}}</td><td>{{.MeanAge}} ({{.StdevAge}})</td><td>{{.MeanAgeEOI}} ({{.StdevAgeEOI}})</td>
+<td>{{.Males}}</td><td>{{.Females}}</td></tr>
+{{end}}</table>
+{{range .Clusters}}<h3 id="{{$file}}-{{.CID}}">Cluster {{.CID}}</h3>
+<p>{{.Graph}}</p>
+{{template "trajectoryTable" .Trajectories}}
+{{end}}{{end}}<h2>All files</h2>
+<ul>{{range .Files}}<li><a href="{{.}}">{{.}}</a></li>{{end}}</ul>
+</body></html>
+`))
+
+// reportTrajectories are the trajectories of a trajectories file in the report.
+type reportTrajectories struct {
+	File         string
+	Trajectories []trajectoryView
+}
+
+// reportCluster is a cluster in the report, with the graph of its trajectories.
+type reportCluster struct {
+	CID          int
+	Graph        template.HTML
+	Trajectories []trajectoryView
+}
+
+// reportClustering is a clustered trajectories file in the report.
+type reportClustering struct {
+	File      string
+	Summaries []*trajectory.ClusterSummary
+	Clusters  []reportCluster
+}
+
+// WriteReport writes a static HTML report of the results in a directory to a file in that directory, e.g.
+// report.html. The report lists the trajectories of the trajectories files, and for each clustered trajectories file,
+// the cluster summaries and the graph and the trajectories of each cluster, as the web UI of ptra serve does.
+func WriteReport(dir, name string) error {
+	s := NewServer(dir)
+	files, err := s.resultFiles()
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Dir          string
+		Trajectories []reportTrajectories
+		Clusterings  []reportClustering
+		Files        []string
+	}{Dir: dir}
+	for _, file := range files {
+		if file == name {
+			continue
+		}
+		data.Files = append(data.Files, file)
+		switch {
+		case strings.HasSuffix(file, ".clustered.trajectories.tab"):
+			ts, nameMap, summaries, err := trajectory.ReadClusteredTrajectoriesFromTabFile(filepath.Join(dir,
+				filepath.FromSlash(file)))
+			if err != nil {
+				return err
+			}
+			clustering := reportClustering{File: file, Summaries: summaries}
+			clusters := map[int][]*trajectory.Trajectory{}
+			for _, t := range ts {
+				clusters[t.Cluster] = append(clusters[t.Cluster], t)
+			}
+			for _, summary := range summaries {
+				var graph strings.Builder
+				writeGraphSVG(&graph, clusters[summary.CID], nameMap)
+				clustering.Clusters = append(clustering.Clusters, reportCluster{CID: summary.CID,
+					// the graph escapes the names of the diagnoses, cf. writeGraphSVG
+					Graph:        template.HTML(graph.String()),
+					Trajectories: viewTrajectories(clusters[summary.CID], nameMap, trajectoryFilter{})})
+			}
+			data.Clusterings = append(data.Clusterings, clustering)
+		case strings.HasSuffix(file, "-trajectories.tab"):
+			ts, nameMap, err := s.readTrajectories(file)
+			if err != nil {
+				return err
+			}
+			data.Trajectories = append(data.Trajectories, reportTrajectories{File: file,
+				Trajectories: viewTrajectories(ts, nameMap, trajectoryFilter{})})
+		}
+	}
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if err := reportTemplate.Execute(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
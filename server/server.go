@@ -0,0 +1,300 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+// Package server implements a local web UI for browsing the results of ptra runs: the trajectories, the clusters, and
+// rendered graphs of the clusters. Filtered trajectories can be downloaded as tab files.
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Server serves the results found in a results directory.
+type Server struct {
+	dir string
+	fs  fs.FS
+}
+
+// NewServer creates a server for the results in the given directory.
+func NewServer(dir string) *Server {
+	return &Server{dir: dir, fs: os.DirFS(dir)}
+}
+
+// Handler returns the http handler of the web UI.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/trajectories", s.trajectories)
+	mux.HandleFunc("/clusters", s.clusters)
+	mux.HandleFunc("/cluster", s.cluster)
+	mux.HandleFunc("/graph.svg", s.graph)
+	mux.HandleFunc("/export", s.export)
+	mux.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.FS(s.fs))))
+	return mux
+}
+
+// Serve starts the web UI for the results in dir on the given address, e.g. localhost:8080.
+func Serve(dir, addr string) error {
+	utils.Info(fmt.Sprintf("Serving results from %s on http://%s", dir, addr))
+	return http.ListenAndServe(addr, NewServer(dir).Handler())
+}
+
+// resultFiles lists the files in the results directory, relative to the directory.
+func (s *Server) resultFiles() ([]string, error) {
+	files := []string{}
+	err := fs.WalkDir(s.fs, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// resultFile checks that a file requested by the client is a valid path inside the results directory and returns its
+// full name.
+func (s *Server) resultFile(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid file: %s", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// trajectoryFilter captures the filters that can be applied to trajectories in the web UI.
+type trajectoryFilter struct {
+	MinPatients int
+	Contains    string
+}
+
+func parseTrajectoryFilter(r *http.Request) trajectoryFilter {
+	minPatients, _ := strconv.Atoi(r.FormValue("minPatients"))
+	return trajectoryFilter{MinPatients: minPatients, Contains: r.FormValue("contains")}
+}
+
+// keep checks if a trajectory passes the filter: all transitions have at least MinPatients patients and at least one of
+// the diagnoses contains the Contains string.
+func (f trajectoryFilter) keep(t *trajectory.Trajectory, nameMap map[int]string) bool {
+	for _, n := range t.PatientNumbers {
+		if n < f.MinPatients {
+			return false
+		}
+	}
+	if f.Contains == "" {
+		return true
+	}
+	for _, d := range t.Diagnoses {
+		if strings.Contains(strings.ToLower(nameMap[d]), strings.ToLower(f.Contains)) {
+			return true
+		}
+	}
+	return false
+}
+
+// trajectoryStep is a diagnosis in a trajectory, together with the number of patients that transition to it. The
+// number of patients is 0 for the first diagnosis.
+type trajectoryStep struct {
+	Diagnosis string
+	Patients  int
+}
+
+// trajectoryView is the representation of a trajectory in the templates.
+type trajectoryView struct {
+	ID, Cluster int
+	Steps       []trajectoryStep
+}
+
+func viewTrajectories(ts []*trajectory.Trajectory, nameMap map[int]string, filter trajectoryFilter) []trajectoryView {
+	views := []trajectoryView{}
+	for _, t := range ts {
+		if !filter.keep(t, nameMap) {
+			continue
+		}
+		view := trajectoryView{ID: t.ID, Cluster: t.Cluster}
+		for i, d := range t.Diagnoses {
+			step := trajectoryStep{Diagnosis: nameMap[d]}
+			if i > 0 {
+				step.Patients = t.PatientNumbers[i-1]
+			}
+			view.Steps = append(view.Steps, step)
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// readTrajectories reads the trajectories from either a trajectories tab file or a clustered trajectories tab file.
+func (s *Server) readTrajectories(name string) ([]*trajectory.Trajectory, map[int]string, error) {
+	file, err := s.resultFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasSuffix(name, ".clustered.trajectories.tab") {
+		ts, nameMap, _, err := trajectory.ReadClusteredTrajectoriesFromTabFile(file)
+		return ts, nameMap, err
+	}
+	return trajectory.ReadTrajectoriesFromTabFile(file)
+}
+
+func (s *Server) render(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	if err := tmpl.Execute(w, data); err != nil {
+		utils.Warning("cannot render the page:", err)
+	}
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	files, err := s.resultFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Dir                    string
+		Trajectories, Clusters []string
+		Files                  []string
+	}{Dir: s.dir, Files: files}
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file, ".clustered.trajectories.tab"):
+			data.Clusters = append(data.Clusters, file)
+		case strings.HasSuffix(file, "-trajectories.tab"):
+			data.Trajectories = append(data.Trajectories, file)
+		}
+	}
+	s.render(w, indexTemplate, data)
+}
+
+func (s *Server) trajectories(w http.ResponseWriter, r *http.Request) {
+	file := r.FormValue("file")
+	ts, nameMap, err := s.readTrajectories(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := parseTrajectoryFilter(r)
+	s.render(w, trajectoriesTemplate, struct {
+		File         string
+		Filter       trajectoryFilter
+		Trajectories []trajectoryView
+	}{file, filter, viewTrajectories(ts, nameMap, filter)})
+}
+
+func (s *Server) clusters(w http.ResponseWriter, r *http.Request) {
+	file := r.FormValue("file")
+	name, err := s.resultFile(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _, summaries, err := trajectory.ReadClusteredTrajectoriesFromTabFile(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.render(w, clustersTemplate, struct {
+		File     string
+		Clusters []*trajectory.ClusterSummary
+	}{file, summaries})
+}
+
+// clusterTrajectories reads the trajectories of a single cluster from a clustered trajectories tab file.
+func (s *Server) clusterTrajectories(r *http.Request) ([]*trajectory.Trajectory, map[int]string, int, error) {
+	cid, err := strconv.Atoi(r.FormValue("cid"))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	ts, nameMap, err := s.readTrajectories(r.FormValue("file"))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	members := []*trajectory.Trajectory{}
+	for _, t := range ts {
+		if t.Cluster == cid {
+			members = append(members, t)
+		}
+	}
+	return members, nameMap, cid, nil
+}
+
+func (s *Server) cluster(w http.ResponseWriter, r *http.Request) {
+	ts, nameMap, cid, err := s.clusterTrajectories(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.render(w, clusterTemplate, struct {
+		File         string
+		CID          int
+		Trajectories []trajectoryView
+	}{r.FormValue("file"), cid, viewTrajectories(ts, nameMap, trajectoryFilter{})})
+}
+
+func (s *Server) graph(w http.ResponseWriter, r *http.Request) {
+	ts, nameMap, _, err := s.clusterTrajectories(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	writeGraphSVG(w, ts, nameMap)
+}
+
+// export writes the filtered trajectories as a tab file in the same format as PrintTrajectoriesToFile.
+func (s *Server) export(w http.ResponseWriter, r *http.Request) {
+	file := r.FormValue("file")
+	ts, nameMap, err := s.readTrajectories(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := parseTrajectoryFilter(r)
+	w.Header().Set("Content-Type", "text/tab-separated-values")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		strings.TrimSuffix(filepath.Base(file), ".tab")+".filtered.tab"))
+	for _, t := range ts {
+		if !filter.keep(t, nameMap) {
+			continue
+		}
+		names := []string{}
+		for _, d := range t.Diagnoses {
+			names = append(names, nameMap[d])
+		}
+		numbers := []string{}
+		for _, n := range t.PatientNumbers {
+			numbers = append(numbers, strconv.Itoa(n))
+		}
+		fmt.Fprintf(w, "%s\n%s\n", strings.Join(names, "\t"), strings.Join(numbers, "\t"))
+	}
+}
@@ -0,0 +1,149 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"ptra/utils"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogBuffer keeps the most recent lines written to it, so they can be shown on the status page.
+type LogBuffer struct {
+	lock    sync.Mutex
+	lines   []string
+	partial []byte
+	max     int
+}
+
+// NewLogBuffer creates a log buffer that keeps the last max lines.
+func NewLogBuffer(max int) *LogBuffer {
+	return &LogBuffer{max: max}
+}
+
+// Write implements io.Writer.
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines = append(b.lines, string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	if len(b.lines) > b.max {
+		b.lines = append([]string(nil), b.lines[len(b.lines)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the lines currently in the buffer.
+func (b *LogBuffer) Lines() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.lines...)
+}
+
+// stageView is the representation of a pipeline stage on the status page.
+type stageView struct {
+	Name         string
+	Steps, Total int64
+	Finished     bool
+	Elapsed      time.Duration
+}
+
+// ServeStatus starts a status page on the given address in the background. The page shows the progress of the stages
+// of the running pipeline, the current memory usage, and the recent lines in logs. It is refreshed every few seconds.
+func ServeStatus(addr string, logs *LogBuffer) {
+	started := time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		stages := []stageView{}
+		for _, s := range utils.Stages() {
+			stages = append(stages, stageView{Name: s.Name, Steps: s.Steps(), Total: s.Total, Finished: s.Finished(),
+				Elapsed: s.Elapsed().Round(time.Second)})
+		}
+		data := struct {
+			Command       string
+			Uptime        time.Duration
+			Stages        []stageView
+			HeapMB, SysMB uint64
+			NumGC         uint32
+			Goroutines    int
+			Logs          []string
+		}{
+			Command:    strings.Join(os.Args, " "),
+			Uptime:     time.Since(started).Round(time.Second),
+			Stages:     stages,
+			HeapMB:     mem.HeapAlloc >> 20,
+			SysMB:      mem.Sys >> 20,
+			NumGC:      mem.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+			Logs:       logs.Lines(),
+		}
+		if err := statusTemplate.Execute(w, data); err != nil {
+			utils.Warning("cannot render the status page:", err)
+		}
+	})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	utils.Info(fmt.Sprintf("Serving status page on http://%s", addr))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			utils.Warning("cannot serve the status page:", err)
+		}
+	}()
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="3"><title>PTRA status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td, th { padding: 0.2em 0.5em; text-align: left; }
+pre { background: #f4f4f4; padding: 0.5em; }
+</style></head><body>
+<h1>PTRA status</h1>
+<p><code>{{.Command}}</code></p>
+<p>Running for {{.Uptime}}. Memory: {{.HeapMB}} MB heap, {{.SysMB}} MB from the OS, {{.NumGC}} GCs. {{.Goroutines}} goroutines.</p>
+<table><tr><th>Stage</th><th>Progress</th><th>Time</th></tr>
+{{range .Stages}}<tr><td>{{.Name}}</td>
+<td>{{if .Finished}}done{{else if .Total}}<progress value="{{.Steps}}" max="{{.Total}}"></progress> {{.Steps}}/{{.Total}}{{else}}<progress></progress>{{end}}</td>
+<td>{{.Elapsed}}</td></tr>
+{{end}}</table>
+<h2>Recent log lines</h2>
+<pre>{{range .Logs}}{{.}}
+{{end}}</pre>
+</body></html>
+`))
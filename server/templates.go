@@ -0,0 +1,85 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package server
+
+import "html/template"
+
+// pageStyle is the style of the pages of the web UI and of the static report, cf. WriteReport.
+const pageStyle = `<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+.arrow { color: #888; }
+</style>`
+
+const pageHeader = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>PTRA results</title>
+` + pageStyle + `</head><body><p><a href="/">PTRA results</a></p>
+`
+
+const pageFooter = `</body></html>`
+
+func page(name, body string) *template.Template {
+	return template.Must(template.New(name).Parse(pageHeader + body + pageFooter))
+}
+
+var indexTemplate = page("index", `<h1>Results in {{.Dir}}</h1>
+<h2>Trajectories</h2>
+<ul>{{range .Trajectories}}<li><a href="/trajectories?file={{.}}">{{.}}</a></li>{{else}}<li>none</li>{{end}}</ul>
+<h2>Clusters</h2>
+<ul>{{range .Clusters}}<li><a href="/clusters?file={{.}}">{{.}}</a> (<a href="/trajectories?file={{.}}">trajectories</a>)</li>{{else}}<li>none</li>{{end}}</ul>
+<h2>All files</h2>
+<ul>{{range .Files}}<li><a href="/files/{{.}}">{{.}}</a></li>{{end}}</ul>
+`)
+
+var trajectoriesTemplate = page("trajectories", `<h1>{{.File}}</h1>
+<form action="/trajectories">
+<input type="hidden" name="file" value="{{.File}}">
+Minimum patients per transition: <input type="number" name="minPatients" value="{{.Filter.MinPatients}}">
+Diagnosis contains: <input type="text" name="contains" value="{{.Filter.Contains}}">
+<input type="submit" value="Filter">
+</form>
+<p>{{len .Trajectories}} trajectories.
+<a href="/export?file={{.File}}&minPatients={{.Filter.MinPatients}}&contains={{.Filter.Contains}}">Download</a></p>
+{{template "trajectoryTable" .Trajectories}}
+`)
+
+var clustersTemplate = page("clusters", `<h1>{{.File}}</h1>
+<table><tr><th>Cluster</th><th>Trajectories</th><th>Mean age</th><th>Mean age EOI</th><th>Males</th><th>Females</th></tr>
+{{$file := .File}}{{range .Clusters}}<tr><td><a href="/cluster?file={{$file}}&cid={{.CID}}">{{.CID}}</a></td>
+<td>{{.Trajectories}}</td><td>{{.MeanAge}} ({{.StdevAge}})</td><td>{{.MeanAgeEOI}} ({{.StdevAgeEOI}})</td>
+<td>{{.Males}}</td><td>{{.Females}}</td></tr>
+{{end}}</table>
+`)
+
+var clusterTemplate = page("cluster", `<h1>Cluster {{.CID}}</h1>
+<p><a href="/clusters?file={{.File}}">{{.File}}</a></p>
+<p><img src="/graph.svg?file={{.File}}&cid={{.CID}}" alt="graph of cluster {{.CID}}"></p>
+{{template "trajectoryTable" .Trajectories}}
+`)
+
+const trajectoryTable = `{{define "trajectoryTable"}}<table>
+{{range .}}<tr><td>{{.ID}}</td><td>{{range .Steps}}{{if .Patients}} <span class="arrow">&rarr;({{.Patients}})&rarr;</span> {{end}}{{.Diagnosis}}{{end}}</td></tr>
+{{end}}</table>{{end}}`
+
+func init() {
+	template.Must(trajectoriesTemplate.Parse(trajectoryTable))
+	template.Must(clusterTemplate.Parse(trajectoryTable))
+	template.Must(reportTemplate.Parse(trajectoryTable))
+}
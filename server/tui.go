@@ -0,0 +1,234 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"ptra/utils"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The keys of the terminal UI.
+const (
+	keyMore       = '+'
+	keyLess       = '-'
+	keyCheckpoint = 'c'
+	keyInterrupt  = 3 // ctrl-c
+)
+
+// verbosityNames are the names of the verbosities, as shown in the terminal UI.
+var verbosityNames = map[utils.Verbosity]string{utils.Silent: "silent", utils.Quiet: "quiet", utils.Normal: "normal",
+	utils.Verbose: "verbose"}
+
+// TUI is a terminal UI for monitoring long ptra runs, e.g. over SSH. It shows the progress of the stages of the running
+// pipeline, the memory usage, and the recent log lines, as the status page does, and handles single keys for actions
+// that do not affect the results of the run: adjusting the verbosity of the messages and requesting an early
+// checkpoint.
+type TUI struct {
+	logs       *LogBuffer
+	rows, cols int
+	started    time.Time
+	lock       sync.Mutex
+	feedback   string // the feedback on the last key
+}
+
+// NewTUI creates a terminal UI that shows the recent lines in logs, on a terminal with the given number of rows and
+// columns.
+func NewTUI(logs *LogBuffer, rows, cols int) *TUI {
+	return &TUI{logs: logs, rows: rows, cols: cols, started: time.Now()}
+}
+
+// Handle handles a key pressed in the terminal UI, and reports whether it is an interrupt, i.e. ctrl-c, which is left
+// to the caller.
+func (t *TUI) Handle(key byte) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch key {
+	case keyMore:
+		if v := utils.GetVerbosity(); v < utils.Verbose {
+			utils.SetVerbosity(v + 1)
+		}
+		t.feedback = "Verbosity: " + verbosityNames[utils.GetVerbosity()]
+	case keyLess:
+		// warnings are always shown
+		if v := utils.GetVerbosity(); v > utils.Quiet {
+			utils.SetVerbosity(v - 1)
+		}
+		t.feedback = "Verbosity: " + verbosityNames[utils.GetVerbosity()]
+	case keyCheckpoint:
+		if utils.RequestCheckpoint() {
+			t.feedback = "Checkpoint requested"
+		} else {
+			t.feedback = "No checkpoint after the relative risk ratios are computed"
+		}
+	case keyInterrupt:
+		return true
+	}
+	return false
+}
+
+// progressBar renders the progress of a stage.
+func progressBar(s *utils.Stage) string {
+	switch {
+	case s.Finished():
+		return "done"
+	case s.Total == 0:
+		return fmt.Sprintf("%d", s.Steps())
+	}
+	const width = 20
+	done := int(s.Steps() * width / s.Total)
+	if done > width {
+		done = width
+	}
+	return fmt.Sprintf("[%s%s] %d/%d", strings.Repeat("#", done), strings.Repeat(".", width-done), s.Steps(), s.Total)
+}
+
+// Render writes a frame of the terminal UI, without escape sequences. The lines are cut off at the number of columns.
+// When the frame does not fit in the number of rows, the oldest stages and log lines are left out, keeping at least
+// half of the available rows for the log lines.
+func (t *TUI) Render(w io.Writer) {
+	t.lock.Lock()
+	feedback := t.feedback
+	t.lock.Unlock()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	lines := []string{
+		"PTRA " + strings.Join(os.Args[1:], " "),
+		fmt.Sprintf("Running for %s. Memory: %d MB heap, %d MB from the OS. Verbosity: %s.",
+			time.Since(t.started).Round(time.Second), mem.HeapAlloc>>20, mem.Sys>>20,
+			verbosityNames[utils.GetVerbosity()]),
+		"",
+		fmt.Sprintf("%-40s %-36s %s", "Stage", "Progress", "Time"),
+	}
+	footer := "Keys: + more messages, - fewer messages, ctrl-c interrupt"
+	if utils.CheckpointsAllowed() {
+		footer = "Keys: + more messages, - fewer messages, c checkpoint, ctrl-c interrupt"
+	}
+	if feedback != "" {
+		footer += ". " + feedback + "."
+	}
+	stages, logs := utils.Stages(), t.logs.Lines()
+	available := utils.Max(t.rows-len(lines)-4, 0)
+	if n := available - utils.Min(len(logs), available/2); n < len(stages) {
+		stages = stages[len(stages)-n:]
+	}
+	if n := available - len(stages); n < len(logs) {
+		logs = logs[len(logs)-n:]
+	}
+	for _, s := range stages {
+		lines = append(lines, fmt.Sprintf("%-40s %-36s %s", s.Name, progressBar(s), s.Elapsed().Round(time.Second)))
+	}
+	lines = append(lines, "", "Recent log lines:")
+	lines = append(lines, logs...)
+	lines = append(lines, "", footer)
+	for _, line := range lines {
+		if len(line) > t.cols {
+			line = line[:t.cols]
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// stty runs stty on the terminal of standard input and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// StartTUI starts a terminal UI on the terminal of standard input and standard output, which is redrawn every second.
+// The terminal is switched to reading single keys without echoing them. On ctrl-c, the terminal is restored and the
+// process is interrupted as usual. StartTUI returns a function that stops the UI after drawing the last frame, and
+// restores the terminal.
+func StartTUI(logs *LogBuffer) (func(), error) {
+	state, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("the terminal UI requires a terminal: %v", err)
+	}
+	rows, cols := 24, 80
+	if size, err := stty("size"); err == nil {
+		fmt.Sscan(size, &rows, &cols)
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return nil, err
+	}
+	t := NewTUI(logs, rows, cols)
+	var drawLock sync.Mutex
+	draw := func() {
+		var frame bytes.Buffer
+		frame.WriteString("\x1b[H\x1b[2J") // move the cursor home and clear the screen
+		t.Render(&frame)
+		drawLock.Lock()
+		defer drawLock.Unlock()
+		os.Stdout.Write(frame.Bytes())
+	}
+	os.Stdout.WriteString("\x1b[?25l") // hide the cursor
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			draw()
+			os.Stdout.WriteString("\x1b[?25h")
+			stty(state)
+		})
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}()
+	go func() {
+		key := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(key); err != nil {
+				return
+			}
+			if t.Handle(key[0]) {
+				stop()
+				if p, err := os.FindProcess(os.Getpid()); err == nil {
+					p.Signal(os.Interrupt)
+				}
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+				draw()
+			}
+		}
+	}()
+	draw()
+	return stop, nil
+}
@@ -0,0 +1,122 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"ptra/trajectory"
+	"ptra/utils"
+	"strings"
+)
+
+const sqlHelp = "\nptra sql parameters:\n" +
+	"ptra sql databaseFile \n" +
+	"[--load files]\n" +
+	"[--query string]\n" +
+	"[--csv]\n" +
+	"[--duckdbPath string]\n" +
+	outputHelp +
+	profileHelp
+
+// ptraResultFiles returns the .ptra files of a ptra run: the trajectories, followed by the clustered trajectories of
+// each granularity, if any.
+func ptraResultFiles(outputPath, name string) []string {
+	files := []string{filepath.Join(outputPath, fmt.Sprintf("%s-trajectories.ptra", name))}
+	clustered, _ := filepath.Glob(filepath.Join(outputPath, fmt.Sprintf("%s-clusters-directly", name),
+		fmt.Sprintf("dump.%s.mci.I*.clustered.ptra", name)))
+	return append(files, clustered...)
+}
+
+// loadDuckDB loads the results of the given .ptra files into the tables of a DuckDB database file, which is created
+// if it does not exist. Tables that already exist are replaced. The database is written by the duckdb executable.
+func loadDuckDB(duckdbPath, database string, files []string) error {
+	dir, err := os.MkdirTemp("", "ptra-sql")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tables, err := trajectory.WriteSQLTables(dir, files)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(duckdbPath, database)
+	cmd.Stdin = strings.NewReader(trajectory.DuckDBLoadScript(tables))
+	end := utils.TraceCommand(cmd)
+	output, err := cmd.CombinedOutput()
+	end(err)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\n%s", duckdbPath, err, output)
+	}
+	utils.Info("Loaded ", len(files), " result files into ", database)
+	return nil
+}
+
+// sql runs the sql command, which loads results into a DuckDB database file and runs queries against it.
+func sql() {
+	var (
+		load       string
+		query      string
+		csvOutput  bool
+		duckdbPath string
+		profiling  profiles
+	)
+	var flags flag.FlagSet
+	flags.StringVar(&load, "load", "", "A comma-separated list of .ptra files to load into the database.")
+	flags.StringVar(&query, "query", "", "The SQL query to run against the database.")
+	flags.BoolVar(&csvOutput, "csv", false, "Print the query result as csv.")
+	flags.StringVar(&duckdbPath, "duckdbPath", "duckdb", "The path to the duckdb binary.")
+	profiling.addFlags(&flags)
+	parseFlags(flags, 3, sqlHelp)
+	database := getFileName(os.Args[2], sqlHelp)
+	outputDir, _ := filepath.Abs(filepath.Dir(database))
+	defer profiling.start(outputDir)()
+	defer utils.StartTracing("ptra sql", programMessage())()
+	if load != "" {
+		if err := loadDuckDB(duckdbPath, database, strings.Split(load, ",")); err != nil {
+			log.Panic(err)
+		}
+	}
+	if query == "" && load != "" {
+		return
+	}
+	// without a query, the duckdb shell is started on the database for interactive use
+	args := []string{database}
+	if csvOutput {
+		args = append([]string{"-csv"}, args...)
+	}
+	if query != "" {
+		args = append(args, "-c", query)
+	}
+	cmd := exec.Command(duckdbPath, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if query == "" {
+		cmd.Stdin = os.Stdin
+	}
+	end := utils.TraceCommand(cmd)
+	err := cmd.Run()
+	end(err)
+	if err != nil {
+		log.Panic(fmt.Sprintf("%s failed: %v", duckdbPath, err))
+	}
+}
@@ -0,0 +1,224 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"ptra/utils"
+	"sort"
+	"strings"
+)
+
+// Multiple sequence alignment of the trajectories in a cluster, as a compact description of the cluster.
+
+// AlignmentColumn is a position in the alignment of a cluster. Diagnosis is the most frequent diagnosis at that
+// position, and Frequency is the fraction of the cluster's trajectories that have that diagnosis at that position.
+// For soft clustering, the trajectories are weighted by their membership weights.
+type AlignmentColumn struct {
+	Diagnosis int
+	Frequency float64
+}
+
+// AlignedTrajectory is a trajectory in an alignment. Positions contains a diagnosis for each column of the alignment,
+// or -1 for a gap.
+type AlignedTrajectory struct {
+	Trajectory *Trajectory
+	Positions  []int
+}
+
+// ClusterAlignment is the alignment of the trajectories of a cluster.
+type ClusterAlignment struct {
+	CID          int
+	Columns      []AlignmentColumn
+	Trajectories []AlignedTrajectory
+}
+
+// Consensus returns the consensus path of an alignment: the columns whose most frequent diagnosis occurs in at least
+// minFrequency of the trajectories, in order.
+func (a *ClusterAlignment) Consensus(minFrequency float64) []AlignmentColumn {
+	consensus := []AlignmentColumn{}
+	for _, c := range a.Columns {
+		if c.Frequency >= minFrequency {
+			consensus = append(consensus, c)
+		}
+	}
+	return consensus
+}
+
+// profileColumn is a column of the profile that is built up during the progressive alignment: the summed weights of
+// the trajectories per diagnosis at this position.
+type profileColumn struct {
+	weights map[int]float64
+}
+
+// alignToProfile aligns a trajectory to a profile with the Needleman-Wunsch algorithm, where matching a diagnosis with
+// a column scores the fraction of the aligned trajectories that have that diagnosis in the column, and gaps are free.
+// It returns for each diagnosis of the trajectory the index of the matching column, or -1 if it is not matched.
+func alignToProfile(profile []*profileColumn, total float64, diagnoses []int) []int {
+	m, n := len(profile), len(diagnoses)
+	score := make([][]float64, m+1)
+	for i := range score {
+		score[i] = make([]float64, n+1)
+	}
+	match := func(i, j int) float64 {
+		return profile[i].weights[diagnoses[j]] / total
+	}
+	for i := 1; i <= m; i++ {
+		for j := 1; j <= n; j++ {
+			best := score[i-1][j]
+			if score[i][j-1] > best {
+				best = score[i][j-1]
+			}
+			if w := match(i-1, j-1); w > 0 && score[i-1][j-1]+w > best {
+				best = score[i-1][j-1] + w
+			}
+			score[i][j] = best
+		}
+	}
+	matched := make([]int, n)
+	for j := range matched {
+		matched[j] = -1
+	}
+	for i, j := m, n; i > 0 && j > 0; {
+		if w := match(i-1, j-1); w > 0 && score[i][j] == score[i-1][j-1]+w {
+			matched[j-1] = i - 1
+			i--
+			j--
+		} else if score[i][j] == score[i-1][j] {
+			i--
+		} else {
+			j--
+		}
+	}
+	return matched
+}
+
+// AlignCluster computes a multiple sequence alignment of the trajectories of a cluster by progressive alignment: the
+// trajectories are added to a profile from longest to shortest, and each trajectory is aligned to the profile of the
+// trajectories added before it, cf. alignToProfile. Diagnoses that are not matched with a column of the profile are
+// inserted as new columns, so that the order of the diagnoses of each trajectory is preserved.
+func AlignCluster(cid int, ts []*Trajectory) *ClusterAlignment {
+	ordered := make([]*Trajectory, len(ts))
+	copy(ordered, ts)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if len(ordered[i].Diagnoses) != len(ordered[j].Diagnoses) {
+			return len(ordered[i].Diagnoses) > len(ordered[j].Diagnoses)
+		}
+		return ordered[i].ID < ordered[j].ID
+	})
+	profile := []*profileColumn{}
+	rows := make([][]*profileColumn, len(ordered))
+	total := 0.0
+	for k, t := range ordered {
+		weight := membershipWeight(t, cid)
+		matched := alignToProfile(profile, total, t.Diagnoses)
+		merged := []*profileColumn{}
+		row := make([]*profileColumn, len(t.Diagnoses))
+		next := 0
+		for j, d := range t.Diagnoses {
+			if matched[j] >= 0 {
+				merged = append(merged, profile[next:matched[j]+1]...)
+				next = matched[j] + 1
+				row[j] = profile[matched[j]]
+			} else {
+				row[j] = &profileColumn{weights: map[int]float64{}}
+				merged = append(merged, row[j])
+			}
+			row[j].weights[d] += weight
+		}
+		profile = append(merged, profile[next:]...)
+		rows[k] = row
+		total += weight
+	}
+	alignment := &ClusterAlignment{CID: cid}
+	index := map[*profileColumn]int{}
+	for i, c := range profile {
+		index[c] = i
+		column := AlignmentColumn{Diagnosis: -1}
+		best := 0.0
+		for d, w := range c.weights {
+			if w > best || (w == best && d < column.Diagnosis) {
+				column.Diagnosis, best = d, w
+			}
+		}
+		if total > 0 {
+			column.Frequency = best / total
+		}
+		alignment.Columns = append(alignment.Columns, column)
+	}
+	for k, t := range ordered {
+		positions := make([]int, len(profile))
+		for i := range positions {
+			positions[i] = -1
+		}
+		for j, c := range rows[k] {
+			positions[index[c]] = t.Diagnoses[j]
+		}
+		alignment.Trajectories = append(alignment.Trajectories, AlignedTrajectory{Trajectory: t, Positions: positions})
+	}
+	return alignment
+}
+
+// PrintClusterAlignmentsToFile prints the alignments of the clusters of an experiment to a tab file, cf. AlignCluster.
+// For each cluster, it prints:
+// - A line with the cluster ID and the number of trajectories: CID: \tab nr \tab Trajectories: \tab nr.
+// - A line with the consensus path, the diagnoses that occur at their position in at least half of the trajectories:
+// Consensus: \tab term1 \tab term2 ...
+// - A line with the frequencies of the consensus diagnoses: Frequencies: \tab nr1 \tab nr2 ...
+// - A line with the most frequent diagnosis of each column of the alignment: Columns: \tab term1 \tab term2 ...
+// - A line with the frequency of the most frequent diagnosis of each column: Frequencies: \tab nr1 \tab nr2 ...
+// - A line per trajectory with its diagnoses aligned to the columns, with - for gaps: TID: \tab nr \tab term1 ...
+func PrintClusterAlignmentsToFile(exp *Experiment, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	printColumns := func(columns []AlignmentColumn, label string) {
+		terms := []string{label}
+		frequencies := []string{"Frequencies:"}
+		for _, c := range columns {
+			terms = append(terms, exp.NameMap[c.Diagnosis])
+			frequencies = append(frequencies, fmt.Sprintf("%.3f", c.Frequency))
+		}
+		fmt.Fprintf(file, "%s\n%s\n", strings.Join(terms, "\t"), strings.Join(frequencies, "\t"))
+	}
+	clusters := CollectClusters(exp)
+	for cid := 0; cid < len(clusters); cid++ {
+		alignment := AlignCluster(cid, clusters[cid])
+		fmt.Fprintf(file, "CID:\t%d\tTrajectories:\t%d\n", cid, len(clusters[cid]))
+		printColumns(alignment.Consensus(0.5), "Consensus:")
+		printColumns(alignment.Columns, "Columns:")
+		for _, row := range alignment.Trajectories {
+			terms := []string{"TID:", fmt.Sprint(row.Trajectory.ID)}
+			for _, d := range row.Positions {
+				if d < 0 {
+					terms = append(terms, "-")
+				} else {
+					terms = append(terms, exp.NameMap[d])
+				}
+			}
+			fmt.Fprintf(file, "%s\n", strings.Join(terms, "\t"))
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Biomarkers, such as mutation status or lab values, as covariates of patients, for stratifying the trajectory
+// discovery and for testing which trajectories are enriched for a biomarker.
+
+// Biomarkers holds the values of a number of biomarkers for the patients, by the patient ID in the input. A biomarker
+// is numeric if all its known values are numbers, and categorical otherwise. Empty values and NA are unknown.
+type Biomarkers struct {
+	Names   []string            // the names of the biomarkers
+	Values  map[string][]string // maps the patient ID in the input onto the values of the biomarkers, in order of Names
+	numeric []bool
+}
+
+// knownBiomarkerValue checks if a biomarker value is known.
+func knownBiomarkerValue(value string) bool {
+	return value != "" && value != "NA"
+}
+
+// ReadBiomarkers reads the biomarkers of the patients from a csv file. The header is patient_id followed by the names
+// of the biomarkers, and each line has the ID of a patient as in the patient file, followed by the values of the
+// biomarkers for that patient.
+func ReadBiomarkers(name string) (*Biomarkers, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("%s: expected patient_id followed by the names of the biomarkers", name)
+	}
+	b := &Biomarkers{Names: header[1:], Values: map[string][]string{}}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if _, ok := b.Values[record[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate patient %s", name, line, record[0])
+		}
+		b.Values[record[0]] = record[1:]
+	}
+	b.numeric = make([]bool, len(b.Names))
+	for i := range b.Names {
+		b.numeric[i] = true
+		for _, values := range b.Values {
+			if knownBiomarkerValue(values[i]) {
+				if _, err := strconv.ParseFloat(values[i], 64); err != nil {
+					b.numeric[i] = false
+					break
+				}
+			}
+		}
+	}
+	return b, nil
+}
+
+// index returns the index of a biomarker in Names, or -1 if there is no such biomarker.
+func (b *Biomarkers) index(name string) int {
+	for i, n := range b.Names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Value returns the value of a biomarker for a patient, and false if the value is not known.
+func (b *Biomarkers) Value(p *Patient, name string) (string, bool) {
+	i := b.index(name)
+	if values, ok := b.Values[p.PIDString]; ok && i >= 0 && knownBiomarkerValue(values[i]) {
+		return values[i], true
+	}
+	return "", false
+}
+
+// Numeric checks if a biomarker is numeric.
+func (b *Biomarkers) Numeric(name string) bool {
+	i := b.index(name)
+	return i >= 0 && b.numeric[i]
+}
+
+// BiomarkerFilter returns a patient filter that keeps the patients for which a biomarker compares to the given value
+// with the operator op, which is one of =, !=, <, <=, >, and >=. The order operators require a numeric biomarker.
+// Patients for which the biomarker is not known are removed. This stratifies the trajectory discovery by biomarker.
+func BiomarkerFilter(b *Biomarkers, name, op, value string) (PatientFilter, error) {
+	if b.index(name) < 0 {
+		return nil, fmt.Errorf("unknown biomarker %s", name)
+	}
+	switch op {
+	case "=":
+		return func(p *Patient) bool {
+			v, ok := b.Value(p, name)
+			return ok && v == value
+		}, nil
+	case "!=":
+		return func(p *Patient) bool {
+			v, ok := b.Value(p, name)
+			return ok && v != value
+		}, nil
+	}
+	if !b.Numeric(name) {
+		return nil, fmt.Errorf("biomarker %s is not numeric for %s", name, op)
+	}
+	x, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("biomarker %s: %v", name, err)
+	}
+	var compare func(y float64) bool
+	switch op {
+	case "<":
+		compare = func(y float64) bool { return y < x }
+	case "<=":
+		compare = func(y float64) bool { return y <= x }
+	case ">":
+		compare = func(y float64) bool { return y > x }
+	case ">=":
+		compare = func(y float64) bool { return y >= x }
+	default:
+		return nil, fmt.Errorf("unknown operator %s for biomarker %s", op, name)
+	}
+	return func(p *Patient) bool {
+		v, ok := b.Value(p, name)
+		if !ok {
+			return false
+		}
+		y, _ := strconv.ParseFloat(v, 64)
+		return compare(y)
+	}, nil
+}
+
+// BiomarkerEnrichment holds the test of a trajectory for enrichment of a biomarker, comparing the patients that follow
+// the complete trajectory to the other patients of the cohort, both restricted to the patients for which the biomarker
+// is known. For a categorical biomarker, there is a test for each of its values (Level): the values are the
+// percentages of patients with that value, the effect is the odds ratio, and the p-value is from Fisher's exact test.
+// For a numeric biomarker, the values are the medians, the effect is the difference of the medians, and the p-value is
+// from the Mann-Whitney U test. The q-value is the Benjamini-Hochberg adjusted p-value over all tests.
+type BiomarkerEnrichment struct {
+	Trajectory                          *Trajectory
+	Biomarker, Level                    string
+	TrajectoryPatients, OtherPatients   int
+	TrajectoryValue, OtherValue, Effect float64
+	PValue, QValue                      float64
+}
+
+// oddsRatio computes the odds ratio of the 2x2 contingency table with rows (a, b) and (c, d). When a cell is zero, 0.5
+// is added to all cells.
+func oddsRatio(a, b, c, d int) float64 {
+	fa, fb, fc, fd := float64(a), float64(b), float64(c), float64(d)
+	if a == 0 || b == 0 || c == 0 || d == 0 {
+		fa, fb, fc, fd = fa+0.5, fb+0.5, fc+0.5, fd+0.5
+	}
+	return (fa * fd) / (fb * fc)
+}
+
+// BiomarkerEnrichments tests each trajectory of an experiment for enrichment of each of the biomarkers, cf.
+// BiomarkerEnrichment. The cohort consists of the given patients. The tests are sorted on their q-values.
+func BiomarkerEnrichments(exp *Experiment, b *Biomarkers, patients *PatientMap) []*BiomarkerEnrichment {
+	enrichments := []*BiomarkerEnrichment{}
+	for _, name := range b.Names {
+		// the known values of the biomarker in the cohort
+		values := map[*Patient]string{}
+		levels := map[string]int{}
+		for _, p := range patients.PIDMap {
+			if v, ok := b.Value(p, name); ok {
+				values[p] = v
+				levels[v]++
+			}
+		}
+		levelNames := []string{}
+		for level := range levels {
+			levelNames = append(levelNames, level)
+		}
+		sort.Strings(levelNames)
+		numeric := b.Numeric(name)
+		for _, t := range exp.Trajectories {
+			if len(t.Diagnoses) == 0 {
+				continue
+			}
+			followers := map[*Patient]bool{}
+			for _, p := range LastPatients(t) {
+				if _, ok := values[p]; ok {
+					followers[p] = true
+				}
+			}
+			n1, n2 := len(followers), len(values)-len(followers)
+			if numeric {
+				xs, ys := []float64{}, []float64{}
+				for p, v := range values {
+					x, _ := strconv.ParseFloat(v, 64)
+					if followers[p] {
+						xs = append(xs, x)
+					} else {
+						ys = append(ys, x)
+					}
+				}
+				e := &BiomarkerEnrichment{Trajectory: t, Biomarker: name, TrajectoryPatients: n1, OtherPatients: n2,
+					TrajectoryValue: utils.Median(xs), OtherValue: utils.Median(ys),
+					PValue: utils.Stats().MannWhitneyUTest(xs, ys)}
+				e.Effect = e.TrajectoryValue - e.OtherValue
+				enrichments = append(enrichments, e)
+				continue
+			}
+			counts := map[string]int{}
+			for p := range followers {
+				counts[values[p]]++
+			}
+			for _, level := range levelNames {
+				a, c := counts[level], levels[level]-counts[level]
+				e := &BiomarkerEnrichment{Trajectory: t, Biomarker: name, Level: level, TrajectoryPatients: n1,
+					OtherPatients: n2, Effect: oddsRatio(a, n1-a, c, n2-c), PValue: math.NaN()}
+				e.TrajectoryValue, _ = utils.Percentage(int64(a), int64(n1))
+				e.OtherValue, _ = utils.Percentage(int64(c), int64(n2))
+				if n1 > 0 && n2 > 0 {
+					e.PValue = utils.Stats().FisherExactTest(a, n1-a, c, n2-c)
+				}
+				enrichments = append(enrichments, e)
+			}
+		}
+	}
+	// adjust the p-values of the tests that could be performed
+	ps := []float64{}
+	for _, e := range enrichments {
+		if !math.IsNaN(e.PValue) {
+			ps = append(ps, e.PValue)
+		}
+	}
+	qs := utils.Stats().BenjaminiHochberg(ps)
+	for _, e := range enrichments {
+		e.QValue = math.NaN()
+		if !math.IsNaN(e.PValue) {
+			e.QValue, qs = qs[0], qs[1:]
+		}
+	}
+	sort.SliceStable(enrichments, func(i, j int) bool {
+		qi, qj := enrichments[i].QValue, enrichments[j].QValue
+		return qi < qj || (!math.IsNaN(qi) && math.IsNaN(qj))
+	})
+	return enrichments
+}
+
+// PrintBiomarkerEnrichmentToCSVFile prints the tests of the trajectories for enrichment of the biomarkers to a CSV file,
+// cf. BiomarkerEnrichments. The header is:
+// Trajectory,Biomarker,Level,TrajectoryPatients,OtherPatients,TrajectoryValue,OtherValue,Effect,PValue,QValue.
+// The level is empty for numeric biomarkers.
+func PrintBiomarkerEnrichmentToCSVFile(exp *Experiment, enrichments []*BiomarkerEnrichment, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"Trajectory", "Biomarker", "Level", "TrajectoryPatients", "OtherPatients",
+		"TrajectoryValue", "OtherValue", "Effect", "PValue", "QValue"}); err != nil {
+		panic(err)
+	}
+	pvalue := func(p float64) string {
+		if math.IsNaN(p) {
+			return "NA"
+		}
+		return strconv.FormatFloat(p, 'E', 3, 64)
+	}
+	for _, e := range enrichments {
+		if err := w.Write([]string{trajectoryName(e.Trajectory, exp.NameMap), e.Biomarker, e.Level,
+			strconv.Itoa(e.TrajectoryPatients), strconv.Itoa(e.OtherPatients), utils.FormatStat(e.TrajectoryValue, 2),
+			utils.FormatStat(e.OtherValue, 2), utils.FormatStat(e.Effect, 2), pvalue(e.PValue),
+			pvalue(e.QValue)}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// ParseBiomarkerFilter parses a biomarker filter of the form name op value, e.g. KRAS=mutant or PDL1>=50, cf.
+// BiomarkerFilter.
+func ParseBiomarkerFilter(b *Biomarkers, s string) (PatientFilter, error) {
+	i := strings.IndexAny(s, "=!<>")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid biomarker filter %s, expected name op value", s)
+	}
+	j := i
+	for j < len(s) && strings.ContainsRune("=!<>", rune(s[j])) {
+		j++
+	}
+	return BiomarkerFilter(b, s[:i], s[i:j], s[j:])
+}
@@ -0,0 +1,196 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"math"
+	"ptra/utils"
+	"sort"
+)
+
+// Bootstrap confidence intervals for the summary statistics of clusters, so that the numbers of small clusters are not
+// over-interpreted.
+
+// Estimate is a statistic together with the bounds of its bootstrap confidence interval. The fields are NaN when the
+// statistic is undefined, e.g. the mean RR of a cluster without finite RR scores.
+type Estimate struct {
+	Value, Low, High float64
+}
+
+// ClusterStatistics contains the summary statistics of a cluster with their bootstrap confidence intervals: the
+// percentage of male patients, the percentage of patients with an event of interest, and the mean RR of the
+// transitions the patients follow.
+type ClusterStatistics struct {
+	CID      int
+	Patients int
+	Males    Estimate
+	EOI      Estimate
+	MeanRR   Estimate
+}
+
+// clusterPatient is a member patient of a cluster, the unit that is resampled for the bootstrap.
+type clusterPatient struct {
+	male, eoi bool
+	rr        float64 // mean of the finite RR scores of the transitions the patient follows, NaN if there are none
+}
+
+// collectClusterPatients collects the patients of a cluster, i.e. the patients in the last diagnosis of the cluster's
+// trajectories. Contrary to MetricsFromTrajectories, a patient that occurs in several trajectories of the cluster is
+// counted once, so that the resampled units are independent.
+func collectClusterPatients(exp *Experiment, c []*Trajectory) []clusterPatient {
+	type rrSum struct {
+		sum float64
+		n   int
+	}
+	index := map[int]int{}
+	patients := []*Patient{}
+	rrs := []rrSum{}
+	for _, t := range c {
+		sum, n := 0.0, 0
+		for i := 1; i < len(t.Diagnoses); i++ {
+			if rr := exp.DxDRR[t.Diagnoses[i-1]][t.Diagnoses[i]]; !math.IsInf(rr, 0) && !math.IsNaN(rr) {
+				sum += rr
+				n++
+			}
+		}
+		for _, p := range LastPatients(t) {
+			j, ok := index[p.PID]
+			if !ok {
+				j = len(patients)
+				index[p.PID] = j
+				patients = append(patients, p)
+				rrs = append(rrs, rrSum{})
+			}
+			rrs[j].sum += sum
+			rrs[j].n += n
+		}
+	}
+	result := make([]clusterPatient, len(patients))
+	for i, p := range patients {
+		result[i] = clusterPatient{male: p.Sex == Male, eoi: p.EOIDate != nil, rr: math.NaN()}
+		if rrs[i].n > 0 {
+			result[i].rr = rrs[i].sum / float64(rrs[i].n)
+		}
+	}
+	return result
+}
+
+// clusterPatientStatistics computes the percentage of males, the percentage of patients with an event of interest,
+// and the mean RR of the given patients.
+func clusterPatientStatistics(patients []clusterPatient) (males, eoi, meanRR float64) {
+	var mCtr, eoiCtr, rrCtr int
+	rrSum := 0.0
+	for _, p := range patients {
+		if p.male {
+			mCtr++
+		}
+		if p.eoi {
+			eoiCtr++
+		}
+		if !math.IsNaN(p.rr) {
+			rrSum += p.rr
+			rrCtr++
+		}
+	}
+	males, eoi, meanRR = math.NaN(), math.NaN(), math.NaN()
+	if len(patients) > 0 {
+		males = 100 * float64(mCtr) / float64(len(patients))
+		eoi = 100 * float64(eoiCtr) / float64(len(patients))
+	}
+	if rrCtr > 0 {
+		meanRR = rrSum / float64(rrCtr)
+	}
+	return males, eoi, meanRR
+}
+
+// percentileInterval returns the bounds of the central confidence interval of the given bootstrap values, ignoring
+// NaN values.
+func percentileInterval(values []float64, confidence float64) (float64, float64) {
+	sorted := []float64{}
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	sort.Float64s(sorted)
+	alpha := (1 - confidence) / 2
+	low := int(math.Floor(alpha * float64(len(sorted)-1)))
+	high := int(math.Ceil((1 - alpha) * float64(len(sorted)-1)))
+	return sorted[low], sorted[high]
+}
+
+// BootstrapClusterStatistics computes the summary statistics of each cluster of an experiment, with 95% percentile
+// bootstrap confidence intervals obtained by resampling the member patients of the cluster with replacement for the
+// given number of runs. The random generator is seeded with the cluster ID, so that reruns give the same intervals.
+func BootstrapClusterStatistics(exp *Experiment, runs int) []*ClusterStatistics {
+	clusters := CollectClusters(exp)
+	stats := make([]*ClusterStatistics, len(clusters))
+	for cid := 0; cid < len(clusters); cid++ {
+		patients := collectClusterPatients(exp, clusters[cid])
+		males, eoi, meanRR := clusterPatientStatistics(patients)
+		stat := &ClusterStatistics{CID: cid, Patients: len(patients),
+			Males: Estimate{males, math.NaN(), math.NaN()}, EOI: Estimate{eoi, math.NaN(), math.NaN()},
+			MeanRR: Estimate{meanRR, math.NaN(), math.NaN()}}
+		if len(patients) > 0 && runs > 0 {
+			rng := utils.Rand().New(int64(cid))
+			sample := make([]clusterPatient, len(patients))
+			bMales, bEOI, bMeanRR := make([]float64, runs), make([]float64, runs), make([]float64, runs)
+			for run := 0; run < runs; run++ {
+				for i := range sample {
+					sample[i] = patients[rng.Intn(len(patients))]
+				}
+				bMales[run], bEOI[run], bMeanRR[run] = clusterPatientStatistics(sample)
+			}
+			stat.Males.Low, stat.Males.High = percentileInterval(bMales, 0.95)
+			stat.EOI.Low, stat.EOI.High = percentileInterval(bEOI, 0.95)
+			stat.MeanRR.Low, stat.MeanRR.High = percentileInterval(bMeanRR, 0.95)
+		}
+		stats[cid] = stat
+	}
+	return stats
+}
+
+// PrintClusterStatisticsToCSVFile prints the summary statistics of the clusters of an experiment with their bootstrap
+// confidence intervals to a CSV file, cf. BootstrapClusterStatistics. The header is:
+// CID,Patients,Males%,Males%Low,Males%High,EOI%,EOI%Low,EOI%High,MeanRR,MeanRRLow,MeanRRHigh. Undefined values are
+// printed as NA.
+func PrintClusterStatisticsToCSVFile(exp *Experiment, name string, runs int) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprintf(file, "CID,Patients,Males%%,Males%%Low,Males%%High,EOI%%,EOI%%Low,EOI%%High,MeanRR,MeanRRLow,MeanRRHigh\n")
+	for _, stat := range BootstrapClusterStatistics(exp, runs) {
+		fmt.Fprintf(file, "%d,%d", stat.CID, stat.Patients)
+		for _, e := range []Estimate{stat.Males, stat.EOI, stat.MeanRR} {
+			fmt.Fprintf(file, ",%s,%s,%s", utils.FormatStat(e.Value, 2), utils.FormatStat(e.Low, 2),
+				utils.FormatStat(e.High, 2))
+		}
+		fmt.Fprintf(file, "\n")
+	}
+}
@@ -0,0 +1,169 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"ptra/utils"
+	"strings"
+)
+
+// Diagnosis bundles combine several diagnoses into a single diagnosis that acts as one step in the trajectories, e.g.
+// metabolic syndrome for three of obesity, hypertension, hyperglycemia, and dyslipidemia within a year. The bundles are
+// added to the diagnoses of the experiment, with their own ID, name, and code, so that they are labelled the same way
+// as other diagnoses in all outputs.
+
+// DiagnosisBundle describes a combination of diagnoses that acts as a single diagnosis. It is loaded from a JSON file
+// with LoadDiagnosisBundles.
+type DiagnosisBundle struct {
+	Name     string   // the medical name of the bundle
+	Code     string   // the code of the bundle in the outputs, by default its codes joined by +
+	Codes    []string // the diagnosis codes in the bundle, where a code includes the codes below it, e.g. E11 E11.6
+	MinCodes int      // the number of different diagnoses of the bundle a patient needs, by default 1
+	Window   float64  // the number of years within which a patient needs these diagnoses, 0 for no limit
+	Keep     bool     // keeps the diagnoses of the bundle in the trajectories, instead of replacing them by the bundle
+}
+
+// LoadDiagnosisBundles loads a list of diagnosis bundles from a JSON file.
+func LoadDiagnosisBundles(fileName string) ([]*DiagnosisBundle, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var bundles []*DiagnosisBundle
+	if err := json.Unmarshal(data, &bundles); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	names := map[string]bool{}
+	for i, b := range bundles {
+		if b.Name == "" || len(b.Codes) == 0 {
+			return nil, fmt.Errorf("%s: bundle %d needs a name and codes", fileName, i+1)
+		}
+		if names[b.Name] {
+			return nil, fmt.Errorf("%s: duplicate bundle %s", fileName, b.Name)
+		}
+		names[b.Name] = true
+		if b.MinCodes == 0 {
+			b.MinCodes = 1
+		}
+		if b.MinCodes < 0 || b.MinCodes > len(b.Codes) {
+			return nil, fmt.Errorf("%s: bundle %s needs between 1 and %d codes", fileName, b.Name, len(b.Codes))
+		}
+		if b.Window < 0 {
+			return nil, fmt.Errorf("%s: bundle %s has a negative window", fileName, b.Name)
+		}
+		if b.Code == "" {
+			b.Code = strings.Join(b.Codes, "+")
+		}
+	}
+	return bundles, nil
+}
+
+// bundleDIDs returns the diagnoses that the codes of a bundle are grouped in. codeDIDs maps the codes onto the
+// diagnoses they are grouped in, cf. DiagnosisValidity.
+func bundleDIDs(b *DiagnosisBundle, codeDIDs map[string][]int) map[int]bool {
+	dids := map[int]bool{}
+	for code, ds := range codeDIDs {
+		for _, c := range b.Codes {
+			if strings.HasPrefix(strings.ToUpper(code), strings.ToUpper(c)) {
+				for _, did := range ds {
+					dids[did] = true
+				}
+				break
+			}
+		}
+	}
+	return dids
+}
+
+// bundleDate returns the date at which a patient first has MinCodes different diagnoses of a bundle within its window,
+// and false if the patient never does. The diagnoses of the patient are sorted by date.
+func bundleDate(p *Patient, b *DiagnosisBundle, dids map[int]bool) (DiagnosisDate, bool) {
+	members := []*Diagnosis{}
+	for _, d := range p.Diagnoses {
+		if !dids[d.DID] {
+			continue
+		}
+		members = append(members, d)
+		if b.Window > 0 {
+			start := DiagnosisDateToFloat(d.Date) - b.Window
+			for len(members) > 0 && DiagnosisDateToFloat(members[0].Date) < start {
+				members = members[1:]
+			}
+		}
+		distinct := map[int]bool{}
+		for _, m := range members {
+			distinct[m.DID] = true
+		}
+		if len(distinct) >= b.MinCodes {
+			return d.Date, true
+		}
+	}
+	return DiagnosisDate{}, false
+}
+
+// ApplyDiagnosisBundles adds the diagnosis bundles to the diagnoses of the patients. The bundles get the diagnosis IDs
+// nofDiagnosisCodes, nofDiagnosisCodes+1, ..., in order. A patient gets a bundle at the date at which the patient first
+// has MinCodes different diagnoses of the bundle within its window. Unless the bundle keeps them, the diagnoses of the
+// bundle are then removed from the patient, so that the bundle replaces them in the trajectories. A diagnosis can be
+// part of several bundles. It returns the number of diagnosis codes including the bundles.
+func ApplyDiagnosisBundles(pMap *PatientMap, bundles []*DiagnosisBundle, codeDIDs map[string][]int,
+	nofDiagnosisCodes int) int {
+	dids := make([]map[int]bool, len(bundles))
+	for i, b := range bundles {
+		dids[i] = bundleDIDs(b, codeDIDs)
+		if len(dids[i]) < b.MinCodes {
+			utils.Warning(fmt.Sprintf("bundle %s only has %d diagnoses in the vocabulary, but needs %d", b.Name,
+				len(dids[i]), b.MinCodes))
+		}
+	}
+	counts := make([]int, len(bundles))
+	for _, p := range pMap.PIDMap {
+		removed := map[int]bool{}
+		added := []*Diagnosis{}
+		for i, b := range bundles {
+			if date, ok := bundleDate(p, b, dids[i]); ok {
+				counts[i]++
+				added = append(added, &Diagnosis{PID: p.PID, DID: nofDiagnosisCodes + i, Date: date})
+				if !b.Keep {
+					for did := range dids[i] {
+						removed[did] = true
+					}
+				}
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		diagnoses := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if !removed[d.DID] {
+				diagnoses = append(diagnoses, d)
+			}
+		}
+		p.Diagnoses = append(diagnoses, added...)
+		SortDiagnoses(p)
+	}
+	for i, b := range bundles {
+		utils.Info("Bundled ", b.Name, " for ", counts[i], " patients.")
+	}
+	return nofDiagnosisCodes + len(bundles)
+}
@@ -0,0 +1,108 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"ptra/utils"
+	"strconv"
+)
+
+// Compacting the diagnosis ID space. The vocabulary of diagnosis codes, e.g. all ICD10 codes of a level, is usually
+// much larger than the set of codes that occur in a cohort. Since the diagnosis IDs size dense structures such as
+// DxDRR and DxDPatients, the IDs are remapped to a contiguous space of the codes that are actually present.
+
+// CompactDiagnosisIDs remaps the diagnosis IDs of the patients to a contiguous space of the diagnosis codes that occur
+// in their diagnoses. The new IDs preserve the order of the old IDs. It returns for each new ID the old ID, for
+// remapping the name map and other maps keyed by diagnosis ID, cf. CompactNameMap and CompactHierarchy.
+func CompactDiagnosisIDs(patients *PatientMap, nofDiagnosisCodes int) []int {
+	present := make([]bool, nofDiagnosisCodes)
+	for _, p := range patients.PIDMap {
+		for _, d := range p.Diagnoses {
+			present[d.DID] = true
+		}
+	}
+	newIDs := make([]int, nofDiagnosisCodes)
+	oldIDs := []int{}
+	for did, ok := range present {
+		if ok {
+			newIDs[did] = len(oldIDs)
+			oldIDs = append(oldIDs, did)
+		} else {
+			newIDs[did] = -1
+		}
+	}
+	for _, p := range patients.PIDMap {
+		for _, d := range p.Diagnoses {
+			d.DID = newIDs[d.DID]
+		}
+	}
+	utils.Info("Compacted ", nofDiagnosisCodes, " diagnosis codes to the ", len(oldIDs), " codes present in the cohort.")
+	return oldIDs
+}
+
+// CompactNameMap remaps a map keyed by diagnosis ID, such as a name map or an ID map, to the compacted IDs returned by
+// CompactDiagnosisIDs.
+func CompactNameMap(m map[int]string, oldIDs []int) map[int]string {
+	result := map[int]string{}
+	for did, oldID := range oldIDs {
+		if v, ok := m[oldID]; ok {
+			result[did] = v
+		}
+	}
+	return result
+}
+
+// CompactHierarchy remaps a hierarchy map to the compacted IDs returned by CompactDiagnosisIDs.
+func CompactHierarchy(m map[int][]string, oldIDs []int) map[int][]string {
+	result := map[int][]string{}
+	for did, oldID := range oldIDs {
+		if v, ok := m[oldID]; ok {
+			result[did] = v
+		}
+	}
+	return result
+}
+
+// PrintDiagnosisIDsToCSVFile prints the mapping of the diagnosis IDs of an experiment to their original codes and
+// medical names to a CSV file, so that the compacted IDs can be traced back. The header is: DID,Code,Name.
+func PrintDiagnosisIDsToCSVFile(exp *Experiment, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"DID", "Code", "Name"}); err != nil {
+		panic(err)
+	}
+	for did := 0; did < exp.NofDiagnosisCodes; did++ {
+		if err := w.Write([]string{strconv.Itoa(did), exp.IdMap[did], exp.NameMap[did]}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,218 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Comparing the support for trajectories between a case cohort and a comparator cohort, e.g. patients exposed and not
+// exposed to a drug.
+
+// CaseCohort returns the analysis IDs of the patients that pass all given filters, which form the case cohort. The
+// other patients form the comparator cohort. The filters are applied to copies of the patients, since some filters
+// remove diagnoses from the patients they are applied to.
+func CaseCohort(patients *PatientMap, filters []PatientFilter) map[int]bool {
+	cases := map[int]bool{}
+	for pid, p := range patients.PIDMap {
+		keep := true
+		for _, filter := range filters {
+			c := *p
+			if !filter(&c) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			cases[pid] = true
+		}
+	}
+	return cases
+}
+
+// TrajectoryComparison holds the comparison of the support for a trajectory between a case and a comparator cohort.
+// The support is the number of patients that follow the complete trajectory. The effect size is the relative risk
+// (RR) of following the trajectory in the case cohort compared to the comparator cohort, with a 95% confidence
+// interval. The p-value is from Fisher's exact test, and the q-value is the Benjamini-Hochberg adjusted p-value.
+type TrajectoryComparison struct {
+	Trajectory                           *Trajectory
+	Case, Comparator                     int
+	CaseTotal, ComparatorTotal           int
+	CasePercentage, ComparatorPercentage float64
+	RR                                   Estimate
+	PValue, QValue                       float64
+}
+
+// relativeRisk computes the relative risk of an event that occurs for a of n1 cases and c of n2 comparators, with a 95%
+// confidence interval computed on the log scale. When a cell of the 2x2 table is zero, 0.5 is added to all cells.
+func relativeRisk(a, n1, c, n2 int) Estimate {
+	if n1 == 0 || n2 == 0 {
+		return Estimate{Value: math.NaN(), Low: math.NaN(), High: math.NaN()}
+	}
+	fa, fn1, fc, fn2 := float64(a), float64(n1), float64(c), float64(n2)
+	if a == 0 || c == 0 || a == n1 || c == n2 {
+		fa, fn1, fc, fn2 = fa+0.5, fn1+1, fc+0.5, fn2+1
+	}
+	rr := (fa / fn1) / (fc / fn2)
+	se := math.Sqrt(1/fa - 1/fn1 + 1/fc - 1/fn2)
+	return Estimate{Value: rr, Low: math.Exp(math.Log(rr) - 1.96*se), High: math.Exp(math.Log(rr) + 1.96*se)}
+}
+
+// CompareCohorts compares the support for each trajectory of an experiment between the case cohort, given by the
+// analysis IDs of its patients, and the comparator cohort, which consists of the other patients. The cohort sizes are
+// given by caseTotal and comparatorTotal. The comparisons are sorted on their q-values.
+func CompareCohorts(exp *Experiment, cases map[int]bool, caseTotal, comparatorTotal int) []*TrajectoryComparison {
+	comparisons := []*TrajectoryComparison{}
+	for _, t := range exp.Trajectories {
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
+		c := &TrajectoryComparison{Trajectory: t, CaseTotal: caseTotal, ComparatorTotal: comparatorTotal}
+		for _, p := range LastPatients(t) {
+			if cases[p.PID] {
+				c.Case++
+			} else {
+				c.Comparator++
+			}
+		}
+		comparisons = append(comparisons, c)
+	}
+	testComparisons(comparisons)
+	sort.SliceStable(comparisons, func(i, j int) bool { return comparisons[i].QValue < comparisons[j].QValue })
+	return comparisons
+}
+
+// testComparisons computes the percentages, the relative risks, the p-values, and the q-values of comparisons of which
+// the support in both cohorts and the cohort sizes are given.
+func testComparisons(comparisons []*TrajectoryComparison) {
+	ps := make([]float64, len(comparisons))
+	for i, c := range comparisons {
+		c.CasePercentage, _ = utils.Percentage(int64(c.Case), int64(c.CaseTotal))
+		c.ComparatorPercentage, _ = utils.Percentage(int64(c.Comparator), int64(c.ComparatorTotal))
+		c.RR = relativeRisk(c.Case, c.CaseTotal, c.Comparator, c.ComparatorTotal)
+		c.PValue = utils.Stats().FisherExactTest(c.Case, c.CaseTotal-c.Case, c.Comparator, c.ComparatorTotal-c.Comparator)
+		ps[i] = c.PValue
+	}
+	for i, q := range utils.Stats().BenjaminiHochberg(ps) {
+		comparisons[i].QValue = q
+	}
+}
+
+// trajectoryName returns the medical terms of the diagnoses of a trajectory, separated by arrows.
+func trajectoryName(t *Trajectory, nameMap map[int]string) string {
+	terms := []string{}
+	for _, d := range t.Diagnoses {
+		terms = append(terms, nameMap[d])
+	}
+	return strings.Join(terms, " -> ")
+}
+
+// PrintCohortComparisonToCSVFile prints a comparison table of the support for the trajectories between a case and a
+// comparator cohort to a CSV file, cf. CompareCohorts. The header is:
+// Trajectory,Case,Comparator,Case%,Comparator%,RR,RRLow,RRHigh,PValue,QValue.
+func PrintCohortComparisonToCSVFile(exp *Experiment, comparisons []*TrajectoryComparison, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"Trajectory", "Case", "Comparator", "Case%", "Comparator%", "RR", "RRLow", "RRHigh",
+		"PValue", "QValue"}); err != nil {
+		panic(err)
+	}
+	for _, c := range comparisons {
+		if err := w.Write([]string{trajectoryName(c.Trajectory, exp.NameMap), strconv.Itoa(c.Case),
+			strconv.Itoa(c.Comparator), utils.FormatStat(c.CasePercentage, 2),
+			utils.FormatStat(c.ComparatorPercentage, 2), utils.FormatStat(c.RR.Value, 2),
+			utils.FormatStat(c.RR.Low, 2), utils.FormatStat(c.RR.High, 2),
+			strconv.FormatFloat(c.PValue, 'E', 3, 64), strconv.FormatFloat(c.QValue, 'E', 3, 64)}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// PrintCohortComparisonGraphToFile prints a diff graph of the trajectories that are differentially supported between
+// a case and a comparator cohort, i.e. with a q-value below maxQ, to a GML file. Each transition is labeled with the
+// log2 RR of the most significant trajectory it occurs in, and colored red when that trajectory is more supported in
+// the case cohort, and blue when it is more supported in the comparator cohort.
+func PrintCohortComparisonGraphToFile(exp *Experiment, comparisons []*TrajectoryComparison, maxQ float64,
+	name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	nodes := []int{}
+	seenNodes := map[int]bool{}
+	edges := [][2]int{}
+	edgeComparisons := map[[2]int]*TrajectoryComparison{}
+	for _, c := range comparisons { // sorted on q-values, so the first comparison of an edge is the most significant
+		if c.QValue >= maxQ || math.IsNaN(c.RR.Value) {
+			continue
+		}
+		ds := c.Trajectory.Diagnoses
+		for i, d := range ds {
+			if !seenNodes[d] {
+				seenNodes[d] = true
+				nodes = append(nodes, d)
+			}
+			if i == 0 {
+				continue
+			}
+			edge := [2]int{ds[i-1], d}
+			if _, ok := edgeComparisons[edge]; !ok {
+				edgeComparisons[edge] = c
+				edges = append(edges, edge)
+			}
+		}
+	}
+	fmt.Fprintf(file, "graph [\n directed 1\nmultigraph 1\n")
+	for _, node := range nodes {
+		fmt.Fprintf(file, "node [ id %d\nlabel \"%s\"\n]\n", node, exp.NameMap[node])
+	}
+	for _, edge := range edges {
+		c := edgeComparisons[edge]
+		color := "#0000FF"
+		if c.RR.Value > 1 {
+			color = "#FF0000"
+		}
+		fmt.Fprintf(file, "edge [\nsource %d\ntarget %d\nlabel \"%s\"\ngraphics [ fill \"%s\" ]\n]\n", edge[0], edge[1],
+			strconv.FormatFloat(math.Log2(c.RR.Value), 'f', 2, 64), color)
+	}
+	fmt.Fprintf(file, "]\n")
+}
@@ -0,0 +1,142 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"ptra/utils"
+	"sort"
+	"strconv"
+)
+
+// The composition of the clusters by chapter, to characterize what a cluster is about at a glance, e.g. with a pie
+// chart per cluster.
+
+// otherChapter is the chapter of the diagnoses outside the hierarchy, e.g. treatments, in the chapter compositions.
+const otherChapter = "Other"
+
+// ChapterShare is the share of a chapter in the diagnoses of a cluster. Diagnoses is the number of distinct diagnoses of
+// the chapter in the trajectories of the cluster, and Occurrences the number of times the diagnoses of the chapter
+// occur in those trajectories. The percentage is the percentage of the occurrences of all chapters.
+type ChapterShare struct {
+	Chapter     string  `json:"chapter"`
+	Diagnoses   int     `json:"diagnoses"`
+	Occurrences int     `json:"occurrences"`
+	Percentage  float64 `json:"percentage"`
+}
+
+// ChapterComposition is the distribution of the diagnoses of the trajectories of a cluster over the chapters.
+type ChapterComposition struct {
+	Cluster  int            `json:"cluster"`
+	Chapters []ChapterShare `json:"chapters"`
+}
+
+// ClusterChapterCompositions computes the distribution of the diagnoses of each cluster over the chapters of the
+// vocabulary, i.e. the ICD10 chapters or CCSR body systems, cf. DiagnosisChapter. The compositions are ordered by
+// cluster ID, and the chapters of a composition from the most to the least occurrences, then by name.
+func ClusterChapterCompositions(exp *Experiment) []ChapterComposition {
+	clusters := CollectClusters(exp)
+	compositions := []ChapterComposition{}
+	for _, cid := range utils.SortedKeys(clusters) {
+		shares := map[string]*ChapterShare{}
+		seen := map[int]bool{}
+		total := 0
+		for _, t := range clusters[cid] {
+			for _, did := range t.Diagnoses {
+				chapter := DiagnosisChapter(exp, did)
+				if chapter == "" {
+					chapter = otherChapter
+				}
+				share, ok := shares[chapter]
+				if !ok {
+					share = &ChapterShare{Chapter: chapter}
+					shares[chapter] = share
+				}
+				if !seen[did] {
+					seen[did] = true
+					share.Diagnoses++
+				}
+				share.Occurrences++
+				total++
+			}
+		}
+		composition := ChapterComposition{Cluster: cid, Chapters: []ChapterShare{}}
+		for _, share := range shares {
+			share.Percentage, _ = utils.Percentage(int64(share.Occurrences), int64(total))
+			composition.Chapters = append(composition.Chapters, *share)
+		}
+		sort.Slice(composition.Chapters, func(i, j int) bool {
+			ci, cj := composition.Chapters[i], composition.Chapters[j]
+			if ci.Occurrences != cj.Occurrences {
+				return ci.Occurrences > cj.Occurrences
+			}
+			return ci.Chapter < cj.Chapter
+		})
+		compositions = append(compositions, composition)
+	}
+	return compositions
+}
+
+// PrintClusterChapterCompositionsToFiles writes the chapter composition of each cluster, cf.
+// ClusterChapterCompositions, to a CSV file with a row per cluster and chapter, and to a JSON file with a list of
+// chapters per cluster, for drawing a pie chart per cluster.
+func PrintClusterChapterCompositionsToFiles(exp *Experiment, csvName, jsonName string) {
+	compositions := ClusterChapterCompositions(exp)
+	file, err := utils.CreateFile(csvName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"CID", "Chapter", "Diagnoses", "Occurrences", "Percentage"}); err != nil {
+		panic(err)
+	}
+	for _, composition := range compositions {
+		for _, share := range composition.Chapters {
+			if err := w.Write([]string{strconv.Itoa(composition.Cluster), share.Chapter,
+				strconv.Itoa(share.Diagnoses), strconv.Itoa(share.Occurrences),
+				utils.FormatStat(share.Percentage, 2)}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+	jsonFile, err := utils.CreateFile(jsonName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := jsonFile.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(jsonFile)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(compositions); err != nil {
+		panic(err)
+	}
+}
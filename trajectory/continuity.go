@@ -0,0 +1,53 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import "fmt"
+
+// LargestObservationGap returns the largest time between consecutive records of a patient, in years, and the date of
+// the record before the gap. The records are the diagnoses of the patient, which are sorted by date. A patient with
+// less than two records has no gap.
+func LargestObservationGap(p *Patient) (float64, DiagnosisDate) {
+	gap, before := 0.0, DiagnosisDate{}
+	for i := 1; i < len(p.Diagnoses); i++ {
+		d := DiagnosisDateToFloat(p.Diagnoses[i].Date) - DiagnosisDateToFloat(p.Diagnoses[i-1].Date)
+		if d > gap {
+			gap, before = d, p.Diagnoses[i-1].Date
+		}
+	}
+	return gap, before
+}
+
+// ApplyObservationGapFilter returns a patient map with the patients that have at least one record every maxGap years
+// during their follow-up. Long gaps without healthcare contact, e.g. because a patient was treated elsewhere, bias the
+// timing of the transitions between diagnoses. The other patients are recorded as exclusions with the reason
+// ExcludedObservationGap and their largest gap as detail.
+func ApplyObservationGapFilter(pMap *PatientMap, maxGap float64) *PatientMap {
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		Exclusions: pMap.Exclusions}
+	for pid, p := range pMap.PIDMap {
+		if gap, before := LargestObservationGap(p); gap > maxGap {
+			ExcludePatient(newPMap, p.PIDString, ExcludedObservationGap, fmt.Sprintf("%.1f years after %d-%02d-%02d",
+				gap, before.Year, before.Month, before.Day))
+		} else {
+			keepPatient(newPMap, pid, p)
+		}
+	}
+	return newPMap
+}
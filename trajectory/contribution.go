@@ -0,0 +1,81 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"ptra/utils"
+)
+
+// Capping the contribution of single patients to the trajectories. A few patients with hundreds of diagnoses follow
+// many trajectories, and can dominate the support of the trajectories and the similarities between them.
+
+// CapPatientContributions lets each patient support at most maxPerPatient trajectories of an experiment. A patient
+// that follows more trajectories is only counted for the maxPerPatient trajectories with the most patients, in the
+// order of SortTrajectories, and is removed from the patients of all the transitions of the other trajectories. The
+// trajectories whose number of patients drops below minPatients are removed, and the remaining trajectories are sorted
+// again. A maximum of 0 or less keeps all contributions.
+func CapPatientContributions(exp *Experiment, maxPerPatient, minPatients int) {
+	if maxPerPatient <= 0 {
+		return
+	}
+	contributions := map[*Patient]int{}
+	capped := utils.Set[*Patient]{}
+	kept := []*Trajectory{}
+	changed, removed := 0, 0
+	for _, t := range exp.Trajectories {
+		excess := utils.Set[*Patient]{}
+		for _, p := range LastPatients(t) {
+			if contributions[p] >= maxPerPatient {
+				excess.Add(p)
+				capped.Add(p)
+				continue
+			}
+			contributions[p]++
+		}
+		if len(excess) == 0 {
+			kept = append(kept, t)
+			continue
+		}
+		changed++
+		// the patient lists are shared with the trajectories that were extended from the same prefix, so they are
+		// copied rather than filtered in place
+		for i, ps := range t.Patients {
+			filtered := make([]*Patient, 0, len(ps))
+			for _, p := range ps {
+				if !excess.Contains(p) {
+					filtered = append(filtered, p)
+				}
+			}
+			t.Patients[i] = filtered
+			t.PatientNumbers[i] = len(filtered)
+		}
+		for p := range excess {
+			delete(t.TrajMap, p)
+		}
+		if trajectoryScore(t) < minPatients {
+			removed++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	SortTrajectories(kept)
+	exp.Trajectories = kept
+	utils.Info("Capped the contributions of ", len(capped), " patients to ", maxPerPatient,
+		" trajectories each: changed ", changed, " and removed ", removed, " trajectories, kept ", len(kept),
+		" trajectories.")
+}
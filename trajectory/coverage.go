@@ -0,0 +1,154 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"ptra/utils"
+	"sort"
+	"strconv"
+)
+
+// Coverage describes how much of the cohort a set of trajectories explains: the number of distinct patients that
+// follow at least one of the trajectories to its last diagnosis, and how many of those have an event of interest.
+type Coverage struct {
+	Trajectories, Patients, EOIPatients int
+}
+
+// CountEOIPatients returns the number of patients with an event of interest.
+func CountEOIPatients(pMap *PatientMap) int {
+	ctr := 0
+	for _, p := range pMap.PIDMap {
+		if p.EOIDate != nil {
+			ctr++
+		}
+	}
+	return ctr
+}
+
+// addCoveredPatients adds the patients that follow the given trajectories to the covered set, indexed by PID.
+func addCoveredPatients(ts []*Trajectory, covered map[int]*Patient) {
+	for _, t := range ts {
+		for _, p := range LastPatients(t) {
+			covered[p.PID] = p
+		}
+	}
+}
+
+// coverageOfPatients computes the coverage for a set of covered patients.
+func coverageOfPatients(nofTrajectories int, covered map[int]*Patient) Coverage {
+	c := Coverage{Trajectories: nofTrajectories, Patients: len(covered)}
+	for _, p := range covered {
+		if p.EOIDate != nil {
+			c.EOIPatients++
+		}
+	}
+	return c
+}
+
+// TrajectoryCoverage computes the coverage of the given trajectories. Patients that follow several trajectories are
+// counted once.
+func TrajectoryCoverage(ts []*Trajectory) Coverage {
+	covered := map[int]*Patient{}
+	addCoveredPatients(ts, covered)
+	return coverageOfPatients(len(ts), covered)
+}
+
+// CoveragePercentages returns the coverage as a percentage of all patients of the experiment, cf.
+// Experiment.PatientCtr, and of all patients with an event of interest. The percentages are NaN when the experiment
+// has no such patients.
+func CoveragePercentages(exp *Experiment, c Coverage) (float64, float64) {
+	patients, _ := utils.Percentage(int64(c.Patients), int64(exp.PatientCtr))
+	eoiPatients, _ := utils.Percentage(int64(c.EOIPatients), int64(exp.EOICtr))
+	return patients, eoiPatients
+}
+
+// coverageRecord formats a coverage as a CSV record.
+func coverageRecord(exp *Experiment, c Coverage) []string {
+	patients, eoiPatients := CoveragePercentages(exp, c)
+	return []string{strconv.Itoa(c.Trajectories), strconv.Itoa(c.Patients), utils.FormatStat(patients, 2),
+		strconv.Itoa(c.EOIPatients), utils.FormatStat(eoiPatients, 2)}
+}
+
+// printCoverageToCSVFile writes a header and the given records to a CSV file.
+func printCoverageToCSVFile(name string, header []string, records [][]string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write(header); err != nil {
+		panic(err)
+	}
+	if err := w.WriteAll(records); err != nil {
+		panic(err)
+	}
+}
+
+// PrintCoverageToFile reports which fraction of the cohort, and of the patients with an event of interest, follows at
+// least one of the trajectories of the experiment. The coverage is printed and written to <name>-coverage.csv.
+func PrintCoverageToFile(exp *Experiment, path string) {
+	c := TrajectoryCoverage(exp.Trajectories)
+	patients, eoiPatients := CoveragePercentages(exp, c)
+	utils.Info("Trajectories cover ", c.Patients, " patients (", utils.FormatStat(patients, 2), "%) and ",
+		c.EOIPatients, " patients with an event of interest (", utils.FormatStat(eoiPatients, 2), "%).")
+	header := []string{"Trajectories", "Patients", "Patients%", "EOIPatients", "EOIPatients%", "TotalPatients",
+		"TotalEOIPatients"}
+	record := append(coverageRecord(exp, c), strconv.Itoa(exp.PatientCtr), strconv.Itoa(exp.EOICtr))
+	printCoverageToCSVFile(filepath.Join(path, fmt.Sprintf("%s-coverage.csv", exp.Name)), header, [][]string{record})
+}
+
+// PrintClusterCoverageToCSVFile writes the coverage of each cluster of trajectories to a CSV file, together with the
+// cumulative coverage of the clusters up to and including it. Clusters are listed by ID, which for MCL clusterings is
+// from largest to smallest, so that the cumulative columns show how much of the cohort the top clusters explain. A
+// last row with CID "all" gives the coverage of all clustered trajectories.
+func PrintClusterCoverageToCSVFile(exp *Experiment, name string) {
+	clusters := CollectClusters(exp)
+	cids := []int{}
+	for cid := range clusters {
+		cids = append(cids, cid)
+	}
+	sort.Ints(cids)
+	records := [][]string{}
+	cumulative := map[int]*Patient{}
+	cumulativeTrajectories := map[*Trajectory]bool{}
+	for _, cid := range cids {
+		record := append([]string{strconv.Itoa(cid)}, coverageRecord(exp, TrajectoryCoverage(clusters[cid]))...)
+		addCoveredPatients(clusters[cid], cumulative)
+		for _, t := range clusters[cid] {
+			cumulativeTrajectories[t] = true
+		}
+		patients, eoiPatients := CoveragePercentages(exp, coverageOfPatients(len(cumulativeTrajectories), cumulative))
+		records = append(records, append(record, utils.FormatStat(patients, 2), utils.FormatStat(eoiPatients, 2)))
+	}
+	all := coverageOfPatients(len(cumulativeTrajectories), cumulative)
+	patients, eoiPatients := CoveragePercentages(exp, all)
+	records = append(records, append(append([]string{"all"}, coverageRecord(exp, all)...),
+		utils.FormatStat(patients, 2), utils.FormatStat(eoiPatients, 2)))
+	header := []string{"CID", "Trajectories", "Patients", "Patients%", "EOIPatients", "EOIPatients%",
+		"CumulativePatients%", "CumulativeEOIPatients%"}
+	printCoverageToCSVFile(name, header, records)
+}
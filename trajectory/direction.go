@@ -0,0 +1,114 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"math"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// Direction is the evidence for the direction of a selected diagnosis pair First -> Second: the numbers of patients
+// that are diagnosed with the first diagnosis before and after the second one, within the time window of the
+// trajectories, and the binomial test statistic on these numbers with which the direction is selected, cf.
+// selectDiagnosisPair.
+type Direction struct {
+	Before, After int     // the numbers of patients with First before and after Second
+	P             float64 // the one-sided binomial p-value of at least Before of Before+After patients if both directions are equally likely
+}
+
+// newDirection returns the direction of a pair with the given numbers of patients in both directions. BinomialCdf
+// requires fewer events than trials, so the p-value of a pair that is never diagnosed in the reverse direction is
+// computed directly.
+func newDirection(before, after int) Direction {
+	n := before + after
+	switch {
+	case before == 0:
+		return Direction{Before: before, After: after, P: 1}
+	case after == 0:
+		return Direction{Before: before, After: after, P: math.Pow(0.5, float64(n))}
+	}
+	return Direction{Before: before, After: after, P: utils.Stats().BinomialCdf(0.5, n, before)}
+}
+
+// Confidence returns the fraction of the patients with both diagnoses of the pair that are diagnosed with First before
+// Second, or NaN if there are no such patients.
+func (d Direction) Confidence() float64 {
+	if d.Before+d.After == 0 {
+		return math.NaN()
+	}
+	return float64(d.Before) / float64(d.Before+d.After)
+}
+
+// String returns the direction as it is shown to reviewers, e.g. 85% (170/200) before, p = 1.2E-24.
+func (d Direction) String() string {
+	return fmt.Sprintf("%s%% (%d/%d) before, p = %s", strconv.FormatFloat(100*d.Confidence(), 'f', 0, 64),
+		d.Before, d.Before+d.After, strconv.FormatFloat(d.P, 'E', 1, 64))
+}
+
+// PairDirections maps the selected diagnosis pairs to their directions.
+type PairDirections map[Pair]Direction
+
+// recordDirection records the direction of a selected pair in the experiment, cf. Experiment.Directions.
+func recordDirection(exp *Experiment, pair *Pair, before, after int) {
+	if exp.Directions == nil {
+		exp.Directions = PairDirections{}
+	}
+	exp.Directions[*pair] = newDirection(before, after)
+}
+
+// TransitionDirection returns the direction of the transition d1 -> d2 of a trajectory, and false if it is not known,
+// e.g. for experiments that are read from files without the directions of the pairs.
+func TransitionDirection(exp *Experiment, d1, d2 int) (Direction, bool) {
+	d, ok := exp.Directions[Pair{First: d1, Second: d2}]
+	return d, ok
+}
+
+// formatDirectionColumns formats the direction of a pair as the columns of the pairs tab file, cf. printPairsToTabFile.
+// The columns are empty if the direction is not known.
+func formatDirectionColumns(d Direction, ok bool) string {
+	if !ok {
+		return "\t\t\t"
+	}
+	return strings.Join([]string{strconv.Itoa(d.Before), strconv.Itoa(d.After),
+		strconv.FormatFloat(d.Confidence(), 'f', 4, 64), strconv.FormatFloat(d.P, 'E', -1, 64)}, "\t")
+}
+
+// parseDirectionColumns parses the columns of a pair of the pairs tab file written by formatDirectionColumns. It
+// returns false if they are empty.
+func parseDirectionColumns(fields []string) (Direction, bool, error) {
+	if fields[0] == "" && fields[1] == "" {
+		return Direction{}, false, nil
+	}
+	before, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Direction{}, false, err
+	}
+	after, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Direction{}, false, err
+	}
+	p, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return Direction{}, false, err
+	}
+	return Direction{Before: before, After: after, P: p}, true, nil
+}
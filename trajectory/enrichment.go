@@ -0,0 +1,140 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"ptra/utils"
+	"strconv"
+)
+
+// EOI enrichment of transitions, for color coding the trajectory graphs so that transitions after which many patients
+// get their event of interest stand out.
+
+// EOIEnrichment computes the ratio of the fraction of the given patients that have an event of interest to the
+// fraction of the patients of the cohort that have an event of interest. It is NaN if there are no patients, or if the
+// cohort has no patients with an event of interest.
+func EOIEnrichment(exp *Experiment, ps []*Patient) float64 {
+	cohort := exp.MCtr + exp.FCtr
+	if len(ps) == 0 || cohort == 0 || exp.EOICtr == 0 {
+		return math.NaN()
+	}
+	eoi := 0
+	for _, p := range ps {
+		if p.EOIDate != nil {
+			eoi++
+		}
+	}
+	return (float64(eoi) / float64(len(ps))) / (float64(exp.EOICtr) / float64(cohort))
+}
+
+// TransitionEOIEnrichments returns the EOI enrichment of the patients of each transition of a trajectory, cf.
+// EOIEnrichment. For trajectories read from a .ptra file, these are the enrichments stored in the file. The
+// enrichments are NaN if the patients of the trajectory are not known, e.g. for trajectories read from a tab file.
+func TransitionEOIEnrichments(exp *Experiment, t *Trajectory) []float64 {
+	if t.EOIEnrichments != nil {
+		return t.EOIEnrichments
+	}
+	enrichments := make([]float64, len(t.PatientNumbers))
+	for i := range enrichments {
+		enrichments[i] = math.NaN()
+		if i < len(t.Patients) {
+			enrichments[i] = EOIEnrichment(exp, t.Patients[i])
+		}
+	}
+	return enrichments
+}
+
+// EOIColorStop is a stop of the suggested color scale for EOI enrichments.
+type EOIColorStop struct {
+	Enrichment float64
+	Color      [3]uint8
+}
+
+// EOIColorScale is the suggested color scale for EOI enrichments: a diverging scale on a logarithmic axis, from blue
+// for transitions with fewer events of interest than the cohort, over white for the cohort rate, to red for
+// transitions with more events of interest. The colors are those of the ColorBrewer RdBu scheme.
+var EOIColorScale = []EOIColorStop{
+	{0.25, [3]uint8{0x21, 0x66, 0xac}},
+	{0.5, [3]uint8{0x92, 0xc5, 0xde}},
+	{1, [3]uint8{0xf7, 0xf7, 0xf7}},
+	{2, [3]uint8{0xf4, 0xa5, 0x82}},
+	{4, [3]uint8{0xb2, 0x18, 0x2b}},
+}
+
+// hexColor formats a color as #rrggbb.
+func hexColor(c [3]uint8) string {
+	return fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2])
+}
+
+// EOIEnrichmentColor returns the color of an EOI enrichment on EOIColorScale as #rrggbb. The colors are interpolated
+// between the stops on a logarithmic axis, and enrichments outside the scale get the color of the nearest end.
+func EOIEnrichmentColor(enrichment float64) string {
+	return hexColor(eoiEnrichmentRGB(enrichment))
+}
+
+// eoiEnrichmentRGB returns the color of an EOI enrichment on EOIColorScale, cf. EOIEnrichmentColor.
+func eoiEnrichmentRGB(enrichment float64) [3]uint8 {
+	first, last := EOIColorScale[0], EOIColorScale[len(EOIColorScale)-1]
+	if math.IsNaN(enrichment) || enrichment <= first.Enrichment {
+		return first.Color
+	}
+	for i := 1; i < len(EOIColorScale); i++ {
+		lo, hi := EOIColorScale[i-1], EOIColorScale[i]
+		if enrichment <= hi.Enrichment {
+			f := math.Log(enrichment/lo.Enrichment) / math.Log(hi.Enrichment/lo.Enrichment)
+			var c [3]uint8
+			for j := range c {
+				c[j] = uint8(math.Round(float64(lo.Color[j]) + f*(float64(hi.Color[j])-float64(lo.Color[j]))))
+			}
+			return c
+		}
+	}
+	return last.Color
+}
+
+// PrintEOIColorScaleToCSVFile writes the stops of the suggested color scale for EOI enrichments to a csv file, as a
+// legend for the trajectory graphs. The header is Enrichment,Color.
+func PrintEOIColorScaleToCSVFile(name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	writer := csv.NewWriter(file)
+	if err := writer.Write([]string{"Enrichment", "Color"}); err != nil {
+		panic(err)
+	}
+	for _, stop := range EOIColorScale {
+		if err := writer.Write([]string{strconv.FormatFloat(stop.Enrichment, 'f', -1, 64),
+			hexColor(stop.Color)}); err != nil {
+			panic(err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		panic(err)
+	}
+}
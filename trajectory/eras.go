@@ -0,0 +1,389 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Era-specific trajectories: repeating the trajectory discovery over sliding calendar windows, and tracking which
+// trajectories emerge and disappear over the eras.
+
+// Era is a calendar window of whole years, from the start of year Start until the start of year End.
+type Era struct {
+	Start, End int
+}
+
+// String returns the label of an era, e.g. 2000-2004 for the era from 2000 until 2005.
+func (era Era) String() string {
+	return fmt.Sprintf("%d-%d", era.Start, era.End-1)
+}
+
+// SlidingEras returns the calendar windows of the given number of years, stepped by the given number of years, that
+// cover the diagnoses of the patients. The first window starts in the year of the first diagnosis, and the last window
+// is the first one that contains the year of the last diagnosis.
+func SlidingEras(patients *PatientMap, window, step int) []Era {
+	if window <= 0 || step <= 0 {
+		panic(fmt.Sprint("Invalid eras of ", window, " years stepped by ", step, " years"))
+	}
+	first, last := math.MaxInt, math.MinInt
+	for _, p := range patients.PIDMap {
+		for _, d := range p.Diagnoses {
+			if d.Date.Year < first {
+				first = d.Date.Year
+			}
+			if d.Date.Year > last {
+				last = d.Date.Year
+			}
+		}
+	}
+	eras := []Era{}
+	for start := first; start <= last; start += step {
+		eras = append(eras, Era{Start: start, End: start + window})
+		if start+window > last {
+			break
+		}
+	}
+	return eras
+}
+
+// EraExperiment creates an experiment over the same diagnosis codes as the given experiment, for copies of the given
+// patients that only keep their diagnoses in an era. Patients without diagnoses in the era are left out. The diagnosis
+// IDs are not compacted, so that the trajectories of different eras can be compared. The relative risk ratios still
+// need to be computed, cf. InitializeExperimentRelativeRiskRatios.
+func EraExperiment(exp *Experiment, patients *PatientMap, era Era) (*Experiment, *PatientMap) {
+	return subsetExperiment(exp, patients, era.String(), func(p *Patient) []*Diagnosis {
+		diagnoses := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if d.Date.Year >= era.Start && d.Date.Year < era.End {
+				diagnoses = append(diagnoses, d)
+			}
+		}
+		return diagnoses
+	})
+}
+
+// subsetExperiment creates an experiment over the same diagnosis codes as the given experiment, for copies of the
+// given patients that only keep the diagnoses returned by restrict. Patients without diagnoses left are left out. The
+// name of the experiment is the name of the given experiment followed by the suffix.
+func subsetExperiment(exp *Experiment, patients *PatientMap, suffix string,
+	restrict func(p *Patient) []*Diagnosis) (*Experiment, *PatientMap) {
+	subPatients := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: patients.Ctr}
+	for pid, p := range patients.PIDMap {
+		newP := copyPatient(p, pid, nil)
+		diagnoses := restrict(newP)
+		if len(diagnoses) == 0 {
+			continue
+		}
+		newP.Diagnoses = diagnoses
+		subPatients.PIDMap[pid] = newP
+		subPatients.PIDStringMap[newP.PIDString] = pid
+		if newP.Sex == Male {
+			subPatients.MaleCtr++
+		} else {
+			subPatients.FemaleCtr++
+		}
+	}
+	AssignCohortAges(subPatients, exp.NofAgeGroups)
+	cohorts := InitializeCohorts(subPatients, exp.NofAgeGroups, exp.NofRegions, exp.NofDiagnosisCodes)
+	dPatients := make([][]*Patient, exp.NofDiagnosisCodes)
+	for _, cohort := range cohorts {
+		for did, ps := range cohort.DPatients {
+			dPatients[did] = append(dPatients[did], ps...)
+		}
+	}
+	subExp := &Experiment{
+		NofAgeGroups:        exp.NofAgeGroups,
+		NofRegions:          exp.NofRegions,
+		Level:               exp.Level,
+		NofDiagnosisCodes:   exp.NofDiagnosisCodes,
+		DxDRR:               MakeDxDRR(exp.NofDiagnosisCodes),
+		DxDPatients:         MakeDxDPatients(exp.NofDiagnosisCodes),
+		DPatients:           dPatients,
+		Cohorts:             cohorts,
+		Name:                fmt.Sprintf("%s-%s", exp.Name, suffix),
+		NameMap:             exp.NameMap,
+		IdMap:               exp.IdMap,
+		Hierarchy:           exp.Hierarchy,
+		CodeHierarchy:       exp.CodeHierarchy,
+		Embeddings:          exp.Embeddings,
+		Messages:            exp.Messages,
+		Validity:            exp.Validity,
+		MaxTrajectories:     exp.MaxTrajectories,
+		ExcludedTransitions: exp.ExcludedTransitions,
+		IncidentLookback:    exp.IncidentLookback,
+		MCtr:                subPatients.MaleCtr,
+		FCtr:                subPatients.FemaleCtr,
+		PatientCtr:          len(subPatients.PIDMap),
+		EOICtr:              CountEOIPatients(subPatients),
+	}
+	return subExp, subPatients
+}
+
+// TrajectoryEvolution tracks a trajectory over eras: the number of patients that follow the trajectory in each era,
+// which is 0 for the eras in which it is not discovered, the index of the first era in which it is discovered
+// (Emerged), and the index of the era after the last era in which it is discovered (Disappeared), or -1 if it is
+// discovered in the last era.
+type TrajectoryEvolution struct {
+	Diagnoses            []int
+	Patients             []int
+	Emerged, Disappeared int
+}
+
+// trajectoryKey returns a key that identifies a trajectory by its diagnoses.
+func trajectoryKey(diagnoses []int) string {
+	key := make([]string, len(diagnoses))
+	for i, d := range diagnoses {
+		key[i] = strconv.Itoa(d)
+	}
+	return strings.Join(key, ",")
+}
+
+// trajectorySupport returns the number of patients that follow a complete trajectory.
+func trajectorySupport(t *Trajectory) int {
+	if len(t.PatientNumbers) == 0 {
+		return 0
+	}
+	return t.PatientNumbers[len(t.PatientNumbers)-1]
+}
+
+// EraEvolution tracks the trajectories discovered in the experiments of a number of eras, cf. TrajectoryEvolution.
+// The trajectories are sorted by the era in which they emerged, then by their total number of patients, highest first.
+func EraEvolution(exps []*Experiment) []*TrajectoryEvolution {
+	evolutions := map[string]*TrajectoryEvolution{}
+	result := []*TrajectoryEvolution{}
+	for i, exp := range exps {
+		for _, t := range exp.Trajectories {
+			key := trajectoryKey(t.Diagnoses)
+			e, ok := evolutions[key]
+			if !ok {
+				e = &TrajectoryEvolution{Diagnoses: t.Diagnoses, Patients: make([]int, len(exps)), Emerged: i}
+				evolutions[key] = e
+				result = append(result, e)
+			}
+			e.Patients[i] = trajectorySupport(t)
+		}
+	}
+	total := map[*TrajectoryEvolution]int{}
+	for _, e := range result {
+		e.Disappeared = -1
+		for i := len(e.Patients) - 1; i >= 0; i-- {
+			if e.Patients[i] > 0 {
+				if i+1 < len(e.Patients) {
+					e.Disappeared = i + 1
+				}
+				break
+			}
+		}
+		for _, n := range e.Patients {
+			total[e] += n
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Emerged != result[j].Emerged {
+			return result[i].Emerged < result[j].Emerged
+		}
+		if total[result[i]] != total[result[j]] {
+			return total[result[i]] > total[result[j]]
+		}
+		return trajectoryKey(result[i].Diagnoses) < trajectoryKey(result[j].Diagnoses)
+	})
+	return result
+}
+
+// eraLabel returns the label of the era with the given index, or the empty string for -1.
+func eraLabel(eras []Era, i int) string {
+	if i < 0 {
+		return ""
+	}
+	return eras[i].String()
+}
+
+// PrintEraEvolutionToCSVFile prints the evolution of the trajectories over the eras to a CSV file, cf. EraEvolution.
+// The header is: Trajectory, the labels of the eras, Emerged, Disappeared. The columns of the eras contain the number
+// of patients that follow the trajectory in each era, and Emerged and Disappeared contain era labels.
+func PrintEraEvolutionToCSVFile(exp *Experiment, eras []Era, evolutions []*TrajectoryEvolution, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	header := []string{"Trajectory"}
+	for _, era := range eras {
+		header = append(header, era.String())
+	}
+	if err := w.Write(append(header, "Emerged", "Disappeared")); err != nil {
+		panic(err)
+	}
+	for _, e := range evolutions {
+		record := []string{trajectoryName(&Trajectory{Diagnoses: e.Diagnoses}, exp.NameMap)}
+		for _, n := range e.Patients {
+			record = append(record, strconv.Itoa(n))
+		}
+		if err := w.Write(append(record, eraLabel(eras, e.Emerged), eraLabel(eras, e.Disappeared))); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// eraNode is a diagnosis in the graph of an era in the JSON file of the era evolution.
+type eraNode struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// eraEdge is a transition in the graph of an era in the JSON file of the era evolution.
+type eraEdge struct {
+	Source   int      `json:"source"`
+	Target   int      `json:"target"`
+	Patients int      `json:"patients"`
+	RR       *float64 `json:"rr,omitempty"`
+	Status   string   `json:"status"`
+}
+
+// eraGraph is the graph of the trajectories of an era in the JSON file of the era evolution.
+type eraGraph struct {
+	Era      string    `json:"era"`
+	Start    int       `json:"start"`
+	End      int       `json:"end"`
+	Patients int       `json:"patients"`
+	Nodes    []eraNode `json:"nodes"`
+	Edges    []eraEdge `json:"edges"`
+}
+
+// eraTrajectory is a trajectory in the JSON file of the era evolution.
+type eraTrajectory struct {
+	Diagnoses   []int    `json:"diagnoses"`
+	Names       []string `json:"names"`
+	Patients    []int    `json:"patients"`
+	Emerged     string   `json:"emerged"`
+	Disappeared string   `json:"disappeared,omitempty"`
+}
+
+// eraEdges collects the transitions of the trajectories of an experiment, with the largest number of patients of the
+// trajectories they occur in.
+func eraEdges(exp *Experiment) ([][2]int, map[[2]int]int) {
+	edges := [][2]int{}
+	patients := map[[2]int]int{}
+	for _, t := range exp.Trajectories {
+		for i := 0; i+1 < len(t.Diagnoses); i++ {
+			edge := [2]int{t.Diagnoses[i], t.Diagnoses[i+1]}
+			if _, ok := patients[edge]; !ok {
+				edges = append(edges, edge)
+			}
+			if i < len(t.PatientNumbers) && t.PatientNumbers[i] > patients[edge] {
+				patients[edge] = t.PatientNumbers[i]
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i][0] < edges[j][0] || (edges[i][0] == edges[j][0] && edges[i][1] < edges[j][1])
+	})
+	return edges, patients
+}
+
+// PrintEraEvolutionToJSONFile prints the evolution of the trajectories over the eras to a JSON file that can drive an
+// animated graph, with one frame per era. Each era has the graph of its trajectories: the diagnoses as nodes and the
+// transitions as edges, with the number of patients, the RR, and a status that is emerged for transitions that are
+// not in the previous era, persisting for transitions that are, and disappeared for transitions of the previous era
+// that are no longer discovered, with 0 patients. The file also lists the trajectories with their number of patients
+// per era, cf. EraEvolution.
+func PrintEraEvolutionToJSONFile(exp *Experiment, eras []Era, exps []*Experiment,
+	evolutions []*TrajectoryEvolution, name string) {
+	graphs := []eraGraph{}
+	previous := map[[2]int]int{}
+	var previousEdges [][2]int
+	for i, eraExp := range exps {
+		edges, patients := eraEdges(eraExp)
+		graph := eraGraph{Era: eras[i].String(), Start: eras[i].Start, End: eras[i].End,
+			Patients: eraExp.MCtr + eraExp.FCtr, Nodes: []eraNode{}, Edges: []eraEdge{}}
+		nodes := map[int]bool{}
+		addNode := func(d int) {
+			if !nodes[d] {
+				nodes[d] = true
+				graph.Nodes = append(graph.Nodes, eraNode{ID: d, Name: exp.NameMap[d]})
+			}
+		}
+		for _, edge := range edges {
+			status := "emerged"
+			if _, ok := previous[edge]; ok {
+				status = "persisting"
+			}
+			e := eraEdge{Source: edge[0], Target: edge[1], Patients: patients[edge], Status: status}
+			if rr := eraExp.DxDRR[edge[0]][edge[1]]; !math.IsNaN(rr) && !math.IsInf(rr, 0) {
+				e.RR = &rr
+			}
+			graph.Edges = append(graph.Edges, e)
+			addNode(edge[0])
+			addNode(edge[1])
+		}
+		for _, edge := range previousEdges {
+			if _, ok := patients[edge]; !ok {
+				graph.Edges = append(graph.Edges, eraEdge{Source: edge[0], Target: edge[1], Status: "disappeared"})
+				addNode(edge[0])
+				addNode(edge[1])
+			}
+		}
+		sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+		graphs = append(graphs, graph)
+		previous, previousEdges = patients, edges
+	}
+	trajectories := []eraTrajectory{}
+	for _, e := range evolutions {
+		t := eraTrajectory{Diagnoses: e.Diagnoses, Patients: e.Patients, Emerged: eraLabel(eras, e.Emerged),
+			Disappeared: eraLabel(eras, e.Disappeared)}
+		for _, d := range e.Diagnoses {
+			t.Names = append(t.Names, exp.NameMap[d])
+		}
+		trajectories = append(trajectories, t)
+	}
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Eras         []eraGraph      `json:"eras"`
+		Trajectories []eraTrajectory `json:"trajectories"`
+	}{graphs, trajectories}); err != nil {
+		panic(err)
+	}
+}
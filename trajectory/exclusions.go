@@ -0,0 +1,85 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"ptra/utils"
+	"sort"
+)
+
+// Reason codes for excluding patients from the analysis.
+const (
+	ExcludedMissingBirthYear = "missing_birth_year" // the year of birth of the patient is missing or invalid
+	ExcludedMissingSex       = "missing_sex"        // the sex of the patient is missing or neither male nor female
+	ExcludedNoDiagnoses      = "no_diagnoses"       // none of the diagnoses of the patient qualify for the analysis
+	ExcludedUnmatchedPatient = "unmatched_patient"  // diagnoses refer to a patient that is not in the patient file
+	ExcludedByPatientFilter  = "patient_filter"     // the patient does not pass one of the patient filters
+	ExcludedObservationGap   = "observation_gap"    // the records of the patient have a gap, cf. ApplyObservationGapFilter
+)
+
+// Exclusion records that a patient was dropped from the analysis, with a reason code and details.
+type Exclusion struct {
+	PIDString string // the patient ID in the input
+	Reason    string // one of the Excluded... reason codes
+	Detail    string // details about the reason, e.g. which patient filter excluded the patient
+}
+
+// ExcludePatient records in a patient map that a patient is excluded from the analysis.
+func ExcludePatient(pMap *PatientMap, pidString, reason, detail string) {
+	pMap.Exclusions = append(pMap.Exclusions, Exclusion{PIDString: pidString, Reason: reason, Detail: detail})
+}
+
+// PrintExclusionsToCSVFile prints the patients that were excluded from the analysis to a CSV file, sorted by reason
+// and patient ID. Such an audit trail is required by ethics committees and journals. The header is:
+// PIDString,Reason,Detail. It also prints the number of excluded patients per reason.
+func PrintExclusionsToCSVFile(exclusions []Exclusion, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	sorted := append([]Exclusion{}, exclusions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Reason != sorted[j].Reason {
+			return sorted[i].Reason < sorted[j].Reason
+		}
+		return sorted[i].PIDString < sorted[j].PIDString
+	})
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"PIDString", "Reason", "Detail"}); err != nil {
+		panic(err)
+	}
+	counts := map[string]int{}
+	for _, e := range sorted {
+		counts[e.Reason]++
+		if err := w.Write([]string{e.PIDString, e.Reason, e.Detail}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+	utils.Info("Excluded ", len(sorted), " patients from the analysis: ", counts)
+}
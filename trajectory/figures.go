@@ -0,0 +1,299 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"math"
+	"ptra/utils"
+	"sort"
+	"strconv"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// A figure bundle of the top clusters of trajectories in PDF format, one page per cluster, so that the results can be
+// reviewed in meetings without any tooling. All sizes are in mm on an A4 landscape page.
+
+const (
+	figureMargin       = 10.0
+	figureGraphRadius  = 45.0
+	figureNodeRadius   = 1.8
+	figureNameLength   = 28
+	figureTrajectories = 5
+)
+
+// figureEdge is a transition between two diagnoses in the graph of a cluster.
+type figureEdge struct {
+	from, to int
+}
+
+// truncateName shortens a diagnosis name for the labels in the figures.
+func truncateName(name string, length int) string {
+	runes := []rune(name)
+	if len(runes) <= length {
+		return name
+	}
+	return string(runes[:length-1]) + "…"
+}
+
+// drawClusterGraph draws the trajectories of a cluster as a directed graph with the diagnoses on a circle around
+// (cx, cy), the same layout as the graphs of ptra serve. The edges are labeled with the number of patients and colored
+// by their EOI enrichment, cf. EOIEnrichmentColor.
+func drawClusterGraph(pdf *gofpdf.Fpdf, tr func(string) string, exp *Experiment, ts []*Trajectory, cx, cy float64) {
+	nodes := []int{}
+	nodeIndex := map[int]int{}
+	edges := []figureEdge{}
+	edgePatients := map[figureEdge]int{}
+	edgeEnrichments := map[figureEdge]float64{}
+	for _, t := range ts {
+		for _, d := range t.Diagnoses {
+			if _, ok := nodeIndex[d]; !ok {
+				nodeIndex[d] = len(nodes)
+				nodes = append(nodes, d)
+			}
+		}
+		enrichments := TransitionEOIEnrichments(exp, t)
+		for i := 0; i < len(t.Diagnoses)-1; i++ {
+			edge := figureEdge{from: t.Diagnoses[i], to: t.Diagnoses[i+1]}
+			if _, ok := edgePatients[edge]; !ok {
+				edges = append(edges, edge)
+				edgeEnrichments[edge] = math.NaN()
+			}
+			// transitions shared by several trajectories are drawn once, with the largest values
+			if t.PatientNumbers[i] > edgePatients[edge] {
+				edgePatients[edge] = t.PatientNumbers[i]
+			}
+			if e := enrichments[i]; !math.IsNaN(e) && (math.IsNaN(edgeEnrichments[edge]) || e > edgeEnrichments[edge]) {
+				edgeEnrichments[edge] = e
+			}
+		}
+	}
+	x := make([]float64, len(nodes))
+	y := make([]float64, len(nodes))
+	for i := range nodes {
+		angle := 2 * math.Pi * float64(i) / float64(len(nodes))
+		x[i] = cx + figureGraphRadius*math.Cos(angle)
+		y[i] = cy + figureGraphRadius*math.Sin(angle)
+	}
+	pdf.SetFont("Helvetica", "", 6)
+	pdf.SetLineWidth(0.4)
+	for _, edge := range edges {
+		x1, y1 := x[nodeIndex[edge.from]], y[nodeIndex[edge.from]]
+		x2, y2 := x[nodeIndex[edge.to]], y[nodeIndex[edge.to]]
+		l := math.Hypot(x2-x1, y2-y1)
+		if l == 0 {
+			continue
+		}
+		// stop the line at the border of the target node so the arrow head is visible
+		ux, uy := (x2-x1)/l, (y2-y1)/l
+		x2, y2 = x2-ux*figureNodeRadius, y2-uy*figureNodeRadius
+		c := [3]uint8{0x88, 0x88, 0x88}
+		if e := edgeEnrichments[edge]; !math.IsNaN(e) {
+			c = eoiEnrichmentRGB(e)
+		}
+		pdf.SetDrawColor(int(c[0]), int(c[1]), int(c[2]))
+		pdf.SetFillColor(int(c[0]), int(c[1]), int(c[2]))
+		pdf.Line(x1, y1, x2, y2)
+		pdf.Polygon([]gofpdf.PointType{{X: x2, Y: y2},
+			{X: x2 - 2*ux - uy, Y: y2 - 2*uy + ux}, {X: x2 - 2*ux + uy, Y: y2 - 2*uy - ux}}, "F")
+		pdf.SetTextColor(0x55, 0x55, 0x55)
+		pdf.Text((x1+x2)/2, (y1+y2)/2, strconv.Itoa(edgePatients[edge]))
+	}
+	pdf.SetFillColor(0x4a, 0x7e, 0xbb)
+	pdf.SetTextColor(0, 0, 0)
+	for i, d := range nodes {
+		pdf.Circle(x[i], y[i], figureNodeRadius, "F")
+		label := tr(truncateName(exp.NameMap[d], figureNameLength))
+		dx := 2 * figureNodeRadius
+		if x[i] < cx {
+			dx = -dx - pdf.GetStringWidth(label)
+		}
+		pdf.Text(x[i]+dx, y[i]+1, label)
+	}
+}
+
+// clusterSummary returns the rows of the summary table of a cluster of trajectories.
+func clusterSummary(exp *Experiment, ts []*Trajectory, curve []KMPoint, deaths int) [][2]string {
+	c := TrajectoryCoverage(ts)
+	patients, eoiPatients := CoveragePercentages(exp, c)
+	covered := map[int]*Patient{}
+	addCoveredPatients(ts, covered)
+	males := 0
+	for _, p := range covered {
+		if p.Sex == Male {
+			males++
+		}
+	}
+	meanAge, sdAge, meanAgeEOI, sdAgeEOI, _, _ := MetricsFromTrajectories(ts)
+	median := "not reached"
+	if deaths == 0 {
+		median = "NA"
+	} else if m, ok := KMMedian(curve); ok {
+		median = utils.FormatStat(m, 1) + " years"
+	}
+	rows := [][2]string{
+		{"Trajectories", strconv.Itoa(c.Trajectories)},
+		{"Patients", fmt.Sprintf("%d (%s%% of cohort)", c.Patients, utils.FormatStat(patients, 1))},
+		{"Patients with EOI", fmt.Sprintf("%d (%s%% of EOI patients)", c.EOIPatients, utils.FormatStat(eoiPatients, 1))},
+		{"Males / females", fmt.Sprintf("%d / %d", males, c.Patients-males)},
+		{"Age at last diagnosis", fmt.Sprintf("%s ± %s", utils.FormatStat(meanAge, 1), utils.FormatStat(sdAge, 1))},
+		{"Age at EOI", fmt.Sprintf("%s ± %s", utils.FormatStat(meanAgeEOI, 1), utils.FormatStat(sdAgeEOI, 1))},
+		{"Deaths after trajectory", strconv.Itoa(deaths)},
+		{"Median survival", median},
+	}
+	if exp.Literature != nil {
+		rows = append(rows, [2]string{"Known trajectories", knownTrajectories(exp.Literature, ts)})
+	}
+	return rows
+}
+
+// drawSummaryTable draws the summary table of a cluster with its top left corner at (x, y).
+func drawSummaryTable(pdf *gofpdf.Fpdf, tr func(string) string, rows [][2]string, x, y float64) {
+	pdf.SetTextColor(0, 0, 0)
+	pdf.SetDrawColor(0xbb, 0xbb, 0xbb)
+	pdf.SetLineWidth(0.2)
+	pdf.SetFillColor(0xee, 0xee, 0xee)
+	for i, row := range rows {
+		pdf.SetXY(x, y+float64(i)*6)
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.CellFormat(45, 6, tr(row[0]), "1", 0, "L", true, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(75, 6, tr(row[1]), "1", 0, "L", false, 0, "")
+	}
+}
+
+// drawKaplanMeier draws a Kaplan-Meier curve in a w x h box with its top left corner at (x, y), with the time in years
+// on the horizontal axis.
+func drawKaplanMeier(pdf *gofpdf.Fpdf, curve []KMPoint, maxTime, x, y, w, h float64) {
+	if maxTime <= 0 {
+		maxTime = 1
+	}
+	px := func(t float64) float64 { return x + w*t/maxTime }
+	py := func(s float64) float64 { return y + h*(1-s) }
+	pdf.SetDrawColor(0, 0, 0)
+	pdf.SetLineWidth(0.2)
+	pdf.Line(x, y, x, y+h)
+	pdf.Line(x, y+h, x+w, y+h)
+	pdf.SetFont("Helvetica", "", 7)
+	pdf.SetTextColor(0, 0, 0)
+	for _, s := range []float64{0, 0.5, 1} {
+		pdf.Line(x-1, py(s), x, py(s))
+		pdf.Text(x-7, py(s)+1, utils.FormatStat(s, 1))
+	}
+	for _, t := range []float64{0, maxTime / 2, maxTime} {
+		pdf.Line(px(t), y+h, px(t), y+h+1)
+		pdf.Text(px(t)-2, y+h+4, utils.FormatStat(t, 1))
+	}
+	pdf.Text(x+w/2-8, y+h+8, "Years after trajectory")
+	pdf.SetDrawColor(0xb2, 0x18, 0x2b)
+	pdf.SetLineWidth(0.4)
+	for i := 1; i < len(curve); i++ {
+		pdf.Line(px(curve[i-1].Time), py(curve[i-1].Survival), px(curve[i].Time), py(curve[i-1].Survival))
+		pdf.Line(px(curve[i].Time), py(curve[i-1].Survival), px(curve[i].Time), py(curve[i].Survival))
+	}
+	last := curve[len(curve)-1]
+	pdf.Line(px(last.Time), py(last.Survival), px(maxTime), py(last.Survival))
+}
+
+// PrintClusterFiguresToPDFFile writes a figure bundle for the top clusters of an experiment to a PDF file. The top
+// clusters are the first nofClusters cluster IDs, which for MCL clusterings are the largest clusters. Each cluster gets
+// one page with the graph of its trajectories, a summary table, the Kaplan-Meier curve of the survival of its patients
+// after completing a trajectory if any of them died, cf. SurvivalAfterTrajectories, and its largest trajectories. With
+// literature annotations, cf. AnnotateLiterature, the summary table counts the known trajectories, and the known
+// trajectories among the largest ones are marked.
+func PrintClusterFiguresToPDFFile(exp *Experiment, name string, nofClusters int) {
+	clusters := CollectClusters(exp)
+	cids := []int{}
+	for cid := range clusters {
+		cids = append(cids, cid)
+	}
+	sort.Ints(cids)
+	if len(cids) > nofClusters {
+		cids = cids[:nofClusters]
+	}
+	pdf := gofpdf.New("L", "mm", "A4", "")
+	pdf.SetAutoPageBreak(false, figureMargin)
+	pdf.SetTitle(fmt.Sprintf("%s: top clusters", exp.Name), true)
+	pdf.SetCreator("ptra", false)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pageWidth, pageHeight := pdf.GetPageSize()
+	for rank, cid := range cids {
+		ts := clusters[cid]
+		pdf.AddPage()
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.SetTextColor(0, 0, 0)
+		pdf.Text(figureMargin, figureMargin+5, tr(fmt.Sprintf("%s - cluster %d (%d of %d)", exp.Name, cid, rank+1,
+			len(cids))))
+		drawClusterGraph(pdf, tr, exp, ts, figureMargin+75, 85)
+		times, events, deaths := SurvivalAfterTrajectories(ts)
+		curve := KaplanMeier(times, events)
+		right := pageWidth - figureMargin - 120
+		drawSummaryTable(pdf, tr, clusterSummary(exp, ts, curve, deaths), right, 25)
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.Text(right, 85, "Survival after trajectory (Kaplan-Meier)")
+		if deaths == 0 {
+			pdf.SetFont("Helvetica", "I", 9)
+			pdf.Text(right, 95, "No survival data available.")
+		} else {
+			maxTime := 0.0
+			for _, t := range times {
+				maxTime = math.Max(maxTime, t)
+			}
+			drawKaplanMeier(pdf, curve, maxTime, right+10, 90, 105, 50)
+		}
+		// the largest trajectories of the cluster
+		sorted := append([]*Trajectory{}, ts...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].PatientNumbers[len(sorted[i].PatientNumbers)-1] >
+				sorted[j].PatientNumbers[len(sorted[j].PatientNumbers)-1]
+		})
+		if len(sorted) > figureTrajectories {
+			sorted = sorted[:figureTrajectories]
+		}
+		y := pageHeight - figureMargin - 6*float64(len(sorted))
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.Text(figureMargin, y-3, "Largest trajectories")
+		pdf.SetFont("Helvetica", "", 8)
+		for _, t := range sorted {
+			names := ""
+			for i, d := range t.Diagnoses {
+				if i > 0 {
+					names += " -> "
+				}
+				names += truncateName(exp.NameMap[d], figureNameLength)
+			}
+			if len(exp.Literature[t]) > 0 {
+				names = "[known] " + names
+			}
+			pdf.SetXY(figureMargin, y)
+			pdf.CellFormat(pageWidth-2*figureMargin, 5, tr(fmt.Sprintf("%s (%d patients)", names,
+				t.PatientNumbers[len(t.PatientNumbers)-1])), "", 0, "L", false, 0, "")
+			y += 6
+		}
+	}
+	if len(cids) == 0 {
+		pdf.AddPage()
+		pdf.SetFont("Helvetica", "", 12)
+		pdf.Text(figureMargin, figureMargin+5, tr(fmt.Sprintf("%s: no clusters", exp.Name)))
+	}
+	if err := pdf.OutputFileAndClose(name); err != nil {
+		panic(err)
+	}
+}
@@ -18,48 +18,75 @@
 
 package trajectory
 
+import "fmt"
+
 // PatientFilter prescribes a function type for implementing filters on TriNetX patients, to be able to calculate
 // trajectories for specific cohorts. E.g. male patients, patients <70 years, patients with specific cancer stage, etc.
 type PatientFilter func(patient *Patient) bool
 
 // TrajectoryFilter is a type to define a trajectory filter function. Such filters take as input a trajectory and must
-// return a bool as output that determines if a trajectory passes a filter or not.
+// return a bool as output that determines if a trajectory passes a filter or not. With a maximum number of trajectories,
+// cf. Experiment.MaxTrajectories, the filters are already applied while building the trajectories in parallel.
 type TrajectoryFilter func(t *Trajectory) bool
 
+// ApplyPatientFilter returns a patient map with the patients that pass the given filter. The patients that do not pass
+// the filter are recorded as exclusions.
 func ApplyPatientFilter(filter PatientFilter, pMap *PatientMap) *PatientMap {
-	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr}
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		Exclusions: pMap.Exclusions}
 	for pid, p := range pMap.PIDMap {
-		if filter(p) {
-			newPMap.PIDStringMap[p.PIDString] = pid
-			newPMap.PIDMap[pid] = p
-			if p.Sex == Male {
-				newPMap.MaleCtr++
-			} else {
-				newPMap.FemaleCtr++
-			}
+		if !filter(p) {
+			ExcludePatient(newPMap, p.PIDString, ExcludedByPatientFilter, "")
+		} else {
+			keepPatient(newPMap, pid, p)
 		}
 	}
 	return newPMap
 }
 
+// ExcludePatientsWithoutDiagnoses returns a patient map with the patients that have at least one diagnosis that
+// qualifies for the analysis, i.e. that is not excluded while parsing the diagnoses. The other patients are recorded as
+// exclusions, since they cannot contribute to any trajectory.
+func ExcludePatientsWithoutDiagnoses(pMap *PatientMap) *PatientMap {
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		Exclusions: pMap.Exclusions}
+	for pid, p := range pMap.PIDMap {
+		if len(p.Diagnoses) == 0 {
+			ExcludePatient(newPMap, p.PIDString, ExcludedNoDiagnoses, "")
+		} else {
+			keepPatient(newPMap, pid, p)
+		}
+	}
+	return newPMap
+}
+
+// keepPatient adds a patient that passes a filter to the patient map of the filtered patients.
+func keepPatient(pMap *PatientMap, pid int, p *Patient) {
+	pMap.PIDStringMap[p.PIDString] = pid
+	pMap.PIDMap[pid] = p
+	if p.Sex == Male {
+		pMap.MaleCtr++
+	} else {
+		pMap.FemaleCtr++
+	}
+}
+
+// ApplyPatientFilters returns a patient map with the patients that pass all given filters. The patients that do not pass
+// a filter are recorded as exclusions, with the position of the first filter they fail as detail, e.g. "pfilter 2".
 func ApplyPatientFilters(filters []PatientFilter, pMap *PatientMap) *PatientMap {
-	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr}
+	newPMap := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}, Ctr: pMap.Ctr,
+		Exclusions: pMap.Exclusions}
 	for pid, p := range pMap.PIDMap {
 		res := true
-		for _, filter := range filters {
+		for i, filter := range filters {
 			res = filter(p) && res
 			if !res {
+				ExcludePatient(newPMap, p.PIDString, ExcludedByPatientFilter, fmt.Sprint("pfilter ", i+1))
 				break
 			}
 		}
 		if res {
-			newPMap.PIDStringMap[p.PIDString] = pid
-			newPMap.PIDMap[pid] = p
-			if p.Sex == Male {
-				newPMap.MaleCtr++
-			} else {
-				newPMap.FemaleCtr++
-			}
+			keepPatient(newPMap, pid, p)
 		}
 	}
 	return newPMap
@@ -153,6 +180,23 @@ func ageAboveAggregator(age int) PatientFilter {
 	}
 }
 
+// AgeWindowFilter restricts the analysis to age-time: it removes all diagnoses a patient gets before minAge or at
+// maxAge and later, cf. PatientAge. Patients without diagnoses in the age window are removed. Contrary to the
+// calendar-based age filters, the window is applied to the age at each diagnosis, which suits congenital and pediatric
+// cohorts, e.g. AgeWindowFilter(0, 18).
+func AgeWindowFilter(minAge, maxAge float64) PatientFilter {
+	return func(p *Patient) bool {
+		newD := []*Diagnosis{}
+		for _, d := range p.Diagnoses {
+			if age := PatientAge(p, d.Date); age >= minAge && age < maxAge {
+				newD = append(newD, d)
+			}
+		}
+		p.Diagnoses = newD
+		return len(newD) > 0
+	}
+}
+
 // LessThanSeventyAggregator collects all patients below a specific age.
 func LessThanSeventyAggregator() PatientFilter {
 	return ageLessAggregator(70)
@@ -0,0 +1,126 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format versions of the text files that ptra writes and loads again
+
+// TextFormat is the kind and version of a text file that ptra writes and loads again, e.g. the trajectories tab file
+// or a saved RR matrix. Such a file starts with a line # ptra kind format version. When a file is loaded, the line is
+// checked, so that a file of another kind, or a file written by a newer ptra version with an incompatible format, is
+// rejected with a clear error instead of being misread. Files without the line were written by ptra versions before
+// the format versions were introduced, and are read as version 0, which has the same format as version 1.
+type TextFormat struct {
+	Kind    string
+	Version int
+}
+
+var (
+	// TrajectoriesFormat is the format of the trajectories tab file, cf. PrintTrajectoriesToFile.
+	TrajectoriesFormat = TextFormat{Kind: "trajectories", Version: 1}
+	// ClusteredTrajectoriesFormat is the format of the clustered trajectories tab file, cf.
+	// PrintClusteredTrajectoriesToFile.
+	ClusteredTrajectoriesFormat = TextFormat{Kind: "clustered-trajectories", Version: 1}
+	// PairsFormat is the format of the pairs tab file, cf. PrintTrajectoriesToFile. Version 2 added the directions of
+	// the pairs.
+	PairsFormat = TextFormat{Kind: "pairs", Version: 2}
+	// RRMatrixFormat is the format of a saved RR matrix, cf. SaveRRMatrix.
+	RRMatrixFormat = TextFormat{Kind: "rr-matrix", Version: 1}
+	// DxDPatientsFormat is the format of the saved patients of the diagnosis pairs, cf. SaveDxDPatients.
+	DxDPatientsFormat = TextFormat{Kind: "dxd-patients", Version: 1}
+)
+
+// formatLinePrefix starts the line with the kind and version of a text file.
+const formatLinePrefix = "# ptra "
+
+// WriteHeader writes the line with the kind and version of a text file.
+func (f TextFormat) WriteHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s%s format %d\n", formatLinePrefix, f.Kind, f.Version)
+	return err
+}
+
+// CheckFormatVersion checks that a file with the given kind and format version can be read by a reader for the
+// supported version of the same kind. Version 0 is a file without format version. A newer version asks to upgrade ptra.
+func CheckFormatVersion(name, kind string, version int, supportedKind string, supported int) error {
+	if kind != supportedKind {
+		return fmt.Errorf("%s is a %s file, expected a %s file", name, kind, supportedKind)
+	}
+	if version < 0 {
+		return fmt.Errorf("%s has an invalid %s format version %d", name, kind, version)
+	}
+	if version > supported {
+		return fmt.Errorf("%s has %s format version %d, which was written by a newer ptra version; this ptra version "+
+			"reads up to version %d, please upgrade ptra to load it", name, kind, version, supported)
+	}
+	return nil
+}
+
+// checkHeader checks the first line of a text file. It returns false if the line is not a format line, i.e. the file
+// has no format version.
+func (f TextFormat) checkHeader(name, line string) (bool, error) {
+	if !strings.HasPrefix(line, formatLinePrefix) {
+		return false, nil
+	}
+	fields := strings.Fields(strings.TrimPrefix(line, formatLinePrefix))
+	if len(fields) != 3 || fields[1] != "format" {
+		return true, fmt.Errorf("%s: invalid format line %q", name, line)
+	}
+	version, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return true, fmt.Errorf("%s: invalid format line %q", name, line)
+	}
+	return true, CheckFormatVersion(name, fields[0], version, f.Kind, f.Version)
+}
+
+// readLines reads the non-empty lines of a text file of this format, cf. readLines, without the format line.
+func (f TextFormat) readLines(name string) ([]string, error) {
+	lines, err := readLines(name)
+	if err != nil || len(lines) == 0 {
+		return lines, err
+	}
+	header, err := f.checkHeader(name, lines[0])
+	if err != nil {
+		return nil, err
+	}
+	if header {
+		return lines[1:], nil
+	}
+	return lines, nil
+}
+
+// skipHeader checks and skips the format line of a text file of this format, if it has one.
+func (f TextFormat) skipHeader(name string, r *bufio.Reader) error {
+	prefix, err := r.Peek(len(formatLinePrefix))
+	if err != nil || string(prefix) != formatLinePrefix {
+		// files without a format line, including empty files
+		return nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = f.checkHeader(name, strings.TrimRight(line, "\r\n"))
+	return err
+}
@@ -0,0 +1,246 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Reading graphs back from GML files, e.g. cluster graphs that were curated in Cytoscape or yEd.
+
+// gmlValue is the value of a key in a GML file: a number or a string, or a nested list of key-value pairs.
+type gmlValue struct {
+	scalar string
+	list   []gmlPair
+}
+
+// gmlPair is a key-value pair in a GML file.
+type gmlPair struct {
+	key   string
+	value gmlValue
+}
+
+// tokenizeGML splits the content of a GML file into tokens: keys, numbers, strings with their quotes, and brackets.
+// Comments, i.e. lines starting with #, are skipped.
+func tokenizeGML(content string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(content); {
+		switch c := content[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#' && (i == 0 || content[i-1] == '\n'):
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case c == '[' || c == ']':
+			tokens = append(tokens, content[i:i+1])
+			i++
+		case c == '"':
+			end := strings.IndexByte(content[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, content[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(content) && !unicode.IsSpace(rune(content[i])) && content[i] != '[' && content[i] != ']' {
+				i++
+			}
+			tokens = append(tokens, content[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// parseGMLList parses the key-value pairs of a GML list, starting at position i of the tokens, up to the closing
+// bracket if nested is true, or up to the end of the tokens otherwise. It returns the pairs and the position after the
+// list.
+func parseGMLList(tokens []string, i int, nested bool) ([]gmlPair, int, error) {
+	pairs := []gmlPair{}
+	for i < len(tokens) {
+		if tokens[i] == "]" {
+			if !nested {
+				return nil, i, fmt.Errorf("unexpected ]")
+			}
+			return pairs, i + 1, nil
+		}
+		if i+1 >= len(tokens) {
+			return nil, i, fmt.Errorf("key %s without a value", tokens[i])
+		}
+		pair := gmlPair{key: tokens[i]}
+		if tokens[i+1] == "[" {
+			list, next, err := parseGMLList(tokens, i+2, true)
+			if err != nil {
+				return nil, next, err
+			}
+			pair.value.list, i = list, next
+		} else {
+			pair.value.scalar, i = tokens[i+1], i+2
+		}
+		pairs = append(pairs, pair)
+	}
+	if nested {
+		return nil, i, fmt.Errorf("missing ]")
+	}
+	return pairs, i, nil
+}
+
+// gmlScalar returns the value of the first occurrence of a key with a number or a string as value in a GML list.
+// Strings are unquoted, and their character entities are decoded.
+func gmlScalar(pairs []gmlPair, key string) (string, bool) {
+	for _, pair := range pairs {
+		if pair.key == key && pair.value.list == nil {
+			if s := pair.value.scalar; len(s) >= 2 && s[0] == '"' {
+				return html.UnescapeString(s[1 : len(s)-1]), true
+			}
+			return pair.value.scalar, true
+		}
+	}
+	return "", false
+}
+
+// gmlInt returns the value of the first occurrence of a key with an integer as value in a GML list.
+func gmlInt(pairs []gmlPair, key string) (int, bool) {
+	s, ok := gmlScalar(pairs, key)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// gmlClusterID returns the cluster ID of a graph, from its comment or label "cluster <cid>" as written by the
+// clustering. It returns false if the graph has no cluster ID.
+func gmlClusterID(graph []gmlPair) (int, bool) {
+	for _, key := range []string{"comment", "label"} {
+		if s, ok := gmlScalar(graph, key); ok {
+			var cid int
+			if _, err := fmt.Sscanf(s, "cluster %d", &cid); err == nil {
+				return cid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ReadClusterGraphsFromGMLFile reads the graphs of a GML file, e.g. cluster graphs written by the clustering that were
+// curated in Cytoscape or yEd, so that the curated graphs can be exported to other formats. Each edge of a graph is
+// returned as a trajectory of two diagnoses, with the edge's patients attribute as patient number, or its label when it
+// has no patients attribute. The cluster of a trajectory is taken from the comment or label "cluster <cid>" of its
+// graph, from the file name cluster-<cid>.gml of split graphs, or else it is the position of the graph in the file.
+// The diagnoses are identified by the labels of the nodes, since editors may renumber the nodes, and new diagnosis IDs
+// are assigned to the labels. It returns the trajectories, a name map from those diagnosis IDs to the labels, and the
+// RRs of the edges with an rr attribute keyed by the labels of the pairs, or nil if no edge has an rr attribute.
+// Nodes without edges are left out.
+func ReadClusterGraphsFromGMLFile(name string) ([]*Trajectory, map[int]string, map[[2]string]float64, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tokens, err := tokenizeGML(string(content))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	pairs, _, err := parseGMLList(tokens, 0, false)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	graphs := [][]gmlPair{}
+	for _, pair := range pairs {
+		if pair.key == "graph" && pair.value.list != nil {
+			graphs = append(graphs, pair.value.list)
+		}
+	}
+	if len(graphs) == 0 {
+		return nil, nil, nil, fmt.Errorf("%s: no graphs", name)
+	}
+	fileCID := -1
+	if len(graphs) == 1 {
+		fmt.Sscanf(filepath.Base(name), "cluster-%d.gml", &fileCID)
+	}
+	index := newNameIndex()
+	trajectories := []*Trajectory{}
+	var rrs map[[2]string]float64
+	for g, graph := range graphs {
+		cid, ok := gmlClusterID(graph)
+		if !ok {
+			cid = g
+			if fileCID >= 0 {
+				cid = fileCID
+			}
+		}
+		labels := map[string]string{}
+		for _, pair := range graph {
+			if pair.key != "node" {
+				continue
+			}
+			id, ok := gmlScalar(pair.value.list, "id")
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("%s: graph %d: node without an id", name, g)
+			}
+			label, ok := gmlScalar(pair.value.list, "label")
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("%s: graph %d: node %s without a label", name, g, id)
+			}
+			labels[id] = label
+		}
+		for _, pair := range graph {
+			if pair.key != "edge" {
+				continue
+			}
+			edge := pair.value.list
+			source, _ := gmlScalar(edge, "source")
+			target, _ := gmlScalar(edge, "target")
+			from, ok1 := labels[source]
+			to, ok2 := labels[target]
+			if !ok1 || !ok2 {
+				return nil, nil, nil, fmt.Errorf("%s: graph %d: edge from %s to %s between unknown nodes", name, g,
+					source, target)
+			}
+			patients, ok := gmlInt(edge, "patients")
+			if !ok {
+				if patients, ok = gmlInt(edge, "label"); !ok {
+					return nil, nil, nil, fmt.Errorf("%s: graph %d: edge from %s to %s without a patient number",
+						name, g, from, to)
+				}
+			}
+			if s, ok := gmlScalar(edge, "rr"); ok {
+				rr, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("%s: graph %d: edge from %s to %s: %v", name, g, from, to, err)
+				}
+				if rrs == nil {
+					rrs = map[[2]string]float64{}
+				}
+				if old, ok := rrs[[2]string{from, to}]; !ok || rr > old {
+					rrs[[2]string{from, to}] = rr
+				}
+			}
+			trajectories = append(trajectories, &Trajectory{Diagnoses: []int{index.id(from), index.id(to)},
+				PatientNumbers: []int{patients}, ID: len(trajectories), Cluster: cid})
+		}
+	}
+	return trajectories, index.nameMap, rrs, nil
+}
@@ -0,0 +1,104 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"ptra/utils"
+	"strconv"
+)
+
+// Restricting the trajectories to incident index cases. A patient whose first recorded diagnosis of the index
+// diagnosis of a trajectory, i.e. its first diagnosis, falls early in the patient's records may have had the diagnosis
+// before the records start, so that the trajectory describes the follow-up of a prevalent case rather than the onset of
+// the disease. With a look-back, the index diagnosis of a patient is only incident if the patient has records for at
+// least the look-back period before it, without an earlier occurrence of the diagnosis.
+
+// IndexCases counts the patients of the diagnosis pairs that start with an index diagnosis whose first diagnosis of it
+// is incident or prevalent, cf. Experiment.IncidentLookback.
+type IndexCases struct {
+	Diagnosis, Incident, Prevalent int
+}
+
+// incidentIndexCase returns whether the first diagnosis of a patient with did is incident, i.e. whether the patient
+// has records for at least lookback years before it. The patient must have the diagnosis.
+func incidentIndexCase(p *Patient, did int, lookback float64) bool {
+	for _, d := range p.Diagnoses {
+		if d.DID == did {
+			return DiagnosisDateToFloat(d.Date)-DiagnosisDateToFloat(p.Diagnoses[0].Date) >= lookback
+		}
+	}
+	return false
+}
+
+// incidentPatients returns the patients whose first diagnosis with did is incident, cf. incidentIndexCase.
+func incidentPatients(patients []*Patient, did int, lookback float64) []*Patient {
+	incident := []*Patient{}
+	for _, p := range patients {
+		if incidentIndexCase(p, did, lookback) {
+			incident = append(incident, p)
+		}
+	}
+	return incident
+}
+
+// countIndexCases counts for each index diagnosis of the given diagnosis pairs the patients of the pairs whose first
+// diagnosis with the index diagnosis is incident or prevalent, with the look-back of the experiment, and stores them in
+// exp.IndexCases, sorted by diagnosis ID.
+func countIndexCases(exp *Experiment, pairs []*Pair) {
+	patients := map[int]utils.Set[*Patient]{}
+	for _, pair := range pairs {
+		if patients[pair.First] == nil {
+			patients[pair.First] = utils.Set[*Patient]{}
+		}
+		for _, p := range exp.DxDPatients[pair.First][pair.Second] {
+			patients[pair.First].Add(p)
+		}
+	}
+	exp.IndexCases = nil
+	incident, prevalent := 0, 0
+	for _, did := range utils.SortedKeys(patients) {
+		cases := IndexCases{Diagnosis: did}
+		for p := range patients[did] {
+			if incidentIndexCase(p, did, exp.IncidentLookback) {
+				cases.Incident++
+			} else {
+				cases.Prevalent++
+			}
+		}
+		incident += cases.Incident
+		prevalent += cases.Prevalent
+		exp.IndexCases = append(exp.IndexCases, cases)
+	}
+	utils.Info("Restricting the trajectories to incident index cases with a look-back of ", exp.IncidentLookback,
+		" years: ", incident, " incident and ", prevalent, " prevalent index cases.")
+}
+
+// PrintIndexCasesToCSVFile prints the numbers of incident and prevalent patients per index diagnosis, cf.
+// Experiment.IndexCases, to a csv file. The header is DID,Name,Incident,Prevalent,Incident%.
+func PrintIndexCasesToCSVFile(exp *Experiment, name string) {
+	records := [][]string{}
+	for _, cases := range exp.IndexCases {
+		percentage := 0.0
+		if total := cases.Incident + cases.Prevalent; total > 0 {
+			percentage = 100 * float64(cases.Incident) / float64(total)
+		}
+		records = append(records, []string{strconv.Itoa(cases.Diagnosis), exp.NameMap[cases.Diagnosis],
+			strconv.Itoa(cases.Incident), strconv.Itoa(cases.Prevalent), strconv.FormatFloat(percentage, 'f', 2, 64)})
+	}
+	writeCSVFile(name, []string{"DID", "Name", "Incident", "Prevalent", "Incident%"}, records)
+}
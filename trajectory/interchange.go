@@ -0,0 +1,555 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"ptra/utils"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The .ptra interchange format is a compact binary container for the trajectories, clusters, and metadata of a run,
+// to exchange results between the ptra subcommands and external tools. A .ptra file is a Zstandard stream of protobuf
+// messages, each preceded by its length as a varint, as written by writeDelimitedTo in the protobuf libraries. The
+// first message is a Header, followed by a Trajectory message per trajectory. The messages are defined in ptra.proto,
+// so that external tools can generate their readers with protoc. Readers skip unknown fields, so that fields can be
+// added without changing the format version, which is only incremented for incompatible changes.
+
+// PtraFormatVersion is the version of the .ptra format written by WritePtra.
+const PtraFormatVersion = 1
+
+// maxPtraMessageSize is the maximum size of a message of a .ptra file, so that a corrupt length does not make ReadPtra
+// allocate more memory than the file can possibly need. The largest message is the header, with the diagnoses.
+const maxPtraMessageSize = 1 << 28
+
+// The field numbers of the messages, cf. ptra.proto.
+const (
+	ptraHeaderFormatVersion   protowire.Number = 1
+	ptraHeaderName            protowire.Number = 2
+	ptraHeaderDiagnosis       protowire.Number = 3
+	ptraHeaderMetadata        protowire.Number = 4
+	ptraHeaderTrajectoryCount protowire.Number = 5
+	ptraHeaderClustered       protowire.Number = 6
+
+	ptraDiagnosisID        protowire.Number = 1
+	ptraDiagnosisCode      protowire.Number = 2
+	ptraDiagnosisName      protowire.Number = 3
+	ptraDiagnosisHierarchy protowire.Number = 4
+
+	ptraMetadataKey   protowire.Number = 1
+	ptraMetadataValue protowire.Number = 2
+
+	ptraTrajectoryID             protowire.Number = 1
+	ptraTrajectoryDiagnoses      protowire.Number = 2
+	ptraTrajectoryPatientNumbers protowire.Number = 3
+	ptraTrajectoryRR             protowire.Number = 4
+	ptraTrajectoryCluster        protowire.Number = 5
+	ptraTrajectoryMemberships    protowire.Number = 6
+	ptraTrajectoryEOIEnrichment  protowire.Number = 7
+
+	ptraMembershipCluster protowire.Number = 1
+	ptraMembershipWeight  protowire.Number = 2
+)
+
+// PtraHeader contains the information of a .ptra file that is not part of the experiment.
+type PtraHeader struct {
+	FormatVersion   int
+	Metadata        map[string]string
+	NofTrajectories int
+	Clustered       bool // whether the trajectories carry a clustering
+}
+
+// appendVarintField appends a varint field. Signed values are encoded as in the int32 type of protobuf.
+func appendVarintField(b []byte, num protowire.Number, v int) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(int64(v)))
+}
+
+// appendBytesField appends a length-delimited field, e.g. a string or an embedded message.
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendPackedVarints appends a packed repeated int32 or uint32 field.
+func appendPackedVarints(b []byte, num protowire.Number, vs []int) []byte {
+	packed := []byte{}
+	for _, v := range vs {
+		packed = protowire.AppendVarint(packed, uint64(int64(v)))
+	}
+	return appendBytesField(b, num, packed)
+}
+
+// appendPackedDoubles appends a packed repeated double field.
+func appendPackedDoubles(b []byte, num protowire.Number, vs []float64) []byte {
+	packed := []byte{}
+	for _, v := range vs {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(v))
+	}
+	return appendBytesField(b, num, packed)
+}
+
+// appendPtraHeader appends the Header message of an experiment.
+func appendPtraHeader(b []byte, exp *Experiment, clustered bool, metadata map[string]string) []byte {
+	b = appendVarintField(b, ptraHeaderFormatVersion, PtraFormatVersion)
+	b = appendBytesField(b, ptraHeaderName, []byte(exp.Name))
+	dids := []int{}
+	for did := range exp.NameMap {
+		dids = append(dids, did)
+	}
+	sort.Ints(dids)
+	for _, did := range dids {
+		d := appendVarintField(nil, ptraDiagnosisID, did)
+		d = appendBytesField(d, ptraDiagnosisCode, []byte(exp.IdMap[did]))
+		d = appendBytesField(d, ptraDiagnosisName, []byte(exp.NameMap[did]))
+		for _, category := range exp.Hierarchy[did] {
+			d = appendBytesField(d, ptraDiagnosisHierarchy, []byte(category))
+		}
+		b = appendBytesField(b, ptraHeaderDiagnosis, d)
+	}
+	keys := []string{}
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := appendBytesField(nil, ptraMetadataKey, []byte(key))
+		entry = appendBytesField(entry, ptraMetadataValue, []byte(metadata[key]))
+		b = appendBytesField(b, ptraHeaderMetadata, entry)
+	}
+	b = appendVarintField(b, ptraHeaderTrajectoryCount, len(exp.Trajectories))
+	if clustered {
+		b = appendVarintField(b, ptraHeaderClustered, 1)
+	}
+	return b
+}
+
+// transitionRRs returns the RR of each transition of a trajectory, or NaN if the RR is not known.
+func transitionRRs(exp *Experiment, t *Trajectory) []float64 {
+	rrs := []float64{}
+	for i := 1; i < len(t.Diagnoses); i++ {
+		d1, d2 := t.Diagnoses[i-1], t.Diagnoses[i]
+		if d1 < len(exp.DxDRR) && d2 < len(exp.DxDRR[d1]) {
+			rrs = append(rrs, exp.DxDRR[d1][d2])
+		} else {
+			rrs = append(rrs, math.NaN())
+		}
+	}
+	return rrs
+}
+
+// knownValues checks if a list of values contains a value that is not NaN.
+func knownValues(fs []float64) bool {
+	for _, f := range fs {
+		if !math.IsNaN(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendPtraTrajectory appends the Trajectory message of a trajectory.
+func appendPtraTrajectory(b []byte, exp *Experiment, id int, t *Trajectory, clustered bool) []byte {
+	b = appendVarintField(b, ptraTrajectoryID, id)
+	b = appendPackedVarints(b, ptraTrajectoryDiagnoses, t.Diagnoses)
+	b = appendPackedVarints(b, ptraTrajectoryPatientNumbers, t.PatientNumbers)
+	b = appendPackedDoubles(b, ptraTrajectoryRR, transitionRRs(exp, t))
+	if enrichments := TransitionEOIEnrichments(exp, t); knownValues(enrichments) {
+		b = appendPackedDoubles(b, ptraTrajectoryEOIEnrichment, enrichments)
+	}
+	if clustered {
+		b = appendVarintField(b, ptraTrajectoryCluster, t.Cluster)
+		for _, m := range t.Memberships {
+			membership := appendVarintField(nil, ptraMembershipCluster, m.Cluster)
+			membership = protowire.AppendTag(membership, ptraMembershipWeight, protowire.Fixed64Type)
+			membership = protowire.AppendFixed64(membership, math.Float64bits(m.Weight))
+			b = appendBytesField(b, ptraTrajectoryMemberships, membership)
+		}
+	}
+	return b
+}
+
+// WritePtra writes the trajectories of an experiment in the .ptra format, together with the given metadata. The
+// clusters of the trajectories are only written if clustered is set. The trajectory IDs are their positions in
+// exp.Trajectories.
+func WritePtra(w io.Writer, exp *Experiment, clustered bool, metadata map[string]string) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	writeMessage := func(message []byte) error {
+		_, err := zw.Write(protowire.AppendBytes(nil, message))
+		return err
+	}
+	if err := writeMessage(appendPtraHeader(nil, exp, clustered, metadata)); err != nil {
+		zw.Close()
+		return err
+	}
+	for i, t := range exp.Trajectories {
+		if err := writeMessage(appendPtraTrajectory(nil, exp, i, t, clustered)); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// WritePtraFile writes the trajectories of an experiment to a .ptra file, cf. WritePtra.
+func WritePtraFile(name string, exp *Experiment, clustered bool, metadata map[string]string) error {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		return err
+	}
+	if err := WritePtra(file, exp, clustered, metadata); err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return file.Close()
+}
+
+// forEachField calls f for each field of a protobuf message, with the encoded value of the field.
+func forEachField(b []byte, f func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := f(num, typ, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// varintValue decodes the value of a varint field. Signed values are decoded as in the int32 type of protobuf.
+func varintValue(typ protowire.Type, value []byte) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, errors.New("expected a varint field")
+	}
+	v, _ := protowire.ConsumeVarint(value)
+	return int(int32(v)), nil
+}
+
+// bytesValue decodes the value of a length-delimited field.
+func bytesValue(typ protowire.Type, value []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, errors.New("expected a length-delimited field")
+	}
+	v, _ := protowire.ConsumeBytes(value)
+	return v, nil
+}
+
+// repeatedVarints decodes the values of a repeated int32 or uint32 field, which may or may not be packed.
+func repeatedVarints(typ protowire.Type, value []byte) ([]int, error) {
+	if typ == protowire.VarintType {
+		v, err := varintValue(typ, value)
+		return []int{v}, err
+	}
+	packed, err := bytesValue(typ, value)
+	if err != nil {
+		return nil, err
+	}
+	vs := []int{}
+	for len(packed) > 0 {
+		v, n := protowire.ConsumeVarint(packed)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		vs = append(vs, int(int32(v)))
+		packed = packed[n:]
+	}
+	return vs, nil
+}
+
+// repeatedDoubles decodes the values of a repeated double field, which may or may not be packed.
+func repeatedDoubles(typ protowire.Type, value []byte) ([]float64, error) {
+	if typ == protowire.Fixed64Type {
+		v, _ := protowire.ConsumeFixed64(value)
+		return []float64{math.Float64frombits(v)}, nil
+	}
+	packed, err := bytesValue(typ, value)
+	if err != nil {
+		return nil, err
+	}
+	vs := []float64{}
+	for len(packed) > 0 {
+		v, n := protowire.ConsumeFixed64(packed)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		vs = append(vs, math.Float64frombits(v))
+		packed = packed[n:]
+	}
+	return vs, nil
+}
+
+// parsePtraDiagnosis parses a Diagnosis message into the maps of an experiment. The NofDiagnosisCodes of the
+// experiment is set by parsePtraHeader, once all diagnoses are parsed.
+func parsePtraDiagnosis(b []byte, exp *Experiment) error {
+	var id int
+	var code, name string
+	hierarchy := []string{}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) (err error) {
+		var v []byte
+		switch num {
+		case ptraDiagnosisID:
+			id, err = varintValue(typ, value)
+		case ptraDiagnosisCode:
+			v, err = bytesValue(typ, value)
+			code = string(v)
+		case ptraDiagnosisName:
+			v, err = bytesValue(typ, value)
+			name = string(v)
+		case ptraDiagnosisHierarchy:
+			v, err = bytesValue(typ, value)
+			hierarchy = append(hierarchy, string(v))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if id < 0 {
+		return fmt.Errorf("invalid diagnosis ID %d", id)
+	}
+	if _, ok := exp.NameMap[id]; ok {
+		return fmt.Errorf("duplicate diagnosis ID %d", id)
+	}
+	exp.NameMap[id] = name
+	exp.IdMap[id] = code
+	if len(hierarchy) > 0 {
+		exp.Hierarchy[id] = hierarchy
+	}
+	return nil
+}
+
+// parsePtraHeader parses a Header message into an experiment and a PtraHeader.
+func parsePtraHeader(b []byte) (*Experiment, *PtraHeader, error) {
+	exp := &Experiment{NameMap: map[int]string{}, IdMap: map[int]string{}, Hierarchy: map[int][]string{}}
+	header := &PtraHeader{Metadata: map[string]string{}}
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) (err error) {
+		var v []byte
+		switch num {
+		case ptraHeaderFormatVersion:
+			header.FormatVersion, err = varintValue(typ, value)
+		case ptraHeaderName:
+			v, err = bytesValue(typ, value)
+			exp.Name = string(v)
+		case ptraHeaderDiagnosis:
+			if v, err = bytesValue(typ, value); err == nil {
+				err = parsePtraDiagnosis(v, exp)
+			}
+		case ptraHeaderMetadata:
+			if v, err = bytesValue(typ, value); err == nil {
+				var key, val []byte
+				err = forEachField(v, func(num protowire.Number, typ protowire.Type, value []byte) (err error) {
+					switch num {
+					case ptraMetadataKey:
+						key, err = bytesValue(typ, value)
+					case ptraMetadataValue:
+						val, err = bytesValue(typ, value)
+					}
+					return err
+				})
+				header.Metadata[string(key)] = string(val)
+			}
+		case ptraHeaderTrajectoryCount:
+			header.NofTrajectories, err = varintValue(typ, value)
+		case ptraHeaderClustered:
+			var clustered int
+			clustered, err = varintValue(typ, value)
+			header.Clustered = clustered != 0
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.FormatVersion < 1 || header.FormatVersion > PtraFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported .ptra format version %d, this ptra version reads up to version %d; "+
+			"files of a newer version require upgrading ptra", header.FormatVersion, PtraFormatVersion)
+	}
+	// the diagnosis IDs are 0 up to the number of diagnoses, so that the size of the diagnosis matrices is bounded by
+	// the size of the header rather than by an ID in the file
+	exp.NofDiagnosisCodes = len(exp.NameMap)
+	for id := range exp.NameMap {
+		if id >= exp.NofDiagnosisCodes {
+			return nil, nil, fmt.Errorf("diagnosis ID %d is out of range, the header has %d diagnoses", id,
+				exp.NofDiagnosisCodes)
+		}
+	}
+	return exp, header, nil
+}
+
+// parsePtraTrajectory parses a Trajectory message. The RRs of its transitions are stored in rrs.
+func parsePtraTrajectory(b []byte, rrs map[[2]int]float64) (*Trajectory, error) {
+	t := &Trajectory{}
+	var transitions []float64
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, value []byte) (err error) {
+		var vs []int
+		var fs []float64
+		switch num {
+		case ptraTrajectoryID:
+			t.ID, err = varintValue(typ, value)
+		case ptraTrajectoryDiagnoses:
+			vs, err = repeatedVarints(typ, value)
+			t.Diagnoses = append(t.Diagnoses, vs...)
+		case ptraTrajectoryPatientNumbers:
+			vs, err = repeatedVarints(typ, value)
+			t.PatientNumbers = append(t.PatientNumbers, vs...)
+		case ptraTrajectoryRR:
+			fs, err = repeatedDoubles(typ, value)
+			transitions = append(transitions, fs...)
+		case ptraTrajectoryEOIEnrichment:
+			fs, err = repeatedDoubles(typ, value)
+			t.EOIEnrichments = append(t.EOIEnrichments, fs...)
+		case ptraTrajectoryCluster:
+			t.Cluster, err = varintValue(typ, value)
+		case ptraTrajectoryMemberships:
+			var v []byte
+			if v, err = bytesValue(typ, value); err == nil {
+				m := Membership{}
+				err = forEachField(v, func(num protowire.Number, typ protowire.Type, value []byte) (err error) {
+					switch num {
+					case ptraMembershipCluster:
+						m.Cluster, err = varintValue(typ, value)
+					case ptraMembershipWeight:
+						fs, err = repeatedDoubles(typ, value)
+						if len(fs) > 0 {
+							m.Weight = fs[0]
+						}
+					}
+					return err
+				})
+				t.Memberships = append(t.Memberships, m)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateTrajectory(t); err != nil {
+		return nil, err
+	}
+	for i, rr := range transitions {
+		if i+1 < len(t.Diagnoses) && !math.IsNaN(rr) {
+			rrs[[2]int{t.Diagnoses[i], t.Diagnoses[i+1]}] = rr
+		}
+	}
+	return t, nil
+}
+
+// ReadPtra reads a .ptra stream written by WritePtra. It returns an experiment with the name, the diagnosis maps, and
+// the trajectories, with their clusters if the header says they are clustered, and the header. The RR matrix of the
+// experiment only contains the RRs of the transitions of the trajectories, the other entries are 1. A corrupt stream,
+// with a message above maxPtraMessageSize or a diagnosis ID beyond the diagnoses of the header, is rejected before the
+// memory for it is allocated.
+func ReadPtra(r io.Reader) (*Experiment, *PtraHeader, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	readMessage := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxPtraMessageSize {
+			return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d bytes", size, maxPtraMessageSize)
+		}
+		// the message grows with the data that is actually read, rather than with the size in the file
+		message, err := io.ReadAll(io.LimitReader(br, int64(size)))
+		if err == nil && uint64(len(message)) < size {
+			err = io.ErrUnexpectedEOF
+		}
+		return message, err
+	}
+	message, err := readMessage()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the .ptra header: %v", err)
+	}
+	exp, header, err := parsePtraHeader(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	rrs := map[[2]int]float64{}
+	for {
+		message, err := readMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading trajectory %d: %v", len(exp.Trajectories), err)
+		}
+		t, err := parsePtraTrajectory(message, rrs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("trajectory %d: %v", len(exp.Trajectories), err)
+		}
+		for _, d := range t.Diagnoses {
+			if err := ValidateDiagnosisID(exp, d); err != nil {
+				return nil, nil, fmt.Errorf("trajectory %d: %v", len(exp.Trajectories), err)
+			}
+		}
+		exp.Trajectories = append(exp.Trajectories, t)
+	}
+	if len(exp.Trajectories) != header.NofTrajectories {
+		return nil, nil, fmt.Errorf("expected %d trajectories, found %d", header.NofTrajectories,
+			len(exp.Trajectories))
+	}
+	exp.DxDRR = MakeDxDRR(exp.NofDiagnosisCodes)
+	for pair, rr := range rrs {
+		exp.DxDRR[pair[0]][pair[1]] = rr
+	}
+	if err := ValidateExperiment(exp); err != nil {
+		return nil, nil, err
+	}
+	return exp, header, nil
+}
+
+// ReadPtraFile reads a .ptra file, cf. ReadPtra.
+func ReadPtraFile(name string) (*Experiment, *PtraHeader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	exp, header, err := ReadPtra(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return exp, header, nil
+}
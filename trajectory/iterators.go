@@ -0,0 +1,121 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"iter"
+	"math"
+	"sort"
+)
+
+// Iterators over the results of an experiment, so that Go code that uses ptra as a library can stream over
+// trajectories, transitions, and cluster members with range-over-func, without collecting them in slices first.
+
+// Transition is a single step of a trajectory, from one diagnosis to the next.
+type Transition struct {
+	Index       int        // The position of the transition in the trajectory, starting at 0
+	From, To    int        // The diagnosis IDs of the transition
+	NofPatients int        // The number of patients that follow the trajectory up to and including the transition
+	Patients    []*Patient // The patients that follow the trajectory up to and including the transition, if known
+	RR          float64    // The relative risk of the diagnosis pair
+}
+
+// AllTrajectories iterates over the trajectories of the experiment together with their index.
+func (exp *Experiment) AllTrajectories() iter.Seq2[int, *Trajectory] {
+	return func(yield func(int, *Trajectory) bool) {
+		for i, t := range exp.Trajectories {
+			if !yield(i, t) {
+				return
+			}
+		}
+	}
+}
+
+// Transitions iterates over the transitions of a trajectory. The patients of a transition are nil if they are not
+// known, e.g. for trajectories read back from a tab file, and the RR is NaN if the experiment has no RR matrix.
+func (exp *Experiment) Transitions(t *Trajectory) iter.Seq[Transition] {
+	return func(yield func(Transition) bool) {
+		for i := 0; i+1 < len(t.Diagnoses); i++ {
+			tr := Transition{Index: i, From: t.Diagnoses[i], To: t.Diagnoses[i+1], RR: math.NaN()}
+			if i < len(t.PatientNumbers) {
+				tr.NofPatients = t.PatientNumbers[i]
+			}
+			if i < len(t.Patients) {
+				tr.Patients = t.Patients[i]
+			}
+			if tr.From < len(exp.DxDRR) && tr.To < len(exp.DxDRR[tr.From]) {
+				tr.RR = exp.DxDRR[tr.From][tr.To]
+			}
+			if !yield(tr) {
+				return
+			}
+		}
+	}
+}
+
+// AllTransitions iterates over the transitions of all trajectories of the experiment, together with the trajectory
+// they belong to.
+func (exp *Experiment) AllTransitions() iter.Seq2[*Trajectory, Transition] {
+	return func(yield func(*Trajectory, Transition) bool) {
+		for _, t := range exp.Trajectories {
+			for tr := range exp.Transitions(t) {
+				if !yield(t, tr) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ClusterIDs iterates over the IDs of the clusters of the experiment in increasing order. For MCL clusterings, this is
+// from the largest to the smallest cluster.
+func (exp *Experiment) ClusterIDs() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		seen := map[int]bool{}
+		cids := []int{}
+		for _, t := range exp.Trajectories {
+			for _, m := range ClusterMemberships(t) {
+				if !seen[m.Cluster] {
+					seen[m.Cluster] = true
+					cids = append(cids, m.Cluster)
+				}
+			}
+		}
+		sort.Ints(cids)
+		for _, cid := range cids {
+			if !yield(cid) {
+				return
+			}
+		}
+	}
+}
+
+// ClusterMembers iterates over the trajectories that belong to a cluster, together with the weight of their
+// membership. For hard clustering, the weights are 1.
+func (exp *Experiment) ClusterMembers(cid int) iter.Seq2[*Trajectory, float64] {
+	return func(yield func(*Trajectory, float64) bool) {
+		for _, t := range exp.Trajectories {
+			if w := membershipWeight(t, cid); w > 0 {
+				if !yield(t, w) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Annotating trajectories with known trajectories from the literature
+
+// KnownTrajectory is a published disease trajectory, given as a sequence of diagnoses, with a reference to the
+// publication.
+type KnownTrajectory struct {
+	Diagnoses []string // the diagnosis codes or medical terms, in order
+	Reference string   // the publication that reports the trajectory
+}
+
+// String returns the diagnoses of a known trajectory, separated by arrows.
+func (k *KnownTrajectory) String() string {
+	return strings.Join(k.Diagnoses, " -> ")
+}
+
+// LiteratureMatches maps trajectories onto the known trajectories they replicate, cf. MatchLiterature. Trajectories
+// that do not replicate any known trajectory are novel, and are not in the map.
+type LiteratureMatches map[*Trajectory][]*KnownTrajectory
+
+// ReadLiterature reads a csv file with known trajectories. The header is trajectory,reference. The trajectory column
+// has the diagnoses of a known trajectory separated by arrows, e.g. E11 -> I10 -> N18. The diagnoses are codes or
+// medical terms of the vocabulary, cf. MatchLiterature. A known trajectory has at least two diagnoses.
+func ReadLiterature(name string) ([]*KnownTrajectory, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if strings.TrimSpace(header[0]) != "trajectory" || strings.TrimSpace(header[1]) != "reference" {
+		return nil, fmt.Errorf("%s: the header must be trajectory,reference", name)
+	}
+	known := []*KnownTrajectory{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		k := &KnownTrajectory{Reference: strings.TrimSpace(record[1])}
+		for _, d := range strings.Split(record[0], "->") {
+			if d = strings.TrimSpace(d); d != "" {
+				k.Diagnoses = append(k.Diagnoses, d)
+			}
+		}
+		if len(k.Diagnoses) < 2 {
+			return nil, fmt.Errorf("%s: known trajectory %q has less than two diagnoses", name, record[0])
+		}
+		known = append(known, k)
+	}
+	return known, nil
+}
+
+// knownDiagnosisMatches checks if a diagnosis of a known trajectory matches a diagnosis of the vocabulary with the
+// given code and medical term. The medical terms must be the same, or the code must start with the known code, e.g.
+// E11 matches E11.9, so that known trajectories can be given at a coarser level than the run. The case is ignored.
+func knownDiagnosisMatches(known, code, name string) bool {
+	known = strings.ToUpper(known)
+	return strings.ToUpper(name) == known || (code != "" && strings.HasPrefix(strings.ToUpper(code), known))
+}
+
+// replicates checks if a trajectory replicates a known trajectory, i.e. if the diagnoses of the known trajectory occur
+// in the trajectory in the same order, not necessarily one after the other.
+func replicates(t *Trajectory, k *KnownTrajectory, nameMap, idMap map[int]string) bool {
+	i := 0
+	for _, d := range t.Diagnoses {
+		if i < len(k.Diagnoses) && knownDiagnosisMatches(k.Diagnoses[i], idMap[d], nameMap[d]) {
+			i++
+		}
+	}
+	return i == len(k.Diagnoses)
+}
+
+// MatchLiterature determines for each trajectory the known trajectories it replicates, cf. replicates. The diagnoses of
+// the known trajectories are matched against the codes (idMap) and medical terms (nameMap) of the vocabulary, cf.
+// knownDiagnosisMatches. The idMap can be empty, e.g. for trajectories read from a tab file. A warning is logged for
+// the known trajectories with diagnoses that are not in the vocabulary, since they cannot be replicated.
+func MatchLiterature(known []*KnownTrajectory, ts []*Trajectory, nameMap, idMap map[int]string) LiteratureMatches {
+	unknown := 0
+	for _, k := range known {
+		for _, kd := range k.Diagnoses {
+			found := false
+			for d, name := range nameMap {
+				if knownDiagnosisMatches(kd, idMap[d], name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				unknown++
+				break
+			}
+		}
+	}
+	if unknown > 0 {
+		utils.Warning(unknown, " of ", len(known), " known trajectories have diagnoses that are not in the "+
+			"vocabulary of the run, and cannot be replicated.")
+	}
+	matches := LiteratureMatches{}
+	for _, t := range ts {
+		for _, k := range known {
+			if replicates(t, k, nameMap, idMap) {
+				matches[t] = append(matches[t], k)
+			}
+		}
+	}
+	return matches
+}
+
+// AnnotateLiterature determines the known trajectories that the trajectories of an experiment replicate, and stores
+// them in the experiment, cf. MatchLiterature.
+func AnnotateLiterature(exp *Experiment, known []*KnownTrajectory) {
+	exp.Literature = MatchLiterature(known, exp.Trajectories, exp.NameMap, exp.IdMap)
+	replicated := map[*KnownTrajectory]bool{}
+	for _, ks := range exp.Literature {
+		for _, k := range ks {
+			replicated[k] = true
+		}
+	}
+	utils.Info(len(exp.Literature), " of ", len(exp.Trajectories), " trajectories replicate ", len(replicated),
+		" of ", len(known), " known trajectories.")
+}
+
+// references returns the distinct references of a list of known trajectories, in order, separated by semicolons.
+func references(known []*KnownTrajectory) string {
+	refs := []string{}
+	seen := map[string]bool{}
+	for _, k := range known {
+		if !seen[k.Reference] {
+			seen[k.Reference] = true
+			refs = append(refs, k.Reference)
+		}
+	}
+	return strings.Join(refs, "; ")
+}
+
+// literatureStatus returns known for a trajectory that replicates a known trajectory, and novel otherwise.
+func literatureStatus(matches LiteratureMatches, t *Trajectory) string {
+	if len(matches[t]) > 0 {
+		return "known"
+	}
+	return "novel"
+}
+
+// writeCSVFile writes records to a csv file, with a header.
+func writeCSVFile(name string, header []string, records [][]string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write(header); err != nil {
+		panic(err)
+	}
+	if err := w.WriteAll(records); err != nil {
+		panic(err)
+	}
+}
+
+// PrintLiteratureToCSVFile prints for each trajectory whether it replicates known trajectories or is novel to a csv
+// file, cf. MatchLiterature. The header is Trajectory,Status,KnownTrajectories,References, with status known or
+// novel. The known trajectories and the references are separated by semicolons.
+func PrintLiteratureToCSVFile(ts []*Trajectory, nameMap map[int]string, matches LiteratureMatches, name string) {
+	records := [][]string{}
+	for _, t := range ts {
+		knownTrajectories := []string{}
+		for _, k := range matches[t] {
+			knownTrajectories = append(knownTrajectories, k.String())
+		}
+		records = append(records, []string{trajectoryName(t, nameMap), literatureStatus(matches, t),
+			strings.Join(knownTrajectories, "; "), references(matches[t])})
+	}
+	writeCSVFile(name, []string{"Trajectory", "Status", "KnownTrajectories", "References"}, records)
+}
+
+// PrintLiteratureReplicationToCSVFile prints for each known trajectory the number of trajectories that replicate it to
+// a csv file, cf. MatchLiterature. The header is KnownTrajectory,Reference,Trajectories. A known trajectory with 0
+// trajectories is not replicated by the run.
+func PrintLiteratureReplicationToCSVFile(known []*KnownTrajectory, matches LiteratureMatches, name string) {
+	counts := map[*KnownTrajectory]int{}
+	for _, ks := range matches {
+		for _, k := range ks {
+			counts[k]++
+		}
+	}
+	records := [][]string{}
+	for _, k := range known {
+		records = append(records, []string{k.String(), k.Reference, strconv.Itoa(counts[k])})
+	}
+	writeCSVFile(name, []string{"KnownTrajectory", "Reference", "Trajectories"}, records)
+}
+
+// PrintClusterLiteratureToCSVFile prints for each cluster of an experiment the number of its trajectories that
+// replicate known trajectories and the number of novel ones to a csv file, cf. AnnotateLiterature. The header is
+// CID,Trajectories,Known,Novel,References, with the references of the known trajectories of the cluster separated by
+// semicolons.
+func PrintClusterLiteratureToCSVFile(exp *Experiment, name string) {
+	clusters := CollectClusters(exp)
+	cids := []int{}
+	for cid := range clusters {
+		cids = append(cids, cid)
+	}
+	sort.Ints(cids)
+	records := [][]string{}
+	for _, cid := range cids {
+		knownCtr := 0
+		known := []*KnownTrajectory{}
+		for _, t := range clusters[cid] {
+			if ks := exp.Literature[t]; len(ks) > 0 {
+				knownCtr++
+				known = append(known, ks...)
+			}
+		}
+		records = append(records, []string{strconv.Itoa(cid), strconv.Itoa(len(clusters[cid])),
+			strconv.Itoa(knownCtr), strconv.Itoa(len(clusters[cid]) - knownCtr), references(known)})
+	}
+	writeCSVFile(name, []string{"CID", "Trajectories", "Known", "Novel", "References"}, records)
+}
+
+// knownTrajectories returns the number of trajectories that replicate known trajectories and its percentage, formatted
+// for printing.
+func knownTrajectories(matches LiteratureMatches, ts []*Trajectory) string {
+	known := 0
+	for _, t := range ts {
+		if len(matches[t]) > 0 {
+			known++
+		}
+	}
+	percentage, _ := utils.Percentage(int64(known), int64(len(ts)))
+	return fmt.Sprintf("%d (%s%% of trajectories)", known, utils.FormatStat(percentage, 1))
+}
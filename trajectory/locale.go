@@ -0,0 +1,113 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Messages are the texts of the reports of an experiment in the language of the reports, e.g. the narratives of the
+// trajectories, cf. TrajectoryNarrative. They map the keys of DefaultMessages onto fmt formats with the same arguments,
+// which a translation can reorder with explicit argument indexes, e.g. %[2]s.
+type Messages map[string]string
+
+// DefaultMessages are the English texts of the reports.
+var DefaultMessages = Messages{
+	"narrative.subject":       "Patients",
+	"narrative.subsequent":    "Of these, patients",
+	"narrative.transition":    "%s diagnosed with %s are at %s of %s%s (n=%d).",
+	"narrative.within":        " within a median of %s months",
+	"narrative.increasedRisk": "increased risk",
+	"narrative.foldIncreased": "%s-fold increased risk",
+	"narrative.foldDecreased": "%s-fold decreased risk",
+	"narrative.trajectory":    "Trajectory %d: %s",
+}
+
+// messageArguments are example arguments of the messages, for checking that a translation uses its arguments
+// correctly, cf. ReadMessages.
+var messageArguments = map[string][]interface{}{
+	"narrative.transition":    {"Patients", "D1", "increased risk", "D2", "", 100},
+	"narrative.within":        {"8"},
+	"narrative.foldIncreased": {"2.1"},
+	"narrative.foldDecreased": {"2.0"},
+	"narrative.trajectory":    {0, "narrative"},
+}
+
+// message formats the message with the given key in the language of the reports of an experiment, cf.
+// Experiment.Messages, or in English if it is not translated.
+func message(exp *Experiment, key string, args ...interface{}) string {
+	format, ok := exp.Messages[key]
+	if !ok {
+		format = DefaultMessages[key]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// ReadMessages reads translated messages from a csv file with the header Key,Text, where the keys are the ones of
+// DefaultMessages. Messages that are not in the file stay in English. It returns an error for unknown keys, and for
+// texts that do not use the arguments of the message correctly, e.g. %d instead of %s, or a missing argument.
+func ReadMessages(name string) (Messages, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(header) != 2 || strings.TrimSpace(header[0]) != "Key" || strings.TrimSpace(header[1]) != "Text" {
+		return nil, fmt.Errorf("%s: the header must be Key,Text", name)
+	}
+	messages := Messages{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		key, text := strings.TrimSpace(record[0]), record[1]
+		if _, ok := DefaultMessages[key]; !ok {
+			keys := []string{}
+			for k := range DefaultMessages {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("%s, line %d: unknown message %s, expected one of %s", name, line, key,
+				strings.Join(keys, ", "))
+		}
+		if example := fmt.Sprintf(text, messageArguments[key]...); strings.Contains(example, "%!") {
+			return nil, fmt.Errorf("%s, line %d: message %s does not use its arguments as %q: %s", name, line, key,
+				DefaultMessages[key], example)
+		}
+		messages[key] = text
+	}
+	return messages, nil
+}
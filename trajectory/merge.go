@@ -0,0 +1,217 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"math"
+	"ptra/utils"
+)
+
+// Merging experiments for incremental data loads, e.g. data delivered in yearly batches.
+
+// AssignCohortAges divides the patients into a given number of age groups, based on the range of years of birth of the
+// patients, and sets the CohortAge of each patient accordingly.
+func AssignCohortAges(patients *PatientMap, nofCohortAges int) {
+	maxYOB := 1850
+	minYOB := 2021
+	for _, p := range patients.PIDMap {
+		maxYOB = utils.Max(p.YOB, maxYOB)
+		minYOB = utils.Min(p.YOB, minYOB)
+	}
+	ageRange := float64(maxYOB-minYOB) / float64(nofCohortAges)
+	ageRange = math.Max(math.Ceil(ageRange), 1)
+	if nofCohortAges > 1 {
+		for _, p := range patients.PIDMap {
+			// the youngest patients fall in the last age group when the range of years of birth is a multiple of it
+			p.CohortAge = utils.Min(int(math.Floor(float64(p.YOB-minYOB)/float64(ageRange))), nofCohortAges-1)
+		}
+	}
+}
+
+// experimentPatients collects the patients of an experiment from its cohorts.
+func experimentPatients(exp *Experiment) []*Patient {
+	patients := []*Patient{}
+	for _, cohort := range exp.Cohorts {
+		patients = append(patients, cohort.Patients...)
+	}
+	return patients
+}
+
+// mergeVocabularies combines the diagnosis codes of two experiments, which are matched on their original diagnostic
+// IDs, cf. Experiment.IdMap, since different codes may share a medical name. The codes of experiment a keep their IDs,
+// and the codes that only occur in experiment b are appended. This is needed because the diagnosis IDs of an
+// experiment are compacted to the codes that occur in its cohort. It returns the combined experiment with only the
+// vocabulary maps filled in, and for each ID of experiment b its combined ID.
+func mergeVocabularies(a, b *Experiment) (*Experiment, []int) {
+	for _, e := range []*Experiment{a, b} {
+		for did := 0; did < e.NofDiagnosisCodes; did++ {
+			if _, ok := e.IdMap[did]; !ok {
+				panic(fmt.Sprint("Cannot merge experiment ", e.Name, " without an original ID for diagnosis ", did))
+			}
+		}
+	}
+	exp := &Experiment{NofDiagnosisCodes: a.NofDiagnosisCodes, NameMap: map[int]string{}, IdMap: map[int]string{},
+		Hierarchy: map[int][]string{}}
+	ids := map[string]int{}
+	for did, name := range a.NameMap {
+		exp.NameMap[did] = name
+	}
+	for did, code := range a.IdMap {
+		exp.IdMap[did] = code
+		ids[code] = did
+	}
+	for did, path := range a.Hierarchy {
+		exp.Hierarchy[did] = path
+	}
+	remap := make([]int, b.NofDiagnosisCodes)
+	for did := range remap {
+		code := b.IdMap[did]
+		newID, ok := ids[code]
+		if !ok {
+			newID = exp.NofDiagnosisCodes
+			exp.NofDiagnosisCodes++
+			exp.IdMap[newID] = code
+			ids[code] = newID
+			if name, ok := b.NameMap[did]; ok {
+				exp.NameMap[newID] = name
+			}
+			if path, ok := b.Hierarchy[did]; ok {
+				exp.Hierarchy[newID] = path
+			}
+		}
+		remap[did] = newID
+	}
+	return exp, remap
+}
+
+// copyPatient creates a copy of a patient with a new analysis ID, so that merging does not modify the patients of the
+// experiments that are merged. The diagnosis IDs are remapped with the given remap, if not nil, cf. mergeVocabularies.
+func copyPatient(p *Patient, pid int, remap []int) *Patient {
+	newP := *p
+	newP.PID = pid
+	newP.Diagnoses = make([]*Diagnosis, len(p.Diagnoses))
+	for i, d := range p.Diagnoses {
+		newP.Diagnoses[i] = &Diagnosis{PID: pid, DID: remapDiagnosis(d.DID, remap), Date: d.Date}
+	}
+	return &newP
+}
+
+func remapDiagnosis(did int, remap []int) int {
+	if remap == nil {
+		return did
+	}
+	return remap[did]
+}
+
+// mergePatient merges the history of a patient from another data batch into a patient. Diagnoses are merged and
+// deduplicated, the earliest event of interest is kept, and a missing date of death is filled in. The diagnosis IDs
+// of the other patient are remapped with the given remap, if not nil.
+func mergePatient(p, other *Patient, remap []int) {
+	for _, d := range other.Diagnoses {
+		AddDiagnosis(p, &Diagnosis{PID: p.PID, DID: remapDiagnosis(d.DID, remap), Date: d.Date})
+	}
+	SortDiagnoses(p)
+	CompactDiagnoses(p)
+	if other.EOIDate != nil && (p.EOIDate == nil || DiagnosisDateSmallerThan(*other.EOIDate, *p.EOIDate)) {
+		eoiDate := *other.EOIDate
+		p.EOIDate = &eoiDate
+	}
+	if p.DeathDate == nil && other.DeathDate != nil {
+		deathDate := *other.DeathDate
+		p.DeathDate = &deathDate
+	}
+}
+
+// MergeExperiments combines two experiments over the same vocabulary of diagnosis codes into a new experiment, so that
+// data delivered in batches can be accumulated without parsing all prior batches again. Since the diagnosis IDs of an
+// experiment are compacted to the codes that occur in its cohort, the diagnosis codes are matched on their original
+// diagnostic IDs, cf. mergeVocabularies. Patients are matched on their input ID (PIDString): the diagnosis histories
+// of patients that occur in both experiments are merged. The cohorts and diagnosis counts are rebuilt from the merged
+// patients, after which the relative risk ratios are recomputed with the given minimum and maximum time between
+// diagnoses, number of sampling iterations, and denominator, cf. InitializeExperimentRelativeRiskRatios. The input
+// experiments must still have their cohorts, and are not modified. MergeExperiments returns the merged experiment and
+// its patients.
+func MergeExperiments(a, b *Experiment, minTime, maxTime float64, iter int, denominator string) (*Experiment,
+	*PatientMap) {
+	if a.NofAgeGroups != b.NofAgeGroups {
+		panic(fmt.Sprint("Cannot merge experiments ", a.Name, " and ", b.Name, " with a different number of age groups"))
+	}
+	if a.Cohorts == nil || b.Cohorts == nil {
+		panic("Cannot merge experiments without cohorts")
+	}
+	utils.Info("Merging experiments ", a.Name, " and ", b.Name)
+	vocabulary, remapB := mergeVocabularies(a, b)
+	patients := &PatientMap{PIDStringMap: map[string]int{}, PIDMap: map[int]*Patient{}}
+	mergedCtr := 0
+	for i, exp := range []*Experiment{a, b} {
+		var remap []int
+		if i == 1 {
+			remap = remapB
+		}
+		for _, p := range experimentPatients(exp) {
+			if existing, ok := GetPatient(p.PIDString, patients); ok {
+				mergePatient(existing, p, remap)
+				mergedCtr++
+				continue
+			}
+			patients.Ctr++ // avoid using 0 as PID
+			newP := copyPatient(p, patients.Ctr, remap)
+			patients.PIDMap[newP.PID] = newP
+			patients.PIDStringMap[newP.PIDString] = newP.PID
+			if newP.Sex == Male {
+				patients.MaleCtr++
+			} else {
+				patients.FemaleCtr++
+			}
+		}
+	}
+	utils.Info("Merged ", mergedCtr, " patients that occur in both experiments, for a total of ", patients.Ctr,
+		" patients.")
+	AssignCohortAges(patients, a.NofAgeGroups)
+	nofRegions := utils.Max(a.NofRegions, b.NofRegions)
+	nofDiagnosisCodes := vocabulary.NofDiagnosisCodes
+	cohorts := InitializeCohorts(patients, a.NofAgeGroups, nofRegions, nofDiagnosisCodes)
+	dPatients := make([][]*Patient, nofDiagnosisCodes)
+	for _, cohort := range cohorts {
+		for did, ps := range cohort.DPatients {
+			dPatients[did] = append(dPatients[did], ps...)
+		}
+	}
+	exp := &Experiment{
+		NofAgeGroups:      a.NofAgeGroups,
+		NofRegions:        nofRegions,
+		Level:             a.Level,
+		NofDiagnosisCodes: nofDiagnosisCodes,
+		DxDRR:             MakeDxDRR(nofDiagnosisCodes),
+		DxDPatients:       MakeDxDPatients(nofDiagnosisCodes),
+		DPatients:         dPatients,
+		Cohorts:           cohorts,
+		Name:              a.Name,
+		NameMap:           vocabulary.NameMap,
+		IdMap:             vocabulary.IdMap,
+		Hierarchy:         vocabulary.Hierarchy,
+		MCtr:              patients.MaleCtr,
+		FCtr:              patients.FemaleCtr,
+		PatientCtr:        len(patients.PIDMap),
+		EOICtr:            CountEOIPatients(patients),
+	}
+	InitializeExperimentRelativeRiskRatios(exp, minTime, maxTime, iter, denominator)
+	return exp, patients
+}
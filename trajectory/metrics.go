@@ -18,7 +18,10 @@
 
 package trajectory
 
-import "math"
+import (
+	"math"
+	"ptra/utils"
+)
 
 // Collecting metrics for clusters of trajectories
 
@@ -52,17 +55,17 @@ func AgeAtEOI(p *Patient) int {
 // trajectories will be counted as separate instances for these age categories.
 // * #males, #females
 // * mean survival time after event of interest
-func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, float64, float64, int, int) {
-	meanAge := 0
-	ctr := 0
-	mCtr := 0
-	fCtr := 0
-	meanAgeOfEOI := 0
-	ctr2 := 0
+// The sums and counters are 64-bit so that they cannot overflow for national cohorts. When there are no patients, or no
+// patients with an event of interest, the corresponding means and standard deviations are NaN.
+func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, float64, float64, int64, int64) {
+	var meanAge, ctr, mCtr, fCtr, meanAgeOfEOI, ctr2 int64
 	for _, t := range trajectories {
-		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
+		for _, p := range LastPatients(t) { // patients in last diagnosis of the trajectory
 			ctr++
-			meanAge = meanAge + AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1])
+			meanAge = meanAge + int64(AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1]))
 			if p.Sex == Male {
 				mCtr++
 			} else {
@@ -70,17 +73,20 @@ func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, floa
 			}
 			ageEOI := AgeAtEOI(p)
 			if ageEOI != -1 {
-				meanAgeOfEOI = meanAgeOfEOI + ageEOI
+				meanAgeOfEOI = meanAgeOfEOI + int64(ageEOI)
 				ctr2++
 			}
 		}
 	}
-	meanAgeF := float64(meanAge) / float64(ctr)
-	meanAgeOfEOIF := float64(meanAgeOfEOI) / float64(ctr2)
+	meanAgeF, _ := utils.Ratio(meanAge, ctr)
+	meanAgeOfEOIF, _ := utils.Ratio(meanAgeOfEOI, ctr2)
 	stdDev := 0.0
 	stdDevEOI := 0.0
 	for _, t := range trajectories {
-		for _, p := range t.Patients[len(t.Patients)-1] { // patients in last diagnosis of the trajectory
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
+		for _, p := range LastPatients(t) { // patients in last diagnosis of the trajectory
 			age := float64(AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1]))
 			stdDev = stdDev + ((meanAgeF - age) * (meanAgeF - age))
 			ageEOI := float64(AgeAtEOI(p))
@@ -89,7 +95,57 @@ func MetricsFromTrajectories(trajectories []*Trajectory) (float64, float64, floa
 			}
 		}
 	}
-	stdDev = math.Sqrt(stdDev / float64(ctr))
-	stdDevEOI = math.Sqrt(stdDevEOI / float64(ctr2))
+	if ctr > 0 {
+		stdDev = math.Sqrt(stdDev / float64(ctr))
+	} else {
+		stdDev = math.NaN()
+	}
+	if ctr2 > 0 {
+		stdDevEOI = math.Sqrt(stdDevEOI / float64(ctr2))
+	} else {
+		stdDevEOI = math.NaN()
+	}
 	return meanAgeF, stdDev, meanAgeOfEOIF, stdDevEOI, mCtr, fCtr
 }
+
+// PatientAge calculates the age of a patient at a given date, in years. Since only the year of birth of a patient is
+// known, the age is counted from the start of that year.
+func PatientAge(p *Patient, date DiagnosisDate) float64 {
+	return DiagnosisDateToFloat(date) - float64(p.YOB)
+}
+
+// TrajectoryDates returns the dates of the diagnoses of a trajectory for a patient that follows the trajectory, i.e.
+// for each diagnosis the first date it occurs after the previous diagnosis of the trajectory. It returns nil if the
+// patient does not have the diagnoses in that order.
+func TrajectoryDates(p *Patient, diagnoses []int) []DiagnosisDate {
+	dates := []DiagnosisDate{}
+	for _, d := range p.Diagnoses {
+		if len(dates) == len(diagnoses) {
+			break
+		}
+		if d.DID == diagnoses[len(dates)] {
+			dates = append(dates, d.Date)
+		}
+	}
+	if len(dates) < len(diagnoses) {
+		return nil
+	}
+	return dates
+}
+
+// MedianAgesFromTrajectory computes for each diagnosis of a trajectory the median age at which the patients that
+// follow the full trajectory get that diagnosis. This places the trajectory in age-time rather than calendar time.
+// The ages are NaN if there are no such patients.
+func MedianAgesFromTrajectory(t *Trajectory) []float64 {
+	ages := make([][]float64, len(t.Diagnoses))
+	for _, p := range LastPatients(t) {
+		for i, date := range TrajectoryDates(p, t.Diagnoses) {
+			ages[i] = append(ages[i], PatientAge(p, date))
+		}
+	}
+	medians := make([]float64, len(t.Diagnoses))
+	for i, xs := range ages {
+		medians[i] = utils.Median(xs)
+	}
+	return medians
+}
@@ -0,0 +1,241 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Naming clusters persistently across runs. Each clustering writes a naming sheet with a stable ID and a name per
+// cluster, which analysts can edit. When the clusters are recomputed, e.g. after a data refresh, the clusters of the
+// new clustering are matched to the clusters of a previous naming sheet by the similarity of their medoids, so that
+// the matched clusters keep their IDs and names, and dashboards that monitor the clusters over time keep working.
+
+// clusterNamesHeader is the header of a naming sheet.
+var clusterNamesHeader = []string{"Cluster", "ID", "Name", "Medoid", "Similarity"}
+
+// clusterNameSimilarity is the minimum Jaccard similarity of the diagnoses of the medoids of two clusters for them to
+// be matched, cf. MatchClusterNames.
+const clusterNameSimilarity = 0.5
+
+// ClusterName is the stable ID and the name of a cluster, and its medoid trajectory, identified by the medical terms
+// of its diagnoses, separated by arrows. Cluster is the cluster in the current clustering, or -1 for a retired cluster
+// without a match in it. Similarity is the similarity of the medoid to the medoid of the previous cluster with the same
+// ID, or NaN if the cluster is new.
+type ClusterName struct {
+	Cluster, ID  int
+	Name, Medoid string
+	Similarity   float64
+}
+
+// ClusterNames is a naming sheet, with the ID and the name of each cluster.
+type ClusterNames []*ClusterName
+
+// ReadClusterNames reads a naming sheet, cf. PrintClusterNamesToCSVFile. The header is
+// Cluster,ID,Name,Medoid,Similarity. Only the IDs, names, and medoids are used, which must be given for every
+// cluster. The names may be empty. The IDs must be unique integers.
+func ReadClusterNames(name string) (ClusterNames, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i, column := range clusterNamesHeader[:4] {
+		if i >= len(header) || strings.TrimSpace(header[i]) != column {
+			return nil, fmt.Errorf("%s: the header must be %s", name, strings.Join(clusterNamesHeader, ","))
+		}
+	}
+	names := ClusterNames{}
+	ids := map[int]bool{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(record) < 4 {
+			return nil, fmt.Errorf("%s, line %d: expected at least 4 columns, got %d", name, line, len(record))
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: invalid ID %q", name, line, record[1])
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("%s, line %d: ID %d is used twice", name, line, id)
+		}
+		ids[id] = true
+		medoid := strings.TrimSpace(record[3])
+		if medoid == "" {
+			return nil, fmt.Errorf("%s, line %d: cluster %d without a medoid", name, line, id)
+		}
+		names = append(names, &ClusterName{Cluster: -1, ID: id, Name: strings.TrimSpace(record[2]), Medoid: medoid})
+	}
+	return names, nil
+}
+
+// medoidTerms returns the unique medical terms of the diagnoses of a medoid, cf. trajectoryName.
+func medoidTerms(medoid string) []string {
+	terms := strings.Split(medoid, " -> ")
+	for i, term := range terms {
+		terms[i] = strings.TrimSpace(term)
+	}
+	return utils.Unique(terms)
+}
+
+// termsJaccard returns the Jaccard similarity of two sets of medical terms.
+func termsJaccard(terms1, terms2 []string) float64 {
+	intersection := utils.IntersectionSize(terms1, terms2)
+	union := len(terms1) + len(terms2) - intersection
+	if union == 0 {
+		return 0
+	}
+	return float64(intersection) / float64(union)
+}
+
+// ClusterMedoids returns for each cluster of an experiment its medoid, the trajectory with the highest total Jaccard
+// similarity of its diagnoses to the other trajectories of the cluster. Ties are broken by the number of patients,
+// highest first. The trajectories without diagnoses, cf. writeClusterGraphs, are ignored.
+func ClusterMedoids(exp *Experiment) map[int]*Trajectory {
+	medoids := map[int]*Trajectory{}
+	for cid, ts := range CollectClusters(exp) {
+		terms := make([][]string, len(ts))
+		for i, t := range ts {
+			terms[i] = medoidTerms(trajectoryName(t, exp.NameMap))
+		}
+		best := -1.0
+		for i, t := range ts {
+			if len(t.Diagnoses) == 0 {
+				continue
+			}
+			total := 0.0
+			for j := range ts {
+				if i != j && len(ts[j].Diagnoses) > 0 {
+					total += termsJaccard(terms[i], terms[j])
+				}
+			}
+			if total > best || (total == best && trajectorySupport(t) > trajectorySupport(medoids[cid])) {
+				best = total
+				medoids[cid] = t
+			}
+		}
+	}
+	return medoids
+}
+
+// MatchClusterNames matches the clusters of an experiment to the clusters of a previous naming sheet, cf.
+// ReadClusterNames. The pairs of a cluster and a previous cluster are matched greedily by the Jaccard similarity of the
+// diagnoses of their medoids, highest first, if it is at least 0.5. A matched cluster keeps the ID and the name of
+// the previous cluster. The other clusters get new IDs, above all previous IDs, and no name. The previous clusters
+// without a match are kept as retired clusters, so that their IDs are not reused and they can still be matched in
+// later runs. The previous naming sheet can be nil. The result is sorted by cluster, with the retired clusters last.
+func MatchClusterNames(exp *Experiment, previous ClusterNames) ClusterNames {
+	medoids := ClusterMedoids(exp)
+	cids := utils.SortedKeys(medoids)
+	type candidate struct {
+		cid, previous int
+		similarity    float64
+	}
+	candidates := []candidate{}
+	for _, cid := range cids {
+		terms := medoidTerms(trajectoryName(medoids[cid], exp.NameMap))
+		for i, name := range previous {
+			if s := termsJaccard(terms, medoidTerms(name.Medoid)); s >= clusterNameSimilarity {
+				candidates = append(candidates, candidate{cid, i, s})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+	matched := map[int]*ClusterName{}
+	matchedPrevious := map[int]bool{}
+	for _, c := range candidates {
+		if matched[c.cid] != nil || matchedPrevious[c.previous] {
+			continue
+		}
+		p := previous[c.previous]
+		matched[c.cid] = &ClusterName{Cluster: c.cid, ID: p.ID, Name: p.Name, Similarity: c.similarity}
+		matchedPrevious[c.previous] = true
+	}
+	nextID := 0
+	for _, name := range previous {
+		nextID = utils.Max(nextID, name.ID+1)
+	}
+	names := ClusterNames{}
+	for _, cid := range cids {
+		name := matched[cid]
+		if name == nil {
+			name = &ClusterName{Cluster: cid, ID: nextID, Similarity: math.NaN()}
+			nextID++
+		}
+		name.Medoid = trajectoryName(medoids[cid], exp.NameMap)
+		names = append(names, name)
+	}
+	retired := 0
+	for i, name := range previous {
+		if !matchedPrevious[i] {
+			names = append(names, &ClusterName{Cluster: -1, ID: name.ID, Name: name.Name, Medoid: name.Medoid,
+				Similarity: math.NaN()})
+			retired++
+		}
+	}
+	if previous != nil {
+		utils.Info("Matched ", len(matchedPrevious), " of ", len(cids), " clusters to named clusters, ", retired,
+			" named clusters are retired.")
+	}
+	return names
+}
+
+// PrintClusterNamesToCSVFile prints a naming sheet for the clusters of an experiment to a csv file, cf.
+// MatchClusterNames. The header is Cluster,ID,Name,Medoid,Similarity. The Cluster column is empty for the retired
+// clusters, and the Similarity column for the new and retired clusters. The names can be edited, and the sheet can be
+// passed to a later run to carry the IDs and the names over.
+func PrintClusterNamesToCSVFile(names ClusterNames, name string) {
+	records := [][]string{}
+	for _, n := range names {
+		cluster, similarity := "", ""
+		if n.Cluster >= 0 {
+			cluster = strconv.Itoa(n.Cluster)
+		}
+		if !math.IsNaN(n.Similarity) {
+			similarity = strconv.FormatFloat(n.Similarity, 'f', 3, 64)
+		}
+		records = append(records, []string{cluster, strconv.Itoa(n.ID), n.Name, n.Medoid, similarity})
+	}
+	writeCSVFile(name, clusterNamesHeader, records)
+}
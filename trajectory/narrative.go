@@ -0,0 +1,105 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"fmt"
+	"math"
+	"ptra/utils"
+	"strings"
+)
+
+// Templated clinical narratives of trajectories, for manuscripts and reports
+
+// TransitionMedianMonths computes the median time in months between the diagnoses of the i-th transition of a
+// trajectory, over the patients that follow the trajectory up to and including that transition. It is NaN if there are
+// no such patients.
+func TransitionMedianMonths(t *Trajectory, i int) float64 {
+	if i >= len(t.Patients) || i+1 >= len(t.Diagnoses) {
+		return math.NaN()
+	}
+	months := []float64{}
+	for _, p := range t.Patients[i] {
+		dates := TrajectoryDates(p, t.Diagnoses[:i+2])
+		if dates == nil {
+			continue
+		}
+		months = append(months, 12*(DiagnosisDateToFloat(dates[i+1])-DiagnosisDateToFloat(dates[i])))
+	}
+	return utils.Median(months)
+}
+
+// riskPhrase describes a relative risk, e.g. "2.1-fold increased risk" for RR 2.1 and "2.0-fold decreased risk" for RR
+// 0.5, in the language of the reports of the experiment. An infinite RR, when none of the comparison patients has the
+// second diagnosis, is an "increased risk".
+func riskPhrase(exp *Experiment, rr float64) string {
+	if math.IsInf(rr, 1) {
+		return message(exp, "narrative.increasedRisk")
+	}
+	if rr < 1 && rr > 0 {
+		return message(exp, "narrative.foldDecreased", utils.FormatStat(1/rr, 1))
+	}
+	return message(exp, "narrative.foldIncreased", utils.FormatStat(rr, 1))
+}
+
+// TrajectoryNarrative generates a short templated description of a trajectory, with one sentence per transition D1 ->
+// D2, e.g. "Patients diagnosed with D1 are at 2.1-fold increased risk of D2 within a median of 8 months (n=150)." The
+// sentences of later transitions start with "Of these," since they describe the patients that followed the trajectory
+// so far. The median time is left out if it is not known, cf. TransitionMedianMonths. The narrative is in the language
+// of the reports of the experiment, cf. Experiment.Messages.
+func TrajectoryNarrative(exp *Experiment, t *Trajectory) string {
+	sentences := []string{}
+	for i := 1; i < len(t.Diagnoses); i++ {
+		d1, d2 := t.Diagnoses[i-1], t.Diagnoses[i]
+		subject := message(exp, "narrative.subject")
+		if i > 1 {
+			subject = message(exp, "narrative.subsequent")
+		}
+		within := ""
+		if months := TransitionMedianMonths(t, i-1); !math.IsNaN(months) {
+			within = message(exp, "narrative.within", utils.FormatStat(months, 0))
+		}
+		n := 0
+		if i-1 < len(t.PatientNumbers) {
+			n = t.PatientNumbers[i-1]
+		}
+		sentences = append(sentences, message(exp, "narrative.transition", subject, exp.NameMap[d1],
+			riskPhrase(exp, exp.DxDRR[d1][d2]), exp.NameMap[d2], within, n))
+	}
+	return strings.Join(sentences, " ")
+}
+
+// printTrajectoryNarrativesToFile prints a narrative for each trajectory to a text file, one line per trajectory
+// prefixed with the number of the trajectory, in the order of the trajectories tab file, cf. TrajectoryNarrative.
+func printTrajectoryNarrativesToFile(exp *Experiment, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for i, t := range exp.Trajectories {
+		if len(t.Diagnoses) < 2 {
+			continue
+		}
+		fmt.Fprintln(file, message(exp, "narrative.trajectory", i, TrajectoryNarrative(exp, t)))
+	}
+}
@@ -0,0 +1,411 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"ptra/utils"
+	"sort"
+	"strings"
+)
+
+// Exporting the clusters as OHDSI cohort definitions, so that the subgroups discovered by the clustering can be
+// instantiated as cohorts on other OMOP CDM databases, e.g. with ATLAS, for external validation. A cluster is defined
+// by the consensus of the alignment of its trajectories, cf. ClusterAlignment.Consensus: the first occurrence of its
+// first diagnosis is the index event, and each next diagnosis must follow the previous one within the time window of
+// the experiment. The diagnoses are matched on their source concepts, i.e. the ICD10 codes as recorded, since these are
+// the codes that ptra analyzes.
+
+// cohortConsensusFrequency is the minimum frequency of the diagnoses of the consensus that defines a cohort, cf.
+// PrintClusterAlignmentsToFile.
+const cohortConsensusFrequency = 0.5
+
+// omopVocabularies are the OMOP vocabularies of the concepts that diagnoses are matched to.
+var omopVocabularies = map[string]bool{"ICD10CM": true, "ICD10": true}
+
+// OMOPConcept is a concept of the OMOP standardized vocabularies, as in the CONCEPT table.
+type OMOPConcept struct {
+	ID            int64
+	Name          string
+	Domain        string
+	Vocabulary    string
+	Class         string
+	Standard      string
+	Code          string
+	InvalidReason string
+}
+
+// OMOPConcepts are the ICD10 concepts of the OMOP vocabularies, sorted by code.
+type OMOPConcepts []*OMOPConcept
+
+// ReadOMOPConcepts reads the ICD10 and ICD10CM concepts from the CONCEPT table of the OMOP vocabularies, as downloaded
+// from Athena: a tab-separated file with a header that has at least the columns concept_id, concept_name, domain_id,
+// vocabulary_id, concept_class_id, standard_concept, concept_code, and invalid_reason.
+func ReadOMOPConcepts(name string) (OMOPConcepts, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.Comma = '\t'
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	required := []string{"concept_id", "concept_name", "domain_id", "vocabulary_id", "concept_class_id",
+		"standard_concept", "concept_code", "invalid_reason"}
+	for _, column := range required {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%s: missing column %s", name, column)
+		}
+	}
+	concepts := OMOPConcepts{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(record) < len(header) {
+			return nil, fmt.Errorf("%s, line %d: expected %d columns, got %d", name, line, len(header), len(record))
+		}
+		if !omopVocabularies[record[columns["vocabulary_id"]]] {
+			continue
+		}
+		var id int64
+		if _, err := fmt.Sscan(record[columns["concept_id"]], &id); err != nil {
+			return nil, fmt.Errorf("%s, line %d: invalid concept_id %q", name, line, record[columns["concept_id"]])
+		}
+		concepts = append(concepts, &OMOPConcept{
+			ID:            id,
+			Name:          record[columns["concept_name"]],
+			Domain:        record[columns["domain_id"]],
+			Vocabulary:    record[columns["vocabulary_id"]],
+			Class:         record[columns["concept_class_id"]],
+			Standard:      record[columns["standard_concept"]],
+			Code:          record[columns["concept_code"]],
+			InvalidReason: record[columns["invalid_reason"]],
+		})
+	}
+	sort.SliceStable(concepts, func(i, j int) bool {
+		if concepts[i].Code != concepts[j].Code {
+			return concepts[i].Code < concepts[j].Code
+		}
+		return concepts[i].ID < concepts[j].ID
+	})
+	return concepts, nil
+}
+
+// Matching returns the concepts for an ICD10 code: the concepts of the code and of all the codes below it, e.g. the
+// concepts of E11, E11.6, E11.65, etc. for E11.
+func (concepts OMOPConcepts) Matching(code string) []*OMOPConcept {
+	if code == "" {
+		return nil
+	}
+	start := sort.Search(len(concepts), func(i int) bool { return concepts[i].Code >= code })
+	end := start
+	for end < len(concepts) && strings.HasPrefix(concepts[end].Code, code) {
+		end++
+	}
+	return concepts[start:end]
+}
+
+// The cohort definitions are written in the JSON format of the OHDSI circe library, which is the format in which
+// ATLAS imports and exports cohort definitions.
+
+type circeConcept struct {
+	ConceptID              int64  `json:"CONCEPT_ID"`
+	ConceptName            string `json:"CONCEPT_NAME"`
+	StandardConcept        string `json:"STANDARD_CONCEPT"`
+	StandardConceptCaption string `json:"STANDARD_CONCEPT_CAPTION"`
+	InvalidReason          string `json:"INVALID_REASON"`
+	InvalidReasonCaption   string `json:"INVALID_REASON_CAPTION"`
+	ConceptCode            string `json:"CONCEPT_CODE"`
+	DomainID               string `json:"DOMAIN_ID"`
+	VocabularyID           string `json:"VOCABULARY_ID"`
+	ConceptClassID         string `json:"CONCEPT_CLASS_ID"`
+}
+
+type circeConceptSetItem struct {
+	Concept            circeConcept `json:"concept"`
+	IsExcluded         bool         `json:"isExcluded"`
+	IncludeDescendants bool         `json:"includeDescendants"`
+	IncludeMapped      bool         `json:"includeMapped"`
+}
+
+type circeConceptSet struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Expression struct {
+		Items []circeConceptSetItem `json:"items"`
+	} `json:"expression"`
+}
+
+type circeConditionOccurrence struct {
+	CodesetID              int                 `json:"CodesetId"`
+	ConditionSourceConcept int                 `json:"ConditionSourceConcept"`
+	First                  bool                `json:"First,omitempty"`
+	CorrelatedCriteria     *circeCriteriaGroup `json:"CorrelatedCriteria,omitempty"`
+}
+
+type circeCriteria struct {
+	ConditionOccurrence circeConditionOccurrence `json:"ConditionOccurrence"`
+}
+
+type circeEndpoint struct {
+	Days  *int `json:"Days,omitempty"`
+	Coeff int  `json:"Coeff"`
+}
+
+type circeWindow struct {
+	Start circeEndpoint `json:"Start"`
+	End   circeEndpoint `json:"End"`
+}
+
+type circeOccurrence struct {
+	Type  int `json:"Type"`
+	Count int `json:"Count"`
+}
+
+type circeCorrelatedCriteria struct {
+	Criteria    circeCriteria   `json:"Criteria"`
+	StartWindow circeWindow     `json:"StartWindow"`
+	Occurrence  circeOccurrence `json:"Occurrence"`
+}
+
+type circeCriteriaGroup struct {
+	Type                    string                    `json:"Type"`
+	CriteriaList            []circeCorrelatedCriteria `json:"CriteriaList"`
+	DemographicCriteriaList []struct{}                `json:"DemographicCriteriaList"`
+	Groups                  []struct{}                `json:"Groups"`
+}
+
+type circeInclusionRule struct {
+	Name       string             `json:"name"`
+	Expression circeCriteriaGroup `json:"expression"`
+}
+
+type circeLimit struct {
+	Type string `json:"Type"`
+}
+
+type circeCohortDefinition struct {
+	Title           string            `json:"title"`
+	ConceptSets     []circeConceptSet `json:"ConceptSets"`
+	PrimaryCriteria struct {
+		CriteriaList      []circeCriteria `json:"CriteriaList"`
+		ObservationWindow struct {
+			PriorDays int `json:"PriorDays"`
+			PostDays  int `json:"PostDays"`
+		} `json:"ObservationWindow"`
+		PrimaryCriteriaLimit circeLimit `json:"PrimaryCriteriaLimit"`
+	} `json:"PrimaryCriteria"`
+	QualifiedLimit    circeLimit           `json:"QualifiedLimit"`
+	ExpressionLimit   circeLimit           `json:"ExpressionLimit"`
+	InclusionRules    []circeInclusionRule `json:"InclusionRules"`
+	CensoringCriteria []struct{}           `json:"CensoringCriteria"`
+	CollapseSettings  struct {
+		CollapseType string `json:"CollapseType"`
+		EraPad       int    `json:"EraPad"`
+	} `json:"CollapseSettings"`
+	CensorWindow    struct{} `json:"CensorWindow"`
+	CdmVersionRange string   `json:"cdmVersionRange"`
+}
+
+// circeDays converts a time in years to a number of days, or nil for an unbounded time.
+func circeDays(years float64) *int {
+	if math.IsInf(years, 0) {
+		return nil
+	}
+	days := int(math.Round(years * 365.25))
+	return &days
+}
+
+// circeConceptSetFor returns the concept set of a diagnosis, cf. OMOPConcepts.Matching, and whether it has concepts.
+func circeConceptSetFor(exp *Experiment, id, did int, concepts OMOPConcepts) (circeConceptSet, bool) {
+	set := circeConceptSet{ID: id, Name: exp.NameMap[did]}
+	set.Expression.Items = []circeConceptSetItem{}
+	for _, c := range concepts.Matching(exp.IdMap[did]) {
+		// ATLAS marks non-standard concepts with N and valid concepts with V, which the CONCEPT table leaves empty
+		concept := circeConcept{ConceptID: c.ID, ConceptName: c.Name, StandardConcept: "N",
+			StandardConceptCaption: "Non-Standard", InvalidReason: "V", InvalidReasonCaption: "Valid",
+			ConceptCode: c.Code, DomainID: c.Domain, VocabularyID: c.Vocabulary, ConceptClassID: c.Class}
+		switch c.Standard {
+		case "S":
+			concept.StandardConcept, concept.StandardConceptCaption = "S", "Standard"
+		case "C":
+			concept.StandardConcept, concept.StandardConceptCaption = "C", "Classification"
+		}
+		if c.InvalidReason != "" {
+			concept.InvalidReason, concept.InvalidReasonCaption = c.InvalidReason, "Invalid"
+		}
+		set.Expression.Items = append(set.Expression.Items, circeConceptSetItem{Concept: concept})
+	}
+	return set, len(set.Expression.Items) > 0
+}
+
+// ClusterCohortDefinition returns the cohort definition of a sequence of diagnoses, e.g. the consensus of a cluster, in
+// the JSON format of ATLAS. The index event is the first occurrence of the first diagnosis, and each next diagnosis must
+// occur within the time window of the experiment after the previous one. It also returns the codes of the diagnoses
+// without OMOP concepts, for which the cohort cannot be instantiated.
+func ClusterCohortDefinition(exp *Experiment, title string, diagnoses []int, concepts OMOPConcepts) ([]byte,
+	[]string, error) {
+	if len(diagnoses) == 0 {
+		return nil, nil, fmt.Errorf("cohort %s has no diagnoses", title)
+	}
+	cohort := circeCohortDefinition{Title: title, CdmVersionRange: ">=5.0.0"}
+	missing := []string{}
+	codesets := map[int]int{}
+	for _, did := range diagnoses {
+		if _, ok := codesets[did]; ok {
+			continue
+		}
+		codesets[did] = len(cohort.ConceptSets)
+		set, ok := circeConceptSetFor(exp, len(cohort.ConceptSets), did, concepts)
+		if !ok {
+			missing = append(missing, exp.IdMap[did])
+		}
+		cohort.ConceptSets = append(cohort.ConceptSets, set)
+	}
+	occurrence := func(did int) circeConditionOccurrence {
+		return circeConditionOccurrence{CodesetID: codesets[did], ConditionSourceConcept: codesets[did]}
+	}
+	index := occurrence(diagnoses[0])
+	index.First = true
+	cohort.PrimaryCriteria.CriteriaList = []circeCriteria{{ConditionOccurrence: index}}
+	cohort.PrimaryCriteria.PrimaryCriteriaLimit = circeLimit{Type: "First"}
+	cohort.QualifiedLimit = circeLimit{Type: "First"}
+	cohort.ExpressionLimit = circeLimit{Type: "First"}
+	cohort.CollapseSettings.CollapseType = "ERA"
+	cohort.InclusionRules = []circeInclusionRule{}
+	cohort.CensoringCriteria = []struct{}{}
+	// each next diagnosis is nested as a correlated criterion of the previous one, so that its time window is relative
+	// to the previous diagnosis rather than to the index event
+	minTime, maxTime := exp.timeWindow()
+	var next *circeCriteriaGroup
+	for i := len(diagnoses) - 1; i > 0; i-- {
+		criteria := occurrence(diagnoses[i])
+		criteria.CorrelatedCriteria = next
+		next = &circeCriteriaGroup{Type: "ALL", CriteriaList: []circeCorrelatedCriteria{{
+			Criteria: circeCriteria{ConditionOccurrence: criteria},
+			StartWindow: circeWindow{Start: circeEndpoint{Days: circeDays(math.Max(0, minTime)), Coeff: 1},
+				End: circeEndpoint{Days: circeDays(maxTime), Coeff: 1}},
+			Occurrence: circeOccurrence{Type: 2, Count: 1}, // at least one occurrence
+		}}, DemographicCriteriaList: []struct{}{}, Groups: []struct{}{}}
+	}
+	if next != nil {
+		names := []string{}
+		for _, did := range diagnoses {
+			names = append(names, exp.NameMap[did])
+		}
+		cohort.InclusionRules = append(cohort.InclusionRules, circeInclusionRule{
+			Name: strings.Join(names, " -> "), Expression: *next})
+	}
+	// the titles have arrows and the version range a >, which are escaped for HTML by default
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(cohort)
+	return content.Bytes(), missing, err
+}
+
+// PrintClusterCohortDefinitionsToFiles writes the cohort definition of each cluster of an experiment to a file
+// cluster-<cid>.json in a directory, cf. ClusterCohortDefinition. The cohorts are defined by the consensus of the
+// alignments of the clusters. The directory also contains an index.tsv manifest that lists, for each cluster, the file
+// name, the number of trajectories, and the consensus diagnoses. Clusters without a consensus are left out.
+func PrintClusterCohortDefinitionsToFiles(exp *Experiment, concepts OMOPConcepts, dir string) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	index, err := utils.CreateFile(filepath.Join(dir, "index.tsv"))
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := index.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	fmt.Fprintf(index, "CID\tFile\tTrajectories\tConsensus\n")
+	clusters := CollectClusters(exp)
+	skipped := 0
+	missing := map[string]bool{}
+	for cid := 0; cid < len(clusters); cid++ {
+		diagnoses := []int{}
+		for _, c := range AlignCluster(cid, clusters[cid]).Consensus(cohortConsensusFrequency) {
+			diagnoses = append(diagnoses, c.Diagnosis)
+		}
+		if len(diagnoses) == 0 {
+			skipped++
+			continue
+		}
+		names := []string{}
+		for _, did := range diagnoses {
+			names = append(names, exp.NameMap[did])
+		}
+		content, codes, err := ClusterCohortDefinition(exp, fmt.Sprintf("%s cluster %d: %s", exp.Name, cid,
+			strings.Join(names, " -> ")), diagnoses, concepts)
+		if err != nil {
+			panic(err)
+		}
+		for _, code := range codes {
+			missing[code] = true
+		}
+		name := fmt.Sprintf("cluster-%d.json", cid)
+		file, err := utils.CreateFile(filepath.Join(dir, name))
+		if err != nil {
+			panic(err)
+		}
+		if _, err := file.Write(content); err != nil {
+			panic(err)
+		}
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(index, "%d\t%s\t%d\t%s\n", cid, name, len(clusters[cid]), strings.Join(names, " -> "))
+	}
+	if skipped > 0 {
+		utils.Warning(skipped, " clusters without a consensus have no cohort definition.")
+	}
+	if len(missing) > 0 {
+		utils.Warning("no OMOP concepts for the diagnosis codes ", strings.Join(utils.SortedKeys(missing), ", "),
+			", the cohorts with these diagnoses cannot be instantiated.")
+	}
+}
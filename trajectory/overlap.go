@@ -0,0 +1,118 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClusterOverlap describes how much the clusters of an experiment share patients, i.e. follow trajectories of several
+// clusters to their last diagnosis, cf. LastPatients. Analyses that treat the clusters as disjoint patient groups count
+// such patients once per cluster.
+type ClusterOverlap struct {
+	Clusters []int              // the cluster IDs, in increasing order
+	Shared   [][]int            // per pair of clusters, the number of patients in both, and on the diagonal, per cluster, its number of patients
+	Patients map[*Patient][]int // per patient in a cluster, the IDs of its clusters, in increasing order
+}
+
+// ClusterPatientOverlap computes the patients that the clusters of an experiment share, cf. CollectClusters. For soft
+// clustering, a patient is in all clusters of the trajectories it follows.
+func ClusterPatientOverlap(exp *Experiment) *ClusterOverlap {
+	clusters := CollectClusters(exp)
+	overlap := &ClusterOverlap{Patients: map[*Patient][]int{}}
+	for cid := range clusters {
+		overlap.Clusters = append(overlap.Clusters, cid)
+	}
+	sort.Ints(overlap.Clusters)
+	for _, cid := range overlap.Clusters {
+		covered := map[int]*Patient{}
+		addCoveredPatients(clusters[cid], covered)
+		for _, p := range covered {
+			overlap.Patients[p] = append(overlap.Patients[p], cid)
+		}
+	}
+	index := make(map[int]int, len(overlap.Clusters))
+	overlap.Shared = make([][]int, len(overlap.Clusters))
+	for i, cid := range overlap.Clusters {
+		index[cid] = i
+		overlap.Shared[i] = make([]int, len(overlap.Clusters))
+	}
+	for _, cids := range overlap.Patients {
+		for _, c1 := range cids {
+			for _, c2 := range cids {
+				overlap.Shared[index[c1]][index[c2]]++
+			}
+		}
+	}
+	return overlap
+}
+
+// Memberships returns the number of cluster memberships of the patients, i.e. the number of patients when the clusters
+// are counted as disjoint patient groups, and the number of patients in more than one cluster.
+func (o *ClusterOverlap) Memberships() (memberships, shared int) {
+	for _, cids := range o.Patients {
+		memberships += len(cids)
+		if len(cids) > 1 {
+			shared++
+		}
+	}
+	return memberships, shared
+}
+
+// PrintClusterOverlapToCSVFiles writes the patients that the clusters of an experiment share, cf.
+// ClusterPatientOverlap, to two CSV files. The first is the cluster x cluster overlap matrix, with a row per cluster,
+// and a column per cluster with the number of patients in both clusters, so that the diagonal holds the number of
+// patients of each cluster. The header is CID, followed by the cluster IDs. The second lists per patient in a cluster
+// the number of its clusters and their IDs, separated by semicolons, with the header PID,Clusters,CIDs, ordered by
+// PID. The extent of the double counting of patients across the clusters is logged.
+func PrintClusterOverlapToCSVFiles(exp *Experiment, matrixName, patientsName string) {
+	overlap := ClusterPatientOverlap(exp)
+	header := []string{"CID"}
+	for _, cid := range overlap.Clusters {
+		header = append(header, strconv.Itoa(cid))
+	}
+	records := [][]string{}
+	for i, cid := range overlap.Clusters {
+		record := []string{strconv.Itoa(cid)}
+		for _, n := range overlap.Shared[i] {
+			record = append(record, strconv.Itoa(n))
+		}
+		records = append(records, record)
+	}
+	writeCSVFile(matrixName, header, records)
+	patients := make([]*Patient, 0, len(overlap.Patients))
+	for p := range overlap.Patients {
+		patients = append(patients, p)
+	}
+	sort.Slice(patients, func(i, j int) bool { return patients[i].PID < patients[j].PID })
+	records = [][]string{}
+	for _, p := range patients {
+		cids := []string{}
+		for _, cid := range overlap.Patients[p] {
+			cids = append(cids, strconv.Itoa(cid))
+		}
+		records = append(records, []string{strconv.Itoa(p.PID), strconv.Itoa(len(cids)), strings.Join(cids, ";")})
+	}
+	writeCSVFile(patientsName, []string{"PID", "Clusters", "CIDs"}, records)
+	memberships, shared := overlap.Memberships()
+	utils.Info("The clusters count ", memberships, " patients, of which ", len(overlap.Patients),
+		" distinct patients, and ", shared, " patients are in more than one cluster.")
+}
@@ -0,0 +1,109 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"fmt"
+	"math"
+)
+
+// Person-time at risk.
+// Counting the patients with a diagnosis d2 in the exposed and the comparison groups of a diagnosis pair d1 -> d2 biases
+// the relative risk when the groups have different follow-up lengths: patients that are followed longer have more time
+// to get d2. Dividing the number of patients with d2 by the person-time at risk instead gives incidence rates, and their
+// ratio is the incidence rate ratio (IRR), which corrects for the differences in follow-up.
+
+// The denominators of the relative risks of diagnosis pairs, cf. InitializeExperimentRelativeRiskRatios.
+const (
+	RRPersonTime = "persontime" // incidence rate ratios, with the person-time at risk as denominators
+	RRCount      = "count"      // risk ratios, with the numbers of patients as denominators
+)
+
+// checkRRDenominator panics if a denominator is not one of RRPersonTime or RRCount.
+func checkRRDenominator(denominator string) {
+	if denominator != RRPersonTime && denominator != RRCount {
+		panic(fmt.Sprintf("Unknown RR denominator: %s", denominator))
+	}
+}
+
+// FollowUp returns the follow-up interval of a patient, in years: from the first diagnosis to the last diagnosis, or
+// to the date of death if that is later. Since the records only contain dates of care, this is the observed part of a
+// patient's history; the patient is right-censored at its end.
+func FollowUp(p *Patient) (float64, float64) {
+	if len(p.Diagnoses) == 0 {
+		return 0, 0
+	}
+	start := DiagnosisDateToFloat(p.Diagnoses[0].Date)
+	end := DiagnosisDateToFloat(p.Diagnoses[len(p.Diagnoses)-1].Date)
+	if p.DeathDate != nil {
+		end = math.Max(end, DiagnosisDateToFloat(*p.DeathDate))
+	}
+	return start, end
+}
+
+// exposedPersonTime returns the person-time at risk for d2 of a patient exposed to d1, in years: the time from minTime
+// after the first d1 diagnosis until the first d2 diagnosis in the time window [minTime, maxTime] after d1, the end of
+// the time window, or the end of the follow-up, whichever comes first. Only the time during the validity period of d2
+// counts, cf. ValidityPeriod.
+func exposedPersonTime(p *Patient, d1, d2 int, minTime, maxTime float64, validity ValidityPeriod) float64 {
+	d1Index := -1
+	for i, d := range p.Diagnoses {
+		if d.DID == d1 {
+			d1Index = i
+			break
+		}
+	}
+	if d1Index == -1 {
+		panic(fmt.Sprint("Disease d1: ", d1, " not present in patient when computing the person-time for d1->d2"))
+	}
+	d1Time := DiagnosisDateToFloat(p.Diagnoses[d1Index].Date)
+	_, end := FollowUp(p)
+	end = math.Min(end, d1Time+maxTime)
+	if _, i := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime); i != -1 {
+		end = math.Min(end, DiagnosisDateToFloat(p.Diagnoses[d1Index+1+i].Date))
+	}
+	return validity.overlap(d1Time+minTime, end)
+}
+
+// unexposedPersonTime returns the person-time at risk for d2 of a patient in a comparison group, in years: the time
+// from the start of the follow-up until the first d2 diagnosis or the end of the follow-up, during the validity period
+// of d2.
+func unexposedPersonTime(p *Patient, d2 int, validity ValidityPeriod) float64 {
+	start, end := FollowUp(p)
+	for _, d := range p.Diagnoses {
+		if d.DID == d2 {
+			end = DiagnosisDateToFloat(d.Date)
+			break
+		}
+	}
+	return validity.overlap(start, end)
+}
+
+// IncidenceRateRatio computes the ratio of the incidence rates of two groups, from the number of events and the
+// person-time at risk of each group. It is NaN if the exposed group has no person-time at risk, and +Inf if the
+// comparison group has no events, as for risk ratios.
+func IncidenceRateRatio(exposedEvents, exposedTime, comparisonEvents, comparisonTime float64) float64 {
+	if exposedTime <= 0 {
+		return math.NaN()
+	}
+	if comparisonTime <= 0 {
+		return math.Inf(1)
+	}
+	return (exposedEvents / exposedTime) / (comparisonEvents / comparisonTime)
+}
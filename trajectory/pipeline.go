@@ -0,0 +1,122 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package trajectory
+
+import (
+	"ptra/utils"
+	"sort"
+)
+
+// Overlapping the computation of the relative risk ratios with the selection of the diagnosis pairs. These are the only
+// stages of the pipeline that are connected: the cohorts are parsed completely before the relative risk ratios are
+// computed, extending the trajectories needs all the selected pairs, and clustering needs all the trajectories.
+
+// rrRowBuffer is the number of diagnoses for which the relative risk ratios are computed, but that are not yet taken
+// into account by the selection of the diagnosis pairs. When the buffer is full, the computation of the relative risk
+// ratios waits for the selection.
+const rrRowBuffer = 64
+
+// releasedPatients replaces the patients of diagnosis pairs that are not selected for building trajectories, cf.
+// InitializeRelativeRiskRatiosAndPairs. It is not nil, so that the pair still counts as a pair with a relative risk
+// ratio.
+var releasedPatients = []*Patient{}
+
+// InitializeRelativeRiskRatiosAndPairs computes the relative risk ratios as InitializeExperimentRelativeRiskRatios, and
+// selects the diagnosis pairs for building trajectories as BuildTrajectories, but connects both stages with a bounded
+// channel: once the relative risk ratios of two diagnoses are computed in both directions, the pair is selected or
+// rejected while the relative risk ratios of the other diagnoses are still being computed. The selected pairs are
+// stored in the experiment, in the same order as when they are selected afterwards, so that BuildTrajectories and
+// BuildTrajectoriesByChapter find the same trajectories. If release is true, the patients of the directions of pairs
+// that are not selected are released as soon as they are rejected, which lowers the peak memory usage, but they can
+// then not be saved with SaveDxDPatients anymore.
+func InitializeRelativeRiskRatiosAndPairs(exp *Experiment, minTime, maxTime float64, iter int, denominator string,
+	minPatients int, minRR float64, release bool) {
+	rows := make(chan int, rrRowBuffer)
+	selected := make(chan []*Pair)
+	go func() {
+		selected <- selectDiagnosisPairsFromRows(exp, rows, minPatients, minRR, release)
+	}()
+	initializeRelativeRiskRatios(exp, minTime, maxTime, iter, denominator, func(d1 int) {
+		rows <- d1
+	})
+	close(rows)
+	exp.Pairs = <-selected
+}
+
+// selectDiagnosisPairsFromRows selects the diagnosis pairs as selectDiagnosisPairs, for the rows of the relative risk
+// matrix in the order in which they are computed. A pair is selected when the rows of both its diagnoses are received.
+// The selected pairs are sorted in the order of selectDiagnosisPairs.
+func selectDiagnosisPairsFromRows(exp *Experiment, rows <-chan int, minPatients int, minRR float64,
+	release bool) []*Pair {
+	utils.Info("Selecting diagnosis pairs for building trajectories while computing relative risk ratios...")
+	type selection struct {
+		i, j int // the diagnoses of the pair, i < j
+		pair *Pair
+	}
+	selections := []selection{}
+	finished := []int{}
+	for d1 := range rows {
+		for _, d2 := range finished {
+			i, j := d1, d2
+			if j < i {
+				i, j = j, i
+			}
+			pair := selectDiagnosisPair(exp, i, j, minPatients, minRR)
+			if pair != nil {
+				selections = append(selections, selection{i: i, j: j, pair: pair})
+			}
+			if release {
+				releaseDiagnosisPair(exp, i, j, pair)
+				releaseDiagnosisPair(exp, j, i, pair)
+			}
+		}
+		finished = append(finished, d1)
+	}
+	sort.Slice(selections, func(k, l int) bool {
+		if selections[k].i != selections[l].i {
+			return selections[k].i < selections[l].i
+		}
+		return selections[k].j < selections[l].j
+	})
+	pairs := make([]*Pair, len(selections))
+	for k, s := range selections {
+		pairs[k] = s.pair
+	}
+	utils.Info("Found ", len(pairs), " suitable diagnosis pairs.")
+	return pairs
+}
+
+// releaseDiagnosisPair releases the patients of the diagnosis pair (d1, d2), unless that is the selected direction of
+// the pair.
+func releaseDiagnosisPair(exp *Experiment, d1, d2 int, selected *Pair) {
+	if selected != nil && selected.First == d1 && selected.Second == d2 {
+		return
+	}
+	if exp.DxDPatients[d1][d2] != nil {
+		exp.DxDPatients[d1][d2] = releasedPatients
+	}
+}
+
+// experimentPairs returns the diagnosis pairs of the experiment for building trajectories. They are selected, unless
+// they are already selected by InitializeRelativeRiskRatiosAndPairs.
+func experimentPairs(exp *Experiment, minPatients int, minRR float64) []*Pair {
+	if exp.Pairs == nil {
+		exp.Pairs = selectDiagnosisPairs(exp, minPatients, minRR)
+	}
+	return exp.Pairs
+}
@@ -0,0 +1,72 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import "math"
+
+// Querying the patients that follow the start of a trajectory, e.g. to build lists of patients that are candidates for
+// an intervention before they reach the end of a discovered trajectory.
+
+// timeWindow returns the time window between the diagnoses of the trajectories of the experiment. If it is not set,
+// e.g. because no trajectories were built for the experiment, any time between diagnoses is accepted.
+func (exp *Experiment) timeWindow() (float64, float64) {
+	if exp.MinTime == 0 && exp.MaxTime == 0 {
+		return math.Inf(-1), math.Inf(1)
+	}
+	return exp.MinTime, exp.MaxTime
+}
+
+// PatientsMatchingPrefix returns the patients whose diagnoses contain the given diagnosis IDs in order, with the time
+// between consecutive diagnoses within the time window of the experiment, cf. MinTime and MaxTime. The diagnoses are
+// matched in the same way as when the trajectories are built, so the patients that follow a trajectory up to its nth
+// diagnosis are the patients that match its first n diagnoses. The patients are sorted by PID. The experiment must
+// still have its patients, so this returns nil for experiments read back from a file.
+func (exp *Experiment) PatientsMatchingPrefix(codes []int) []*Patient {
+	if len(codes) == 0 || codes[0] < 0 || codes[0] >= len(exp.DPatients) {
+		return nil
+	}
+	minTime, maxTime := exp.timeWindow()
+	result := []*Patient{}
+	for _, p := range exp.DPatients[codes[0]] {
+		if matchesPrefix(p, codes, minTime, maxTime) {
+			result = append(result, p)
+		}
+	}
+	SortPatientsByPID(result)
+	return result
+}
+
+// matchesPrefix checks if the diagnoses of a patient contain the given diagnosis IDs in order, with the time between
+// consecutive diagnoses in the time window [minTime, maxTime], cf. PatientsMatchingPrefix.
+func matchesPrefix(p *Patient, codes []int, minTime, maxTime float64) bool {
+	idx := -1
+	for i, d := range p.Diagnoses {
+		if d.DID == codes[0] {
+			idx = i
+			break
+		}
+	}
+	for _, code := range codes[1:] {
+		if idx == -1 {
+			break
+		}
+		idx = countPatientTrajectory(p, idx, code, minTime, maxTime)
+	}
+	return idx != -1
+}
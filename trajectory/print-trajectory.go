@@ -20,34 +20,36 @@ package trajectory
 
 import (
 	"fmt"
-	"os"
+	"math"
 	"path/filepath"
 	"ptra/utils"
 	"strconv"
+	"strings"
 )
 
 // Plotting of trajectories
 
-// PrintTrajectory prints a trajectory to standard output.
+// PrintTrajectory prints a trajectory as a detail, cf. utils.Detail.
 func PrintTrajectory(t *Trajectory, exp *Experiment) {
+	var line strings.Builder
 	j := 0
 	for i, d := range t.Diagnoses {
 		dName := exp.NameMap[d]
-		fmt.Print(dName)
+		fmt.Fprint(&line, dName)
 		if i != len(t.Diagnoses)-1 {
-			fmt.Print(" -- ", t.PatientNumbers[j], " --> ")
+			fmt.Fprint(&line, " -- ", t.PatientNumbers[j], " --> ")
 		}
 		j++
 	}
-	fmt.Println(" ")
+	utils.Detail(line.String(), " ")
 }
 
 // printTrajectoriesToTabFile prints a human-readable representation of trajectories to a tab file. Per trajectory, it
 // prints two lines. A first line is a list of medical terms for diagnoses in the trajectory (in order of occurrence):
 // term1 tab term2 tab ... termn. The second line lists the number of patients for each transition in the trajectory:
-// nr1->2 tab nr2->3 tab ... nrn-1->n.
+// nr1->2 tab nr2->3 tab ... nrn-1->n. The file starts with the format line of TrajectoriesFormat.
 func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]string, name string) {
-	file, err := os.Create(name)
+	file, err := utils.CreateFile(name)
 	if err != nil {
 		panic(err)
 	}
@@ -56,7 +58,16 @@ func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]stri
 			panic(err)
 		}
 	}()
+	if err := TrajectoriesFormat.WriteHeader(file); err != nil {
+		panic(err)
+	}
+	skipped := 0
+	defer func() { WarnSkippedTrajectories(skipped, "printing "+name) }()
 	for _, trajectory := range trajectories {
+		if len(trajectory.Diagnoses) == 0 {
+			skipped++
+			continue
+		}
 		nodes := trajectory.Diagnoses
 		labels := trajectory.PatientNumbers
 		var line string
@@ -80,12 +91,44 @@ func printTrajectoriesToTabFile(trajectories []*Trajectory, nameMap map[int]stri
 	}
 }
 
+// printTrajectoryAgesToTabFile prints the trajectories in age-time to a tab file. For each trajectory, it prints two
+// lines. A first line is a list of medical terms for the diagnoses in the trajectory: term1 tab term2 tab ... termn. The
+// second line lists for each diagnosis the median age of the patients at that diagnosis, cf. MedianAgesFromTrajectory:
+// age1 tab age2 tab ... agen.
+func printTrajectoryAgesToTabFile(trajectories []*Trajectory, nameMap map[int]string, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	for _, trajectory := range trajectories {
+		if len(trajectory.Diagnoses) == 0 {
+			continue
+		}
+		terms := []string{}
+		for _, node := range trajectory.Diagnoses {
+			terms = append(terms, nameMap[node])
+		}
+		ages := []string{}
+		for _, age := range MedianAgesFromTrajectory(trajectory) {
+			ages = append(ages, utils.FormatStat(age, 1))
+		}
+		fmt.Fprintf(file, "%s\n%s\n", strings.Join(terms, "\t"), strings.Join(ages, "\t"))
+	}
+}
+
 // printPairsToTableFile prints the diagnosis pairs and the associated relative risks scores in a human-readable format
 // to a tab file. For each diagnosis pair, it prints one line that lists the medical terms for the diagnoses and the
-// relative risk score: term1 tab term2 tab RR.
+// relative risk score, and the direction of the pair, cf. Direction: term1 tab term2 tab RR tab before tab after tab
+// confidence tab p. The direction columns are empty if the direction is not known. The file starts with the format
+// line of PairsFormat.
 func printPairsToTabFile(exp *Experiment, name string) {
 	pairs := exp.Pairs
-	file, err := os.Create(name)
+	file, err := utils.CreateFile(name)
 	if err != nil {
 		panic(err)
 	}
@@ -94,9 +137,13 @@ func printPairsToTabFile(exp *Experiment, name string) {
 			panic(err)
 		}
 	}()
+	if err := PairsFormat.WriteHeader(file); err != nil {
+		panic(err)
+	}
 	for _, pair := range pairs {
-		fmt.Fprintf(file, "%s\t%s\t%s\n", exp.NameMap[pair.First], exp.NameMap[pair.Second],
-			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64))
+		d, ok := TransitionDirection(exp, pair.First, pair.Second)
+		fmt.Fprintf(file, "%s\t%s\t%s\t%s\n", exp.NameMap[pair.First], exp.NameMap[pair.Second],
+			strconv.FormatFloat(exp.DxDRR[pair.First][pair.Second], 'E', -1, 64), formatDirectionColumns(d, ok))
 	}
 }
 
@@ -109,10 +156,18 @@ func convertTrajectoriesToGraph(exp *Experiment) ([]int, [][][]int) {
 		am[i] = make([][]int, exp.NofDiagnosisCodes)
 	}
 	nodes := []int{}
+	seenNodes := utils.Set[int]{}
+	skipped := 0
+	defer func() { WarnSkippedTrajectories(skipped, "converting trajectories to a graph") }()
 	for _, traj := range trajectories {
+		if len(traj.Diagnoses) == 0 {
+			skipped++
+			continue
+		}
 		//collect nodes
 		for _, d := range traj.Diagnoses {
-			if !utils.MemberInt(d, nodes) {
+			if !seenNodes.Contains(d) {
+				seenNodes.Add(d)
 				nodes = append(nodes, d)
 			}
 		}
@@ -123,7 +178,7 @@ func convertTrajectoriesToGraph(exp *Experiment) ([]int, [][][]int) {
 			second := traj.Diagnoses[j]
 			n := traj.PatientNumbers[i]
 			if am[first][second] != nil {
-				if !utils.MemberInt(n, am[first][second]) {
+				if !utils.Member(n, am[first][second]) {
 					am[first][second] = append(am[first][second], n)
 				}
 			} else {
@@ -140,7 +195,7 @@ func convertTrajectoriesToGraph(exp *Experiment) ([]int, [][][]int) {
 // in the graph are the medical terms for the diagnoses that make up the trajectories. The edges are derived from the
 // transitions between diagnoses in the trajectories.
 func printTrajectoriesToOneGraphFile(exp *Experiment, name string) {
-	file, err := os.Create(name)
+	file, err := utils.CreateFile(name)
 	if err != nil {
 		panic(err)
 	}
@@ -173,7 +228,7 @@ func printTrajectoriesToOneGraphFile(exp *Experiment, name string) {
 
 // printTrajectoriesToIndividualGraphsFile prints each trajectory as a separate subgraph to the same GML output file.
 func printTrajectoriesToIndividualGraphsFile(exp *Experiment, name string) {
-	file, err := os.Create(name)
+	file, err := utils.CreateFile(name)
 	if err != nil {
 		panic(err)
 	}
@@ -207,7 +262,9 @@ func printTrajectoriesToIndividualGraphsFile(exp *Experiment, name string) {
 
 // PrintTrajectoriesToFile outputs an experiment's calculated trajectories to file in multiple formats:
 // - A tab file containing trajectories as lists of medical terms and lists of numbers of patients for each transition
+// - A tab file containing trajectories as lists of medical terms and lists of median ages at each diagnosis
 // - A tab file containing all disease pairs and their relative risk scores (medical terms + float for RR)
+// - A text file containing a templated narrative for each trajectory
 // - A GML file with one graph reprsenting all trajectories
 // - A GML file where each trajectory is represented as an individula subgraph
 func PrintTrajectoriesToFile(exp *Experiment, path string) {
@@ -217,37 +274,54 @@ func PrintTrajectoriesToFile(exp *Experiment, path string) {
 	// create a file that just has each trajectory as a tab seperated list of disease codes
 	tabFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories.tab", exp.Name))
 	printTrajectoriesToTabFile(exp.Trajectories, exp.NameMap, tabFileName)
+	agesFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-ages.tab", exp.Name))
+	printTrajectoryAgesToTabFile(exp.Trajectories, exp.NameMap, agesFileName)
 	tabFileName2 := filepath.Join(path, fmt.Sprintf("%s-pairs.tab", exp.Name))
 	printPairsToTabFile(exp, tabFileName2)
+	narrativesFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-narratives.txt", exp.Name))
+	printTrajectoryNarrativesToFile(exp, narrativesFileName)
 	graphFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-merged-graph.gml", exp.Name))
 	printTrajectoriesToOneGraphFile(exp, graphFileName)
 	graphsFileName := filepath.Join(path, fmt.Sprintf("%s-trajectories-individual-graphs.gml", exp.Name))
 	printTrajectoriesToIndividualGraphsFile(exp, graphsFileName)
 }
 
-// collectClusters returns a map from cluster ID to a set of trajectories that belong to that cluster
-func collectClusters(exp *Experiment) map[int][]*Trajectory {
+// CollectClusters returns a map from cluster ID to a set of trajectories that belong to that cluster. For soft
+// clustering, a trajectory belongs to all clusters it has a membership for.
+func CollectClusters(exp *Experiment) map[int][]*Trajectory {
 	clusters := map[int][]*Trajectory{}
 	for _, t := range exp.Trajectories {
-		if _, ok := clusters[t.Cluster]; ok {
-			clusters[t.Cluster] = append(clusters[t.Cluster], t)
-		} else {
-			clusters[t.Cluster] = []*Trajectory{t}
+		for _, m := range ClusterMemberships(t) {
+			clusters[m.Cluster] = append(clusters[m.Cluster], t)
 		}
 	}
 	return clusters
 }
 
+// membershipWeight returns the weight of the membership of a trajectory in a cluster, or 0 if the trajectory does not
+// belong to the cluster.
+func membershipWeight(t *Trajectory, cluster int) float64 {
+	for _, m := range ClusterMemberships(t) {
+		if m.Cluster == cluster {
+			return m.Weight
+		}
+	}
+	return 0
+}
+
 // PrintClusteredTrajectoriesToFile plots the trajectories of an experiment to a tab file, including for each trajectory
 // information about the cluster a trajectory belongs to. For each trajectory it prints 3 lines:
-// - A line with the cluster ID and the trajectory ID: CID: \tab nr \tab TID: \tab nr.
+// - A line with the cluster ID and the trajectory ID: CID: \tab nr \tab TID: \tab nr. For soft clustering, the
+// trajectory is printed for each cluster it belongs to, and the line ends with the membership weight: \tab Weight: \tab
+// nr.
 // - A list of medical terms for the diagnoses: term1 \tab term2 ...\tab termn.
 // - A list of patient numbers for the transitions between diagnosis pairs: nr1->2 \tab nr2->3 ...\tab nrn-1->n.
+// The file starts with the format line of ClusteredTrajectoriesFormat.
 func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 	//plots a line with cluster ID, trajectory ID
 	//plots a line with trajectory
 	//plots a line with trajectory labels (= nr of patients)
-	file, err := os.Create(name)
+	file, err := utils.CreateFile(name)
 	if err != nil {
 		panic(err)
 	}
@@ -256,25 +330,43 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 			panic(err)
 		}
 	}()
-	clusters := collectClusters(exp)
+	if err := ClusteredTrajectoriesFormat.WriteHeader(file); err != nil {
+		panic(err)
+	}
+	clusters := CollectClusters(exp)
+	soft := SoftClustered(exp)
+	skipped := 0
+	defer func() { WarnSkippedTrajectories(skipped, "printing "+name) }()
 	for i := 0; i < len(clusters); i++ {
 		c := clusters[i]
 		// print out metrics of the c
 		ageMean, stdev, ageEOIMean, stdev2, mCtr, fCtr := MetricsFromTrajectories(c)
+		if math.IsNaN(ageEOIMean) {
+			utils.Warning("no patients with an event of interest in cluster ", i, ", omitting EOI age statistics.")
+		}
 		line := fmt.Sprintf("CID:\t%d\tMean Age:\t%s\tStdev:\t%s\tMean Age EOI:\t%s\tStdev:\t%s\tMales:\t%d\tFemales:\t%d\tTrajectories:\t%d\n",
 			i,
-			strconv.FormatFloat(ageMean, 'f', 2, 64),
-			strconv.FormatFloat(stdev, 'f', 2, 64),
-			strconv.FormatFloat(ageEOIMean, 'f', 2, 64),
-			strconv.FormatFloat(stdev2, 'f', 2, 64), mCtr, fCtr, len(c))
+			utils.FormatStat(ageMean, 2),
+			utils.FormatStat(stdev, 2),
+			utils.FormatStat(ageEOIMean, 2),
+			utils.FormatStat(stdev2, 2), mCtr, fCtr, len(c))
 		fmt.Fprintf(file, line)
 		line = ""
 		// print the trajectories to tab file
 		for _, trajectory := range c {
+			if len(trajectory.Diagnoses) == 0 {
+				skipped++
+				continue
+			}
 			nodes := trajectory.Diagnoses
 			labels := trajectory.PatientNumbers
 			//print c and trajectory ID
-			line = fmt.Sprintf("%sCID:\t%d\tTID:\t%d\n", line, i, trajectory.ID)
+			if soft {
+				line = fmt.Sprintf("%sCID:\t%d\tTID:\t%d\tWeight:\t%.3f\n", line, i, trajectory.ID,
+					membershipWeight(trajectory, i))
+			} else {
+				line = fmt.Sprintf("%sCID:\t%d\tTID:\t%d\n", line, i, trajectory.ID)
+			}
 			fmt.Fprintf(file, line)
 			line = ""
 			//print trajectory
@@ -304,11 +396,12 @@ func PrintClusteredTrajectoriesToFile(exp *Experiment, name string) {
 // - A CSV file with patient information. The header is: PID,AgeEOI,Sex,PIDString. This represents: patient analysis id,
 // age at which the event of interest occurred, sex, and the TriNetX patient id.
 // - A CSV file with cluster information. The header is: PID,CID,TID,Age. This represents: patient id, cluster id,
-// trajectory id, and age of the patient when matching the trajectory.
+// trajectory id, and age of the patient when matching the trajectory. For soft clustering, there is a line for each
+// cluster the trajectory belongs to, and an extra Weight column with the membership weight.
 func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 	// print the patients information for this cluster to a CSV file containing:
 	// PID, Age, AgeEOI, Sex, PIDString
-	pFile, err := os.Create(pName)
+	pFile, err := utils.CreateFile(pName)
 	if err != nil {
 		panic(err)
 	}
@@ -316,8 +409,7 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 	fmt.Fprintf(pFile, "PID,AgeEOI,Sex,PIDString\n")
 	pSeen := map[int]bool{}
 	for _, t := range exp.Trajectories {
-		ps := t.Patients
-		for _, p := range ps[len(ps)-1] {
+		for _, p := range LastPatients(t) {
 			if _, ok := pSeen[p.PID]; !ok {
 				pSeen[p.PID] = true
 				ageEOI := AgeAtEOI(p)
@@ -337,7 +429,7 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 	}
 	// print the cluster information to a CSV file containing:
 	// PID,CID,TID
-	cFile, err := os.Create(cName)
+	cFile, err := utils.CreateFile(cName)
 	if err != nil {
 		panic(err)
 	}
@@ -347,12 +439,28 @@ func PrintClustersToCSVFiles(exp *Experiment, pName, cName string) {
 		}
 	}()
 	// print header
-	fmt.Fprintf(cFile, "PID,CID,TID,Age\n")
+	soft := SoftClustered(exp)
+	if soft {
+		fmt.Fprintf(cFile, "PID,CID,TID,Age,Weight\n")
+	} else {
+		fmt.Fprintf(cFile, "PID,CID,TID,Age\n")
+	}
+	skipped := 0
 	for _, t := range exp.Trajectories {
-		ps := t.Patients
-		for _, p := range ps[len(ps)-1] {
+		if len(t.Diagnoses) == 0 {
+			skipped++
+			continue
+		}
+		for _, p := range LastPatients(t) {
 			age := AgeAtDiagnosis(p, t.Diagnoses[len(t.Diagnoses)-1])
-			fmt.Fprintf(cFile, "%d,%d,%d,%d\n", p.PID, t.Cluster, t.ID, age)
+			if !soft {
+				fmt.Fprintf(cFile, "%d,%d,%d,%d\n", p.PID, t.Cluster, t.ID, age)
+				continue
+			}
+			for _, m := range t.Memberships {
+				fmt.Fprintf(cFile, "%d,%d,%d,%d,%.3f\n", p.PID, m.Cluster, t.ID, age, m.Weight)
+			}
 		}
 	}
+	WarnSkippedTrajectories(skipped, "printing "+cName)
 }
@@ -0,0 +1,362 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Reading trajectories back from the tab files written by a previous run.
+
+// nameIndex assigns diagnosis IDs to medical terms read from output files, which only contain the terms.
+type nameIndex struct {
+	ids     map[string]int
+	nameMap map[int]string
+}
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{ids: map[string]int{}, nameMap: map[int]string{}}
+}
+
+// id returns the diagnosis ID for a medical term, assigning a new ID for terms that were not seen before.
+func (index *nameIndex) id(name string) int {
+	if id, ok := index.ids[name]; ok {
+		return id
+	}
+	name = strings.Clone(name)
+	id := len(index.ids)
+	index.ids[name] = id
+	index.nameMap[id] = name
+	return id
+}
+
+// parseTrajectoryLines parses the two lines that represent a trajectory in a tab file: a line with the medical terms
+// of the diagnoses and a line with the number of patients for each transition.
+func parseTrajectoryLines(index *nameIndex, names, numbers string) (*Trajectory, error) {
+	t := &Trajectory{}
+	for _, name := range strings.Split(names, "\t") {
+		t.Diagnoses = append(t.Diagnoses, index.id(name))
+	}
+	for _, field := range strings.Split(numbers, "\t") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		t.PatientNumbers = append(t.PatientNumbers, n)
+	}
+	if len(t.PatientNumbers) != len(t.Diagnoses)-1 {
+		return nil, fmt.Errorf("%d patient numbers for %d diagnoses", len(t.PatientNumbers), len(t.Diagnoses))
+	}
+	return t, nil
+}
+
+// readLines reads all non-empty lines of a file.
+func readLines(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// ReadTrajectoriesFromTabFile reads the trajectories from a tab file written by PrintTrajectoriesToFile. Since the tab
+// file only contains the medical terms of the diagnoses, new diagnosis IDs are assigned to the terms. It returns the
+// trajectories and a name map from those diagnosis IDs to the medical terms. The patients of the trajectories are not
+// stored in the tab file and are left empty. It returns an error for a file of another format or a newer format version,
+// cf. TextFormat.
+func ReadTrajectoriesFromTabFile(name string) ([]*Trajectory, map[int]string, error) {
+	lines, err := TrajectoriesFormat.readLines(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(lines)%2 != 0 {
+		return nil, nil, fmt.Errorf("%s: expected two lines per trajectory", name)
+	}
+	index := newNameIndex()
+	trajectories := []*Trajectory{}
+	for i := 0; i < len(lines); i = i + 2 {
+		t, err := parseTrajectoryLines(index, lines[i], lines[i+1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+		}
+		t.ID = len(trajectories)
+		trajectories = append(trajectories, t)
+	}
+	return trajectories, index.nameMap, nil
+}
+
+// ClusterSummary contains the metrics of a cluster as written by PrintClusteredTrajectoriesToFile.
+type ClusterSummary struct {
+	CID                          int
+	MeanAge, StdevAge            string
+	MeanAgeEOI, StdevAgeEOI      string
+	Males, Females, Trajectories int
+}
+
+// parseClusterSummary parses the fields of a cluster header line: CID: nr Mean Age: nr Stdev: nr ...
+func parseClusterSummary(fields []string) (*ClusterSummary, error) {
+	if len(fields) < 16 {
+		return nil, fmt.Errorf("incomplete cluster header")
+	}
+	summary := &ClusterSummary{MeanAge: fields[3], StdevAge: fields[5], MeanAgeEOI: fields[7], StdevAgeEOI: fields[9]}
+	var err error
+	if summary.CID, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	if summary.Males, err = strconv.Atoi(fields[11]); err != nil {
+		return nil, err
+	}
+	if summary.Females, err = strconv.Atoi(fields[13]); err != nil {
+		return nil, err
+	}
+	if summary.Trajectories, err = strconv.Atoi(fields[15]); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// ReadClusteredTrajectoriesFromTabFile reads the clustered trajectories from a tab file written by
+// PrintClusteredTrajectoriesToFile. It returns the trajectories, with their cluster and trajectory IDs filled in, a
+// name map from newly assigned diagnosis IDs to medical terms, and the summaries of the clusters. For soft clustering,
+// a trajectory is returned for each cluster it belongs to, with the weight of that membership. The format version is
+// checked as by ReadTrajectoriesFromTabFile.
+func ReadClusteredTrajectoriesFromTabFile(name string) ([]*Trajectory, map[int]string, []*ClusterSummary, error) {
+	lines, err := ClusteredTrajectoriesFormat.readLines(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	index := newNameIndex()
+	trajectories := []*Trajectory{}
+	summaries := []*ClusterSummary{}
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Split(lines[i], "\t")
+		if len(fields) > 2 && fields[0] == "CID:" && fields[2] == "Mean Age:" {
+			summary, err := parseClusterSummary(fields)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+			}
+			summaries = append(summaries, summary)
+			continue
+		}
+		if (len(fields) != 4 && len(fields) != 6) || fields[0] != "CID:" || fields[2] != "TID:" || i+2 >= len(lines) {
+			return nil, nil, nil, fmt.Errorf("%s:%d: expected a trajectory header", name, i+1)
+		}
+		t, err := parseTrajectoryLines(index, lines[i+1], lines[i+2])
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %v", name, i+2, err)
+		}
+		if t.Cluster, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+		}
+		if t.ID, err = strconv.Atoi(fields[3]); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+		}
+		if len(fields) == 6 {
+			// soft clustering: the trajectory is listed for each of its clusters, with the membership weight
+			weight, err := strconv.ParseFloat(fields[5], 64)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+			}
+			t.Memberships = []Membership{{Cluster: t.Cluster, Weight: weight}}
+		}
+		trajectories = append(trajectories, t)
+		i = i + 2
+	}
+	return trajectories, index.nameMap, summaries, nil
+}
+
+// ReadPairsFromTabFile reads the diagnosis pairs and their relative risk scores from a tab file written by
+// PrintTrajectoriesToFile. It returns a map from the medical terms of the pairs to their RR. The format version is
+// checked as by ReadTrajectoriesFromTabFile.
+func ReadPairsFromTabFile(name string) (map[[2]string]float64, error) {
+	pairs, _, err := readPairsTabFile(name)
+	return pairs, err
+}
+
+// ReadPairDirectionsFromTabFile reads the directions of the diagnosis pairs from a tab file written by
+// PrintTrajectoriesToFile, cf. Direction. It returns a map from the medical terms of the pairs to their direction,
+// which is empty for files of format version 0 and 1, which do not have the directions.
+func ReadPairDirectionsFromTabFile(name string) (map[[2]string]Direction, error) {
+	_, directions, err := readPairsTabFile(name)
+	return directions, err
+}
+
+// readPairsTabFile reads the RRs and the directions of the diagnosis pairs from a pairs tab file. Version 2 added the
+// columns of the directions, cf. printPairsToTabFile.
+func readPairsTabFile(name string) (map[[2]string]float64, map[[2]string]Direction, error) {
+	lines, err := PairsFormat.readLines(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	pairs := map[[2]string]float64{}
+	directions := map[[2]string]Direction{}
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 && len(fields) != 7 {
+			return nil, nil, fmt.Errorf("%s:%d: expected two diagnoses, an RR, and optionally their direction", name,
+				i+1)
+		}
+		rr, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+		}
+		key := [2]string{fields[0], fields[1]}
+		pairs[key] = rr
+		if len(fields) == 7 {
+			d, ok, err := parseDirectionColumns(fields[3:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %v", name, i+1, err)
+			}
+			if ok {
+				directions[key] = d
+			}
+		}
+	}
+	return pairs, directions, nil
+}
+
+// ReadMclDumpFile reads a clustering written by mcxdump, e.g. dump.name.mci.I40 in the cluster output folder of a run.
+// The file has a line per cluster, which lists the IDs of the trajectories in the cluster. Since the output differs
+// between MCL versions, the IDs may be separated by any whitespace, commas, or semicolons, and empty fields, e.g. of
+// trailing separators, and empty lines are skipped. It returns the trajectory IDs per cluster, in the order of the
+// clusters, or an error that quotes the file and the line that cannot be parsed.
+func ReadMclDumpFile(name string) ([][]int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	clusters := [][]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := scanner.Text()
+		fields := strings.FieldsFunc(line, isMclDumpSeparator)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "(mcl") {
+			return nil, fmt.Errorf("%s:%d: %q: this is an mcl matrix file, expected the output of mcxdump", name,
+				lineNr, line)
+		}
+		ids := make([]int, len(fields))
+		for i, field := range fields {
+			if ids[i], err = strconv.Atoi(field); err != nil {
+				return nil, fmt.Errorf("%s:%d: %q: invalid trajectory ID %q", name, lineNr, line, field)
+			}
+		}
+		clusters = append(clusters, ids)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return clusters, nil
+}
+
+// isMclDumpSeparator checks if a character separates the trajectory IDs in an mcxdump file, cf. ReadMclDumpFile.
+func isMclDumpSeparator(r rune) bool {
+	return unicode.IsSpace(r) || r == ',' || r == ';'
+}
+
+// clusterHash computes a hash of the sorted trajectory IDs of a cluster.
+func clusterHash(ids []int) uint64 {
+	h := fnv.New64a()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%d\t", id)
+	}
+	return h.Sum64()
+}
+
+// SortClusters puts a clustering, given as the trajectory IDs per cluster, in a canonical order, so that the cluster
+// IDs do not depend on the order in which MCL or an external clusterer lists the clusters. The IDs within a cluster
+// are sorted, and the clusters are sorted by size, largest first, then by the hash of their IDs. Clusters with the
+// same size and hash are ordered by their IDs.
+func SortClusters(clusters [][]int) {
+	type hashedCluster struct {
+		ids  []int
+		hash uint64
+	}
+	hashed := make([]hashedCluster, len(clusters))
+	for i, ids := range clusters {
+		sort.Ints(ids)
+		hashed[i] = hashedCluster{ids: ids, hash: clusterHash(ids)}
+	}
+	sort.Slice(hashed, func(i, j int) bool {
+		a, b := hashed[i], hashed[j]
+		if len(a.ids) != len(b.ids) {
+			return len(a.ids) > len(b.ids)
+		}
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		for k := range a.ids {
+			if a.ids[k] != b.ids[k] {
+				return a.ids[k] < b.ids[k]
+			}
+		}
+		return false
+	})
+	for i, c := range hashed {
+		clusters[i] = c.ids
+	}
+}
+
+// ReadLegacyClustering loads the clustering of a run of an earlier ptra version, which only kept the trajectories tab
+// file and the mcxdump files of the clustering, into the trajectories read from that tab file, cf.
+// ReadTrajectoriesFromTabFile. The trajectory IDs in the dump file are the positions of the trajectories in the tab
+// file. It sets the Cluster of each trajectory, so that the results can be re-exported with the current writers. The
+// clusters are numbered in the canonical order of SortClusters, like those of a new run. Trajectories that do not occur
+// in the dump file are not clustered and are removed. It returns the clustered trajectories, ordered by cluster.
+func ReadLegacyClustering(dumpFile string, trajectories []*Trajectory) ([]*Trajectory, error) {
+	clusters, err := ReadMclDumpFile(dumpFile)
+	if err != nil {
+		return nil, err
+	}
+	SortClusters(clusters)
+	clustered := []*Trajectory{}
+	for cid, ids := range clusters {
+		for _, id := range ids {
+			if id < 0 || id >= len(trajectories) {
+				return nil, fmt.Errorf("%s: trajectory %d does not exist, the trajectories file has %d trajectories",
+					dumpFile, id, len(trajectories))
+			}
+			t := trajectories[id]
+			t.Cluster = cid
+			t.Memberships = nil
+			clustered = append(clustered, t)
+		}
+	}
+	return clustered, nil
+}
@@ -0,0 +1,110 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import "container/heap"
+
+// trajectoryRetention collects the trajectories that are finalized while building trajectories. Without a maximum, it
+// keeps all of them. With a maximum, cf. Experiment.MaxTrajectories, it only keeps the highest scoring trajectories that
+// pass the trajectory filters, in a bounded heap with the lowest ranked trajectory at its root, so that the trajectories
+// that cannot make the cut are dropped as soon as they are found.
+type trajectoryRetention struct {
+	max          int                // the maximum number of trajectories, 0 for no maximum
+	filters      []TrajectoryFilter // the filters that a trajectory must pass to be kept when there is a maximum
+	trajectories []*Trajectory      // the kept trajectories, ordered as a heap when there is a maximum
+	qualifying   int                // the number of trajectories that passed the filters when there is a maximum
+}
+
+// newTrajectoryRetention returns a trajectoryRetention that keeps at most max trajectories, or all trajectories if max
+// is 0.
+func newTrajectoryRetention(max int, filters []TrajectoryFilter) *trajectoryRetention {
+	return &trajectoryRetention{max: max, filters: filters, trajectories: []*Trajectory{}}
+}
+
+// Len, Less, Swap, Push, and Pop implement heap.Interface, with the lowest ranked trajectory first.
+func (r *trajectoryRetention) Len() int { return len(r.trajectories) }
+
+func (r *trajectoryRetention) Less(i, j int) bool {
+	return trajectoryBefore(r.trajectories[j], r.trajectories[i])
+}
+
+func (r *trajectoryRetention) Swap(i, j int) {
+	r.trajectories[i], r.trajectories[j] = r.trajectories[j], r.trajectories[i]
+}
+
+func (r *trajectoryRetention) Push(x interface{}) {
+	r.trajectories = append(r.trajectories, x.(*Trajectory))
+}
+
+func (r *trajectoryRetention) Pop() interface{} {
+	last := len(r.trajectories) - 1
+	t := r.trajectories[last]
+	r.trajectories[last] = nil
+	r.trajectories = r.trajectories[:last]
+	return t
+}
+
+// full returns whether the retention holds its maximum number of trajectories.
+func (r *trajectoryRetention) full() bool {
+	return r.max > 0 && len(r.trajectories) >= r.max
+}
+
+// add offers a finalized trajectory to the retention.
+func (r *trajectoryRetention) add(t *Trajectory) {
+	if r.max <= 0 {
+		r.trajectories = append(r.trajectories, t)
+		return
+	}
+	if !keepTrajectory(t, r.filters) || ValidateTrajectory(t) != nil {
+		return
+	}
+	r.qualifying++
+	r.retain(t)
+}
+
+// retain keeps a trajectory that passed the filters, if it ranks higher than the lowest ranked trajectory of a full
+// retention, which it then replaces.
+func (r *trajectoryRetention) retain(t *Trajectory) {
+	if r.full() {
+		if !trajectoryBefore(t, r.trajectories[0]) {
+			return
+		}
+		heap.Pop(r)
+	}
+	heap.Push(r, t)
+}
+
+// prunable returns whether a trajectory and all its extensions cannot be retained anymore. Extending a trajectory never
+// increases its score, so this is the case when the retention is full and the trajectory scores lower than the lowest
+// ranked trajectory.
+func (r *trajectoryRetention) prunable(t *Trajectory) bool {
+	return r.full() && trajectoryScore(t) < trajectoryScore(r.trajectories[0])
+}
+
+// merge adds the trajectories of another retention with the same maximum and filters.
+func (r *trajectoryRetention) merge(other *trajectoryRetention) {
+	if r.max <= 0 {
+		r.trajectories = append(r.trajectories, other.trajectories...)
+		return
+	}
+	r.qualifying += other.qualifying
+	for _, t := range other.trajectories {
+		r.retain(t)
+	}
+}
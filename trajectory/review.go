@@ -0,0 +1,181 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// Curating trajectories with a clinical review file. A run writes a review sheet with its trajectories, which
+// clinicians mark to accept, reject, or merge trajectories. A later run can apply the reviewed sheet, so that its
+// reports and clustering only use the curated trajectories.
+
+// The decisions of a review sheet. Trajectories without a decision are kept, as accepted trajectories.
+const (
+	ReviewAccept = "accept"
+	ReviewReject = "reject"
+	ReviewMerge  = "merge"
+)
+
+// reviewHeader is the header of a review sheet.
+var reviewHeader = []string{"Trajectory", "Patients", "Decision", "MergeInto", "Comment"}
+
+// ReviewDecision is the decision of a clinician for a trajectory, identified by the medical terms of its diagnoses,
+// separated by arrows. A merged trajectory is merged into the trajectory given by MergeInto.
+type ReviewDecision struct {
+	Trajectory, Decision, MergeInto, Comment string
+}
+
+// Review maps trajectories, identified by the medical terms of their diagnoses separated by arrows, onto their review
+// decisions.
+type Review map[string]*ReviewDecision
+
+// ReadReview reads a review sheet, cf. PrintReviewSheetToCSVFile. The header is
+// Trajectory,Patients,Decision,MergeInto,Comment. The decision is empty, accept, reject, or merge, and the case is
+// ignored. A merged trajectory needs the trajectory it is merged into in the MergeInto column. The trailing empty
+// columns may be left out.
+func ReadReview(name string) (Review, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for i, column := range reviewHeader[:3] {
+		if i >= len(header) || strings.TrimSpace(header[i]) != column {
+			return nil, fmt.Errorf("%s: the header must be %s", name, strings.Join(reviewHeader, ","))
+		}
+	}
+	review := Review{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		for len(record) < len(reviewHeader) {
+			record = append(record, "")
+		}
+		r := &ReviewDecision{Trajectory: strings.TrimSpace(record[0]),
+			Decision: strings.ToLower(strings.TrimSpace(record[2])), MergeInto: strings.TrimSpace(record[3]),
+			Comment: record[4]}
+		switch r.Decision {
+		case "", ReviewAccept, ReviewReject:
+		case ReviewMerge:
+			if r.MergeInto == "" {
+				return nil, fmt.Errorf("%s, line %d: merged trajectory %q without MergeInto", name, line, r.Trajectory)
+			}
+			if r.MergeInto == r.Trajectory {
+				return nil, fmt.Errorf("%s, line %d: trajectory %q is merged into itself", name, line, r.Trajectory)
+			}
+		default:
+			return nil, fmt.Errorf("%s, line %d: unknown decision %q, expected accept, reject, or merge", name, line,
+				r.Decision)
+		}
+		if _, ok := review[r.Trajectory]; ok {
+			return nil, fmt.Errorf("%s, line %d: trajectory %q is reviewed twice", name, line, r.Trajectory)
+		}
+		review[r.Trajectory] = r
+	}
+	return review, nil
+}
+
+// PrintReviewSheetToCSVFile prints a review sheet for the trajectories of an experiment to a csv file, cf.
+// ReadReview. The decisions, merge targets, and comments of a previous review are copied, if any, so that a review
+// can be continued over several runs. The review can be nil.
+func PrintReviewSheetToCSVFile(exp *Experiment, review Review, name string) {
+	records := [][]string{}
+	for _, t := range exp.Trajectories {
+		if len(t.Diagnoses) == 0 {
+			continue
+		}
+		record := []string{trajectoryName(t, exp.NameMap), strconv.Itoa(trajectorySupport(t)), "", "", ""}
+		if r, ok := review[record[0]]; ok {
+			record[2], record[3], record[4] = r.Decision, r.MergeInto, r.Comment
+		}
+		records = append(records, record)
+	}
+	writeCSVFile(name, reviewHeader, records)
+}
+
+// ApplyReview removes the rejected and merged trajectories from an experiment. Trajectories that are not in the
+// review are kept. A merged trajectory must be merged into a trajectory of the experiment that is kept, otherwise an
+// error is returned and the experiment is not changed. A warning is logged for the reviewed trajectories that are not
+// in the experiment, e.g. because the parameters of the run changed.
+func ApplyReview(exp *Experiment, review Review) error {
+	names := utils.Set[string]{}
+	for _, t := range exp.Trajectories {
+		names.Add(trajectoryName(t, exp.NameMap))
+	}
+	missing := 0
+	for _, r := range review {
+		if !names.Contains(r.Trajectory) {
+			missing++
+			continue
+		}
+		if r.Decision != ReviewMerge {
+			continue
+		}
+		if !names.Contains(r.MergeInto) {
+			return fmt.Errorf("trajectory %q is merged into %q, which is not a trajectory of the run", r.Trajectory,
+				r.MergeInto)
+		}
+		if target, ok := review[r.MergeInto]; ok && (target.Decision == ReviewReject || target.Decision == ReviewMerge) {
+			return fmt.Errorf("trajectory %q is merged into %q, which is marked %s", r.Trajectory, r.MergeInto,
+				target.Decision)
+		}
+	}
+	if missing > 0 {
+		utils.Warning(missing, " reviewed trajectories are not trajectories of the run.")
+	}
+	kept := []*Trajectory{}
+	rejected, merged := 0, 0
+	for _, t := range exp.Trajectories {
+		r, ok := review[trajectoryName(t, exp.NameMap)]
+		switch {
+		case ok && r.Decision == ReviewReject:
+			rejected++
+		case ok && r.Decision == ReviewMerge:
+			merged++
+		default:
+			kept = append(kept, t)
+		}
+	}
+	exp.Trajectories = kept
+	utils.Info("Applied the review: rejected ", rejected, " and merged ", merged, " trajectories, kept ", len(kept),
+		" trajectories.")
+	return nil
+}
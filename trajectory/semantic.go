@@ -0,0 +1,244 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WuPalmerSimilarity computes the Wu-Palmer semantic similarity between two diagnoses, based on their paths in the
+// vocabulary hierarchy (exp.Hierarchy): 2 * depth(lcs) / (depth(d1) + depth(d2)), where lcs is the lowest common
+// ancestor of both diagnoses, and the depth of the root of the hierarchy is 1. E.g. type 2 diabetes and diabetes with
+// renal complications share the ancestors up to diabetes, so they are similar, whereas diagnoses in different ICD10
+// chapters only share the root and are not very similar. Diagnoses without a path in the hierarchy, e.g. treatments,
+// only match themselves.
+func WuPalmerSimilarity(exp *Experiment, d1, d2 int) float64 {
+	if d1 == d2 {
+		return 1.0
+	}
+	path1, ok1 := exp.Hierarchy[d1]
+	path2, ok2 := exp.Hierarchy[d2]
+	if !ok1 || !ok2 {
+		return 0.0
+	}
+	lcs := 0
+	for lcs < len(path1) && lcs < len(path2) && path1[lcs] == path2[lcs] {
+		lcs++
+	}
+	// + 1 for the root
+	return 2 * float64(lcs+1) / float64(len(path1)+1+len(path2)+1)
+}
+
+// icd10CodePath returns the path of ancestor codes of an ICD10 code by its prefixes, from the letter of its chapter
+// down to the code itself, ignoring the dot, e.g. C, C3, C34, C341 for C34.1. It returns nil for the empty code.
+func icd10CodePath(code string) []string {
+	code = strings.ReplaceAll(strings.TrimSpace(code), ".", "")
+	path := []string{}
+	for i := 1; i <= len(code); i++ {
+		path = append(path, code[:i])
+	}
+	if len(path) == 0 {
+		return nil
+	}
+	return path
+}
+
+// ReadCodeHierarchy reads a code hierarchy from a csv file with the header Code,Parent, which maps each code to its
+// parent code. The codes without a parent, or with an empty parent, are roots. A code can only have one parent.
+func ReadCodeHierarchy(name string) (map[string]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(header) != 2 || strings.TrimSpace(header[0]) != "Code" || strings.TrimSpace(header[1]) != "Parent" {
+		return nil, fmt.Errorf("%s: the header must be Code,Parent", name)
+	}
+	parents := map[string]string{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		code, parent := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if code == "" {
+			return nil, fmt.Errorf("%s, line %d: empty code", name, line)
+		}
+		if p, ok := parents[code]; ok && p != parent {
+			return nil, fmt.Errorf("%s, line %d: code %s has two parents, %s and %s", name, line, code, p, parent)
+		}
+		parents[code] = parent
+	}
+	return parents, nil
+}
+
+// ApplyCodeHierarchy sets the paths of the diagnoses of an experiment in a code hierarchy, cf. ReadCodeHierarchy, as
+// exp.CodeHierarchy. The path of a diagnosis runs from the root of its code, cf. exp.IdMap, down to the code itself.
+// The codes that are not in the hierarchy are roots. It returns an error if the hierarchy has a cycle.
+func ApplyCodeHierarchy(exp *Experiment, parents map[string]string) error {
+	hierarchy := map[int][]string{}
+	for did, code := range exp.IdMap {
+		path := []string{}
+		seen := map[string]bool{}
+		for c := code; c != ""; c = parents[c] {
+			if seen[c] {
+				return fmt.Errorf("the code hierarchy has a cycle through %s", c)
+			}
+			seen[c] = true
+			path = append(path, c)
+		}
+		for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+			path[i], path[j] = path[j], path[i]
+		}
+		hierarchy[did] = path
+	}
+	exp.CodeHierarchy = hierarchy
+	return nil
+}
+
+// CodePath returns the path of ancestor codes of a diagnosis, in exp.CodeHierarchy, or by the prefixes of its ICD10
+// code if the experiment has no code hierarchy, cf. icd10CodePath.
+func CodePath(exp *Experiment, did int) []string {
+	if exp.CodeHierarchy != nil {
+		return exp.CodeHierarchy[did]
+	}
+	return icd10CodePath(exp.IdMap[did])
+}
+
+// AncestorSimilarity computes a partial credit for two diagnoses based on their shared ancestors in the code
+// hierarchy, cf. CodePath: 2 * shared / (depth(d1) + depth(d2)), where shared is the number of ancestors that both
+// paths start with. E.g. the sibling codes C34.1 and C34.9 share the ancestors C, C3, and C34, so they have a
+// similarity of 0.75, whereas codes in different chapters share no ancestors and have a similarity of 0. Diagnoses
+// without a code only match themselves.
+func AncestorSimilarity(exp *Experiment, d1, d2 int) float64 {
+	if d1 == d2 {
+		return 1.0
+	}
+	path1, path2 := CodePath(exp, d1), CodePath(exp, d2)
+	if len(path1) == 0 || len(path2) == 0 {
+		return 0.0
+	}
+	shared := 0
+	for shared < len(path1) && shared < len(path2) && path1[shared] == path2[shared] {
+		shared++
+	}
+	return 2 * float64(shared) / float64(len(path1)+len(path2))
+}
+
+// ReadEmbeddings reads precomputed embeddings of diagnosis codes, e.g. from cui2vec or node2vec, from a csv file with a
+// header. Each line has a code followed by the components of its embedding. The names in the header are ignored, but
+// all embeddings must have the dimension of the header.
+func ReadEmbeddings(name string) (map[string][]float64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("%s: the header must have a code column and at least one embedding column", name)
+	}
+	embeddings := map[string][]float64{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		code := strings.TrimSpace(record[0])
+		if code == "" {
+			return nil, fmt.Errorf("%s, line %d: empty code", name, line)
+		}
+		if _, ok := embeddings[code]; ok {
+			return nil, fmt.Errorf("%s, line %d: code %s has two embeddings", name, line, code)
+		}
+		embedding := make([]float64, len(record)-1)
+		for i, field := range record[1:] {
+			if embedding[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+				return nil, fmt.Errorf("%s, line %d: %v", name, line, err)
+			}
+		}
+		embeddings[code] = embedding
+	}
+	return embeddings, nil
+}
+
+// ApplyEmbeddings sets the embeddings of the diagnoses of an experiment, cf. ReadEmbeddings, as exp.Embeddings. The
+// embedding of a diagnosis is the one of its code, cf. exp.IdMap. It returns the number of diagnoses with an embedding.
+func ApplyEmbeddings(exp *Experiment, embeddings map[string][]float64) int {
+	exp.Embeddings = map[int][]float64{}
+	for did, code := range exp.IdMap {
+		if embedding, ok := embeddings[code]; ok {
+			exp.Embeddings[did] = embedding
+		}
+	}
+	return len(exp.Embeddings)
+}
+
+// EmbeddingCosineSimilarity computes the cosine similarity of the embeddings of two diagnoses, cf. ApplyEmbeddings, so
+// that rare codes that are semantically close to common codes are similar to them. Negative similarities count as 0.
+// Diagnoses without an embedding, or with a zero embedding, only match themselves.
+func EmbeddingCosineSimilarity(exp *Experiment, d1, d2 int) float64 {
+	if d1 == d2 {
+		return 1.0
+	}
+	e1, ok1 := exp.Embeddings[d1]
+	e2, ok2 := exp.Embeddings[d2]
+	if !ok1 || !ok2 {
+		return 0.0
+	}
+	dot, norm1, norm2 := 0.0, 0.0, 0.0
+	for i := range e1 {
+		dot += e1[i] * e2[i]
+		norm1 += e1[i] * e1[i]
+		norm2 += e2[i] * e2[i]
+	}
+	if norm1 == 0 || norm2 == 0 {
+		return 0.0
+	}
+	return math.Max(0, math.Min(1, dot/math.Sqrt(norm1*norm2)))
+}
@@ -0,0 +1,181 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"ptra/utils"
+	"strconv"
+
+	"github.com/exascience/pargo/parallel"
+)
+
+// Sex-specific relative risk ratios for the transitions of the trajectories. Some trajectories differ strongly between
+// males and females, which the pooled relative risk ratio of a transition hides.
+
+// maxSexSpecificPValue is the p-value below which a sex-specific relative risk ratio is significant, as for the pooled
+// relative risk ratios, cf. InitializeExperimentRelativeRiskRatios.
+const maxSexSpecificPValue = 0.001
+
+// SexSpecificRR holds the relative risk ratio of a transition d1->d2 for the patients of one sex: the number of
+// patients exposed to d1 (Exposed), the number of them that are diagnosed with d2 within the time constraints
+// (Followed), the relative risk ratio, and its p-value. The relative risk ratio is NaN when it cannot be computed, e.g.
+// when no patients of that sex are exposed to d1.
+type SexSpecificRR struct {
+	Exposed, Followed int
+	RR, PValue        float64
+}
+
+// Significant returns whether a sex-specific relative risk ratio is significant.
+func (rr SexSpecificRR) Significant() bool {
+	return !math.IsNaN(rr.RR) && rr.PValue <= maxSexSpecificPValue
+}
+
+// SexSpecificTransition holds the pooled and the sex-specific relative risk ratios of a transition of the trajectories.
+type SexSpecificTransition struct {
+	D1, D2       int
+	RR           float64
+	Male, Female SexSpecificRR
+}
+
+// sexSpecificRR computes the relative risk ratio of a diagnosis pair (d1, d2) for the patients exposed to d1 of the
+// given sex. The comparison groups are sampled from the patients of the same sex that are not exposed to d1.
+func sexSpecificRR(exp *Experiment, d1, d2, sex int, minTime, maxTime float64, iter int,
+	denominator string) SexSpecificRR {
+	exposed := []*Patient{}
+	for _, p := range exp.DPatients[d1] {
+		if p.Sex == sex {
+			exposed = append(exposed, p)
+		}
+	}
+	result := SexSpecificRR{Exposed: len(exposed), RR: math.NaN(), PValue: 1}
+	if len(exposed) == 0 {
+		return result
+	}
+	for _, p := range exposed {
+		ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime)
+		result.Followed += ctr
+	}
+	result.RR, result.PValue = sampleRelativeRiskRatio(exp, exposed, patientsToIdMap(exp.DPatients[d1]), d1, d2,
+		result.Followed, minTime, maxTime, iter, denominator)
+	return result
+}
+
+// SexSpecificRelativeRiskRatios computes the relative risk ratios of the transitions of the trajectories of an
+// experiment separately for males and females, with the same time constraints (minTime and maxTime), number of
+// iterations (iter), and denominator as the pooled relative risk ratios, cf. InitializeExperimentRelativeRiskRatios.
+// The cohorts and patients of the experiment must still be available. The transitions are sorted on their diagnoses.
+func SexSpecificRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, iter int,
+	denominator string) []*SexSpecificTransition {
+	checkRRDenominator(denominator)
+	if exp.Cohorts == nil || exp.DPatients == nil {
+		panic("The sex-specific relative risk ratios need the cohorts and patients of the experiment.")
+	}
+	edges, _ := eraEdges(exp)
+	transitions := make([]*SexSpecificTransition, len(edges))
+	stage := utils.StartStage("Calculating sex-specific relative risk ratios", len(edges))
+	parallel.Range(0, len(edges), 0, func(low, high int) {
+		for i, edge := range edges[low:high] {
+			d1, d2 := edge[0], edge[1]
+			transitions[low+i] = &SexSpecificTransition{D1: d1, D2: d2, RR: exp.DxDRR[d1][d2],
+				Male:   sexSpecificRR(exp, d1, d2, Male, minTime, maxTime, iter, denominator),
+				Female: sexSpecificRR(exp, d1, d2, Female, minTime, maxTime, iter, denominator)}
+			stage.Add(1)
+		}
+	})
+	return transitions
+}
+
+// PrintSexSpecificTransitionsToCSVFile prints the pooled and sex-specific relative risk ratios of the transitions of
+// the trajectories to a CSV file, cf. SexSpecificRelativeRiskRatios. The header is:
+// From,To,RR,Males,MalesFollowed,MaleRR,MalePValue,Females,FemalesFollowed,FemaleRR,FemalePValue,MaleFemaleRatio.
+// MaleFemaleRatio is the ratio of the male to the female relative risk ratio. Undefined values are written as NA.
+func PrintSexSpecificTransitionsToCSVFile(exp *Experiment, transitions []*SexSpecificTransition, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"From", "To", "RR", "Males", "MalesFollowed", "MaleRR", "MalePValue", "Females",
+		"FemalesFollowed", "FemaleRR", "FemalePValue", "MaleFemaleRatio"}); err != nil {
+		panic(err)
+	}
+	for _, t := range transitions {
+		record := []string{exp.NameMap[t.D1], exp.NameMap[t.D2], utils.FormatStat(t.RR, 2)}
+		for _, rr := range []SexSpecificRR{t.Male, t.Female} {
+			record = append(record, strconv.Itoa(rr.Exposed), strconv.Itoa(rr.Followed), utils.FormatStat(rr.RR, 2),
+				strconv.FormatFloat(rr.PValue, 'E', 3, 64))
+		}
+		record = append(record, utils.FormatStat(t.Male.RR/t.Female.RR, 2))
+		if err := w.Write(record); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
+
+// PrintSexSpecificGraphToFile prints a graph of the transitions of the trajectories with split edges to a GML file:
+// each transition has an edge for males and an edge for females when the relative risk ratio for that sex is
+// significant, labeled with that relative risk ratio, and colored blue for males and red for females.
+func PrintSexSpecificGraphToFile(exp *Experiment, transitions []*SexSpecificTransition, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	nodes := []int{}
+	seenNodes := map[int]bool{}
+	for _, t := range transitions {
+		for _, d := range []int{t.D1, t.D2} {
+			if !seenNodes[d] {
+				seenNodes[d] = true
+				nodes = append(nodes, d)
+			}
+		}
+	}
+	fmt.Fprintf(file, "graph [\n directed 1\nmultigraph 1\n")
+	for _, node := range nodes {
+		fmt.Fprintf(file, "node [ id %d\nlabel \"%s\"\n]\n", node, exp.NameMap[node])
+	}
+	for _, t := range transitions {
+		if t.Male.Significant() {
+			fmt.Fprintf(file, "edge [\nsource %d\ntarget %d\nlabel \"M %s\"\ngraphics [ fill \"#0000FF\" ]\n]\n",
+				t.D1, t.D2, strconv.FormatFloat(t.Male.RR, 'f', 2, 64))
+		}
+		if t.Female.Significant() {
+			fmt.Fprintf(file, "edge [\nsource %d\ntarget %d\nlabel \"F %s\"\ngraphics [ fill \"#FF0000\" ]\n]\n",
+				t.D1, t.D2, strconv.FormatFloat(t.Female.RR, 'f', 2, 64))
+		}
+	}
+	fmt.Fprintf(file, "]\n")
+}
@@ -0,0 +1,187 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A SQL view on the results of ptra runs. The results are staged as csv files, one per table, that a database such as
+// DuckDB loads, so that analysts can query the trajectories and clusters with SQL.
+
+// SQLColumn is a column of a table of the SQL view, with its SQL type.
+type SQLColumn struct {
+	Name, Type string
+}
+
+// SQLTable is a table of the SQL view, staged as a csv file with a header line.
+type SQLTable struct {
+	Name    string
+	Columns []SQLColumn
+	File    string
+}
+
+// sqlSchema defines the tables of the SQL view. Each result file that is loaded is a run, and all rows refer to the
+// run they come from.
+var sqlSchema = []SQLTable{
+	{Name: "runs", Columns: []SQLColumn{{"run", "INTEGER"}, {"name", "VARCHAR"}, {"file", "VARCHAR"},
+		{"clustered", "BOOLEAN"}, {"granularity", "INTEGER"}, {"trajectories", "INTEGER"}}},
+	{Name: "diagnoses", Columns: []SQLColumn{{"run", "INTEGER"}, {"did", "INTEGER"}, {"code", "VARCHAR"},
+		{"name", "VARCHAR"}, {"chapter", "VARCHAR"}}},
+	{Name: "trajectories", Columns: []SQLColumn{{"run", "INTEGER"}, {"tid", "INTEGER"}, {"length", "INTEGER"},
+		{"patients", "INTEGER"}, {"diagnoses", "VARCHAR"}}},
+	{Name: "transitions", Columns: []SQLColumn{{"run", "INTEGER"}, {"tid", "INTEGER"}, {"step", "INTEGER"},
+		{"from_did", "INTEGER"}, {"to_did", "INTEGER"}, {"patients", "INTEGER"}, {"rr", "DOUBLE"}}},
+	{Name: "clusters", Columns: []SQLColumn{{"run", "INTEGER"}, {"tid", "INTEGER"}, {"cid", "INTEGER"},
+		{"weight", "DOUBLE"}}},
+}
+
+// sqlFloat formats a float for a csv file of the SQL view. NaN values are written as empty fields, which are NULL.
+func sqlFloat(f float64) string {
+	if math.IsNaN(f) {
+		return ""
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sqlRows collects the rows of the tables of the SQL view for a run.
+func sqlRows(run int, file string, exp *Experiment, header *PtraHeader) map[string][][]string {
+	rows := map[string][][]string{}
+	r := strconv.Itoa(run)
+	granularity := header.Metadata["granularity"]
+	rows["runs"] = append(rows["runs"], []string{r, exp.Name, file, strconv.FormatBool(header.Clustered),
+		granularity, strconv.Itoa(len(exp.Trajectories))})
+	for _, did := range sortedDiagnosisIDs(exp.NameMap) {
+		chapter := ""
+		if h := exp.Hierarchy[did]; len(h) > 0 {
+			chapter = h[0]
+		}
+		rows["diagnoses"] = append(rows["diagnoses"], []string{r, strconv.Itoa(did), exp.IdMap[did],
+			exp.NameMap[did], chapter})
+	}
+	for _, t := range exp.Trajectories {
+		tid := strconv.Itoa(t.ID)
+		names := make([]string, len(t.Diagnoses))
+		for i, did := range t.Diagnoses {
+			names[i] = exp.NameMap[did]
+		}
+		patients := ""
+		if len(t.PatientNumbers) > 0 {
+			patients = strconv.Itoa(t.PatientNumbers[len(t.PatientNumbers)-1])
+		}
+		rows["trajectories"] = append(rows["trajectories"], []string{r, tid, strconv.Itoa(len(t.Diagnoses)),
+			patients, strings.Join(names, " -> ")})
+		for tr := range exp.Transitions(t) {
+			rows["transitions"] = append(rows["transitions"], []string{r, tid, strconv.Itoa(tr.Index),
+				strconv.Itoa(tr.From), strconv.Itoa(tr.To), strconv.Itoa(tr.NofPatients), sqlFloat(tr.RR)})
+		}
+		if header.Clustered {
+			for _, m := range ClusterMemberships(t) {
+				rows["clusters"] = append(rows["clusters"], []string{r, tid, strconv.Itoa(m.Cluster),
+					sqlFloat(m.Weight)})
+			}
+		}
+	}
+	return rows
+}
+
+// sortedDiagnosisIDs returns the diagnosis IDs of a name map in increasing order.
+func sortedDiagnosisIDs(nameMap map[int]string) []int {
+	dids := make([]int, 0, len(nameMap))
+	for did := range nameMap {
+		dids = append(dids, did)
+	}
+	sort.Ints(dids)
+	return dids
+}
+
+// WriteSQLTables reads the given .ptra files and writes the tables of the SQL view on their results as csv files in a
+// directory. The files are numbered as runs in the given order. It returns the tables with their files.
+func WriteSQLTables(dir string, files []string) ([]SQLTable, error) {
+	writers := map[string]*csv.Writer{}
+	tables := make([]SQLTable, len(sqlSchema))
+	osFiles := []*os.File{}
+	defer func() {
+		for _, f := range osFiles {
+			f.Close()
+		}
+	}()
+	for i, table := range sqlSchema {
+		table.File = filepath.Join(dir, fmt.Sprintf("%s.csv", table.Name))
+		f, err := os.Create(table.File)
+		if err != nil {
+			return nil, err
+		}
+		osFiles = append(osFiles, f)
+		w := csv.NewWriter(f)
+		columns := make([]string, len(table.Columns))
+		for j, c := range table.Columns {
+			columns[j] = c.Name
+		}
+		if err := w.Write(columns); err != nil {
+			return nil, err
+		}
+		writers[table.Name] = w
+		tables[i] = table
+	}
+	for run, file := range files {
+		exp, header, err := ReadPtraFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for name, rows := range sqlRows(run+1, file, exp, header) {
+			if err := writers[name].WriteAll(rows); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, table := range tables {
+		writers[table.Name].Flush()
+		if err := writers[table.Name].Error(); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+// sqlString quotes a string as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// DuckDBLoadScript returns a DuckDB script that (re)creates the tables of the SQL view from their csv files.
+func DuckDBLoadScript(tables []SQLTable) string {
+	var script strings.Builder
+	for _, table := range tables {
+		columns := make([]string, len(table.Columns))
+		for i, c := range table.Columns {
+			columns[i] = fmt.Sprintf("%s: %s", sqlString(c.Name), sqlString(c.Type))
+		}
+		fmt.Fprintf(&script, "CREATE OR REPLACE TABLE %s AS SELECT * FROM read_csv(%s, header = true, "+
+			"columns = {%s});\n", table.Name, sqlString(table.File), strings.Join(columns, ", "))
+	}
+	return script.String()
+}
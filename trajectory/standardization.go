@@ -0,0 +1,225 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"ptra/utils"
+	"strconv"
+	"strings"
+)
+
+// Standardizing the support for trajectories to the age and sex structure of a reference population (direct
+// standardization), so that the prevalence of trajectories can be compared across cohorts with different demographics.
+
+// ReferenceStratum is an age band and sex of a reference population, with its population size. The ages are
+// inclusive, and MaxAge is -1 for an open-ended band.
+type ReferenceStratum struct {
+	MinAge, MaxAge int
+	Sex            int
+	Population     float64
+}
+
+// contains checks if a patient of the given age and sex belongs to the stratum.
+func (s ReferenceStratum) contains(age float64, sex int) bool {
+	a := int(math.Floor(age))
+	return sex == s.Sex && a >= s.MinAge && (s.MaxAge < 0 || a <= s.MaxAge)
+}
+
+// ReadReferencePopulation reads the strata of a reference population from a CSV file with the header
+// AgeMin,AgeMax,Sex,Population, e.g. a standard population such as the European Standard Population split by sex. The
+// sex is M or F, and AgeMax may be empty for the last, open-ended age band.
+func ReadReferencePopulation(name string) ([]ReferenceStratum, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	if _, err := reader.Read(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	strata := []ReferenceStratum{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(record) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected AgeMin,AgeMax,Sex,Population", name, line)
+		}
+		s := ReferenceStratum{MaxAge: -1}
+		if s.MinAge, err = strconv.Atoi(record[0]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		if record[1] != "" {
+			if s.MaxAge, err = strconv.Atoi(record[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", name, line, err)
+			}
+		}
+		switch strings.ToUpper(record[2]) {
+		case "M":
+			s.Sex = Male
+		case "F":
+			s.Sex = Female
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown sex %s, expected M or F", name, line, record[2])
+		}
+		if s.Population, err = strconv.ParseFloat(record[3], 64); err != nil || s.Population < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid population %s", name, line, record[3])
+		}
+		strata = append(strata, s)
+	}
+	if len(strata) == 0 {
+		return nil, fmt.Errorf("%s: no strata", name)
+	}
+	return strata, nil
+}
+
+// Standardization holds the reference population and the number of cohort patients per stratum. The age of a patient
+// is the age at their first diagnosis, i.e. at the start of their follow-up. Patients outside all strata are not
+// counted.
+type Standardization struct {
+	Strata       []ReferenceStratum
+	Weights      []float64 // the share of each stratum in the reference population
+	CohortCounts []int     // the number of cohort patients per stratum
+	Unstratified int       // the number of cohort patients outside all strata
+}
+
+// patientStratum returns the index of the stratum of a patient, or -1 if the patient is outside all strata.
+func patientStratum(strata []ReferenceStratum, p *Patient) int {
+	if len(p.Diagnoses) == 0 {
+		return -1
+	}
+	age := PatientAge(p, p.Diagnoses[0].Date)
+	for i, s := range strata {
+		if s.contains(age, p.Sex) {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewStandardization counts the cohort patients per stratum of the reference population. Strata without cohort
+// patients are left out of the weights, with a warning, since no rate can be estimated for them.
+func NewStandardization(strata []ReferenceStratum, patients *PatientMap) *Standardization {
+	s := &Standardization{Strata: strata, Weights: make([]float64, len(strata)), CohortCounts: make([]int, len(strata))}
+	for _, p := range patients.PIDMap {
+		if i := patientStratum(strata, p); i >= 0 {
+			s.CohortCounts[i]++
+		} else {
+			s.Unstratified++
+		}
+	}
+	total, empty := 0.0, 0
+	for i, stratum := range strata {
+		if s.CohortCounts[i] > 0 {
+			total += stratum.Population
+		} else {
+			empty++
+		}
+	}
+	for i, stratum := range strata {
+		if s.CohortCounts[i] > 0 && total > 0 {
+			s.Weights[i] = stratum.Population / total
+		}
+	}
+	if empty > 0 {
+		utils.Warning(empty, " strata of the reference population have no patients in the cohort and are "+
+			"left out of the standardization.")
+	}
+	if s.Unstratified > 0 {
+		utils.Warning(s.Unstratified, " patients do not belong to a stratum of the reference population "+
+			"and are left out of the standardization.")
+	}
+	return s
+}
+
+// StandardizedSupport computes the crude and the directly standardized support rate of a trajectory, as the
+// percentage of the cohort that follows the full trajectory. The standardized rate is the weighted sum of the rates per
+// stratum, with the shares of the strata in the reference population as weights, with a 95% confidence interval based
+// on the normal approximation of the variance of the rates per stratum.
+func (s *Standardization) StandardizedSupport(t *Trajectory) (float64, Estimate) {
+	counts := make([]int, len(s.Strata))
+	total, support := 0, 0
+	for _, n := range s.CohortCounts {
+		total += n
+	}
+	for _, p := range LastPatients(t) {
+		if i := patientStratum(s.Strata, p); i >= 0 {
+			counts[i]++
+			support++
+		}
+	}
+	crude, _ := utils.Percentage(int64(support), int64(total))
+	if total == 0 {
+		return crude, Estimate{Value: math.NaN(), Low: math.NaN(), High: math.NaN()}
+	}
+	rate, variance := 0.0, 0.0
+	for i, n := range s.CohortCounts {
+		if n == 0 {
+			continue
+		}
+		r := float64(counts[i]) / float64(n)
+		rate += s.Weights[i] * r
+		variance += s.Weights[i] * s.Weights[i] * r * (1 - r) / float64(n)
+	}
+	se := math.Sqrt(variance)
+	return crude, Estimate{Value: 100 * rate, Low: 100 * math.Max(0, rate-1.96*se), High: 100 * math.Min(1, rate+1.96*se)}
+}
+
+// PrintStandardizedSupportToCSVFile prints the crude and standardized support rates of the trajectories of an
+// experiment to a CSV file, cf. StandardizedSupport. The trajectories are numbered from 0 in the order of the
+// trajectories tab file. The header is: TID,Trajectory,Patients,Crude%,Standardized%,StandardizedLow%,StandardizedHigh%.
+func PrintStandardizedSupportToCSVFile(exp *Experiment, s *Standardization, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"TID", "Trajectory", "Patients", "Crude%", "Standardized%", "StandardizedLow%",
+		"StandardizedHigh%"}); err != nil {
+		panic(err)
+	}
+	for i, t := range exp.Trajectories {
+		crude, standardized := s.StandardizedSupport(t)
+		if err := w.Write([]string{strconv.Itoa(i), trajectoryName(t, exp.NameMap), strconv.Itoa(len(LastPatients(t))),
+			utils.FormatStat(crude, 4), utils.FormatStat(standardized.Value, 4), utils.FormatStat(standardized.Low, 4),
+			utils.FormatStat(standardized.High, 4)}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,121 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Concurrent use of experiments. The functions that only read an experiment, e.g. the iterators, PatientsMatchingPrefix,
+// CollectClusters, and the Print functions, can be called concurrently on the same experiment. The functions that
+// change an experiment, e.g. InitializeRelativeRiskRatiosAndPairs, BuildTrajectories, AnnotateLiterature, ApplyReview,
+// and the clustering functions of the cluster package, must not be called concurrently with any other function on
+// the same experiment. An ExperimentStore publishes experiments to readers while writers build new ones.
+
+// ExperimentStore holds the latest published experiment, so that a service can serve queries over an experiment while
+// a new one is being built. A published experiment is an immutable snapshot: readers get it with Load and can use it
+// for as long as they need, while writers publish new experiments with Publish or Update.
+type ExperimentStore struct {
+	current atomic.Pointer[Experiment]
+	writer  sync.Mutex // serializes the updates
+}
+
+// NewExperimentStore creates a store that publishes an experiment, which can be nil.
+func NewExperimentStore(exp *Experiment) *ExperimentStore {
+	s := &ExperimentStore{}
+	s.current.Store(exp)
+	return s
+}
+
+// Load returns the latest published experiment, or nil if none is published. The experiment must not be changed.
+func (s *ExperimentStore) Load() *Experiment {
+	return s.current.Load()
+}
+
+// Publish makes an experiment the latest published experiment. The experiment must not be changed afterwards.
+func (s *ExperimentStore) Publish(exp *Experiment) {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	s.current.Store(exp)
+}
+
+// Update changes a copy of the latest published experiment with update, cf. Experiment.Copy, and publishes the copy if
+// update does not return an error. The readers keep using the previous experiment until the copy is published. The
+// updates are serialized, so that concurrent writers do not lose each other's changes.
+func (s *ExperimentStore) Update(update func(exp *Experiment) error) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	exp := s.current.Load().Copy()
+	if err := update(exp); err != nil {
+		return err
+	}
+	s.current.Store(exp)
+	return nil
+}
+
+// Copy returns a copy of an experiment that can be changed by the functions that change experiments without changing
+// the original, e.g. to cluster the trajectories of a published experiment again, cf. ExperimentStore.Update. The
+// trajectories with their literature matches, the pairs and their directions, and the matrices of the relative risk
+// ratios and their patients are copied; the patients, cohorts, and vocabulary maps are shared, since they are not
+// changed after parsing.
+func (exp *Experiment) Copy() *Experiment {
+	if exp == nil {
+		return nil
+	}
+	c := *exp
+	c.Trajectories = make([]*Trajectory, len(exp.Trajectories))
+	copies := make(map[*Trajectory]*Trajectory, len(exp.Trajectories))
+	for i, t := range exp.Trajectories {
+		tc := *t
+		tc.Memberships = append([]Membership(nil), t.Memberships...)
+		c.Trajectories[i] = &tc
+		copies[t] = &tc
+	}
+	if exp.Literature != nil {
+		c.Literature = LiteratureMatches{}
+		for t, known := range exp.Literature {
+			if tc, ok := copies[t]; ok {
+				c.Literature[tc] = known
+			}
+		}
+	}
+	if exp.Pairs != nil {
+		c.Pairs = append([]*Pair{}, exp.Pairs...)
+	}
+	if exp.Directions != nil {
+		c.Directions = make(PairDirections, len(exp.Directions))
+		for pair, d := range exp.Directions {
+			c.Directions[pair] = d
+		}
+	}
+	if exp.DxDRR != nil {
+		c.DxDRR = make([][]float64, len(exp.DxDRR))
+		for i, row := range exp.DxDRR {
+			c.DxDRR[i] = append([]float64(nil), row...)
+		}
+	}
+	if exp.DxDPatients != nil {
+		c.DxDPatients = make([][][]*Patient, len(exp.DxDPatients))
+		for i, row := range exp.DxDPatients {
+			c.DxDPatients[i] = append([][]*Patient(nil), row...)
+		}
+	}
+	return &c
+}
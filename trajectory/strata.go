@@ -0,0 +1,165 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"ptra/utils"
+	"sort"
+	"strconv"
+)
+
+// Discovering the trajectories separately for the patients that reach the event of interest early and late, to find
+// the trajectories that discriminate between a fast and a slow progression to the outcome.
+
+// The EOI strata, cf. EOIStrata.
+const (
+	EarlyEOI = "early"
+	LateEOI  = "late"
+)
+
+// TimeToEOI returns the time from the start of the follow-up of a patient to its event of interest, in years, cf.
+// FollowUp. It returns false for patients without an event of interest.
+func TimeToEOI(p *Patient) (float64, bool) {
+	if p.EOIDate == nil || len(p.Diagnoses) == 0 {
+		return 0, false
+	}
+	start, _ := FollowUp(p)
+	return DiagnosisDateToFloat(*p.EOIDate) - start, true
+}
+
+// EOIStrata splits the patients with an event of interest into the patients that reach it early, i.e. with a time to
+// the event of interest of at most cutoff years, cf. TimeToEOI, and the patients that reach it late. It returns the
+// analysis IDs of the patients of both strata. Patients without an event of interest are in neither stratum.
+func EOIStrata(patients *PatientMap, cutoff float64) (early, late map[int]bool) {
+	early, late = map[int]bool{}, map[int]bool{}
+	for pid, p := range patients.PIDMap {
+		if t, ok := TimeToEOI(p); ok {
+			if t <= cutoff {
+				early[pid] = true
+			} else {
+				late[pid] = true
+			}
+		}
+	}
+	return early, late
+}
+
+// StratumExperiment creates an experiment over the same diagnosis codes as the given experiment, for copies of the
+// patients of a stratum, given by their analysis IDs, e.g. an EOI stratum, cf. EOIStrata. The name of the experiment
+// is the name of the given experiment followed by -eoi- and the name of the stratum. The relative risk ratios still
+// need to be computed, as for EraExperiment.
+func StratumExperiment(exp *Experiment, patients *PatientMap, stratum string,
+	pids map[int]bool) (*Experiment, *PatientMap) {
+	return subsetExperiment(exp, patients, "eoi-"+stratum, func(p *Patient) []*Diagnosis {
+		if pids[p.PID] {
+			return p.Diagnoses
+		}
+		return nil
+	})
+}
+
+// StratumComparison compares the support for a trajectory between the early and the late EOI stratum, with the early
+// stratum as the case cohort, cf. TrajectoryComparison. Discovered is the stratum in which the trajectory is
+// discovered, or both.
+type StratumComparison struct {
+	TrajectoryComparison
+	Discovered string
+}
+
+// stratumSupport counts the patients of a stratum that follow a trajectory, with the time window of the experiment of
+// the stratum, cf. PatientsMatchingPrefix.
+func stratumSupport(exp *Experiment, patients *PatientMap, diagnoses []int) int {
+	minTime, maxTime := exp.timeWindow()
+	ctr := 0
+	for _, p := range patients.PIDMap {
+		if matchesPrefix(p, diagnoses, minTime, maxTime) {
+			ctr++
+		}
+	}
+	return ctr
+}
+
+// CompareEOIStrata compares the support for the trajectories discovered in the early and the late EOI stratum, cf.
+// StratumExperiment, between both strata. Since a trajectory may only be discovered in one stratum, the support is
+// counted for the patients of both strata, so that the trajectories that discriminate between the strata are those
+// with a low q-value. The comparisons are sorted on their q-values.
+func CompareEOIStrata(early, late *Experiment, earlyPatients, latePatients *PatientMap) []*StratumComparison {
+	comparisons := []*StratumComparison{}
+	index := map[string]*StratumComparison{}
+	for _, stratum := range []struct {
+		exp  *Experiment
+		name string
+	}{{early, EarlyEOI}, {late, LateEOI}} {
+		for _, t := range stratum.exp.Trajectories {
+			key := trajectoryKey(t.Diagnoses)
+			if c, ok := index[key]; ok {
+				c.Discovered = "both"
+				continue
+			}
+			c := &StratumComparison{TrajectoryComparison: TrajectoryComparison{Trajectory: t,
+				Case:            stratumSupport(early, earlyPatients, t.Diagnoses),
+				Comparator:      stratumSupport(late, latePatients, t.Diagnoses),
+				CaseTotal:       len(earlyPatients.PIDMap),
+				ComparatorTotal: len(latePatients.PIDMap)}, Discovered: stratum.name}
+			index[key] = c
+			comparisons = append(comparisons, c)
+		}
+	}
+	tests := make([]*TrajectoryComparison, len(comparisons))
+	for i, c := range comparisons {
+		tests[i] = &c.TrajectoryComparison
+	}
+	testComparisons(tests)
+	sort.SliceStable(comparisons, func(i, j int) bool { return comparisons[i].QValue < comparisons[j].QValue })
+	return comparisons
+}
+
+// PrintEOIStrataComparisonToCSVFile prints the comparison of the support for the trajectories between the early and
+// the late EOI stratum to a CSV file, cf. CompareEOIStrata. The header is:
+// Trajectory,Discovered,Early,Late,Early%,Late%,RR,RRLow,RRHigh,PValue,QValue.
+func PrintEOIStrataComparisonToCSVFile(exp *Experiment, comparisons []*StratumComparison, name string) {
+	file, err := utils.CreateFile(name)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"Trajectory", "Discovered", "Early", "Late", "Early%", "Late%", "RR", "RRLow",
+		"RRHigh", "PValue", "QValue"}); err != nil {
+		panic(err)
+	}
+	for _, c := range comparisons {
+		if err := w.Write([]string{trajectoryName(c.Trajectory, exp.NameMap), c.Discovered, strconv.Itoa(c.Case),
+			strconv.Itoa(c.Comparator), utils.FormatStat(c.CasePercentage, 2),
+			utils.FormatStat(c.ComparatorPercentage, 2), utils.FormatStat(c.RR.Value, 2),
+			utils.FormatStat(c.RR.Low, 2), utils.FormatStat(c.RR.High, 2),
+			strconv.FormatFloat(c.PValue, 'E', 3, 64), strconv.FormatFloat(c.QValue, 'E', 3, 64)}); err != nil {
+			panic(err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,114 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"sort"
+)
+
+// Survival after trajectories, for comparing the prognosis of the patients of clusters with Kaplan-Meier curves.
+
+// KMPoint is a step of a Kaplan-Meier curve: the estimated survival probability from the given time on, and the number
+// of patients at risk just before that time.
+type KMPoint struct {
+	Time     float64
+	Survival float64
+	AtRisk   int
+}
+
+// KaplanMeier computes the Kaplan-Meier estimate of the survival curve for the given follow-up times, where events
+// tells for each time if it is an event (e.g. death) or a censoring. The curve starts with survival 1 at time 0, and
+// has a step at each time with at least one event. Censorings at the time of an event are counted as at risk.
+func KaplanMeier(times []float64, events []bool) []KMPoint {
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return times[order[i]] < times[order[j]] })
+	curve := []KMPoint{{Time: 0, Survival: 1, AtRisk: len(times)}}
+	survival := 1.0
+	atRisk := len(times)
+	for i := 0; i < len(order); {
+		t := times[order[i]]
+		deaths, leaving := 0, 0
+		for ; i < len(order) && times[order[i]] == t; i++ {
+			if events[order[i]] {
+				deaths++
+			}
+			leaving++
+		}
+		if deaths > 0 {
+			survival *= 1 - float64(deaths)/float64(atRisk)
+			curve = append(curve, KMPoint{Time: t, Survival: survival, AtRisk: atRisk})
+		}
+		atRisk -= leaving
+	}
+	return curve
+}
+
+// KMMedian returns the median survival time of a Kaplan-Meier curve, i.e. the first time at which the survival drops
+// to 0.5 or below, and false if the curve does not reach 0.5.
+func KMMedian(curve []KMPoint) (float64, bool) {
+	for _, p := range curve {
+		if p.Survival <= 0.5 {
+			return p.Time, true
+		}
+	}
+	return 0, false
+}
+
+// SurvivalAfterTrajectories collects the survival times of the patients that follow the given trajectories to their
+// last diagnosis, in years from the completion of the trajectory to death, or to the end of the follow-up for patients
+// without a date of death, cf. FollowUp. Patients that follow several of the trajectories are counted once, from their
+// earliest completion. It returns the times, whether each time ends in death, and the number of deaths.
+func SurvivalAfterTrajectories(ts []*Trajectory) ([]float64, []bool, int) {
+	completion := map[*Patient]float64{}
+	for _, t := range ts {
+		for _, p := range LastPatients(t) {
+			dates := TrajectoryDates(p, t.Diagnoses)
+			if dates == nil {
+				continue
+			}
+			done := DiagnosisDateToFloat(dates[len(dates)-1])
+			if old, ok := completion[p]; !ok || done < old {
+				completion[p] = done
+			}
+		}
+	}
+	patients := make([]*Patient, 0, len(completion))
+	for p := range completion {
+		patients = append(patients, p)
+	}
+	SortPatientsByPID(patients)
+	times := make([]float64, len(patients))
+	events := make([]bool, len(patients))
+	deaths := 0
+	for i, p := range patients {
+		_, end := FollowUp(p)
+		if p.DeathDate != nil {
+			end = DiagnosisDateToFloat(*p.DeathDate)
+			events[i] = true
+			deaths++
+		}
+		if times[i] = end - completion[p]; times[i] < 0 {
+			times[i] = 0
+		}
+	}
+	return times, events, deaths
+}
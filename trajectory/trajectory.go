@@ -19,19 +19,17 @@
 package trajectory
 
 import (
+	"bufio"
 	"encoding/csv"
 	"fmt"
 	"github.com/exascience/pargo/parallel"
-	"github.com/valyala/fastrand"
 	"io"
 	"math"
-	"math/rand"
 	"os"
 	"ptra/utils"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
@@ -140,20 +138,32 @@ func diagnosisEqual(d1, d2 *Diagnosis) bool {
 }
 
 // CompactDiagnoses makes a sorted diagnosis list contain unique diagnoses for a patient. Want to avoid over counting diagnoses.
-func CompactDiagnoses(p *Patient) {
-	if len(p.Diagnoses) > 1 {
-		diagnoses := p.Diagnoses
-		curDiagnosis := diagnoses[0]
-		newDiagnoses := []*Diagnosis{}
-		newDiagnoses = append(newDiagnoses, curDiagnosis)
-		for _, diagnosis := range diagnoses[1:] {
-			if !diagnosisEqual(curDiagnosis, diagnosis) {
-				curDiagnosis = diagnosis
-				newDiagnoses = append(newDiagnoses, curDiagnosis)
+// Diagnoses are the same if they have the same DID and date, e.g. when they occur in several input files. It returns
+// the number of removed diagnoses.
+func CompactDiagnoses(p *Patient) int {
+	if len(p.Diagnoses) <= 1 {
+		return 0
+	}
+	newDiagnoses := []*Diagnosis{}
+	sameDate := 0 // the start of the diagnoses in newDiagnoses with the date of the current diagnosis
+	for _, diagnosis := range p.Diagnoses {
+		if len(newDiagnoses) > 0 && !diagnosisDateEqual(newDiagnoses[len(newDiagnoses)-1].Date, diagnosis.Date) {
+			sameDate = len(newDiagnoses)
+		}
+		duplicate := false
+		for _, d := range newDiagnoses[sameDate:] {
+			if diagnosisEqual(d, diagnosis) {
+				duplicate = true
+				break
 			}
 		}
-		p.Diagnoses = newDiagnoses
+		if !duplicate {
+			newDiagnoses = append(newDiagnoses, diagnosis)
+		}
 	}
+	removed := len(p.Diagnoses) - len(newDiagnoses)
+	p.Diagnoses = newDiagnoses
+	return removed
 }
 
 // PatientMap contains all patient information parsed from the input.
@@ -162,8 +172,9 @@ type PatientMap struct {
 	Ctr          int              //total nr of patients parsed, also used for creating PIDs
 	PIDMap       map[int]*Patient //maps PID onto a patient object that contain YOB, sex, age group, etc
 	// optional info for logging
-	MaleCtr   int
-	FemaleCtr int
+	MaleCtr    int
+	FemaleCtr  int
+	Exclusions []Exclusion // the patients that were dropped from the analysis, cf. PrintExclusionsToCSVFile
 }
 
 // GetPatient retrieves from a patient map the patient object associated with a given patient ID. The patient ID is
@@ -216,16 +227,30 @@ func MakeDxDPatients(size int) [][][]*Patient {
 // Experiment contains the inputs and outputs for calculating diagnosis trajectories for a specific patient population.
 type Experiment struct {
 	NofAgeGroups, NofRegions, Level, NofDiagnosisCodes int
-	DxDRR                                              [][]float64    //per disease pair, relative risk score (RR)
-	DxDPatients                                        [][][]*Patient //per disease pair, all patients diagnosed
-	DPatients                                          [][]*Patient   //per disease, all patients diagnosed
-	Cohorts                                            []*Cohort      //cohorts in the experiment
-	Name                                               string         //name of the experiment, for printing
-	NameMap                                            map[int]string // maps diagnosis ID to medical name
-	Trajectories                                       []*Trajectory  // a list of computed trajectories
-	Pairs                                              []*Pair        // a list of all selected pairs that are used to compute trajectories
-	IdMap                                              map[int]string // maps the analysis DID to the original diagnostic ID used in the input data
-	MCtr, FCtr                                         int            //counters for counting nr of males,females,patients
+	DxDRR                                              [][]float64       //per disease pair, relative risk score (RR)
+	DxDPatients                                        [][][]*Patient    //per disease pair, all patients diagnosed
+	DPatients                                          [][]*Patient      //per disease, all patients diagnosed
+	Cohorts                                            []*Cohort         //cohorts in the experiment
+	Name                                               string            //name of the experiment, for printing
+	NameMap                                            map[int]string    // maps diagnosis ID to medical name
+	Trajectories                                       []*Trajectory     // a list of computed trajectories
+	Pairs                                              []*Pair           // a list of all selected pairs that are used to compute trajectories
+	IdMap                                              map[int]string    // maps the analysis DID to the original diagnostic ID used in the input data
+	Hierarchy                                          map[int][]string  // maps the analysis DID to its path of categories in the vocabulary hierarchy, from the top category down to the DID's own medical name
+	CodeHierarchy                                      map[int][]string  // maps the analysis DID to its path of ancestor codes in a code hierarchy, from the root down to its own code, cf. ApplyCodeHierarchy, nil for the ICD10 code prefixes
+	Embeddings                                         map[int][]float64 // maps the analysis DID to the embedding of its code, cf. ApplyEmbeddings, nil without embeddings
+	MCtr, FCtr                                         int               //counters for counting nr of males,females,patients
+	PatientCtr                                         int               // the total number of patients in the cohorts, cf. CoveragePercentages
+	EOICtr                                             int               //counter for the nr of patients with an event of interest
+	MinTime, MaxTime                                   float64           // the time window between the diagnoses of the trajectories, in years, cf. BuildTrajectories
+	Literature                                         LiteratureMatches // the known trajectories that the trajectories replicate, cf. AnnotateLiterature, nil without literature
+	Validity                                           []ValidityPeriod  // per disease, the period during which it could be recorded, cf. DiagnosisValidity, nil if always valid
+	MaxTrajectories                                    int               // the maximum number of trajectories that are kept while building them, cf. BuildTrajectories, 0 for no maximum
+	ExcludedTransitions                                map[Pair]int      // the diagnosis transitions that are ignored, with their number of patients, cf. ExcludeTransitions, nil if none
+	IncidentLookback                                   float64           // if > 0, the look-back in years for the index diagnoses of the trajectories to be incident, cf. incidentIndexCase
+	IndexCases                                         []IndexCases      // per index diagnosis, the numbers of incident and prevalent patients, cf. countIndexCases, nil without a look-back
+	Messages                                           Messages          // the texts of the reports in their language, cf. ReadMessages, nil for English
+	Directions                                         PairDirections    // per selected pair, the evidence for its direction, cf. selectDiagnosisPair, nil before the pairs are selected
 }
 
 // selectCohort returns from a list of cohorts a cohort that matches a specific age group, sex, and region.
@@ -272,16 +297,34 @@ func makeCohorts(nofAgeGroups, nofRegions, nofDiagnoses int) []*Cohort {
 	return cohorts
 }
 
+// SortedPatients returns the patients of a patient map sorted by PID, so that the patient lists derived from it do not
+// depend on the iteration order of the map.
+func SortedPatients(patients *PatientMap) []*Patient {
+	sorted := make([]*Patient, 0, len(patients.PIDMap))
+	for _, p := range patients.PIDMap {
+		sorted = append(sorted, p)
+	}
+	SortPatientsByPID(sorted)
+	return sorted
+}
+
+// SortPatientsByPID sorts a list of patients by PID.
+func SortPatientsByPID(patients []*Patient) {
+	sort.Slice(patients, func(i, j int) bool {
+		return patients[i].PID < patients[j].PID
+	})
+}
+
 // InitializeCohorts creates cohorts + initializes them with the counts for each diagnosis + patients per diagnosis
 func InitializeCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofDiagnosisCodes int) []*Cohort {
-	fmt.Println("Initializing cohorts: with ", len(patients.PIDMap), " patients (Males: ", patients.MaleCtr, ""+
+	utils.Info("Initializing cohorts: with ", len(patients.PIDMap), " patients (Males: ", patients.MaleCtr, ""+
 		"Females: ", patients.FemaleCtr, ") "+
 		" nr of diagnosis codes: ", nofDiagnosisCodes, "nr of age groups: ", nofAgegroups)
-	fmt.Println("Making cohort vectors...")
+	utils.Info("Making cohort vectors...")
 	cohorts := makeCohorts(nofAgegroups, nofRegions, nofDiagnosisCodes)
 	// count occurence of diagnoses, collect patients in the cohort
-	fmt.Println("Counting diagnosis occurrences...")
-	for _, patient := range patients.PIDMap {
+	utils.Info("Counting diagnosis occurrences...")
+	for _, patient := range SortedPatients(patients) {
 		diagnoses := patient.Diagnoses
 		cohort := selectCohort(cohorts, nofAgegroups, nofRegions, patient.Sex, patient.CohortAge, patient.Region)
 		cohort.NofPatients++
@@ -305,14 +348,15 @@ func InitializeCohorts(patients *PatientMap, nofAgegroups, nofRegions, nofDiagno
 // without shuffling the input patients, which would be computationally too costly.
 func selectRandomPatientsWithoutShuffle(patients []*Patient, ctr int, patientsToExclude map[int]bool) []*Patient {
 	collectedPatients := []*Patient{}
-	maxRandSkips := utils.MaxInt(0, len(patients)-len(patientsToExclude)-ctr)
+	maxRandSkips := utils.Max(0, len(patients)-len(patientsToExclude)-ctr)
+	rng := utils.Rand().Shared()
 	for _, p := range patients {
 		if len(collectedPatients) == ctr {
 			break
 		}
 		if _, ok := patientsToExclude[p.PID]; !ok { // not a member of patients to exclude
 			if maxRandSkips > 0 {
-				if fastrand.Uint32n(2) > 0 {
+				if rng.Intn(2) > 0 {
 					collectedPatients = append(collectedPatients, p)
 				} else {
 					maxRandSkips--
@@ -437,12 +481,23 @@ func patientsToIdMap(patients []*Patient) map[int]bool {
 // experiment. It takes into account the minimum and maximum time between diagnoses (minTime and maxTime). It is an
 // iterative algorithm that runs for a given number of iterations (iter). With iter = 400, the calculated p-values are
 // within 0.05 of the true p-values and with iter = 10000 they are within 0.01 of the true p-values.
-// The relative risk ratios are calculated in parallel for all possible diagnosis pairs.
-func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, iter int) {
-	fmt.Println("Initializing relative risk ratios...")
-	fmt.Println("Sampling ", iter, " comparison groups for each diagnosis pair...")
-	// init random nr generator
-	rand.Seed(time.Now().UnixNano())
+// The relative risk ratios are calculated in parallel for all possible diagnosis pairs. With RRPersonTime as
+// denominator, they are incidence rate ratios, with the person-time at risk of the exposed and comparison groups as
+// denominators, cf. exposedPersonTime and unexposedPersonTime. With RRCount, they are risk ratios, with the numbers of
+// patients in the groups as denominators. The significance test compares the numbers of patients in both cases.
+func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, iter int, denominator string) {
+	initializeRelativeRiskRatios(exp, minTime, maxTime, iter, denominator, nil)
+}
+
+// initializeRelativeRiskRatios computes the relative risk ratios as InitializeExperimentRelativeRiskRatios. If
+// rowDone is not nil, it is called for each diagnosis d1 once the relative risk ratios and patients of all pairs
+// (d1, d2) are computed, from the goroutine that computed them. It can block to slow down the computation.
+func initializeRelativeRiskRatios(exp *Experiment, minTime, maxTime float64, iter int, denominator string,
+	rowDone func(d1 int)) {
+	checkRRDenominator(denominator)
+	utils.Info("Initializing relative risk ratios...")
+	utils.Info("Sampling ", iter, " comparison groups for each diagnosis pair...")
+	stage := utils.StartStage("Calculating relative risk ratios", exp.NofDiagnosisCodes)
 	indexVector := []int{}
 	for i := 0; i < exp.NofDiagnosisCodes; i++ {
 		indexVector = append(indexVector, i)
@@ -454,70 +509,111 @@ func InitializeExperimentRelativeRiskRatios(exp *Experiment, minTime, maxTime fl
 			if len(d1ExposedPatients) > 0 {
 				parallel.Range(0, len(indexVector), 0, func(low, high int) {
 					for _, d2 := range indexVector[low:high] {
-						// select randomly patients without d1 as a control group of same size as group 1
-						notd1ExposedPatients := selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
-						if len(d1ExposedPatients) == len(notd1ExposedPatients) {
-							// count nr of patients with d2 in the exposed group, taking into account time constraints
-							// between exposure and diagnosis d1
-							d2CtrInExposedGroup := 0
-							d1FollowedByd2Patients := []*Patient{}
-							for _, p := range d1ExposedPatients {
-								ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime)
-								if ctr > 0 {
-									d1FollowedByd2Patients = AppendPatient(d1FollowedByd2Patients, p)
-								}
-								d2CtrInExposedGroup = d2CtrInExposedGroup + ctr
-							}
-							// count nr of patients with d2 in the not exposed group
-							// take the average of this of 400 iterations; 400 iterations to get within 0.05 of the
-							// true p-value.
-							// first filter out pairs (d1, d2) with a high chance that #d2 in non exposed >= #d1->d2 in exposed
-							probd2Notd1Exposed := probNotExposed(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d2)
-							probd2d1Exposed := float64(d2CtrInExposedGroup) / float64(len(d1ExposedPatients))
-							if probd2Notd1Exposed >= probd2d1Exposed {
-								continue // skip sampling for testing d1->d2 pair because it is unlikely
-							}
-							var pval float64
-							d2CtrInNotExposedGroup := 0 // will be average if N iterations
-							for i := 0; i < iter; i++ {
-								d2Ctr := 0
-								for _, p := range notd1ExposedPatients {
-									ctr := countPatientDiagnosis(p, d2)
-									d2Ctr = d2Ctr + ctr
-									d2CtrInNotExposedGroup = d2CtrInNotExposedGroup + ctr
-								}
-								if d2Ctr >= d2CtrInExposedGroup { // if #D2 in comparison group >= #D1->D2 in exposed group, unlikely that D1->D2
-									pval++
-								}
-								notd1ExposedPatients = selectRandomPatientsFromSimilarCohorts(exp, d1ExposedPatients, d1ExposedPatientsIDMap)
-							}
-							pval = pval / float64(iter)
-							d2CtrInNotExposedGroup = d2CtrInNotExposedGroup / iter // take the average of d2s counted in all sampled non exposed groups
-							if pval > 0.001 {
-								continue // seems that #D2 in non exposed > #D1->D2 in exposed, so unlikely D1->D2
+						if excludedTransition(exp, d1, d2) {
+							continue
+						}
+						// count nr of patients with d2 in the exposed group, taking into account time constraints
+						// between exposure and diagnosis d1
+						d2CtrInExposedGroup := 0
+						d1FollowedByd2Patients := []*Patient{}
+						for _, p := range d1ExposedPatients {
+							ctr, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime)
+							if ctr > 0 {
+								// the exposed patients are distinct, so there is no need to check for duplicates
+								d1FollowedByd2Patients = append(d1FollowedByd2Patients, p)
 							}
-							// compute RR
-							a := float64(d2CtrInExposedGroup)
-							b := float64(len(d1ExposedPatients) - d2CtrInExposedGroup)
-							c := float64(d2CtrInNotExposedGroup)
-							d := float64(len(d1ExposedPatients) - d2CtrInNotExposedGroup) //take len(d1ExposedPatients) cause we want same length randomly selected groups
-							p1 := a / (a + b)
-							p2 := c / (c + d)
-							RR := p1 / p2
-							// initialize RR, d1->d2 ctrs etc
-							exp.DxDRR[d1][d2] = RR
-							exp.DxDPatients[d1][d2] = d1FollowedByd2Patients
+							d2CtrInExposedGroup = d2CtrInExposedGroup + ctr
+						}
+						// first filter out pairs (d1, d2) with a high chance that #d2 in non exposed >= #d1->d2 in exposed
+						probd2Notd1Exposed := probNotExposed(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d2)
+						probd2d1Exposed := float64(d2CtrInExposedGroup) / float64(len(d1ExposedPatients))
+						if probd2Notd1Exposed >= probd2d1Exposed {
+							continue // skip sampling for testing d1->d2 pair because it is unlikely
+						}
+						RR, pval := sampleRelativeRiskRatio(exp, d1ExposedPatients, d1ExposedPatientsIDMap, d1, d2,
+							d2CtrInExposedGroup, minTime, maxTime, iter, denominator)
+						if pval > 0.001 || math.IsNaN(RR) {
+							continue // seems that #D2 in non exposed > #D1->D2 in exposed, so unlikely D1->D2
 						}
+						// initialize RR, d1->d2 ctrs etc
+						exp.DxDRR[d1][d2] = RR
+						exp.DxDPatients[d1][d2] = d1FollowedByd2Patients
 					}
 				})
 			}
+			stage.Add(1)
+			if rowDone != nil {
+				rowDone(d1)
+			}
 		}
 	})
 }
 
+// sampleRelativeRiskRatio computes the relative risk ratio of a diagnosis pair (d1, d2) for a group of patients exposed
+// to d1 (exposed), of which d2CtrInExposedGroup are diagnosed with d2 within the time constraints, cf.
+// countPatientDiagnosisPair. It samples iter comparison groups of the same size from the patients that are not exposed
+// to d1 (exposedIDs) with the same sex, age group, and region as the exposed patients. It returns the relative risk
+// ratio and the fraction of comparison groups with at least as many patients diagnosed with d2 as the exposed group,
+// i.e. the p-value. The relative risk ratio is NaN when no comparison group of the same size can be sampled, or when
+// the exposed group has no person-time at risk, cf. InitializeExperimentRelativeRiskRatios.
+func sampleRelativeRiskRatio(exp *Experiment, exposed []*Patient, exposedIDs map[int]bool, d1, d2,
+	d2CtrInExposedGroup int, minTime, maxTime float64, iter int, denominator string) (float64, float64) {
+	// select randomly patients without d1 as a control group of same size as group 1
+	notd1ExposedPatients := selectRandomPatientsFromSimilarCohorts(exp, exposed, exposedIDs)
+	if len(exposed) != len(notd1ExposedPatients) {
+		return math.NaN(), 1
+	}
+	personTime := denominator == RRPersonTime
+	// count nr of patients with d2 in the not exposed group
+	// take the average of this of 400 iterations; 400 iterations to get within 0.05 of the
+	// true p-value.
+	var pval float64
+	// 64-bit, because this sums over all iterations: #patients x iter can overflow 32 bits
+	var d2CtrInNotExposedGroup int64 // will be average if N iterations
+	notExposedTime := 0.0            // person-time at risk, summed over all iterations
+	for i := 0; i < iter; i++ {
+		d2Ctr := 0
+		for _, p := range notd1ExposedPatients {
+			ctr := countPatientDiagnosis(p, d2)
+			d2Ctr = d2Ctr + ctr
+			d2CtrInNotExposedGroup = d2CtrInNotExposedGroup + int64(ctr)
+			if personTime {
+				notExposedTime += unexposedPersonTime(p, d2, exp.validity(d2))
+			}
+		}
+		if d2Ctr >= d2CtrInExposedGroup { // if #D2 in comparison group >= #D1->D2 in exposed group, unlikely that D1->D2
+			pval++
+		}
+		notd1ExposedPatients = selectRandomPatientsFromSimilarCohorts(exp, exposed, exposedIDs)
+	}
+	pval = pval / float64(iter)
+	d2CtrInNotExposedGroup = d2CtrInNotExposedGroup / int64(iter) // take the average of d2s counted in all sampled non exposed groups
+	// compute RR
+	a := float64(d2CtrInExposedGroup)
+	b := float64(len(exposed) - d2CtrInExposedGroup)
+	c := float64(d2CtrInNotExposedGroup)
+	d := float64(int64(len(exposed)) - d2CtrInNotExposedGroup) //take len(exposed) cause we want same length randomly selected groups
+	p1 := a / (a + b)
+	p2 := c / (c + d)
+	RR := p1 / p2
+	if personTime {
+		exposedTime := 0.0
+		for _, p := range exposed {
+			exposedTime += exposedPersonTime(p, d1, d2, minTime, maxTime, exp.validity(d2))
+		}
+		// the average person-time of the sampled comparison groups, as for the counts
+		RR = IncidenceRateRatio(a, exposedTime, c, notExposedTime/float64(iter))
+	}
+	return RR, pval
+}
+
 // LoadRRMatrix loads an RR matrix from file and stores it in the given experiment. This file was created from a
-// previous run. This can be used instead of initializeRelativeRiskRatiosParallel
+// previous run. This can be used instead of initializeRelativeRiskRatiosParallel. The format version of the file is
+// checked, cf. TextFormat.
 func LoadRRMatrix(exp *Experiment, path string) {
+	if err := ValidateExperiment(exp); err != nil {
+		panic(fmt.Errorf("loading the RR matrix %s: %v", path, err))
+	}
 	//reverse the exp name map
 	nameMapReversed := map[string]int{}
 	for i, name := range exp.NameMap {
@@ -532,7 +628,11 @@ func LoadRRMatrix(exp *Experiment, path string) {
 			panic(err)
 		}
 	}()
-	reader := csv.NewReader(file)
+	br := bufio.NewReader(file)
+	if err := RRMatrixFormat.skipHeader(path, br); err != nil {
+		panic(err)
+	}
+	reader := csv.NewReader(br)
 	reader.Comma = '\t'
 	for {
 		record, err := reader.Read()
@@ -542,8 +642,11 @@ func LoadRRMatrix(exp *Experiment, path string) {
 		if err != nil {
 			panic(err)
 		}
-		d1 := nameMapReversed[record[0]]
-		d2 := nameMapReversed[record[1]]
+		d1, ok1 := nameMapReversed[record[0]]
+		d2, ok2 := nameMapReversed[record[1]]
+		if !ok1 || !ok2 {
+			continue // diagnosis codes that do not occur in this cohort
+		}
 		RR, err := strconv.ParseFloat(record[2], 64)
 		if err != nil {
 			panic(err)
@@ -577,7 +680,11 @@ func LoadDxDPatients(exp *Experiment, pMap *PatientMap, path string) {
 			panic(err)
 		}
 	}()
-	reader := csv.NewReader(file)
+	br := bufio.NewReader(file)
+	if err := DxDPatientsFormat.skipHeader(path, br); err != nil {
+		panic(err)
+	}
+	reader := csv.NewReader(br)
 	reader.Comma = '\t'
 	for {
 		record, err := reader.Read()
@@ -587,8 +694,11 @@ func LoadDxDPatients(exp *Experiment, pMap *PatientMap, path string) {
 		if err != nil {
 			panic(err)
 		}
-		d1 := nameMapReversed[record[0]]
-		d2 := nameMapReversed[record[1]]
+		d1, ok1 := nameMapReversed[record[0]]
+		d2, ok2 := nameMapReversed[record[1]]
+		if !ok1 || !ok2 {
+			continue // diagnosis codes that do not occur in this cohort
+		}
 		pidStrings := strings.Split(record[2], ",")
 		for _, pidString := range pidStrings {
 			pid := pMap.PIDStringMap[pidString]
@@ -599,9 +709,9 @@ func LoadDxDPatients(exp *Experiment, pMap *PatientMap, path string) {
 }
 
 // SaveRRMatrix stores the RR matrix calculated for the given experiment. The diagnosis pairs from the matrix are
-// stored line per line as follows: medical name 1, medical name 2, RR.
+// stored line per line as follows: medical name 1, medical name 2, RR, after the format line of RRMatrixFormat.
 func SaveRRMatrix(exp *Experiment, path string) {
-	file, err := os.Create(path)
+	file, err := utils.CreateFile(path)
 	if err != nil {
 		panic(err)
 	}
@@ -610,6 +720,9 @@ func SaveRRMatrix(exp *Experiment, path string) {
 			panic(err)
 		}
 	}()
+	if err := RRMatrixFormat.WriteHeader(file); err != nil {
+		panic(err)
+	}
 	for i, js := range exp.DxDRR {
 		for j, RR := range js {
 			fmt.Fprintf(file, "%s\t%s\t%s\n", exp.NameMap[i], exp.NameMap[j],
@@ -618,9 +731,10 @@ func SaveRRMatrix(exp *Experiment, path string) {
 	}
 }
 
-// SaveDPatients saves per disease the PIDs that are diagnosed with this disease
+// SaveDPatients saves per disease the PIDs that are diagnosed with this disease, after the format line of
+// DxDPatientsFormat.
 func SaveDxDPatients(exp *Experiment, path string) {
-	file, err := os.Create(path)
+	file, err := utils.CreateFile(path)
 	if err != nil {
 		panic(err)
 	}
@@ -629,6 +743,9 @@ func SaveDxDPatients(exp *Experiment, path string) {
 			panic(err)
 		}
 	}()
+	if err := DxDPatientsFormat.WriteHeader(file); err != nil {
+		panic(err)
+	}
 	for i, js := range exp.DxDPatients {
 		for k, ps := range js {
 			if len(js) > 0 {
@@ -664,21 +781,22 @@ func MergeCohorts(cohorts []*Cohort) *Cohort {
 			}
 		}
 	}
-	fmt.Println("Merged cohort")
-	PrintCohort(cohort1, utils.MinInt(len(cohort1.DCtr), 22))
+	utils.Detail("Merged cohort")
+	PrintCohort(cohort1, utils.Min(len(cohort1.DCtr), 22))
 	return cohort1
 }
 
-// PrintCohort prints a cohort to standard output.
+// PrintCohort prints a cohort as a detail, cf. utils.Detail.
 func PrintCohort(cohort *Cohort, max int) {
-	fmt.Println("Cohort: ")
-	fmt.Println("Age group: ", cohort.AgeGroup, " Sex: ", cohort.Sex, " Region: ", cohort.Region, " Nr of patients: ", cohort.NofPatients, " "+
+	utils.Detail("Cohort: ")
+	utils.Detail("Age group: ", cohort.AgeGroup, " Sex: ", cohort.Sex, " Region: ", cohort.Region, " Nr of patients: ", cohort.NofPatients, " "+
 		"Nr of diagnoses: ", cohort.NofDiagnoses)
-	fmt.Println("DCtr: [")
+	var counts strings.Builder
 	for i := 0; i < max; i++ {
-		fmt.Print(cohort.DCtr[i], ", ")
+		fmt.Fprint(&counts, cohort.DCtr[i], ", ")
 	}
-	fmt.Println("...]")
+	utils.Detail("DCtr: [")
+	utils.Detail(counts.String(), "...]")
 }
 
 // Pair is a struct for representing a diagnosis pair. It simply stores two diagnosis codes.
@@ -689,46 +807,65 @@ type Pair struct {
 // selectDiagnosisPairs selects diagnosis pairs from which to calculate trajectories. These pairs are constrained by
 // requiring a minimum number of patients that is diagnosed with the disease pair, and a minimum RR score.
 func selectDiagnosisPairs(exp *Experiment, minPatients int, minRR float64) []*Pair {
-	fmt.Println("Selecting diagnosis pairs for building trajectories...")
+	utils.Info("Selecting diagnosis pairs for building trajectories...")
 	pairs := []*Pair{}
 	nofDiagnosisCodes := len(exp.NameMap)
 	for i := 0; i < nofDiagnosisCodes; i++ {
-		for j := i; j < nofDiagnosisCodes; j++ {
-			occurs := len(exp.DxDPatients[i][j])
-			occursReverse := len(exp.DxDPatients[j][i])
-			RR := exp.DxDRR[i][j]
-			RRReverse := exp.DxDRR[j][i]
-			if i != j {
-				if occurs >= minPatients && RR > minRR && occursReverse >= minPatients && RRReverse > minRR {
-					var maxOccurs int
-					var maxIndices *Pair
-					if occurs > occursReverse {
-						maxOccurs = occurs
-						maxIndices = &Pair{First: i, Second: j}
-					} else {
-						maxOccurs = occursReverse
-						maxIndices = &Pair{First: j, Second: i}
-					}
-					test := utils.BinomialCdf(0.5, occurs+occursReverse, maxOccurs)
-					if test < 0.05 {
-						pairs = append(pairs, maxIndices)
-					}
-					continue
-				}
-				if occurs >= minPatients && RR > minRR {
-					pairs = append(pairs, &Pair{First: i, Second: j})
-					continue
-				}
-				if occursReverse >= minPatients && RRReverse > minRR {
-					pairs = append(pairs, &Pair{First: j, Second: i})
-				}
+		for j := i + 1; j < nofDiagnosisCodes; j++ {
+			if pair := selectDiagnosisPair(exp, i, j, minPatients, minRR); pair != nil {
+				pairs = append(pairs, pair)
 			}
 		}
 	}
-	fmt.Println("Found ", len(pairs), " suitable diagnosis pairs.")
+	utils.Info("Found ", len(pairs), " suitable diagnosis pairs.")
 	return pairs
 }
 
+// selectDiagnosisPair selects the direction of the diagnoses i and j, with i < j, for building trajectories, cf.
+// selectDiagnosisPairs. It returns nil if neither direction is suitable. An excluded direction, cf.
+// ExcludeTransitions, is never suitable. The direction of a selected pair is recorded in the experiment, cf.
+// Experiment.Directions.
+func selectDiagnosisPair(exp *Experiment, i, j, minPatients int, minRR float64) *Pair {
+	occurs := len(exp.DxDPatients[i][j])
+	occursReverse := len(exp.DxDPatients[j][i])
+	if excludedTransition(exp, i, j) {
+		occurs = 0
+	}
+	if excludedTransition(exp, j, i) {
+		occursReverse = 0
+	}
+	RR := exp.DxDRR[i][j]
+	RRReverse := exp.DxDRR[j][i]
+	if occurs >= minPatients && RR > minRR && occursReverse >= minPatients && RRReverse > minRR {
+		var maxOccurs int
+		var maxIndices *Pair
+		if occurs > occursReverse {
+			maxOccurs = occurs
+			maxIndices = &Pair{First: i, Second: j}
+		} else {
+			maxOccurs = occursReverse
+			maxIndices = &Pair{First: j, Second: i}
+		}
+		test := utils.Stats().BinomialCdf(0.5, occurs+occursReverse, maxOccurs)
+		if test < 0.05 {
+			recordDirection(exp, maxIndices, maxOccurs, occurs+occursReverse-maxOccurs)
+			return maxIndices
+		}
+		return nil
+	}
+	if occurs >= minPatients && RR > minRR {
+		pair := &Pair{First: i, Second: j}
+		recordDirection(exp, pair, occurs, occursReverse)
+		return pair
+	}
+	if occursReverse >= minPatients && RRReverse > minRR {
+		pair := &Pair{First: j, Second: i}
+		recordDirection(exp, pair, occursReverse, occurs)
+		return pair
+	}
+	return nil
+}
+
 // Trajectory holds all data relevant to a disease trajectory.
 type Trajectory struct {
 	Diagnoses      []int            // A list of diagnosis codes that represent the trajectory
@@ -737,6 +874,170 @@ type Trajectory struct {
 	TrajMap        map[*Patient]int //Maps patient IDs onto a diagnosis index for trajectory tracking
 	ID             int              // An analysis id
 	Cluster        int              //A cluster ID to which this trajectory is assigned to
+	Memberships    []Membership     // For soft clustering, the clusters this trajectory belongs to, nil otherwise
+	EOIEnrichments []float64        // For trajectories read from a .ptra file, the EOI enrichment per transition, nil otherwise
+}
+
+// ValidateTrajectory checks that a trajectory has at least one diagnosis, and a patient number for each transition.
+func ValidateTrajectory(t *Trajectory) error {
+	if len(t.Diagnoses) == 0 {
+		return fmt.Errorf("trajectory %d has no diagnoses", t.ID)
+	}
+	if len(t.PatientNumbers) != len(t.Diagnoses)-1 {
+		return fmt.Errorf("trajectory %d has %d patient numbers for %d diagnoses", t.ID, len(t.PatientNumbers),
+			len(t.Diagnoses))
+	}
+	return nil
+}
+
+// ValidateDiagnosisID checks that a diagnosis ID referenced by an experiment is below its NofDiagnosisCodes and has a
+// medical term in its NameMap.
+func ValidateDiagnosisID(exp *Experiment, did int) error {
+	if did < 0 || did >= exp.NofDiagnosisCodes {
+		return fmt.Errorf("diagnosis ID %d is out of range, the experiment has %d diagnosis codes", did,
+			exp.NofDiagnosisCodes)
+	}
+	if _, ok := exp.NameMap[did]; !ok {
+		return fmt.Errorf("diagnosis ID %d has no medical term", did)
+	}
+	return nil
+}
+
+// ValidateExperiment checks that the diagnosis IDs of an experiment match its NofDiagnosisCodes: the NameMap has a
+// medical term for each ID below NofDiagnosisCodes and for no other IDs, the diagnosis matrices have NofDiagnosisCodes
+// rows and columns, and the pairs and trajectories only refer to valid IDs, cf. ValidateDiagnosisID. This catches an
+// experiment that does not match its inputs, e.g. an RR matrix of a run at another level, with the offending ID,
+// instead of an index out of range deep in a writer.
+func ValidateExperiment(exp *Experiment) error {
+	for did := range exp.NameMap {
+		if did < 0 || did >= exp.NofDiagnosisCodes {
+			return fmt.Errorf("the name map has diagnosis ID %d, the experiment has %d diagnosis codes", did,
+				exp.NofDiagnosisCodes)
+		}
+	}
+	if len(exp.NameMap) != exp.NofDiagnosisCodes {
+		for did := 0; did < exp.NofDiagnosisCodes; did++ {
+			if err := ValidateDiagnosisID(exp, did); err != nil {
+				return err
+			}
+		}
+	}
+	if exp.DxDRR != nil {
+		if len(exp.DxDRR) != exp.NofDiagnosisCodes {
+			return fmt.Errorf("the RR matrix has %d rows, the experiment has %d diagnosis codes", len(exp.DxDRR),
+				exp.NofDiagnosisCodes)
+		}
+		for did, row := range exp.DxDRR {
+			if len(row) != exp.NofDiagnosisCodes {
+				return fmt.Errorf("row %d of the RR matrix has %d columns, the experiment has %d diagnosis codes",
+					did, len(row), exp.NofDiagnosisCodes)
+			}
+		}
+	}
+	if exp.DxDPatients != nil && len(exp.DxDPatients) != exp.NofDiagnosisCodes {
+		return fmt.Errorf("the DxD patients have %d rows, the experiment has %d diagnosis codes",
+			len(exp.DxDPatients), exp.NofDiagnosisCodes)
+	}
+	if exp.DPatients != nil && len(exp.DPatients) != exp.NofDiagnosisCodes {
+		return fmt.Errorf("the patients per diagnosis have %d entries, the experiment has %d diagnosis codes",
+			len(exp.DPatients), exp.NofDiagnosisCodes)
+	}
+	for _, pair := range exp.Pairs {
+		for _, did := range []int{pair.First, pair.Second} {
+			if err := ValidateDiagnosisID(exp, did); err != nil {
+				return fmt.Errorf("pair %d -> %d: %v", pair.First, pair.Second, err)
+			}
+		}
+	}
+	for i, t := range exp.Trajectories {
+		for _, did := range t.Diagnoses {
+			if err := ValidateDiagnosisID(exp, did); err != nil {
+				return fmt.Errorf("trajectory %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateClusters checks that the trajectory IDs of a clustering, e.g. read from an mcxdump file, are valid positions
+// in the trajectories of an experiment.
+func ValidateClusters(exp *Experiment, clusters [][]int) error {
+	for cid, ids := range clusters {
+		for _, id := range ids {
+			if id < 0 || id >= len(exp.Trajectories) {
+				return fmt.Errorf("cluster %d has trajectory %d, the experiment has %d trajectories", cid, id,
+					len(exp.Trajectories))
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveInvalidTrajectories removes the trajectories that fail ValidateTrajectory from a list of trajectories, and
+// reports the number of removed trajectories with a warning.
+func RemoveInvalidTrajectories(ts []*Trajectory) []*Trajectory {
+	valid := []*Trajectory{}
+	for _, t := range ts {
+		if ValidateTrajectory(t) == nil {
+			valid = append(valid, t)
+		}
+	}
+	WarnSkippedTrajectories(len(ts)-len(valid), "removing invalid trajectories")
+	return valid
+}
+
+// WarnSkippedTrajectories logs a warning with the number of empty or invalid trajectories that were skipped while
+// doing something, if any.
+func WarnSkippedTrajectories(skipped int, doing string) {
+	if skipped > 0 {
+		utils.Warning("skipped ", skipped, " empty or invalid trajectories while ", doing, ".")
+	}
+}
+
+// CountEmptyTrajectories counts the trajectories without diagnoses in a list of trajectories.
+func CountEmptyTrajectories(ts []*Trajectory) int {
+	ctr := 0
+	for _, t := range ts {
+		if len(t.Diagnoses) == 0 {
+			ctr++
+		}
+	}
+	return ctr
+}
+
+// LastPatients returns the patients that follow the full trajectory, i.e. the patients of its last transition. It
+// returns nil if the patients are not known, e.g. for trajectories read back from a tab file.
+func LastPatients(t *Trajectory) []*Patient {
+	if len(t.Patients) == 0 {
+		return nil
+	}
+	return t.Patients[len(t.Patients)-1]
+}
+
+// Membership is the membership of a trajectory in a cluster for soft clustering. The weights of the memberships of a
+// trajectory sum to 1.
+type Membership struct {
+	Cluster int
+	Weight  float64
+}
+
+// ClusterMemberships returns the clusters a trajectory belongs to. For hard clustering, this is the single cluster the
+// trajectory is assigned to, with weight 1.
+func ClusterMemberships(t *Trajectory) []Membership {
+	if t.Memberships != nil {
+		return t.Memberships
+	}
+	return []Membership{{Cluster: t.Cluster, Weight: 1.0}}
+}
+
+// SoftClustered checks if the trajectories of an experiment are soft clustered.
+func SoftClustered(exp *Experiment) bool {
+	for _, t := range exp.Trajectories {
+		if t.Memberships != nil {
+			return true
+		}
+	}
+	return false
 }
 
 // extendTrajectory tries to extend a given trajectory (currentT) with a diagnosis (d). It returns a map which maps all
@@ -755,20 +1056,99 @@ func extendTrajectory(currentT *Trajectory, d int, minTime, maxTime float64) map
 // BuildTrajectories calculates the trajectories for an experiment. The trajectories are constrained by: a
 // minimum number of patients in the trajectory (minPatients), a maximum number of diagnoses in the trajectory (maxLength),
 // a minumum number of diagnoses in the trajectory (minLength), a minimum RR for each diagnosis transition (minRR), and
-// a list of filters.
+// a list of filters. If the diagnosis pairs are already selected while computing the relative risk ratios, cf.
+// InitializeRelativeRiskRatiosAndPairs, they are not selected again. If the experiment has a maximum number of
+// trajectories, cf. MaxTrajectories, only the highest scoring trajectories that pass the filters are kept while
+// building, so that the memory usage is bounded by the maximum rather than by the number of qualifying trajectories.
+// If the experiment has an incident look-back, cf. IncidentLookback, the trajectories only count the patients whose
+// first diagnosis of the index diagnosis of the trajectory is incident, cf. incidentIndexCase.
 func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, minTime, maxTime, minRR float64,
 	filters []TrajectoryFilter) []*Trajectory {
-	fmt.Println("Building patient trajectories...")
-	pairs := selectDiagnosisPairs(exp, minPatients, minRR)
-	exp.Pairs = pairs
-	var trajectories []*Trajectory
-	stack := []*Trajectory{}
+	utils.Info("Building patient trajectories...")
+	exp.MinTime, exp.MaxTime = minTime, maxTime
+	pairs := experimentPairs(exp, minPatients, minRR)
+	if exp.IncidentLookback > 0 {
+		countIndexCases(exp, pairs)
+	}
+	stage := utils.StartStage("Building trajectories", len(pairs))
+	retained := extendTrajectories(exp, pairs, pairs, minPatients, maxLength, minLength, minTime, maxTime, filters,
+		stage)
+	return finalizeTrajectories(exp, retainedTrajectories(retained), filters)
+}
+
+// DiagnosisChapter returns the chapter of a diagnosis, i.e. the top category of its path in the vocabulary hierarchy,
+// such as an ICD10 chapter or a CCSR body system. It returns the empty string for diagnoses outside the hierarchy.
+func DiagnosisChapter(exp *Experiment, did int) string {
+	if path := exp.Hierarchy[did]; len(path) > 0 {
+		return path[0]
+	}
+	return ""
+}
+
+// BuildTrajectoriesByChapter calculates the same trajectories as BuildTrajectories, but processes the diagnosis pairs
+// chapter by chapter, based on the chapter of the first diagnosis of the pairs. Only the trajectories that start in
+// one chapter are extended at a time, which lowers the peak memory usage at the cost of a longer run time, since each
+// chapter is processed in parallel separately. The trajectories of each chapter are merged as soon as the chapter is
+// processed, keeping only the highest scoring trajectories over all chapters if the experiment has a maximum number of
+// trajectories, after which the other trajectories of the chapter are released. The merged trajectories are sorted
+// into the same order as those of BuildTrajectories, cf. SortTrajectories.
+func BuildTrajectoriesByChapter(exp *Experiment, minPatients, maxLength, minLength int, minTime, maxTime,
+	minRR float64, filters []TrajectoryFilter) []*Trajectory {
+	utils.Info("Building patient trajectories chapter by chapter...")
+	exp.MinTime, exp.MaxTime = minTime, maxTime
+	pairs := experimentPairs(exp, minPatients, minRR)
+	if exp.IncidentLookback > 0 {
+		countIndexCases(exp, pairs)
+	}
+	chunks := map[string][]*Pair{}
+	chapters := []string{}
 	for _, pair := range pairs {
+		chapter := DiagnosisChapter(exp, pair.First)
+		if _, ok := chunks[chapter]; !ok {
+			chapters = append(chapters, chapter)
+		}
+		chunks[chapter] = append(chunks[chapter], pair)
+	}
+	sort.Strings(chapters)
+	stage := utils.StartStage("Building trajectories", len(pairs))
+	retained := newTrajectoryRetention(exp.MaxTrajectories, filters)
+	for _, chapter := range chapters {
+		name := chapter
+		if name == "" {
+			name = "diagnoses outside the hierarchy"
+		}
+		utils.Info("Building trajectories for ", len(chunks[chapter]), " pairs starting in chapter: ", name)
+		chunk := extendTrajectories(exp, chunks[chapter], pairs, minPatients, maxLength, minLength, minTime, maxTime,
+			filters, stage)
+		for _, t := range chunk.trajectories {
+			t.TrajMap = nil // only needed for extending the trajectories of the chapter
+		}
+		retained.merge(chunk)
+		chunk.trajectories = nil // release the trajectories of the chapter that are not retained
+	}
+	return finalizeTrajectories(exp, retainedTrajectories(retained), filters)
+}
+
+// extendTrajectories calculates the trajectories that start with the given diagnosis pairs (starts), by extending
+// them with the selected diagnosis pairs (pairs). The finalized trajectories are collected in a trajectoryRetention
+// with the maximum number of trajectories of the experiment. With an incident look-back, the trajectories only start
+// with the patients whose index diagnosis is incident, and the starts with fewer than minPatients such patients are
+// skipped.
+func extendTrajectories(exp *Experiment, starts, pairs []*Pair, minPatients, maxLength, minLength int, minTime,
+	maxTime float64, filters []TrajectoryFilter, stage *utils.Stage) *trajectoryRetention {
+	stack := []*Trajectory{}
+	for _, pair := range starts {
+		patients := exp.DxDPatients[pair.First][pair.Second]
+		if exp.IncidentLookback > 0 {
+			if patients = incidentPatients(patients, pair.First, exp.IncidentLookback); len(patients) < minPatients {
+				continue
+			}
+		}
 		t := &Trajectory{Diagnoses: []int{pair.First, pair.Second},
-			PatientNumbers: []int{len(exp.DxDPatients[pair.First][pair.Second])},
-			Patients:       [][]*Patient{exp.DxDPatients[pair.First][pair.Second]},
+			PatientNumbers: []int{len(patients)},
+			Patients:       [][]*Patient{patients},
 			TrajMap:        map[*Patient]int{}}
-		for _, p := range exp.DxDPatients[pair.First][pair.Second] {
+		for _, p := range patients {
 			_, idx := countPatientDiagnosisPair(p, pair.First, pair.Second, minTime, maxTime)
 			t.TrajMap[p] = idx
 		}
@@ -776,8 +1156,9 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 	}
 	// divide the work
 	result := parallel.RangeReduce(0, len(stack), 0, func(low, high int) interface{} {
-		lstack := stack[low:high]
-		ltrajectories := []*Trajectory{}
+		// copy the range, so that appending extensions does not overwrite the ranges of other goroutines
+		lstack := append([]*Trajectory{}, stack[low:high]...)
+		lretained := newTrajectoryRetention(exp.MaxTrajectories, filters)
 		tCtr := 0
 		for {
 			if len(lstack) == 0 {
@@ -785,6 +1166,9 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 			}
 			currentT := lstack[0]
 			lstack = lstack[1:]
+			if lretained.prunable(currentT) {
+				continue
+			}
 			// find potential extensions
 			lastT := currentT.Diagnoses[len(currentT.Diagnoses)-1]
 			ctr := 0
@@ -793,7 +1177,6 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 					//patients := intersectPatients(currentT.Patients[len(currentT.Patients)-1], exp.DxDPatients[lastT][pair.Second])
 					extendedTrajMap := extendTrajectory(currentT, pair.Second, minTime, maxTime)
 					if len(extendedTrajMap) > minPatients {
-						currentT.TrajMap = extendedTrajMap
 						diagnoses := make([]int, len(currentT.Diagnoses))
 						copy(diagnoses, currentT.Diagnoses)
 						patientNumbers := make([]int, len(currentT.PatientNumbers))
@@ -804,54 +1187,106 @@ func BuildTrajectories(exp *Experiment, minPatients, maxLength, minLength int, m
 						for p, _ := range extendedTrajMap {
 							patients = append(patients, p)
 						}
+						SortPatientsByPID(patients)
 						newT := &Trajectory{
 							Diagnoses:      append(diagnoses, pair.Second), // should copy slice, could be updated many times...
 							PatientNumbers: append(patientNumbers, len(patients)),
 							Patients:       append(ps, patients),
+							TrajMap:        extendedTrajMap,
 						}
 						// check if trajectory is finalized
 						if len(newT.Diagnoses) >= maxLength {
 							//newT.Patients = nil // help gc
-							ltrajectories = append(ltrajectories, newT)
+							lretained.add(newT)
 							tCtr++
 						} else {
 							ctr++
-							lstack = append(lstack, newT)
+							if !lretained.prunable(newT) {
+								lstack = append(lstack, newT)
+							}
 						}
 					}
 				}
 			}
 			if ctr == 0 && len(currentT.Diagnoses) >= minLength { // no extension, finalize this trajectory
-				ltrajectories = append(ltrajectories, currentT)
+				lretained.add(currentT)
 				tCtr++
 			}
 		}
-		return ltrajectories
+		stage.Add(high - low)
+		return lretained
 	}, func(result1, result2 interface{}) interface{} {
-		r1 := result1.([]*Trajectory)
-		r2 := result2.([]*Trajectory)
-		for _, t := range r2 {
-			r1 = append(r1, t)
-		}
+		r1 := result1.(*trajectoryRetention)
+		r1.merge(result2.(*trajectoryRetention))
 		return r1
 	})
-	trajectories = result.([]*Trajectory)
-	fmt.Println("Found ", len(trajectories), " trajectories.")
+	return result.(*trajectoryRetention)
+}
+
+// retainedTrajectories returns the trajectories of a trajectoryRetention, and reports how many trajectories were
+// dropped if it has a maximum.
+func retainedTrajectories(retained *trajectoryRetention) []*Trajectory {
+	if retained.max > 0 {
+		utils.Info("Retained the ", len(retained.trajectories), " highest scoring of ", retained.qualifying,
+			" qualifying trajectories.")
+	}
+	return retained.trajectories
+}
+
+// SortTrajectories sorts trajectories by their score, which is the number of patients that follow the full trajectory,
+// highest first. Trajectories with the same score are ordered by their diagnosis IDs. This makes the order of the
+// trajectories independent of how the work was divided when building them in parallel.
+func SortTrajectories(trajectories []*Trajectory) {
+	sort.SliceStable(trajectories, func(i, j int) bool {
+		return trajectoryBefore(trajectories[i], trajectories[j])
+	})
+}
+
+// trajectoryBefore returns whether trajectory ti comes before trajectory tj in the order of SortTrajectories.
+func trajectoryBefore(ti, tj *Trajectory) bool {
+	if ni, nj := trajectoryScore(ti), trajectoryScore(tj); ni != nj {
+		return ni > nj
+	}
+	for k := 0; k < len(ti.Diagnoses) && k < len(tj.Diagnoses); k++ {
+		if ti.Diagnoses[k] != tj.Diagnoses[k] {
+			return ti.Diagnoses[k] < tj.Diagnoses[k]
+		}
+	}
+	return len(ti.Diagnoses) < len(tj.Diagnoses)
+}
+
+// trajectoryScore returns the number of patients that follow the full trajectory.
+func trajectoryScore(t *Trajectory) int {
+	if len(t.PatientNumbers) == 0 {
+		return 0
+	}
+	return t.PatientNumbers[len(t.PatientNumbers)-1]
+}
+
+// finalizeTrajectories applies the trajectory filters to the calculated trajectories, and stores the remaining valid
+// trajectories in the experiment.
+func finalizeTrajectories(exp *Experiment, trajectories []*Trajectory, filters []TrajectoryFilter) []*Trajectory {
+	utils.Info("Found ", len(trajectories), " trajectories.")
 	filteredTrajectories := []*Trajectory{}
 	for _, traj := range trajectories {
-		keep := true
-		for _, filter := range filters {
-			if !filter(traj) {
-				keep = false
-				break
-			}
-		}
-		if keep {
+		if keepTrajectory(traj, filters) {
 			filteredTrajectories = append(filteredTrajectories, traj)
 		}
 	}
-	fmt.Println("Filtered down from: ", len(trajectories), " trajectories down to: ", len(filteredTrajectories),
+	utils.Info("Filtered down from: ", len(trajectories), " trajectories down to: ", len(filteredTrajectories),
 		" trajectories.")
+	filteredTrajectories = RemoveInvalidTrajectories(filteredTrajectories)
+	SortTrajectories(filteredTrajectories)
 	exp.Trajectories = filteredTrajectories
 	return filteredTrajectories
 }
+
+// keepTrajectory returns whether a trajectory passes all trajectory filters.
+func keepTrajectory(t *Trajectory, filters []TrajectoryFilter) bool {
+	for _, filter := range filters {
+		if !filter(t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"ptra/utils"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Excluding clinically trivial diagnosis transitions, e.g. coding artifacts such as a screening followed by the
+// disease that is screened for, from the relative risk ratios and the trajectories.
+
+// ExcludedTransition is a diagnosis transition that is ignored when computing the relative risk ratios and building
+// the trajectories.
+type ExcludedTransition struct {
+	From, To string // the diagnosis codes or medical terms of the transition
+}
+
+// ReadExcludedTransitions reads a csv file with diagnosis transitions to exclude. The header is from,to. The diagnoses
+// are codes or medical terms of the vocabulary, cf. ExcludeTransitions.
+func ReadExcludedTransitions(name string) ([]*ExcludedTransition, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if strings.TrimSpace(header[0]) != "from" || strings.TrimSpace(header[1]) != "to" {
+		return nil, fmt.Errorf("%s: the header must be from,to", name)
+	}
+	transitions := []*ExcludedTransition{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		transition := &ExcludedTransition{From: strings.TrimSpace(record[0]), To: strings.TrimSpace(record[1])}
+		if transition.From == "" || transition.To == "" {
+			return nil, fmt.Errorf("%s: excluded transition %q -> %q has an empty diagnosis", name, record[0],
+				record[1])
+		}
+		transitions = append(transitions, transition)
+	}
+	return transitions, nil
+}
+
+// matchingDiagnoses returns the diagnosis IDs of an experiment that match a diagnosis code or medical term, cf.
+// knownDiagnosisMatches, in ascending order.
+func matchingDiagnoses(exp *Experiment, diagnosis string) []int {
+	dids := []int{}
+	for did, name := range exp.NameMap {
+		if knownDiagnosisMatches(diagnosis, exp.IdMap[did], name) {
+			dids = append(dids, did)
+		}
+	}
+	sort.Ints(dids)
+	return dids
+}
+
+// ExcludeTransitions records the diagnosis transitions to exclude in the experiment, cf. Experiment.ExcludedTransitions,
+// so that their relative risk ratios are not computed and they are never selected for building trajectories. The
+// diagnoses of the transitions are matched against the codes and medical terms of the vocabulary as for known
+// trajectories, cf. knownDiagnosisMatches, so that e.g. Z12 excludes the transitions from all codes of the Z12
+// category. For each excluded transition, the number of patients that have it within the time window between
+// diagnoses of minTime and maxTime years is recorded. A warning is logged for the transitions with diagnoses that are
+// not in the vocabulary. It returns the number of excluded transitions between diagnoses of the vocabulary.
+func ExcludeTransitions(exp *Experiment, transitions []*ExcludedTransition, minTime, maxTime float64) int {
+	if exp.ExcludedTransitions == nil {
+		exp.ExcludedTransitions = map[Pair]int{}
+	}
+	unknown := 0
+	for _, transition := range transitions {
+		froms, tos := matchingDiagnoses(exp, transition.From), matchingDiagnoses(exp, transition.To)
+		if len(froms) == 0 || len(tos) == 0 {
+			unknown++
+			continue
+		}
+		for _, d1 := range froms {
+			for _, d2 := range tos {
+				if d1 == d2 {
+					continue
+				}
+				ctr := 0
+				for _, p := range exp.DPatients[d1] {
+					if n, _ := countPatientDiagnosisPair(p, d1, d2, minTime, maxTime); n > 0 {
+						ctr++
+					}
+				}
+				exp.ExcludedTransitions[Pair{First: d1, Second: d2}] = ctr
+			}
+		}
+	}
+	if unknown > 0 {
+		utils.Warning(unknown, " of ", len(transitions), " excluded transitions have diagnoses that are not in the "+
+			"vocabulary of the run, and are ignored.")
+	}
+	patients := 0
+	for _, ctr := range exp.ExcludedTransitions {
+		patients += ctr
+	}
+	utils.Info("Excluding ", len(exp.ExcludedTransitions), " diagnosis transitions, followed by ", patients,
+		" patients in total.")
+	return len(exp.ExcludedTransitions)
+}
+
+// excludedTransition returns whether the transition from diagnosis d1 to diagnosis d2 is excluded, cf.
+// ExcludeTransitions.
+func excludedTransition(exp *Experiment, d1, d2 int) bool {
+	_, ok := exp.ExcludedTransitions[Pair{First: d1, Second: d2}]
+	return ok
+}
+
+// PrintExcludedTransitionsToCSVFile prints the excluded transitions of an experiment, cf. ExcludeTransitions, to a csv
+// file. The header is From,To,FromName,ToName,Patients, with the codes and medical terms of the diagnoses, and the
+// number of patients that have the transition. The transitions are sorted on their diagnosis IDs.
+func PrintExcludedTransitionsToCSVFile(exp *Experiment, name string) {
+	pairs := []Pair{}
+	for pair := range exp.ExcludedTransitions {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].First != pairs[j].First {
+			return pairs[i].First < pairs[j].First
+		}
+		return pairs[i].Second < pairs[j].Second
+	})
+	records := [][]string{}
+	for _, pair := range pairs {
+		records = append(records, []string{exp.IdMap[pair.First], exp.IdMap[pair.Second], exp.NameMap[pair.First],
+			exp.NameMap[pair.Second], strconv.Itoa(exp.ExcludedTransitions[pair])})
+	}
+	writeCSVFile(name, []string{"From", "To", "FromName", "ToName", "Patients"}, records)
+}
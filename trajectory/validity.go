@@ -0,0 +1,189 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package trajectory
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Code validity periods. Diagnosis codes are introduced and retired over time, e.g. U07.1 for COVID-19 was introduced
+// in 2020. A patient cannot get a diagnosis outside the validity period of its codes, so the person-time at risk for a
+// diagnosis only counts the time during which it could be recorded. Otherwise the follow-up before a code was
+// introduced counts as time at risk without events, which inflates the relative risk ratios of recently introduced
+// codes, cf. exposedPersonTime and unexposedPersonTime.
+
+// ValidityPeriod is the period during which a diagnosis could be recorded, in years as by DiagnosisDateToFloat. An
+// open bound is infinite.
+type ValidityPeriod struct {
+	From, To float64
+}
+
+// AlwaysValid is the validity period of the diagnoses without known validity dates.
+var AlwaysValid = ValidityPeriod{From: math.Inf(-1), To: math.Inf(1)}
+
+// overlap returns the length of the overlap of a validity period with the interval [start, end], in years.
+func (v ValidityPeriod) overlap(start, end float64) float64 {
+	return math.Max(0, math.Min(end, v.To)-math.Max(start, v.From))
+}
+
+// validity returns the validity period of a diagnosis of an experiment, cf. Experiment.Validity.
+func (exp *Experiment) validity(did int) ValidityPeriod {
+	if exp.Validity == nil {
+		return AlwaysValid
+	}
+	return exp.Validity[did]
+}
+
+// parseValidityDate parses a date of a code validity file, which is a date YYYY-MM-DD or a year YYYY. A year is the
+// start of the year for the start of a validity period, and the end of the year for the end of a validity period. An
+// empty date is an open bound, given as open.
+func parseValidityDate(date string, end bool, open float64) (float64, error) {
+	date = strings.TrimSpace(date)
+	if date == "" {
+		return open, nil
+	}
+	if len(date) == 4 {
+		year, err := strconv.Atoi(date)
+		if err != nil {
+			return 0, fmt.Errorf("invalid year %q", date)
+		}
+		if end {
+			return DiagnosisDateToFloat(DiagnosisDate{Year: year, Month: 12, Day: 31}), nil
+		}
+		return DiagnosisDateToFloat(DiagnosisDate{Year: year, Month: 1, Day: 1}), nil
+	}
+	fields := strings.Split(date, "-")
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or YYYY", date)
+	}
+	ymd := make([]int, 3)
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return 0, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or YYYY", date)
+		}
+		ymd[i] = n
+	}
+	return DiagnosisDateToFloat(DiagnosisDate{Year: ymd[0], Month: ymd[1], Day: ymd[2]}), nil
+}
+
+// ReadCodeValidity reads a csv file with the validity periods of diagnosis codes. The header is
+// code,validFrom,validTo. The dates are YYYY-MM-DD or YYYY, and an empty date is an open bound, e.g. U07.1,2020-04-01,
+// for a code that is still valid. The codes are returned in upper case.
+func ReadCodeValidity(name string) (map[string]ValidityPeriod, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if strings.TrimSpace(header[0]) != "code" || strings.TrimSpace(header[1]) != "validFrom" ||
+		strings.TrimSpace(header[2]) != "validTo" {
+		return nil, fmt.Errorf("%s: the header must be code,validFrom,validTo", name)
+	}
+	validity := map[string]ValidityPeriod{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		code := strings.ToUpper(strings.TrimSpace(record[0]))
+		from, err := parseValidityDate(record[1], false, math.Inf(-1))
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", name, line, err)
+		}
+		to, err := parseValidityDate(record[2], true, math.Inf(1))
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %v", name, line, err)
+		}
+		if from > to {
+			return nil, fmt.Errorf("%s, line %d: code %s is retired before it is introduced", name, line, code)
+		}
+		validity[code] = ValidityPeriod{From: from, To: to}
+	}
+	return validity, nil
+}
+
+// codeValidity returns the validity period of a code: the validity period of the code itself, or else of its longest
+// prefix with a validity period, e.g. of U07 for U07.1. Codes without a validity period are always valid.
+func codeValidity(code string, validity map[string]ValidityPeriod) (ValidityPeriod, bool) {
+	code = strings.ToUpper(code)
+	for l := len(code); l > 0; l-- {
+		if v, ok := validity[code[:l]]; ok {
+			return v, true
+		}
+	}
+	return AlwaysValid, false
+}
+
+// DiagnosisValidity computes the validity periods of the diagnoses of an experiment from the validity periods of the
+// codes, cf. ReadCodeValidity. codeDIDs maps the codes onto the diagnoses they are grouped in. A diagnosis can be
+// recorded whenever one of its codes can be recorded, so its validity period spans those of its codes, and it is always
+// valid if one of its codes is.
+func DiagnosisValidity(codeDIDs map[string][]int, validity map[string]ValidityPeriod,
+	nofDiagnosisCodes int) []ValidityPeriod {
+	result := make([]ValidityPeriod, nofDiagnosisCodes)
+	seen := make([]bool, nofDiagnosisCodes)
+	for code, dids := range codeDIDs {
+		v, _ := codeValidity(code, validity)
+		for _, did := range dids {
+			if !seen[did] {
+				result[did], seen[did] = v, true
+			} else {
+				result[did] = ValidityPeriod{From: math.Min(result[did].From, v.From), To: math.Max(result[did].To, v.To)}
+			}
+		}
+	}
+	for did, ok := range seen {
+		if !ok {
+			result[did] = AlwaysValid
+		}
+	}
+	return result
+}
+
+// CompactValidity remaps the validity periods of the diagnoses to the compacted IDs returned by CompactDiagnosisIDs.
+func CompactValidity(validity []ValidityPeriod, oldIDs []int) []ValidityPeriod {
+	if validity == nil {
+		return nil
+	}
+	result := make([]ValidityPeriod, len(oldIDs))
+	for did, oldID := range oldIDs {
+		result[did] = validity[oldID]
+	}
+	return result
+}
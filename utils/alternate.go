@@ -0,0 +1,191 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// alternateRandom is the alternate random backend, with the PCG generators of math/rand/v2 for seeded generators and
+// its ChaCha8 top-level functions for the shared generator.
+type alternateRandom struct{}
+
+func (alternateRandom) New(seed int64) Random {
+	return pcgRandom{rand.New(rand.NewPCG(uint64(seed), 0))}
+}
+
+func (alternateRandom) Shared() Random {
+	return chachaRandom{}
+}
+
+// pcgRandom adapts a generator of math/rand/v2 to Random.
+type pcgRandom struct {
+	r *rand.Rand
+}
+
+func (r pcgRandom) Intn(n int) int {
+	return r.r.IntN(n)
+}
+
+func (r pcgRandom) Float64() float64 {
+	return r.r.Float64()
+}
+
+// chachaRandom is the top-level generator of math/rand/v2, which is safe for concurrent use.
+type chachaRandom struct{}
+
+func (chachaRandom) Intn(n int) int {
+	return rand.IntN(n)
+}
+
+func (chachaRandom) Float64() float64 {
+	return rand.Float64()
+}
+
+// alternateStatistics is the alternate statistics backend. Its tests are computed with other algorithms than those of
+// the reference backend, so that the two can validate each other.
+type alternateStatistics struct{}
+
+// FisherExactTest computes the hypergeometric probabilities of the tables with the same margins with the recurrence
+// between consecutive tables, instead of from factorials.
+func (alternateStatistics) FisherExactTest(a, b, c, d int) float64 {
+	row1, col1, n := a+b, a+c, a+b+c+d
+	low, high := max(0, row1+col1-n), min(row1, col1)
+	// the logarithms of the probabilities, up to a constant
+	lps := make([]float64, high-low+1)
+	for x := low; x < high; x++ {
+		ratio := float64((row1-x)*(col1-x)) / float64((x+1)*(n-row1-col1+x+1))
+		lps[x-low+1] = lps[x-low] + math.Log(ratio)
+	}
+	maxLp := math.Inf(-1)
+	for _, lp := range lps {
+		maxLp = math.Max(maxLp, lp)
+	}
+	observed := lps[a-low]
+	p, total := 0.0, 0.0
+	for _, lp := range lps {
+		q := math.Exp(lp - maxLp)
+		total += q
+		if lp <= observed+1e-7 {
+			p += q
+		}
+	}
+	return math.Min(p/total, 1)
+}
+
+// BinomialCdf sums the binomial probabilities of k to n successes, instead of using the regularized incomplete beta
+// function.
+func (alternateStatistics) BinomialCdf(p float64, n, k int) float64 {
+	if k <= 0 {
+		return 1
+	}
+	if p <= 0 {
+		return 0
+	}
+	if p >= 1 {
+		return 1
+	}
+	lgn, _ := math.Lgamma(float64(n + 1))
+	lp, lq := math.Log(p), math.Log1p(-p)
+	sum := 0.0
+	for i := k; i <= n; i++ {
+		lgi, _ := math.Lgamma(float64(i + 1))
+		lgni, _ := math.Lgamma(float64(n - i + 1))
+		sum += math.Exp(lgn - lgi - lgni + float64(i)*lp + float64(n-i)*lq)
+	}
+	return math.Min(sum, 1)
+}
+
+// MannWhitneyUTest counts for each value of xs the smaller and equal values of ys to compute U, instead of summing
+// ranks.
+func (alternateStatistics) MannWhitneyUTest(xs, ys []float64) float64 {
+	n1, n2 := len(xs), len(ys)
+	if n1 == 0 || n2 == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64{}, ys...)
+	sort.Float64s(sorted)
+	u := 0.0
+	for _, x := range xs {
+		smaller := sort.SearchFloat64s(sorted, x)
+		equal := sort.Search(len(sorted), func(i int) bool { return sorted[i] > x }) - smaller
+		u += float64(smaller) + float64(equal)/2
+	}
+	counts := map[float64]int{}
+	for _, x := range xs {
+		counts[x]++
+	}
+	for _, y := range ys {
+		counts[y]++
+	}
+	ties := 0.0
+	for _, count := range counts {
+		t := float64(count)
+		ties += t*t*t - t
+	}
+	f1, f2 := float64(n1), float64(n2)
+	n := f1 + f2
+	sigma := math.Sqrt(f1 * f2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+	z := (u - f1*f2/2) / sigma
+	return math.Min(2*normalUpperTail(math.Abs(z)), 1)
+}
+
+// normalUpperTail computes the probability that a standard normal variable exceeds z >= 0, with the continued
+// fraction of Laplace, or the series of the error function for small z.
+func normalUpperTail(z float64) float64 {
+	if z < 3 {
+		// erf(x) = 2/sqrt(pi) * sum_k (-1)^k x^(2k+1) / (k! (2k+1)), with x = z/sqrt(2)
+		x := z / math.Sqrt2
+		term, sum := x, x
+		for k := 1; k < 200 && math.Abs(term) > 1e-17*math.Abs(sum); k++ {
+			term *= -x * x / float64(k)
+			sum += term / float64(2*k+1)
+		}
+		return 0.5 - sum/math.Sqrt(math.Pi)
+	}
+	// Laplace's continued fraction of the Mills ratio 1/(z+1/(z+2/(z+3/(z+...)))), evaluated from the back
+	f := 0.0
+	for k := 60; k >= 1; k-- {
+		f = float64(k) / (z + f)
+	}
+	return math.Exp(-z*z/2) / math.Sqrt(2*math.Pi) / (z + f)
+}
+
+// BenjaminiHochberg takes for each p-value the minimum of the adjusted p-values of the same or larger p-values,
+// looked up by binary search in the sorted p-values, instead of following the order of the ranks.
+func (alternateStatistics) BenjaminiHochberg(ps []float64) []float64 {
+	n := len(ps)
+	sorted := append([]float64{}, ps...)
+	sort.Float64s(sorted)
+	minima := make([]float64, n+1)
+	minima[n] = 1
+	for i := n - 1; i >= 0; i-- {
+		minima[i] = math.Min(minima[i+1], sorted[i]*float64(n)/float64(i+1))
+	}
+	qs := make([]float64, n)
+	for i, p := range ps {
+		qs[i] = minima[sort.SearchFloat64s(sorted, p)]
+	}
+	return qs
+}
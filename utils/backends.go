@@ -0,0 +1,236 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/valyala/fastrand"
+)
+
+// The names of the backends for the random generators and the statistical tests, cf. RandomBackendByName and
+// StatisticsBackendByName.
+const (
+	// ReferenceBackend is the implementation that ptra uses by default.
+	ReferenceBackend = "reference"
+	// AlternateBackend is an independent implementation, for validating the results of the reference backend.
+	AlternateBackend = "alternate"
+	// CrossCheckBackend computes the statistical tests with both the reference and the alternate backend, and warns
+	// when they disagree, cf. CrossCheckedStatistics.
+	CrossCheckBackend = "crosscheck"
+)
+
+// Random is a generator of random numbers.
+type Random interface {
+	// Intn returns a random number in [0, n).
+	Intn(n int) int
+	// Float64 returns a random number in [0.0, 1.0).
+	Float64() float64
+}
+
+// RandomBackend creates the random generators that ptra uses for sampling, cf. SetRandomBackend.
+type RandomBackend interface {
+	// New returns a generator that gives the same numbers for the same seed. It need not be safe for concurrent use.
+	New(seed int64) Random
+	// Shared returns an unseeded generator that is safe for concurrent use.
+	Shared() Random
+}
+
+// StatisticsBackend implements the statistical tests of ptra, cf. SetStatisticsBackend.
+type StatisticsBackend interface {
+	// FisherExactTest computes the two-sided p-value of Fisher's exact test for the 2x2 table a b / c d.
+	FisherExactTest(a, b, c, d int) float64
+	// BinomialCdf computes the probability of at least k successes in n trials with success probability p.
+	BinomialCdf(p float64, n, k int) float64
+	// MannWhitneyUTest computes the two-sided p-value of the Mann-Whitney U test, cf. MannWhitneyUTest.
+	MannWhitneyUTest(xs, ys []float64) float64
+	// BenjaminiHochberg computes the q-values of p-values with the Benjamini-Hochberg procedure.
+	BenjaminiHochberg(ps []float64) []float64
+}
+
+// The backends are swapped atomically, so that they can be set while other goroutines compute. The backends are
+// wrapped in structs, since an atomic.Value only holds values of the same type.
+type (
+	randomBackendValue     struct{ RandomBackend }
+	statisticsBackendValue struct{ StatisticsBackend }
+)
+
+var randomBackend, statisticsBackend atomic.Value
+
+func init() {
+	randomBackend.Store(randomBackendValue{referenceRandom{}})
+	statisticsBackend.Store(statisticsBackendValue{defaultStatistics()})
+}
+
+// SetRandomBackend sets the backend of the random generators. Computations that already started may continue with
+// the previous backend.
+func SetRandomBackend(backend RandomBackend) {
+	randomBackend.Store(randomBackendValue{backend})
+}
+
+// Rand returns the backend of the random generators, cf. SetRandomBackend.
+func Rand() RandomBackend {
+	return randomBackend.Load().(randomBackendValue).RandomBackend
+}
+
+// SetStatisticsBackend sets the backend of the statistical tests. Computations that already started may continue
+// with the previous backend.
+func SetStatisticsBackend(backend StatisticsBackend) {
+	statisticsBackend.Store(statisticsBackendValue{backend})
+}
+
+// Stats returns the backend of the statistical tests, cf. SetStatisticsBackend.
+func Stats() StatisticsBackend {
+	return statisticsBackend.Load().(statisticsBackendValue).StatisticsBackend
+}
+
+// RandomBackendByName returns the random backend with the given name, ReferenceBackend or AlternateBackend.
+func RandomBackendByName(name string) (RandomBackend, error) {
+	switch name {
+	case ReferenceBackend:
+		return referenceRandom{}, nil
+	case AlternateBackend:
+		return alternateRandom{}, nil
+	}
+	return nil, fmt.Errorf("unknown random backend %q, expected %s or %s", name, ReferenceBackend, AlternateBackend)
+}
+
+// StatisticsBackendByName returns the statistics backend with the given name, ReferenceBackend, AlternateBackend, or
+// CrossCheckBackend.
+func StatisticsBackendByName(name string) (StatisticsBackend, error) {
+	switch name {
+	case ReferenceBackend:
+		return referenceStatistics{}, nil
+	case AlternateBackend:
+		return alternateStatistics{}, nil
+	case CrossCheckBackend:
+		return NewCrossCheckedStatistics(referenceStatistics{}, alternateStatistics{}), nil
+	}
+	return nil, fmt.Errorf("unknown statistics backend %q, expected %s, %s, or %s", name, ReferenceBackend,
+		AlternateBackend, CrossCheckBackend)
+}
+
+// referenceRandom is the reference random backend, with the generators of math/rand and fastrand.
+type referenceRandom struct{}
+
+func (referenceRandom) New(seed int64) Random {
+	return rand.New(rand.NewSource(seed))
+}
+
+func (referenceRandom) Shared() Random {
+	return fastRandom{}
+}
+
+// fastRandom is a generator that is safe for concurrent use, without locking, cf. fastrand.
+type fastRandom struct{}
+
+func (fastRandom) Intn(n int) int {
+	return int(fastrand.Uint32n(uint32(n)))
+}
+
+func (fastRandom) Float64() float64 {
+	return float64(fastrand.Uint32()) / (1 << 32)
+}
+
+// referenceStatistics is the reference statistics backend, with the tests of this package.
+type referenceStatistics struct{}
+
+func (referenceStatistics) FisherExactTest(a, b, c, d int) float64 {
+	return FisherExactTest(a, b, c, d)
+}
+
+func (referenceStatistics) BinomialCdf(p float64, n, k int) float64 {
+	return BinomialCdf(p, n, k)
+}
+
+func (referenceStatistics) MannWhitneyUTest(xs, ys []float64) float64 {
+	return MannWhitneyUTest(xs, ys)
+}
+
+func (referenceStatistics) BenjaminiHochberg(ps []float64) []float64 {
+	return BenjaminiHochberg(ps)
+}
+
+// crossCheckTolerance is the absolute difference up to which the results of two statistics backends agree. It allows
+// for the precision of the continued fraction of BinomialCdf.
+const crossCheckTolerance = 1e-6
+
+// CrossCheckedStatistics is a statistics backend that computes each test with a primary and an alternate backend. It
+// returns the result of the primary backend, and warns when the results differ by more than a tolerance, so that a
+// validation run documents that the results do not depend on the implementation of the tests.
+type CrossCheckedStatistics struct {
+	Primary, Alternate StatisticsBackend
+	checks             atomic.Int64
+	discrepancies      atomic.Int64
+}
+
+// NewCrossCheckedStatistics returns a backend that cross-checks the tests of primary with those of alternate.
+func NewCrossCheckedStatistics(primary, alternate StatisticsBackend) *CrossCheckedStatistics {
+	return &CrossCheckedStatistics{Primary: primary, Alternate: alternate}
+}
+
+// Checks returns the number of results that have been cross-checked.
+func (s *CrossCheckedStatistics) Checks() int64 {
+	return s.checks.Load()
+}
+
+// Discrepancies returns the number of results on which the backends disagreed.
+func (s *CrossCheckedStatistics) Discrepancies() int64 {
+	return s.discrepancies.Load()
+}
+
+// check compares the results of the primary and the alternate backend of a test, and returns the primary result. The
+// test is described by a format and its arguments, which are only formatted for a warning.
+func (s *CrossCheckedStatistics) check(primary, alternate float64, format string, a ...interface{}) float64 {
+	s.checks.Add(1)
+	if math.IsNaN(primary) && math.IsNaN(alternate) {
+		return primary
+	}
+	if !(math.Abs(primary-alternate) <= crossCheckTolerance) {
+		s.discrepancies.Add(1)
+		Warning(fmt.Sprintf("the statistics backends disagree on "+format+": %v versus %v",
+			append(a, primary, alternate)...))
+	}
+	return primary
+}
+
+func (s *CrossCheckedStatistics) FisherExactTest(a, b, c, d int) float64 {
+	return s.check(s.Primary.FisherExactTest(a, b, c, d), s.Alternate.FisherExactTest(a, b, c, d),
+		"FisherExactTest(%d, %d, %d, %d)", a, b, c, d)
+}
+
+func (s *CrossCheckedStatistics) BinomialCdf(p float64, n, k int) float64 {
+	return s.check(s.Primary.BinomialCdf(p, n, k), s.Alternate.BinomialCdf(p, n, k), "BinomialCdf(%v, %d, %d)", p, n, k)
+}
+
+func (s *CrossCheckedStatistics) MannWhitneyUTest(xs, ys []float64) float64 {
+	return s.check(s.Primary.MannWhitneyUTest(xs, ys), s.Alternate.MannWhitneyUTest(xs, ys),
+		"MannWhitneyUTest of %d and %d values", len(xs), len(ys))
+}
+
+func (s *CrossCheckedStatistics) BenjaminiHochberg(ps []float64) []float64 {
+	qs, alternate := s.Primary.BenjaminiHochberg(ps), s.Alternate.BenjaminiHochberg(ps)
+	for i := range qs {
+		s.check(qs[i], alternate[i], "BenjaminiHochberg of p-value %v", ps[i])
+	}
+	return qs
+}
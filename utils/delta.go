@@ -0,0 +1,259 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Delta exports only rewrite the output files of a run that changed since the previous run into the same output
+// directory, cf. StartDelta. The output files are created with CreateFile, which compares the output with the previous
+// file while it is written, so that an unchanged file is not touched, and a changed file is only rewritten from the
+// first byte that differs.
+
+// The status of an output file in a delta export, compared to the previous run.
+const (
+	DeltaAdded     = "added"     // the file did not exist
+	DeltaChanged   = "changed"   // the file was rewritten
+	DeltaUnchanged = "unchanged" // the file was not touched
+	DeltaStale     = "stale"     // the file was written by the previous run, but not by this run
+)
+
+// deltaManifest holds the content hashes of the output files of a run, by file name relative to the directory of the
+// manifest.
+type deltaManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// deltaEntry is the content hash and status of an output file of a delta export.
+type deltaEntry struct {
+	hash, status string
+}
+
+// deltaExport records the output files of a delta export.
+type deltaExport struct {
+	dir      string
+	previous map[string]string
+	mutex    sync.Mutex
+	files    map[string]deltaEntry
+}
+
+// delta is the current delta export, or nil when delta exports are disabled.
+var (
+	deltaMutex sync.Mutex
+	delta      *deltaExport
+)
+
+// StartDelta enables delta exports, cf. CreateFile. The manifest file holds the content hashes of the output files of
+// the previous run, if any, and is relative to the output directory.
+func StartDelta(manifest string) error {
+	export := &deltaExport{dir: filepath.Dir(manifest), previous: map[string]string{}, files: map[string]deltaEntry{}}
+	content, err := os.ReadFile(manifest)
+	if err == nil {
+		var m deltaManifest
+		if err := json.Unmarshal(content, &m); err != nil {
+			return fmt.Errorf("%s: %v", manifest, err)
+		}
+		export.previous = m.Files
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	deltaMutex.Lock()
+	defer deltaMutex.Unlock()
+	delta = export
+	return nil
+}
+
+// FinishDelta disables delta exports. It writes the content hashes of the output files to the manifest file given to
+// StartDelta, and a changelog to a csv file with the header File,Status,SHA256,PreviousSHA256, with the status of each
+// output file compared to the previous run. The output files of the previous run that were not written are stale.
+func FinishDelta(manifest, changelog string) (err error) {
+	deltaMutex.Lock()
+	export := delta
+	delta = nil
+	deltaMutex.Unlock()
+	if export == nil {
+		return errors.New("delta exports are not enabled")
+	}
+	m := deltaManifest{Files: map[string]string{}}
+	records := [][]string{}
+	for file, entry := range export.files {
+		m.Files[file] = entry.hash
+		records = append(records, []string{file, entry.status, entry.hash, export.previous[file]})
+	}
+	for file, hash := range export.previous {
+		if _, ok := export.files[file]; !ok {
+			records = append(records, []string{file, DeltaStale, "", hash})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i][0] < records[j][0] })
+	content, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifest, content, 0666); err != nil {
+		return err
+	}
+	file, err := os.Create(changelog)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := csv.NewWriter(file)
+	if err := w.Write([]string{"File", "Status", "SHA256", "PreviousSHA256"}); err != nil {
+		return err
+	}
+	return w.WriteAll(records)
+}
+
+// record records the content hash and status of an output file of a delta export.
+func (export *deltaExport) record(name, hash, status string) {
+	rel, err := filepath.Rel(export.dir, name)
+	if err != nil {
+		rel = name
+	}
+	export.mutex.Lock()
+	defer export.mutex.Unlock()
+	export.files[filepath.ToSlash(rel)] = deltaEntry{hash: hash, status: status}
+}
+
+// deltaFile is an output file of a delta export. As long as the output matches the previous file, nothing is written.
+type deltaFile struct {
+	export *deltaExport
+	name   string
+	old    *os.File      // the previous file, nil when there is none or when the output differs from it
+	reader *bufio.Reader // reads the previous file
+	buffer []byte
+	// the number of bytes that match the previous file
+	matched int64
+	out     *os.File // nil as long as the output matches the previous file
+	status  string
+	hash    hash.Hash
+}
+
+// CreateFile creates an output file, like os.Create. When delta exports are enabled, cf. StartDelta, an existing file
+// is only rewritten when the output differs from it, and the content hash and status of the file are recorded for the
+// changelog, cf. FinishDelta.
+func CreateFile(name string) (io.WriteCloser, error) {
+	deltaMutex.Lock()
+	export := delta
+	deltaMutex.Unlock()
+	if export == nil {
+		return os.Create(name)
+	}
+	f := &deltaFile{export: export, name: name, hash: sha256.New()}
+	old, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if f.out, err = os.Create(name); err != nil {
+			return nil, err
+		}
+		f.status = DeltaAdded
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.old, f.reader, f.status = old, bufio.NewReader(old), DeltaUnchanged
+	return f, nil
+}
+
+// diverge switches a delta file to writing, when the output differs from the previous file. The matching bytes are
+// kept, so that only the rest of the file is rewritten.
+func (f *deltaFile) diverge() error {
+	if err := f.old.Close(); err != nil {
+		return err
+	}
+	f.old, f.reader = nil, nil
+	out, err := os.OpenFile(f.name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := out.Truncate(f.matched); err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := out.Seek(f.matched, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	f.out, f.status = out, DeltaChanged
+	return nil
+}
+
+// Write writes to a delta file.
+func (f *deltaFile) Write(p []byte) (int, error) {
+	f.hash.Write(p)
+	if f.out == nil {
+		if len(f.buffer) < len(p) {
+			f.buffer = make([]byte, len(p))
+		}
+		n, err := io.ReadFull(f.reader, f.buffer[:len(p)])
+		if err == nil && bytes.Equal(f.buffer[:n], p) {
+			f.matched += int64(n)
+			return len(p), nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if err := f.diverge(); err != nil {
+			return 0, err
+		}
+	}
+	return f.out.Write(p)
+}
+
+// Close closes a delta file, and records its content hash and status. The output is unchanged when it matches the
+// complete previous file, otherwise the previous file is truncated.
+func (f *deltaFile) Close() error {
+	if f.out == nil {
+		if _, err := f.reader.ReadByte(); err == io.EOF {
+			f.export.record(f.name, hex.EncodeToString(f.hash.Sum(nil)), f.status)
+			return f.old.Close()
+		} else if err != nil {
+			f.old.Close()
+			return err
+		}
+		if err := f.diverge(); err != nil { // the previous file is longer
+			return err
+		}
+	}
+	if err := f.out.Close(); err != nil {
+		return err
+	}
+	f.export.record(f.name, hex.EncodeToString(f.hash.Sum(nil)), f.status)
+	return nil
+}
@@ -0,0 +1,72 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// logFactorial computes log(n!).
+func logFactorial(n int) float64 {
+	r, _ := math.Lgamma(float64(n + 1))
+	return r
+}
+
+// hypergeometricLogProbability computes the log probability of a 2x2 contingency table with cells a, b, c, d given its
+// margins.
+func hypergeometricLogProbability(a, b, c, d int) float64 {
+	return logFactorial(a+b) + logFactorial(c+d) + logFactorial(a+c) + logFactorial(b+d) - logFactorial(a+b+c+d) -
+		logFactorial(a) - logFactorial(b) - logFactorial(c) - logFactorial(d)
+}
+
+// FisherExactTest computes the two-sided p-value of Fisher's exact test for the 2x2 contingency table with rows (a, b)
+// and (c, d). The p-value is the sum of the probabilities of all tables with the same margins that are at most as
+// likely as the given table.
+func FisherExactTest(a, b, c, d int) float64 {
+	row1, col1, n := a+b, a+c, a+b+c+d
+	observed := hypergeometricLogProbability(a, b, c, d)
+	p := 0.0
+	for x := MaxInt(0, row1+col1-n); x <= MinInt(row1, col1); x++ {
+		lp := hypergeometricLogProbability(x, row1-x, col1-x, n-row1-col1+x)
+		if lp <= observed+1e-7 { // relative tolerance for rounding errors, as in R's fisher.test
+			p += math.Exp(lp)
+		}
+	}
+	return math.Min(p, 1)
+}
+
+// BenjaminiHochberg adjusts p-values for multiple testing with the Benjamini-Hochberg procedure, which controls the
+// false discovery rate (FDR). It returns the q-values in the order of the given p-values.
+func BenjaminiHochberg(ps []float64) []float64 {
+	n := len(ps)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return ps[order[i]] < ps[order[j]] })
+	qs := make([]float64, n)
+	min := 1.0
+	for rank := n; rank >= 1; rank-- {
+		i := order[rank-1]
+		min = math.Min(min, ps[i]*float64(n)/float64(rank))
+		qs[i] = min
+	}
+	return qs
+}
@@ -0,0 +1,55 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import "sync"
+
+// Interner deduplicates strings. Vocabulary files contain the same diagnosis codes and category names many times,
+// each parsed into a separately allocated string. Interning them keeps a single copy of each distinct string in
+// memory. An Interner is meant for one load, e.g. the parsing of a single file, so that its map is freed with it.
+// Strings that are mostly unique, such as patient IDs, should not be interned.
+type Interner struct {
+	lock    sync.Mutex
+	strings map[string]string
+}
+
+// NewInterner creates an empty Interner.
+func NewInterner() *Interner {
+	return &Interner{strings: map[string]string{}}
+}
+
+// Intern returns the canonical copy of a string. The first time a string is interned, a copy of it becomes the canonical
+// copy, so that substrings of parsed lines do not keep the complete lines alive. It is safe to call Intern concurrently.
+func (interner *Interner) Intern(s string) string {
+	interner.lock.Lock()
+	defer interner.lock.Unlock()
+	if canonical, ok := interner.strings[s]; ok {
+		return canonical
+	}
+	canonical := string([]byte(s))
+	interner.strings[canonical] = canonical
+	return canonical
+}
+
+// Len returns the number of distinct strings that are interned.
+func (interner *Interner) Len() int {
+	interner.lock.Lock()
+	defer interner.lock.Unlock()
+	return len(interner.strings)
+}
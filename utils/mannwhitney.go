@@ -0,0 +1,72 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"math"
+	"sort"
+)
+
+// MannWhitneyUTest computes the two-sided p-value of the Mann-Whitney U test (Wilcoxon rank-sum test) for the
+// hypothesis that two samples come from the same distribution. The p-value uses the normal approximation of U with a
+// correction for ties, which is accurate when both samples have more than about 10 values. It is NaN if a sample is
+// empty, and 1 if all values are tied.
+func MannWhitneyUTest(xs, ys []float64) float64 {
+	n1, n2 := len(xs), len(ys)
+	if n1 == 0 || n2 == 0 {
+		return math.NaN()
+	}
+	type value struct {
+		x     float64
+		first bool
+	}
+	values := make([]value, 0, n1+n2)
+	for _, x := range xs {
+		values = append(values, value{x, true})
+	}
+	for _, y := range ys {
+		values = append(values, value{y, false})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].x < values[j].x })
+	rankSum, ties := 0.0, 0.0
+	for i := 0; i < len(values); {
+		j := i
+		for j < len(values) && values[j].x == values[i].x {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // the mean rank of the tied values, counting from 1
+		for k := i; k < j; k++ {
+			if values[k].first {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	f1, f2 := float64(n1), float64(n2)
+	n := f1 + f2
+	u := rankSum - f1*(f1+1)/2
+	sigma := math.Sqrt(f1 * f2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return 1
+	}
+	z := (u - f1*f2/2) / sigma
+	return math.Min(math.Erfc(math.Abs(z)/math.Sqrt2), 1)
+}
@@ -0,0 +1,48 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// WriteNpyMatrix writes a square matrix of float32 values, in row-major order, in the .npy format of NumPy, version
+// 1.0, so that it can be loaded with numpy.load. The header is padded so that the data is aligned to 64 bytes.
+func WriteNpyMatrix(w io.Writer, n int, values []float32) error {
+	if len(values) != n*n {
+		return fmt.Errorf("expected %d values for a %dx%d matrix, got %d", n*n, n, n, len(values))
+	}
+	header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (%d, %d), }", n, n)
+	// the magic string, the version, and the header length take 10 bytes, and the header ends with a newline
+	header += strings.Repeat(" ", 63-(10+len(header))%64) + "\n"
+	out := bufio.NewWriter(w)
+	out.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(out, binary.LittleEndian, uint16(len(header)))
+	out.WriteString(header)
+	var buf [4]byte
+	for _, v := range values {
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+		out.Write(buf[:])
+	}
+	return out.Flush()
+}
@@ -0,0 +1,85 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Verbosity controls which messages ptra prints, cf. SetVerbosity.
+type Verbosity int32
+
+const (
+	// Silent suppresses all messages, e.g. when ptra is used as a library.
+	Silent Verbosity = iota
+	// Quiet only prints warnings.
+	Quiet
+	// Normal prints warnings and the progress of the pipeline. This is the default.
+	Normal
+	// Verbose also prints details, e.g. the collected trajectories and the cohorts.
+	Verbose
+)
+
+var (
+	verbosity = int32(Normal)
+	// messages is the logger for the progress messages and details. It writes to standard error, so that standard
+	// output is reserved for the data that is written by the ptra commands, e.g. the query results of ptra sql.
+	messages = log.New(os.Stderr, "", 0)
+)
+
+// SetVerbosity sets which messages are printed.
+func SetVerbosity(v Verbosity) {
+	atomic.StoreInt32(&verbosity, int32(v))
+}
+
+// GetVerbosity returns which messages are printed, cf. SetVerbosity.
+func GetVerbosity() Verbosity {
+	return Verbosity(atomic.LoadInt32(&verbosity))
+}
+
+// SetOutput sets the writer to which the progress messages and details are written. The warnings are written to the
+// output of the standard logger, cf. log.SetOutput.
+func SetOutput(w io.Writer) {
+	messages.SetOutput(w)
+}
+
+// Info prints a progress message if the verbosity is Normal or Verbose. The operands are formatted as by fmt.Println.
+func Info(a ...interface{}) {
+	if GetVerbosity() >= Normal {
+		messages.Output(2, fmt.Sprintln(a...))
+	}
+}
+
+// Detail prints a message with details if the verbosity is Verbose. The operands are formatted as by fmt.Println.
+func Detail(a ...interface{}) {
+	if GetVerbosity() >= Verbose {
+		messages.Output(2, fmt.Sprintln(a...))
+	}
+}
+
+// Warning prints a warning with the standard logger, unless the verbosity is Silent. The operands are formatted as by
+// fmt.Println, after "Warning: ".
+func Warning(a ...interface{}) {
+	if GetVerbosity() >= Quiet {
+		log.Output(2, "Warning: "+fmt.Sprintln(a...))
+	}
+}
@@ -0,0 +1,285 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal writer of Parquet files, for exporting large tables of numbers, such as the similarities between
+// trajectories, to data science tools. It supports required INT32 and DOUBLE columns, which are written
+// uncompressed in the PLAIN encoding, with a data page per column per row group. The file metadata are encoded with the
+// Thrift compact protocol, cf. https://parquet.apache.org/docs/file-format/.
+
+// The types of the columns of a Parquet file.
+const (
+	ParquetInt32  = 1
+	ParquetDouble = 5
+)
+
+// ParquetColumn is a required column of a Parquet file, with a name and a type, ParquetInt32 or ParquetDouble.
+type ParquetColumn struct {
+	Name string
+	Type int32
+}
+
+// The Thrift compact protocol types of the fields of the Parquet metadata.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs with the compact protocol.
+type thriftWriter struct {
+	buf     []byte
+	lastIDs []int16 // the IDs of the last fields of the enclosing structs
+	lastID  int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf = binary.AppendUvarint(t.buf, v)
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+// field writes the header of a field of a struct.
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.zigzag(int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+func (t *thriftWriter) string(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// list writes the header of a list field with n elements of the given type.
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	t.listHeader(typ, n)
+}
+
+func (t *thriftWriter) listHeader(typ byte, n int) {
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.varint(uint64(n))
+	}
+}
+
+// begin starts a struct, either as a field with the given ID, or as an element of a list if id is 0.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.lastIDs = append(t.lastIDs, t.lastID)
+	t.lastID = 0
+}
+
+// end ends a struct.
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0) // stop field
+	t.lastID = t.lastIDs[len(t.lastIDs)-1]
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+// parquetColumnChunk describes the data page of a column in a row group.
+type parquetColumnChunk struct {
+	offset, size, values int64
+}
+
+// ParquetWriter writes a Parquet file, with a row group per rowGroupSize rows, cf. ParquetColumn.
+type ParquetWriter struct {
+	w            *bufio.Writer
+	offset       int64
+	columns      []ParquetColumn
+	rowGroupSize int
+	values       [][]byte // the encoded values of the current row group, per column
+	rows         int      // the number of rows in the current row group
+	rowGroups    [][]parquetColumnChunk
+	rowCounts    []int64
+	err          error
+}
+
+// NewParquetWriter starts a Parquet file with the given columns on w, with at most rowGroupSize rows per row group.
+func NewParquetWriter(w io.Writer, columns []ParquetColumn, rowGroupSize int) *ParquetWriter {
+	pw := &ParquetWriter{w: bufio.NewWriter(w), columns: columns, rowGroupSize: rowGroupSize,
+		values: make([][]byte, len(columns))}
+	pw.write([]byte("PAR1"))
+	return pw
+}
+
+func (pw *ParquetWriter) write(p []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	pw.err = err
+}
+
+// Write adds a row to the Parquet file, with a value per column: an int32 for ParquetInt32 columns, and a float64 for
+// ParquetDouble columns.
+func (pw *ParquetWriter) Write(row ...interface{}) error {
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("expected %d values per row, got %d", len(pw.columns), len(row))
+	}
+	for c, value := range row {
+		switch v := value.(type) {
+		case int32:
+			if pw.columns[c].Type != ParquetInt32 {
+				return fmt.Errorf("column %s: unexpected int32 value", pw.columns[c].Name)
+			}
+			pw.values[c] = binary.LittleEndian.AppendUint32(pw.values[c], uint32(v))
+		case float64:
+			if pw.columns[c].Type != ParquetDouble {
+				return fmt.Errorf("column %s: unexpected float64 value", pw.columns[c].Name)
+			}
+			pw.values[c] = binary.LittleEndian.AppendUint64(pw.values[c], math.Float64bits(v))
+		default:
+			return fmt.Errorf("column %s: unsupported value %v", pw.columns[c].Name, value)
+		}
+	}
+	pw.rows++
+	if pw.rows >= pw.rowGroupSize {
+		pw.flushRowGroup()
+	}
+	return pw.err
+}
+
+// flushRowGroup writes the data pages of the current row group.
+func (pw *ParquetWriter) flushRowGroup() {
+	if pw.rows == 0 {
+		return
+	}
+	chunks := make([]parquetColumnChunk, len(pw.columns))
+	for c, values := range pw.values {
+		var header thriftWriter
+		header.begin(0)
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(values)))
+		header.i32(3, int32(len(values)))
+		header.begin(5)
+		header.i32(1, int32(pw.rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE definition levels, which are not stored for required columns
+		header.i32(4, 3) // RLE repetition levels, idem
+		header.end()
+		header.end()
+		chunks[c] = parquetColumnChunk{offset: pw.offset, size: int64(len(header.buf) + len(values)),
+			values: int64(pw.rows)}
+		pw.write(header.buf)
+		pw.write(values)
+		pw.values[c] = values[:0]
+	}
+	pw.rowGroups = append(pw.rowGroups, chunks)
+	pw.rowCounts = append(pw.rowCounts, int64(pw.rows))
+	pw.rows = 0
+}
+
+// Close writes the last row group and the metadata of the Parquet file. It does not close the underlying writer.
+func (pw *ParquetWriter) Close() error {
+	pw.flushRowGroup()
+	var meta thriftWriter
+	meta.begin(0)
+	meta.i32(1, 1) // version
+	meta.list(2, thriftStruct, len(pw.columns)+1)
+	meta.begin(0)
+	meta.string(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.end()
+	for _, column := range pw.columns {
+		meta.begin(0)
+		meta.i32(1, column.Type)
+		meta.i32(3, 0) // REQUIRED
+		meta.string(4, column.Name)
+		meta.end()
+	}
+	total := int64(0)
+	for _, n := range pw.rowCounts {
+		total += n
+	}
+	meta.i64(3, total)
+	meta.list(4, thriftStruct, len(pw.rowGroups))
+	for g, chunks := range pw.rowGroups {
+		meta.begin(0)
+		meta.list(1, thriftStruct, len(chunks))
+		size := int64(0)
+		for c, chunk := range chunks {
+			meta.begin(0)
+			meta.i64(2, chunk.offset)
+			meta.begin(3)
+			meta.i32(1, pw.columns[c].Type)
+			meta.list(2, thriftI32, 2)
+			meta.zigzag(0) // PLAIN
+			meta.zigzag(3) // RLE
+			meta.list(3, thriftBinary, 1)
+			meta.binary(pw.columns[c].Name)
+			meta.i32(4, 0) // UNCOMPRESSED
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.size)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+			size += chunk.size
+		}
+		meta.i64(2, size)
+		meta.i64(3, pw.rowCounts[g])
+		meta.end()
+	}
+	meta.string(6, "ptra")
+	meta.end()
+	pw.write(meta.buf)
+	pw.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.buf))))
+	pw.write([]byte("PAR1"))
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
@@ -0,0 +1,151 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Stage tracks the progress of a stage of the ptra pipeline, e.g. parsing the input or calculating the relative risk
+// ratios. The progress is measured in steps, of which there are Total. A Total of 0 means the number of steps is not
+// known upfront.
+type Stage struct {
+	Name  string
+	Total int64
+	done  int64
+	start time.Time
+	end   int64 // unix nanoseconds, 0 while the stage is running
+	ctx   context.Context
+	span  trace.Span // the span of the stage when the run is traced, cf. StartTracing
+}
+
+// Add marks n more steps of the stage as done. It is safe to call Add from multiple goroutines.
+func (s *Stage) Add(n int) {
+	atomic.AddInt64(&s.done, int64(n))
+}
+
+// Done marks the stage as finished.
+func (s *Stage) Done() {
+	atomic.StoreInt64(&s.end, time.Now().UnixNano())
+	s.span.SetAttributes(attribute.Int64("ptra.stage.steps", s.Steps()))
+	s.span.End()
+}
+
+// Steps returns the number of steps of the stage that are done.
+func (s *Stage) Steps() int64 {
+	return atomic.LoadInt64(&s.done)
+}
+
+// Finished checks if the stage is finished.
+func (s *Stage) Finished() bool {
+	return atomic.LoadInt64(&s.end) != 0
+}
+
+// Elapsed returns the time spent in the stage so far, or the total time of the stage when it is finished.
+func (s *Stage) Elapsed() time.Duration {
+	if end := atomic.LoadInt64(&s.end); end != 0 {
+		return time.Unix(0, end).Sub(s.start)
+	}
+	return time.Since(s.start)
+}
+
+var (
+	stagesLock sync.Mutex
+	stages     []*Stage
+)
+
+// StartStage registers a new stage of the pipeline with the given number of steps and returns it so that the caller
+// can report its progress. Any stage that is still running is finished first, since the stages are executed one after
+// the other.
+func StartStage(name string, total int) *Stage {
+	stagesLock.Lock()
+	defer stagesLock.Unlock()
+	finishStages()
+	s := &Stage{Name: name, Total: int64(total), start: time.Now()}
+	s.ctx, s.span = startStageSpan(name, total)
+	stages = append(stages, s)
+	return s
+}
+
+func finishStages() {
+	for _, s := range stages {
+		if !s.Finished() {
+			s.Done()
+		}
+	}
+}
+
+// FinishStages marks all stages as finished, at the end of the pipeline.
+func FinishStages() {
+	stagesLock.Lock()
+	defer stagesLock.Unlock()
+	finishStages()
+}
+
+// Stages returns the stages of the pipeline that are started so far.
+func Stages() []*Stage {
+	stagesLock.Lock()
+	defer stagesLock.Unlock()
+	return append([]*Stage(nil), stages...)
+}
+
+// checkpoint is 1 while an early checkpoint of the pipeline is requested, cf. RequestCheckpoint.
+var checkpoint int32
+
+// checkpoints is 1 while the running pipeline can still write an early checkpoint, cf. AllowCheckpoints.
+var checkpoints int32
+
+// AllowCheckpoints sets whether the running pipeline can still write an early checkpoint. Disallowing checkpoints
+// clears a pending request.
+func AllowCheckpoints(allow bool) {
+	if allow {
+		atomic.StoreInt32(&checkpoints, 1)
+	} else {
+		atomic.StoreInt32(&checkpoints, 0)
+		atomic.StoreInt32(&checkpoint, 0)
+	}
+}
+
+// CheckpointsAllowed checks if the running pipeline can still write an early checkpoint, cf. AllowCheckpoints.
+func CheckpointsAllowed() bool {
+	return atomic.LoadInt32(&checkpoints) == 1
+}
+
+// RequestCheckpoint requests an early checkpoint of the running pipeline, e.g. from the terminal UI. The pipeline writes
+// the checkpoint at the next point from which it can be resumed, cf. CheckpointRequested. It returns false, without
+// requesting a checkpoint, if the pipeline cannot write one anymore, cf. AllowCheckpoints. It is safe to call
+// RequestCheckpoint from multiple goroutines.
+func RequestCheckpoint() bool {
+	if !CheckpointsAllowed() {
+		return false
+	}
+	atomic.StoreInt32(&checkpoint, 1)
+	return true
+}
+
+// CheckpointRequested checks if an early checkpoint is requested, and clears the request.
+func CheckpointRequested() bool {
+	return atomic.SwapInt32(&checkpoint, 0) == 1
+}
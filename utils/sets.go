@@ -0,0 +1,155 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package utils
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Generic set and collection operations. The linear operations, such as Member and IntersectionSize, are meant for
+// short slices, e.g. the diagnoses of a trajectory, for which they are faster than building a map. For longer slices,
+// use a Set, or sort the slices and use SortedIntersection.
+
+// Min returns the smaller of x and y.
+func Min[T cmp.Ordered](x, y T) T {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// Max returns the larger of x and y.
+func Max[T cmp.Ordered](x, y T) T {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// Member returns whether x occurs in the slice ys.
+func Member[T comparable](x T, ys []T) bool {
+	for _, y := range ys {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// Unique returns the elements of a slice without duplicates, in the order of their first occurrences. The input slice
+// is not modified.
+func Unique[T comparable](xs []T) []T {
+	seen := make(Set[T], len(xs))
+	result := make([]T, 0, len(xs))
+	for _, x := range xs {
+		if !seen.Contains(x) {
+			seen.Add(x)
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+// IntersectionSize returns the number of distinct elements that occur in both slices xs and ys. Duplicates are only
+// counted once, so that it can be used for set similarities such as the Jaccard index.
+func IntersectionSize[T comparable](xs, ys []T) int {
+	n := 0
+	for i, x := range xs {
+		if Member(x, ys) && !Member(x, xs[:i]) {
+			n++
+		}
+	}
+	return n
+}
+
+// SortedIntersection returns the distinct elements that occur in both of the sorted slices xs and ys, in sorted order.
+// It runs in linear time.
+func SortedIntersection[T cmp.Ordered](xs, ys []T) []T {
+	result := []T{}
+	for i, j := 0, 0; i < len(xs) && j < len(ys); {
+		switch c := cmp.Compare(xs[i], ys[j]); {
+		case c < 0:
+			i++
+		case c > 0:
+			j++
+		default:
+			if len(result) == 0 || result[len(result)-1] != xs[i] {
+				result = append(result, xs[i])
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// SortedIntersectionSize returns the number of distinct elements that occur in both of the sorted slices xs and ys,
+// without allocating their intersection, cf. SortedIntersection.
+func SortedIntersectionSize[T cmp.Ordered](xs, ys []T) int {
+	n := 0
+	for i, j := 0, 0; i < len(xs) && j < len(ys); {
+		switch c := cmp.Compare(xs[i], ys[j]); {
+		case c < 0:
+			i++
+		case c > 0:
+			j++
+		default:
+			if i == 0 || xs[i-1] != xs[i] {
+				n++
+			}
+			i++
+			j++
+		}
+	}
+	return n
+}
+
+// SortedKeys returns the keys of a map in sorted order, e.g. for iterating over a map in the same order in each run.
+func SortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Set is a set of comparable elements.
+type Set[T comparable] map[T]struct{}
+
+// NewSet returns a set with the given elements.
+func NewSet[T comparable](xs ...T) Set[T] {
+	s := make(Set[T], len(xs))
+	for _, x := range xs {
+		s.Add(x)
+	}
+	return s
+}
+
+// Add adds x to a set.
+func (s Set[T]) Add(x T) {
+	s[x] = struct{}{}
+}
+
+// Contains returns whether x is an element of a set.
+func (s Set[T]) Contains(x T) bool {
+	_, ok := s[x]
+	return ok
+}
@@ -0,0 +1,271 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Signed manifests let the recipients of a shared result bundle verify that the output files were not altered after
+// they left the environment of the run, cf. SignOutputs and VerifySignedOutputs. A manifest holds the SHA-256 hashes
+// of the output files and a signature of the hashes, either an HMAC-SHA256 with a shared secret, or an ed25519
+// signature that recipients verify with the public key only.
+
+// The signature algorithms of a signed manifest.
+const (
+	SignatureHMAC    = "hmac-sha256"
+	SignatureEd25519 = "ed25519"
+)
+
+// The status of an output file that differs from a signed manifest.
+const (
+	SignatureChanged  = "changed"  // the file was altered
+	SignatureMissing  = "missing"  // the file was signed, but does not exist
+	SignatureUnsigned = "unsigned" // the file exists, but was not signed
+)
+
+// ErrInvalidSignature is returned by VerifySignedOutputs when the signature of a manifest does not match its hashes.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// signedManifest holds the content hashes of the output files of a run, by file name relative to the directory of the
+// manifest, and the signature of the algorithm and the hashes.
+type signedManifest struct {
+	Algorithm string            `json:"algorithm"`
+	Files     map[string]string `json:"files"`
+	Signature string            `json:"signature"`
+}
+
+// signedContent returns the content of a manifest that is signed. The file names are sorted by json.Marshal, so that
+// the content does not depend on the order in which the files were hashed.
+func (m *signedManifest) signedContent() ([]byte, error) {
+	return json.Marshal(struct {
+		Algorithm string            `json:"algorithm"`
+		Files     map[string]string `json:"files"`
+	}{m.Algorithm, m.Files})
+}
+
+// signingKey is the key of a signed manifest: an HMAC secret, an ed25519 private key for signing and verifying, or an
+// ed25519 public key for verifying only.
+type signingKey struct {
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// readSigningKey reads the key of a signed manifest. A key file with a PEM block holds an ed25519 key, either a PKCS #8
+// private key or a PKIX public key, e.g. as generated with openssl genpkey -algorithm ed25519. Any other key file holds
+// an HMAC secret, without leading and trailing white space.
+func readSigningKey(name string) (*signingKey, error) {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		secret := bytes.TrimSpace(content)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s: empty secret", name)
+		}
+		return &signingKey{secret: secret}, nil
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 private key", name)
+		}
+		return &signingKey{private: private, public: private.Public().(ed25519.PublicKey)}, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 public key", name)
+		}
+		return &signingKey{public: public}, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %s", name, block.Type)
+	}
+}
+
+// algorithm returns the signature algorithm of a key.
+func (key *signingKey) algorithm() string {
+	if key.secret != nil {
+		return SignatureHMAC
+	}
+	return SignatureEd25519
+}
+
+// sign signs content with a key.
+func (key *signingKey) sign(content []byte) ([]byte, error) {
+	if key.secret != nil {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(content)
+		return mac.Sum(nil), nil
+	}
+	if key.private == nil {
+		return nil, errors.New("signing requires an ed25519 private key, not a public key")
+	}
+	return ed25519.Sign(key.private, content), nil
+}
+
+// verify checks the signature of content with a key.
+func (key *signingKey) verify(algorithm string, content, signature []byte) bool {
+	if algorithm != key.algorithm() {
+		return false
+	}
+	if key.secret != nil {
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(content)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return ed25519.Verify(key.public, content, signature)
+}
+
+// HashFile returns the hex-encoded SHA-256 hash of the content of a file.
+func HashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFiles returns the hashes of the regular files in a directory and its subdirectories, by file name relative to
+// the directory, except for the excluded file.
+func hashFiles(dir, exclude string) (map[string]string, error) {
+	files := map[string]string{}
+	exclude = filepath.Clean(exclude)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || filepath.Clean(path) == exclude {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hash, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = hash
+		return nil
+	})
+	return files, err
+}
+
+// SignOutputs writes a signed manifest with the SHA-256 hashes of all files in the directory of the manifest and its
+// subdirectories, e.g. the output path of a run, signed with the key in the key file, cf. readSigningKey.
+func SignOutputs(manifest, keyFile string) error {
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+	files, err := hashFiles(filepath.Dir(manifest), manifest)
+	if err != nil {
+		return err
+	}
+	m := signedManifest{Algorithm: key.algorithm(), Files: files}
+	content, err := m.signedContent()
+	if err != nil {
+		return err
+	}
+	signature, err := key.sign(content)
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyFile, err)
+	}
+	m.Signature = hex.EncodeToString(signature)
+	content, err = json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifest, content, 0666)
+}
+
+// VerifySignedOutputs checks the signature of a signed manifest with the key in the key file, and returns
+// ErrInvalidSignature if it does not match. Otherwise, it compares the files in the directory of the manifest and its
+// subdirectories with the signed hashes, and returns the files that differ, by file name with their status.
+func VerifySignedOutputs(manifest, keyFile string) (map[string]string, error) {
+	key, err := readSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var m signedManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", manifest, err)
+	}
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", manifest, ErrInvalidSignature)
+	}
+	if content, err = m.signedContent(); err != nil {
+		return nil, err
+	}
+	if !key.verify(m.Algorithm, content, signature) {
+		return nil, fmt.Errorf("%s: %w", manifest, ErrInvalidSignature)
+	}
+	files, err := hashFiles(filepath.Dir(manifest), manifest)
+	if err != nil {
+		return nil, err
+	}
+	differences := map[string]string{}
+	for file, hash := range m.Files {
+		if current, ok := files[file]; !ok {
+			differences[file] = SignatureMissing
+		} else if current != hash {
+			differences[file] = SignatureChanged
+		}
+	}
+	for file := range files {
+		if _, ok := m.Files[file]; !ok {
+			differences[file] = SignatureUnsigned
+		}
+	}
+	return differences, nil
+}
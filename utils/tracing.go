@@ -0,0 +1,161 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing the stages of the ptra pipeline and the external processes it runs with OpenTelemetry. Without an exporter,
+// the spans are not recorded.
+
+var (
+	tracer       = otel.Tracer("ptra")
+	tracingLock  sync.Mutex
+	tracingCtx   = context.Background() // the context of the span of the command that is traced
+	traceContext = propagation.TraceContext{}
+)
+
+// TracingConfigured checks if an OTLP endpoint for exporting traces is configured with the standard OpenTelemetry
+// environment variables OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+func TracingConfigured() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// StartTracing starts tracing a command when an OTLP endpoint is configured, cf. TracingConfigured. The traces are
+// exported with OTLP over HTTP, which is configured further with the standard OpenTelemetry environment variables, e.g.
+// OTEL_EXPORTER_OTLP_HEADERS. It returns a function that ends the span of the command and exports the remaining spans.
+// If the export cannot be set up, a warning is logged and the command is not traced.
+func StartTracing(command, version string) func() {
+	if !TracingConfigured() {
+		return func() {}
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		Warning("cannot export traces: ", err)
+		return func() {}
+	}
+	return StartTracingTo(exporter, command, version)
+}
+
+// StartTracingTo starts tracing a command, exporting the spans to the given exporter. The span of the command is the
+// parent of the spans of the stages of the pipeline, cf. StartStage, which are the parents of the spans of the external
+// processes, cf. TraceCommand. If the environment variable TRACEPARENT holds a W3C trace context, e.g. set by a
+// workflow engine that runs ptra, the span of the command is part of that trace. The service name is ptra, unless
+// OTEL_SERVICE_NAME is set. It returns a function that ends the span of the command and exports the remaining spans.
+func StartTracingTo(exporter sdktrace.SpanExporter, command, version string) func() {
+	attributes := []attribute.KeyValue{attribute.String("service.version", version)}
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		attributes = append(attributes, attribute.String("service.name", "ptra"))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attributes...))
+	if err != nil {
+		Warning("incomplete trace resource: ", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	parent := traceContext.Extract(context.Background(), propagation.MapCarrier{
+		"traceparent": os.Getenv("TRACEPARENT"),
+		"tracestate":  os.Getenv("TRACESTATE"),
+	})
+	ctx, span := tracer.Start(parent, command, trace.WithAttributes(
+		attribute.StringSlice("process.command_args", os.Args)))
+	tracingLock.Lock()
+	tracingCtx = ctx
+	tracingLock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			FinishStages()
+			span.End()
+			tracingLock.Lock()
+			tracingCtx = context.Background()
+			tracingLock.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(ctx); err != nil {
+				Warning("cannot export traces: ", err)
+			}
+		})
+	}
+}
+
+// startStageSpan starts the span of a stage of the pipeline, as a child of the span of the command.
+func startStageSpan(name string, total int) (context.Context, trace.Span) {
+	tracingLock.Lock()
+	ctx := tracingCtx
+	tracingLock.Unlock()
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.Int("ptra.stage.total", total)))
+}
+
+// TraceCommand starts a span for running an external process, as a child of the span of the running stage of the
+// pipeline, cf. StartStage. It must be called before the process is started, because it passes the trace context to
+// the process in the TRACEPARENT environment variable, so that processes that are traced themselves join the trace. It
+// returns a function to call with the error of the process when it finishes, which ends the span.
+func TraceCommand(cmd *exec.Cmd) func(err error) {
+	tracingLock.Lock()
+	ctx := tracingCtx
+	tracingLock.Unlock()
+	stagesLock.Lock()
+	for _, s := range stages {
+		if !s.Finished() {
+			ctx = s.ctx
+		}
+	}
+	stagesLock.Unlock()
+	ctx, span := tracer.Start(ctx, "exec "+filepath.Base(cmd.Path), trace.WithAttributes(
+		attribute.String("process.executable.name", filepath.Base(cmd.Path)),
+		attribute.StringSlice("process.command_args", cmd.Args)))
+	if span.SpanContext().IsValid() {
+		carrier := propagation.MapCarrier{}
+		traceContext.Inject(ctx, carrier)
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		for key, value := range carrier {
+			cmd.Env = append(cmd.Env, strings.ToUpper(key)+"="+value)
+		}
+	}
+	return func(err error) {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			span.SetAttributes(attribute.Int("process.exit.code", exitErr.ExitCode()))
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -18,25 +18,66 @@
 
 package utils
 
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MinInt returns the smaller of two ints.
+//
+// Deprecated: use Min.
 func MinInt(x, y int) int {
-	if x < y {
-		return x
-	}
-	return y
+	return Min(x, y)
 }
 
+// MaxInt returns the larger of two ints.
+//
+// Deprecated: use Max.
 func MaxInt(x, y int) int {
-	if x > y {
-		return x
-	}
-	return y
+	return Max(x, y)
 }
 
+// MemberInt returns whether x occurs in the slice y.
+//
+// Deprecated: use Member, or a Set for long slices.
 func MemberInt(x int, y []int) bool {
-	for _, el := range y {
-		if el == x {
-			return true
-		}
+	return Member(x, y)
+}
+
+// Ratio divides x by y. Division by zero does not produce an infinity; instead NaN is returned together with false, so
+// that callers can omit the value from their output and report a warning.
+func Ratio(x, y int64) (float64, bool) {
+	if y == 0 {
+		return math.NaN(), false
+	}
+	return float64(x) / float64(y), true
+}
+
+// Percentage computes x as a percentage of y. As with Ratio, NaN and false are returned when y is zero.
+func Percentage(x, y int64) (float64, bool) {
+	r, ok := Ratio(x, y)
+	return 100.0 * r, ok
+}
+
+// Median computes the median of a list of numbers, or NaN for an empty list. The list is sorted in place.
+func Median(xs []float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+// FormatStat formats a statistic with the given precision for writing to an output file. Undefined statistics (NaN or
+// infinities) are written as NA.
+func FormatStat(x float64, prec int) string {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return "NA"
 	}
-	return false
+	return strconv.FormatFloat(x, 'f', prec, 64)
 }
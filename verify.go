@@ -0,0 +1,381 @@
+// PTRA: Patient Trajectory Analysis Library
+// Copyright (c) 2022 imec vzw.
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version, and Additional Terms
+// (see below).
+
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public
+// License and Additional Terms along with this program. If not, see
+// <https://github.com/ExaScience/ptra/blob/master/LICENSE.txt>.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"ptra/cluster"
+	"ptra/trajectory"
+	"ptra/utils"
+	"sort"
+	"strings"
+)
+
+// rrQuantiles are the quantiles of the RR scores that are stored in a snapshot.
+var rrQuantiles = []float64{0.05, 0.25, 0.5, 0.75, 0.95}
+
+// snapshot contains the key outputs of a ptra run. A snapshot of a reference run can be compared against a rerun with
+// the verify command, e.g. to validate an upgrade of ptra.
+type snapshot struct {
+	FormatVersion     int           // the format version of the snapshot, cf. snapshotFormatVersion
+	Version           string        // the ptra version that created the snapshot
+	Trajectories      int           // the number of trajectories
+	TrajectoryLengths map[int]int   // the number of trajectories per trajectory length
+	Pairs             int           // the number of diagnosis pairs used for building trajectories
+	RRPairs           int           // the number of diagnosis pairs with a significant RR score
+	RRQuantiles       []float64     // the quantiles of the finite RR scores, cf. rrQuantiles
+	ClusterSizes      map[int][]int // per cluster granularity, the sizes of the clusters in decreasing order
+}
+
+// The format versions of the saved configurations and snapshots. Files without a format version were written by ptra
+// versions before the format versions were introduced, and are read as version 0, cf. trajectory.CheckFormatVersion.
+const (
+	configFormatVersion   = 1
+	snapshotFormatVersion = 1
+)
+
+func configFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.config.json", cfg.OutputPath, cfg.Name)
+}
+
+func snapshotFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.snapshot.json", cfg.OutputPath, cfg.Name)
+}
+
+func manifestFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.manifest.json", cfg.OutputPath, cfg.Name)
+}
+
+func changelogFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.changelog.csv", cfg.OutputPath, cfg.Name)
+}
+
+func checkpointFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.checkpoint-rr.tab", cfg.OutputPath, cfg.Name)
+}
+
+func signatureFileName(cfg *config) string {
+	return fmt.Sprintf("%s%s.signature.json", cfg.OutputPath, cfg.Name)
+}
+
+func saveJSON(v interface{}, fileName string) {
+	file, err := utils.CreateFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func loadJSON(v interface{}, fileName string) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		panic(fmt.Errorf("%s: %v", fileName, err))
+	}
+}
+
+// absFileName makes a file name absolute, so that a saved config can be used from another working directory.
+func absFileName(name string) string {
+	if name == "" {
+		return name
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		panic(err)
+	}
+	return abs
+}
+
+// absFileNames makes the file names of a comma-separated list of input files absolute, cf. absFileName.
+func absFileNames(names string) string {
+	if !strings.Contains(names, ",") {
+		return absFileName(names)
+	}
+	abs := []string{}
+	for _, name := range strings.Split(names, ",") {
+		abs = append(abs, absFileName(strings.TrimSpace(name)))
+	}
+	return strings.Join(abs, ",")
+}
+
+// saveConfig saves the configuration of a run as json, with its format version. All file names are made absolute.
+func saveConfig(cfg *config, fileName string) {
+	saved := *cfg
+	saved.FormatVersion = configFormatVersion
+	saved.PatientInfo = absFileNames(saved.PatientInfo)
+	saved.PatientDiagnoses = absFileNames(saved.PatientDiagnoses)
+	for _, name := range []*string{&saved.DiagnosisInfo, &saved.ICD9ToICD10File, &saved.SaveRR, &saved.LoadRR,
+		&saved.TumorInfo, &saved.Biomarkers, &saved.Literature, &saved.Review, &saved.TreatmentInfo,
+		&saved.SimilarityFile, &saved.CodeValidity, &saved.OMOPConcepts, &saved.ClusterNames,
+		&saved.Bundles, &saved.ExcludeTransitions, &saved.Sign, &saved.SimilarityCache,
+		&saved.CodeHierarchy, &saved.Embeddings, &saved.Descriptions, &saved.Messages, &saved.CheckpointDir} {
+		*name = absFileName(*name)
+	}
+	if saved.Clusterer != cluster.NativeClusterer {
+		saved.Clusterer = absFileName(saved.Clusterer)
+	}
+	saveJSON(&saved, fileName)
+}
+
+// quantile returns the q-th quantile of sorted values, using linear interpolation.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := q * float64(len(sorted)-1)
+	low := int(math.Floor(pos))
+	high := int(math.Ceil(pos))
+	return sorted[low] + (sorted[high]-sorted[low])*(pos-float64(low))
+}
+
+// takeSnapshot collects the key outputs of a finished run. The cluster sizes are read from the clustered trajectory
+// files written by the clustering step.
+func takeSnapshot(exp *trajectory.Experiment, cfg *config) *snapshot {
+	snap := &snapshot{
+		FormatVersion:     snapshotFormatVersion,
+		Version:           programMessage(),
+		Trajectories:      len(exp.Trajectories),
+		TrajectoryLengths: map[int]int{},
+		Pairs:             len(exp.Pairs),
+		ClusterSizes:      map[int][]int{},
+	}
+	for _, t := range exp.Trajectories {
+		snap.TrajectoryLengths[len(t.Diagnoses)]++
+	}
+	rrs := []float64{}
+	// only the pairs that passed the significance test have an RR score, the others keep the default RR of 1
+	for d1, row := range exp.DxDPatients {
+		for d2, patients := range row {
+			if patients == nil {
+				continue
+			}
+			snap.RRPairs++
+			// the RR is infinite if d2 never occurs in the comparison groups, which is left out of the quantiles
+			if rr := exp.DxDRR[d1][d2]; !math.IsInf(rr, 0) && !math.IsNaN(rr) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	sort.Float64s(rrs)
+	for _, q := range rrQuantiles {
+		// NaN cannot be encoded in json, so empty RR matrices get 0 quantiles
+		if len(rrs) == 0 {
+			snap.RRQuantiles = append(snap.RRQuantiles, 0)
+		} else {
+			snap.RRQuantiles = append(snap.RRQuantiles, quantile(rrs, q))
+		}
+	}
+	if cfg.Cluster {
+		for _, gran := range cfg.clusterGranularityList() {
+			fileName := filepath.Join(cfg.OutputPath, fmt.Sprintf("%s-clusters-directly", exp.Name),
+				fmt.Sprintf("dump.%s.mci.I%d.clustered.trajectories.tab", exp.Name, gran))
+			_, _, summaries, err := trajectory.ReadClusteredTrajectoriesFromTabFile(fileName)
+			if err != nil {
+				utils.Warning("cannot read clusters for snapshot: ", err)
+				continue
+			}
+			sizes := []int{}
+			for _, summary := range summaries {
+				sizes = append(sizes, summary.Trajectories)
+			}
+			sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+			snap.ClusterSizes[gran] = sizes
+		}
+	}
+	return snap
+}
+
+func saveSnapshot(snap *snapshot, fileName string) {
+	saveJSON(snap, fileName)
+}
+
+// snapshotComparison collects the differences between a reference snapshot and a new snapshot. Counts may differ by
+// countSlack in addition to the relative tolerance. The names of both snapshots and the statuses of equal and
+// differing outputs are used in the report.
+type snapshotComparison struct {
+	tolerance  float64
+	countSlack float64
+	failures   int
+	names      [2]string
+	statuses   [2]string
+}
+
+// newSnapshotComparison creates a comparison of a snapshot against a reference snapshot, as by the verify command.
+func newSnapshotComparison(tolerance float64) *snapshotComparison {
+	return &snapshotComparison{tolerance: tolerance, countSlack: 1, names: [2]string{"reference", "verified"},
+		statuses: [2]string{"OK  ", "FAIL"}}
+}
+
+// compare checks if a value is within the relative tolerance of a reference value, or within the given absolute
+// tolerance, and prints the result.
+func (c *snapshotComparison) compare(what string, reference, value, absolute float64) {
+	status := c.statuses[0]
+	if math.Abs(value-reference) > math.Max(c.tolerance*math.Abs(reference), absolute) {
+		status = c.statuses[1]
+		c.failures++
+	}
+	fmt.Printf("%s %s: %s %v, %s %v\n", status, what, c.names[0], reference, c.names[1], value)
+}
+
+// compareCount compares counts. For verify, small counts are allowed to differ by 1, since the relative tolerance is
+// too strict for them, cf. countSlack.
+func (c *snapshotComparison) compareCount(what string, reference, value int) {
+	c.compare(what, float64(reference), float64(value), c.countSlack)
+}
+
+// compareSnapshots prints a report of the comparison of a snapshot against a reference snapshot and returns the number
+// of outputs that differ more than the given relative tolerance.
+func compareSnapshots(reference, snap *snapshot, tolerance float64) int {
+	return newSnapshotComparison(tolerance).compareSnapshots(reference, snap)
+}
+
+// compareSnapshots prints a report of the comparison of a snapshot against a reference snapshot and returns the number
+// of outputs that differ more than the tolerance of the comparison.
+func (c *snapshotComparison) compareSnapshots(reference, snap *snapshot) int {
+	for i, version := range []string{reference.Version, snap.Version} {
+		fmt.Printf("%s%s version: %s\n", strings.ToUpper(c.names[i][:1]), c.names[i][1:], version)
+	}
+	c.compareCount("trajectories", reference.Trajectories, snap.Trajectories)
+	lengths := map[int]bool{}
+	for l := range reference.TrajectoryLengths {
+		lengths[l] = true
+	}
+	for l := range snap.TrajectoryLengths {
+		lengths[l] = true
+	}
+	sortedLengths := []int{}
+	for l := range lengths {
+		sortedLengths = append(sortedLengths, l)
+	}
+	sort.Ints(sortedLengths)
+	for _, l := range sortedLengths {
+		c.compareCount(fmt.Sprintf("trajectories of length %d", l), reference.TrajectoryLengths[l],
+			snap.TrajectoryLengths[l])
+	}
+	c.compareCount("diagnosis pairs", reference.Pairs, snap.Pairs)
+	c.compareCount("diagnosis pairs with RR", reference.RRPairs, snap.RRPairs)
+	for i, q := range rrQuantiles {
+		if i < len(reference.RRQuantiles) && i < len(snap.RRQuantiles) {
+			c.compare(fmt.Sprintf("RR quantile %v", q), reference.RRQuantiles[i], snap.RRQuantiles[i], 0)
+		}
+	}
+	grans := []int{}
+	for gran := range reference.ClusterSizes {
+		grans = append(grans, gran)
+	}
+	sort.Ints(grans)
+	for _, gran := range grans {
+		refSizes, sizes := reference.ClusterSizes[gran], snap.ClusterSizes[gran]
+		c.compareCount(fmt.Sprintf("clusters for granularity %d", gran), len(refSizes), len(sizes))
+		// only the largest clusters are compared, small clusters are too sensitive to random sampling
+		for i := 0; i < len(refSizes) && i < len(sizes) && i < 10; i++ {
+			c.compareCount(fmt.Sprintf("size of cluster %d for granularity %d", i+1, gran), refSizes[i],
+				sizes[i])
+		}
+	}
+	return c.failures
+}
+
+const verifyHelp = "\nptra verify parameters:\n" +
+	"ptra verify configFile snapshotFile \n" +
+	"[--outputPath path]\n" +
+	"[--tolerance nr]\n" +
+	outputHelp +
+	profileHelp
+
+// verify implements the ptra verify command, which reruns a pipeline with a stored config and compares the key outputs
+// against a reference snapshot.
+func verify() {
+	var (
+		outputPath string
+		tolerance  float64
+		profiling  profiles
+	)
+	var flags flag.FlagSet
+	flags.StringVar(&outputPath, "outputPath", "", "The path where the outputs of the rerun are written. By default "+
+		"a temporary directory is used.")
+	flags.Float64Var(&tolerance, "tolerance", 0.05, "The relative tolerance for differences between the reference "+
+		"and the rerun.")
+	profiling.addFlags(&flags)
+	parseFlags(flags, 4, verifyHelp)
+	configFile := getFileName(os.Args[2], verifyHelp)
+	snapshotFile := getFileName(os.Args[3], verifyHelp)
+	var cfg config
+	loadJSON(&cfg, configFile)
+	if err := trajectory.CheckFormatVersion(configFile, "config", cfg.FormatVersion, "config",
+		configFormatVersion); err != nil {
+		panic(err)
+	}
+	var reference snapshot
+	loadJSON(&reference, snapshotFile)
+	if err := trajectory.CheckFormatVersion(snapshotFile, "snapshot", reference.FormatVersion, "snapshot",
+		snapshotFormatVersion); err != nil {
+		panic(err)
+	}
+	if outputPath == "" {
+		dir, err := os.MkdirTemp("", "ptra-verify-")
+		if err != nil {
+			panic(err)
+		}
+		outputPath = dir
+	}
+	outputPath, _ = filepath.Abs(outputPath)
+	cfg.OutputPath = outputPath + string(filepath.Separator)
+	// do not overwrite the RR matrix of the reference run
+	cfg.SaveRR = ""
+	utils.Info("Verifying against ", snapshotFile, " with outputs in ", cfg.OutputPath)
+	stopProfiling := profiling.start(cfg.OutputPath)
+	defer stopProfiling()
+	stopTracing := utils.StartTracing("ptra verify", programMessage())
+	defer stopTracing()
+	exp, err := runPipeline(&cfg)
+	failures := compareSnapshots(&reference, takeSnapshot(exp, &cfg), tolerance)
+	if failures > 0 || err != nil {
+		if err != nil {
+			fmt.Printf("Verification failed: %v\n", err)
+		} else {
+			fmt.Printf("Verification failed: %d outputs differ more than the tolerance.\n", failures)
+		}
+		stopTracing()
+		stopProfiling()
+		os.Exit(1)
+	}
+	fmt.Println("Verification succeeded.")
+}